@@ -0,0 +1,109 @@
+// Command agent runs on each remote proxy server and applies the state the
+// central control plane assigns to that node.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/proxy-manager/controlplane/internal/agent"
+	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/config"
+	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/store"
+	"github.com/proxy-manager/controlplane/internal/wireguard"
+	"github.com/proxy-manager/controlplane/pkg/client"
+)
+
+// version is reported to the control plane; set with -ldflags "-X main.version=...".
+var version = "dev"
+
+func main() {
+	validateOnly := flag.Bool("validate-config", false, "load and validate the configuration, then exit")
+	flag.Parse()
+
+	cfg, err := config.LoadAgent()
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+	if *validateOnly {
+		fmt.Println("configuration is valid")
+		return
+	}
+
+	var logLevel slog.Level
+	switch cfg.LogLevel {
+	case "debug":
+		logLevel = slog.LevelDebug
+	case "warn":
+		logLevel = slog.LevelWarn
+	case "error":
+		logLevel = slog.LevelError
+	default:
+		logLevel = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})))
+
+	slog.Info("starting node agent",
+		"control_plane", cfg.ControlPlaneURL,
+		"sync_interval", cfg.SyncInterval,
+		"wg_interface", cfg.WGInterface,
+		"version", version,
+	)
+
+	cp, err := client.New(cfg.ControlPlaneURL, client.WithTLSFiles(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA))
+	if err != nil {
+		slog.Error("failed to configure control plane client", "error", err)
+		os.Exit(1)
+	}
+
+	// The node's desired state is kept in memory and fetched again at start
+	db, err := store.New(":memory:")
+	if err != nil {
+		slog.Error("failed to initialize local state", "error", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	caddyClient := caddy.NewHTTPClient(cfg.CaddyAdminSocket)
+	wgClient := wireguard.NewRealWGClient()
+	defer wgClient.Close()
+	wgManager := wireguard.NewManager(cfg.WGInterface, wgClient)
+
+	nftConn, err := firewall.NewRealNFTConn(cfg.WGInterface)
+	if err != nil {
+		slog.Error("failed to open nftables connection", "error", err)
+		os.Exit(1)
+	}
+	fwManager := firewall.NewManager(nftConn)
+	fwManager.SetReservedPorts(cfg.ReservedPorts)
+	if err := fwManager.Init(); err != nil {
+		slog.Warn("failed to initialize nftables chain (may require CAP_NET_ADMIN)", "error", err)
+	}
+
+	a := agent.New(cp, db, caddyClient, wgManager, fwManager, cfg.SyncInterval, cfg.Endpoint, version)
+	a.Reconciler().SetACMEIssuer(caddy.ACMEIssuer{Email: cfg.ACMEEmail, CA: cfg.ACMECA})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx)
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+
+	slog.Info("shutting down", "signal", sig)
+	cancel()
+	<-done // Let a reconciliation in progress finish
+	slog.Info("node agent stopped")
+}
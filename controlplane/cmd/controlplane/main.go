@@ -2,29 +2,59 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/proxy-manager/controlplane/internal/admission"
 	"github.com/proxy-manager/controlplane/internal/api"
+	"github.com/proxy-manager/controlplane/internal/audit"
+	"github.com/proxy-manager/controlplane/internal/autoban"
+	"github.com/proxy-manager/controlplane/internal/backup"
+	"github.com/proxy-manager/controlplane/internal/ca"
 	"github.com/proxy-manager/controlplane/internal/caddy"
 	"github.com/proxy-manager/controlplane/internal/config"
+	"github.com/proxy-manager/controlplane/internal/dns"
 	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/housekeeping"
+	"github.com/proxy-manager/controlplane/internal/leader"
+	"github.com/proxy-manager/controlplane/internal/notify"
+	"github.com/proxy-manager/controlplane/internal/probe"
 	"github.com/proxy-manager/controlplane/internal/reconciler"
+	"github.com/proxy-manager/controlplane/internal/sigv4"
+	"github.com/proxy-manager/controlplane/internal/sockstats"
 	"github.com/proxy-manager/controlplane/internal/store"
 	"github.com/proxy-manager/controlplane/internal/wireguard"
 )
 
+// version is reported by GET /api/v1/server; set with -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {
-	// Load configuration from environment
+	validateOnly := flag.Bool("validate-config", false, "load and validate the configuration, then exit")
+	restore := flag.Bool("restore", false, "download the newest backup snapshot to SQLITE_PATH, then exit")
+	restoreKey := flag.String("restore-key", "", "with -restore, the snapshot key to restore instead of the newest")
+	migrateDown := flag.Int("migrate-down", -1, "roll the database schema back to this version, then exit")
+	flag.Parse()
+
+	// Load configuration from environment and CONFIG_FILE
 	cfg, err := config.Load()
 	if err != nil {
 		slog.Error("failed to load config", "error", err)
 		os.Exit(1)
 	}
+	if *validateOnly {
+		fmt.Println("configuration is valid")
+		return
+	}
 
 	// Configure log level
 	var logLevel slog.Level
@@ -47,6 +77,20 @@ func main() {
 		"wg_interface", cfg.WGInterface,
 	)
 
+	if *restore {
+		if cfg.BackupS3Bucket == "" {
+			slog.Error("cannot restore: BACKUP_S3_BUCKET is not set")
+			os.Exit(1)
+		}
+		key, err := backup.Restore(context.Background(), newBackupS3(cfg), cfg.BackupS3Prefix, *restoreKey, cfg.SQLitePath)
+		if err != nil {
+			slog.Error("restore failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("database restored", "key", key, "path", cfg.SQLitePath)
+		return
+	}
+
 	// Initialize SQLite database
 	db, err := store.New(cfg.SQLitePath)
 	if err != nil {
@@ -55,20 +99,67 @@ func main() {
 	}
 	defer db.Close()
 
+	if *migrateDown >= 0 {
+		if err := db.MigrateDown(*migrateDown); err != nil {
+			slog.Error("schema rollback failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("database schema rolled back", "version", *migrateDown)
+		return
+	}
+
+	db.SetQueryTimeout(cfg.DBQueryTimeout)
 	tunnelStore := store.NewTunnelStore(db)
 	routeStore := store.NewRouteStore(db)
 	fwStore := store.NewFirewallStore(db)
+	tenantStore := store.NewTenantStore(db)
+	nodeStore := store.NewNodeStore(db)
 
 	// Initialize Caddy admin client
-	caddyClient := caddy.NewHTTPClient(cfg.CaddyAdminSocket)
+	var caddyClient *caddy.HTTPClient
+	if cfg.CaddyAdminURL != "" {
+		caddyClient, err = caddy.NewRemoteHTTPClient(caddy.RemoteConfig{
+			URL:      cfg.CaddyAdminURL,
+			Username: cfg.CaddyAdminUser,
+			Password: cfg.CaddyAdminPass,
+			CertFile: cfg.CaddyAdminCert,
+			KeyFile:  cfg.CaddyAdminKey,
+			CAFile:   cfg.CaddyAdminCA,
+		})
+		if err != nil {
+			slog.Error("failed to configure caddy admin client", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("using caddy admin API over TCP", "url", cfg.CaddyAdminURL)
+	} else {
+		caddyClient = caddy.NewHTTPClient(cfg.CaddyAdminSocket)
+	}
+	retryPolicy := caddy.DefaultRetryPolicy()
+	retryPolicy.MaxRetries = cfg.CaddyRetries
+	retryPolicy.BreakerThreshold = cfg.BreakerThreshold
+	retryPolicy.BreakerCooldown = cfg.BreakerCooldown
+	caddyClient.SetRetryPolicy(retryPolicy)
 
 	// Initialize WireGuard manager
 	wgClient := wireguard.NewRealWGClient()
+	defer wgClient.Close()
 	wgManager := wireguard.NewManager(cfg.WGInterface, wgClient)
 
 	// Initialize firewall manager
-	nftConn := firewall.NewRealNFTConn()
+	nftConn, err := firewall.NewRealNFTConn(cfg.WGInterface)
+	if err != nil {
+		slog.Error("failed to open nftables connection", "error", err)
+		os.Exit(1)
+	}
 	fwManager := firewall.NewManager(nftConn)
+	fwManager.SetReservedPorts(cfg.ReservedPorts)
+	fwManager.SetChainOptions(firewall.ChainOptions{
+		Policy:        cfg.FirewallPolicy,
+		ForwardPolicy: cfg.FirewallForwardPolicy,
+		Priority:      cfg.FirewallPriority,
+		Services:      managedServices(cfg),
+		Redirects:     wgRedirects(cfg),
+	})
 
 	// Initialize nftables dynamic chain
 	if err := fwManager.Init(); err != nil {
@@ -77,34 +168,193 @@ func main() {
 
 	// Initialize reconciler
 	rec := reconciler.New(tunnelStore, routeStore, fwStore, caddyClient, wgManager, fwManager, cfg.ReconcileInterval)
+	rec.SetSubsystemInterval(reconciler.SubsystemCaddy, cfg.ReconcileIntervalCaddy)
+	rec.SetSubsystemInterval(reconciler.SubsystemWireGuard, cfg.ReconcileIntervalWG)
+	rec.SetSubsystemInterval(reconciler.SubsystemFirewall, cfg.ReconcileIntervalFW)
+	rec.SetStatsInterval(cfg.ReconcileIntervalStats)
+	rec.SetMode(cfg.ReconcileMode)
+	rec.SetStatsRetention(cfg.StatsRetention)
+	if cfg.RouteStatsHistory > 0 {
+		rec.SetRouteStats(sockstats.Established, cfg.RouteStatsHistory)
+	}
+	rec.SetTunnelRetention(cfg.TunnelRetention)
+	rec.SetApprovalTTL(cfg.ApprovalTTL)
+	rec.SetInactivityWarning(cfg.InactivityWarning)
+	rec.SetPeerDefaults(cfg.WGKeepalive, cfg.ConnectedWindow)
+	for system, policy := range cfg.UnmanagedPolicy {
+		rec.SetUnmanagedPolicy(system, policy)
+	}
+	rec.SetServerEndpoint(cfg.ServerEndpoint)
+	rec.SetVPNNetwork(cfg.WGServerIP, cfg.WGSubnet)
+	rec.SetWGFallback(cfg.WGFallbackTransport, cfg.WGFallbackHost, cfg.WGFallbackPort, cfg.WGFallbackUpstream)
+	rec.SetACMEIssuer(caddy.ACMEIssuer{Email: cfg.ACMEEmail, CA: cfg.ACMECA})
+	rec.SetNodes(nodeStore)
+	// Restore routes as soon as Caddy is back instead of at the next interval
+	caddyClient.SetOnRecover(rec.ForceReconcile)
+	// API writes to Caddy are not edits for the watcher to undo
+	caddyClient.SetOnWrite(rec.CaddyWritten)
+	var notifier notify.Notifier
+	if len(cfg.WebhookURLs) > 0 {
+		notifier = notify.NewWebhookNotifier(cfg.WebhookURLs, cfg.WebhookSecret)
+		rec.SetNotifier(notifier)
+	}
 
 	// Create API server
-	srv := api.NewServer(cfg, tunnelStore, routeStore, fwStore, caddyClient, wgManager, fwManager, rec)
+	srv := api.NewServer(cfg, tunnelStore, routeStore, fwStore, tenantStore, nodeStore, caddyClient, wgManager, fwManager, rec)
+	if notifier != nil {
+		srv.SetNotifier(notifier)
+	}
+	srv.SetVersion(version)
+	if cfg.ValidateURL != "" {
+		srv.SetValidator(admission.NewWebhook(cfg.ValidateURL, cfg.ValidateSecret, cfg.ValidateTimeout, cfg.ValidateFailOpen))
+		slog.Info("validating changes with webhook", "url", cfg.ValidateURL, "fail_open", cfg.ValidateFailOpen)
+	}
+
+	if dnsUpdater := newDNSUpdater(cfg); dnsUpdater != nil {
+		srv.SetDNS(dnsUpdater)
+		rec.SetDNS(dnsUpdater)
+		slog.Info("managing DNS records", "provider", cfg.DNSProvider, "ipv4", cfg.DNSTargetIPv4, "ipv6", cfg.DNSTargetIPv6)
+	}
 
-	// Configure TLS
-	tlsConfig, err := api.NewTLSConfig(cfg)
+	auditSink, err := newAuditSink(cfg)
+	if err != nil {
+		slog.Error("failed to configure audit sinks", "error", err)
+		os.Exit(1)
+	}
+	if auditSink != nil {
+		srv.SetAuditSink(auditSink)
+		defer auditSink.Close()
+	}
+
+	// Configure TLS; renewed certificates are picked up without a restart
+	certReloader, err := api.NewCertReloader(cfg)
 	if err != nil {
 		slog.Error("failed to configure TLS", "error", err)
 		os.Exit(1)
 	}
 
+	// Issue API client certificates and refuse revoked ones in the handshake
+	if cfg.TLSClientCAKey != "" {
+		authority, err := ca.Load(cfg.TLSClientCA, cfg.TLSClientCAKey)
+		if err != nil {
+			slog.Error("failed to load client CA", "error", err)
+			os.Exit(1)
+		}
+		srv.SetCA(authority, store.NewCertStore(db))
+		if certReloader != nil {
+			certReloader.SetRevocationCheck(srv.CheckRevocation)
+		}
+		slog.Info("client certificate issuance enabled", "ca", cfg.TLSClientCA)
+	}
+
+	// Background work, including the reconciliation loop, runs until shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	httpServer := &http.Server{
 		Addr:         cfg.ListenAddr,
-		Handler:      srv.Handler(),
+		Handler:      srv.Handler(ctx),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
-	if tlsConfig != nil {
-		httpServer.TLSConfig = tlsConfig
+	if certReloader != nil {
+		httpServer.TLSConfig = certReloader.TLSConfig()
+		go certReloader.Watch(ctx, cfg.TLSReloadInterval)
 	}
 
-	// Start reconciliation loop in background
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// With a lease TTL, instances sharing the database elect one leader;
+	// the others serve reads and wait to take over
+	var elector *leader.Elector
+	if cfg.HALeaseTTL > 0 {
+		elector = leader.New(store.NewLeaseStore(db), cfg.HAInstanceID, cfg.HALeaseTTL)
+		elector.SetOnElected(rec.ForceReconcile)
+		rec.SetLeaderCheck(elector.IsLeader)
+		srv.SetElector(elector)
+		go elector.Run(ctx)
+		slog.Info("leader election enabled", "instance", cfg.HAInstanceID, "lease_ttl", cfg.HALeaseTTL)
+	}
+
+	// Adopt a hand-configured server's peers and routes before the first
+	// pass would remove them
+	if cfg.ImportOnStart {
+		res, err := rec.Import(ctx, false)
+		if err != nil {
+			slog.Error("failed to import existing state", "error", err)
+			os.Exit(1)
+		}
+		for _, s := range res.Skipped {
+			slog.Warn("not imported", "kind", s.Kind, "id", s.ID, "reason", s.Reason)
+		}
+	}
+
+	recDone := make(chan struct{})
+	go func() {
+		defer close(recDone)
+		rec.Run(ctx)
+	}()
+	if cfg.CaddyWatch > 0 {
+		go rec.WatchCaddy(ctx, cfg.CaddyWatch)
+	}
+
+	// Copy the database to S3 whenever it changes, so a rebuilt VPS can restore it
+	if cfg.BackupS3Bucket != "" {
+		replicator := backup.New(db, newBackupS3(cfg), cfg.BackupS3Prefix, cfg.BackupRetain)
+		if elector != nil {
+			replicator.SetLeaderCheck(elector.IsLeader)
+		}
+		srv.SetBackup(replicator)
+		go replicator.Run(ctx, cfg.BackupInterval)
+		slog.Info("database backups enabled", "bucket", cfg.BackupS3Bucket, "prefix", cfg.BackupS3Prefix, "interval", cfg.BackupInterval)
+	}
 
-	go rec.Run(ctx)
+	// Checkpoint the WAL, check for corruption, return freed pages to the OS,
+	// and prune old audit entries
+	keeper := housekeeping.New(db, housekeeping.Options{
+		CheckpointInterval: cfg.DBCheckpointInterval,
+		IntegrityInterval:  cfg.DBIntegrityInterval,
+		VacuumInterval:     cfg.DBVacuumInterval,
+		AuditRetention:     cfg.AuditRetention,
+		AuditArchiveDir:    cfg.AuditArchiveDir,
+	})
+	if elector != nil {
+		keeper.SetLeaderCheck(elector.IsLeader)
+	}
+	srv.SetHousekeeping(keeper)
+	go keeper.Run(ctx)
+
+	// Ban sources that flood Caddy's log with errors; tunnel peers are never banned
+	if cfg.BanLogFile != "" {
+		ignore := cfg.BanIgnore
+		if subnet, err := netip.ParsePrefix(cfg.WGSubnet); err == nil {
+			ignore = append(ignore, subnet)
+		}
+		banWatcher := autoban.New(fwStore, autoban.Options{
+			LogFile:   cfg.BanLogFile,
+			Threshold: cfg.BanThreshold,
+			Window:    cfg.BanWindow,
+			Duration:  cfg.BanDuration,
+			Ignore:    ignore,
+		})
+		banWatcher.SetOnBan(rec.ForceReconcile)
+		go banWatcher.Run(ctx)
+		slog.Info("automatic bans enabled", "log", cfg.BanLogFile, "threshold", cfg.BanThreshold, "window", cfg.BanWindow, "duration", cfg.BanDuration)
+	}
+
+	// Probe each peer's latency and loss, which handshakes alone don't show
+	if cfg.ProbeInterval > 0 {
+		prober := probe.New(tunnelStore, routeStore, probe.Options{
+			Method:  cfg.ProbeMethod,
+			Timeout: cfg.ProbeTimeout,
+			Window:  cfg.ProbeWindow,
+		})
+		if elector != nil {
+			prober.SetLeaderCheck(elector.IsLeader)
+		}
+		go prober.Run(ctx, cfg.ProbeInterval)
+		slog.Info("latency probing enabled", "method", cfg.ProbeMethod, "interval", cfg.ProbeInterval, "window", cfg.ProbeWindow)
+	}
 
 	// Start HTTP server
 	go func() {
@@ -128,7 +378,7 @@ func main() {
 	sig := <-quit
 
 	slog.Info("shutting down", "signal", sig)
-	cancel() // Stop reconciler
+	cancel() // Stop the reconciler and other background work
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
@@ -136,6 +386,102 @@ func main() {
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
 		slog.Error("HTTP server shutdown error", "error", err)
 	}
+	<-recDone   // Let a reconciliation in progress finish
+	srv.Close() // Let the rate limiters save their counters
 
 	slog.Info("control plane stopped")
 }
+
+// newAuditSink opens the configured copies of the audit log, or returns nil
+// if the audit log is kept only in SQLite.
+func newAuditSink(cfg *config.Config) (audit.Sink, error) {
+	var sinks audit.Multi
+	if cfg.AuditFile != "" {
+		f, err := audit.NewFileSink(cfg.AuditFile, cfg.AuditFileMaxBytes, cfg.AuditFileKeep)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, f)
+		slog.Info("copying audit log to file", "path", cfg.AuditFile)
+	}
+	if cfg.AuditSyslog != "" {
+		network, addr, _ := config.ParseSyslogTarget(cfg.AuditSyslog)
+		s, err := audit.NewSyslogSink(network, addr)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+		slog.Info("copying audit log to syslog", "target", cfg.AuditSyslog)
+	}
+	if cfg.AuditHTTPURL != "" {
+		sinks = append(sinks, audit.NewHTTPSink(cfg.AuditHTTPURL, cfg.AuditHTTPSecret))
+		slog.Info("forwarding audit log", "url", cfg.AuditHTTPURL)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
+
+// managedServices returns the ports the input chain keeps open under a drop
+// policy besides route listen ports: SSH, the API, WireGuard and its TCP
+// fallback, and HTTP for ACME challenges and redirects.
+func managedServices(cfg *config.Config) []firewall.Service {
+	services := []firewall.Service{{Name: "http", Proto: "tcp", Port: 80}}
+	if cfg.FirewallSSHPort > 0 {
+		services = append(services, firewall.Service{Name: "ssh", Proto: "tcp", Port: cfg.FirewallSSHPort})
+	}
+	if _, port, err := net.SplitHostPort(cfg.ListenAddr); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			services = append(services, firewall.Service{Name: "api", Proto: "tcp", Port: p})
+		}
+	}
+	if cfg.WGFallbackTransport != "" {
+		services = append(services, firewall.Service{Name: "wireguard-tcp", Proto: "tcp", Port: cfg.WGFallbackPort})
+	}
+	return append(services, firewall.Service{Name: "wireguard", Proto: "udp", Port: cfg.WGPort()})
+}
+
+// wgRedirects returns the redirects of WG_ALT_PORTS to the WireGuard port.
+func wgRedirects(cfg *config.Config) []firewall.Redirect {
+	var redirects []firewall.Redirect
+	for _, port := range cfg.WGAltPorts {
+		redirects = append(redirects, firewall.Redirect{Port: port, ToPort: cfg.WGPort()})
+	}
+	return redirects
+}
+
+// newBackupS3 builds the client for the backup bucket.
+func newBackupS3(cfg *config.Config) *backup.S3 {
+	return backup.NewS3(cfg.BackupS3Endpoint, cfg.BackupS3Region, cfg.BackupS3Bucket, sigv4.Credentials{
+		AccessKey:    cfg.BackupAccessKey,
+		SecretKey:    cfg.BackupSecretKey,
+		SessionToken: cfg.BackupSessionToken,
+	})
+}
+
+// newDNSUpdater builds the configured DNS provider, or returns nil if DNS
+// management is disabled.
+func newDNSUpdater(cfg *config.Config) *dns.Updater {
+	var provider dns.Provider
+	switch cfg.DNSProvider {
+	case "cloudflare":
+		provider = dns.NewCloudflare(cfg.CloudflareToken, cfg.CloudflareZoneID)
+	case "route53":
+		provider = dns.NewRoute53(cfg.Route53ZoneID, cfg.AWSAccessKeyID, cfg.AWSSecretKey, cfg.AWSSessionToken)
+	case "rfc2136":
+		provider = dns.NewRFC2136(cfg.RFC2136Server, cfg.RFC2136Zone, cfg.RFC2136KeyName, cfg.RFC2136Secret, cfg.RFC2136Algorithm)
+	default:
+		return nil
+	}
+	// Both parse: config validation checked them
+	var ipv4, ipv6 netip.Addr
+	if cfg.DNSTargetIPv4 != "" {
+		ipv4 = netip.MustParseAddr(cfg.DNSTargetIPv4).Unmap()
+	}
+	if cfg.DNSTargetIPv6 != "" {
+		ipv6 = netip.MustParseAddr(cfg.DNSTargetIPv6)
+	}
+	return dns.NewUpdater(provider, ipv4, ipv6, cfg.DNSTTL)
+}
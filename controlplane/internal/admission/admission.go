@@ -0,0 +1,128 @@
+// Package admission asks an operator-run webhook to approve tunnel and route
+// changes before the control plane commits them, so site policy (say, no
+// port forwards below 1024) can be enforced without patching the API.
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/notify"
+)
+
+// Operations sent in Request.Operation.
+const (
+	OperationCreate = "create"
+	OperationDelete = "delete"
+)
+
+// Request describes a proposed change. Object is the resource as the
+// caller asked for it on create, and as it is stored on delete.
+type Request struct {
+	Operation  string      `json:"operation"`
+	Kind       string      `json:"kind"` // "tunnel" or "route"
+	ResourceID string      `json:"resource_id,omitempty"`
+	TenantID   string      `json:"tenant_id,omitempty"`
+	ClientCN   string      `json:"client_cn,omitempty"`
+	Object     interface{} `json:"object"`
+	Time       time.Time   `json:"time"`
+}
+
+// Response is what the webhook answers. A denial's Reason is returned to
+// the API caller.
+type Response struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// DeniedError is returned by Validate when the webhook vetoes a change.
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Reason == "" {
+		return "denied by validation webhook"
+	}
+	return "denied by validation webhook: " + e.Reason
+}
+
+// maxResponseSize bounds how much of a webhook answer is read.
+const maxResponseSize = 64 << 10
+
+// Webhook POSTs each Request as JSON to an operator URL and expects a
+// Response with status 200. When secret is set, requests carry the same
+// HMAC signature header as event webhooks.
+type Webhook struct {
+	url        string
+	secret     []byte
+	failOpen   bool
+	httpClient *http.Client
+}
+
+// NewWebhook creates a validator for url. Requests time out after timeout;
+// when failOpen is set, a webhook that cannot be reached or answers badly
+// approves the change instead of blocking it.
+func NewWebhook(url, secret string, timeout time.Duration, failOpen bool) *Webhook {
+	return &Webhook{
+		url:        url,
+		secret:     []byte(secret),
+		failOpen:   failOpen,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// FailOpen reports whether changes are approved when the webhook fails.
+func (w *Webhook) FailOpen() bool {
+	return w.failOpen
+}
+
+// Validate asks the webhook about req. It returns a *DeniedError when the
+// change is vetoed and another error when no answer could be had, whatever
+// the fail-open setting; callers decide what to do with the latter.
+func (w *Webhook) Validate(ctx context.Context, req Request) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		httpReq.Header.Set(notify.SignatureHeader, "sha256="+notify.Sign(w.secret, body))
+	}
+
+	resp, err := w.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	var out Response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&out); err != nil {
+		return fmt.Errorf("decode webhook response: %w", err)
+	}
+	if !out.Allowed {
+		return &DeniedError{Reason: out.Reason}
+	}
+	return nil
+}
+
+// IsDenied reports whether err is a veto from the webhook, and its reason.
+func IsDenied(err error) (string, bool) {
+	var denied *DeniedError
+	if errors.As(err, &denied) {
+		return denied.Reason, true
+	}
+	return "", false
+}
@@ -0,0 +1,59 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/notify"
+)
+
+func TestWebhookValidate(t *testing.T) {
+	var got Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if want := "sha256=" + notify.Sign([]byte("s3cret"), body); r.Header.Get(notify.SignatureHeader) != want {
+			t.Errorf("signature mismatch: got %q want %q", r.Header.Get(notify.SignatureHeader), want)
+		}
+		json.Unmarshal(body, &got)
+		if got.Kind == "route" {
+			json.NewEncoder(w).Encode(Response{Allowed: false, Reason: "no port forwards below 1024"})
+			return
+		}
+		json.NewEncoder(w).Encode(Response{Allowed: true})
+	}))
+	defer srv.Close()
+
+	wh := NewWebhook(srv.URL, "s3cret", time.Second, false)
+	if err := wh.Validate(context.Background(), Request{Operation: OperationCreate, Kind: "tunnel", ResourceID: "tun_1"}); err != nil {
+		t.Fatalf("expected approval, got %v", err)
+	}
+	if got.Operation != OperationCreate || got.ResourceID != "tun_1" {
+		t.Errorf("unexpected request: %+v", got)
+	}
+
+	err := wh.Validate(context.Background(), Request{Operation: OperationCreate, Kind: "route"})
+	reason, denied := IsDenied(err)
+	if !denied || reason != "no port forwards below 1024" {
+		t.Errorf("expected denial with reason, got %v", err)
+	}
+}
+
+func TestWebhookValidateFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	err := NewWebhook(srv.URL, "", time.Second, true).Validate(context.Background(), Request{Kind: "tunnel"})
+	if err == nil {
+		t.Fatal("expected error from failing webhook")
+	}
+	if _, denied := IsDenied(err); denied {
+		t.Errorf("a failing webhook is not a denial: %v", err)
+	}
+}
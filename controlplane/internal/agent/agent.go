@@ -0,0 +1,298 @@
+// Package agent runs on a remote proxy server (a node) managed by a central
+// control plane. Each sync it fetches the node's desired state over mTLS,
+// mirrors it into a local store, applies it to Caddy, WireGuard, and
+// nftables with the same reconciler the control plane uses, and reports peer
+// stats and errors back.
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/reconciler"
+	"github.com/proxy-manager/controlplane/internal/store"
+	"github.com/proxy-manager/controlplane/internal/wireguard"
+	"github.com/proxy-manager/controlplane/pkg/client"
+)
+
+// Agent keeps one node in line with the control plane.
+type Agent struct {
+	cp        *client.Client
+	wgManager *wireguard.Manager
+	tunnels   *store.TunnelStore
+	routes    *store.RouteStore
+	fwStore   *store.FirewallStore
+	rec       *reconciler.Reconciler
+	interval  time.Duration
+	endpoint  string
+	version   string
+	logger    *slog.Logger
+}
+
+// New creates an Agent that mirrors the node's state into db, which should
+// be a private (e.g. in-memory) database, and syncs every interval. endpoint
+// overrides the node's public WireGuard endpoint when non-empty.
+func New(
+	cp *client.Client,
+	db *store.DB,
+	caddyClient caddy.Client,
+	wgManager *wireguard.Manager,
+	fwManager *firewall.Manager,
+	interval time.Duration,
+	endpoint, version string,
+) *Agent {
+	tunnels := store.NewTunnelStore(db)
+	routes := store.NewRouteStore(db)
+	fwStore := store.NewFirewallStore(db)
+	return &Agent{
+		cp:        cp,
+		wgManager: wgManager,
+		tunnels:   tunnels,
+		routes:    routes,
+		fwStore:   fwStore,
+		rec:       reconciler.New(tunnels, routes, fwStore, caddyClient, wgManager, fwManager, interval),
+		interval:  interval,
+		endpoint:  endpoint,
+		version:   version,
+		logger:    slog.Default(),
+	}
+}
+
+// Reconciler returns the reconciler applying the mirrored state, so callers
+// can configure it (e.g. the ACME issuer) before Run.
+func (a *Agent) Reconciler() *reconciler.Reconciler {
+	return a.rec
+}
+
+// Run registers the node, retrying until it succeeds, and then syncs every
+// interval until ctx is canceled.
+func (a *Agent) Run(ctx context.Context) {
+	for {
+		err := a.Register(ctx)
+		if err == nil {
+			break
+		}
+		a.logger.Error("failed to register with the control plane", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.interval):
+		}
+	}
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		if err := a.Sync(ctx); err != nil {
+			a.logger.Error("sync failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Register reports the node's WireGuard public key, endpoint, and agent
+// version to the control plane.
+func (a *Agent) Register(ctx context.Context) error {
+	pubKey, err := a.wgManager.GetServerPublicKey()
+	if err != nil {
+		return fmt.Errorf("read WireGuard public key: %w", err)
+	}
+	node, err := a.cp.RegisterNode(ctx, client.RegisterNodeRequest{
+		PublicKey: pubKey,
+		Endpoint:  a.endpoint,
+		Version:   a.version,
+	})
+	if err != nil {
+		return err
+	}
+	a.logger.Info("registered with the control plane", "node", node.ID, "name", node.Name, "endpoint", node.Endpoint)
+	return nil
+}
+
+// Sync fetches the desired state, applies it, and reports back. If the
+// control plane is unreachable the node keeps its last applied state.
+func (a *Agent) Sync(ctx context.Context) error {
+	state, err := a.cp.NodeState(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch state: %w", err)
+	}
+	if err := a.mirror(state); err != nil {
+		return err
+	}
+
+	a.rec.Reconcile(ctx)
+	applied := a.applyPSKs(state.Tunnels)
+
+	report := client.NodeReport{AppliedPSKs: applied}
+	if rs, err := a.fwStore.GetReconciliationState(); err == nil && rs.LastStatus == "error" {
+		report.Error = rs.LastError
+	}
+	peers, err := a.wgManager.ListPeers()
+	if err != nil {
+		report.Error = fmt.Sprintf("list WireGuard peers: %v", err)
+	}
+	for _, p := range peers {
+		stats := client.PeerStats{
+			PublicKey: p.PublicKey,
+			Endpoint:  p.Endpoint,
+			RxBytes:   p.ReceiveBytes,
+			TxBytes:   p.TransmitBytes,
+		}
+		if !p.LastHandshakeTime.IsZero() {
+			hs := p.LastHandshakeTime
+			stats.LastHandshake = &hs
+		}
+		report.Peers = append(report.Peers, stats)
+	}
+
+	// Unacknowledged PSKs stay pending and are applied again next sync
+	if err := a.cp.ReportNode(ctx, report); err != nil {
+		return fmt.Errorf("report: %w", err)
+	}
+	return nil
+}
+
+// mirror replaces the local store's contents with state. The agent is the
+// store's only writer and runs passes itself, so the reconciler never sees
+// it half-written.
+func (a *Agent) mirror(state *client.NodeState) error {
+	if err := a.clear(); err != nil {
+		return fmt.Errorf("clear local state: %w", err)
+	}
+
+	for _, t := range state.Tunnels {
+		// Source CIDRs and inactivity are enforced by the control plane from
+		// reported peer stats, and rotations are delivered as pending PSKs
+		keepalive, connectedThreshold := t.PersistentKeepalive, t.ConnectedThreshold
+		tunnel := &store.Tunnel{
+			ID:                  t.ID,
+			PublicKey:           t.PublicKey,
+			VpnIP:               t.VpnIP,
+			Domains:             t.Domains,
+			Enabled:             t.Enabled,
+			Labels:              t.Labels,
+			TenantID:            t.TenantID,
+			Isolate:             t.Isolate,
+			PersistentKeepalive: &keepalive,
+			ConnectedThreshold:  &connectedThreshold,
+			AdvertisedRoutes:    t.AdvertisedRoutes,
+		}
+		for _, p := range t.AllowedUpstreamPorts {
+			tunnel.AllowedUpstreamPorts = append(tunnel.AllowedUpstreamPorts, store.PortRange{Start: p.Start, End: max(p.Start, p.End)})
+		}
+		if err := a.tunnels.Create(tunnel); err != nil {
+			return err
+		}
+	}
+	for _, r := range state.Routes {
+		route := &store.Route{
+			ID:            r.ID,
+			TunnelID:      r.TunnelID,
+			ListenPort:    r.ListenPort,
+			ListenPortEnd: r.ListenPortEnd,
+			Protocol:      r.Protocol,
+			MatchType:     r.MatchType,
+			MatchValue:    r.MatchValue,
+			Upstream:      r.Upstream,
+			CaddyID:       r.CaddyID,
+			Enabled:       r.Enabled,
+			TenantID:      r.TenantID,
+			ProxyProtocol: r.ProxyProtocol,
+			QUIC:          r.QUIC,
+			Priority:      r.Priority,
+			TerminateTLS:  r.TerminateTLS,
+		}
+		if route.MatchValue == nil {
+			route.MatchValue = []string{}
+		}
+		// Routes created before SNI domains were unique may share one; the
+		// first in the state is served
+		if err := a.routes.Create(route); errors.Is(err, store.ErrDomainInUse) {
+			a.logger.Warn("skipping route whose domain another route already serves", "route", route.ID, "domains", route.MatchValue)
+		} else if err != nil {
+			return err
+		}
+	}
+	for _, r := range state.FirewallRules {
+		rule := &store.FirewallRule{
+			ID:         r.ID,
+			Port:       r.Port,
+			Proto:      r.Proto,
+			Chain:      r.Chain,
+			Direction:  r.Direction,
+			SourceCIDR: r.SourceCIDR,
+			DestCIDR:   r.DestCIDR,
+			Action:     r.Action,
+			Enabled:    r.Enabled,
+			TenantID:   r.TenantID,
+
+			ActiveHours: r.ActiveHours,
+			Description: r.Description,
+			Group:       r.Group,
+		}
+		if err := a.fwStore.Create(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clear deletes every tunnel, route, and firewall rule from the local store.
+func (a *Agent) clear() error {
+	routes, err := a.routes.List()
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if err := a.routes.Delete(r.ID); err != nil {
+			return err
+		}
+	}
+	tunnels, err := a.tunnels.List()
+	if err != nil {
+		return err
+	}
+	for _, t := range tunnels {
+		if err := a.tunnels.Delete(t.ID); err != nil {
+			return err
+		}
+	}
+	rules, err := a.fwStore.List()
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if err := a.fwStore.Delete(r.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPSKs sets the PSKs delivered for enabled tunnels on their kernel
+// peers, which the reconciler has just added, and returns them for
+// acknowledgement.
+func (a *Agent) applyPSKs(tunnels []client.NodeTunnel) []client.AppliedPSK {
+	var applied []client.AppliedPSK
+	for _, t := range tunnels {
+		if t.PresharedKey == "" || !t.Enabled {
+			continue
+		}
+		keepalive := time.Duration(t.PersistentKeepalive) * time.Second
+		if err := a.wgManager.AddPeer(t.PublicKey, t.PresharedKey, t.VpnIP, t.AdvertisedRoutes, keepalive); err != nil {
+			a.logger.Error("failed to apply preshared key", "tunnel", t.ID, "error", err)
+			continue
+		}
+		applied = append(applied, client.AppliedPSK{TunnelID: t.ID, PSKHash: wireguard.HashPSK(t.PresharedKey)})
+	}
+	return applied
+}
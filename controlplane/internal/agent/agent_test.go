@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/store"
+	"github.com/proxy-manager/controlplane/internal/wireguard"
+	"github.com/proxy-manager/controlplane/pkg/client"
+)
+
+// fakeControlPlane serves the agent endpoints from a fixed state and records
+// what the agent sends.
+type fakeControlPlane struct {
+	mu         sync.Mutex
+	state      client.NodeState
+	registered *client.RegisterNodeRequest
+	reports    []client.NodeReport
+}
+
+func (f *fakeControlPlane) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var data any
+	switch r.URL.Path {
+	case "/api/v1/agent/register":
+		var req client.RegisterNodeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.registered = &req
+		data = f.state.Node
+	case "/api/v1/agent/state":
+		data = f.state
+	case "/api/v1/agent/report":
+		var report client.NodeReport
+		json.NewDecoder(r.Body).Decode(&report)
+		f.reports = append(f.reports, report)
+		data = map[string]string{"status": "ok"}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+// stubCaddy implements caddy.Client, accepting every change.
+type stubCaddy struct {
+	routes []caddy.CaddyRoute
+}
+
+func (s *stubCaddy) GetL4Config(ctx context.Context) (*caddy.L4Config, error) {
+	return &caddy.L4Config{Servers: map[string]*caddy.L4Server{}}, nil
+}
+
+func (s *stubCaddy) AddRoute(ctx context.Context, route caddy.CaddyRoute) error {
+	s.routes = append(s.routes, route)
+	return nil
+}
+
+func (s *stubCaddy) UpdateRoute(ctx context.Context, route caddy.CaddyRoute) error {
+	for i := range s.routes {
+		if s.routes[i].ID == route.ID {
+			s.routes[i] = route
+		}
+	}
+	return nil
+}
+
+func (s *stubCaddy) ReplaceRoutes(ctx context.Context, routes []caddy.CaddyRoute) error {
+	s.routes = routes
+	return nil
+}
+
+func (s *stubCaddy) DeleteRoute(ctx context.Context, caddyID string) error { return nil }
+func (s *stubCaddy) CreateServer(ctx context.Context) error                { return nil }
+func (s *stubCaddy) CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID, proxyProtocol string) error {
+	return nil
+}
+func (s *stubCaddy) CreateQUICServer(ctx context.Context) error                     { return nil }
+func (s *stubCaddy) AddQUICRoute(ctx context.Context, route caddy.CaddyRoute) error { return nil }
+func (s *stubCaddy) DeleteServer(ctx context.Context, serverName string) error      { return nil }
+func (s *stubCaddy) SyncManagedCertificates(ctx context.Context, subjects []string, issuer caddy.ACMEIssuer) (bool, error) {
+	return false, nil
+}
+func (s *stubCaddy) CheckManagedCertificates(ctx context.Context, subjects []string, issuer caddy.ACMEIssuer) (bool, error) {
+	return false, nil
+}
+
+// stubWG implements wireguard.WGClient in memory.
+type stubWG struct {
+	peers map[string]wireguard.PeerInfo
+	psks  map[string]string
+}
+
+func (s *stubWG) AddPeer(iface string, pubkey, psk, vpnIP string, routes []string, keepalive time.Duration) error {
+	s.peers[pubkey] = wireguard.PeerInfo{PublicKey: pubkey, AllowedIPs: wireguard.PeerAllowedIPs(vpnIP, routes), Keepalive: keepalive}
+	if psk != "" {
+		s.psks[pubkey] = psk
+	}
+	return nil
+}
+
+func (s *stubWG) RemovePeer(iface string, pubkey string) error {
+	delete(s.peers, pubkey)
+	return nil
+}
+
+func (s *stubWG) ApplyPeers(iface string, peers []wireguard.PeerConfig) error {
+	for _, p := range peers {
+		var err error
+		if p.Remove {
+			err = s.RemovePeer(iface, p.PublicKey)
+		} else {
+			err = s.AddPeer(iface, p.PublicKey, p.PSK, p.VpnIP, p.Routes, p.Keepalive)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *stubWG) HostPrefixes(iface string) ([]netip.Prefix, error) { return nil, nil }
+
+func (s *stubWG) GetDevice(iface string) (*wireguard.DeviceInfo, error) {
+	var peers []wireguard.PeerInfo
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	return &wireguard.DeviceInfo{PublicKey: "node-key=", ListenPort: 51820, Peers: peers}, nil
+}
+
+// stubNFT implements firewall.NFTConn in memory.
+type stubNFT struct {
+	rules map[string]firewall.Rule
+}
+
+func (s *stubNFT) Init(firewall.ChainOptions) error     { return nil }
+func (s *stubNFT) AddRule(rule firewall.Rule) error     { s.rules[rule.ID] = rule; return nil }
+func (s *stubNFT) DeleteRule(id string) error           { delete(s.rules, id); return nil }
+func (s *stubNFT) ReplaceRule(rule firewall.Rule) error { s.rules[rule.ID] = rule; return nil }
+func (s *stubNFT) AddBan(ip string) error               { return nil }
+func (s *stubNFT) DeleteBan(ip string) error            { return nil }
+func (s *stubNFT) ListBans() ([]string, error)          { return nil, nil }
+func (s *stubNFT) AddIsolation(ip string) error         { return nil }
+func (s *stubNFT) DeleteIsolation(ip string) error      { return nil }
+func (s *stubNFT) ListIsolated() ([]string, error)      { return nil, nil }
+func (s *stubNFT) ListRules() ([]firewall.Rule, error) {
+	var rules []firewall.Rule
+	for _, r := range s.rules {
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (s *stubNFT) RestrictUpstream(firewall.UpstreamRestriction) error  { return nil }
+func (s *stubNFT) DeleteUpstreamRestriction(ip string) error            { return nil }
+func (s *stubNFT) ListUpstreamRestrictions() (map[string]string, error) { return nil, nil }
+
+func (s *stubNFT) AddRouteCounter(c firewall.RouteCounter) error       { return nil }
+func (s *stubNFT) DeleteRouteCounter(key string) error                 { return nil }
+func (s *stubNFT) ListRouteCounters() ([]firewall.RouteCounter, error) { return nil, nil }
+func (s *stubNFT) AddService(firewall.Service) error                   { return nil }
+func (s *stubNFT) DeleteService(name string) error                     { return nil }
+func (s *stubNFT) ListServices() ([]firewall.Service, error)           { return nil, nil }
+
+func TestRegisterAndSync(t *testing.T) {
+	psk := "cHNrcHNrcHNrcHNrcHNrcHNrcHNrcHNrcHNrcHNrcHM="
+	fake := &fakeControlPlane{state: client.NodeState{
+		Node: client.Node{ID: "node_1", Name: "edge-1"},
+		Tunnels: []client.NodeTunnel{{
+			Tunnel: client.Tunnel{
+				ID: "tun_1", PublicKey: "client-key=", VpnIP: "10.0.0.2",
+				Domains: []string{"app.example.com"}, Enabled: true, NodeID: "node_1",
+				PersistentKeepalive: 40,
+			},
+			PresharedKey: psk,
+		}},
+		Routes: []client.Route{{
+			ID: "route_1", TunnelID: "tun_1", ListenPort: 443, Protocol: "tcp",
+			MatchType: "sni", MatchValue: []string{"app.example.com"},
+			Upstream: "10.0.0.2:443", CaddyID: "route-route_1", Enabled: true,
+		}},
+		FirewallRules: []client.FirewallRule{{
+			ID: "fw_1", Port: 8443, Proto: "tcp", Chain: "input", Direction: "in",
+			SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true,
+		}},
+	}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	cp, err := client.New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := store.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	caddyClient := &stubCaddy{}
+	wg := &stubWG{peers: map[string]wireguard.PeerInfo{}, psks: map[string]string{}}
+	nft := &stubNFT{rules: map[string]firewall.Rule{}}
+	a := New(cp, db, caddyClient, wireguard.NewManager("wg0", wg), firewall.NewManager(nft),
+		time.Minute, "203.0.113.9:51820", "1.2.3")
+	ctx := context.Background()
+
+	if err := a.Register(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if fake.registered == nil || fake.registered.PublicKey != "node-key=" ||
+		fake.registered.Endpoint != "203.0.113.9:51820" || fake.registered.Version != "1.2.3" {
+		t.Fatalf("unexpected registration: %+v", fake.registered)
+	}
+
+	if err := a.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if peer, ok := wg.peers["client-key="]; !ok {
+		t.Error("expected the tunnel's peer to be added")
+	} else if peer.Keepalive != 40*time.Second {
+		t.Errorf("expected the tunnel's keepalive to be applied, got %s", peer.Keepalive)
+	}
+	if wg.psks["client-key="] != psk {
+		t.Errorf("expected the delivered PSK to be applied, got %q", wg.psks["client-key="])
+	}
+	if _, ok := nft.rules["fw_1"]; !ok {
+		t.Error("expected the firewall rule to be applied")
+	}
+	if len(caddyClient.routes) == 0 {
+		t.Error("expected the route to be applied to Caddy")
+	}
+
+	if len(fake.reports) != 1 {
+		t.Fatalf("expected 1 report, got %d", len(fake.reports))
+	}
+	report := fake.reports[0]
+	if len(report.AppliedPSKs) != 1 || report.AppliedPSKs[0].TunnelID != "tun_1" ||
+		report.AppliedPSKs[0].PSKHash != wireguard.HashPSK(psk) {
+		t.Errorf("expected the PSK to be acknowledged by hash, got %+v", report.AppliedPSKs)
+	}
+	if len(report.Peers) != 1 || report.Peers[0].PublicKey != "client-key=" {
+		t.Errorf("expected the peer to be reported, got %+v", report.Peers)
+	}
+
+	// The tunnel moved away: the next sync drops its peer
+	fake.mu.Lock()
+	fake.state.Tunnels = nil
+	fake.state.Routes = nil
+	fake.mu.Unlock()
+	if err := a.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := wg.peers["client-key="]; ok {
+		t.Error("expected the removed tunnel's peer to be dropped")
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/admission"
+)
+
+// SetValidator makes tunnel and route creates and deletes wait for the
+// approval of an operator webhook before anything is changed.
+func (s *Server) SetValidator(v *admission.Webhook) {
+	s.validator = v
+}
+
+// admit asks the validation webhook whether the caller may apply op to the
+// kind resource id. It writes the error response and returns false when the
+// change is vetoed, or when the webhook cannot be reached and fail-open is
+// off. Handlers call it after their own checks and before the first change,
+// so a veto leaves nothing to undo.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request, op, kind, id, tenantID string, object interface{}) bool {
+	if s.validator == nil {
+		return true
+	}
+	err := s.validator.Validate(r.Context(), admission.Request{
+		Operation:  op,
+		Kind:       kind,
+		ResourceID: id,
+		TenantID:   tenantID,
+		ClientCN:   identityFrom(r.Context()).ClientCN,
+		Object:     object,
+		Time:       time.Now().UTC(),
+	})
+	if err == nil {
+		return true
+	}
+	if _, denied := admission.IsDenied(err); denied {
+		writeError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	if s.validator.FailOpen() {
+		slog.Warn("validation webhook failed, allowing change", "operation", op, "kind", kind, "id", id, "error", err)
+		return true
+	}
+	slog.Warn("validation webhook failed, rejecting change", "operation", op, "kind", kind, "id", id, "error", err)
+	writeError(w, http.StatusServiceUnavailable, "validation webhook unavailable")
+	return false
+}
@@ -3,35 +3,70 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/proxy-manager/controlplane/internal/admission"
+	"github.com/proxy-manager/controlplane/internal/backup"
+	"github.com/proxy-manager/controlplane/internal/ca"
 	"github.com/proxy-manager/controlplane/internal/caddy"
 	"github.com/proxy-manager/controlplane/internal/config"
+	"github.com/proxy-manager/controlplane/internal/dns"
 	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/housekeeping"
+	"github.com/proxy-manager/controlplane/internal/leader"
+	"github.com/proxy-manager/controlplane/internal/notify"
+	"github.com/proxy-manager/controlplane/internal/reconciler"
+	"github.com/proxy-manager/controlplane/internal/sigv4"
 	"github.com/proxy-manager/controlplane/internal/store"
 	"github.com/proxy-manager/controlplane/internal/wireguard"
+	"gopkg.in/yaml.v3"
 )
 
 // --- Mock implementations ---
 
 type mockCaddyClient struct {
-	routes  []caddy.CaddyRoute
-	addErr  error
-	delErr  error
-	getErr  error
+	routes     []caddy.CaddyRoute
+	quicRoutes []caddy.CaddyRoute
+	deletedIDs []string
+	pfServers  []string
+	addErr     error
+	delErr     error
+	getErr     error
 }
 
 func (m *mockCaddyClient) GetL4Config(ctx context.Context) (*caddy.L4Config, error) {
 	if m.getErr != nil {
 		return nil, m.getErr
 	}
-	return &caddy.L4Config{Servers: map[string]*caddy.L4Server{}}, nil
+	servers := map[string]*caddy.L4Server{}
+	if len(m.routes) > 0 {
+		servers["proxy"] = &caddy.L4Server{Routes: m.routes}
+	}
+	for _, pf := range m.pfServers {
+		servers[strings.Fields(pf)[0]] = &caddy.L4Server{}
+	}
+	return &caddy.L4Config{Servers: servers}, nil
 }
 
 func (m *mockCaddyClient) AddRoute(ctx context.Context, route caddy.CaddyRoute) error {
@@ -42,36 +77,78 @@ func (m *mockCaddyClient) AddRoute(ctx context.Context, route caddy.CaddyRoute)
 	return nil
 }
 
+func (m *mockCaddyClient) UpdateRoute(ctx context.Context, route caddy.CaddyRoute) error {
+	for i := range m.routes {
+		if m.routes[i].ID == route.ID {
+			m.routes[i] = route
+		}
+	}
+	return nil
+}
+
+func (m *mockCaddyClient) ReplaceRoutes(ctx context.Context, routes []caddy.CaddyRoute) error {
+	m.routes = routes
+	return nil
+}
+
 func (m *mockCaddyClient) DeleteRoute(ctx context.Context, caddyID string) error {
-	return m.delErr
+	if m.delErr != nil {
+		return m.delErr
+	}
+	m.deletedIDs = append(m.deletedIDs, caddyID)
+	return nil
 }
 
 func (m *mockCaddyClient) CreateServer(ctx context.Context) error {
 	return nil
 }
 
-func (m *mockCaddyClient) CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID string) error {
+func (m *mockCaddyClient) CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID, proxyProtocol string) error {
+	m.pfServers = append(m.pfServers, serverName+" "+upstream)
+	return nil
+}
+
+func (m *mockCaddyClient) CreateQUICServer(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockCaddyClient) AddQUICRoute(ctx context.Context, route caddy.CaddyRoute) error {
+	if m.addErr != nil {
+		return m.addErr
+	}
+	m.quicRoutes = append(m.quicRoutes, route)
 	return nil
 }
 
 func (m *mockCaddyClient) DeleteServer(ctx context.Context, serverName string) error {
+	m.deletedIDs = append(m.deletedIDs, serverName)
 	return nil
 }
 
+func (m *mockCaddyClient) SyncManagedCertificates(ctx context.Context, subjects []string, issuer caddy.ACMEIssuer) (bool, error) {
+	return false, nil
+}
+
+func (m *mockCaddyClient) CheckManagedCertificates(ctx context.Context, subjects []string, issuer caddy.ACMEIssuer) (bool, error) {
+	return false, nil
+}
+
 type mockWGClient struct {
 	peers     map[string]wireguard.PeerInfo
 	publicKey string
+	host      []netip.Prefix // networks HostPrefixes reports
 }
 
 func newMockWGClient() *mockWGClient {
 	return &mockWGClient{
 		peers:     make(map[string]wireguard.PeerInfo),
 		publicKey: "c2VydmVyLXB1Yi1rZXktMzItYnl0ZXMtaGVyZQ==",
+		host:      []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
 	}
 }
 
-func (m *mockWGClient) AddPeer(iface string, pubkey, psk, vpnIP string) error {
-	m.peers[pubkey] = wireguard.PeerInfo{PublicKey: pubkey, AllowedIPs: []string{vpnIP + "/32"}}
+func (m *mockWGClient) AddPeer(iface string, pubkey, psk, vpnIP string, routes []string, keepalive time.Duration) error {
+	m.peers[pubkey] = wireguard.PeerInfo{PublicKey: pubkey, AllowedIPs: wireguard.PeerAllowedIPs(vpnIP, routes), Keepalive: keepalive}
 	return nil
 }
 
@@ -80,23 +157,46 @@ func (m *mockWGClient) RemovePeer(iface string, pubkey string) error {
 	return nil
 }
 
+func (m *mockWGClient) ApplyPeers(iface string, peers []wireguard.PeerConfig) error {
+	for _, p := range peers {
+		var err error
+		if p.Remove {
+			err = m.RemovePeer(iface, p.PublicKey)
+		} else {
+			err = m.AddPeer(iface, p.PublicKey, p.PSK, p.VpnIP, p.Routes, p.Keepalive)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockWGClient) HostPrefixes(iface string) ([]netip.Prefix, error) { return m.host, nil }
+
 func (m *mockWGClient) GetDevice(iface string) (*wireguard.DeviceInfo, error) {
 	var peers []wireguard.PeerInfo
 	for _, p := range m.peers {
 		peers = append(peers, p)
 	}
-	return &wireguard.DeviceInfo{PublicKey: m.publicKey, ListenPort: 51820, Peers: peers}, nil
+	return &wireguard.DeviceInfo{PublicKey: m.publicKey, ListenPort: 51820, MTU: 1420, Peers: peers}, nil
 }
 
 type mockNFTConn struct {
-	rules map[string]firewall.Rule
+	replaceErr error
+
+	rules    map[string]firewall.Rule
+	bans     map[string]bool
+	isolated map[string]bool
+	counters map[string]firewall.RouteCounter
+	upstream map[string]firewall.UpstreamRestriction
 }
 
 func newMockNFTConn() *mockNFTConn {
 	return &mockNFTConn{rules: make(map[string]firewall.Rule)}
 }
 
-func (m *mockNFTConn) Init() error { return nil }
+func (m *mockNFTConn) Init(firewall.ChainOptions) error { return nil }
 
 func (m *mockNFTConn) AddRule(rule firewall.Rule) error {
 	m.rules[rule.ID] = rule
@@ -108,6 +208,102 @@ func (m *mockNFTConn) DeleteRule(id string) error {
 	return nil
 }
 
+func (m *mockNFTConn) ReplaceRule(rule firewall.Rule) error {
+	if m.replaceErr != nil {
+		return m.replaceErr
+	}
+	m.rules[rule.ID] = rule
+	return nil
+}
+
+func (m *mockNFTConn) AddBan(ip string) error {
+	if m.bans == nil {
+		m.bans = make(map[string]bool)
+	}
+	m.bans[ip] = true
+	return nil
+}
+
+func (m *mockNFTConn) DeleteBan(ip string) error {
+	delete(m.bans, ip)
+	return nil
+}
+
+func (m *mockNFTConn) ListBans() ([]string, error) {
+	var ips []string
+	for ip := range m.bans {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (m *mockNFTConn) AddIsolation(ip string) error {
+	if m.isolated == nil {
+		m.isolated = make(map[string]bool)
+	}
+	m.isolated[ip] = true
+	return nil
+}
+
+func (m *mockNFTConn) DeleteIsolation(ip string) error {
+	delete(m.isolated, ip)
+	return nil
+}
+
+func (m *mockNFTConn) ListIsolated() ([]string, error) {
+	var ips []string
+	for ip := range m.isolated {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (m *mockNFTConn) RestrictUpstream(r firewall.UpstreamRestriction) error {
+	if m.upstream == nil {
+		m.upstream = make(map[string]firewall.UpstreamRestriction)
+	}
+	m.upstream[r.IP] = r
+	return nil
+}
+
+func (m *mockNFTConn) DeleteUpstreamRestriction(ip string) error {
+	delete(m.upstream, ip)
+	return nil
+}
+
+func (m *mockNFTConn) ListUpstreamRestrictions() (map[string]string, error) {
+	digests := map[string]string{}
+	for ip, r := range m.upstream {
+		digests[ip] = r.Digest()
+	}
+	return digests, nil
+}
+
+func (m *mockNFTConn) AddRouteCounter(c firewall.RouteCounter) error {
+	if m.counters == nil {
+		m.counters = make(map[string]firewall.RouteCounter)
+	}
+	m.counters[c.Key()] = c
+	return nil
+}
+
+func (m *mockNFTConn) DeleteRouteCounter(key string) error {
+	delete(m.counters, key)
+	return nil
+}
+
+func (m *mockNFTConn) AddService(firewall.Service) error         { return nil }
+func (m *mockNFTConn) DeleteService(name string) error           { return nil }
+func (m *mockNFTConn) ListServices() ([]firewall.Service, error) { return nil, nil }
+
+func (m *mockNFTConn) ListRouteCounters() ([]firewall.RouteCounter, error) {
+	var counters []firewall.RouteCounter
+	for _, c := range m.counters {
+		counters = append(counters, c)
+	}
+	return counters, nil
+}
+
 func (m *mockNFTConn) ListRules() ([]firewall.Rule, error) {
 	var rules []firewall.Rule
 	for _, r := range m.rules {
@@ -128,29 +324,50 @@ func setupTestServer(t *testing.T) (*Server, *store.DB) {
 	t.Cleanup(func() { db.Close() })
 
 	cfg := &config.Config{
-		ListenAddr:     ":7443",
-		WGInterface:    "wg0",
-		WGSubnet:       "10.0.0.0/24",
-		WGServerIP:     "10.0.0.1",
-		ServerEndpoint: "203.0.113.1:51820",
+		ListenAddr:      ":7443",
+		WGInterface:     "wg0",
+		WGSubnet:        "10.0.0.0/24",
+		WGServerIP:      "10.0.0.1",
+		ServerEndpoint:  "203.0.113.1:51820",
+		ReservedPorts:   map[int]bool{22: true, 2019: true, 7443: true, 51820: true},
+		WGKeepalive:     25 * time.Second,
+		ConnectedWindow: 5 * time.Minute,
+		RateLimitRead:   300,
+		RateLimitMutate: 100,
+		KeyEscrow:       15 * time.Minute,
 	}
 
 	tunnelStore := store.NewTunnelStore(db)
 	routeStore := store.NewRouteStore(db)
 	fwStore := store.NewFirewallStore(db)
+	tenantStore := store.NewTenantStore(db)
+	nodeStore := store.NewNodeStore(db)
 
 	mockWG := newMockWGClient()
 	wgMgr := wireguard.NewManager("wg0", mockWG)
 
 	mockNFT := newMockNFTConn()
 	fwMgr := firewall.NewManager(mockNFT)
+	fwMgr.SetReservedPorts(cfg.ReservedPorts)
 
 	mockCaddy := &mockCaddyClient{}
 
-	srv := NewServer(cfg, tunnelStore, routeStore, fwStore, mockCaddy, wgMgr, fwMgr, nil)
+	srv := NewServer(cfg, tunnelStore, routeStore, fwStore, tenantStore, nodeStore, mockCaddy, wgMgr, fwMgr, nil)
 	return srv, db
 }
 
+// testHandler returns srv's full middleware chain, stopping its background
+// work when the test ends.
+func testHandler(t *testing.T, srv *Server) http.Handler {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		srv.Close()
+	})
+	return srv.Handler(ctx)
+}
+
 func doRequest(srv *Server, method, path string, body interface{}) *httptest.ResponseRecorder {
 	var bodyReader io.Reader
 	if body != nil {
@@ -166,6 +383,28 @@ func doRequest(srv *Server, method, path string, body interface{}) *httptest.Res
 	return rr
 }
 
+// doRequestAs issues a request authenticated with an mTLS client CN ("cn:<name>")
+// or a bearer token (any other non-empty value).
+func doRequestAs(srv *Server, who, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var bodyReader io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		bodyReader = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, bodyReader)
+	if cert, ok := strings.CutPrefix(who, "cn:"); ok {
+		// "cn:<name>,ou:<unit>,ou:<unit>" presents a client certificate
+		parts := strings.Split(cert, ",ou:")
+		subject := pkix.Name{CommonName: parts[0], OrganizationalUnit: parts[1:]}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: subject}}}
+	} else if who != "" {
+		req.Header.Set("Authorization", "Bearer "+who)
+	}
+	rr := httptest.NewRecorder()
+	srv.mux.ServeHTTP(rr, req)
+	return rr
+}
+
 func parseJSON(t *testing.T, rr *httptest.ResponseRecorder) map[string]interface{} {
 	t.Helper()
 	var result map[string]interface{}
@@ -191,6 +430,65 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 }
 
+func TestReadyEndpoint(t *testing.T) {
+	srv, db := setupTestServer(t)
+
+	rr := doRequestAs(srv, "", "GET", "/api/v1/health/ready", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if body := parseJSON(t, rr); body["status"] != "ready" {
+		t.Errorf("expected ready, got %v", body["status"])
+	}
+
+	srv.caddyClient.(*mockCaddyClient).getErr = fmt.Errorf("dial unix /run/caddy/admin.sock: no such file")
+	db.Close()
+	rr = doRequestAs(srv, "", "GET", "/api/v1/health/ready", nil)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", rr.Code, rr.Body.String())
+	}
+	body := parseJSON(t, rr)
+	checks := body["checks"].(map[string]interface{})
+	for name, wantOK := range map[string]bool{"sqlite": false, "caddy": false, "wireguard": true, "nftables": true} {
+		check := checks[name].(map[string]interface{})
+		if check["ok"] != wantOK {
+			t.Errorf("%s: expected ok=%v, got %v", name, wantOK, check)
+		}
+		if _, ok := check["error"]; ok {
+			t.Errorf("%s: expected no error detail on an unauthenticated endpoint, got %v", name, check)
+		}
+	}
+}
+
+func TestBackupSnapshot(t *testing.T) {
+	srv, db := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/backup/snapshot", nil)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without backups configured, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var uploaded []string
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			uploaded = append(uploaded, r.URL.Path)
+		}
+		io.WriteString(w, "<ListBucketResult></ListBucketResult>")
+	}))
+	defer s3.Close()
+	client := backup.NewS3(s3.URL, "us-east-1", "bucket", sigv4.Credentials{AccessKey: "AKID", SecretKey: "secret"})
+	srv.SetBackup(backup.New(db, client, "pm", 0))
+
+	rr = doRequest(srv, "POST", "/api/v1/backup/snapshot", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["uploaded"] != true || len(uploaded) != 1 || uploaded[0] != "/bucket/"+data["key"].(string) {
+		t.Errorf("expected one upload matching %v, got %v", data, uploaded)
+	}
+}
+
 // --- Server pubkey tests ---
 
 func TestGetServerPubkey(t *testing.T) {
@@ -207,6 +505,31 @@ func TestGetServerPubkey(t *testing.T) {
 	}
 }
 
+func TestGetServer(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.SetVersion("1.2.3")
+	rr := doRequest(srv, "GET", "/api/v1/server", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	want := map[string]interface{}{
+		"public_key":  "c2VydmVyLXB1Yi1rZXktMzItYnl0ZXMtaGVyZQ==",
+		"listen_port": float64(51820),
+		"endpoint":    "203.0.113.1:51820",
+		"wg_subnet":   "10.0.0.0/24",
+		"server_ip":   "10.0.0.1",
+		"mtu":         float64(1420),
+		"version":     "1.2.3",
+	}
+	for key, value := range want {
+		if data[key] != value {
+			t.Errorf("%s = %v, want %v", key, data[key], value)
+		}
+	}
+}
+
 // --- Tunnel endpoint tests ---
 
 func TestCreateTunnelFlowA(t *testing.T) {
@@ -334,8 +657,18 @@ func TestDeleteTunnel(t *testing.T) {
 	body := parseJSON(t, rr)
 	tunnelID := body["id"].(string)
 
-	// Delete
+	// The tunnel's route must be confirmed
 	rr = doRequest(srv, "DELETE", "/api/v1/tunnels/"+tunnelID, nil)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 without force, got %d: %s", rr.Code, rr.Body.String())
+	}
+	deps := parseJSON(t, rr)["dependents"].(map[string]interface{})
+	if routes := deps["routes"].([]interface{}); len(routes) != 1 {
+		t.Errorf("expected the route to be listed, got %v", deps)
+	}
+
+	// Delete
+	rr = doRequest(srv, "DELETE", "/api/v1/tunnels/"+tunnelID+"?force=true", nil)
 	if rr.Code != http.StatusNoContent {
 		t.Errorf("expected 204, got %d: %s", rr.Code, rr.Body.String())
 	}
@@ -374,6 +707,107 @@ func TestGetTunnelConfig(t *testing.T) {
 	if rr.Header().Get("Content-Type") != "text/plain" {
 		t.Errorf("expected text/plain, got %s", rr.Header().Get("Content-Type"))
 	}
+
+	// Other client platforms
+	rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/config?format=mikrotik&interface=wg-vps", tunnelID), nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/interface wireguard add name=wg-vps") {
+		t.Errorf("expected a RouterOS script, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Disposition"); !strings.HasSuffix(got, ".rsc") {
+		t.Errorf("expected an .rsc download, got %q", got)
+	}
+	for _, query := range []string{"format=openvpn", "interface=far-too-long-a-name"} {
+		rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/config?%s", tunnelID, query), nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rr.Code)
+		}
+	}
+}
+
+func TestGetTunnelConfigTCPFallback(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains": []string{"a.com"}, "upstream_port": 443,
+	})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+	path := fmt.Sprintf("/api/v1/tunnels/%s/config?transport=tcp", tunnelID)
+
+	// Without a fallback, TCP configs are refused
+	rr = doRequest(srv, "GET", path, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a fallback, got %d", rr.Code)
+	}
+
+	srv.cfg.WGFallbackTransport, srv.cfg.WGFallbackHost, srv.cfg.WGFallbackPort = "wstunnel", "wg.example.com", 443
+	rr = doRequest(srv, "GET", path, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	config := rr.Body.String()
+	for _, want := range []string{"# wstunnel client -L 'udp://127.0.0.1:51820:127.0.0.1:51820?timeout_sec=0' wss://wg.example.com:443\n", "MTU = 1280\n", "Endpoint = 127.0.0.1:51820\n"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("expected %q in config, got:\n%s", want, config)
+		}
+	}
+
+	for _, query := range []string{"transport=tcp&routing=full", "transport=quic"} {
+		rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/config?%s", tunnelID, query), nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rr.Code)
+		}
+	}
+
+	// The fallback's host is taken like a route's domain
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains": []string{"wg.example.com"}, "upstream_port": 443,
+	})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for the fallback's host, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestGetTunnelConfigAltPorts(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.WGAltPorts = []int{443, 4500}
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains": []string{"a.com"}, "upstream_port": 443,
+	})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/config", tunnelID), nil)
+	want := "# If 203.0.113.1:51820 is blocked, use one of: 203.0.113.1:443, 203.0.113.1:4500\n"
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("expected %q in config, got %d:\n%s", want, rr.Code, rr.Body.String())
+	}
+
+	rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/config?port=443", tunnelID), nil)
+	config := rr.Body.String()
+	for _, want := range []string{"Endpoint = 203.0.113.1:443\n", "use one of: 203.0.113.1:51820, 203.0.113.1:4500\n"} {
+		if !strings.Contains(config, want) {
+			t.Errorf("expected %q in config, got:\n%s", want, config)
+		}
+	}
+	rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/config?port=8443", tunnelID), nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a port the server does not listen on, got %d", rr.Code)
+	}
+
+	// UDP/443 belongs to WireGuard, so QUIC routes are refused
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "sni", "match_value": []string{"b.com"}, "upstream_port": 443, "quic": true,
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a quic route, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "port_forward", "listen_port": 4000, "listen_port_end": 5000,
+		"upstream_port": 4000, "protocol": "udp",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a range covering 4500/udp, got %d: %s", rr.Code, rr.Body.String())
+	}
 }
 
 func TestGetTunnelConfigNotFound(t *testing.T) {
@@ -386,7 +820,7 @@ func TestGetTunnelConfigNotFound(t *testing.T) {
 }
 
 func TestGetTunnelQR(t *testing.T) {
-	srv, _ := setupTestServer(t)
+	srv, db := setupTestServer(t)
 
 	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
 		"domains": []string{"a.com"}, "upstream_port": 443,
@@ -404,6 +838,38 @@ func TestGetTunnelQR(t *testing.T) {
 	if rr.Body.Len() == 0 {
 		t.Error("expected non-empty QR code PNG")
 	}
+
+	// Within the escrow window the config download has the real keys
+	rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/config", tunnelID), nil)
+	if strings.Contains(rr.Body.String(), wireguard.PrivateKeyPlaceholder) || !strings.Contains(rr.Body.String(), "PresharedKey") {
+		t.Errorf("expected the escrowed private key and PSK in the config, got %s", rr.Body.String())
+	}
+
+	// Once the key is gone the QR code cannot be made
+	srv.escrow.drop(tunnelID)
+	rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/qr", tunnelID), nil)
+	if rr.Code != http.StatusGone {
+		t.Errorf("expected 410 after the escrow window, got %d", rr.Code)
+	}
+
+	// Nor ever for a client-generated key
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{5}, 32))
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"public_key": key})
+	flowB := parseJSON(t, rr)["id"].(string)
+	rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/qr", flowB), nil)
+	if rr.Code != http.StatusConflict || !strings.Contains(parseJSON(t, rr)["error"].(string), "client-generated key") {
+		t.Errorf("expected 409 with guidance for a Flow B tunnel, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// A tunnel from before the key origin was recorded is not taken for one
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	legacy := parseJSON(t, rr)["id"].(string)
+	srv.escrow.drop(legacy)
+	db.Conn().Exec(`UPDATE wg_peers SET server_key = 0, client_key = 0 WHERE id = ?`, legacy)
+	rr = doRequest(srv, "GET", fmt.Sprintf("/api/v1/tunnels/%s/qr", legacy), nil)
+	if rr.Code != http.StatusGone || !strings.Contains(parseJSON(t, rr)["error"].(string), "predates key escrow") {
+		t.Errorf("expected 410 for a tunnel of unknown key origin, got %d: %s", rr.Code, rr.Body.String())
+	}
 }
 
 func TestRotateTunnel(t *testing.T) {
@@ -524,432 +990,766 @@ func TestGetRotationPolicyNotFound(t *testing.T) {
 	}
 }
 
-// --- Route endpoint tests ---
-
-func TestCreateRoute(t *testing.T) {
+func TestCreateTunnelWithLabelsAndFilter(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	// Create a tunnel first
 	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
-		"upstream_port": 443,
-	})
-	body := parseJSON(t, rr)
-	tunnelID := body["id"].(string)
-
-	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
-		"tunnel_id":     tunnelID,
-		"match_type":    "sni",
-		"match_value":   []string{"new.example.com"},
-		"upstream_port": 8080,
+		"labels": map[string]string{"env": "prod", "team": "payments"},
 	})
-
 	if rr.Code != http.StatusCreated {
 		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
 	}
+	doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"labels": map[string]string{"env": "staging"},
+	})
 
-	body = parseJSON(t, rr)
-	data := body["data"].(map[string]interface{})
-	if data["tunnel_id"] != tunnelID {
-		t.Errorf("expected tunnel_id %s, got %v", tunnelID, data["tunnel_id"])
+	rr = doRequest(srv, "GET", "/api/v1/tunnels?label=env=prod", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
 	}
-	if data["upstream"] == nil {
-		t.Error("expected upstream")
+	data := parseJSON(t, rr)["data"].([]interface{})
+	if len(data) != 1 {
+		t.Fatalf("expected 1 tunnel with env=prod, got %d", len(data))
+	}
+	labels := data[0].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels["team"] != "payments" {
+		t.Errorf("expected team=payments, got %v", labels["team"])
 	}
-}
-
-func TestCreateRouteInvalidTunnel(t *testing.T) {
-	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
-		"tunnel_id":     "nonexistent",
-		"match_type":    "sni",
-		"match_value":   []string{"a.com"},
-		"upstream_port": 443,
-	})
+	rr = doRequest(srv, "GET", "/api/v1/tunnels?label=env", nil)
 	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
+		t.Errorf("expected 400 for malformed selector, got %d", rr.Code)
 	}
 }
 
-func TestCreateRouteInvalidMatchType(t *testing.T) {
+func TestCreateTunnelInvalidLabel(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
-	body := parseJSON(t, rr)
-	tunnelID := body["id"].(string)
-
-	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
-		"tunnel_id":     tunnelID,
-		"match_type":    "invalid",
-		"match_value":   []string{"a.com"},
-		"upstream_port": 443,
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"labels": map[string]string{"bad key!": "x"},
 	})
 	if rr.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", rr.Code)
 	}
 }
 
-func TestCreateRouteEmptyMatchValue(t *testing.T) {
+func TestUpdateTunnelLabels(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
-	body := parseJSON(t, rr)
-	tunnelID := body["id"].(string)
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelID := parseJSON(t, rr)["id"].(string)
 
-	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
-		"tunnel_id":     tunnelID,
-		"match_type":    "sni",
-		"match_value":   []string{},
-		"upstream_port": 443,
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+tunnelID, map[string]interface{}{
+		"labels": map[string]string{"env": "prod"},
 	})
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["labels"].(map[string]interface{})["env"] != "prod" {
+		t.Errorf("expected env=prod, got %v", data["labels"])
 	}
-}
-
-func TestCreateRouteReservedPort(t *testing.T) {
-	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
-	body := parseJSON(t, rr)
-	tunnelID := body["id"].(string)
+	// The update answers with the same fields as a read
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+tunnelID, nil)
+	read := parseJSON(t, rr)["data"].(map[string]interface{})
+	for field := range read {
+		if _, ok := data[field]; !ok && field != "routes" {
+			t.Errorf("expected %s in the update response", field)
+		}
+	}
 
-	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
-		"tunnel_id":     tunnelID,
-		"match_type":    "sni",
-		"match_value":   []string{"a.com"},
-		"upstream_port": 22,
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/tun_nonexistent", map[string]interface{}{
+		"labels": map[string]string{"env": "prod"},
 	})
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
 	}
 }
 
-func TestListRoutes(t *testing.T) {
+func TestTunnelIsolation(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "GET", "/api/v1/routes", nil)
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", rr.Code)
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"isolate": true})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	tunnelID, vpnIP := created["id"].(string), created["vpn_ip"].(string)
+	if isolated, _ := srv.fwManager.ListIsolated(); len(isolated) != 1 || isolated[0] != vpnIP {
+		t.Fatalf("expected %s isolated, got %v", vpnIP, isolated)
 	}
 
-	body := parseJSON(t, rr)
-	data := body["data"].([]interface{})
-	if len(data) != 0 {
-		t.Errorf("expected 0 routes, got %d", len(data))
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+tunnelID, map[string]interface{}{"isolate": false})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if data := parseJSON(t, rr)["data"].(map[string]interface{}); data["isolate"] != false {
+		t.Errorf("expected isolate false, got %v", data["isolate"])
+	}
+	if isolated, _ := srv.fwManager.ListIsolated(); len(isolated) != 0 {
+		t.Errorf("expected no isolated peers, got %v", isolated)
+	}
+	if tunnel, _ := srv.tunnelStore.Get(tunnelID); tunnel.Isolate {
+		t.Error("expected isolate cleared in the store")
 	}
 }
 
-func TestDeleteRoute(t *testing.T) {
+func TestTunnelSourceCIDRAndEndpoints(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	// Create tunnel + route
-	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
-		"domains": []string{"a.com"}, "upstream_port": 443,
-	})
-	body := parseJSON(t, rr)
-	tunnelID := body["id"].(string)
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"source_cidr": "not-a-cidr"})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid source_cidr, got %d", rr.Code)
+	}
 
-	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
-		"tunnel_id": tunnelID, "match_type": "sni", "match_value": []string{"b.com"}, "upstream_port": 8080,
-	})
-	body = parseJSON(t, rr)
-	routeID := body["data"].(map[string]interface{})["id"].(string)
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"source_cidr": "198.51.100.9/24"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	id := parseJSON(t, rr)["id"].(string)
+	tunnel, _ := srv.tunnelStore.Get(id)
+	if tunnel.SourceCIDR != "198.51.100.0/24" {
+		t.Errorf("expected normalized CIDR, got %q", tunnel.SourceCIDR)
+	}
 
-	rr = doRequest(srv, "DELETE", "/api/v1/routes/"+routeID, nil)
-	if rr.Code != http.StatusNoContent {
-		t.Errorf("expected 204, got %d", rr.Code)
+	// Clear the restriction and disable
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"source_cidr": "", "enabled": false})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["source_cidr"] != "" || data["enabled"] != false {
+		t.Errorf("unexpected tunnel after update: %v", data)
 	}
-}
 
-func TestDeleteRouteNotFound(t *testing.T) {
-	srv, _ := setupTestServer(t)
+	srv.tunnelStore.RecordEndpoint(tunnel.PublicKey, "198.51.100.7:51820", time.Unix(1_700_000_000, 0))
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/endpoints", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	history := parseJSON(t, rr)["data"].([]interface{})
+	if len(history) != 1 || history[0].(map[string]interface{})["endpoint"] != "198.51.100.7:51820" {
+		t.Errorf("unexpected endpoint history: %v", history)
+	}
 
-	rr := doRequest(srv, "DELETE", "/api/v1/routes/nonexistent", nil)
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/tun_missing/endpoints", nil)
 	if rr.Code != http.StatusNotFound {
 		t.Errorf("expected 404, got %d", rr.Code)
 	}
 }
 
-// --- Firewall endpoint tests ---
+// --- Route endpoint tests ---
 
-func TestCreateFirewallRule(t *testing.T) {
+func TestCreateRoute(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-		"port":        8080,
-		"proto":       "tcp",
-		"source_cidr": "0.0.0.0/0",
-		"action":      "allow",
+	// Create a tunnel first
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"upstream_port": 443,
+	})
+	body := parseJSON(t, rr)
+	tunnelID := body["id"].(string)
+
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "sni",
+		"match_value":   []string{"new.example.com"},
+		"upstream_port": 8080,
 	})
 
 	if rr.Code != http.StatusCreated {
 		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
 	}
 
-	body := parseJSON(t, rr)
+	body = parseJSON(t, rr)
 	data := body["data"].(map[string]interface{})
-	if data["port"] != float64(8080) {
-		t.Errorf("expected port 8080, got %v", data["port"])
+	if data["tunnel_id"] != tunnelID {
+		t.Errorf("expected tunnel_id %s, got %v", tunnelID, data["tunnel_id"])
 	}
-	if data["proto"] != "tcp" {
-		t.Errorf("expected proto tcp, got %v", data["proto"])
+	if data["upstream"] == nil {
+		t.Error("expected upstream")
 	}
 }
 
-func TestCreateFirewallRuleDefaults(t *testing.T) {
+func TestCreateRouteProxyProtocol(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-		"port":  8080,
-		"proto": "tcp",
-	})
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelID := parseJSON(t, rr)["id"].(string)
 
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":      tunnelID,
+		"match_type":     "sni",
+		"match_value":    []string{"pp.example.com"},
+		"upstream_port":  8443,
+		"proxy_protocol": "v2",
+	})
 	if rr.Code != http.StatusCreated {
 		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
 	}
-
-	body := parseJSON(t, rr)
-	data := body["data"].(map[string]interface{})
-	if data["source_cidr"] != "0.0.0.0/0" {
-		t.Errorf("expected default source_cidr 0.0.0.0/0, got %v", data["source_cidr"])
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["proxy_protocol"] != "v2" {
+		t.Errorf("expected proxy_protocol v2, got %v", data["proxy_protocol"])
 	}
-	if data["action"] != "allow" {
-		t.Errorf("expected default action allow, got %v", data["action"])
+	mock := srv.caddyClient.(*mockCaddyClient)
+	if len(mock.routes) != 1 || mock.routes[0].Handle[0].ProxyProtocol != "v2" {
+		t.Errorf("expected caddy route with proxy_protocol v2, got %+v", mock.routes)
+	}
+	stored, _ := srv.routeStore.Get(data["id"].(string))
+	if stored.ProxyProtocol != "v2" {
+		t.Errorf("expected stored proxy_protocol v2, got %q", stored.ProxyProtocol)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"tunnel_id": tunnelID, "match_type": "sni", "match_value": []string{"a.example.com"}, "upstream_port": 443, "proxy_protocol": "v3"},
+		{"tunnel_id": tunnelID, "match_type": "port_forward", "protocol": "udp", "listen_port": 5000, "upstream_port": 5000, "proxy_protocol": "v1"},
+	} {
+		rr = doRequest(srv, "POST", "/api/v1/routes", body)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %v, got %d", body, rr.Code)
+		}
 	}
 }
 
-func TestCreateFirewallRuleInvalidPort(t *testing.T) {
+func TestCreatePortForwardRange(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-		"port": 0, "proto": "tcp",
-	})
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
-	}
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelID := parseJSON(t, rr)["id"].(string)
 
-	rr = doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-		"port": 70000, "proto": "tcp",
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "port_forward", "protocol": "udp",
+		"listen_port": 30000, "listen_port_end": 30002, "upstream_port": 40000,
 	})
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400 for port 70000, got %d", rr.Code)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["listen_port_end"] != float64(30002) {
+		t.Errorf("expected listen_port_end 30002, got %v", data["listen_port_end"])
+	}
+	mock := srv.caddyClient.(*mockCaddyClient)
+	if len(mock.pfServers) != 3 || !strings.HasPrefix(mock.pfServers[2], "pf-udp-30002 udp/") || !strings.HasSuffix(mock.pfServers[2], ":40002") {
+		t.Errorf("expected one server per port, got %v", mock.pfServers)
 	}
-}
-
-func TestCreateFirewallRuleReservedPort(t *testing.T) {
-	srv, _ := setupTestServer(t)
 
-	for _, port := range []int{22, 2019, 7443, 51820} {
-		rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-			"port": port, "proto": "tcp",
-		})
+	for _, body := range []map[string]interface{}{
+		// Overlaps the end of the existing range
+		{"protocol": "udp", "listen_port": 30002, "upstream_port": 30002},
+		// Covers the existing range
+		{"protocol": "udp", "listen_port": 29900, "listen_port_end": 30100, "upstream_port": 29900},
+	} {
+		body["tunnel_id"], body["match_type"] = tunnelID, "port_forward"
+		rr = doRequest(srv, "POST", "/api/v1/routes", body)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected 409 for %v, got %d: %s", body, rr.Code, rr.Body.String())
+		}
+	}
+	for _, body := range []map[string]interface{}{
+		{"listen_port": 5000, "listen_port_end": 4999, "upstream_port": 5000},
+		{"listen_port": 1000, "listen_port_end": 3000, "upstream_port": 1000},
+		{"listen_port": 7400, "listen_port_end": 7450, "upstream_port": 7400},
+		{"listen_port": 65000, "listen_port_end": 65010, "upstream_port": 65530},
+	} {
+		body["tunnel_id"], body["match_type"] = tunnelID, "port_forward"
+		rr = doRequest(srv, "POST", "/api/v1/routes", body)
 		if rr.Code != http.StatusBadRequest {
-			t.Errorf("expected 400 for reserved port %d, got %d", port, rr.Code)
+			t.Errorf("expected 400 for %v, got %d: %s", body, rr.Code, rr.Body.String())
 		}
 	}
-}
-
-func TestCreateFirewallRuleInvalidProto(t *testing.T) {
-	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-		"port": 8080, "proto": "icmp",
+	// The same ports over TCP are free
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "port_forward", "protocol": "tcp",
+		"listen_port": 30000, "listen_port_end": 30002, "upstream_port": 30000,
 	})
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for tcp range, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = doRequest(srv, "DELETE", "/api/v1/routes/"+data["id"].(string), nil)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	if strings.Join(mock.deletedIDs, ",") != "pf-udp-30000,pf-udp-30001,pf-udp-30002" {
+		t.Errorf("expected every server of the range deleted, got %v", mock.deletedIDs)
 	}
 }
 
-func TestCreateFirewallRuleInvalidCIDR(t *testing.T) {
+func TestCreateRouteQUIC(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-		"port": 8080, "proto": "tcp", "source_cidr": "not-a-cidr",
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "sni",
+		"match_value":   []string{"h3.example.com"},
+		"upstream_port": 443,
+		"quic":          true,
 	})
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["quic"] != true {
+		t.Errorf("expected quic true, got %v", data["quic"])
+	}
+	mock := srv.caddyClient.(*mockCaddyClient)
+	if len(mock.quicRoutes) != 1 {
+		t.Fatalf("expected 1 quic route, got %d", len(mock.quicRoutes))
+	}
+	qr := mock.quicRoutes[0]
+	if qr.ID != data["caddy_id"].(string)+"-quic" {
+		t.Errorf("unexpected quic route id %q", qr.ID)
+	}
+	if dial := qr.Handle[0].Upstreams[0].Dial[0]; dial != "udp/"+data["upstream"].(string) {
+		t.Errorf("expected udp upstream, got %q", dial)
 	}
-}
 
-func TestCreateFirewallRuleInvalidAction(t *testing.T) {
-	srv, _ := setupTestServer(t)
+	rr = doRequest(srv, "DELETE", "/api/v1/routes/"+data["id"].(string), nil)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	if len(mock.deletedIDs) != 2 || mock.deletedIDs[1] != qr.ID {
+		t.Errorf("expected sni and quic routes deleted, got %v", mock.deletedIDs)
+	}
 
-	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-		"port": 8080, "proto": "tcp", "action": "reject",
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "port_forward",
+		"listen_port":   5000,
+		"upstream_port": 5000,
+		"quic":          true,
 	})
 	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
+		t.Errorf("expected 400 for quic on port_forward, got %d", rr.Code)
 	}
 }
 
-func TestListFirewallRules(t *testing.T) {
+func TestUpdateRoutePriority(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "GET", "/api/v1/firewall/rules", nil)
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "sni",
+		"match_value":   []string{"*.example.com"},
+		"upstream_port": 443,
+		"priority":      -10,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["priority"] != float64(-10) {
+		t.Errorf("expected priority -10, got %v", data["priority"])
+	}
+	routeID := data["id"].(string)
+
+	rr = doRequest(srv, "PATCH", "/api/v1/routes/"+routeID, map[string]interface{}{"priority": 5})
 	if rr.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", rr.Code)
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data = parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["priority"] != float64(5) {
+		t.Errorf("expected priority 5, got %v", data["priority"])
+	}
+	stored, _ := srv.routeStore.Get(routeID)
+	if stored.Priority != 5 {
+		t.Errorf("expected stored priority 5, got %d", stored.Priority)
 	}
 
-	body := parseJSON(t, rr)
-	data := body["data"].([]interface{})
-	if len(data) != 0 {
-		t.Errorf("expected 0 rules, got %d", len(data))
+	rr = doRequest(srv, "PATCH", "/api/v1/routes/route_missing", map[string]interface{}{"priority": 1})
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
 	}
 }
 
-func TestDeleteFirewallRule(t *testing.T) {
+func TestCreateRouteSNIConflict(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	// Create
-	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
-		"port": 8080, "proto": "tcp",
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"domains": []string{"*.example.com"}, "upstream_port": 443})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	wildTunnel := parseJSON(t, rr)["id"].(string)
+	routes, _ := srv.routeStore.ListByTunnelID(wildTunnel)
+	wildRoute := routes[0].ID
+
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	otherTunnel := parseJSON(t, rr)["id"].(string)
+
+	// A specific name under the wildcard on another tunnel is ambiguous
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     otherTunnel,
+		"match_type":    "sni",
+		"match_value":   []string{"App.example.com"},
+		"upstream_port": 443,
 	})
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rr.Code, rr.Body.String())
+	}
 	body := parseJSON(t, rr)
-	ruleID := body["data"].(map[string]interface{})["id"].(string)
+	if msg := body["error"].(string); !strings.Contains(msg, wildRoute) {
+		t.Errorf("expected conflicting route %s in error, got %q", wildRoute, msg)
+	}
+	if conflict, _ := body["conflict"].(map[string]interface{}); conflict["route_id"] != wildRoute || conflict["tunnel_id"] != wildTunnel {
+		t.Errorf("expected the owning route in conflict, got %v", body["conflict"])
+	}
 
-	// Delete
-	rr = doRequest(srv, "DELETE", "/api/v1/firewall/rules/"+ruleID, nil)
-	if rr.Code != http.StatusNoContent {
-		t.Errorf("expected 204, got %d", rr.Code)
+	// Explicitly allowed, e.g. together with a higher priority
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     otherTunnel,
+		"match_type":    "sni",
+		"match_value":   []string{"app.example.com"},
+		"upstream_port": 443,
+		"allow_overlap": true,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 with allow_overlap, got %d: %s", rr.Code, rr.Body.String())
 	}
-}
 
-func TestDeleteFirewallRuleNotFound(t *testing.T) {
-	srv, _ := setupTestServer(t)
+	// Identical names are never allowed
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     wildTunnel,
+		"match_type":    "sni",
+		"match_value":   []string{"app.example.com"},
+		"upstream_port": 8443,
+		"allow_overlap": true,
+	})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for duplicate name, got %d", rr.Code)
+	}
 
-	rr := doRequest(srv, "DELETE", "/api/v1/firewall/rules/nonexistent", nil)
-	if rr.Code != http.StatusNotFound {
-		t.Errorf("expected 404, got %d", rr.Code)
+	// Tunnel creation checks its domains too
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"domains": []string{"api.example.com"}, "upstream_port": 443})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 creating tunnel, got %d", rr.Code)
 	}
 }
 
-// --- Status endpoint tests ---
-
-func TestStatusEndpoint(t *testing.T) {
+func TestCreateRouteDistinctCaddyIDs(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "GET", "/api/v1/status", nil)
-	if rr.Code != http.StatusOK {
-		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"domains": []string{"a.example.com"}, "upstream_port": 443})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
 	}
+	tunnelID := parseJSON(t, rr)["id"].(string)
 
-	body := parseJSON(t, rr)
-	if body["tunnels"] == nil {
-		t.Error("expected tunnels in status")
+	// A second SNI route on the same tunnel gets its own Caddy route
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "sni",
+		"match_value":   []string{"b.example.com"},
+		"upstream_port": 8443,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
 	}
-	if body["routes"] == nil {
-		t.Error("expected routes in status")
+
+	routes, _ := srv.routeStore.ListByTunnelID(tunnelID)
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(routes))
 	}
-	if body["firewall"] == nil {
-		t.Error("expected firewall in status")
+	for _, route := range routes {
+		if want := caddy.SNIRouteID(route.ID); route.CaddyID != want {
+			t.Errorf("expected caddy id %s, got %s", want, route.CaddyID)
+		}
 	}
-	if body["reconciliation"] == nil {
-		t.Error("expected reconciliation in status")
+	if routes[0].CaddyID == routes[1].CaddyID {
+		t.Errorf("expected distinct caddy ids, both are %s", routes[0].CaddyID)
 	}
+}
 
-	recon := body["reconciliation"].(map[string]interface{})
-	if recon["last_status"] != "pending" {
-		t.Errorf("expected pending status, got %v", recon["last_status"])
+func TestCreateRouteSharedUpstream(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"domains": []string{"a.example.com"}, "upstream_port": 443})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	// Its traffic could not be told from the first route's
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "sni",
+		"match_value":   []string{"b.example.com"},
+		"upstream_port": 443,
+	})
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "add the domains") {
+		t.Errorf("expected a hint to add the domains, got %s", rr.Body.String())
+	}
+
+	// A port forward overlapping the upstream is rejected too
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":       tunnelID,
+		"match_type":      "port_forward",
+		"listen_port":     20440,
+		"listen_port_end": 20450,
+		"upstream_port":   440,
+	})
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rr.Code, rr.Body.String())
 	}
 }
 
-// --- Force reconcile tests ---
+func TestValidateSNI(t *testing.T) {
+	for _, d := range []string{"example.com", "*.example.com", "a-b.example.co.uk"} {
+		if err := validateSNI(d); err != nil {
+			t.Errorf("validateSNI(%q): %v", d, err)
+		}
+	}
+	for _, d := range []string{"*.com", "a*.example.com", "*.*.example.com", "a..example.com", "-a.example.com", "^app\\.example\\.com$"} {
+		if err := validateSNI(d); err == nil {
+			t.Errorf("validateSNI(%q): expected error", d)
+		}
+	}
+}
 
-func TestForceReconcile(t *testing.T) {
+func TestIdempotencyKey(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	rr := doRequest(srv, "POST", "/api/v1/reconcile", nil)
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", rr.Code)
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/firewall/rules", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		srv.mux.ServeHTTP(rr, req)
+		return rr
 	}
 
-	body := parseJSON(t, rr)
-	if body["status"] != "reconciliation triggered" {
-		t.Errorf("expected reconciliation triggered, got %v", body["status"])
+	first := post("key-1", `{"port": 8080, "proto": "tcp"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", first.Code, first.Body.String())
+	}
+	retry := post("key-1", `{"port": 8080, "proto": "tcp"}`)
+	if retry.Code != http.StatusCreated {
+		t.Fatalf("expected replayed 201, got %d: %s", retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("expected Idempotent-Replayed header on retry")
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("expected identical body, got %s vs %s", retry.Body.String(), first.Body.String())
+	}
+	if rules, _ := srv.fwStore.List(); len(rules) != 1 {
+		t.Errorf("expected 1 firewall rule, got %d", len(rules))
 	}
-}
 
-// --- Middleware tests ---
+	if rr := post("key-1", `{"port": 9090, "proto": "tcp"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for reused key, got %d", rr.Code)
+	}
 
-func TestRateLimiting(t *testing.T) {
-	srv, _ := setupTestServer(t)
+	// Failed requests are stored too; a new key creates a new rule
+	if rr := post("key-2", `{"port": 22, "proto": "tcp"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+	if rr := post("key-2", `{"port": 22, "proto": "tcp"}`); rr.Code != http.StatusBadRequest || rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected replayed 400, got %d", rr.Code)
+	}
+}
 
-	rl := NewRateLimiter(3, time.Minute)
-	handler := rl.RateLimitMiddleware(srv.mux)
+func TestIdempotencyKeyPanic(t *testing.T) {
+	srv, _ := setupTestServer(t)
 
-	for i := 0; i < 3; i++ {
-		req := httptest.NewRequest("GET", "/api/v1/health", nil)
-		req.RemoteAddr = "1.2.3.4:5678"
+	post := func(h http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/firewall/rules", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", "key-1")
 		rr := httptest.NewRecorder()
-		handler.ServeHTTP(rr, req)
-		if rr.Code != http.StatusOK {
-			t.Fatalf("request %d: expected 200, got %d", i+1, rr.Code)
-		}
+		func() {
+			defer func() { recover() }()
+			srv.idempotent(h)(rr, req)
+		}()
+		return rr
 	}
 
-	// 4th request should be rate limited
-	req := httptest.NewRequest("GET", "/api/v1/health", nil)
-	req.RemoteAddr = "1.2.3.4:5678"
-	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusTooManyRequests {
-		t.Errorf("expected 429, got %d", rr.Code)
+	// A handler that panics leaves no reservation behind, so the retry runs
+	post(func(http.ResponseWriter, *http.Request) { panic("boom") })
+	rr := post(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) })
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected the retry to run, got %d: %s", rr.Code, rr.Body.String())
 	}
 }
 
-func TestLoggingMiddleware(t *testing.T) {
-	srv, _ := setupTestServer(t)
+func TestCreateTunnelRollsBackOnPersistFailure(t *testing.T) {
+	srv, db := setupTestServer(t)
 
-	handler := LoggingMiddleware(srv.mux)
+	// Make the route insert fail after the peer, tunnel, and Caddy route exist
+	_, err := db.Conn().Exec(`CREATE TRIGGER fail_route_insert BEFORE INSERT ON l4_routes
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+	if err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
 
-	req := httptest.NewRequest("GET", "/api/v1/health", nil)
-	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, req)
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains":       []string{"rollback.example.com"},
+		"upstream_port": 443,
+	})
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rr.Code, rr.Body.String())
+	}
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", rr.Code)
+	if tunnels, _ := srv.tunnelStore.List(); len(tunnels) != 0 {
+		t.Errorf("expected no tunnels after rollback, got %d", len(tunnels))
+	}
+	if peers, _ := srv.wgManager.ListPeers(); len(peers) != 0 {
+		t.Errorf("expected no WireGuard peers after rollback, got %d", len(peers))
+	}
+	mock := srv.caddyClient.(*mockCaddyClient)
+	if len(mock.routes) != 1 || len(mock.deletedIDs) != 1 || mock.deletedIDs[0] != mock.routes[0].ID {
+		t.Errorf("expected the added caddy route to be deleted, added %v deleted %v", mock.routes, mock.deletedIDs)
 	}
 }
 
-func TestCreateTunnelInvalidJSON(t *testing.T) {
+func TestCreateTunnelDuplicatePublicKey(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	req := httptest.NewRequest("POST", "/api/v1/tunnels", bytes.NewReader([]byte("not json")))
-	req.Header.Set("Content-Type", "application/json")
-	rr := httptest.NewRecorder()
+	body := map[string]interface{}{"public_key": "a2tra2tra2tra2tra2tra2tra2tra2tra2tra2tra2s="}
+	if rr := doRequest(srv, "POST", "/api/v1/tunnels", body); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := doRequest(srv, "POST", "/api/v1/tunnels", body); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if peers, _ := srv.wgManager.ListPeers(); len(peers) != 1 {
+		t.Errorf("expected the existing peer to survive, got %d peers", len(peers))
+	}
+}
+
+func TestRotationPolicyIfMatch(t *testing.T) {
+	srv, db := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+	path := "/api/v1/tunnels/" + tunnelID + "/rotation-policy"
+
+	rr = doRequest(srv, "GET", path, nil)
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag on rotation policy")
+	}
+
+	patch := func(ifMatch string, body map[string]interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest("PATCH", path, bytes.NewReader(b))
+		req.Header.Set("If-Match", ifMatch)
+		rr := httptest.NewRecorder()
+		srv.mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Operator A updates with the current ETag
+	rr = patch(etag, map[string]interface{}{"inactive_expiry_days": 30})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	newTag := rr.Header().Get("ETag")
+	if newTag == "" || newTag == etag {
+		t.Fatalf("expected a new ETag, got %q", newTag)
+	}
+
+	// Operator B still holds the old ETag
+	rr = patch(etag, map[string]interface{}{"inactive_expiry_days": 60})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("ETag") != newTag {
+		t.Errorf("expected current ETag on 412, got %q", rr.Header().Get("ETag"))
+	}
+	tunnel, _ := srv.tunnelStore.Get(tunnelID)
+	if tunnel.InactiveExpiryDays != 30 {
+		t.Errorf("expected A's change to survive, got %d days", tunnel.InactiveExpiryDays)
+	}
+
+	// Traffic stats bump updated_at but are not the caller's to change, so
+	// the tag stays valid
+	db.Conn().Exec(`UPDATE wg_peers SET updated_at = updated_at - 60 WHERE id = ?`, tunnelID)
+	if rr = doRequest(srv, "GET", path, nil); rr.Header().Get("ETag") != newTag {
+		t.Fatalf("expected the ETag to ignore updated_at, got %q", rr.Header().Get("ETag"))
+	}
+	handshake := time.Now()
+	if err := srv.tunnelStore.UpdatePeerStats(tunnel.PublicKey, &handshake, 1024, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if rr = doRequest(srv, "GET", path, nil); rr.Header().Get("ETag") != newTag {
+		t.Errorf("expected a stats update to keep the ETag, got %q", rr.Header().Get("ETag"))
+	}
+
+	// The tunnel list carries the same tag, and DELETE honors it
+	rr = doRequest(srv, "GET", "/api/v1/tunnels", nil)
+	listed := parseJSON(t, rr)["data"].([]interface{})[0].(map[string]interface{})
+	if listed["etag"] != newTag {
+		t.Errorf("expected list etag %s, got %v", newTag, listed["etag"])
+	}
+	req := httptest.NewRequest("DELETE", "/api/v1/tunnels/"+tunnelID, nil)
+	req.Header.Set("If-Match", etag)
+	rr = httptest.NewRecorder()
 	srv.mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 deleting with stale ETag, got %d", rr.Code)
+	}
+}
+
+func TestCreateRouteInvalidTunnel(t *testing.T) {
+	srv, _ := setupTestServer(t)
 
+	rr := doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     "nonexistent",
+		"match_type":    "sni",
+		"match_value":   []string{"a.com"},
+		"upstream_port": 443,
+	})
 	if rr.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", rr.Code)
 	}
 }
 
-func TestCreateRouteInvalidJSON(t *testing.T) {
+func TestCreateRouteInvalidMatchType(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	req := httptest.NewRequest("POST", "/api/v1/routes", bytes.NewReader([]byte("bad")))
-	rr := httptest.NewRecorder()
-	srv.mux.ServeHTTP(rr, req)
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
+	body := parseJSON(t, rr)
+	tunnelID := body["id"].(string)
 
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "invalid",
+		"match_value":   []string{"a.com"},
+		"upstream_port": 443,
+	})
 	if rr.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", rr.Code)
 	}
 }
 
-func TestCreateFirewallRuleInvalidJSON(t *testing.T) {
+func TestCreateRouteEmptyMatchValue(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
-	req := httptest.NewRequest("POST", "/api/v1/firewall/rules", bytes.NewReader([]byte("bad")))
-	rr := httptest.NewRecorder()
-	srv.mux.ServeHTTP(rr, req)
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
+	body := parseJSON(t, rr)
+	tunnelID := body["id"].(string)
 
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "sni",
+		"match_value":   []string{},
+		"upstream_port": 443,
+	})
 	if rr.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", rr.Code)
 	}
 }
 
-func TestCreateRouteInvalidSNI(t *testing.T) {
+func TestCreateRouteReservedPort(t *testing.T) {
 	srv, _ := setupTestServer(t)
 
 	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
@@ -957,10 +1757,3600 @@ func TestCreateRouteInvalidSNI(t *testing.T) {
 	tunnelID := body["id"].(string)
 
 	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
-		"tunnel_id": tunnelID, "match_type": "sni",
-		"match_value": []string{"invalid domain!!!"}, "upstream_port": 443,
+		"tunnel_id":     tunnelID,
+		"match_type":    "sni",
+		"match_value":   []string{"a.com"},
+		"upstream_port": 22,
 	})
 	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400 for invalid SNI, got %d", rr.Code)
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestTunnelAllowedUpstreamPorts(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"allowed_upstream_ports": []map[string]int{{"start": 65536}},
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid range, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"allowed_upstream_ports": []map[string]int{{"start": 443}, {"start": 8000, "end": 8099}},
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	createRoute := func(fields map[string]interface{}) *httptest.ResponseRecorder {
+		fields["tunnel_id"] = tunnelID
+		return doRequest(srv, "POST", "/api/v1/routes", fields)
+	}
+	if rr := createRoute(map[string]interface{}{"match_type": "sni", "match_value": []string{"app.example.com"}, "upstream_port": 8080}); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for an allowed port, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := createRoute(map[string]interface{}{"match_type": "sni", "match_value": []string{"db.example.com"}, "upstream_port": 5432}); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a port outside the allowed ones, got %d: %s", rr.Code, rr.Body.String())
+	}
+	// 8090-8110 runs past the end of 8000-8099
+	if rr := createRoute(map[string]interface{}{"match_type": "port_forward", "listen_port": 30000, "listen_port_end": 30020, "upstream_port": 8090}); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a range leaving the allowed ports, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The route to 8080 would no longer be reachable
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+tunnelID, map[string]interface{}{
+		"allowed_upstream_ports": []map[string]int{{"start": 443}},
+	})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+tunnelID, map[string]interface{}{
+		"allowed_upstream_ports": []map[string]int{},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if ports := parseJSON(t, rr)["data"].(map[string]interface{})["allowed_upstream_ports"]; ports != nil {
+		t.Errorf("expected any port allowed, got %v", ports)
+	}
+	if rr := createRoute(map[string]interface{}{"match_type": "sni", "match_value": []string{"db.example.com"}, "upstream_port": 5432}); rr.Code != http.StatusCreated {
+		t.Errorf("expected 201 once unrestricted, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestListRoutes(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "GET", "/api/v1/routes", nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rr.Code)
+	}
+
+	body := parseJSON(t, rr)
+	data := body["data"].([]interface{})
+	if len(data) != 0 {
+		t.Errorf("expected 0 routes, got %d", len(data))
+	}
+}
+
+func TestDeleteRoute(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	// Create tunnel + route
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains": []string{"a.com"}, "upstream_port": 443,
+	})
+	body := parseJSON(t, rr)
+	tunnelID := body["id"].(string)
+
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "sni", "match_value": []string{"b.com"}, "upstream_port": 8080,
+	})
+	body = parseJSON(t, rr)
+	routeID := body["data"].(map[string]interface{})["id"].(string)
+
+	rr = doRequest(srv, "DELETE", "/api/v1/routes/"+routeID, nil)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rr.Code)
+	}
+}
+
+func TestDeleteRouteNotFound(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "DELETE", "/api/v1/routes/nonexistent", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+// --- Firewall endpoint tests ---
+
+func TestCreateFirewallRule(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port":        8080,
+		"proto":       "tcp",
+		"source_cidr": "0.0.0.0/0",
+		"action":      "allow",
+	})
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	body := parseJSON(t, rr)
+	data := body["data"].(map[string]interface{})
+	if data["port"] != float64(8080) {
+		t.Errorf("expected port 8080, got %v", data["port"])
+	}
+	if data["proto"] != "tcp" {
+		t.Errorf("expected proto tcp, got %v", data["proto"])
+	}
+}
+
+func TestCreateFirewallRuleCanonicalCIDR(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	// nftables reports the masked network, so that is what gets stored
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port":        8080,
+		"proto":       "tcp",
+		"source_cidr": "192.168.1.77/24",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["source_cidr"] != "192.168.1.0/24" {
+		t.Errorf("expected source_cidr 192.168.1.0/24, got %v", data["source_cidr"])
+	}
+}
+
+func TestCreateFirewallRuleForwardChain(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	// Reserved ports protect the VPS; forward rules only filter peer traffic
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port":        22,
+		"proto":       "tcp",
+		"chain":       "forward",
+		"direction":   "out",
+		"source_cidr": "10.0.0.5/32",
+		"action":      "deny",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["chain"] != "forward" || data["direction"] != "out" {
+		t.Errorf("unexpected rule: %v", data)
+	}
+	rules, _ := srv.fwManager.ListRules()
+	if len(rules) != 1 || rules[0].Chain != "forward" || rules[0].Direction != "out" {
+		t.Errorf("unexpected nftables rules: %+v", rules)
+	}
+	stored, _ := srv.fwStore.Get(data["id"].(string))
+	if stored.Chain != "forward" || stored.Direction != "out" {
+		t.Errorf("unexpected stored rule: %+v", stored)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"port": 8080, "proto": "tcp", "direction": "out"},
+		{"port": 8080, "proto": "tcp", "chain": "postrouting"},
+		{"port": 22, "proto": "tcp"},
+	} {
+		if rr := doRequest(srv, "POST", "/api/v1/firewall/rules", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestCreateFirewallRuleEgress(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	// Peers must not reach the VPS metadata service
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port":        80,
+		"proto":       "tcp",
+		"chain":       "forward",
+		"source_cidr": "10.0.0.0/24",
+		"dest_cidr":   "169.254.169.254/32",
+		"action":      "deny",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["dest_cidr"] != "169.254.169.254/32" || data["direction"] != "in" {
+		t.Errorf("unexpected rule: %v", data)
+	}
+	stored, _ := srv.fwStore.Get(data["id"].(string))
+	if stored.DestCIDR != "169.254.169.254/32" {
+		t.Errorf("unexpected stored rule: %+v", stored)
+	}
+
+	// Output rules default to direction out; an IPv6 destination to an IPv6 source
+	rr = doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port":      25,
+		"proto":     "tcp",
+		"chain":     "output",
+		"dest_cidr": "2001:db8::1/64",
+		"action":    "deny",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data = parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["direction"] != "out" || data["source_cidr"] != "::/0" || data["dest_cidr"] != "2001:db8::/64" {
+		t.Errorf("unexpected rule: %v", data)
+	}
+	rules, _ := srv.fwManager.ListRules()
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 nftables rules, got %+v", rules)
+	}
+	for _, rule := range rules {
+		if rule.DestCIDR == "" {
+			t.Errorf("expected a destination on %+v", rule)
+		}
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"port": 8080, "proto": "tcp", "chain": "output", "direction": "in"},
+		{"port": 8080, "proto": "tcp", "dest_cidr": "not-a-cidr"},
+		{"port": 8080, "proto": "tcp", "source_cidr": "10.0.0.0/8", "dest_cidr": "2001:db8::/32"},
+	} {
+		if rr := doRequest(srv, "POST", "/api/v1/firewall/rules", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", body, rr.Code)
+		}
+	}
+
+	// The source cannot change family under the destination
+	rr = doRequest(srv, "PATCH", "/api/v1/firewall/rules/"+stored.ID, map[string]interface{}{"source_cidr": "::/0"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a mixed-family update, got %d", rr.Code)
+	}
+}
+
+func TestCreateFirewallRuleDefaults(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port":  8080,
+		"proto": "tcp",
+	})
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	body := parseJSON(t, rr)
+	data := body["data"].(map[string]interface{})
+	if data["source_cidr"] != "0.0.0.0/0" {
+		t.Errorf("expected default source_cidr 0.0.0.0/0, got %v", data["source_cidr"])
+	}
+	if data["action"] != "allow" {
+		t.Errorf("expected default action allow, got %v", data["action"])
+	}
+}
+
+func TestCreateFirewallRuleInvalidPort(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 0, "proto": "tcp",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 70000, "proto": "tcp",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for port 70000, got %d", rr.Code)
+	}
+}
+
+func TestCreateFirewallRuleReservedPort(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	for _, port := range []int{22, 2019, 7443, 51820} {
+		rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+			"port": port, "proto": "tcp",
+		})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for reserved port %d, got %d", port, rr.Code)
+		}
+	}
+}
+
+func TestCreateFirewallRuleInvalidProto(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "icmp",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestCreateFirewallRuleInvalidCIDR(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp", "source_cidr": "not-a-cidr",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestCreateFirewallRuleInvalidAction(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp", "action": "reject",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestListFirewallRules(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "GET", "/api/v1/firewall/rules", nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rr.Code)
+	}
+
+	body := parseJSON(t, rr)
+	data := body["data"].([]interface{})
+	if len(data) != 0 {
+		t.Errorf("expected 0 rules, got %d", len(data))
+	}
+}
+
+func TestFirewallRuleHits(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"name": "block-db", "port": 5432, "proto": "tcp", "action": "deny",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create rule: %d %s", rr.Code, rr.Body.String())
+	}
+	ruleID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+	rr = doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{"port": 8080, "proto": "tcp"})
+	disabledID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+	doRequest(srv, "PATCH", "/api/v1/firewall/rules/"+disabledID, map[string]interface{}{"enabled": false})
+
+	rr = doRequest(srv, "GET", "/api/v1/firewall/rules", nil)
+	for _, item := range parseJSON(t, rr)["data"].([]interface{}) {
+		rule := item.(map[string]interface{})
+		hits, counted := rule["hits"].(map[string]interface{})
+		switch rule["id"] {
+		case ruleID:
+			if !counted || hits["packets"] != float64(0) || hits["bytes"] != float64(0) {
+				t.Errorf("expected zero hits for the rule in nftables, got %v", rule["hits"])
+			}
+		case disabledID:
+			if rule["hits"] != nil {
+				t.Errorf("expected no hits for a disabled rule, got %v", rule["hits"])
+			}
+		}
+	}
+
+	metrics := doRequest(srv, "GET", "/api/v1/monitoring/metrics", nil).Body.String()
+	for _, want := range []string{
+		"# TYPE proxy_manager_firewall_rule_packets_total counter\n",
+		fmt.Sprintf(`proxy_manager_firewall_rule_packets_total{rule_id="%s",rule_name="block-db",action="deny"} 0`, ruleID),
+		fmt.Sprintf(`proxy_manager_firewall_rule_bytes_total{rule_id="%s",rule_name="block-db",action="deny"} 0`, ruleID),
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected %q in metrics:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, disabledID) {
+		t.Errorf("expected no metrics for the disabled rule:\n%s", metrics)
+	}
+}
+
+func TestDeleteFirewallRule(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	// Create
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp",
+	})
+	body := parseJSON(t, rr)
+	ruleID := body["data"].(map[string]interface{})["id"].(string)
+
+	// Delete
+	rr = doRequest(srv, "DELETE", "/api/v1/firewall/rules/"+ruleID, nil)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rr.Code)
+	}
+
+	// A client that goes away after nftables changed still gets the store
+	// updated to match
+	rr = doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{"port": 8081, "proto": "tcp"})
+	ruleID = parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("DELETE", "/api/v1/firewall/rules/"+ruleID, nil).WithContext(ctx)
+	srv.mux.ServeHTTP(httptest.NewRecorder(), req)
+	if _, err := srv.fwStore.Get(ruleID); err == nil {
+		t.Error("expected the delete to be persisted after the client went away")
+	}
+}
+
+func TestUpdateFirewallRule(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp",
+	})
+	ruleID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+	path := "/api/v1/firewall/rules/" + ruleID
+
+	rr = doRequest(srv, "PATCH", path, map[string]interface{}{"source_cidr": "198.51.100.0/24", "action": "deny"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["source_cidr"] != "198.51.100.0/24" || data["action"] != "deny" || data["enabled"] != true {
+		t.Errorf("unexpected rule %v", data)
+	}
+	rules, _ := srv.fwManager.ListRules()
+	if len(rules) != 1 || rules[0].SourceCIDR != "198.51.100.0/24" || rules[0].Action != "deny" {
+		t.Errorf("expected nftables rule replaced in place, got %+v", rules)
+	}
+	stored, _ := srv.fwStore.Get(ruleID)
+	if stored.SourceCIDR != "198.51.100.0/24" || stored.Action != "deny" {
+		t.Errorf("expected change persisted, got %+v", stored)
+	}
+
+	// Disabling removes the nftables rule but keeps the stored one
+	rr = doRequest(srv, "PATCH", path, map[string]interface{}{"enabled": false})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rules, _ := srv.fwManager.ListRules(); len(rules) != 0 {
+		t.Errorf("expected no nftables rules while disabled, got %+v", rules)
+	}
+	rr = doRequest(srv, "PATCH", path, map[string]interface{}{"enabled": true})
+	if rules, _ := srv.fwManager.ListRules(); rr.Code != http.StatusOK || len(rules) != 1 {
+		t.Errorf("expected rule restored on enable, got %d %+v", rr.Code, rules)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"source_cidr": "not-a-cidr"},
+		{"action": "reject"},
+	} {
+		rr = doRequest(srv, "PATCH", path, body)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %v, got %d", body, rr.Code)
+		}
+	}
+	rr = doRequest(srv, "PATCH", "/api/v1/firewall/rules/fw_rule_missing", map[string]interface{}{"action": "deny"})
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+func TestUpdateFirewallRuleNFTFailure(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	mockNFT := newMockNFTConn()
+	srv.fwManager = firewall.NewManager(mockNFT)
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp",
+	})
+	ruleID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+
+	// A change nftables rejects is not stored
+	mockNFT.replaceErr = fmt.Errorf("netlink: operation not permitted")
+	rr = doRequest(srv, "PATCH", "/api/v1/firewall/rules/"+ruleID, map[string]interface{}{"action": "deny"})
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if stored, _ := srv.fwStore.Get(ruleID); stored.Action != "allow" {
+		t.Errorf("expected the stored rule unchanged, got %+v", stored)
+	}
+}
+
+func TestFirewallRuleActiveHours(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	// A window that starts two hours from now has not started yet
+	now := time.Now().UTC()
+	hours := now.Add(2*time.Hour).Format("15:04") + "-" + now.Add(3*time.Hour).Format("15:04")
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp", "active_hours": hours,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["active_hours"] != hours || data["active"] != false {
+		t.Errorf("unexpected rule %v", data)
+	}
+	if rules, _ := srv.fwManager.ListRules(); len(rules) != 0 {
+		t.Errorf("expected no nftables rule outside the active hours, got %+v", rules)
+	}
+	path := "/api/v1/firewall/rules/" + data["id"].(string)
+
+	rr = doRequest(srv, "GET", "/api/v1/firewall/rules", nil)
+	listed := parseJSON(t, rr)["data"].([]interface{})[0].(map[string]interface{})
+	if listed["active"] != false || listed["enabled"] != true {
+		t.Errorf("expected an enabled but inactive rule, got %v", listed)
+	}
+
+	// Clearing the hours applies the rule right away
+	rr = doRequest(srv, "PATCH", path, map[string]interface{}{"active_hours": ""})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if data := parseJSON(t, rr)["data"].(map[string]interface{}); data["active"] != true {
+		t.Errorf("expected the rule to be active, got %v", data)
+	}
+	if rules, _ := srv.fwManager.ListRules(); len(rules) != 1 {
+		t.Errorf("expected the nftables rule to be added, got %+v", rules)
+	}
+
+	// And setting them removes it until the window opens
+	rr = doRequest(srv, "PATCH", path, map[string]interface{}{"active_hours": hours})
+	if rules, _ := srv.fwManager.ListRules(); rr.Code != http.StatusOK || len(rules) != 0 {
+		t.Errorf("expected the nftables rule to be removed, got %d %+v", rr.Code, rules)
+	}
+
+	for _, bad := range []string{"8-18", "08:00-08:00", "08:00"} {
+		if rr := doRequest(srv, "PATCH", path, map[string]interface{}{"active_hours": bad}); rr.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", bad, rr.Code)
+		}
+		rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{"port": 9090, "proto": "tcp", "active_hours": bad})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400 on create, got %d", bad, rr.Code)
+		}
+	}
+}
+
+func TestFirewallRuleGroups(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	var shopIDs []string
+	for _, port := range []int{8080, 8081, 8082} {
+		rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+			"port": port, "proto": "tcp", "group": "shop", "description": "shop backend",
+		})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+		}
+		data := parseJSON(t, rr)["data"].(map[string]interface{})
+		if data["group"] != "shop" || data["description"] != "shop backend" {
+			t.Errorf("unexpected rule %v", data)
+		}
+		shopIDs = append(shopIDs, data["id"].(string))
+	}
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{"port": 9090, "proto": "tcp"})
+	otherID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+
+	// Moving a rule out of the group and listing by group
+	rr = doRequest(srv, "PATCH", "/api/v1/firewall/rules/"+shopIDs[2], map[string]interface{}{"group": "", "description": "kept"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "GET", "/api/v1/firewall/rules?group=shop", nil)
+	if data := parseJSON(t, rr)["data"].([]interface{}); len(data) != 2 {
+		t.Errorf("expected 2 rules in the group, got %d", len(data))
+	}
+
+	rr = doRequest(srv, "DELETE", "/api/v1/firewall/groups/shop", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	deleted := parseJSON(t, rr)["data"].(map[string]interface{})["deleted"].([]interface{})
+	if len(deleted) != 2 || deleted[0] != shopIDs[0] || deleted[1] != shopIDs[1] {
+		t.Errorf("expected the two shop rules to be deleted, got %v", deleted)
+	}
+	rules, _ := srv.fwManager.ListRules()
+	if len(rules) != 2 {
+		t.Errorf("expected 2 nftables rules left, got %+v", rules)
+	}
+	for _, id := range []string{shopIDs[2], otherID} {
+		if _, err := srv.fwStore.Get(id); err != nil {
+			t.Errorf("expected %s to be kept: %v", id, err)
+		}
+	}
+	if rr := doRequest(srv, "DELETE", "/api/v1/firewall/groups/shop", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an empty group, got %d", rr.Code)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"port": 8080, "proto": "tcp", "group": "no spaces"},
+		{"port": 8080, "proto": "tcp", "description": strings.Repeat("x", maxDescriptionLen+1)},
+	} {
+		if rr := doRequest(srv, "POST", "/api/v1/firewall/rules", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", rr.Code)
+		}
+	}
+}
+
+func TestBulkFirewallRules(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	listRules := func() []*store.FirewallRule {
+		rules, err := srv.fwStore.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rules
+	}
+
+	// One invalid rule keeps an atomic request from creating any
+	rules := []map[string]interface{}{
+		{"port": 8080, "proto": "tcp", "name": "web"},
+		{"port": 8081, "proto": "icmp"},
+		{"port": 8082, "proto": "tcp", "name": "web"},
+		{"port": 5432, "proto": "tcp", "source_cidr": "192.0.2.0/24", "action": "deny", "group": "db"},
+	}
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules/bulk", rules)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	results := parseJSON(t, rr)["results"].([]interface{})
+	var statuses []string
+	for _, res := range results {
+		statuses = append(statuses, res.(map[string]interface{})["status"].(string))
+	}
+	if strings.Join(statuses, ",") != "valid,invalid,invalid,valid" {
+		t.Errorf("unexpected statuses %v", statuses)
+	}
+	if len(listRules()) != 0 {
+		t.Fatal("expected an atomic request with invalid rules to create nothing")
+	}
+
+	// Best effort creates the valid ones
+	rr = doRequest(srv, "POST", "/api/v1/firewall/rules/bulk?mode=best_effort", rules)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["created"] != 2.0 || data["invalid"] != 2.0 || data["failed"] != 0.0 {
+		t.Errorf("unexpected counts %v", data)
+	}
+	if len(listRules()) != 2 {
+		t.Errorf("expected 2 stored rules, got %d", len(listRules()))
+	}
+	if fw, _ := srv.fwManager.ListRules(); len(fw) != 2 {
+		t.Errorf("expected 2 nftables rules, got %+v", fw)
+	}
+
+	// CSV, with a name taken by an existing rule: nothing is created
+	csvBody := "port,proto,source_cidr,action,name\n9000,udp,198.51.100.0/24,allow,\n9001,tcp,,deny,web\n"
+	req := httptest.NewRequest("POST", "/api/v1/firewall/rules/bulk", strings.NewReader(csvBody))
+	req.Header.Set("Content-Type", "text/csv")
+	rr = httptest.NewRecorder()
+	srv.mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a name in use, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	csvBody = "# migrated from iptables\nport,proto,source_cidr,action,group\n9000,udp,198.51.100.0/24,allow,vpn\n9001,tcp,,deny,vpn\n"
+	req = httptest.NewRequest("POST", "/api/v1/firewall/rules/bulk", strings.NewReader(csvBody))
+	req.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	rr = httptest.NewRecorder()
+	srv.mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	results = parseJSON(t, rr)["data"].(map[string]interface{})["results"].([]interface{})
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %v", results)
+	}
+	rule := results[0].(map[string]interface{})["rule"].(map[string]interface{})
+	if rule["port"] != 9000.0 || rule["proto"] != "udp" || rule["source_cidr"] != "198.51.100.0/24" || rule["group"] != "vpn" {
+		t.Errorf("unexpected rule %v", rule)
+	}
+	if len(listRules()) != 4 {
+		t.Errorf("expected 4 stored rules, got %d", len(listRules()))
+	}
+
+	for _, body := range []string{"", "port,protocol\n80,tcp\n", "port,proto\n80,tcp,extra\n"} {
+		req := httptest.NewRequest("POST", "/api/v1/firewall/rules/bulk", strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/csv")
+		rr := httptest.NewRecorder()
+		srv.mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", body, rr.Code)
+		}
+	}
+	if rr := doRequest(srv, "POST", "/api/v1/firewall/rules/bulk?mode=some", rules); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown mode, got %d", rr.Code)
+	}
+}
+
+func TestSimulateFirewall(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.fwManager.SetChainOptions(firewall.ChainOptions{Policy: firewall.PolicyDrop,
+		Services: []firewall.Service{{Name: "ssh", Proto: "tcp", Port: 22}}})
+
+	rr := doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 5432, "proto": "tcp", "source_cidr": "192.0.2.0/24", "name": "db",
+	})
+	allowID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+	rr = doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 5432, "proto": "tcp", "source_cidr": "192.0.2.66/32", "action": "deny",
+	})
+	denyID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+	now := time.Now()
+	srv.fwStore.AddBan(&store.Ban{IP: "198.51.100.7", Reason: "test", Hits: 20, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+
+	for _, tc := range []struct {
+		body      map[string]interface{}
+		allowed   bool
+		matchedBy string
+		ruleID    string
+	}{
+		{map[string]interface{}{"source_ip": "192.0.2.10", "port": 5432, "proto": "tcp"}, true, "rule", allowID},
+		{map[string]interface{}{"source_ip": "192.0.2.66", "port": 5432, "proto": "tcp"}, false, "rule", denyID},
+		{map[string]interface{}{"source_ip": "203.0.113.1", "port": 5432, "proto": "tcp"}, false, "policy", ""},
+		{map[string]interface{}{"source_ip": "203.0.113.1", "port": 22, "proto": "tcp"}, true, "service", ""},
+		{map[string]interface{}{"source_ip": "198.51.100.7", "port": 22, "proto": "tcp"}, false, "ban", ""},
+		{map[string]interface{}{"source_ip": "203.0.113.1", "port": 5432, "proto": "tcp", "chain": "forward"}, true, "policy", ""},
+	} {
+		rr := doRequest(srv, "POST", "/api/v1/firewall/rules/simulate", tc.body)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %d: %s", tc.body, rr.Code, rr.Body.String())
+		}
+		data := parseJSON(t, rr)["data"].(map[string]interface{})
+		ruleID := ""
+		if rule, ok := data["rule"].(map[string]interface{}); ok {
+			ruleID = rule["id"].(string)
+		}
+		if data["allowed"] != tc.allowed || data["matched_by"] != tc.matchedBy || ruleID != tc.ruleID {
+			t.Errorf("%v: unexpected result %v", tc.body, data)
+		}
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"source_ip": "not-an-ip", "port": 5432, "proto": "tcp"},
+		{"source_ip": "192.0.2.10", "port": 0, "proto": "tcp"},
+		{"source_ip": "192.0.2.10", "port": 5432, "proto": "icmp"},
+		{"source_ip": "192.0.2.10", "dest_ip": "2001:db8::1", "port": 5432, "proto": "tcp"},
+		{"source_ip": "192.0.2.10", "port": 5432, "proto": "tcp", "chain": "output", "direction": "in"},
+	} {
+		if rr := doRequest(srv, "POST", "/api/v1/firewall/rules/simulate", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestListBans(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	now := time.Now()
+	srv.fwStore.AddBan(&store.Ban{IP: "198.51.100.7", Reason: "20 errors in 1m0s", Hits: 20, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	srv.fwStore.AddBan(&store.Ban{IP: "198.51.100.8", Reason: "expired", Hits: 20, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)})
+
+	rr := doRequest(srv, "GET", "/api/v1/firewall/bans", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].([]interface{})
+	if len(data) != 1 {
+		t.Fatalf("expected 1 active ban, got %d", len(data))
+	}
+	ban := data[0].(map[string]interface{})
+	if ban["ip"] != "198.51.100.7" || ban["hits"] != float64(20) || ban["expires_at"] == "" {
+		t.Errorf("unexpected ban: %v", ban)
+	}
+}
+
+func TestDeleteFirewallRuleNotFound(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "DELETE", "/api/v1/firewall/rules/nonexistent", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+// --- Status endpoint tests ---
+
+func TestStatusEndpoint(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "GET", "/api/v1/status", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	body := parseJSON(t, rr)
+	if body["tunnels"] == nil {
+		t.Error("expected tunnels in status")
+	}
+	if body["routes"] == nil {
+		t.Error("expected routes in status")
+	}
+	if body["firewall"] == nil {
+		t.Error("expected firewall in status")
+	}
+	if body["reconciliation"] == nil {
+		t.Error("expected reconciliation in status")
+	}
+
+	recon := body["reconciliation"].(map[string]interface{})
+	if recon["last_status"] != "pending" {
+		t.Errorf("expected pending status, got %v", recon["last_status"])
+	}
+}
+
+func TestStatusDatabase(t *testing.T) {
+	srv, db := setupTestServer(t)
+
+	// Without housekeeping there is no database section
+	rr := doRequest(srv, "GET", "/api/v1/status", nil)
+	if body := parseJSON(t, rr); body["database"] != nil {
+		t.Errorf("expected no database status, got %v", body["database"])
+	}
+
+	keeper := housekeeping.New(db, housekeeping.Options{})
+	srv.SetHousekeeping(keeper)
+	keeper.IntegrityCheck()
+
+	rr = doRequest(srv, "GET", "/api/v1/status", nil)
+	database, _ := parseJSON(t, rr)["database"].(map[string]interface{})
+	if database == nil || database["size_bytes"].(float64) <= 0 {
+		t.Fatalf("expected the database size in status, got %v", database)
+	}
+	if database["checkpoint"] != nil {
+		t.Errorf("expected no checkpoint yet, got %v", database["checkpoint"])
+	}
+	if integrity, _ := database["integrity_check"].(map[string]interface{}); integrity["ok"] != true || integrity["last_run_at"] == nil {
+		t.Errorf("expected a passed integrity check, got %v", database["integrity_check"])
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/monitoring/metrics", nil)
+	for _, want := range []string{"proxy_manager_db_size_bytes ", "proxy_manager_db_integrity_ok 1\n"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q in metrics:\n%s", want, rr.Body.String())
+		}
+	}
+}
+
+// certSubsystem is a subsystem registered alongside the built-in ones.
+type certSubsystem struct{}
+
+func (certSubsystem) Name() string { return "certs" }
+func (certSubsystem) Reconcile(context.Context) ([]reconciler.DriftOp, error) {
+	return nil, nil
+}
+
+func TestRegisteredSubsystemReported(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.reconciler = reconciler.New(srv.tunnelStore, srv.routeStore, srv.fwStore, srv.caddyClient, srv.wgManager, srv.fwManager, time.Minute)
+	srv.reconciler.Register(certSubsystem{})
+
+	rr := doRequest(srv, "GET", "/api/v1/status", nil)
+	subsystems := parseJSON(t, rr)["reconciliation"].(map[string]interface{})["subsystems"].(map[string]interface{})
+	for _, name := range []string{"caddy", "certs", "firewall", "wireguard"} {
+		if subsystems[name] == nil {
+			t.Errorf("expected %s in the status subsystems, got %v", name, subsystems)
+		}
+	}
+
+	metrics := doRequest(srv, "GET", "/api/v1/monitoring/metrics", nil).Body.String()
+	var order []string
+	for _, line := range strings.Split(metrics, "\n") {
+		if name, ok := strings.CutPrefix(line, `proxy_manager_reconcile_consecutive_failures{subsystem="`); ok {
+			order = append(order, strings.SplitN(name, `"`, 2)[0])
+		}
+	}
+	if want := []string{"caddy", "certs", "firewall", "wireguard"}; !slices.Equal(order, want) {
+		t.Errorf("expected failures for %v in order, got %v", want, order)
+	}
+}
+
+func TestMonitoring(t *testing.T) {
+	srv, db := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"name": "office"})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	rr = doRequest(srv, "GET", "/api/v1/monitoring/metrics", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	metrics := rr.Body.String()
+	for _, want := range []string{
+		fmt.Sprintf(`proxy_manager_tunnel_connected{tunnel_id="%s",tunnel_name="office",vpn_ip="10.0.0.2"} 0`, tunnelID),
+		"proxy_manager_vpn_addresses_used 1\n",
+		"proxy_manager_vpn_addresses_total 253\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected %q in metrics:\n%s", want, metrics)
+		}
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/monitoring/rules", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var rules struct {
+		Groups []struct {
+			Name  string
+			Rules []struct {
+				Alert  string
+				Expr   string
+				Labels map[string]string
+			}
+		}
+	}
+	if err := yaml.Unmarshal(rr.Body.Bytes(), &rules); err != nil {
+		t.Fatalf("parse rules: %v\n%s", err, rr.Body.String())
+	}
+	if len(rules.Groups) != 2 || len(rules.Groups[0].Rules) != 1 || len(rules.Groups[1].Rules) != 2 {
+		t.Fatalf("expected a tunnel group with one rule and a system group with two, got %+v", rules.Groups)
+	}
+	down := rules.Groups[0].Rules[0]
+	if down.Alert != "TunnelDown" || down.Labels["tunnel_id"] != tunnelID || !strings.Contains(down.Expr, tunnelID) {
+		t.Errorf("unexpected tunnel rule %+v", down)
+	}
+
+	// Latency probes show in the status and metrics
+	ts := store.NewTunnelStore(db)
+	rtt := 40 * time.Millisecond
+	ts.RecordProbe(tunnelID, time.Now().Add(-time.Minute), nil, 10)
+	ts.RecordProbe(tunnelID, time.Now(), &rtt, 10)
+	rr = doRequest(srv, "GET", "/api/v1/status", nil)
+	peers := parseJSON(t, rr)["tunnels"].(map[string]interface{})["peers"].([]interface{})
+	latency, _ := peers[0].(map[string]interface{})["latency"].(map[string]interface{})
+	if latency["rtt_avg_ms"] != float64(40) || latency["loss"] != 0.5 || latency["samples"] != float64(2) {
+		t.Errorf("unexpected latency in status: %v", latency)
+	}
+	rr = doRequest(srv, "GET", "/api/v1/monitoring/metrics", nil)
+	for _, want := range []string{
+		fmt.Sprintf(`proxy_manager_tunnel_rtt_seconds{tunnel_id="%s",tunnel_name="office",vpn_ip="10.0.0.2"} 0.04`, tunnelID),
+		fmt.Sprintf(`proxy_manager_tunnel_probe_loss_ratio{tunnel_id="%s",tunnel_name="office",vpn_ip="10.0.0.2"} 0.5`, tunnelID),
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q in metrics:\n%s", want, rr.Body.String())
+		}
+	}
+
+	// Disabled tunnels are not expected to be up
+	doRequest(srv, "PATCH", "/api/v1/tunnels/"+tunnelID, map[string]interface{}{"enabled": false})
+	rr = doRequest(srv, "GET", "/api/v1/monitoring/rules", nil)
+	if strings.Contains(rr.Body.String(), tunnelID) {
+		t.Errorf("expected no rule for a disabled tunnel:\n%s", rr.Body.String())
+	}
+}
+
+func TestStatusLive(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "sni", "match_value": []string{"app.example.com"}, "upstream_port": 443,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp", "source_cidr": "0.0.0.0/0", "action": "allow",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The stored view has no in_sync fields
+	body := parseJSON(t, doRequest(srv, "GET", "/api/v1/status", nil))
+	peer := body["tunnels"].(map[string]interface{})["peers"].([]interface{})[0].(map[string]interface{})
+	if _, ok := peer["in_sync"]; ok || body["live"] != nil {
+		t.Error("expected no live view without ?live=true")
+	}
+
+	// Drift: the peer disappeared from the interface, Caddy is unreachable
+	tunnel, _ := srv.tunnelStore.Get(tunnelID)
+	srv.wgManager.RemovePeer(tunnel.PublicKey)
+	srv.caddyClient.(*mockCaddyClient).getErr = fmt.Errorf("connection refused")
+
+	body = parseJSON(t, doRequest(srv, "GET", "/api/v1/status?live=true", nil))
+	peer = body["tunnels"].(map[string]interface{})["peers"].([]interface{})[0].(map[string]interface{})
+	if peer["in_sync"] != false {
+		t.Errorf("expected tunnel out of sync, got %v", peer["in_sync"])
+	}
+	route := body["routes"].(map[string]interface{})["routes"].([]interface{})[0].(map[string]interface{})
+	if v, ok := route["in_sync"]; !ok || v != nil {
+		t.Errorf("expected null in_sync for route when caddy is unreachable, got %v", v)
+	}
+	rule := body["firewall"].(map[string]interface{})["rules"].([]interface{})[0].(map[string]interface{})
+	if rule["in_sync"] != true {
+		t.Errorf("expected firewall rule in sync, got %v", rule["in_sync"])
+	}
+	errs := body["live"].(map[string]interface{})["errors"].(map[string]interface{})
+	if errs["caddy"] != "connection refused" || len(errs) != 1 {
+		t.Errorf("expected only a caddy error, got %v", errs)
+	}
+
+	srv.caddyClient.(*mockCaddyClient).getErr = nil
+	body = parseJSON(t, doRequest(srv, "GET", "/api/v1/status?live=true", nil))
+	route = body["routes"].(map[string]interface{})["routes"].([]interface{})[0].(map[string]interface{})
+	if route["in_sync"] != true {
+		t.Errorf("expected route in sync, got %v", route["in_sync"])
+	}
+}
+
+// --- Leader election tests ---
+
+func TestStandbyRefusesMutations(t *testing.T) {
+	srv, db := setupTestServer(t)
+	leases := store.NewLeaseStore(db)
+	leases.Acquire("controlplane-leader", "cp-b", time.Now(), time.Minute)
+	srv.SetElector(leader.New(leases, "cp-a", 15*time.Second))
+	h := testHandler(t, srv)
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader("{}")))
+		return rr
+	}
+
+	rr := serve("POST", "/api/v1/tunnels")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get(LeaderHeader) != "cp-b" {
+		t.Fatalf("expected 503 naming cp-b, got %d %q", rr.Code, rr.Header().Get(LeaderHeader))
+	}
+	if tunnels, _ := srv.tunnelStore.List(); len(tunnels) != 0 {
+		t.Error("a standby must not create tunnels")
+	}
+
+	rr = serve("GET", "/api/v1/status")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected reads on a standby, got %d", rr.Code)
+	}
+	role := parseJSON(t, rr)["leader"].(map[string]interface{})
+	if role["is_leader"] != false || role["leader_id"] != "cp-b" || role["instance_id"] != "cp-a" {
+		t.Errorf("unexpected leader status %v", role)
+	}
+
+	rr = serve("GET", "/api/v1/health/ready")
+	check := parseJSON(t, rr)["checks"].(map[string]interface{})["leader"].(map[string]interface{})
+	if rr.Code != http.StatusServiceUnavailable || check["ok"] != false {
+		t.Errorf("expected a standby to be not ready, got %d %v", rr.Code, check)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	srv, db := setupTestServer(t)
+	h := testHandler(t, srv)
+	serve := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+
+	rr := serve("POST", "/api/v1/maintenance", map[string]interface{}{"enabled": true, "message": "migrating to a new host"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = serve("POST", "/api/v1/tunnels", map[string]interface{}{})
+	if rr.Code != http.StatusServiceUnavailable || parseJSON(t, rr)["error"] != "migrating to a new host" {
+		t.Fatalf("expected 503 with the operator's message, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if tunnels, _ := srv.tunnelStore.List(); len(tunnels) != 0 {
+		t.Error("maintenance mode must not create tunnels")
+	}
+	rr = serve("GET", "/api/v1/status", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected reads during maintenance, got %d", rr.Code)
+	}
+	if m := parseJSON(t, rr)["maintenance"].(map[string]interface{}); m["enabled"] != true {
+		t.Errorf("expected the status to report maintenance, got %v", m)
+	}
+	// Firewall simulations are POSTs that change nothing
+	rr = serve("POST", "/api/v1/firewall/rules/simulate", map[string]interface{}{"source_ip": "192.0.2.10", "port": 443, "proto": "tcp"})
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected simulations during maintenance, got %d: %s", rr.Code, rr.Body.String())
+	}
+	// Node agents keep reporting; this one is refused only for lacking a certificate
+	if rr = serve("POST", "/api/v1/agent/report", map[string]interface{}{}); rr.Code == http.StatusServiceUnavailable {
+		t.Errorf("expected agent reports during maintenance, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The mode is persisted, so a new server on the same database keeps it
+	restarted := NewServer(srv.cfg, srv.tunnelStore, srv.routeStore, store.NewFirewallStore(db), srv.tenantStore,
+		srv.nodeStore, srv.caddyClient, srv.wgManager, srv.fwManager, nil)
+	h2 := testHandler(t, restarted)
+	rr = httptest.NewRecorder()
+	h2.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/v1/tunnels/tun_x", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected maintenance to survive a restart, got %d", rr.Code)
+	}
+
+	rr = serve("POST", "/api/v1/maintenance", map[string]interface{}{"enabled": false})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr = serve("POST", "/api/v1/tunnels", map[string]interface{}{}); rr.Code != http.StatusCreated {
+		t.Errorf("expected mutations after maintenance, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMaintenanceModeCached(t *testing.T) {
+	srv, db := setupTestServer(t)
+	h := testHandler(t, srv)
+	serve := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+	if rr := serve("POST", "/api/v1/maintenance", map[string]interface{}{"enabled": true}); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("DELETE", "/api/v1/tunnels/tun_x", nil); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rr.Code)
+	}
+
+	// Mutations are checked against the cached mode, without the database
+	if _, err := db.Conn().Exec(`DROP TABLE maintenance`); err != nil {
+		t.Fatal(err)
+	}
+	if rr := serve("DELETE", "/api/v1/tunnels/tun_x", nil); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the cached mode to refuse the mutation, got %d", rr.Code)
+	}
+
+	// Once the cache expires, an unreadable mode leaves the status's field null
+	srv.forgetMaintenance()
+	rr := serve("GET", "/api/v1/status", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if v, ok := parseJSON(t, rr)["maintenance"]; !ok || v != nil {
+		t.Errorf("expected null maintenance, got %v", v)
+	}
+}
+
+// --- Audit log tests ---
+
+func TestAuditLogBodiesAndDiff(t *testing.T) {
+	srv, db := setupTestServer(t)
+	srv.cfg.AuditBodyLimit = 4096
+	h := testHandler(t, srv)
+	serve := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+
+	rr := serve("POST", "/api/v1/tunnels", map[string]interface{}{"labels": map[string]string{"env": "prod"}})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelID := parseJSON(t, rr)["id"].(string)
+	rr = serve("PATCH", "/api/v1/tunnels/"+tunnelID, map[string]interface{}{"labels": map[string]string{"env": "dev"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rows, err := db.Conn().Query(`SELECT method, request_body, diff FROM audit_log ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var entries [][3]string
+	for rows.Next() {
+		var method string
+		var body, diff sql.NullString
+		rows.Scan(&method, &body, &diff)
+		entries = append(entries, [3]string{method, body.String, diff.String})
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %v", entries)
+	}
+
+	var created map[string]map[string]interface{}
+	json.Unmarshal([]byte(entries[0][2]), &created)
+	if created["vpn_ip"]["before"] != nil || created["vpn_ip"]["after"] == nil {
+		t.Errorf("expected create diff from nothing, got %s", entries[0][2])
+	}
+	if entries[1][1] != `{"labels":{"env":"dev"}}` {
+		t.Errorf("unexpected request body %q", entries[1][1])
+	}
+	if want := `{"labels":{"after":{"env":"dev"},"before":{"env":"prod"}}}`; entries[1][2] != want {
+		t.Errorf("diff = %s, want %s", entries[1][2], want)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	body := `{"public_key":"cHVi","preshared_key":"c2VjcmV0","webhook_secret":"s","issue_token":true,"peers":[{"psk":"x"}]}`
+	got := redactBody([]byte(body), 4096)
+	want := `{"issue_token":true,"peers":[{"psk":"[REDACTED]"}],"preshared_key":"[REDACTED]","public_key":"cHVi","webhook_secret":"[REDACTED]"}`
+	if got != want {
+		t.Errorf("redactBody = %s, want %s", got, want)
+	}
+	if got := redactBody([]byte(`{"name":"abcdefghij"}`), 10); got != `{"name":"a...[truncated, 21 bytes]` {
+		t.Errorf("unexpected truncation %q", got)
+	}
+	if got := redactBody([]byte("private_key=abc"), 4096); strings.Contains(got, "abc") {
+		t.Errorf("non-JSON body must not be stored, got %q", got)
+	}
+}
+
+// --- Force reconcile tests ---
+
+func TestForceReconcile(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/reconcile", nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rr.Code)
+	}
+
+	body := parseJSON(t, rr)
+	if body["status"] != "reconciliation triggered" {
+		t.Errorf("expected reconciliation triggered, got %v", body["status"])
+	}
+}
+
+// --- Middleware tests ---
+
+func TestRateLimiting(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rl := NewRateLimiter(ctx, 3, time.Minute)
+	handler := rl.RateLimitMiddleware(srv.mux)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/health", nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i+1, rr.Code)
+		}
+	}
+
+	// 4th request should be rate limited
+	req := httptest.NewRequest("GET", "/api/v1/health", nil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d", rr.Code)
+	}
+}
+
+func TestRateLimiterPersist(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	send := func(handler http.Handler) int {
+		req := httptest.NewRequest("GET", "/api/v1/health", nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rl := NewRateLimiter(ctx, 2, time.Hour)
+	if err := rl.Persist(srv.rateLimits, "read"); err != nil {
+		t.Fatal(err)
+	}
+	handler := rl.RateLimitMiddleware(srv.mux)
+	send(handler)
+	send(handler)
+	if code := send(handler); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", code)
+	}
+
+	// Stopping the limiter ends its goroutine and saves the buckets
+	cancel()
+	select {
+	case <-rl.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("rate limiter did not stop")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	restarted := NewRateLimiter(ctx, 2, time.Hour)
+	if err := restarted.Persist(srv.rateLimits, "read"); err != nil {
+		t.Fatal(err)
+	}
+	if code := send(restarted.RateLimitMiddleware(srv.mux)); code != http.StatusTooManyRequests {
+		t.Errorf("expected the limit to survive a restart, got %d", code)
+	}
+}
+
+func TestRateLimiterSavesChangedBuckets(t *testing.T) {
+	srv, db := setupTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rl := NewRateLimiter(ctx, 2, time.Hour)
+	if err := rl.Persist(srv.rateLimits, "read"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rl.take("ip:192.0.2.1", now)
+	rl.save()
+
+	// A bucket left alone since the last save is not written again
+	if _, err := db.Conn().Exec(`UPDATE rate_limits SET tokens = 0.5 WHERE key = 'ip:192.0.2.1'`); err != nil {
+		t.Fatal(err)
+	}
+	rl.take("ip:192.0.2.2", now)
+	rl.save()
+	buckets, err := srv.rateLimits.List("read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %+v", buckets)
+	}
+	for _, b := range buckets {
+		if b.Key == "ip:192.0.2.1" && b.Tokens != 0.5 {
+			t.Errorf("expected the unchanged bucket to be left alone, got %+v", b)
+		}
+	}
+
+	// Forgotten buckets are deleted
+	rl.cleanup(now.Add(2 * time.Hour))
+	rl.save()
+	if buckets, _ := srv.rateLimits.List("read"); len(buckets) != 0 {
+		t.Errorf("expected the refilled buckets to be deleted, got %+v", buckets)
+	}
+}
+
+func TestHandlerSharesRateLimiters(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.RateLimitRead = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	first := srv.Handler(ctx)
+	second := srv.Handler(context.Background())
+	send := func(handler http.Handler) int {
+		req := httptest.NewRequest("GET", "/api/v1/health", nil)
+		req.RemoteAddr = "192.0.2.1:40000"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	send(first)
+	send(first)
+	if code := send(second); code != http.StatusTooManyRequests {
+		t.Errorf("expected the handlers to share a budget, got %d", code)
+	}
+
+	// Only the first call's context needs canceling for Close to return
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	handler := LoggingMiddleware(srv.mux)
+
+	req := httptest.NewRequest("GET", "/api/v1/health", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rr.Code)
+	}
+}
+
+func TestCreateTunnelInvalidJSON(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	req := httptest.NewRequest("POST", "/api/v1/tunnels", bytes.NewReader([]byte("not json")))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	srv.mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestCreateRouteInvalidJSON(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	req := httptest.NewRequest("POST", "/api/v1/routes", bytes.NewReader([]byte("bad")))
+	rr := httptest.NewRecorder()
+	srv.mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestCreateFirewallRuleInvalidJSON(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	req := httptest.NewRequest("POST", "/api/v1/firewall/rules", bytes.NewReader([]byte("bad")))
+	rr := httptest.NewRecorder()
+	srv.mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestCreateRouteInvalidSNI(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
+	body := parseJSON(t, rr)
+	tunnelID := body["id"].(string)
+
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "sni",
+		"match_value": []string{"invalid domain!!!"}, "upstream_port": 443,
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid SNI, got %d", rr.Code)
+	}
+}
+
+func TestCreateRouteTerminateTLS(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
+	body := parseJSON(t, rr)
+	tunnelID := body["id"].(string)
+
+	invalid := []map[string]interface{}{
+		{"match_type": "sni", "match_value": []string{"*.example.com"}, "terminate_tls": true},
+		{"match_type": "sni", "match_value": []string{"app.example.com"}, "protocol": "quic", "terminate_tls": true},
+		{"match_type": "port_forward", "listen_port": 25565, "terminate_tls": true},
+	}
+	for _, req := range invalid {
+		req["tunnel_id"] = tunnelID
+		req["upstream_port"] = 8080
+		rr = doRequest(srv, "POST", "/api/v1/routes", req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %v, got %d: %s", req, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "sni",
+		"match_value": []string{"app.example.com"}, "upstream_port": 8080, "terminate_tls": true,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["terminate_tls"] != true {
+		t.Errorf("expected terminate_tls in response, got %v", data["terminate_tls"])
+	}
+}
+
+func TestCreateRouteTTL(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	for _, ttl := range []int{-1, maxRouteTTLMinutes + 1} {
+		rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+			"tunnel_id": tunnelID, "match_type": "sni",
+			"match_value": []string{"support.example.com"}, "upstream_port": 8080, "ttl_minutes": ttl,
+		})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for ttl_minutes %d, got %d: %s", ttl, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "sni",
+		"match_value": []string{"support.example.com"}, "upstream_port": 8080, "ttl_minutes": 60,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["expires_at"] == nil {
+		t.Error("expected expires_at in response")
+	}
+	if left, _ := data["ttl_remaining_seconds"].(float64); left <= 3500 || left > 3600 {
+		t.Errorf("expected about an hour of TTL left, got %v", data["ttl_remaining_seconds"])
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/routes", nil)
+	for _, route := range parseJSON(t, rr)["data"].([]interface{}) {
+		route := route.(map[string]interface{})
+		if route["id"] == data["id"] && route["ttl_remaining_seconds"] == nil {
+			t.Error("expected ttl_remaining_seconds in the route list")
+		}
+		if route["id"] != data["id"] && route["ttl_remaining_seconds"] != nil {
+			t.Errorf("expected no TTL on a permanent route, got %v", route["ttl_remaining_seconds"])
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	srv, db := setupTestServer(t)
+	if rr := doRequest(srv, "POST", "/api/v1/import", nil); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a reconciler, got %d", rr.Code)
+	}
+
+	srv.reconciler = reconciler.New(srv.tunnelStore, srv.routeStore, srv.fwStore, srv.caddyClient, srv.wgManager, srv.fwManager, time.Minute)
+	srv.wgManager.AddPeer("pk_hand", "", "10.0.0.5", nil, 25*time.Second)
+	mockCaddy := srv.caddyClient.(*mockCaddyClient)
+	mockCaddy.routes = []caddy.CaddyRoute{caddy.BuildCaddyRoute("", []string{"hand.example.com"}, "10.0.0.5:443", "", false)}
+
+	rr := doRequest(srv, "POST", "/api/v1/import?dry_run=true", nil)
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if rr.Code != http.StatusOK || data["dry_run"] != true || len(data["tunnels"].([]interface{})) != 1 {
+		t.Fatalf("unexpected dry run %d: %s", rr.Code, rr.Body.String())
+	}
+	if tunnels, _ := store.NewTunnelStore(db).List(); len(tunnels) != 0 {
+		t.Fatal("a dry run should not create tunnels")
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/import", nil)
+	data = parseJSON(t, rr)["data"].(map[string]interface{})
+	if rr.Code != http.StatusOK || len(data["tunnels"].([]interface{})) != 1 || len(data["routes"].([]interface{})) != 1 {
+		t.Fatalf("unexpected import %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnel := data["tunnels"].([]interface{})[0].(map[string]interface{})
+	if tunnel["imported"] != true || tunnel["vpn_ip"] != "10.0.0.5" {
+		t.Errorf("unexpected imported tunnel %v", tunnel)
+	}
+	if mockCaddy.routes[0].ID == "" {
+		t.Error("expected the imported Caddy route to be given an @id")
+	}
+
+	// Adopted state is not imported twice
+	rr = doRequest(srv, "POST", "/api/v1/import", nil)
+	data = parseJSON(t, rr)["data"].(map[string]interface{})
+	if len(data["tunnels"].([]interface{})) != 0 || len(data["routes"].([]interface{})) != 0 {
+		t.Errorf("expected nothing left to import, got %s", rr.Body.String())
+	}
+}
+
+// --- Tenant isolation tests ---
+
+func TestTenantIsolation(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.AdminCNs = []string{"ops"}
+
+	tokens := map[string]string{}
+	for _, name := range []string{"team-a", "team-b"} {
+		rr := doRequestAs(srv, "cn:ops", "POST", "/api/v1/tenants", map[string]interface{}{
+			"name": name, "issue_token": true,
+		})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("create tenant %s: expected 201, got %d: %s", name, rr.Code, rr.Body.String())
+		}
+		tokens[name] = parseJSON(t, rr)["data"].(map[string]interface{})["api_token"].(string)
+	}
+
+	rr := doRequestAs(srv, tokens["team-a"], "POST", "/api/v1/tunnels", map[string]interface{}{})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("tenant create tunnel: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelA := parseJSON(t, rr)["id"].(string)
+	doRequestAs(srv, tokens["team-b"], "POST", "/api/v1/tunnels", map[string]interface{}{})
+
+	// Each tenant sees only its own tunnel
+	rr = doRequestAs(srv, tokens["team-a"], "GET", "/api/v1/tunnels", nil)
+	if data := parseJSON(t, rr)["data"].([]interface{}); len(data) != 1 {
+		t.Errorf("expected team-a to see 1 tunnel, got %d", len(data))
+	}
+
+	// Another tenant cannot delete it
+	rr = doRequestAs(srv, tokens["team-b"], "DELETE", "/api/v1/tunnels/"+tunnelA, nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for cross-tenant delete, got %d", rr.Code)
+	}
+
+	// Nor attach routes to it
+	rr = doRequestAs(srv, tokens["team-b"], "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelA, "match_type": "sni", "match_value": []string{"b.example.com"}, "upstream_port": 443,
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for cross-tenant route, got %d", rr.Code)
+	}
+
+	// Admin sees everything
+	rr = doRequestAs(srv, "cn:ops", "GET", "/api/v1/tunnels", nil)
+	if data := parseJSON(t, rr)["data"].([]interface{}); len(data) != 2 {
+		t.Errorf("expected admin to see 2 tunnels, got %d", len(data))
+	}
+
+	// Tenants cannot manage tenants
+	rr = doRequestAs(srv, tokens["team-a"], "GET", "/api/v1/tenants", nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for tenant listing tenants, got %d", rr.Code)
+	}
+}
+
+func TestPolicyEnforcement(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.AdminCNs = []string{"ops"}
+
+	tokens := map[string]string{}
+	tenantIDs := map[string]string{}
+	for _, name := range []string{"team-a", "team-b"} {
+		rr := doRequestAs(srv, "cn:ops", "POST", "/api/v1/tenants", map[string]interface{}{
+			"name": name, "issue_token": true,
+		})
+		data := parseJSON(t, rr)["data"].(map[string]interface{})
+		tokens[name], tenantIDs[name] = data["api_token"].(string), data["id"].(string)
+	}
+
+	rr := doRequestAs(srv, "cn:ops", "PUT", "/api/v1/policies/global", map[string]interface{}{
+		"port_ranges":     []map[string]int{{"start": 1024, "end": 65535}},
+		"forbidden_cidrs": []string{"10.10.0.0/16"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("set global policy: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequestAs(srv, "cn:ops", "PUT", "/api/v1/policies/"+tenantIDs["team-b"], map[string]interface{}{
+		"domain_suffixes": []string{"B.example.com"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("set tenant policy: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := parseJSON(t, rr)["data"].(map[string]interface{})["domain_suffixes"].([]interface{}); len(got) != 1 || got[0] != "b.example.com" {
+		t.Errorf("expected the suffix to be normalized, got %v", got)
+	}
+
+	// Only admins set policies, and a suffix belongs to one tenant
+	rr = doRequestAs(srv, tokens["team-a"], "PUT", "/api/v1/policies/global", map[string]interface{}{})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a tenant setting a policy, got %d", rr.Code)
+	}
+	rr = doRequestAs(srv, "cn:ops", "PUT", "/api/v1/policies/"+tenantIDs["team-a"], map[string]interface{}{
+		"domain_suffixes": []string{"b.example.com"},
+	})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a suffix held by another tenant, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Tenants see the global policy and their own
+	rr = doRequestAs(srv, tokens["team-a"], "GET", "/api/v1/policies", nil)
+	if data := parseJSON(t, rr)["data"].([]interface{}); len(data) != 1 {
+		t.Errorf("expected team-a to see 1 policy, got %d", len(data))
+	}
+
+	rr = doRequestAs(srv, tokens["team-a"], "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelA := parseJSON(t, rr)["id"].(string)
+	rr = doRequestAs(srv, tokens["team-b"], "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelB := parseJSON(t, rr)["id"].(string)
+
+	forbidden := []struct {
+		name, who, method, path string
+		body                    map[string]interface{}
+	}{
+		{"another tenant's domain", tokens["team-a"], "POST", "/api/v1/routes", map[string]interface{}{
+			"tunnel_id": tunnelA, "match_type": "sni", "match_value": []string{"app.b.example.com"}, "upstream_port": 443}},
+		{"a wildcard over another tenant's suffix", tokens["team-a"], "POST", "/api/v1/routes", map[string]interface{}{
+			"tunnel_id": tunnelA, "match_type": "sni", "match_value": []string{"*.example.com"}, "upstream_port": 443}},
+		{"a domain outside the tenant's suffixes", tokens["team-b"], "POST", "/api/v1/routes", map[string]interface{}{
+			"tunnel_id": tunnelB, "match_type": "sni", "match_value": []string{"a.example.org"}, "upstream_port": 443}},
+		{"a port below the allowed range", tokens["team-a"], "POST", "/api/v1/routes", map[string]interface{}{
+			"tunnel_id": tunnelA, "match_type": "port_forward", "protocol": "tcp", "listen_port": 80, "upstream_port": 80}},
+		{"a firewall port below the allowed range", tokens["team-a"], "POST", "/api/v1/firewall/rules", map[string]interface{}{
+			"port": 80, "proto": "tcp"}},
+		{"a source within a forbidden CIDR", tokens["team-a"], "PATCH", "/api/v1/tunnels/" + tunnelA, map[string]interface{}{
+			"source_cidr": "10.10.1.0/24"}},
+		{"an advertised route overlapping a forbidden CIDR", "cn:ops", "POST", "/api/v1/tunnels", map[string]interface{}{
+			"advertised_routes": []string{"10.10.0.0/15"}}},
+		{"a firewall rule open to any source", tokens["team-a"], "POST", "/api/v1/firewall/rules", map[string]interface{}{
+			"port": 8443, "proto": "tcp"}},
+		{"a firewall source containing a forbidden CIDR", tokens["team-a"], "POST", "/api/v1/firewall/rules", map[string]interface{}{
+			"port": 8443, "proto": "tcp", "source_cidr": "10.0.0.0/8"}},
+		{"a firewall destination within a forbidden CIDR", tokens["team-a"], "POST", "/api/v1/firewall/rules", map[string]interface{}{
+			"port": 8443, "proto": "tcp", "source_cidr": "192.0.2.0/24", "chain": "forward", "dest_cidr": "10.10.1.0/24"}},
+	}
+	for _, tc := range forbidden {
+		rr := doRequestAs(srv, tc.who, tc.method, tc.path, tc.body)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d: %s", tc.name, rr.Code, rr.Body.String())
+		}
+	}
+
+	allowed := []struct {
+		name, who, path string
+		body            map[string]interface{}
+	}{
+		{"the tenant's own domain", tokens["team-b"], "/api/v1/routes", map[string]interface{}{
+			"tunnel_id": tunnelB, "match_type": "sni", "match_value": []string{"app.b.example.com"}, "upstream_port": 443}},
+		{"an unreserved domain", tokens["team-a"], "/api/v1/routes", map[string]interface{}{
+			"tunnel_id": tunnelA, "match_type": "sni", "match_value": []string{"a.example.org"}, "upstream_port": 443}},
+		{"a port in the allowed range", tokens["team-a"], "/api/v1/routes", map[string]interface{}{
+			"tunnel_id": tunnelA, "match_type": "port_forward", "protocol": "tcp", "listen_port": 8080, "upstream_port": 80}},
+		{"a firewall rule from outside the forbidden CIDRs", tokens["team-a"], "/api/v1/firewall/rules", map[string]interface{}{
+			"port": 8443, "proto": "tcp", "source_cidr": "192.0.2.0/24"}},
+	}
+	for _, tc := range allowed {
+		rr := doRequestAs(srv, tc.who, "POST", tc.path, tc.body)
+		if rr.Code != http.StatusCreated {
+			t.Errorf("%s: expected 201, got %d: %s", tc.name, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Without the policies the port is allowed again
+	for _, scope := range []string{"global", tenantIDs["team-b"]} {
+		if rr := doRequestAs(srv, "cn:ops", "DELETE", "/api/v1/policies/"+scope, nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("delete policy %s: expected 204, got %d", scope, rr.Code)
+		}
+	}
+	rr = doRequestAs(srv, tokens["team-a"], "POST", "/api/v1/firewall/rules", map[string]interface{}{"port": 80, "proto": "tcp"})
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected 201 without policies, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestTenantAuthenticationFailures(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.AdminCNs = []string{"ops"}
+
+	rr := doRequestAs(srv, "pmt_bogus", "GET", "/api/v1/tunnels", nil)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for invalid token, got %d", rr.Code)
+	}
+
+	rr = doRequestAs(srv, "cn:stranger", "GET", "/api/v1/tunnels", nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for unmapped CN, got %d", rr.Code)
+	}
+
+	// Health stays unauthenticated
+	rr = doRequestAs(srv, "", "GET", "/api/v1/health", nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for health, got %d", rr.Code)
+	}
+}
+
+func TestDeleteTenantWithResources(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tenants", map[string]interface{}{"name": "team-a", "client_cn": "team-a-client"})
+	tenantID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+
+	rr = doRequestAs(srv, "cn:team-a-client", "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	ruleID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+
+	rr = doRequest(srv, "DELETE", "/api/v1/tenants/"+tenantID, nil)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 while tenant owns resources, got %d", rr.Code)
+	}
+
+	doRequest(srv, "DELETE", "/api/v1/firewall/rules/"+ruleID, nil)
+	rr = doRequest(srv, "DELETE", "/api/v1/tenants/"+tenantID, nil)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRoleEnforcement(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.AdminCNs = []string{"ops"}
+	srv.cfg.RoleMap = map[string]string{"cn:deployer": "operator", "ou:viewers": "read-only"}
+
+	rr := doRequestAs(srv, "cn:deployer", "POST", "/api/v1/tunnels", map[string]interface{}{})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("operator create tunnel: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	// Read-only callers (mapped by OU) can list but not mutate
+	rr = doRequestAs(srv, "cn:alice,ou:viewers", "GET", "/api/v1/tunnels", nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("read-only list: expected 200, got %d", rr.Code)
+	}
+	rr = doRequestAs(srv, "cn:alice,ou:viewers", "DELETE", "/api/v1/tunnels/"+tunnelID, nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("read-only delete: expected 403, got %d", rr.Code)
+	}
+	rr = doRequestAs(srv, "cn:alice,ou:viewers", "GET", "/api/v1/tunnels/"+tunnelID+"/config", nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("read-only config download: expected 403, got %d", rr.Code)
+	}
+
+	// Operators cannot manage tenants
+	rr = doRequestAs(srv, "cn:deployer", "POST", "/api/v1/tenants", map[string]interface{}{"name": "x", "issue_token": true})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("operator create tenant: expected 403, got %d", rr.Code)
+	}
+
+	// Unmapped clients are rejected unless DEFAULT_ROLE is set
+	rr = doRequestAs(srv, "cn:stranger", "GET", "/api/v1/tunnels", nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("unmapped client: expected 403, got %d", rr.Code)
+	}
+	srv.cfg.DefaultRole = "read-only"
+	rr = doRequestAs(srv, "cn:stranger", "GET", "/api/v1/tunnels", nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("default role: expected 200, got %d", rr.Code)
+	}
+
+	rr = doRequestAs(srv, "cn:ops", "DELETE", "/api/v1/tunnels/"+tunnelID, nil)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("admin delete: expected 204, got %d", rr.Code)
+	}
+}
+
+func TestReadOnlyTenantToken(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.AdminCNs = []string{"ops"}
+
+	rr := doRequestAs(srv, "cn:ops", "POST", "/api/v1/tenants", map[string]interface{}{
+		"name": "auditors", "issue_token": true, "token_scope": "read-only",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create tenant: expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	token := parseJSON(t, rr)["data"].(map[string]interface{})["api_token"].(string)
+
+	rr = doRequestAs(srv, token, "GET", "/api/v1/tunnels", nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("read-only token list: expected 200, got %d", rr.Code)
+	}
+	rr = doRequestAs(srv, token, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("read-only token create: expected 403, got %d", rr.Code)
+	}
+
+	rr = doRequestAs(srv, "cn:ops", "POST", "/api/v1/tenants", map[string]interface{}{
+		"name": "bad", "issue_token": true, "token_scope": "admin",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("admin token scope: expected 400, got %d", rr.Code)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "GET", "/api/v1/openapi.json", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	spec := parseJSON(t, rr)
+	if spec["openapi"] != "3.1.0" {
+		t.Errorf("expected openapi 3.1.0, got %v", spec["openapi"])
+	}
+
+	// Every registered endpoint is documented with a unique operation ID
+	paths := spec["paths"].(map[string]interface{})
+	seen := map[string]bool{}
+	for _, e := range srv.endpoints() {
+		item, ok := paths[e.path].(map[string]interface{})
+		if !ok {
+			t.Fatalf("path %s missing from spec", e.path)
+		}
+		op, ok := item[strings.ToLower(e.method)].(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s %s missing from spec", e.method, e.path)
+		}
+		id := op["operationId"].(string)
+		if id == "" || seen[id] {
+			t.Errorf("%s %s: empty or duplicate operationId %q", e.method, e.path, id)
+		}
+		seen[id] = true
+	}
+
+	// A PUT by name either updates or creates
+	put := paths["/api/v1/routes/by-name/{name}"].(map[string]interface{})["put"].(map[string]interface{})
+	responses := put["responses"].(map[string]interface{})
+	if responses["200"] == nil || responses["201"] == nil {
+		t.Errorf("expected 200 and 201 declared for PUT by name, got %v", responses)
+	}
+
+	// Request schemas come from the request structs
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	tunnel := schemas["CreateTunnelRequest"].(map[string]interface{})["properties"].(map[string]interface{})
+	labels, ok := tunnel["labels"].(map[string]interface{})
+	if !ok || labels["type"] != "object" {
+		t.Errorf("expected labels object in CreateTunnelRequest, got %v", tunnel["labels"])
+	}
+}
+
+func TestGetTunnelStats(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	created := parseJSON(t, rr)
+	id := created["id"].(string)
+	tunnel, _ := srv.tunnelStore.Get(id)
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.tunnelStore.RecordStatsSample(tunnel.PublicKey, 0, 0, base)
+	srv.tunnelStore.RecordStatsSample(tunnel.PublicKey, 7500, 750, base.Add(30*time.Minute))
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/stats?from=2024-01-01T00:00:00Z&to=2024-01-01T01:00:00Z&resolution=1h", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	buckets := data["buckets"].([]interface{})
+	if len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(buckets))
+	}
+	first := buckets[0].(map[string]interface{})
+	if first["rx_bytes"].(float64) != 7500 {
+		t.Errorf("expected rx_bytes 7500, got %v", first["rx_bytes"])
+	}
+	if first["rx_bps"].(float64) != 7500*8/3600.0 {
+		t.Errorf("unexpected rx_bps %v", first["rx_bps"])
+	}
+
+	for _, q := range []string{"?resolution=abc", "?resolution=1s", "?from=yesterday", "?from=2024-01-02T00:00:00Z&to=2024-01-01T00:00:00Z"} {
+		rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/stats"+q, nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", q, rr.Code)
+		}
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/tun_missing/stats", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+func TestRouteConnectionStats(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	tunnelID := parseJSON(t, rr)["id"].(string)
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id":     tunnelID,
+		"match_type":    "sni",
+		"match_value":   []string{"stats.example.com"},
+		"upstream_port": 8080,
+	})
+	routeID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+
+	// No samples yet
+	rr = doRequest(srv, "GET", "/api/v1/routes/"+routeID, nil)
+	if conns := parseJSON(t, rr)["data"].(map[string]interface{})["connections"]; conns != nil {
+		t.Fatalf("expected no connections before sampling, got %v", conns)
+	}
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.routeStore.RecordStatsSample(routeID, 1, 0, 0, base)
+	srv.routeStore.RecordStatsSample(routeID, 3, 7500, 750, base.Add(30*time.Minute))
+
+	rr = doRequest(srv, "GET", "/api/v1/routes", nil)
+	entry := parseJSON(t, rr)["data"].([]interface{})[0].(map[string]interface{})
+	conns, ok := entry["connections"].(map[string]interface{})
+	if !ok || conns["active"].(float64) != 3 || conns["rx_bytes"].(float64) != 7500 || conns["sampled_at"] != "2024-01-01T00:30:00Z" {
+		t.Errorf("unexpected connections %v", entry["connections"])
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/routes/"+routeID+"/stats?from=2024-01-01T00:00:00Z&to=2024-01-01T01:00:00Z&resolution=1h", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	first := data["buckets"].([]interface{})[0].(map[string]interface{})
+	if first["rx_bytes"].(float64) != 7500 || first["max_active"].(float64) != 3 {
+		t.Errorf("unexpected first bucket %v", first)
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/routes/"+routeID+"/stats?resolution=1s", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+	rr = doRequest(srv, "GET", "/api/v1/routes/route_missing/stats", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+func TestDeferRevocationAndExpiringSoon(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.InactivityWarning = 7 * 24 * time.Hour
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	id := parseJSON(t, rr)["id"].(string)
+	tunnel, _ := srv.tunnelStore.Get(id)
+
+	// Last handshake 88 days ago: revocation in 2 days (default expiry is 90)
+	hs := time.Now().Add(-88 * 24 * time.Hour)
+	srv.tunnelStore.UpdatePeerStats(tunnel.PublicKey, &hs, 0, 0)
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels", nil)
+	entry := parseJSON(t, rr)["data"].([]interface{})[0].(map[string]interface{})
+	if entry["expiring_soon"] != true {
+		t.Fatalf("expected expiring_soon, got %v", entry["expiring_soon"])
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/tunnels/"+id+"/defer-revocation", map[string]interface{}{"days": 30})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if parseJSON(t, rr)["expiring_soon"] != false {
+		t.Error("expected expiring_soon=false after deferral")
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/status", nil)
+	tunnels := parseJSON(t, rr)["tunnels"].(map[string]interface{})
+	if tunnels["expiring_soon"].(float64) != 0 {
+		t.Errorf("expected 0 expiring tunnels in status, got %v", tunnels["expiring_soon"])
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/tunnels/"+id+"/defer-revocation", map[string]interface{}{"days": 0})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for days=0, got %d", rr.Code)
+	}
+}
+
+// writeTestCert writes a self-signed certificate and key for cn, valid for
+// a week and usable as a CA.
+func writeTestCert(t *testing.T, certFile, keyFile, cn string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(7 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, "old")
+
+	r, err := NewCertReloader(&config.Config{TLSCert: certFile, TLSKey: keyFile})
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	current := func() string {
+		cert, err := r.TLSConfig().GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.Subject.CommonName
+	}
+	if got := current(); got != "old" {
+		t.Fatalf("expected old cert, got %s", got)
+	}
+
+	// A half-written renewal (new cert, old key) keeps serving the old pair.
+	writeTestCert(t, certFile, filepath.Join(dir, "unused.key"), "new")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	r.reloadIfChanged()
+	if got := current(); got != "old" {
+		t.Fatalf("expected old cert after mismatched reload, got %s", got)
+	}
+
+	// Once the key is in place too, the next check swaps them in.
+	writeTestCert(t, certFile, keyFile, "new")
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	r.reloadIfChanged()
+	if got := current(); got != "new" {
+		t.Fatalf("expected renewed cert, got %s", got)
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	srv, db := setupTestServer(t)
+	if rr := doRequest(srv, "POST", "/api/v1/certs", map[string]interface{}{"common_name": "alice"}); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without a CA key, got %d", rr.Code)
+	}
+
+	dir := t.TempDir()
+	caFile, caKey := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	writeTestCert(t, caFile, caKey, "test-ca")
+	authority, err := ca.Load(caFile, caKey)
+	if err != nil {
+		t.Fatalf("load CA: %v", err)
+	}
+	srv.SetCA(authority, store.NewCertStore(db))
+
+	for _, body := range []map[string]interface{}{
+		{"common_name": ""},
+		{"common_name": "bad\nname"},
+		{"common_name": "alice", "validity_days": 4000},
+		{"common_name": "alice", "validity_days": 30}, // beyond the CA's expiry
+		{"common_name": "alice", "csr": "not a csr"},
+	} {
+		if rr := doRequest(srv, "POST", "/api/v1/certs", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %v, got %d: %s", body, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := doRequestAs(srv, "cn:root", "POST", "/api/v1/certs", map[string]interface{}{"common_name": "alice", "organizational_unit": "ops", "validity_days": 1})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("issue: %d %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	id := data["id"].(string)
+	if data["private_key"] == "" || data["issued_by"] != "root" || data["revoked"] != false {
+		t.Errorf("unexpected issue response %v", data)
+	}
+	block, _ := pem.Decode([]byte(data["certificate"].(string)))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || cert.Subject.CommonName != "alice" || cert.SerialNumber.Text(16) != id {
+		t.Fatalf("unexpected certificate %v (err %v)", cert.Subject, err)
+	}
+
+	// The revocation check runs on verified client certificates in the handshake
+	reloader, err := NewCertReloader(&config.Config{TLSCert: caFile, TLSKey: caKey, TLSClientCA: caFile})
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	reloader.SetRevocationCheck(srv.CheckRevocation)
+	verify := reloader.TLSConfig().VerifyConnection
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); err != nil {
+		t.Fatalf("expected the new certificate accepted, got %v", err)
+	}
+
+	if rr := doRequest(srv, "POST", "/api/v1/certs/"+id+"/revoke", map[string]interface{}{"reason": "laptop lost"}); rr.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := doRequest(srv, "POST", "/api/v1/certs/"+id+"/revoke", nil); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 revoking twice, got %d", rr.Code)
+	}
+	if rr := doRequest(srv, "POST", "/api/v1/certs/ffff/revoke", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown serial, got %d", rr.Code)
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); err == nil {
+		t.Error("expected the revoked certificate refused in the handshake")
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/certs/"+id, nil)
+	data = parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["revoked"] != true || data["revocation_reason"] != "laptop lost" {
+		t.Errorf("unexpected revoked cert %v", data)
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/certs/crl", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("crl: %d %s", rr.Code, rr.Body.String())
+	}
+	block, _ = pem.Decode(rr.Body.Bytes())
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse CRL: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("expected the revoked serial on the CRL, got %+v", crl.RevokedCertificateEntries)
+	}
+}
+
+type recordingDNSProvider struct {
+	set     []string
+	deleted []string
+}
+
+func (p *recordingDNSProvider) SetRecords(_ context.Context, name, rtype string, values []string, _ int) error {
+	p.set = append(p.set, rtype+" "+name+" "+strings.Join(values, ","))
+	return nil
+}
+
+func (p *recordingDNSProvider) DeleteRecords(_ context.Context, name, rtype string) error {
+	p.deleted = append(p.deleted, rtype+" "+name)
+	return nil
+}
+
+func TestTunnelDNSRecords(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	provider := &recordingDNSProvider{}
+	srv.SetDNS(dns.NewUpdater(provider, netip.MustParseAddr("203.0.113.10"), netip.Addr{}, 300))
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains":       []string{"app.example.com"},
+		"upstream_port": 443,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelID := parseJSON(t, rr)["id"].(string)
+	srv.background.wait()
+	if len(provider.set) != 1 || provider.set[0] != "A app.example.com 203.0.113.10" {
+		t.Errorf("expected A record for app.example.com, got %v", provider.set)
+	}
+
+	rr = doRequest(srv, "DELETE", "/api/v1/tunnels/"+tunnelID+"?force=true", nil)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	srv.background.wait()
+	if len(provider.deleted) != 1 || provider.deleted[0] != "A app.example.com" {
+		t.Errorf("expected A record removed, got %v", provider.deleted)
+	}
+}
+
+// --- Node tests ---
+
+func TestNodeAgentFlow(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/nodes", map[string]interface{}{"name": "edge-1", "client_cn": "agent-edge-1"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	nodeID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+
+	// Unregistered nodes can't take tunnels
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"node_id": nodeID})
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for unregistered node, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"node_id": "node_missing"})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown node, got %d", rr.Code)
+	}
+
+	// The agent certificate only works on the agent endpoints
+	rr = doRequestAs(srv, "cn:agent-edge-1", "GET", "/api/v1/tunnels", nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for agent certificate on management API, got %d", rr.Code)
+	}
+	rr = doRequestAs(srv, "cn:someone-else", "GET", "/api/v1/agent/state", nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for non-agent certificate, got %d", rr.Code)
+	}
+
+	nodeKey := "bm9kZWtleW5vZGVrZXlub2Rla2V5bm9kZWtleW5vZGU="
+	rr = doRequestAs(srv, "cn:agent-edge-1", "POST", "/api/v1/agent/register", map[string]interface{}{
+		"public_key": nodeKey, "endpoint": "198.51.100.20:51820", "version": "1.0.0",
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"node_id": nodeID, "domains": []string{"app.example.com"}, "upstream_port": 443,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	tunnelID := created["id"].(string)
+	config := created["config"].(string)
+	if !strings.Contains(config, "PublicKey = "+nodeKey) || !strings.Contains(config, "Endpoint = 198.51.100.20:51820") {
+		t.Errorf("expected config to point at the node, got:\n%s", config)
+	}
+	if peers, _ := srv.wgManager.ListPeers(); len(peers) != 0 {
+		t.Errorf("expected no local peer for a node tunnel, got %v", peers)
+	}
+
+	// The agent receives the tunnel with its pending PSK
+	rr = doRequestAs(srv, "cn:agent-edge-1", "GET", "/api/v1/agent/state", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	state := parseJSON(t, rr)["data"].(map[string]interface{})
+	tunnels := state["tunnels"].([]interface{})
+	if len(tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel in node state, got %d", len(tunnels))
+	}
+	psk, _ := tunnels[0].(map[string]interface{})["preshared_key"].(string)
+	if psk == "" {
+		t.Fatal("expected the pending PSK in node state")
+	}
+	if routes := state["routes"].([]interface{}); len(routes) != 1 {
+		t.Errorf("expected 1 route in node state, got %d", len(routes))
+	}
+
+	rr = doRequestAs(srv, "cn:agent-edge-1", "POST", "/api/v1/agent/report", map[string]interface{}{
+		"applied_psks": []map[string]interface{}{{"tunnel_id": tunnelID, "psk_hash": wireguard.HashPSK(psk)}},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if tunnel, _ := srv.tunnelStore.Get(tunnelID); tunnel.PendingPSK != "" {
+		t.Error("expected the acknowledged PSK to be cleared")
+	}
+	node, _ := srv.nodeStore.Get(nodeID)
+	if node.LastSeenAt == nil || node.AgentVersion != "1.0.0" {
+		t.Errorf("expected node seen with version, got %+v", node)
+	}
+
+	rr = doRequest(srv, "DELETE", "/api/v1/nodes/"+nodeID, nil)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 deleting a node with tunnels, got %d", rr.Code)
+	}
+	doRequest(srv, "DELETE", "/api/v1/tunnels/"+tunnelID+"?force=true", nil)
+	rr = doRequest(srv, "DELETE", "/api/v1/nodes/"+nodeID, nil)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestNodeFailover(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	sharedKey := "c2hhcmVka2V5c2hhcmVka2V5c2hhcmVka2V5c2hhcmU="
+	otherKey := "b3RoZXJrZXlvdGhlcmtleW90aGVya2V5b3RoZXJrZXk="
+	for _, n := range []struct{ name, key string }{{"edge-1", sharedKey}, {"edge-2", sharedKey}, {"edge-3", otherKey}} {
+		rr := doRequest(srv, "POST", "/api/v1/nodes", map[string]interface{}{
+			"name": n.name, "client_cn": "agent-" + n.name, "endpoint": "192.0.2.1:51820",
+		})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+		}
+		doRequestAs(srv, "cn:agent-"+n.name, "POST", "/api/v1/agent/register", map[string]interface{}{"public_key": n.key})
+	}
+	nodes, _ := srv.nodeStore.List()
+	primary, standby, other := nodes[0].ID, nodes[1].ID, nodes[2].ID
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"failover_node_ids": []string{standby}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for failover nodes without node_id, got %d", rr.Code)
+	}
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"node_id": primary, "failover_node_ids": []string{other}})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a failover node with a different key, got %d", rr.Code)
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"node_id": primary, "failover_node_ids": []string{standby}, "domains": []string{"app.example.com"},
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelID := parseJSON(t, rr)["id"].(string)
+
+	// Both nodes receive the tunnel, its route, and the PSK until each applies it
+	ack := func(cn string) {
+		rr := doRequestAs(srv, cn, "GET", "/api/v1/agent/state", nil)
+		state := parseJSON(t, rr)["data"].(map[string]interface{})
+		tunnels, routes := state["tunnels"].([]interface{}), state["routes"].([]interface{})
+		if len(tunnels) != 1 || len(routes) != 1 {
+			t.Fatalf("expected 1 tunnel and 1 route for %s, got %d and %d", cn, len(tunnels), len(routes))
+		}
+		psk, _ := tunnels[0].(map[string]interface{})["preshared_key"].(string)
+		if psk == "" {
+			t.Fatalf("expected a pending PSK for %s", cn)
+		}
+		doRequestAs(srv, cn, "POST", "/api/v1/agent/report", map[string]interface{}{
+			"applied_psks": []map[string]interface{}{{"tunnel_id": tunnelID, "psk_hash": wireguard.HashPSK(psk)}},
+		})
+	}
+	ack("cn:agent-edge-1")
+	if tunnel, _ := srv.tunnelStore.Get(tunnelID); tunnel.PendingPSK == "" {
+		t.Fatal("expected the PSK to stay pending until the failover node applies it")
+	}
+	ack("cn:agent-edge-2")
+	if tunnel, _ := srv.tunnelStore.Get(tunnelID); tunnel.PendingPSK != "" {
+		t.Error("expected the PSK to be cleared once every node applied it")
+	}
+
+	routes, _ := srv.routeStore.ListByTunnelID(tunnelID)
+	srv.nodeStore.RecordSeen(primary, time.Now(), "caddy unreachable")
+	rr = doRequest(srv, "GET", "/api/v1/routes/"+routes[0].ID+"/nodes", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	status := parseJSON(t, rr)["data"].(map[string]interface{})
+	if status["active_node_id"] != standby {
+		t.Errorf("expected traffic to fail over to %s, got %v", standby, status["active_node_id"])
+	}
+	entries := status["nodes"].([]interface{})
+	if len(entries) != 2 || entries[0].(map[string]interface{})["status"] != "degraded" ||
+		entries[1].(map[string]interface{})["status"] != "serving" {
+		t.Errorf("unexpected node statuses: %v", entries)
+	}
+
+	rr = doRequest(srv, "DELETE", "/api/v1/nodes/"+standby, nil)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 deleting a failover node in use, got %d", rr.Code)
+	}
+}
+
+func TestGetTunnelEvents(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	id := parseJSON(t, rr)["id"].(string)
+	at := time.Unix(1_700_000_000, 0)
+	srv.tunnelStore.RecordConnection(id, true, "198.51.100.7:51820", at)
+	srv.tunnelStore.RecordConnection(id, false, "198.51.100.7:51820", at.Add(time.Hour))
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/events", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	events := parseJSON(t, rr)["data"].([]interface{})
+	if len(events) != 2 || events[0].(map[string]interface{})["type"] != "disconnected" ||
+		events[1].(map[string]interface{})["at"] != "2023-11-14T22:13:20Z" {
+		t.Errorf("unexpected events: %v", events)
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/tun_missing/events", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+func TestTunnelConnectionSettings(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"persistent_keepalive": 10})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	id := created["id"].(string)
+	if !strings.Contains(created["config"].(string), "PersistentKeepalive = 10\n") {
+		t.Errorf("expected keepalive 10 in config, got:\n%s", created["config"])
+	}
+	if created["connected_threshold"] != float64(300) {
+		t.Errorf("expected the default connected threshold, got %v", created["connected_threshold"])
+	}
+	peerKeepalive := func() time.Duration {
+		peers, _ := srv.wgManager.ListPeers()
+		return peers[0].Keepalive
+	}
+	if got := peerKeepalive(); got != 10*time.Second {
+		t.Errorf("expected peer keepalive 10s, got %s", got)
+	}
+
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{
+		"persistent_keepalive": 0, "connected_threshold": 600,
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["persistent_keepalive"] != float64(0) || data["connected_threshold"] != float64(600) {
+		t.Errorf("unexpected settings: %v", data)
+	}
+	if got := peerKeepalive(); got != 0 {
+		t.Errorf("expected peer keepalive disabled, got %s", got)
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/config", nil)
+	if strings.Contains(rr.Body.String(), "PersistentKeepalive") {
+		t.Errorf("expected no keepalive in config, got:\n%s", rr.Body.String())
+	}
+
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"persistent_keepalive": 70000})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for out-of-range keepalive, got %d", rr.Code)
+	}
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"connected_threshold": 0})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for zero connected threshold, got %d", rr.Code)
+	}
+}
+
+func TestTunnelClientRouting(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"client_routing": "full"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	id := created["id"].(string)
+	if !strings.Contains(created["config"].(string), "AllowedIPs = 0.0.0.0/0, ::/0\n") {
+		t.Errorf("expected a full-tunnel config, got:\n%s", created["config"])
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/config", nil)
+	if !strings.Contains(rr.Body.String(), "AllowedIPs = 0.0.0.0/0, ::/0\n") {
+		t.Errorf("expected the stored mode in the config, got:\n%s", rr.Body.String())
+	}
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/config?routing=subnet", nil)
+	if !strings.Contains(rr.Body.String(), "AllowedIPs = 10.0.0.0/24\n") {
+		t.Errorf("expected the subnet in the config, got:\n%s", rr.Body.String())
+	}
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/config?routing=everything", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown routing mode, got %d", rr.Code)
+	}
+
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"client_routing": "split"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if routing := parseJSON(t, rr)["data"].(map[string]interface{})["client_routing"]; routing != "split" {
+		t.Errorf("expected split routing, got %v", routing)
+	}
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id+"/config", nil)
+	if !strings.Contains(rr.Body.String(), "AllowedIPs = 10.0.0.1/32\n") {
+		t.Errorf("expected the server IP in the config, got:\n%s", rr.Body.String())
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"client_routing": "all"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown client_routing, got %d", rr.Code)
+	}
+}
+
+func TestTunnelClientDNSAndMTU(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"dns": []string{"10.0.0.53", "corp.example.com"}, "mtu": 1380,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	config := created["config"].(string)
+	if !strings.Contains(config, "DNS = 10.0.0.53, corp.example.com\nMTU = 1380\n") {
+		t.Errorf("expected DNS and MTU in config, got:\n%s", config)
+	}
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+created["id"].(string)+"/config", nil)
+	if !strings.Contains(rr.Body.String(), "MTU = 1380\n") {
+		t.Errorf("expected MTU in downloaded config, got:\n%s", rr.Body.String())
+	}
+
+	// Omitted DNS keeps the default; an empty list leaves it out
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	if !strings.Contains(parseJSON(t, rr)["config"].(string), "DNS = 1.1.1.1\n") {
+		t.Error("expected the default DNS")
+	}
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"dns": []string{}})
+	if strings.Contains(parseJSON(t, rr)["config"].(string), "DNS") {
+		t.Error("expected no DNS line for an empty list")
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"dns": []string{"not a domain"}},
+		{"mtu": 100},
+	} {
+		rr = doRequest(srv, "POST", "/api/v1/tunnels", body)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %v, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestCreateTunnelStaticVPNIP(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"vpn_ip": "10.0.0.50"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	if created["vpn_ip"] != "10.0.0.50" || !strings.Contains(created["config"].(string), "Address = 10.0.0.50/32") {
+		t.Errorf("expected the requested address, got %v", created["vpn_ip"])
+	}
+
+	// Allocation still hands out the lowest free address
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{})
+	if vpnIP := parseJSON(t, rr)["vpn_ip"]; vpnIP != "10.0.0.2" {
+		t.Errorf("expected the first free address, got %v", vpnIP)
+	}
+
+	tests := []struct {
+		vpnIP string
+		code  int
+	}{
+		{"10.0.0.50", http.StatusConflict},
+		{"10.0.1.5", http.StatusBadRequest},
+		{"10.0.0.1", http.StatusBadRequest},
+		{"10.0.0.255", http.StatusBadRequest},
+		{"10.0.0.0", http.StatusBadRequest},
+		{"fd00::5", http.StatusBadRequest},
+		{"not-an-ip", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"vpn_ip": tt.vpnIP})
+		if rr.Code != tt.code {
+			t.Errorf("vpn_ip %s: expected %d, got %d: %s", tt.vpnIP, tt.code, rr.Code, rr.Body.String())
+		}
+	}
+
+	// A deleted tunnel keeps its address until it is purged, and says so
+	srv.cfg.TunnelRetention = 24 * time.Hour
+	doRequest(srv, "DELETE", "/api/v1/tunnels/"+created["id"].(string), nil)
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"vpn_ip": "10.0.0.50"})
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "held by deleted tunnel "+created["id"].(string)) {
+		t.Errorf("expected a 409 naming the deleted tunnel, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestTunnelAdvertisedRoutes(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"advertised_routes": []string{"192.168.1.7/24"},
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	id := created["id"].(string)
+	if routes, _ := created["advertised_routes"].([]interface{}); len(routes) != 1 || routes[0] != "192.168.1.0/24" {
+		t.Errorf("expected the masked prefix, got %v", created["advertised_routes"])
+	}
+	peers, _ := srv.wgManager.ListPeers()
+	if len(peers) != 1 || !slices.Equal(peers[0].AllowedIPs, []string{"10.0.0.2/32", "192.168.1.0/24"}) {
+		t.Fatalf("expected the LAN in the peer's AllowedIPs, got %+v", peers)
+	}
+
+	tests := []struct {
+		routes []string
+		code   int
+	}{
+		{[]string{"192.168.1.128/25"}, http.StatusConflict},
+		{[]string{"10.0.0.0/16"}, http.StatusBadRequest},
+		{[]string{"172.16.0.0/16", "172.16.5.0/24"}, http.StatusBadRequest},
+		{[]string{"0.0.0.0/0"}, http.StatusBadRequest},
+		{[]string{"0.0.0.0/1", "128.0.0.0/1"}, http.StatusBadRequest},
+		{[]string{"169.254.169.254/32"}, http.StatusBadRequest},
+		{[]string{"127.0.0.0/8"}, http.StatusBadRequest},
+		{[]string{"203.0.113.0/25"}, http.StatusConflict}, // the VPS's own network
+		{[]string{"fd00::/64"}, http.StatusBadRequest},
+		{[]string{"not-a-cidr"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"advertised_routes": tt.routes})
+		if rr.Code != tt.code {
+			t.Errorf("advertised_routes %v: expected %d, got %d: %s", tt.routes, tt.code, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Only admins advertise routes
+	srv.cfg.AdminCNs = []string{"ops"}
+	srv.cfg.RoleMap = map[string]string{"cn:deployer": "operator"}
+	rr = doRequestAs(srv, "cn:deployer", "POST", "/api/v1/tunnels", map[string]interface{}{"advertised_routes": []string{"172.20.0.0/24"}})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an operator, got %d: %s", rr.Code, rr.Body.String())
+	}
+	srv.cfg.AdminCNs, srv.cfg.RoleMap = nil, nil
+
+	// Routes may target a LAN host, but only one the tunnel advertises
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": id, "match_type": "sni", "match_value": []string{"nas.example.com"},
+		"upstream_port": 443, "upstream_ip": "192.168.1.20",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if upstream := parseJSON(t, rr)["data"].(map[string]interface{})["upstream"]; upstream != "192.168.1.20:443" {
+		t.Errorf("expected the LAN upstream, got %v", upstream)
+	}
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": id, "match_type": "sni", "match_value": []string{"other.example.com"},
+		"upstream_port": 443, "upstream_ip": "192.168.2.20",
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an upstream outside the advertised routes, got %d", rr.Code)
+	}
+
+	// PATCH replaces the list and updates the kernel peer
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{
+		"advertised_routes": []string{"192.168.2.0/24"},
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	peers, _ = srv.wgManager.ListPeers()
+	if len(peers) != 1 || !slices.Equal(peers[0].AllowedIPs, []string{"10.0.0.2/32", "192.168.2.0/24"}) {
+		t.Errorf("expected the new LAN in the peer's AllowedIPs, got %+v", peers)
+	}
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"advertised_routes": []string{}})
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if routes, _ := data["advertised_routes"].([]interface{}); len(routes) != 0 {
+		t.Errorf("expected the routes to be removed, got %v", data["advertised_routes"])
+	}
+}
+
+func TestTunnelNotes(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"description": "Build runner in the basement", "owner_email": "alice@example.com", "device_name": "runner-01",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	id := created["id"].(string)
+	if created["owner_email"] != "alice@example.com" || created["device_name"] != "runner-01" {
+		t.Errorf("expected the notes in the create response, got %v", created)
+	}
+	doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"owner_email": "bob@example.com"})
+
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"device_name": "runner-02"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["device_name"] != "runner-02" || data["description"] != "Build runner in the basement" {
+		t.Errorf("expected only device_name to change, got %v", data)
+	}
+
+	// The list filters on the owner, ignoring case
+	rr = doRequest(srv, "GET", "/api/v1/tunnels?owner_email=Alice@Example.com", nil)
+	list := parseJSON(t, rr)["data"].([]interface{})
+	if len(list) != 1 || list[0].(map[string]interface{})["id"] != id {
+		t.Fatalf("expected alice's tunnel only, got %v", list)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"owner_email": "not-an-email"},
+		{"owner_email": "Alice <alice@example.com>"},
+		{"device_name": "runner\n01"},
+		{"description": strings.Repeat("x", 1025)},
+	} {
+		if rr := doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", body, rr.Code)
+		}
+	}
+
+	// An empty string clears a note
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"owner_email": ""})
+	if data := parseJSON(t, rr)["data"].(map[string]interface{}); data["owner_email"] != "" {
+		t.Errorf("expected the owner to be cleared, got %v", data["owner_email"])
+	}
+}
+
+func TestTunnelExpiresAt(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	expiresAt := time.Now().Add(30 * 24 * time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339)
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"expires_at": expiresAt})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	id := created["id"].(string)
+	if created["expires_at"] != expiresAt {
+		t.Errorf("expected expires_at %s, got %v", expiresAt, created["expires_at"])
+	}
+
+	for _, value := range []string{"next week", time.Now().Add(-time.Hour).Format(time.RFC3339)} {
+		if rr := doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"expires_at": value}); rr.Code != http.StatusBadRequest {
+			t.Errorf("expires_at %q: expected 400, got %d", value, rr.Code)
+		}
+	}
+
+	// Once the reconciler disabled an expired tunnel, enabling it needs a new date
+	past := time.Now().Add(-time.Hour)
+	srv.tunnelStore.SetExpiry(id, &past)
+	srv.tunnelStore.SetEnabled(id, false)
+	rr = doRequest(srv, "GET", "/api/v1/status", nil)
+	if peers := parseJSON(t, rr)["tunnels"].(map[string]interface{}); peers["expired"] != float64(1) {
+		t.Errorf("expected the status to count the expired tunnel, got %v", peers["expired"])
+	}
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"enabled": true})
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 when enabling an expired tunnel, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"enabled": true, "expires_at": ""})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if data := parseJSON(t, rr)["data"].(map[string]interface{}); data["enabled"] != true || data["expires_at"] != nil {
+		t.Errorf("expected an enabled tunnel without expiry, got %v", data)
+	}
+}
+
+type recordingNotifier struct {
+	events []notify.Event
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, e notify.Event) error {
+	n.events = append(n.events, e)
+	return nil
+}
+
+func TestTunnelApproval(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.AdminCNs = []string{"ops"}
+	srv.cfg.RoleMap = map[string]string{"cn:deployer": "operator"}
+	srv.cfg.TunnelApproval = true
+	notifier := &recordingNotifier{}
+	srv.SetNotifier(notifier)
+
+	create := func() string {
+		rr := doRequestAs(srv, "cn:deployer", "POST", "/api/v1/tunnels", map[string]interface{}{
+			"domains": []string{"pending.example.com"}, "upstream_port": 443,
+		})
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+		}
+		created := parseJSON(t, rr)
+		if created["pending_approval"] != true || created["config"] == nil {
+			t.Errorf("expected a pending tunnel with its config, got %v", created)
+		}
+		return created["id"].(string)
+	}
+	id := create()
+	srv.background.wait()
+	if peers, _ := srv.wgManager.ListPeers(); len(peers) != 0 {
+		t.Fatalf("expected no peer before approval, got %+v", peers)
+	}
+	if routes, _ := srv.routeStore.ListEnabled(); len(routes) != 0 {
+		t.Fatalf("expected no enabled route before approval, got %d", len(routes))
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventTunnelApprovalRequested {
+		t.Errorf("expected an approval_requested event, got %+v", notifier.events)
+	}
+
+	// Only admins decide, and a pending tunnel cannot be enabled directly
+	if rr := doRequestAs(srv, "cn:deployer", "POST", "/api/v1/tunnels/"+id+"/approve", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("operator approve: expected 403, got %d", rr.Code)
+	}
+	if rr := doRequestAs(srv, "cn:deployer", "PATCH", "/api/v1/tunnels/"+id, map[string]interface{}{"enabled": true}); rr.Code != http.StatusConflict {
+		t.Errorf("enable pending tunnel: expected 409, got %d", rr.Code)
+	}
+
+	rr := doRequestAs(srv, "cn:ops", "POST", "/api/v1/tunnels/"+id+"/approve", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("approve: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if data := parseJSON(t, rr)["data"].(map[string]interface{}); data["enabled"] != true || data["pending_approval"] != false {
+		t.Errorf("expected an enabled tunnel, got %v", data)
+	}
+	tunnel, _ := srv.tunnelStore.Get(id)
+	if peers, _ := srv.wgManager.ListPeers(); len(peers) != 1 || tunnel.PendingPSK != "" {
+		t.Errorf("expected the peer added with its PSK, got %+v (pending PSK %q)", peers, tunnel.PendingPSK)
+	}
+	if routes, _ := srv.routeStore.ListEnabled(); len(routes) != 1 {
+		t.Errorf("expected the route enabled, got %d", len(routes))
+	}
+	if rr := doRequestAs(srv, "cn:ops", "POST", "/api/v1/tunnels/"+id+"/approve", nil); rr.Code != http.StatusConflict {
+		t.Errorf("second approve: expected 409, got %d", rr.Code)
+	}
+
+	// Rejecting discards the tunnel, freeing its domain for a new request
+	if rr := doRequestAs(srv, "cn:ops", "DELETE", "/api/v1/tunnels/"+id+"?force=true", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	id = create()
+	rr = doRequestAs(srv, "cn:ops", "POST", "/api/v1/tunnels/"+id+"/reject", map[string]string{"reason": "unknown device"})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("reject: expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := srv.tunnelStore.Get(id); err == nil {
+		t.Error("expected the rejected tunnel to be removed")
+	}
+	srv.background.wait()
+	last := notifier.events[len(notifier.events)-1]
+	if last.Type != notify.EventTunnelRejected || last.Data["reason"] != "unknown device" {
+		t.Errorf("expected a rejected event with the reason, got %+v", last)
+	}
+
+	// Admins' tunnels are applied right away
+	if rr := doRequestAs(srv, "cn:ops", "POST", "/api/v1/tunnels", map[string]interface{}{}); rr.Code != http.StatusCreated {
+		t.Errorf("admin create: expected 201, got %d", rr.Code)
+	}
+}
+
+func TestTunnelSoftDeleteRestore(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.TunnelRetention = 24 * time.Hour
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains": []string{"restore.example.com"}, "upstream_port": 443,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	id := created["id"].(string)
+	tunnel, _ := srv.tunnelStore.Get(id)
+
+	rr = doRequest(srv, "DELETE", "/api/v1/tunnels/"+id+"?force=true", nil)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", rr.Code, rr.Body.String())
+	}
+	if peers, _ := srv.wgManager.ListPeers(); len(peers) != 0 {
+		t.Errorf("expected the peer to be removed, got %d", len(peers))
+	}
+	rr = doRequest(srv, "GET", "/api/v1/tunnels", nil)
+	if data := parseJSON(t, rr)["data"].([]interface{}); len(data) != 0 {
+		t.Errorf("expected the deleted tunnel to be hidden, got %d", len(data))
+	}
+	rr = doRequest(srv, "GET", "/api/v1/tunnels?deleted=true", nil)
+	deleted := parseJSON(t, rr)["data"].([]interface{})
+	if len(deleted) != 1 || deleted[0].(map[string]interface{})["purge_at"] == nil {
+		t.Fatalf("expected the tombstone to be listed with purge_at, got %v", deleted)
+	}
+
+	// The key stays with the tombstone
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"public_key": tunnel.PublicKey, "domains": []string{"other.example.com"}, "upstream_port": 443,
+	})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for the deleted tunnel's key, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/tunnels/"+id+"/restore", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].(map[string]interface{})
+	if data["preshared_key"] == "" || data["deleted_at"] != nil {
+		t.Errorf("unexpected restore response: %v", data)
+	}
+	if routes, _ := data["routes"].([]interface{}); len(routes) != 1 {
+		t.Errorf("expected the route to be restored, got %v", data["routes"])
+	}
+	if peers, _ := srv.wgManager.ListPeers(); len(peers) != 1 {
+		t.Errorf("expected the peer to be added back, got %d", len(peers))
+	}
+	if routes, _ := srv.routeStore.ListByTunnelID(id); len(routes) != 1 {
+		t.Errorf("expected 1 route in the store, got %d", len(routes))
+	}
+
+	rr = doRequest(srv, "POST", "/api/v1/tunnels/"+id+"/restore", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 restoring a live tunnel, got %d", rr.Code)
+	}
+
+	// A route created in the meantime blocks the restore
+	doRequest(srv, "DELETE", "/api/v1/tunnels/"+id+"?force=true", nil)
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains": []string{"restore.example.com"}, "upstream_port": 443,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "POST", "/api/v1/tunnels/"+id+"/restore", nil)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a taken domain, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestDeleteTunnelDependents(t *testing.T) {
+	srv, db := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains": []string{"deps.example.com"}, "upstream_port": 443,
+	})
+	created := parseJSON(t, rr)
+	id := created["id"].(string)
+	vpnIP := created["vpn_ip"].(string)
+
+	rr = doRequest(srv, "POST", "/api/v1/firewall/rules", map[string]interface{}{
+		"port": 8080, "proto": "tcp", "source_cidr": vpnIP + "/32", "action": "allow",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create rule: %d %s", rr.Code, rr.Body.String())
+	}
+	ruleID := parseJSON(t, rr)["data"].(map[string]interface{})["id"].(string)
+
+	rr = doRequest(srv, "DELETE", "/api/v1/tunnels/"+id, nil)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rr.Code, rr.Body.String())
+	}
+	deps := parseJSON(t, rr)["dependents"].(map[string]interface{})
+	if rules := deps["firewall_rules"].([]interface{}); len(rules) != 1 || rules[0] != ruleID {
+		t.Errorf("expected the rule to be listed, got %v", deps)
+	}
+	if _, err := srv.tunnelStore.Get(id); err != nil {
+		t.Errorf("expected the tunnel to be kept, got %v", err)
+	}
+
+	rr = doRequest(srv, "DELETE", "/api/v1/tunnels/"+id+"?force=true", nil)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 with force, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := srv.fwStore.Get(ruleID); err != nil {
+		t.Errorf("expected the firewall rule to be kept, got %v", err)
+	}
+
+	// A route left behind by a missing tunnel is reported by the status
+	if _, err := db.Conn().Exec(`PRAGMA foreign_keys = OFF`); err != nil {
+		t.Fatal(err)
+	}
+	srv.routeStore.Create(&store.Route{ID: "route_orphan", TunnelID: "tun_gone", ListenPort: 443,
+		MatchType: "sni", MatchValue: []string{"orphan.example.com"}, Upstream: "10.0.0.9:443", CaddyID: "route-orphan", Enabled: true})
+	rr = doRequest(srv, "GET", "/api/v1/status", nil)
+	routes := parseJSON(t, rr)["routes"].(map[string]interface{})
+	if orphaned := routes["orphaned"].([]interface{}); len(orphaned) != 1 || orphaned[0] != "route_orphan" {
+		t.Errorf("expected the orphaned route to be reported, got %v", routes["orphaned"])
+	}
+}
+
+func TestGetTunnelAndRoute(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+		"domains": []string{"single.example.com"}, "upstream_port": 443,
+		"labels": map[string]string{"env": "prod"},
+	})
+	id := parseJSON(t, rr)["id"].(string)
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/"+id, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("get tunnel: %d %s", rr.Code, rr.Body.String())
+	}
+	tunnel := parseJSON(t, rr)["data"].(map[string]interface{})
+	if tunnel["id"] != id || rr.Header().Get("ETag") != tunnel["etag"] {
+		t.Errorf("unexpected tunnel: %v (ETag %q)", tunnel, rr.Header().Get("ETag"))
+	}
+	routes := tunnel["routes"].([]interface{})
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 embedded route, got %v", tunnel["routes"])
+	}
+	routeID := routes[0].(map[string]interface{})["id"].(string)
+
+	rr = doRequest(srv, "GET", "/api/v1/routes/"+routeID, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("get route: %d %s", rr.Code, rr.Body.String())
+	}
+	route := parseJSON(t, rr)["data"].(map[string]interface{})
+	summary, _ := route["tunnel"].(map[string]interface{})
+	if route["id"] != routeID || summary == nil || summary["id"] != id || summary["vpn_ip"] != tunnel["vpn_ip"] {
+		t.Errorf("unexpected route: %v", route)
+	}
+
+	for _, path := range []string{"/api/v1/tunnels/nonexistent", "/api/v1/routes/nonexistent"} {
+		if rr := doRequest(srv, "GET", path, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestListTunnelRoutes(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	var ids []string
+	for _, domain := range []string{"one.example.com", "two.example.com"} {
+		rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{
+			"domains": []string{domain}, "upstream_port": 443,
+		})
+		ids = append(ids, parseJSON(t, rr)["id"].(string))
+	}
+
+	rr := doRequest(srv, "GET", "/api/v1/tunnels/"+ids[0]+"/routes", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	data := parseJSON(t, rr)["data"].([]interface{})
+	if len(data) != 1 {
+		t.Fatalf("expected only the tunnel's route, got %v", data)
+	}
+	route := data[0].(map[string]interface{})
+	if route["tunnel_id"] != ids[0] || route["match_value"].([]interface{})[0] != "one.example.com" {
+		t.Errorf("unexpected route: %v", route)
+	}
+
+	rr = doRequest(srv, "GET", "/api/v1/tunnels/nonexistent/routes", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+func TestStrictJSONBodies(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.MaxBodyBytes = 1024
+	handler := testHandler(t, srv)
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/tunnels", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(`{"domains": ["typo.example.com"], "upstream_prt": 443}`)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `unknown field \"upstream_prt\"`) {
+		t.Errorf("expected 400 naming the unknown field, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = send(`{"domains": ["a.example.com"], "upstream_port": 443} {"domains": []}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for trailing data, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = send(`{"domains": ["big.example.com"], "labels": {"note": "` + strings.Repeat("x", 2048) + `"}}`)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for an oversized body, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if tunnels, _ := srv.tunnelStore.List(); len(tunnels) != 0 {
+		t.Errorf("expected no tunnel to be created, got %d", len(tunnels))
+	}
+
+	// A body without Content-Length is cut off while it is read
+	req := httptest.NewRequest("POST", "/api/v1/tunnels", io.MultiReader(
+		strings.NewReader(`{"domains": ["chunked.example.com"], "labels": {"note": "`),
+		strings.NewReader(strings.Repeat("x", 2048)+`"}}`)))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for an oversized streamed body, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRateLimitIdentity(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.RateLimitRead = 2
+	srv.cfg.RateLimitMutate = 1
+	srv.cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")}
+	handler := testHandler(t, srv)
+	send := func(method, remote, forwardedFor, cn string) int {
+		req := httptest.NewRequest(method, "/api/v1/tunnels", strings.NewReader(`{}`))
+		req.RemoteAddr = remote + ":40000"
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		if cn != "" {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}}}
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Clients behind the trusted proxy have their own budgets
+	for i := 0; i < 2; i++ {
+		if code := send("GET", "10.9.0.5", "198.51.100.1, 10.9.0.7", ""); code != http.StatusOK {
+			t.Fatalf("read %d: expected 200, got %d", i+1, code)
+		}
+	}
+	if code := send("GET", "10.9.0.5", "198.51.100.1", ""); code != http.StatusTooManyRequests {
+		t.Errorf("expected the client's third read to be limited, got %d", code)
+	}
+	if code := send("GET", "10.9.0.5", "198.51.100.2", ""); code != http.StatusOK {
+		t.Errorf("expected another client behind the proxy to be allowed, got %d", code)
+	}
+
+	// Reads and changes are counted separately
+	if code := send("POST", "10.9.0.5", "198.51.100.1", ""); code == http.StatusTooManyRequests {
+		t.Error("expected the mutate budget to be separate from the read budget")
+	}
+	if code := send("POST", "10.9.0.5", "198.51.100.1", ""); code != http.StatusTooManyRequests {
+		t.Errorf("expected the second change to be limited, got %d", code)
+	}
+
+	// An untrusted peer cannot pick its identity with X-Forwarded-For
+	send("GET", "192.0.2.1", "198.51.100.10", "")
+	send("GET", "192.0.2.1", "198.51.100.11", "")
+	if code := send("GET", "192.0.2.1", "198.51.100.12", ""); code != http.StatusTooManyRequests {
+		t.Errorf("expected the untrusted peer to be limited by its own IP, got %d", code)
+	}
+
+	// Certificate holders sharing an address are told apart by CN
+	send("GET", "192.0.2.1", "", "alice")
+	send("GET", "192.0.2.1", "", "alice")
+	if code := send("GET", "192.0.2.1", "", "alice"); code != http.StatusTooManyRequests {
+		t.Errorf("expected alice to be limited, got %d", code)
+	}
+	if code := send("GET", "192.0.2.1", "", "bob"); code != http.StatusOK {
+		t.Errorf("expected bob to have a separate budget, got %d", code)
+	}
+}
+
+func TestRateLimitKeyCachesTokens(t *testing.T) {
+	srv, db := setupTestServer(t)
+	tenants := store.NewTenantStore(db)
+	if err := tenants.Create(&store.Tenant{ID: "tenant_a", Name: "a", TokenHash: hashToken("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	key := func(token string) string {
+		req := httptest.NewRequest("GET", "/api/v1/tunnels", nil)
+		req.RemoteAddr = "192.0.2.1:40000"
+		req.Header.Set("Authorization", "Bearer "+token)
+		return srv.rateLimitKey(req)
+	}
+
+	if got := key("secret"); got != "token:"+hashToken("secret") {
+		t.Fatalf("expected the token's bucket, got %q", got)
+	}
+	if got := key("made-up"); got != "ip:192.0.2.1" {
+		t.Fatalf("expected an unknown token to count against the IP, got %q", got)
+	}
+
+	// Both answers are served from the cache, without the tenant table
+	if _, err := db.Conn().Exec("DELETE FROM tenants"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Conn().Exec("INSERT INTO tenants (id, name, token_hash, created_at, updated_at) VALUES ('tenant_b', 'b', ?, datetime('now'), datetime('now'))", hashToken("made-up")); err != nil {
+		t.Fatal(err)
+	}
+	if got := key("secret"); got != "token:"+hashToken("secret") {
+		t.Errorf("expected the cached lookup, got %q", got)
+	}
+	if got := key("made-up"); got != "ip:192.0.2.1" {
+		t.Errorf("expected the cached miss, got %q", got)
+	}
+}
+
+func TestStartupReport(t *testing.T) {
+	srv, db := setupTestServer(t)
+	if rr := doRequest(srv, "GET", "/api/v1/reconcile/startup-report", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before the first pass, got %d", rr.Code)
+	}
+
+	store.NewFirewallStore(db).SaveStartupReport(&store.StartupReport{
+		StartedAt: time.Now(), Mode: "enforce", PreviousStatus: "error", Status: "drift_corrected",
+		Ops: store.OpCounts{Attempted: 1, Succeeded: 1},
+		Subsystems: map[string]store.StartupSubsystem{
+			"wireguard": {Ops: []store.RepairOp{{Type: "add", ID: "pk1", Detail: "peer", Result: "repaired"}}},
+		},
+	})
+	rr := doRequest(srv, "GET", "/api/v1/reconcile/startup-report", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	report := parseJSON(t, rr)["data"].(map[string]interface{})
+	if report["clean_shutdown"] != false || report["succeeded"] != float64(1) {
+		t.Errorf("unexpected report: %v", report)
+	}
+	ops := report["subsystems"].(map[string]interface{})["wireguard"].(map[string]interface{})["ops"].([]interface{})
+	if len(ops) != 1 || ops[0].(map[string]interface{})["result"] != "repaired" {
+		t.Errorf("expected the repaired peer listed, got %v", ops)
+	}
+}
+
+func TestReconcileHistory(t *testing.T) {
+	srv, db := setupTestServer(t)
+	runStore := store.NewReconcileRunStore(db)
+	ops := store.OpCounts{Attempted: 4, Succeeded: 3, Failed: 1}
+	runStore.Record(&store.ReconcileRun{
+		StartedAt: time.Now().Add(-time.Minute), Status: "ok", Subsystems: map[string]store.OpCounts{},
+	})
+	runStore.Record(&store.ReconcileRun{
+		StartedAt: time.Now(), Status: "error", Error: "wireguard: 1 of 4 operations failed",
+		Ops: ops, Subsystems: map[string]store.OpCounts{"wireguard": ops},
+	})
+
+	rr := doRequest(srv, "GET", "/api/v1/reconcile/history?limit=1", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	runs := parseJSON(t, rr)["data"].([]interface{})
+	if len(runs) != 1 {
+		t.Fatalf("expected 1 run, got %d", len(runs))
+	}
+	run := runs[0].(map[string]interface{})
+	if run["status"] != "error" || run["attempted"] != float64(4) || run["succeeded"] != float64(3) || run["failed"] != float64(1) {
+		t.Errorf("unexpected run: %v", run)
+	}
+	wg := run["subsystems"].(map[string]interface{})["wireguard"].(map[string]interface{})
+	if wg["failed"] != float64(1) {
+		t.Errorf("expected per-subsystem counts, got %v", wg)
+	}
+
+	if rr := doRequest(srv, "GET", "/api/v1/reconcile/history?limit=0", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a zero limit, got %d", rr.Code)
+	}
+
+	recon := parseJSON(t, doRequest(srv, "GET", "/api/v1/status", nil))["reconciliation"].(map[string]interface{})
+	last := recon["last_operations"].(map[string]interface{})
+	if last["attempted"] != float64(4) || last["failed"] != float64(1) {
+		t.Errorf("expected the status to report the last pass's operations, got %v", last)
+	}
+
+	// An unreadable history leaves the field null instead of failing the status
+	if _, err := db.Conn().Exec(`DROP TABLE reconcile_runs`); err != nil {
+		t.Fatal(err)
+	}
+	rr = doRequest(srv, "GET", "/api/v1/status", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	recon = parseJSON(t, rr)["reconciliation"].(map[string]interface{})
+	if v, ok := recon["last_operations"]; !ok || v != nil {
+		t.Errorf("expected null last_operations, got %v", v)
+	}
+}
+
+func TestPutState(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	doc := map[string]interface{}{
+		"tunnels": []map[string]interface{}{
+			{"public_key": key, "labels": map[string]string{"env": "prod"}},
+		},
+		"routes": []map[string]interface{}{
+			{"tunnel_public_key": key, "match_type": "sni", "match_value": []string{"app.example.com"}, "upstream_port": 443},
+		},
+		"firewall_rules": []map[string]interface{}{
+			{"port": 8080, "proto": "tcp", "source_cidr": "198.51.100.7/24"},
+		},
+	}
+	apply := func(path string, doc interface{}) []interface{} {
+		t.Helper()
+		rr := doRequest(srv, "PUT", path, doc)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		return parseJSON(t, rr)["data"].(map[string]interface{})["changes"].([]interface{})
+	}
+	summary := func(changes []interface{}) []string {
+		var out []string
+		for _, c := range changes {
+			c := c.(map[string]interface{})
+			out = append(out, c["action"].(string)+" "+c["kind"].(string))
+		}
+		return out
+	}
+
+	changes := apply("/api/v1/state", doc)
+	if got := summary(changes); !slices.Equal(got, []string{"create tunnel", "create route", "create firewall_rule"}) {
+		t.Fatalf("unexpected change set %v", got)
+	}
+	created := changes[0].(map[string]interface{})["result"].(map[string]interface{})
+	if created["preshared_key"] == "" || created["preshared_key"] == nil {
+		t.Error("expected the tunnel create to return its PSK")
+	}
+	tunnel, err := srv.tunnelStore.GetByPublicKey(key)
+	if err != nil || tunnel.Labels["env"] != "prod" {
+		t.Fatalf("expected the tunnel to be created, got %+v, %v", tunnel, err)
+	}
+
+	// Applying the same document again changes nothing
+	if changes := apply("/api/v1/state", doc); len(changes) != 0 {
+		t.Fatalf("expected no changes, got %v", summary(changes))
+	}
+
+	// A dry run reports the diff without applying it
+	doc["tunnels"].([]map[string]interface{})[0]["labels"] = map[string]string{"env": "dev"}
+	doc["routes"].([]map[string]interface{})[0]["priority"] = 5
+	doc["routes"] = append(doc["routes"].([]map[string]interface{}), map[string]interface{}{
+		"tunnel_public_key": key, "match_type": "port_forward", "listen_port": 2222, "upstream_port": 8022,
+	})
+	doc["firewall_rules"].([]map[string]interface{})[0]["action"] = "deny"
+	want := []string{"update tunnel", "update route", "create route", "update firewall_rule"}
+	if got := summary(apply("/api/v1/state?dry_run=true", doc)); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if tunnel, _ := srv.tunnelStore.GetByPublicKey(key); tunnel.Labels["env"] != "prod" {
+		t.Error("a dry run must not apply changes")
+	}
+	if got := summary(apply("/api/v1/state", doc)); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	routes, _ := srv.routeStore.List()
+	if len(routes) != 2 || routes[0].Priority != 5 {
+		t.Errorf("expected the route priority to be updated and a port forward added, got %d routes", len(routes))
+	}
+	if rules, _ := srv.fwStore.List(); len(rules) != 1 || rules[0].Action != "deny" {
+		t.Errorf("expected the rule to be updated in place, got %+v", rules)
+	}
+
+	// Fields fixed at creation cannot change
+	doc["tunnels"].([]map[string]interface{})[0]["node_id"] = "node_x"
+	if rr := doRequest(srv, "PUT", "/api/v1/state", doc); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a node_id change, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// An empty section deletes every resource of its kind; an omitted one is
+	// left alone
+	changes = apply("/api/v1/state", map[string]interface{}{"tunnels": []interface{}{}})
+	if got := summary(changes); !slices.Equal(got, []string{"delete tunnel"}) {
+		t.Fatalf("expected the tunnel to be deleted with its routes, got %v", got)
+	}
+	if rules, _ := srv.fwStore.List(); len(rules) != 1 {
+		t.Error("expected firewall rules outside the document to be kept")
+	}
+
+	// A document with an invalid resource is rejected before anything is
+	// applied, including the deletes it implies
+	rr := doRequest(srv, "PUT", "/api/v1/state", map[string]interface{}{
+		"tunnels": []map[string]interface{}{{"public_key": key}},
+		"firewall_rules": []map[string]interface{}{
+			{"port": 9090, "proto": "tcp"},
+			{"port": 9091, "proto": "sctp"},
+		},
+	})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid rule, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rules, _ := srv.fwStore.List(); len(rules) != 1 || rules[0].Port != 8080 {
+		t.Errorf("expected no change to be applied, got %+v", rules)
+	}
+	if _, err := srv.tunnelStore.GetByPublicKey(key); err == nil {
+		t.Error("expected the tunnel to stay deleted")
+	}
+
+	// Deletes run last, except a route's delete, which runs just before the
+	// route that replaces it
+	doc = map[string]interface{}{
+		"tunnels": []map[string]interface{}{{"public_key": key}},
+		"routes": []map[string]interface{}{
+			{"tunnel_public_key": key, "match_type": "port_forward", "listen_port": 2222, "upstream_port": 2022},
+		},
+	}
+	apply("/api/v1/state", doc)
+	doc["routes"].([]map[string]interface{})[0]["upstream_port"] = 2023
+	doc["firewall_rules"] = []map[string]interface{}{{"port": 9090, "proto": "tcp"}}
+	want = []string{"delete route", "create route", "create firewall_rule", "delete firewall_rule"}
+	if got := summary(apply("/api/v1/state", doc)); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestPutByName(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+	tunnelBody := map[string]interface{}{"public_key": key, "labels": map[string]string{"env": "prod"}}
+
+	// The first PUT creates the tunnel and returns it as GET does, with its
+	// key material beside it
+	rr := doRequest(srv, "PUT", "/api/v1/tunnels/by-name/web", tunnelBody)
+	if rr.Code != http.StatusCreated || rr.Header().Get("ETag") == "" {
+		t.Fatalf("expected 201 with an ETag, got %d: %s", rr.Code, rr.Body.String())
+	}
+	created := parseJSON(t, rr)
+	data := created["data"].(map[string]interface{})
+	creds, _ := created["credentials"].(map[string]interface{})
+	if data["name"] != "web" || data["etag"] == nil || creds["preshared_key"] == nil {
+		t.Fatalf("expected a named tunnel with its PSK, got %v", created)
+	}
+	tunnelID := data["id"].(string)
+
+	// Repeating it changes nothing; a changed label is updated in place
+	rr = doRequest(srv, "PUT", "/api/v1/tunnels/by-name/web", tunnelBody)
+	if rr.Code != http.StatusOK || parseJSON(t, rr)["data"].(map[string]interface{})["id"] != tunnelID {
+		t.Fatalf("expected 200 for the same tunnel, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelBody["labels"] = map[string]string{"env": "dev"}
+	if rr := doRequest(srv, "PUT", "/api/v1/tunnels/by-name/web", tunnelBody); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if tunnel, _ := srv.tunnelStore.Get(tunnelID); tunnel.Labels["env"] != "dev" {
+		t.Errorf("expected the labels to be updated, got %v", tunnel.Labels)
+	}
+
+	// Fields fixed at creation are a conflict, as is reusing the name
+	tunnelBody["node_id"] = "node_x"
+	if rr := doRequest(srv, "PUT", "/api/v1/tunnels/by-name/web", tunnelBody); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a node_id change, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"name": "web"})
+	if rr.Code != http.StatusConflict || !strings.Contains(parseJSON(t, rr)["error"].(string), tunnelID) {
+		t.Errorf("expected 409 naming %s, got %d: %s", tunnelID, rr.Code, rr.Body.String())
+	}
+	if rr := doRequest(srv, "POST", "/api/v1/tunnels", map[string]interface{}{"name": "not a name"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid name, got %d", rr.Code)
+	}
+	if rr := doRequest(srv, "PUT", "/api/v1/tunnels/by-name/web", map[string]interface{}{"name": "api"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a body name that differs from the path, got %d", rr.Code)
+	}
+
+	// Routes: only the priority can change
+	routeBody := map[string]interface{}{"tunnel_id": tunnelID, "match_type": "sni", "match_value": []string{"web.example.com"}, "upstream_port": 443}
+	rr = doRequest(srv, "PUT", "/api/v1/routes/by-name/web-https", routeBody)
+	if rr.Code != http.StatusCreated || rr.Header().Get("ETag") == "" {
+		t.Fatalf("expected 201 with an ETag, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if route := parseJSON(t, rr)["data"].(map[string]interface{}); route["name"] != "web-https" || route["etag"] == nil {
+		t.Errorf("expected the route as returned by GET, got %v", route)
+	}
+	routeBody["priority"] = 7
+	rr = doRequest(srv, "PUT", "/api/v1/routes/by-name/web-https", routeBody)
+	if rr.Code != http.StatusOK || parseJSON(t, rr)["data"].(map[string]interface{})["priority"] != float64(7) {
+		t.Fatalf("expected the priority to be updated, got %d: %s", rr.Code, rr.Body.String())
+	}
+	routeBody["upstream_port"] = 8443
+	if rr := doRequest(srv, "PUT", "/api/v1/routes/by-name/web-https", routeBody); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an upstream change, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = doRequest(srv, "GET", "/api/v1/routes?name=web-https", nil)
+	if routes := parseJSON(t, rr)["data"].([]interface{}); len(routes) != 1 {
+		t.Errorf("expected the name filter to find 1 route, got %d", len(routes))
+	}
+
+	// Firewall rules: the source CIDR and action are updated
+	ruleBody := map[string]interface{}{"port": 8080, "proto": "tcp"}
+	rr = doRequest(srv, "PUT", "/api/v1/firewall/rules/by-name/web-alt", ruleBody)
+	if rr.Code != http.StatusCreated || rr.Header().Get("ETag") == "" {
+		t.Fatalf("expected 201 with an ETag, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rule := parseJSON(t, rr)["data"].(map[string]interface{}); rule["name"] != "web-alt" {
+		t.Errorf("expected the rule as returned by GET, got %v", rule)
+	}
+	ruleBody["action"] = "deny"
+	if rr := doRequest(srv, "PUT", "/api/v1/firewall/rules/by-name/web-alt", ruleBody); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rules, _ := srv.fwStore.List(); len(rules) != 1 || rules[0].Action != "deny" || rules[0].Name != "web-alt" {
+		t.Errorf("expected the named rule to be updated in place, got %+v", rules)
+	}
+	ruleBody["port"] = 8081
+	if rr := doRequest(srv, "PUT", "/api/v1/firewall/rules/by-name/web-alt", ruleBody); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a port change, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestValidationWebhook(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	var down bool
+	var seen []admission.Request
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var req admission.Request
+		json.NewDecoder(r.Body).Decode(&req)
+		seen = append(seen, req)
+		object, _ := req.Object.(map[string]interface{})
+		if req.Kind == "route" && object["match_type"] == "port_forward" && object["listen_port"].(float64) < 1024 {
+			json.NewEncoder(w).Encode(admission.Response{Reason: "no port forwards below 1024"})
+			return
+		}
+		json.NewEncoder(w).Encode(admission.Response{Allowed: true})
+	}))
+	defer webhook.Close()
+	srv.SetValidator(admission.NewWebhook(webhook.URL, "", time.Second, false))
+
+	rr := doRequestAs(srv, "cn:ops", "POST", "/api/v1/tunnels", map[string]interface{}{"upstream_port": 443})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	tunnelID := parseJSON(t, rr)["id"].(string)
+	if len(seen) != 1 || seen[0].Operation != admission.OperationCreate || seen[0].Kind != "tunnel" ||
+		seen[0].ResourceID != tunnelID || seen[0].ClientCN != "ops" {
+		t.Errorf("unexpected validation request: %+v", seen)
+	}
+
+	// A veto is returned with its reason and nothing is created
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "port_forward", "protocol": "tcp", "listen_port": 80, "upstream_port": 80,
+	})
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "no port forwards below 1024") {
+		t.Fatalf("expected 403 with the reason, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if routes, _ := srv.routeStore.ListByTunnelID(tunnelID); len(routes) != 0 {
+		t.Errorf("vetoed route was stored: %+v", routes)
+	}
+	rr = doRequest(srv, "POST", "/api/v1/routes", map[string]interface{}{
+		"tunnel_id": tunnelID, "match_type": "port_forward", "protocol": "tcp", "listen_port": 8080, "upstream_port": 80,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// An unreachable webhook blocks changes unless it fails open
+	down = true
+	rr = doRequest(srv, "DELETE", "/api/v1/tunnels/"+tunnelID+"?force=true", nil)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := srv.tunnelStore.Get(tunnelID); err != nil {
+		t.Errorf("tunnel deleted without approval: %v", err)
+	}
+	srv.SetValidator(admission.NewWebhook(webhook.URL, "", time.Second, true))
+	rr = doRequest(srv, "DELETE", "/api/v1/tunnels/"+tunnelID+"?force=true", nil)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 with fail-open, got %d: %s", rr.Code, rr.Body.String())
 	}
 }
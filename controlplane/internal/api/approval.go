@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/notify"
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// SetNotifier delivers the events of API actions, such as tunnel approvals,
+// to webhook receivers.
+func (s *Server) SetNotifier(n notify.Notifier) {
+	s.notifier = n
+}
+
+// notify queues the delivery of an event, so the request does not wait
+// for the receivers, and logs failures. Delivery is best effort.
+func (s *Server) notify(e notify.Event) {
+	if s.notifier == nil {
+		return
+	}
+	s.background.push(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.notifier.Notify(ctx, e); err != nil {
+			fmt.Printf("warning: failed to deliver %s event: %v\n", e.Type, err)
+		}
+	})
+}
+
+type rejectTunnelRequest struct {
+	Reason string `json:"reason,omitempty"` // passed on in the tunnel.rejected event
+}
+
+// pendingTunnel returns the tunnel of the request if the caller can see it
+// and it awaits approval, and writes the error response otherwise.
+func (s *Server) pendingTunnel(w http.ResponseWriter, r *http.Request) (*store.Tunnel, bool) {
+	tunnel, err := s.tunnels(r).Get(r.PathValue("id"))
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return nil, false
+	}
+	if !tunnel.PendingApproval {
+		writeError(w, http.StatusConflict, store.ErrNotPending.Error())
+		return nil, false
+	}
+	return tunnel, true
+}
+
+// handleApproveTunnel applies a tunnel created with TUNNEL_APPROVAL on: it
+// is enabled with its routes, and its peer gets the PSK issued at creation,
+// so the config the requester already holds starts working.
+func (s *Server) handleApproveTunnel(w http.ResponseWriter, r *http.Request) {
+	tunnel, ok := s.pendingTunnel(w, r)
+	if !ok {
+		return
+	}
+	pending := tunnel
+	tunnel, err := s.tunnels(r).Approve(tunnel.ID)
+	if errors.Is(err, store.ErrNotPending) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, store.ErrDomainInUse) {
+		s.writeDomainTaken(w, r, pending.ID, pending.Domains)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to approve tunnel: %v", err))
+		return
+	}
+
+	// A node's agent adds the peer with the pending PSK at its next sync
+	if tunnel.NodeID == "" {
+		keepalive := tunnel.Keepalive(s.cfg.WGKeepalive)
+		if err := s.wgManager.AddPeer(tunnel.PublicKey, tunnel.PendingPSK, tunnel.VpnIP, tunnel.AdvertisedRoutes, keepalive); err != nil {
+			// Non-fatal: the reconciler adds the peer with the pending PSK
+			fmt.Printf("warning: failed to add approved peer: %v\n", err)
+		} else if err := s.tunnels(r).SetPendingPSK(tunnel.ID, ""); err != nil {
+			fmt.Printf("warning: failed to clear applied PSK: %v\n", err)
+		} else {
+			tunnel.PendingPSK = ""
+		}
+		if tunnel.Isolate {
+			if err := s.fwManager.IsolatePeer(tunnel.VpnIP); err != nil {
+				// Non-fatal: reconciler will fix this
+				fmt.Printf("warning: failed to isolate peer: %v\n", err)
+			}
+		}
+	}
+
+	routes, err := s.routes(r).ListByTunnelID(tunnel.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list routes: %v", err))
+		return
+	}
+	var domains []string
+	for _, route := range routes {
+		if route.MatchType == "sni" {
+			domains = append(domains, route.MatchValue...)
+		}
+	}
+	// The reconciler adds the routes to Caddy in priority order
+	if s.reconciler != nil {
+		s.reconciler.ForceReconcile()
+	}
+	s.publishDNS(domains)
+
+	s.notify(notify.Event{
+		Type: notify.EventTunnelApproved, TunnelID: tunnel.ID, Time: time.Now(),
+		Data: map[string]interface{}{"approved_by": identityFrom(r.Context()).ClientCN},
+	})
+
+	w.Header().Set("ETag", tunnelETag(tunnel))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": s.tunnelResponse(tunnel)})
+}
+
+// handleRejectTunnel discards a tunnel awaiting approval, releasing its VPN
+// IP, domains, and name. Nothing was applied for it, so only rows are
+// removed. The body is optional.
+func (s *Server) handleRejectTunnel(w http.ResponseWriter, r *http.Request) {
+	var req rejectTunnelRequest
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+		return
+	}
+	tunnel, ok := s.pendingTunnel(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.routes(r).DeleteByTunnelID(tunnel.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete routes: %v", err))
+		return
+	}
+	if err := s.tunnels(r).Delete(tunnel.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete tunnel: %v", err))
+		return
+	}
+	s.escrow.drop(tunnel.ID)
+
+	s.notify(notify.Event{
+		Type: notify.EventTunnelRejected, TunnelID: tunnel.ID, Time: time.Now(),
+		Data: map[string]interface{}{"rejected_by": identityFrom(r.Context()).ClientCN, "reason": req.Reason},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/audit"
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// redacted replaces secret values in recorded request bodies.
+const redacted = "[REDACTED]"
+
+// secretKeys are request body fields whose string values are never stored.
+// Keys ending in one of them after an underscore (e.g. "webhook_secret")
+// are redacted too.
+var secretKeys = []string{"private_key", "psk", "preshared_key", "password", "secret", "token"}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if key == s || strings.HasSuffix(key, "_"+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactBody returns body with secret values replaced, cut to at most limit
+// bytes. Bodies that are not JSON are not stored, since secrets in them
+// cannot be found.
+func redactBody(body []byte, limit int) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("[non-JSON body, %d bytes]", len(body))
+	}
+	out, _ := json.Marshal(redactValue(v))
+	if len(out) > limit {
+		return fmt.Sprintf("%s...[truncated, %d bytes]", out[:limit], len(out))
+	}
+	return string(out)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if _, ok := val.(string); ok && isSecretKey(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactValue(val)
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = redactValue(val)
+		}
+	}
+	return v
+}
+
+// auditResource returns the kind and ID of the resource a mutation path
+// refers to. The ID is empty for collection paths (creates); kind is empty
+// for paths that change no single resource.
+func auditResource(path string) (kind, id string) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/api/v1/"), "/"), "/")
+	switch {
+	case parts[0] == "tunnels":
+		kind = "tunnel"
+	case parts[0] == "routes":
+		kind = "route"
+	case parts[0] == "tenants":
+		kind = "tenant"
+	case parts[0] == "certs":
+		kind = "cert"
+	case parts[0] == "firewall" && len(parts) > 1 && parts[1] == "rules":
+		kind, parts = "firewall_rule", parts[1:]
+	default:
+		return "", ""
+	}
+	if len(parts) > 1 {
+		id = parts[1]
+	}
+	return kind, id
+}
+
+// createdID returns the ID of the resource a create response describes,
+// whether at the top level or under "data".
+func createdID(body []byte) string {
+	var resp struct {
+		ID   string `json:"id"`
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return ""
+	}
+	if resp.ID != "" {
+		return resp.ID
+	}
+	return resp.Data.ID
+}
+
+// auditSnapshot returns the stored state of a resource for diffing, or nil
+// if it does not exist. Secrets, fields that change on every write (etag,
+// updated_at), and countdowns (ttl_remaining_seconds) are left out.
+func (s *Server) auditSnapshot(kind, id string) map[string]interface{} {
+	var state map[string]interface{}
+	switch kind {
+	case "tunnel":
+		if t, err := s.tunnelStore.Get(id); err == nil && t != nil {
+			state = tunnelAuditState(t)
+		}
+	case "route":
+		if r, err := s.routeStore.Get(id); err == nil && r != nil {
+			state = routeResponse(r)
+		}
+	case "firewall_rule":
+		if r, err := s.fwStore.Get(id); err == nil && r != nil {
+			state = firewallRuleResponse(r)
+		}
+	case "tenant":
+		if t, err := s.tenantStore.Get(id); err == nil && t != nil {
+			state = tenantToMap(t)
+		}
+	case "cert":
+		if s.certStore != nil {
+			if c, err := s.certStore.Get(id); err == nil {
+				state = certResponse(c)
+			}
+		}
+	}
+	if state == nil {
+		return nil
+	}
+	delete(state, "etag")
+	delete(state, "updated_at")
+	delete(state, "ttl_remaining_seconds")
+	return roundTripJSON(state)
+}
+
+// tunnelAuditState is the editable state of a tunnel. Traffic counters and
+// handshakes are refreshed by the reconciler and are not part of a change.
+func tunnelAuditState(t *store.Tunnel) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                         t.ID,
+		"public_key":                 t.PublicKey,
+		"vpn_ip":                     t.VpnIP,
+		"domains":                    t.Domains,
+		"enabled":                    t.Enabled,
+		"pending_approval":           t.PendingApproval,
+		"labels":                     t.Labels,
+		"tenant_id":                  t.TenantID,
+		"source_cidr":                t.SourceCIDR,
+		"isolate":                    t.Isolate,
+		"auto_rotate_psk":            t.AutoRotatePSK,
+		"psk_rotation_interval_days": t.PSKRotationIntervalDays,
+		"auto_revoke_inactive":       t.AutoRevokeInactive,
+		"inactive_expiry_days":       t.InactiveExpiryDays,
+		"grace_period_minutes":       t.GracePeriodMinutes,
+		"description":                t.Description,
+		"owner_email":                t.OwnerEmail,
+		"device_name":                t.DeviceName,
+		"expires_at":                 formatTimePtr(t.ExpiresAt),
+		"last_rotation_at":           formatTimePtr(t.LastRotationAt),
+		"revoke_deferred_until":      formatTimePtr(t.RevokeDeferredUntil),
+		"created_at":                 t.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// roundTripJSON converts v to its generic JSON form so that values compare
+// equal regardless of their Go types.
+func roundTripJSON(v interface{}) map[string]interface{} {
+	b, _ := json.Marshal(v)
+	var m map[string]interface{}
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// auditDiff returns the fields that differ between before and after as a
+// JSON object of {"field": {"before": ..., "after": ...}}, or "" if nothing
+// changed. A nil state means the resource did not exist.
+func auditDiff(before, after map[string]interface{}) string {
+	keys := make(map[string]bool)
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	diff := make(map[string]interface{})
+	for k := range keys {
+		b, a := before[k], after[k]
+		if reflect.DeepEqual(b, a) {
+			continue
+		}
+		diff[k] = map[string]interface{}{"before": b, "after": a}
+	}
+	if len(diff) == 0 {
+		return ""
+	}
+	out, _ := json.Marshal(diff)
+	return string(out)
+}
+
+// SetAuditSink copies every audit log entry to sink (file, syslog, HTTP
+// collector) in addition to SQLite. It must be called before Handler.
+func (s *Server) SetAuditSink(sink audit.Sink) {
+	s.auditSink = sink
+}
+
+// auditEvent converts a stored audit entry to the form sent to sinks.
+func auditEvent(e *store.AuditEntry) audit.Event {
+	return audit.Event{
+		Time:        time.Now().UTC(),
+		ClientCN:    e.ClientCN,
+		SourceIP:    e.SourceIP,
+		Method:      e.Method,
+		Path:        e.Path,
+		BodyHash:    e.BodyHash,
+		Result:      e.Result,
+		Error:       e.ErrorMsg,
+		RequestBody: e.RequestBody,
+		Diff:        e.Diff,
+	}
+}
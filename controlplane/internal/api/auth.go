@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// role is an API permission level. Higher roles include all lower ones.
+type role int
+
+const (
+	roleReadOnly role = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+// parseRole converts a configured role name into a role.
+func parseRole(name string) (role, bool) {
+	switch name {
+	case "read-only":
+		return roleReadOnly, true
+	case "operator":
+		return roleOperator, true
+	case "admin":
+		return roleAdmin, true
+	}
+	return 0, false
+}
+
+func (r role) String() string {
+	switch r {
+	case roleReadOnly:
+		return "read-only"
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// identity describes the authenticated caller of a request.
+type identity struct {
+	ClientCN string
+	TenantID string // empty for callers with cross-tenant scope
+	Role     role
+}
+
+// canAccess reports whether the caller may see or mutate a resource owned by tenantID.
+func (id *identity) canAccess(tenantID string) bool {
+	return id.TenantID == "" || id.TenantID == tenantID
+}
+
+type identityKey struct{}
+
+// identityFrom returns the identity stored by require. A request that did not
+// pass through require gets an identity with no role and no access.
+func identityFrom(ctx context.Context) *identity {
+	if id, ok := ctx.Value(identityKey{}).(*identity); ok {
+		return id
+	}
+	return &identity{TenantID: "-"}
+}
+
+// require resolves the caller's identity from its mTLS client certificate or
+// bearer token, rejects callers below the minimum role, and stores the
+// identity in the request context.
+func (s *Server) require(min role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, status, err := s.resolveIdentity(r)
+		if err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		if id.Role < min {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("insufficient role: %s required", min))
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	}
+}
+
+// resolveIdentity maps a request to an identity.
+//
+// Bearer tokens map to their tenant with the token's scope. Client certificates
+// get a role from ADMIN_CNS or ROLE_MAP (by CN, then OU); a CN registered on a
+// tenant scopes the caller to that tenant, capped at operator. Callers matching
+// nothing get DEFAULT_ROLE. When no mapping is configured at all the deployment
+// is single-tenant and every authenticated client is an admin. Certificates of
+// node agents are always refused.
+func (s *Server) resolveIdentity(r *http.Request) (*identity, int, error) {
+	cn := clientCN(r)
+
+	if token := bearerToken(r); token != "" {
+		tenant, err := s.tenantStore.GetByTokenHash(hashToken(token))
+		if err != nil {
+			return nil, http.StatusUnauthorized, fmt.Errorf("invalid API token")
+		}
+		scope, ok := parseRole(tenant.TokenScope)
+		if !ok || scope > roleOperator {
+			scope = roleOperator
+		}
+		return &identity{ClientCN: cn, TenantID: tenant.ID, Role: scope}, 0, nil
+	}
+
+	// Node agents use their certificates only for the agent endpoints
+	if cn != "" && s.nodeStore != nil {
+		if _, err := s.nodeStore.GetByClientCN(cn); err == nil {
+			return nil, http.StatusForbidden, fmt.Errorf("node agent certificates cannot use the management API")
+		}
+	}
+
+	mapped, hasRole := s.roleForCert(r)
+
+	if cn != "" {
+		if tenant, err := s.tenantStore.GetByClientCN(cn); err == nil {
+			if !hasRole || mapped > roleOperator {
+				mapped = roleOperator
+			}
+			return &identity{ClientCN: cn, TenantID: tenant.ID, Role: mapped}, 0, nil
+		}
+	}
+
+	if hasRole {
+		return &identity{ClientCN: cn, Role: mapped}, 0, nil
+	}
+	if def, ok := parseRole(s.cfg.DefaultRole); ok {
+		return &identity{ClientCN: cn, Role: def}, 0, nil
+	}
+	if len(s.cfg.AdminCNs) == 0 && len(s.cfg.RoleMap) == 0 {
+		return &identity{ClientCN: cn, Role: roleAdmin}, 0, nil
+	}
+	return nil, http.StatusForbidden, fmt.Errorf("client has no role mapping")
+}
+
+// roleForCert looks up the role of the verified client certificate by CN
+// (ADMIN_CNS, then ROLE_MAP "cn:") and then by OU (ROLE_MAP "ou:").
+func (s *Server) roleForCert(r *http.Request) (role, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return 0, false
+	}
+	subject := r.TLS.PeerCertificates[0].Subject
+
+	if slices.Contains(s.cfg.AdminCNs, subject.CommonName) {
+		return roleAdmin, true
+	}
+	if name, ok := s.cfg.RoleMap["cn:"+subject.CommonName]; ok {
+		return parseRole(name)
+	}
+	best, found := role(0), false
+	for _, ou := range subject.OrganizationalUnit {
+		if name, ok := s.cfg.RoleMap["ou:"+ou]; ok {
+			if rl, ok := parseRole(name); ok && rl > best {
+				best, found = rl, true
+			}
+		}
+	}
+	return best, found
+}
+
+// tenantForCreate returns the tenant a new resource should belong to. Callers
+// with cross-tenant scope may assign any existing tenant (or none); tenants
+// always own what they create.
+func (s *Server) tenantForCreate(r *http.Request, requested string) (string, int, error) {
+	id := identityFrom(r.Context())
+	if id.TenantID != "" {
+		if requested != "" && requested != id.TenantID {
+			return "", http.StatusForbidden, fmt.Errorf("cannot create resources for another tenant")
+		}
+		return id.TenantID, 0, nil
+	}
+	if requested != "" {
+		if _, err := s.tenantStore.Get(requested); err != nil {
+			return "", http.StatusBadRequest, fmt.Errorf("tenant not found")
+		}
+	}
+	return requested, 0, nil
+}
+
+// clientCN extracts the CommonName of the verified mTLS client certificate.
+func clientCN(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return ""
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// hashToken returns the hex SHA-256 of an API token. Only hashes are stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum)
+}
+
+// generateAPIToken returns a new random API token.
+func generateAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return "pmt_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import "sync"
+
+// backgroundQueue runs tasks one at a time, in the order they were queued,
+// so requests don't wait on the DNS provider or the webhook receivers, and a record's removal never overtakes its creation. The zero
+// value is ready to use.
+type backgroundQueue struct {
+	mu      sync.Mutex
+	tasks   []func()
+	running bool
+	idle    sync.WaitGroup
+}
+
+// push queues task, starting a worker if none is running.
+func (q *backgroundQueue) push(task func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks = append(q.tasks, task)
+	if !q.running {
+		q.running = true
+		q.idle.Add(1)
+		go q.drain()
+	}
+}
+
+// drain runs the queued tasks until there are none left.
+func (q *backgroundQueue) drain() {
+	defer q.idle.Done()
+	for {
+		q.mu.Lock()
+		if len(q.tasks) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		q.mu.Unlock()
+		task()
+	}
+}
+
+// wait blocks until every queued task has run.
+func (q *backgroundQueue) wait() {
+	q.idle.Wait()
+}
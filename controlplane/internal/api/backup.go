@@ -0,0 +1,27 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/proxy-manager/controlplane/internal/backup"
+)
+
+// SetBackup enables POST /api/v1/backup/snapshot, which uploads a database
+// snapshot on demand.
+func (s *Server) SetBackup(r *backup.Replicator) {
+	s.backup = r
+}
+
+func (s *Server) handleBackupSnapshot(w http.ResponseWriter, r *http.Request) {
+	if s.backup == nil {
+		writeError(w, http.StatusServiceUnavailable, "backups are not configured (set BACKUP_S3_BUCKET)")
+		return
+	}
+	res, err := s.backup.Snapshot(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("backup failed: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": res})
+}
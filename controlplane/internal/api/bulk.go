@@ -0,0 +1,235 @@
+package api
+
+import (
+	"cmp"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// maxBulkRules caps the rules of one bulk request.
+const maxBulkRules = 1000
+
+// Modes of a bulk request.
+const (
+	bulkAtomic     = "atomic"      // create every rule or none
+	bulkBestEffort = "best_effort" // create the valid rules and report the rest
+)
+
+// bulkFirewallRulesRequest is the JSON body of a bulk request: the rules, as
+// for creating them one at a time.
+type bulkFirewallRulesRequest []createFirewallRuleRequest
+
+// bulkRuleResult is the outcome of one rule of a bulk request.
+type bulkRuleResult struct {
+	Row    int                    `json:"row"`    // 1-based, in the array or below the CSV header
+	Status string                 `json:"status"` // "created", "valid", "invalid", or "failed"
+	Error  string                 `json:"error,omitempty"`
+	Rule   map[string]interface{} `json:"rule,omitempty"` // the created rule
+}
+
+// handleBulkFirewallRules creates many firewall rules from a JSON array or
+// a CSV document, such as a converted iptables ruleset. Every rule is
+// validated like a single create. ?mode=atomic, the default, creates them
+// in one transaction if all are valid and none otherwise;
+// ?mode=best_effort creates the valid ones. Each rule's outcome is
+// reported by its row.
+func (s *Server) handleBulkFirewallRules(w http.ResponseWriter, r *http.Request) {
+	mode := cmp.Or(r.URL.Query().Get("mode"), bulkAtomic)
+	if mode != bulkAtomic && mode != bulkBestEffort {
+		writeError(w, http.StatusBadRequest, "mode must be 'atomic' or 'best_effort'")
+		return
+	}
+
+	var reqs bulkFirewallRulesRequest
+	var rowErrs []error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+		var err error
+		reqs, rowErrs, err = parseRulesCSV(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else if !decodeJSON(w, r, &reqs) {
+		return
+	}
+	if len(reqs) == 0 {
+		writeError(w, http.StatusBadRequest, "no firewall rules given")
+		return
+	}
+	if len(reqs) > maxBulkRules {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d firewall rules can be created at once", maxBulkRules))
+		return
+	}
+
+	// Validate every rule first; names must also differ within the request
+	results := make([]bulkRuleResult, len(reqs))
+	rules := make([]*store.FirewallRule, len(reqs))
+	names := make(map[string]int)
+	invalid := 0
+	for i := range reqs {
+		results[i].Row = i + 1
+		var rule *store.FirewallRule
+		var err error
+		if rowErrs != nil && rowErrs[i] != nil {
+			err = rowErrs[i]
+		} else {
+			rule, _, err = s.prepareFirewallRule(r, &reqs[i])
+		}
+		if err == nil && rule.Name != "" {
+			key := rule.TenantID + "/" + rule.Name
+			if row, ok := names[key]; ok {
+				err = fmt.Errorf("name %q is already used by row %d", rule.Name, row)
+			}
+			names[key] = i + 1
+		}
+		if err != nil {
+			results[i].Status, results[i].Error = "invalid", err.Error()
+			invalid++
+			continue
+		}
+		results[i].Status = "valid"
+		rules[i] = rule
+	}
+
+	if mode == bulkAtomic {
+		if invalid > 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":   fmt.Sprintf("%d of %d firewall rules are invalid, none were created", invalid, len(reqs)),
+				"results": results,
+			})
+			return
+		}
+		if err := s.firewall(r).CreateAll(rules); errors.Is(err, store.ErrNameInUse) {
+			writeError(w, http.StatusConflict, fmt.Sprintf("%v, none were created", err))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to persist firewall rules: %v", err))
+			return
+		}
+	}
+
+	// Rules are stored before they are added to nftables, so a failed
+	// transaction leaves nftables untouched; the reconciler adds the rules
+	// that fail to be added here
+	now := time.Now()
+	created, failed := 0, 0
+	for i, rule := range rules {
+		if rule == nil {
+			continue
+		}
+		if mode == bulkBestEffort {
+			if err := s.firewall(r).Create(rule); err != nil {
+				results[i].Status, results[i].Error = "failed", err.Error()
+				failed++
+				continue
+			}
+		}
+		if rule.InActiveHours(now) {
+			if err := s.fwManager.AddRule(nftRule(rule)); err != nil {
+				slog.Warn("failed to add nftables rule", "id", rule.ID, "error", err)
+			}
+		}
+		results[i].Status, results[i].Rule = "created", firewallRuleResponse(rule)
+		created++
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"mode":    mode,
+			"created": created,
+			"invalid": invalid,
+			"failed":  failed,
+			"results": results,
+		},
+	})
+}
+
+// csvRuleColumns sets the field of a create request each CSV column holds.
+// Columns are named like the JSON fields.
+var csvRuleColumns = map[string]func(req *createFirewallRuleRequest, value string) error{
+	"name": func(req *createFirewallRuleRequest, v string) error { req.Name = v; return nil },
+	"port": func(req *createFirewallRuleRequest, v string) error {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", v)
+		}
+		req.Port = port
+		return nil
+	},
+	"proto":        func(req *createFirewallRuleRequest, v string) error { req.Proto = v; return nil },
+	"chain":        func(req *createFirewallRuleRequest, v string) error { req.Chain = v; return nil },
+	"direction":    func(req *createFirewallRuleRequest, v string) error { req.Direction = v; return nil },
+	"source_cidr":  func(req *createFirewallRuleRequest, v string) error { req.SourceCIDR = v; return nil },
+	"dest_cidr":    func(req *createFirewallRuleRequest, v string) error { req.DestCIDR = v; return nil },
+	"action":       func(req *createFirewallRuleRequest, v string) error { req.Action = v; return nil },
+	"tenant_id":    func(req *createFirewallRuleRequest, v string) error { req.TenantID = v; return nil },
+	"active_hours": func(req *createFirewallRuleRequest, v string) error { req.ActiveHours = v; return nil },
+	"description":  func(req *createFirewallRuleRequest, v string) error { req.Description = v; return nil },
+	"group":        func(req *createFirewallRuleRequest, v string) error { req.Group = v; return nil },
+}
+
+// parseRulesCSV reads firewall rules from a CSV document whose header row
+// names its columns. Empty cells take the defaults, and lines starting with
+// '#' are comments. It returns the rules with, for each one, the error that
+// makes it unreadable or nil, or an error for the whole document.
+func parseRulesCSV(body io.Reader) (bulkFirewallRulesRequest, []error, error) {
+	cr := csv.NewReader(body)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("CSV body has no header row")
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, col := range header {
+		col = strings.ToLower(strings.TrimSpace(col))
+		if csvRuleColumns[col] == nil {
+			return nil, nil, fmt.Errorf("unknown CSV column %q", col)
+		}
+		if seen[col] {
+			return nil, nil, fmt.Errorf("duplicate CSV column %q", col)
+		}
+		seen[col], header[i] = true, col
+	}
+
+	var reqs bulkFirewallRulesRequest
+	var rowErrs []error
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		var req createFirewallRuleRequest
+		var rowErr error
+		for i, value := range record {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			if err := csvRuleColumns[header[i]](&req, value); err != nil && rowErr == nil {
+				rowErr = err
+			}
+		}
+		reqs = append(reqs, req)
+		rowErrs = append(rowErrs, rowErr)
+	}
+	return reqs, rowErrs, nil
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/proxy-manager/controlplane/internal/ca"
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// Client certificate limits. 64 characters is the X.509 upper bound of a
+// CN or OU.
+const (
+	defaultCertValidityDays = 365
+	maxCertValidityDays     = 3650
+	maxCertNameLen          = 64
+	crlValidity             = 24 * time.Hour
+)
+
+// SetCA enables the client certificate endpoints, which issue certificates
+// signed by authority and record them in certs for revocation.
+func (s *Server) SetCA(authority *ca.Authority, certs *store.CertStore) {
+	s.ca = authority
+	s.certStore = certs
+}
+
+// CheckRevocation rejects a verified client certificate that the embedded
+// CA issued and that has since been revoked. It is looked up in SQLite on
+// every handshake, so revocations made by any instance apply at once.
+// Certificates of other CAs in TLS_CLIENT_CA are not checked.
+func (s *Server) CheckRevocation(cert *x509.Certificate) error {
+	if s.ca == nil || !s.ca.Issued(cert) {
+		return nil
+	}
+	revoked, err := s.certStore.IsRevoked(cert.SerialNumber.Text(16))
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return fmt.Errorf("client certificate %s has been revoked", cert.SerialNumber.Text(16))
+	}
+	return nil
+}
+
+type issueCertRequest struct {
+	CommonName         string `json:"common_name"`
+	OrganizationalUnit string `json:"organizational_unit,omitempty"`
+	ValidityDays       int    `json:"validity_days,omitempty"` // default 365
+	CSR                string `json:"csr,omitempty"`           // PEM request; the server generates the key pair if empty
+}
+
+type revokeCertRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// validCertName reports whether name can be a CN or OU: 1-64 characters,
+// none of them control characters.
+func validCertName(name string) bool {
+	return name != "" && len([]rune(name)) <= maxCertNameLen && strings.IndexFunc(name, unicode.IsControl) < 0
+}
+
+// requireCA writes a 503 and returns false when no CA key is configured.
+func (s *Server) requireCA(w http.ResponseWriter) bool {
+	if s.ca == nil {
+		writeError(w, http.StatusServiceUnavailable, "certificate issuance is not configured (set TLS_CLIENT_CA_KEY)")
+		return false
+	}
+	return true
+}
+
+// handleIssueCert signs a client certificate. Unless the request brings a
+// CSR, the private key is generated here and returned only in this
+// response; it is never stored.
+func (s *Server) handleIssueCert(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCA(w) {
+		return
+	}
+	var req issueCertRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !validCertName(req.CommonName) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("common_name must be 1-%d characters without control characters", maxCertNameLen))
+		return
+	}
+	if req.OrganizationalUnit != "" && !validCertName(req.OrganizationalUnit) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("organizational_unit must be at most %d characters without control characters", maxCertNameLen))
+		return
+	}
+	if req.ValidityDays == 0 {
+		req.ValidityDays = defaultCertValidityDays
+	}
+	if req.ValidityDays < 1 || req.ValidityDays > maxCertValidityDays {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("validity_days must be between 1 and %d", maxCertValidityDays))
+		return
+	}
+
+	issued, err := s.ca.Issue(ca.Request{
+		CommonName:         req.CommonName,
+		OrganizationalUnit: req.OrganizationalUnit,
+		Validity:           time.Duration(req.ValidityDays) * 24 * time.Hour,
+		CSR:                []byte(req.CSR),
+	})
+	if errors.Is(err, ca.ErrBeyondCA) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("validity_days: %v", err))
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if req.CSR != "" {
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, fmt.Sprintf("failed to issue certificate: %v", err))
+		return
+	}
+
+	cert := &store.ClientCert{
+		Serial:             issued.Serial,
+		CommonName:         req.CommonName,
+		OrganizationalUnit: req.OrganizationalUnit,
+		IssuedBy:           identityFrom(r.Context()).ClientCN,
+		NotBefore:          issued.NotBefore,
+		NotAfter:           issued.NotAfter,
+	}
+	if err := s.certStore.Create(cert); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to record certificate: %v", err))
+		return
+	}
+
+	data := certResponse(cert)
+	data["certificate"] = issued.CertPEM
+	data["ca_certificate"] = s.ca.CertPEM()
+	if issued.KeyPEM != "" {
+		data["private_key"] = issued.KeyPEM
+		data["warning"] = "Save this private key now. It will not be shown again."
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"data": data})
+}
+
+func (s *Server) handleListCerts(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCA(w) {
+		return
+	}
+	certs, err := s.certStore.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list certificates: %v", err))
+		return
+	}
+	result := make([]map[string]interface{}, 0, len(certs))
+	for _, c := range certs {
+		result = append(result, certResponse(c))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+func (s *Server) handleGetCert(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCA(w) {
+		return
+	}
+	cert, err := s.certStore.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "certificate not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": certResponse(cert)})
+}
+
+// handleRevokeCert revokes a certificate. New handshakes with it fail right
+// away; connections already open are not cut.
+func (s *Server) handleRevokeCert(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCA(w) {
+		return
+	}
+	var req revokeCertRequest
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+		return
+	}
+	id := r.PathValue("id")
+	if _, err := s.certStore.Get(id); err != nil {
+		writeError(w, http.StatusNotFound, "certificate not found")
+		return
+	}
+	if err := s.certStore.Revoke(id, req.Reason, time.Now()); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrAlreadyRevoked) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	cert, err := s.certStore.Get(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load certificate: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": certResponse(cert)})
+}
+
+// handleGetCRL serves the CA's revocation list in PEM, for proxies or other
+// services that verify the same client certificates. It lists revoked
+// certificates until they expire and is signed afresh on every request.
+func (s *Server) handleGetCRL(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCA(w) {
+		return
+	}
+	certs, err := s.certStore.ListRevoked(time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list revoked certificates: %v", err))
+		return
+	}
+	revoked := make([]ca.Revoked, 0, len(certs))
+	for _, c := range certs {
+		revoked = append(revoked, ca.Revoked{Serial: c.Serial, RevokedAt: *c.RevokedAt})
+	}
+	crl, err := s.ca.CRL(revoked, crlValidity)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to sign CRL: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", "attachment; filename=client-ca.crl")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(crl))
+}
+
+func certResponse(c *store.ClientCert) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                  c.Serial,
+		"common_name":         c.CommonName,
+		"organizational_unit": c.OrganizationalUnit,
+		"issued_by":           c.IssuedBy,
+		"not_before":          c.NotBefore.UTC().Format(time.RFC3339),
+		"not_after":           c.NotAfter.UTC().Format(time.RFC3339),
+		"created_at":          c.CreatedAt.UTC().Format(time.RFC3339),
+		"revoked":             c.RevokedAt != nil,
+		"revoked_at":          formatTimePtr(c.RevokedAt),
+		"revocation_reason":   c.RevocationReason,
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"github.com/proxy-manager/controlplane/internal/housekeeping"
+)
+
+// SetHousekeeping adds the database size and the outcome of the latest
+// checkpoint, integrity check, vacuum, and audit pruning to GET
+// /api/v1/status and the metrics.
+func (s *Server) SetHousekeeping(k *housekeeping.Keeper) {
+	s.keeper = k
+}
+
+// databaseStatus describes the database files and housekeeping runs.
+func (s *Server) databaseStatus() map[string]interface{} {
+	status := map[string]interface{}{}
+	if stats, err := s.keeper.Stats(); err != nil {
+		status["error"] = err.Error()
+	} else {
+		status["size_bytes"] = stats.FileBytes
+		status["wal_bytes"] = stats.WALBytes
+		status["free_bytes"] = stats.FreeBytes()
+	}
+
+	runs := s.keeper.Status()
+	var checkpoint, integrity, vacuum, prune interface{}
+	if c := runs.Checkpoint; c != nil {
+		checkpoint = runResponse(c.Run, map[string]interface{}{
+			"busy":         c.Busy,
+			"log_frames":   c.LogFrames,
+			"checkpointed": c.Checkpointed,
+		})
+	}
+	if i := runs.Integrity; i != nil {
+		problems := i.Problems
+		if problems == nil {
+			problems = []string{}
+		}
+		integrity = runResponse(i.Run, map[string]interface{}{
+			"ok":       i.Err == "" && len(i.Problems) == 0,
+			"problems": problems,
+		})
+	}
+	if v := runs.Vacuum; v != nil {
+		vacuum = runResponse(v.Run, map[string]interface{}{"freed_bytes": v.FreedBytes})
+	}
+	if p := runs.AuditPrune; p != nil {
+		var archive interface{}
+		if p.Archive != "" {
+			archive = p.Archive
+		}
+		prune = runResponse(p.Run, map[string]interface{}{"deleted": p.Deleted, "archive": archive})
+	}
+	status["checkpoint"] = checkpoint
+	status["integrity_check"] = integrity
+	status["vacuum"] = vacuum
+	status["audit_prune"] = prune
+	return status
+}
+
+// runResponse adds the time, duration, and error of a housekeeping run to
+// its fields.
+func runResponse(run housekeeping.Run, fields map[string]interface{}) map[string]interface{} {
+	var runErr interface{}
+	if run.Err != "" {
+		runErr = run.Err
+	}
+	fields["last_run_at"] = formatTimePtr(&run.At)
+	fields["duration_ms"] = run.Duration.Milliseconds()
+	fields["error"] = runErr
+	return fields
+}
+
+// databaseMetrics returns the database file sizes and, once a check has
+// run, whether the database passed its latest integrity check. They are
+// left out if the sizes cannot be read.
+func (s *Server) databaseMetrics() []metric {
+	stats, err := s.keeper.Stats()
+	if err != nil {
+		return nil
+	}
+	metrics := []metric{
+		{name: "proxy_manager_db_size_bytes", help: "Size of the SQLite database file.", samples: []sample{{value: float64(stats.FileBytes)}}},
+		{name: "proxy_manager_db_wal_bytes", help: "Size of the SQLite write-ahead log.", samples: []sample{{value: float64(stats.WALBytes)}}},
+		{name: "proxy_manager_db_free_bytes", help: "Space taken by free pages, returned to the OS by the next vacuum.", samples: []sample{{value: float64(stats.FreeBytes())}}},
+	}
+	if i := s.keeper.Status().Integrity; i != nil {
+		ok := 0.0
+		if i.Err == "" && len(i.Problems) == 0 {
+			ok = 1
+		}
+		metrics = append(metrics, metric{name: "proxy_manager_db_integrity_ok", help: "Whether the latest database integrity check passed.", samples: []sample{{value: ok}}})
+	}
+	return metrics
+}
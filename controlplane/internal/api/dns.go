@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/dns"
+)
+
+// dnsTimeout bounds the provider calls queued by a single request.
+const dnsTimeout = 30 * time.Second
+
+// SetDNS makes SNI route domains resolve to the VPS: records are published
+// when a route is created and removed when it is deleted.
+func (s *Server) SetDNS(u *dns.Updater) {
+	s.dns = u
+}
+
+// publishDNS queues the creation of records for a new SNI route's domains.
+// It is best effort: the route works as soon as the records exist, so a
+// provider failure is logged rather than failing the request, which does
+// not wait for the provider.
+func (s *Server) publishDNS(domains []string) {
+	if s.dns == nil || len(domains) == 0 {
+		return
+	}
+	s.background.push(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		defer cancel()
+		if err := s.dns.Publish(ctx, domains); err != nil {
+			slog.Warn("failed to publish DNS records", "domains", domains, "error", err)
+		}
+	})
+}
+
+// unpublishDNS queues the removal of a deleted SNI route's records.
+func (s *Server) unpublishDNS(domains []string) {
+	if s.dns == nil || len(domains) == 0 {
+		return
+	}
+	s.background.push(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		defer cancel()
+		if err := s.dns.Unpublish(ctx, domains); err != nil {
+			slog.Warn("failed to remove DNS records", "domains", domains, "error", err)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// keyEscrow keeps the private key and PSK of a tunnel whose keys the server
+// just generated, so its config can still be downloaded, e.g. as a QR code
+// for a phone, for a short while after the create or rotate response. Keys
+// are only held in memory and never written to the database.
+type keyEscrow struct {
+	mu   sync.Mutex
+	keys map[string]escrowedKey // by tunnel ID
+}
+
+type escrowedKey struct {
+	privateKey string
+	psk        string
+	expires    time.Time
+}
+
+func newKeyEscrow() *keyEscrow {
+	return &keyEscrow{keys: make(map[string]escrowedKey)}
+}
+
+// put holds a tunnel's keys for ttl, replacing any held before. A zero ttl
+// disables the escrow.
+func (e *keyEscrow) put(tunnelID, privateKey, psk string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	for id, k := range e.keys {
+		if now.After(k.expires) {
+			delete(e.keys, id)
+		}
+	}
+	e.keys[tunnelID] = escrowedKey{privateKey: privateKey, psk: psk, expires: now.Add(ttl)}
+}
+
+// get returns the keys held for a tunnel, if they have not expired.
+func (e *keyEscrow) get(tunnelID string) (escrowedKey, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	k, ok := e.keys[tunnelID]
+	if !ok || time.Now().After(k.expires) {
+		delete(e.keys, tunnelID)
+		return escrowedKey{}, false
+	}
+	return k, true
+}
+
+// drop forgets a tunnel's keys, e.g. when it is deleted.
+func (e *keyEscrow) drop(tunnelID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.keys, tunnelID)
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// ETags are derived from the fields callers can change, plus the updated_at
+// of routes and firewall rules, so two edits within the same second still
+// produce different tags. Fields the reconciler refreshes on every pass
+// (handshakes, traffic counters, endpoints) are left out; otherwise every
+// tag would go stale within one interval. Stats updates bump a tunnel's
+// updated_at, so its tag leaves that out too.
+
+// etagOf hashes the given values into a strong ETag.
+func etagOf(fields ...interface{}) string {
+	h := sha256.New()
+	for _, f := range fields {
+		fmt.Fprintf(h, "\x00%v", f)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+}
+
+// unixOrZero formats an optional time for hashing.
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// tunnelETag covers the tunnel and its rotation policy, which share a row.
+func tunnelETag(t *store.Tunnel) string {
+	return etagOf(
+		t.Name, t.Domains, t.Labels, t.SourceCIDR, t.Isolate, t.Enabled, t.PublicKey, t.PendingRotationID,
+		t.AutoRotatePSK, t.PSKRotationIntervalDays, t.AutoRevokeInactive,
+		t.InactiveExpiryDays, t.GracePeriodMinutes,
+		unixOrZero(t.LastRotationAt), unixOrZero(t.RevokeDeferredUntil),
+		t.Keepalive(-1), t.ConnectedWithin(-1), t.ClientRouting, // -1 when unset
+		t.AdvertisedRoutes, t.Description, t.OwnerEmail, t.DeviceName,
+		unixOrZero(t.ExpiresAt), t.PendingApproval, t.AllowedUpstreamPorts,
+		t.ClientDNS, t.ClientMTU,
+	)
+}
+
+func routeETag(r *store.Route) string {
+	return etagOf(r.UpdatedAt.Unix(), r.Priority, r.Enabled, r.MatchValue, r.Upstream)
+}
+
+func firewallRuleETag(fr *store.FirewallRule) string {
+	return etagOf(fr.UpdatedAt.Unix(), fr.Port, fr.Proto, fr.SourceCIDR, fr.Action, fr.Enabled, fr.ActiveHours, fr.Description, fr.Group)
+}
+
+// lockIfMatch serializes conditional writes, so two requests carrying the
+// same If-Match cannot both pass the check before either writes. Requests
+// without If-Match are not serialized. Call the returned func when done.
+func (s *Server) lockIfMatch(r *http.Request) func() {
+	if r.Header.Get("If-Match") == "" {
+		return func() {}
+	}
+	s.writeMu.Lock()
+	return s.writeMu.Unlock
+}
+
+// checkIfMatch enforces an If-Match precondition against the resource's
+// current ETag. It writes 412 and returns false when none of the listed tags
+// match; a missing header or "*" always passes.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, current string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	w.Header().Set("ETag", current)
+	writeError(w, http.StatusPreconditionFailed, "resource was modified; fetch it again and retry with the new ETag")
+	return false
+}
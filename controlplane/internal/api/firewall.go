@@ -1,11 +1,14 @@
 package api
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"time"
+	"unicode/utf8"
 
 	"github.com/proxy-manager/controlplane/internal/firewall"
 	"github.com/proxy-manager/controlplane/internal/store"
@@ -13,128 +16,387 @@ import (
 )
 
 type createFirewallRuleRequest struct {
+	Name       string `json:"name,omitempty"` // unique per tenant; see PUT /api/v1/firewall/rules/by-name/{name}
 	Port       int    `json:"port"`
 	Proto      string `json:"proto"`
+	Chain      string `json:"chain,omitempty"`
+	Direction  string `json:"direction,omitempty"`
 	SourceCIDR string `json:"source_cidr,omitempty"`
+	DestCIDR   string `json:"dest_cidr,omitempty"` // empty matches every destination
 	Action     string `json:"action,omitempty"`
+	TenantID   string `json:"tenant_id,omitempty"`
+
+	ActiveHours string `json:"active_hours,omitempty"` // "HH:MM-HH:MM" UTC; empty is all day
+	Description string `json:"description,omitempty"`
+	Group       string `json:"group,omitempty"` // see DELETE /api/v1/firewall/groups/{group}
+}
+
+type updateFirewallRuleRequest struct {
+	SourceCIDR  *string `json:"source_cidr,omitempty"`
+	Action      *string `json:"action,omitempty"`
+	Enabled     *bool   `json:"enabled,omitempty"`
+	ActiveHours *string `json:"active_hours,omitempty"` // "" applies the rule all day
+	Description *string `json:"description,omitempty"`  // "" clears it
+	Group       *string `json:"group,omitempty"`        // "" takes the rule out of its group
 }
 
 func (s *Server) handleCreateFirewallRule(w http.ResponseWriter, r *http.Request) {
 	var req createFirewallRuleRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON body")
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	dbRule, status, err := s.prepareFirewallRule(r, &req)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	// Add to nftables, unless the rule is outside its active hours; the
+	// reconciler adds it when they start
+	active := dbRule.InActiveHours(time.Now())
+	if active {
+		if err := s.fwManager.AddRule(nftRule(dbRule)); err != nil {
+			// Non-fatal, reconciler will fix
+			fmt.Printf("warning: failed to add nftables rule: %v\n", err)
+		}
+	}
+
+	// Persist to SQLite
+	if err := s.firewall(r).Create(dbRule); errors.Is(err, store.ErrNameInUse) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("name %q is already used by another firewall rule", req.Name))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to persist firewall rule: %v", err))
 		return
 	}
 
-	// Set defaults
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":          dbRule.ID,
+			"name":        req.Name,
+			"port":        req.Port,
+			"proto":       req.Proto,
+			"chain":       req.Chain,
+			"direction":   req.Direction,
+			"source_cidr": req.SourceCIDR,
+			"dest_cidr":   req.DestCIDR,
+			"action":      req.Action,
+			"status":      "active",
+			"enabled":     true,
+			"tenant_id":   dbRule.TenantID,
+			"created_at":  dbRule.CreatedAt.UTC().Format(time.RFC3339),
+			"updated_at":  dbRule.UpdatedAt.UTC().Format(time.RFC3339),
+
+			"active_hours": req.ActiveHours,
+			"active":       active,
+			"description":  req.Description,
+			"group":        req.Group,
+		},
+	})
+}
+
+// prepareFirewallRule applies the defaults to a create request, validates it,
+// and checks the caller may create it, without changing anything. It
+// returns the rule to store, with a new ID, or the status and error to
+// report.
+func (s *Server) prepareFirewallRule(r *http.Request, req *createFirewallRuleRequest) (*store.FirewallRule, int, error) {
+	// Set defaults; the source defaults to the destination's address family
 	if req.SourceCIDR == "" {
 		req.SourceCIDR = "0.0.0.0/0"
+		if dest, err := netip.ParsePrefix(req.DestCIDR); err == nil && dest.Addr().Is6() {
+			req.SourceCIDR = "::/0"
+		}
 	}
 	if req.Action == "" {
 		req.Action = "allow"
 	}
+	if req.Chain == "" {
+		req.Chain = firewall.ChainInput
+	}
+	if req.Direction == "" {
+		req.Direction = "in"
+		if req.Chain == firewall.ChainOutput {
+			req.Direction = "out"
+		}
+	}
+
+	// Validate chain and direction; only forward rules can match traffic
+	// leaving through the WireGuard interface, and output rules match what
+	// the VPS itself sends
+	if req.Chain != firewall.ChainInput && req.Chain != firewall.ChainForward && req.Chain != firewall.ChainOutput {
+		return nil, http.StatusBadRequest, errors.New("chain must be 'input', 'forward', or 'output'")
+	}
+	if req.Direction != "in" && req.Direction != "out" {
+		return nil, http.StatusBadRequest, errors.New("direction must be 'in' or 'out'")
+	}
+	if req.Direction == "out" && req.Chain == firewall.ChainInput {
+		return nil, http.StatusBadRequest, errors.New("direction 'out' requires chain 'forward' or 'output'")
+	}
+	if req.Direction == "in" && req.Chain == firewall.ChainOutput {
+		return nil, http.StatusBadRequest, errors.New("chain 'output' requires direction 'out'")
+	}
 
-	// Validate port
+	// Validate port; reserved ports protect the VPS, which forward rules don't filter
 	if req.Port < 1 || req.Port > 65535 {
-		writeError(w, http.StatusBadRequest, "port must be between 1 and 65535")
-		return
+		return nil, http.StatusBadRequest, errors.New("port must be between 1 and 65535")
 	}
-	if reservedPorts[req.Port] {
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("port %d is reserved", req.Port))
-		return
+	if s.cfg.ReservedPorts[req.Port] && req.Chain == firewall.ChainInput {
+		return nil, http.StatusBadRequest, fmt.Errorf("port %d is reserved", req.Port)
 	}
 
 	// Validate protocol
 	if req.Proto != "tcp" && req.Proto != "udp" {
-		writeError(w, http.StatusBadRequest, "proto must be 'tcp' or 'udp'")
-		return
+		return nil, http.StatusBadRequest, errors.New("proto must be 'tcp' or 'udp'")
 	}
 
-	// Validate CIDR
-	_, _, err := net.ParseCIDR(req.SourceCIDR)
+	// Validate CIDR; store it the way nftables reports it back (host bits cleared)
+	_, ipNet, err := net.ParseCIDR(req.SourceCIDR)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid source_cidr: %v", err))
-		return
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid source_cidr: %v", err)
+	}
+	req.SourceCIDR = ipNet.String()
+	if req.DestCIDR != "" {
+		_, ipNet, err := net.ParseCIDR(req.DestCIDR)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid dest_cidr: %v", err)
+		}
+		// A /0 destination is any destination
+		req.DestCIDR = ""
+		if ones, _ := ipNet.Mask.Size(); ones > 0 {
+			req.DestCIDR = ipNet.String()
+		}
+	}
+	if !sameFamily(req.SourceCIDR, req.DestCIDR) {
+		return nil, http.StatusBadRequest, errors.New("source_cidr and dest_cidr must be of the same address family")
 	}
 
 	// Validate action
 	if req.Action != "allow" && req.Action != "deny" {
-		writeError(w, http.StatusBadRequest, "action must be 'allow' or 'deny'")
-		return
+		return nil, http.StatusBadRequest, errors.New("action must be 'allow' or 'deny'")
 	}
-
-	ruleID := wireguard.GenerateRandomID("fw_rule_")
-
-	// Add to nftables
-	fwRule := firewall.Rule{
-		ID:         ruleID,
-		Port:       req.Port,
-		Proto:      req.Proto,
-		Direction:  "in",
-		SourceCIDR: req.SourceCIDR,
-		Action:     req.Action,
+	if _, _, err := store.ParseActiveHours(req.ActiveHours); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid active_hours: %v", err)
 	}
-	if err := s.fwManager.AddRule(fwRule); err != nil {
-		// Non-fatal, reconciler will fix
-		fmt.Printf("warning: failed to add nftables rule: %v\n", err)
+	if err := validateRuleNotes(req.Description, req.Group); err != nil {
+		return nil, http.StatusBadRequest, err
 	}
 
-	// Persist to SQLite
-	dbRule := &store.FirewallRule{
-		ID:         ruleID,
-		Port:       req.Port,
-		Proto:      req.Proto,
-		Direction:  "in",
-		SourceCIDR: req.SourceCIDR,
-		Action:     req.Action,
-		Enabled:    true,
-	}
-	if err := s.fwStore.Create(dbRule); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to persist firewall rule: %v", err))
-		return
+	tenantID, status, err := s.tenantForCreate(r, req.TenantID)
+	if err != nil {
+		return nil, status, err
+	}
+	if status, err := s.checkName("firewall rule", tenantID, req.Name); err != nil {
+		return nil, status, err
+	}
+	// A deny rule only narrows access, so its addresses are not a claim
+	claim := policyClaim{Ports: []store.PortRange{{Start: req.Port, End: req.Port}}}
+	if req.Action == "allow" {
+		claim.SourceCIDRs = []string{req.SourceCIDR}
+		if req.DestCIDR != "" {
+			claim.DestCIDRs = []string{req.DestCIDR}
+		}
+	}
+	if status, err := s.checkPolicy(tenantID, claim); err != nil {
+		return nil, status, err
 	}
 
-	writeJSON(w, http.StatusCreated, map[string]interface{}{
-		"data": map[string]interface{}{
-			"id":          ruleID,
-			"port":        req.Port,
-			"proto":       req.Proto,
-			"source_cidr": req.SourceCIDR,
-			"action":      req.Action,
-			"status":      "active",
-			"enabled":     true,
-			"created_at":  dbRule.CreatedAt.UTC().Format(time.RFC3339),
-			"updated_at":  dbRule.UpdatedAt.UTC().Format(time.RFC3339),
-		},
-	})
+	return &store.FirewallRule{
+		ID:          wireguard.GenerateRandomID("fw_rule_"),
+		Name:        req.Name,
+		Port:        req.Port,
+		Proto:       req.Proto,
+		Chain:       req.Chain,
+		Direction:   req.Direction,
+		SourceCIDR:  req.SourceCIDR,
+		DestCIDR:    req.DestCIDR,
+		Action:      req.Action,
+		Enabled:     true,
+		TenantID:    tenantID,
+		ActiveHours: req.ActiveHours,
+		Description: req.Description,
+		Group:       req.Group,
+	}, 0, nil
+}
+
+// nftRule is the nftables rule of a stored firewall rule.
+func nftRule(rule *store.FirewallRule) firewall.Rule {
+	return firewall.Rule{
+		ID:         rule.ID,
+		Port:       rule.Port,
+		Proto:      rule.Proto,
+		Chain:      rule.Chain,
+		Direction:  rule.Direction,
+		SourceCIDR: rule.SourceCIDR,
+		DestCIDR:   rule.DestCIDR,
+		Action:     rule.Action,
+	}
 }
 
 func (s *Server) handleListFirewallRules(w http.ResponseWriter, r *http.Request) {
-	rules, err := s.fwStore.List()
+	rules, err := s.firewall(r).List()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list firewall rules: %v", err))
 		return
 	}
 
+	caller := identityFrom(r.Context())
+	named := nameFilter(r)
+	group := r.URL.Query().Get("group")
+	hits := s.ruleHits()
 	result := make([]map[string]interface{}, 0, len(rules))
 	for _, rule := range rules {
-		entry := map[string]interface{}{
-			"id":          rule.ID,
-			"port":        rule.Port,
-			"proto":       rule.Proto,
-			"direction":   rule.Direction,
-			"source_cidr": rule.SourceCIDR,
-			"action":      rule.Action,
-			"enabled":     rule.Enabled,
-			"created_at":  rule.CreatedAt.UTC().Format(time.RFC3339),
-			"updated_at":  rule.UpdatedAt.UTC().Format(time.RFC3339),
+		if !caller.canAccess(rule.TenantID) || !named(rule.Name) || (group != "" && rule.Group != group) {
+			continue
+		}
+		resp := firewallRuleResponse(rule)
+		resp["hits"] = nil
+		if h, ok := hits[rule.ID]; ok {
+			resp["hits"] = map[string]interface{}{"packets": h.Packets, "bytes": h.Bytes}
 		}
-		result = append(result, entry)
+		result = append(result, resp)
 	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
 }
 
+// ruleHits returns the rules in nftables by ID, with the packets and bytes
+// they matched. It returns nil if the chains cannot be read, so listings
+// still work without nftables.
+func (s *Server) ruleHits() map[string]firewall.Rule {
+	rules, err := s.fwManager.ListRules()
+	if err != nil {
+		slog.Warn("failed to read firewall rule counters", "error", err)
+		return nil
+	}
+	hits := make(map[string]firewall.Rule, len(rules))
+	for _, rule := range rules {
+		hits[rule.ID] = rule
+	}
+	return hits
+}
+
+// handleUpdateFirewallRule changes a rule's source CIDR, action, or enabled
+// flag. nftables is updated first so a rejected change leaves the stored
+// rule untouched, and the nftables change is undone if the store update
+// fails.
+func (s *Server) handleUpdateFirewallRule(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "rule id is required")
+		return
+	}
+
+	var req updateFirewallRuleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.SourceCIDR != nil {
+		_, ipNet, err := net.ParseCIDR(*req.SourceCIDR)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid source_cidr: %v", err))
+			return
+		}
+		*req.SourceCIDR = ipNet.String()
+	}
+	if req.Action != nil && *req.Action != "allow" && *req.Action != "deny" {
+		writeError(w, http.StatusBadRequest, "action must be 'allow' or 'deny'")
+		return
+	}
+	if req.ActiveHours != nil {
+		if _, _, err := store.ParseActiveHours(*req.ActiveHours); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid active_hours: %v", err))
+			return
+		}
+	}
+	if err := validateRuleNotes(deref(req.Description), deref(req.Group)); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	defer s.lockIfMatch(r)()
+	rule, err := s.firewall(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(rule.TenantID) {
+		writeError(w, http.StatusNotFound, "firewall rule not found")
+		return
+	}
+	if !checkIfMatch(w, r, firewallRuleETag(rule)) {
+		return
+	}
+
+	updated := *rule
+	if req.SourceCIDR != nil {
+		updated.SourceCIDR = *req.SourceCIDR
+	}
+	if req.Action != nil {
+		updated.Action = *req.Action
+	}
+	if req.Enabled != nil {
+		updated.Enabled = *req.Enabled
+	}
+	if req.ActiveHours != nil {
+		updated.ActiveHours = *req.ActiveHours
+	}
+	if req.Description != nil {
+		updated.Description = *req.Description
+	}
+	if req.Group != nil {
+		updated.Group = *req.Group
+	}
+	if updated == *rule {
+		w.Header().Set("ETag", firewallRuleETag(rule))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": firewallRuleResponse(rule)})
+		return
+	}
+	if !sameFamily(updated.SourceCIDR, updated.DestCIDR) {
+		writeError(w, http.StatusBadRequest, "source_cidr and dest_cidr must be of the same address family")
+		return
+	}
+	if updated.Action == "allow" && (updated.SourceCIDR != rule.SourceCIDR || rule.Action != "allow") {
+		claim := policyClaim{SourceCIDRs: []string{updated.SourceCIDR}}
+		if updated.DestCIDR != "" {
+			claim.DestCIDRs = []string{updated.DestCIDR}
+		}
+		if status, err := s.checkPolicy(rule.TenantID, claim); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+	}
+
+	// Only rules enabled and within their active hours are in nftables
+	now := time.Now()
+	wasActive := rule.Enabled && rule.InActiveHours(now)
+	active := updated.Enabled && updated.InActiveHours(now)
+	if err := s.applyRuleChange(rule, &updated, wasActive, active); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update nftables rule: %v", err))
+		return
+	}
+
+	if err := s.firewall(r).Update(&updated); err != nil {
+		if err := s.applyRuleChange(&updated, rule, active, wasActive); err != nil {
+			fmt.Printf("warning: failed to restore nftables rule %s: %v\n", rule.ID, err)
+		}
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update firewall rule: %v", err))
+		return
+	}
+
+	w.Header().Set("ETag", firewallRuleETag(&updated))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": firewallRuleResponse(&updated)})
+}
+
+// applyRuleChange moves the nftables rule of from to that of to, adding or
+// removing it as the rule becomes active or inactive.
+func (s *Server) applyRuleChange(from, to *store.FirewallRule, wasActive, active bool) error {
+	switch {
+	case wasActive && active:
+		return s.fwManager.ReplaceRule(nftRule(to))
+	case active:
+		return s.fwManager.AddRule(nftRule(to))
+	case wasActive:
+		return s.fwManager.DeleteRule(from.ID)
+	}
+	return nil
+}
+
 func (s *Server) handleDeleteFirewallRule(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
@@ -142,11 +404,15 @@ func (s *Server) handleDeleteFirewallRule(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	rule, err := s.fwStore.Get(id)
-	if err != nil {
+	defer s.lockIfMatch(r)()
+	rule, err := s.firewall(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(rule.TenantID) {
 		writeError(w, http.StatusNotFound, "firewall rule not found")
 		return
 	}
+	if !checkIfMatch(w, r, firewallRuleETag(rule)) {
+		return
+	}
 
 	// Remove from nftables
 	if err := s.fwManager.DeleteRule(rule.ID); err != nil {
@@ -155,10 +421,258 @@ func (s *Server) handleDeleteFirewallRule(w http.ResponseWriter, r *http.Request
 	}
 
 	// Delete from DB
-	if err := s.fwStore.Delete(id); err != nil {
+	if err := s.firewall(r).Delete(id); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete firewall rule: %v", err))
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// handleDeleteFirewallGroup deletes every firewall rule of a group the
+// caller can access, such as the rules created for one application. The
+// rules are removed from nftables first, then from SQLite in a single
+// transaction; nftables deletions that fail are left to the reconciler.
+func (s *Server) handleDeleteFirewallGroup(w http.ResponseWriter, r *http.Request) {
+	group := r.PathValue("group")
+	rules, err := s.firewall(r).List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list firewall rules: %v", err))
+		return
+	}
+
+	caller := identityFrom(r.Context())
+	ids := []string{}
+	for _, rule := range rules {
+		if rule.Group == group && caller.canAccess(rule.TenantID) {
+			ids = append(ids, rule.ID)
+		}
+	}
+	if len(ids) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("firewall rule group %q not found", group))
+		return
+	}
+
+	for _, id := range ids {
+		if err := s.fwManager.DeleteRule(id); err != nil {
+			// Non-fatal
+			fmt.Printf("warning: failed to delete nftables rule: %v\n", err)
+		}
+	}
+	if err := s.firewall(r).DeleteAll(ids); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete firewall rules: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{"group": group, "deleted": ids},
+	})
+}
+
+// simulatePath evaluates the firewall rules without changing anything.
+const simulatePath = "/api/v1/firewall/rules/simulate"
+
+type simulateFirewallRequest struct {
+	SourceIP  string `json:"source_ip"`
+	DestIP    string `json:"dest_ip,omitempty"` // needed to match rules with a dest_cidr
+	Port      int    `json:"port"`
+	Proto     string `json:"proto"`
+	Chain     string `json:"chain,omitempty"`     // default "input"
+	Direction string `json:"direction,omitempty"` // default "in", or "out" on the output chain
+}
+
+// handleSimulateFirewall reports whether a new connection would get through
+// the dynamic chains, and what decides on it: a rule, a ban, peer isolation,
+// a service, or the chain policy. It evaluates the stored rules that are
+// enabled and within their active hours, not what nftables holds, so drift
+// the reconciler has yet to correct is not reflected.
+func (s *Server) handleSimulateFirewall(w http.ResponseWriter, r *http.Request) {
+	var req simulateFirewallRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	packet := firewall.Packet{Chain: req.Chain, Direction: req.Direction, Port: req.Port, Proto: req.Proto}
+	var err error
+	if packet.Source, err = netip.ParseAddr(req.SourceIP); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid source_ip: %v", err))
+		return
+	}
+	if req.DestIP != "" {
+		if packet.Dest, err = netip.ParseAddr(req.DestIP); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid dest_ip: %v", err))
+			return
+		}
+		if packet.Source.Unmap().Is4() != packet.Dest.Unmap().Is4() {
+			writeError(w, http.StatusBadRequest, "source_ip and dest_ip must be of the same address family")
+			return
+		}
+	}
+	// A packet is described like a rule that would match it
+	if err := firewall.ValidateRule(firewall.Rule{Port: req.Port, Proto: req.Proto, Chain: req.Chain, Direction: req.Direction}); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	set, byID, err := s.simulationRuleset(r, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	verdict := firewall.Simulate(packet, set)
+
+	result := map[string]interface{}{
+		"allowed":    verdict.Accept,
+		"verdict":    firewall.PolicyDrop,
+		"matched_by": verdict.Match,
+		"rule":       nil,
+		"policy":     set.Options.Policy,
+	}
+	if verdict.Accept {
+		result["verdict"] = firewall.PolicyAccept
+	}
+	switch packet.Chain {
+	case firewall.ChainForward:
+		result["policy"] = set.Options.ForwardPolicy
+	case firewall.ChainOutput:
+		result["policy"] = firewall.PolicyAccept
+	}
+	if result["policy"] == "" {
+		result["policy"] = firewall.PolicyAccept
+	}
+	if verdict.Detail != "" {
+		result["detail"] = verdict.Detail
+	}
+	// Rules of other tenants still decide, but are not shown
+	if verdict.Rule != nil {
+		if rule := byID[verdict.Rule.ID]; identityFrom(r.Context()).canAccess(rule.TenantID) {
+			result["rule"] = firewallRuleResponse(rule)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+// simulationRuleset returns what the dynamic chains hold once reconciled,
+// and the stored rules by ID. Rules are in the order AddRule gives them:
+// deny rules, newest first, then allow rules, oldest first.
+func (s *Server) simulationRuleset(r *http.Request, now time.Time) (firewall.Ruleset, map[string]*store.FirewallRule, error) {
+	set := firewall.Ruleset{Options: s.fwManager.Options()}
+	rules, err := s.firewall(r).ListEnabled()
+	if err != nil {
+		return set, nil, fmt.Errorf("failed to list firewall rules: %v", err)
+	}
+	byID := make(map[string]*store.FirewallRule, len(rules))
+	var denies, allows []firewall.Rule
+	for _, rule := range rules {
+		if !rule.InActiveHours(now) {
+			continue
+		}
+		byID[rule.ID] = rule
+		fwRule := firewall.Rule{
+			ID:         rule.ID,
+			Port:       rule.Port,
+			Proto:      rule.Proto,
+			Chain:      rule.Chain,
+			Direction:  rule.Direction,
+			SourceCIDR: rule.SourceCIDR,
+			DestCIDR:   rule.DestCIDR,
+			Action:     rule.Action,
+		}
+		if rule.Action == "deny" {
+			denies = append([]firewall.Rule{fwRule}, denies...)
+		} else {
+			allows = append(allows, fwRule)
+		}
+	}
+	set.Rules = append(denies, allows...)
+
+	bans, err := s.firewall(r).ListBans(now)
+	if err != nil {
+		return set, nil, fmt.Errorf("failed to list bans: %v", err)
+	}
+	for _, ban := range bans {
+		set.Bans = append(set.Bans, ban.IP)
+	}
+	tunnels, err := s.tunnels(r).ListEnabled()
+	if err != nil {
+		return set, nil, fmt.Errorf("failed to list tunnels: %v", err)
+	}
+	for _, t := range tunnels {
+		if t.Isolate && t.NodeID == "" {
+			set.Isolated = append(set.Isolated, t.VpnIP)
+		}
+	}
+	// Route listen ports are opened by the reconciler; read them back
+	if services, err := s.fwManager.ListServices(); err == nil && len(services) > 0 {
+		set.Options.Services = services
+	}
+	return set, byID, nil
+}
+
+// handleListBans lists the source IPs currently banned by the automatic ban
+// subsystem. Bans apply to the whole host, so only admins can see them.
+func (s *Server) handleListBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.firewall(r).ListBans(time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list bans: %v", err))
+		return
+	}
+
+	result := make([]map[string]interface{}, 0, len(bans))
+	for _, b := range bans {
+		result = append(result, map[string]interface{}{
+			"ip":         b.IP,
+			"reason":     b.Reason,
+			"hits":       b.Hits,
+			"created_at": b.CreatedAt.UTC().Format(time.RFC3339),
+			"expires_at": b.ExpiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+// firewallRuleResponse is the JSON representation of a stored firewall rule.
+func firewallRuleResponse(rule *store.FirewallRule) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          rule.ID,
+		"name":        rule.Name,
+		"port":        rule.Port,
+		"proto":       rule.Proto,
+		"chain":       rule.Chain,
+		"direction":   rule.Direction,
+		"source_cidr": rule.SourceCIDR,
+		"dest_cidr":   rule.DestCIDR,
+		"action":      rule.Action,
+		"enabled":     rule.Enabled,
+		"tenant_id":   rule.TenantID,
+		"etag":        firewallRuleETag(rule),
+		"created_at":  rule.CreatedAt.UTC().Format(time.RFC3339),
+		"updated_at":  rule.UpdatedAt.UTC().Format(time.RFC3339),
+
+		"active_hours": rule.ActiveHours,
+		"active":       rule.Enabled && rule.InActiveHours(time.Now()),
+		"description":  rule.Description,
+		"group":        rule.Group,
+	}
+}
+
+// validateRuleNotes checks a firewall rule's description and group; ""
+// leaves either out. Groups follow the rules for names.
+func validateRuleNotes(description, group string) error {
+	if utf8.RuneCountInString(description) > maxDescriptionLen {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLen)
+	}
+	if group != "" && !resourceNameRegex.MatchString(group) {
+		return fmt.Errorf("group must be 1-63 letters, digits, '.', '_', or '-', starting with a letter or digit")
+	}
+	return nil
+}
+
+// sameFamily reports whether a rule's source CIDR and destination CIDR, if
+// it has one, are of the same address family. nftables matches both in the
+// same IPv4 or IPv6 header.
+func sameFamily(sourceCIDR, destCIDR string) bool {
+	source, err1 := netip.ParsePrefix(sourceCIDR)
+	dest, err2 := netip.ParsePrefix(destCIDR)
+	return err1 != nil || err2 != nil || source.Addr().Is4() == dest.Addr().Is4()
+}
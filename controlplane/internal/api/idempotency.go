@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// idempotencyTTL is how long a stored response is replayed for a key.
+	idempotencyTTL = 24 * time.Hour
+	// maxIdempotencyKeyLen bounds the Idempotency-Key header.
+	maxIdempotencyKeyLen = 255
+)
+
+// idempotent makes a POST handler safe to retry. When the request carries an
+// Idempotency-Key header, the first response for that key is stored and
+// replayed for later requests with the same key and body, so a client that
+// timed out can retry a create without producing a duplicate. Keys are scoped
+// to the caller; reusing one with a different body is rejected. Server errors
+// and panics are not stored, so the retry runs the handler again.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		caller := identityFrom(r.Context())
+		scope := caller.ClientCN + "|" + caller.TenantID
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(hash[:])
+
+		existing, err := s.idempotency.Reserve(scope, key, requestHash, time.Now(), idempotencyTTL)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to check Idempotency-Key")
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.RequestHash != requestHash:
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request")
+			case existing.Status == 0:
+				writeError(w, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+			default:
+				if existing.ContentType != "" {
+					w.Header().Set("Content-Type", existing.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if p := recover(); p != nil {
+				if err := s.idempotency.Release(scope, key); err != nil {
+					slog.Error("failed to release idempotency key", "key", key, "error", err)
+				}
+				panic(p)
+			}
+		}()
+		next(rec, r)
+
+		if rec.status >= 500 {
+			err = s.idempotency.Release(scope, key)
+		} else {
+			err = s.idempotency.Complete(scope, key, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		}
+		if err != nil {
+			slog.Error("failed to store idempotent response", "key", key, "error", err)
+		}
+	}
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/proxy-manager/controlplane/internal/reconciler"
+)
+
+// handleImport adopts the WireGuard peers and Caddy routes that the store
+// does not know as tunnels and routes marked imported, so a server set up
+// by hand keeps its state. ?dry_run=true only reports what would be
+// adopted.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if s.reconciler == nil {
+		writeError(w, http.StatusServiceUnavailable, "import needs the reconciler, which is not running")
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	res, err := s.reconciler.Import(r.Context(), dryRun)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to import: %v", err))
+		return
+	}
+
+	tunnels := make([]map[string]interface{}, 0, len(res.Tunnels))
+	for _, t := range res.Tunnels {
+		tunnels = append(tunnels, s.tunnelResponse(t))
+	}
+	routes := make([]map[string]interface{}, 0, len(res.Routes))
+	for _, route := range res.Routes {
+		routes = append(routes, routeResponse(route))
+	}
+	skipped := res.Skipped
+	if skipped == nil {
+		skipped = []reconciler.ImportSkip{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"dry_run": dryRun,
+			"tunnels": tunnels,
+			"routes":  routes,
+			"skipped": skipped,
+		},
+	})
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/proxy-manager/controlplane/internal/leader"
+)
+
+// LeaderHeader names the current leader on requests a standby refuses.
+const LeaderHeader = "X-Leader"
+
+// SetElector makes the server defer to leader election: while this
+// instance is a standby, requests that would change state are refused with
+// 503 so clients and load balancers move to the leader. It must be called
+// before the server starts serving.
+func (s *Server) SetElector(e *leader.Elector) {
+	s.elector = e
+}
+
+// standbyGuard refuses mutations while this instance is not the leader.
+// Reads are served from the shared database.
+func (s *Server) standbyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.elector == nil || s.elector.IsLeader() || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if id, err := s.elector.Leader(); err == nil && id != "" {
+			w.Header().Set(LeaderHeader, id)
+		}
+		writeError(w, http.StatusServiceUnavailable, "this instance is a standby; send changes to the leader")
+	})
+}
+
+// leaderStatus describes this instance's role for the status endpoint.
+func (s *Server) leaderStatus() map[string]interface{} {
+	current, err := s.elector.Leader()
+	status := map[string]interface{}{
+		"instance_id": s.elector.ID(),
+		"is_leader":   s.elector.IsLeader(),
+		"leader_id":   current,
+	}
+	if err != nil {
+		status["error"] = err.Error()
+	}
+	return status
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// maintenancePath toggles maintenance mode and is the one mutation allowed
+// while it is on.
+const maintenancePath = "/api/v1/maintenance"
+
+// maxMaintenanceMessage caps the message shown to refused clients.
+const maxMaintenanceMessage = 500
+
+// defaultMaintenanceMessage is returned when the operator gave no message.
+const defaultMaintenanceMessage = "the API is in read-only maintenance mode"
+
+// agentPathPrefix covers the endpoints node agents call, which keep working
+// in maintenance mode so nodes stay registered and report their peers.
+const agentPathPrefix = "/api/v1/agent/"
+
+// maintenanceTTL is how long the maintenance mode read from the database is
+// trusted, which bounds how long other instances sharing it take to see a
+// change.
+const maintenanceTTL = 5 * time.Second
+
+// maintenanceCache holds the maintenance mode, so mutations do not each read
+// it from the database.
+type maintenanceCache struct {
+	mu      sync.Mutex
+	mode    *store.Maintenance
+	fetched time.Time
+}
+
+// maintenance returns the maintenance mode, from the cache if it was read
+// less than maintenanceTTL ago.
+func (s *Server) maintenance(r *http.Request) (*store.Maintenance, error) {
+	c := &s.maintMode
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mode != nil && time.Since(c.fetched) < maintenanceTTL {
+		return c.mode, nil
+	}
+	m, err := s.firewall(r).GetMaintenance()
+	if err != nil {
+		return nil, err
+	}
+	c.mode, c.fetched = m, time.Now()
+	return m, nil
+}
+
+// forgetMaintenance makes the next maintenance call read the database.
+func (s *Server) forgetMaintenance() {
+	s.maintMode.mu.Lock()
+	defer s.maintMode.mu.Unlock()
+	s.maintMode.mode = nil
+}
+
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+// maintenanceGuard refuses mutations with 503 while maintenance mode is on.
+// Firewall simulations are POSTs but change nothing, so they are let through,
+// and so are node agents. The mode is read from the database at most every
+// maintenanceTTL, so toggling it on one instance applies to all that share it
+// within seconds.
+func (s *Server) maintenanceGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.URL.Path == maintenancePath ||
+			r.URL.Path == simulatePath || strings.HasPrefix(r.URL.Path, agentPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m, err := s.maintenance(r)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to check maintenance mode: %v", err))
+			return
+		}
+		if !m.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		msg := m.Message
+		if msg == "" {
+			msg = defaultMaintenanceMessage
+		}
+		writeError(w, http.StatusServiceUnavailable, msg)
+	})
+}
+
+// handleGetMaintenance returns the maintenance mode.
+func (s *Server) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	m, err := s.firewall(r).GetMaintenance()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get maintenance mode: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": maintenanceResponse(m)})
+}
+
+// handleSetMaintenance turns maintenance mode on or off.
+func (s *Server) handleSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Message) > maxMaintenanceMessage {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("message must be at most %d bytes", maxMaintenanceMessage))
+		return
+	}
+	if !req.Enabled {
+		req.Message = ""
+	}
+
+	cn := identityFrom(r.Context()).ClientCN
+	defer s.forgetMaintenance()
+	if err := s.firewall(r).SetMaintenance(req.Enabled, req.Message, cn); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to set maintenance mode: %v", err))
+		return
+	}
+	if req.Enabled {
+		slog.Warn("maintenance mode enabled, mutations are refused", "by", cn, "message", req.Message)
+	} else {
+		slog.Info("maintenance mode disabled", "by", cn)
+	}
+
+	m, err := s.firewall(r).GetMaintenance()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get maintenance mode: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": maintenanceResponse(m)})
+}
+
+func maintenanceResponse(m *store.Maintenance) map[string]interface{} {
+	var message, updatedBy interface{}
+	if m.Message != "" {
+		message = m.Message
+	}
+	if m.UpdatedBy != "" {
+		updatedBy = m.UpdatedBy
+	}
+	return map[string]interface{}{
+		"enabled":    m.Enabled,
+		"message":    message,
+		"updated_by": updatedBy,
+		"updated_at": formatTimePtr(m.UpdatedAt),
+	}
+}
@@ -1,22 +1,32 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/proxy-manager/controlplane/internal/audit"
 	"github.com/proxy-manager/controlplane/internal/store"
 )
 
 // AuditLogger provides audit logging for mutations.
 type AuditLogger struct {
 	fwStore *store.FirewallStore
+
+	// Set by RecordBodies; bodyLimit 0 records only the body hash
+	bodyLimit int
+	snapshot  func(kind, id string) map[string]interface{}
+
+	sink audit.Sink // optional copy of every entry outside SQLite
 }
 
 // NewAuditLogger creates a new AuditLogger.
@@ -24,6 +34,19 @@ func NewAuditLogger(fwStore *store.FirewallStore) *AuditLogger {
 	return &AuditLogger{fwStore: fwStore}
 }
 
+// SetSink copies every entry to sink in addition to SQLite.
+func (al *AuditLogger) SetSink(sink audit.Sink) {
+	al.sink = sink
+}
+
+// RecordBodies makes the logger store the redacted request body, up to limit
+// bytes, and the diff of the affected resource's state as read by snapshot
+// before and after the request.
+func (al *AuditLogger) RecordBodies(limit int, snapshot func(kind, id string) map[string]interface{}) {
+	al.bodyLimit = limit
+	al.snapshot = snapshot
+}
+
 // LoggingMiddleware logs every request with method, path, status, and duration.
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -42,6 +65,27 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// BodyLimitMiddleware caps request bodies at limit bytes. Bodies that
+// declare a larger Content-Length are rejected with 413 before they are
+// read; reading past the limit of any other body fails, which decodeJSON
+// reports as 413. A limit of 0 disables the cap.
+func BodyLimitMiddleware(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if limit <= 0 || r.Body == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > limit {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // AuditMiddleware logs mutations (POST, PUT, PATCH, DELETE) to the audit_log table.
 func AuditMiddleware(al *AuditLogger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -55,8 +99,10 @@ func AuditMiddleware(al *AuditLogger) func(http.Handler) http.Handler {
 
 			// Read and hash the body
 			var bodyHash string
+			var bodyBytes []byte
 			if r.Body != nil {
-				bodyBytes, err := io.ReadAll(r.Body)
+				var err error
+				bodyBytes, err = io.ReadAll(r.Body)
 				if err == nil && len(bodyBytes) > 0 {
 					hash := sha256.Sum256(bodyBytes)
 					bodyHash = fmt.Sprintf("%x", hash[:8])
@@ -73,99 +119,337 @@ func AuditMiddleware(al *AuditLogger) func(http.Handler) http.Handler {
 			// Extract source IP
 			sourceIP, _, _ := net.SplitHostPort(r.RemoteAddr)
 
+			// Snapshot the affected resource; a create's ID is only known
+			// from its response
+			var kind, id string
+			var before map[string]interface{}
+			if al.bodyLimit > 0 {
+				kind, id = auditResource(r.URL.Path)
+				if kind != "" && id != "" {
+					before = al.snapshot(kind, id)
+				}
+			}
+
 			sw := &statusWriter{ResponseWriter: w, status: 200}
-			next.ServeHTTP(sw, r)
+			var rw http.ResponseWriter = sw
+			var cw *captureWriter
+			if kind != "" && id == "" {
+				cw = &captureWriter{statusWriter: sw}
+				rw = cw
+			}
+			next.ServeHTTP(rw, r)
 
 			// Write audit log entry
-			result := "ok"
-			errMsg := ""
+			entry := &store.AuditEntry{
+				ClientCN: clientCN,
+				SourceIP: sourceIP,
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				BodyHash: bodyHash,
+				Result:   "ok",
+			}
 			if sw.status >= 400 {
-				result = "error"
-				errMsg = fmt.Sprintf("HTTP %d", sw.status)
+				entry.Result = "error"
+				entry.ErrorMsg = fmt.Sprintf("HTTP %d", sw.status)
+			}
+			if al.bodyLimit > 0 {
+				entry.RequestBody = redactBody(bodyBytes, al.bodyLimit)
+				if cw != nil {
+					id = createdID(cw.body.Bytes())
+				}
+				if kind != "" && id != "" {
+					entry.Diff = auditDiff(before, al.snapshot(kind, id))
+				}
 			}
 
-			if err := al.fwStore.WriteAuditLog(clientCN, sourceIP, r.Method, r.URL.Path, bodyHash, result, errMsg); err != nil {
+			if err := al.fwStore.WriteAuditEntry(entry); err != nil {
 				slog.Error("failed to write audit log", "error", err)
 			}
+			if al.sink != nil {
+				if err := al.sink.Write(auditEvent(entry)); err != nil {
+					slog.Error("failed to write audit sink", "error", err)
+				}
+			}
 		})
 	}
 }
 
-// RateLimiter provides a simple per-IP rate limiter.
+// captureWriter keeps a copy of the response body, up to maxCapturedBody
+// bytes, so the audit log can read the ID of a created resource.
+type captureWriter struct {
+	*statusWriter
+	body bytes.Buffer
+}
+
+const maxCapturedBody = 64 << 10
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if room := maxCapturedBody - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(len(b), room)])
+	}
+	return w.statusWriter.Write(b)
+}
+
+// RateLimiter is a token bucket rate limiter. Each client may burst up to
+// rate requests and regains rate tokens per window. Clients are told apart by
+// key, which defaults to the remote IP.
 type RateLimiter struct {
-	mu       sync.Mutex
-	visitors map[string]*visitor
-	rate     int           // requests per window
-	window   time.Duration
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	rate    int // requests per window
+	window  time.Duration
+	key     func(r *http.Request) string
+
+	// Set by Persist
+	rateLimits *store.RateLimitStore
+	scope      string
+	dirty      map[string]bool // keys changed since the last save; false if forgotten
+
+	done chan struct{} // closed once the limiter has stopped
 }
 
-type visitor struct {
-	count    int
-	resetAt  time.Time
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
 }
 
-// NewRateLimiter creates a rate limiter that allows `rate` requests per `window` per IP.
-func NewRateLimiter(rate int, window time.Duration) *RateLimiter {
+// NewRateLimiter creates a rate limiter that allows `rate` requests per
+// `window` per IP. Its cleanup goroutine runs until ctx is canceled.
+func NewRateLimiter(ctx context.Context, rate int, window time.Duration) *RateLimiter {
 	rl := &RateLimiter{
-		visitors: make(map[string]*visitor),
-		rate:     rate,
-		window:   window,
-	}
-	// Cleanup goroutine
-	go func() {
-		ticker := time.NewTicker(window)
-		defer ticker.Stop()
-		for range ticker.C {
-			rl.cleanup()
-		}
-	}()
+		buckets: make(map[string]*bucket),
+		rate:    rate,
+		window:  window,
+		key:     remoteIP,
+		done:    make(chan struct{}),
+	}
+	go rl.run(ctx)
 	return rl
 }
 
-func (rl *RateLimiter) cleanup() {
+// SetKeyFunc makes the limiter count requests per key(r) instead of per IP.
+func (rl *RateLimiter) SetKeyFunc(key func(r *http.Request) string) {
+	rl.key = key
+}
+
+// Persist loads the buckets saved under scope and saves the changed ones
+// back every window and when the limiter stops, so limits survive restarts.
+func (rl *RateLimiter) Persist(rateLimits *store.RateLimitStore, scope string) error {
+	saved, err := rateLimits.List(scope)
+	if err != nil {
+		return err
+	}
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
-	now := time.Now()
-	for ip, v := range rl.visitors {
-		if now.After(v.resetAt) {
-			delete(rl.visitors, ip)
+	for _, b := range saved {
+		rl.buckets[b.Key] = &bucket{tokens: b.Tokens, updatedAt: b.UpdatedAt}
+	}
+	rl.rateLimits, rl.scope, rl.dirty = rateLimits, scope, make(map[string]bool)
+	return nil
+}
+
+// Done is closed once ctx is canceled and the limiter has saved its buckets.
+func (rl *RateLimiter) Done() <-chan struct{} {
+	return rl.done
+}
+
+func (rl *RateLimiter) run(ctx context.Context) {
+	defer close(rl.done)
+	ticker := time.NewTicker(rl.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			rl.save()
+			return
+		case <-ticker.C:
+			rl.cleanup(time.Now())
+			rl.save()
 		}
 	}
 }
 
-// RateLimitMiddleware applies rate limiting per client IP.
-func (rl *RateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-		if ip == "" {
-			ip = r.RemoteAddr
+// refill returns b's tokens at now, capped at a full bucket.
+func (rl *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	perSecond := float64(rl.rate) / rl.window.Seconds()
+	return min(float64(rl.rate), b.tokens+now.Sub(b.updatedAt).Seconds()*perSecond)
+}
+
+// take spends one of key's tokens. If none is left it returns false and how
+// long until one is.
+func (rl *RateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rl.rate)}
+		rl.buckets[key] = b
+	} else {
+		b.tokens = rl.refill(b, now)
+	}
+	b.updatedAt = now
+	if rl.dirty != nil {
+		rl.dirty[key] = true
+	}
+	if b.tokens < 1 {
+		perSecond := float64(rl.rate) / rl.window.Seconds()
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup forgets clients whose buckets have filled up again, which is the
+// state a new client starts in.
+func (rl *RateLimiter) cleanup(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, b := range rl.buckets {
+		if rl.refill(b, now) >= float64(rl.rate) {
+			delete(rl.buckets, key)
+			if rl.dirty != nil {
+				rl.dirty[key] = false
+			}
 		}
+	}
+}
 
+// save writes the buckets changed or forgotten since the last save to the
+// store, if the limiter is persisted. Keys that fail to save are kept for
+// the next attempt.
+func (rl *RateLimiter) save() {
+	rl.mu.Lock()
+	if rl.rateLimits == nil || len(rl.dirty) == 0 {
+		rl.mu.Unlock()
+		return
+	}
+	dirty := rl.dirty
+	rl.dirty = make(map[string]bool)
+	var (
+		changed []store.RateBucket
+		removed []string
+	)
+	for key, kept := range dirty {
+		if b, ok := rl.buckets[key]; kept && ok {
+			changed = append(changed, store.RateBucket{Key: key, Tokens: b.tokens, UpdatedAt: b.updatedAt})
+		} else {
+			removed = append(removed, key)
+		}
+	}
+	rl.mu.Unlock()
+
+	if err := rl.rateLimits.Save(rl.scope, changed, removed); err != nil {
+		slog.Error("failed to save rate limits", "scope", rl.scope, "error", err)
 		rl.mu.Lock()
-		v, exists := rl.visitors[ip]
-		now := time.Now()
-		if !exists || now.After(v.resetAt) {
-			rl.visitors[ip] = &visitor{count: 1, resetAt: now.Add(rl.window)}
-			rl.mu.Unlock()
-			next.ServeHTTP(w, r)
-			return
+		for key, kept := range dirty {
+			if _, ok := rl.dirty[key]; !ok {
+				rl.dirty[key] = kept
+			}
 		}
+		rl.mu.Unlock()
+	}
+}
 
-		v.count++
-		if v.count > rl.rate {
-			rl.mu.Unlock()
-			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(v.resetAt.Sub(now).Seconds())+1))
+// RateLimitMiddleware applies rate limiting per client.
+func (rl *RateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := rl.take(rl.key(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
 			writeJSON(w, http.StatusTooManyRequests, map[string]string{
 				"error": "rate limit exceeded",
 			})
 			return
 		}
-		rl.mu.Unlock()
-
 		next.ServeHTTP(w, r)
 	})
 }
 
+// ReadWriteRateLimit sends GET and HEAD requests through read and every other
+// method through mutate, so reads and changes have separate budgets.
+func ReadWriteRateLimit(read, mutate *RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		readHandler := read.RateLimitMiddleware(next)
+		mutateHandler := mutate.RateLimitMiddleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				readHandler.ServeHTTP(w, r)
+				return
+			}
+			mutateHandler.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKey identifies the caller a request is counted against: its API
+// token, else its client certificate CN, else its IP. Unknown tokens count
+// against the IP so that made-up tokens cannot dodge the limit. Token
+// lookups are cached, so requests over the limit cost no database query.
+func (s *Server) rateLimitKey(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		hash := hashToken(token)
+		now := time.Now()
+		valid, ok := s.tokens.get(hash, now)
+		if !ok {
+			_, err := s.tenantStore.GetByTokenHash(hash)
+			valid = err == nil
+			s.tokens.put(hash, valid, now)
+		}
+		if valid {
+			return "token:" + hash
+		}
+	} else if cn := clientCN(r); cn != "" {
+		return "cn:" + cn
+	}
+	return "ip:" + clientIP(r, s.cfg.TrustedProxies)
+}
+
+// remoteIP returns the IP of the connection's peer.
+func remoteIP(r *http.Request) string {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if ip == "" {
+		ip = r.RemoteAddr
+	}
+	return ip
+}
+
+// clientIP returns the IP of the client behind any trusted proxies. When the
+// peer is trusted, X-Forwarded-For is walked from the right, skipping the
+// trusted hops, and the first other address is the client. Headers from
+// untrusted peers are ignored, since anyone can send them.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(ip, trusted) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap().String()
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrustedProxy reports whether ip is inside one of the trusted prefixes.
+func isTrustedProxy(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // statusWriter wraps ResponseWriter to capture the status code.
 type statusWriter struct {
 	http.ResponseWriter
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+	"gopkg.in/yaml.v3"
+)
+
+// Thresholds of the suggested alert rules.
+const (
+	tunnelDownFor         = 10 * time.Minute // disconnected this long before alerting
+	reconcileFailingAfter = 3                // consecutive failed passes of a subsystem
+	reconcileFailingFor   = 5 * time.Minute
+	addressPoolFullRatio  = 0.9 // share of VPN addresses allocated
+	addressPoolFullFor    = 15 * time.Minute
+)
+
+// metric is one Prometheus gauge, or counter, with its samples.
+type metric struct {
+	name    string
+	help    string
+	counter bool
+	samples []sample
+}
+
+type sample struct {
+	labels [][2]string // name, value pairs in order
+	value  float64
+}
+
+// labelEscaper escapes label values for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetrics(w http.ResponseWriter, metrics []metric) {
+	var b strings.Builder
+	for _, m := range metrics {
+		typ := "gauge"
+		if m.counter {
+			typ = "counter"
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, typ)
+		for _, s := range m.samples {
+			b.WriteString(m.name)
+			if len(s.labels) > 0 {
+				pairs := make([]string, len(s.labels))
+				for i, l := range s.labels {
+					pairs[i] = fmt.Sprintf(`%s="%s"`, l[0], labelEscaper.Replace(l[1]))
+				}
+				b.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			fmt.Fprintf(&b, " %g\n", s.value)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
+
+// monitoredTunnels returns the enabled tunnels the caller can see, which
+// are the ones expected to be up.
+func (s *Server) monitoredTunnels(r *http.Request) ([]*store.Tunnel, error) {
+	tunnels, err := s.tunnels(r).ListEnabled()
+	if err != nil {
+		return nil, err
+	}
+	return filterOwned(tunnels, identityFrom(r.Context()), func(t *store.Tunnel) string { return t.TenantID }), nil
+}
+
+// handleGetMetrics serves the gauges the rules of GET
+// /api/v1/monitoring/rules alert on, the latency and loss of probed tunnels,
+// and the hits of firewall rules, in the Prometheus text format. Callers
+// scoped to a tenant only get their tunnels and rules.
+func (s *Server) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
+	tunnels, err := s.monitoredTunnels(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list tunnels: %v", err))
+		return
+	}
+
+	connected := metric{name: "proxy_manager_tunnel_connected", help: "Whether the tunnel's peer has handshaken within its connected threshold."}
+	now := time.Now()
+	for _, t := range tunnels {
+		value := 0.0
+		if t.Connected(now, s.cfg.ConnectedWindow) {
+			value = 1
+		}
+		connected.samples = append(connected.samples, sample{
+			labels: [][2]string{{"tunnel_id", t.ID}, {"tunnel_name", t.Name}, {"vpn_ip", t.VpnIP}},
+			value:  value,
+		})
+	}
+	metrics := []metric{connected}
+
+	probes, err := s.tunnels(r).ProbeSummaries()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load latency probes: %v", err))
+		return
+	}
+	rtt := metric{name: "proxy_manager_tunnel_rtt_seconds", help: "Average round-trip time of the latest latency probes that got a reply."}
+	loss := metric{name: "proxy_manager_tunnel_probe_loss_ratio", help: "Share of the latest latency probes that got no reply."}
+	for _, t := range tunnels {
+		p, ok := probes[t.ID]
+		if !ok {
+			continue
+		}
+		labels := [][2]string{{"tunnel_id", t.ID}, {"tunnel_name", t.Name}, {"vpn_ip", t.VpnIP}}
+		if p.Lost < p.Samples {
+			rtt.samples = append(rtt.samples, sample{labels: labels, value: p.AvgRTT.Seconds()})
+		}
+		loss.samples = append(loss.samples, sample{labels: labels, value: p.Loss()})
+	}
+	if len(loss.samples) > 0 {
+		metrics = append(metrics, rtt, loss)
+	}
+
+	rules, err := s.firewall(r).List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list firewall rules: %v", err))
+		return
+	}
+	packets := metric{name: "proxy_manager_firewall_rule_packets_total", help: "Packets the firewall rule matched since it was added or last changed.", counter: true}
+	bytes := metric{name: "proxy_manager_firewall_rule_bytes_total", help: "Bytes the firewall rule matched since it was added or last changed.", counter: true}
+	hits := s.ruleHits()
+	for _, rule := range rules {
+		h, ok := hits[rule.ID]
+		if !ok || !identityFrom(r.Context()).canAccess(rule.TenantID) {
+			continue
+		}
+		labels := [][2]string{{"rule_id", rule.ID}, {"rule_name", rule.Name}, {"action", rule.Action}}
+		packets.samples = append(packets.samples, sample{labels: labels, value: float64(h.Packets)})
+		bytes.samples = append(bytes.samples, sample{labels: labels, value: float64(h.Bytes)})
+	}
+	if len(packets.samples) > 0 {
+		metrics = append(metrics, packets, bytes)
+	}
+
+	if identityFrom(r.Context()).TenantID == "" {
+		used, total, err := s.tunnels(r).AddressPoolUsage(s.cfg.WGServerIP, s.cfg.AddressPools())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to count VPN addresses: %v", err))
+			return
+		}
+		metrics = append(metrics,
+			metric{name: "proxy_manager_vpn_addresses_used", help: "VPN addresses allocated to tunnels.", samples: []sample{{value: float64(used)}}},
+			metric{name: "proxy_manager_vpn_addresses_total", help: "VPN addresses in the address pools.", samples: []sample{{value: float64(total)}}},
+		)
+		if s.reconciler != nil {
+			failures := metric{name: "proxy_manager_reconcile_consecutive_failures", help: "Reconciliation passes in a row that failed for the subsystem."}
+			unmanaged := metric{name: "proxy_manager_reconcile_unmanaged_resources", help: "Resources not created by the control plane that the last pass reported and left in place."}
+			drift := metric{name: "proxy_manager_reconcile_drift", help: "Corrections the last pass found necessary but did not make in observe mode."}
+			states := s.reconciler.Subsystems()
+			found := s.reconciler.Unmanaged()
+			observed := s.reconciler.Drift()
+			for _, system := range slices.Sorted(maps.Keys(states)) {
+				failures.samples = append(failures.samples, sample{
+					labels: [][2]string{{"subsystem", system}},
+					value:  float64(states[system].ConsecutiveFailures),
+				})
+				unmanaged.samples = append(unmanaged.samples, sample{
+					labels: [][2]string{{"subsystem", system}},
+					value:  float64(len(found[system])),
+				})
+				drift.samples = append(drift.samples, sample{
+					labels: [][2]string{{"subsystem", system}},
+					value:  float64(len(observed[system])),
+				})
+			}
+			metrics = append(metrics, failures, unmanaged, drift)
+		}
+		if s.keeper != nil {
+			metrics = append(metrics, s.databaseMetrics()...)
+		}
+	}
+
+	writeMetrics(w, metrics)
+}
+
+// alertRule is a Prometheus alerting rule.
+type alertRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type ruleGroup struct {
+	Name  string      `yaml:"name"`
+	Rules []alertRule `yaml:"rules"`
+}
+
+// handleGetMonitoringRules renders a Prometheus rules file for the current
+// tunnels, on top of the metrics of GET /api/v1/monitoring/metrics: one
+// TunnelDown alert per enabled tunnel, and for unscoped callers alerts on
+// failing reconciliation and a nearly exhausted VPN address pool. Reload it
+// into Prometheus whenever tunnels change so alerts follow them.
+func (s *Server) handleGetMonitoringRules(w http.ResponseWriter, r *http.Request) {
+	tunnels, err := s.monitoredTunnels(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list tunnels: %v", err))
+		return
+	}
+	slices.SortFunc(tunnels, func(a, b *store.Tunnel) int { return strings.Compare(a.ID, b.ID) })
+
+	tunnelRules := make([]alertRule, 0, len(tunnels))
+	for _, t := range tunnels {
+		display := t.ID
+		if t.Name != "" {
+			display = t.Name
+		}
+		tunnelRules = append(tunnelRules, alertRule{
+			Alert:  "TunnelDown",
+			Expr:   fmt.Sprintf("proxy_manager_tunnel_connected{tunnel_id=%q} == 0", t.ID),
+			For:    promDuration(tunnelDownFor),
+			Labels: map[string]string{"severity": "warning", "tunnel_id": t.ID},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Tunnel %s (%s) is down", display, t.VpnIP),
+				"description": fmt.Sprintf("The peer of tunnel %s has not completed a WireGuard handshake within its connected threshold for %s.", display, promDuration(tunnelDownFor)),
+			},
+		})
+	}
+	groups := []ruleGroup{{Name: "proxy-manager-tunnels", Rules: tunnelRules}}
+
+	if identityFrom(r.Context()).TenantID == "" {
+		groups = append(groups, ruleGroup{Name: "proxy-manager", Rules: []alertRule{
+			{
+				Alert:  "ProxyManagerReconcileFailing",
+				Expr:   fmt.Sprintf("proxy_manager_reconcile_consecutive_failures >= %d", reconcileFailingAfter),
+				For:    promDuration(reconcileFailingFor),
+				Labels: map[string]string{"severity": "critical"},
+				Annotations: map[string]string{
+					"summary":     "Reconciliation of {{ $labels.subsystem }} is failing",
+					"description": "The last {{ $value }} reconciliation passes of {{ $labels.subsystem }} failed; its live state may not match the database. See GET /api/v1/status.",
+				},
+			},
+			{
+				Alert:  "ProxyManagerAddressPoolNearlyFull",
+				Expr:   fmt.Sprintf("proxy_manager_vpn_addresses_used / proxy_manager_vpn_addresses_total > %g", addressPoolFullRatio),
+				For:    promDuration(addressPoolFullFor),
+				Labels: map[string]string{"severity": "warning"},
+				Annotations: map[string]string{
+					"summary":     "VPN address pool is nearly full",
+					"description": fmt.Sprintf("More than %g%% of the VPN addresses are allocated; new tunnels fail once none are left. Widen WG_ADDRESS_POOLS or purge deleted tunnels.", addressPoolFullRatio*100),
+				},
+			},
+		}})
+	}
+
+	out, err := yaml.Marshal(map[string]interface{}{"groups": groups})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to render rules: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Content-Disposition", "attachment; filename=proxy-manager-rules.yml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// promDuration formats d as a Prometheus duration, e.g. "10m".
+func promDuration(d time.Duration) string {
+	if d%time.Minute == 0 {
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	}
+	return fmt.Sprintf("%ds", int(d/time.Second))
+}
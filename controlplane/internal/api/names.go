@@ -0,0 +1,356 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// resourceNameRegex validates the caller-supplied names of tunnels, routes,
+// and firewall rules.
+var resourceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._\-]{0,62}$`)
+
+var errInvalidName = errors.New("name must be 1-63 letters, digits, '.', '_', or '-', starting with a letter or digit")
+
+// checkName validates a caller-supplied name and checks that no other
+// resource of the kind ("tunnel", "route", or "firewall rule") holds it in
+// the tenant. An empty name leaves the resource unnamed and always passes.
+func (s *Server) checkName(kind, tenantID, name string) (int, error) {
+	if name == "" {
+		return 0, nil
+	}
+	if !resourceNameRegex.MatchString(name) {
+		return http.StatusBadRequest, errInvalidName
+	}
+
+	var holder string
+	switch kind {
+	case "tunnel":
+		if t, err := s.tunnelStore.GetByName(tenantID, name); err == nil {
+			if t.DeletedAt != nil {
+				return http.StatusConflict, fmt.Errorf("name %q is held by deleted tunnel %s until it is purged; restore it instead", name, t.ID)
+			}
+			holder = t.ID
+		}
+	case "route":
+		if route, err := s.routeStore.GetByName(tenantID, name); err == nil {
+			holder = route.ID
+		}
+	case "firewall rule":
+		if rule, err := s.fwStore.GetByName(tenantID, name); err == nil {
+			holder = rule.ID
+		}
+	}
+	if holder != "" {
+		return http.StatusConflict, fmt.Errorf("name %q is already used by %s %s", name, kind, holder)
+	}
+	return 0, nil
+}
+
+// nameFromPath reads the {name} of a by-name endpoint and checks it against
+// the name in the body, which may be left out.
+func nameFromPath(r *http.Request, bodyName string) (string, error) {
+	name := r.PathValue("name")
+	if bodyName != "" && bodyName != name {
+		return "", fmt.Errorf("name in the body does not match the path")
+	}
+	if !resourceNameRegex.MatchString(name) {
+		return "", errInvalidName
+	}
+	return name, nil
+}
+
+// relay writes the response of a sub-request as this request's response.
+func relay(w http.ResponseWriter, status int, body []byte) {
+	writeJSON(w, status, json.RawMessage(body))
+}
+
+// tunnelCredentialFields are the fields of a tunnel create response that
+// are only shown once: the client config with its private key (Flow A),
+// or the PSK and server details for the client's own config (Flow B).
+var tunnelCredentialFields = []string{
+	"config", "qr_code_url", "warning",
+	"preshared_key", "server_public_key", "server_endpoint",
+}
+
+// tunnelCredentials picks the tunnel credential fields out of a create
+// response.
+func tunnelCredentials(body []byte) map[string]interface{} {
+	var resp map[string]interface{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+	creds := map[string]interface{}{}
+	for _, field := range tunnelCredentialFields {
+		if v, ok := resp[field]; ok {
+			creds[field] = v
+		}
+	}
+	return creds
+}
+
+// handlePutTunnelByName creates the caller's tunnel with the given name, or
+// brings the existing one in line with the body, so clients can manage
+// tunnels by a name of their choosing instead of the generated ID. The body
+// is that of POST /api/v1/tunnels. Labels, source CIDR, isolation, client
+// routing, advertised routes, notes, and the expiry date are updated; the
+// other fields only apply when the tunnel is created, and a body that differs
+// in them is a conflict. Either way the response holds the tunnel as returned
+// by GET; a created one adds its credentials, which are not shown again.
+func (s *Server) handlePutTunnelByName(w http.ResponseWriter, r *http.Request) {
+	var req createTunnelRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	name, err := nameFromPath(r, req.Name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tenantID, status, err := s.tenantForCreate(r, req.TenantID)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	current, err := s.tunnels(r).GetByName(tenantID, name)
+	if err != nil {
+		req.Name = name
+		status, body := s.subRequest(r, http.MethodPost, "/api/v1/tunnels", req)
+		if status >= 300 {
+			relay(w, status, body)
+			return
+		}
+		if current, err = s.tunnels(r).Get(createdID(body)); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get created tunnel: %v", err))
+			return
+		}
+		w.Header().Set("ETag", tunnelETag(current))
+		writeJSON(w, status, map[string]interface{}{
+			"data":        s.tunnelResponse(current),
+			"credentials": tunnelCredentials(body),
+		})
+		return
+	}
+	if current.DeletedAt != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("name %q is held by deleted tunnel %s until it is purged; restore it instead", name, current.ID))
+		return
+	}
+
+	desired := stateTunnel{
+		PublicKey:            req.PublicKey,
+		Enabled:              &current.Enabled, // toggled with PATCH, not here
+		Labels:               req.Labels,
+		SourceCIDR:           req.SourceCIDR,
+		Isolate:              req.Isolate,
+		PersistentKeepalive:  req.PersistentKeepalive,
+		ConnectedThreshold:   req.ConnectedThreshold,
+		ClientRouting:        req.ClientRouting,
+		AdvertisedRoutes:     req.AdvertisedRoutes,
+		Description:          req.Description,
+		OwnerEmail:           req.OwnerEmail,
+		DeviceName:           req.DeviceName,
+		ExpiresAt:            req.ExpiresAt,
+		TenantID:             req.TenantID,
+		NodeID:               req.NodeID,
+		VpnIP:                req.VpnIP,
+		AllowedUpstreamPorts: req.AllowedUpstreamPorts,
+	}
+	field := fixedTunnelFieldChanged(current, desired)
+	switch {
+	case field != "":
+	case req.PublicKey != "" && req.PublicKey != current.PublicKey:
+		field = "public_key"
+	case req.Domains != nil && !slices.Equal(slices.Sorted(slices.Values(req.Domains)), slices.Sorted(slices.Values(current.Domains))):
+		field = "domains"
+	case !slices.Equal(req.FailoverNodeIDs, current.FailoverNodeIDs):
+		field = "failover_node_ids"
+	case req.DNS != nil && !slices.Equal(req.DNS, clientDNS(current)):
+		field = "dns"
+	case req.MTU != 0 && req.MTU != current.ClientMTU:
+		field = "mtu"
+	}
+	if field != "" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("%s of tunnel %q can only be set when it is created; delete the tunnel to change it", field, name))
+		return
+	}
+
+	if update, changed := tunnelUpdate(current, desired); changed {
+		if status, body := s.subRequest(r, http.MethodPatch, "/api/v1/tunnels/"+current.ID, update); status >= 300 {
+			relay(w, status, body)
+			return
+		}
+		if current, err = s.tunnels(r).Get(current.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get tunnel: %v", err))
+			return
+		}
+	}
+	w.Header().Set("ETag", tunnelETag(current))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": s.tunnelResponse(current)})
+}
+
+// handlePutRouteByName creates the route with the given name, or checks the
+// existing one against the body of POST /api/v1/routes. Only the priority
+// of a route can change; a body that differs in anything else is a conflict.
+// Either way the response holds the route as returned by GET.
+func (s *Server) handlePutRouteByName(w http.ResponseWriter, r *http.Request) {
+	var req createRouteRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	name, err := nameFromPath(r, req.Name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tunnel, err := s.tunnels(r).Get(req.TunnelID)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusBadRequest, "tunnel not found")
+		return
+	}
+
+	current, err := s.routes(r).GetByName(tunnel.TenantID, name)
+	if err != nil {
+		req.Name = name
+		status, body := s.subRequest(r, http.MethodPost, "/api/v1/routes", req)
+		if status >= 300 {
+			relay(w, status, body)
+			return
+		}
+		if current, err = s.routes(r).Get(createdID(body)); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get created route: %v", err))
+			return
+		}
+		w.Header().Set("ETag", routeETag(current))
+		writeJSON(w, status, map[string]interface{}{"data": routeResponse(current)})
+		return
+	}
+
+	desired := desiredRouteKey(tunnel, stateRoute{
+		MatchType:     req.MatchType,
+		MatchValue:    req.MatchValue,
+		UpstreamPort:  req.UpstreamPort,
+		UpstreamIP:    req.UpstreamIP,
+		Protocol:      req.Protocol,
+		ListenPort:    req.ListenPort,
+		ListenPortEnd: req.ListenPortEnd,
+		ProxyProtocol: req.ProxyProtocol,
+		QUIC:          req.QUIC,
+		TerminateTLS:  req.TerminateTLS,
+	})
+	if existingRouteKey(current) != desired {
+		writeError(w, http.StatusConflict, fmt.Sprintf("route %q was created with different settings and only its priority can change; delete the route to change the rest", name))
+		return
+	}
+
+	if current.Priority != req.Priority {
+		update := updateRouteRequest{Priority: &req.Priority}
+		if status, body := s.subRequest(r, http.MethodPatch, "/api/v1/routes/"+current.ID, update); status >= 300 {
+			relay(w, status, body)
+			return
+		}
+		if current, err = s.routes(r).Get(current.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get route: %v", err))
+			return
+		}
+	}
+	w.Header().Set("ETag", routeETag(current))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": routeResponse(current)})
+}
+
+// handlePutFirewallRuleByName creates the firewall rule with the given name,
+// or brings the existing one in line with the body of POST
+// /api/v1/firewall/rules. The source CIDR and action are updated; a body
+// with another port, protocol, chain, or direction is a conflict. Either way
+// the response holds the rule as returned by GET.
+func (s *Server) handlePutFirewallRuleByName(w http.ResponseWriter, r *http.Request) {
+	var req createFirewallRuleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	name, err := nameFromPath(r, req.Name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tenantID, status, err := s.tenantForCreate(r, req.TenantID)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	current, err := s.firewall(r).GetByName(tenantID, name)
+	if err != nil {
+		req.Name = name
+		status, body := s.subRequest(r, http.MethodPost, "/api/v1/firewall/rules", req)
+		if status >= 300 {
+			relay(w, status, body)
+			return
+		}
+		if current, err = s.firewall(r).Get(createdID(body)); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get created firewall rule: %v", err))
+			return
+		}
+		w.Header().Set("ETag", firewallRuleETag(current))
+		writeJSON(w, status, map[string]interface{}{"data": firewallRuleResponse(current)})
+		return
+	}
+
+	desired := withRuleDefaults(stateFirewallRule{
+		Port:       req.Port,
+		Proto:      req.Proto,
+		Chain:      req.Chain,
+		Direction:  req.Direction,
+		SourceCIDR: req.SourceCIDR,
+		DestCIDR:   req.DestCIDR,
+		Action:     req.Action,
+
+		ActiveHours: req.ActiveHours,
+		Description: req.Description,
+		Group:       req.Group,
+	})
+	if desired.Port != current.Port || desired.Proto != current.Proto ||
+		desired.Chain != current.Chain || desired.Direction != current.Direction || desired.DestCIDR != current.DestCIDR {
+		writeError(w, http.StatusConflict, fmt.Sprintf("firewall rule %q was created for another port, protocol, chain, direction, or destination; delete the rule to change them", name))
+		return
+	}
+
+	var update updateFirewallRuleRequest
+	if desired.SourceCIDR != current.SourceCIDR {
+		update.SourceCIDR = &desired.SourceCIDR
+	}
+	if desired.Action != current.Action {
+		update.Action = &desired.Action
+	}
+	if desired.ActiveHours != current.ActiveHours {
+		update.ActiveHours = &desired.ActiveHours
+	}
+	if desired.Description != current.Description {
+		update.Description = &desired.Description
+	}
+	if desired.Group != current.Group {
+		update.Group = &desired.Group
+	}
+	if update != (updateFirewallRuleRequest{}) {
+		if status, body := s.subRequest(r, http.MethodPatch, "/api/v1/firewall/rules/"+current.ID, update); status >= 300 {
+			relay(w, status, body)
+			return
+		}
+		if current, err = s.firewall(r).Get(current.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get firewall rule: %v", err))
+			return
+		}
+	}
+	w.Header().Set("ETag", firewallRuleETag(current))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": firewallRuleResponse(current)})
+}
+
+// nameFilter returns a list's ?name= filter; a resource passes when the
+// filter is empty or equals its name.
+func nameFilter(r *http.Request) func(name string) bool {
+	want := r.URL.Query().Get("name")
+	return func(name string) bool { return want == "" || name == want }
+}
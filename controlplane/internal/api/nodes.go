@@ -0,0 +1,468 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+	"github.com/proxy-manager/controlplane/internal/wireguard"
+)
+
+// nodeOnlineWindow is how recently a node's agent must have reported for the
+// node to count as online. Agents report every sync interval (30s by default).
+const nodeOnlineWindow = 2 * time.Minute
+
+type createNodeRequest struct {
+	Name     string `json:"name"`
+	ClientCN string `json:"client_cn"`          // CN of the agent's client certificate
+	Endpoint string `json:"endpoint,omitempty"` // public WireGuard host:port; the agent may report it instead
+}
+
+func (s *Server) handleCreateNode(w http.ResponseWriter, r *http.Request) {
+	var req createNodeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if !tenantNameRegex.MatchString(req.Name) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid node name: %q", req.Name))
+		return
+	}
+	if req.ClientCN == "" {
+		writeError(w, http.StatusBadRequest, "client_cn is required")
+		return
+	}
+	if req.Endpoint != "" {
+		if err := validateNodeEndpoint(req.Endpoint); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Agent certificates are refused by the management API, so a CN that
+	// already grants API access cannot become a node
+	_, mapped := s.cfg.RoleMap["cn:"+req.ClientCN]
+	if _, err := s.tenantStore.GetByClientCN(req.ClientCN); err == nil || mapped || slices.Contains(s.cfg.AdminCNs, req.ClientCN) {
+		writeError(w, http.StatusConflict, "client_cn is already used for API access")
+		return
+	}
+
+	node := &store.Node{
+		ID:       wireguard.GenerateRandomID("node_"),
+		Name:     req.Name,
+		ClientCN: req.ClientCN,
+		Endpoint: req.Endpoint,
+	}
+	if err := s.nodeStore.Create(node); err != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("failed to create node: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"data": nodeResponse(node)})
+}
+
+func (s *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	nodes, err := s.nodeStore.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list nodes: %v", err))
+		return
+	}
+
+	result := make([]map[string]interface{}, 0, len(nodes))
+	for _, n := range nodes {
+		result = append(result, nodeResponse(n))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+func (s *Server) handleGetNode(w http.ResponseWriter, r *http.Request) {
+	node, err := s.nodeStore.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": nodeResponse(node)})
+}
+
+func (s *Server) handleDeleteNode(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.nodeStore.Get(id); err != nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+
+	tunnels, err := s.tunnels(r).ListByNodeID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(tunnels) > 0 {
+		writeError(w, http.StatusConflict, fmt.Sprintf("node still has %d tunnels", len(tunnels)))
+		return
+	}
+
+	if err := s.nodeStore.Delete(id); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete node: %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// agentRegisterRequest represents the request body for POST /api/v1/agent/register.
+type agentRegisterRequest struct {
+	PublicKey string `json:"public_key"`         // the node's WireGuard public key
+	Endpoint  string `json:"endpoint,omitempty"` // overrides the endpoint set on the node
+	Version   string `json:"version,omitempty"`
+}
+
+// agentReportRequest represents the request body for POST /api/v1/agent/report.
+type agentReportRequest struct {
+	Error       string            `json:"error,omitempty"`        // last reconciliation error on the node
+	AppliedPSKs []agentAppliedPSK `json:"applied_psks,omitempty"` // pending PSKs now set on the node's peers
+	Peers       []agentPeer       `json:"peers,omitempty"`
+}
+
+// agentAppliedPSK acknowledges a delivered PSK by its hash, so the secret is
+// never sent back.
+type agentAppliedPSK struct {
+	TunnelID string `json:"tunnel_id"`
+	PSKHash  string `json:"psk_hash"`
+}
+
+// agentPeer is the kernel state of one WireGuard peer on a node.
+type agentPeer struct {
+	PublicKey     string     `json:"public_key"`
+	Endpoint      string     `json:"endpoint,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	RxBytes       int64      `json:"rx_bytes"`
+	TxBytes       int64      `json:"tx_bytes"`
+}
+
+// handleAgentRegister records the WireGuard key and endpoint of the calling
+// agent's node. Tunnels can be placed on a node once it has registered.
+func (s *Server) handleAgentRegister(w http.ResponseWriter, r *http.Request) {
+	node, ok := s.agentNode(w, r)
+	if !ok {
+		return
+	}
+
+	var req agentRegisterRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(req.PublicKey); err != nil || len(decoded) != 32 {
+		writeError(w, http.StatusBadRequest, "public_key must be valid base64 encoding of 32 bytes")
+		return
+	}
+	if req.Endpoint != "" {
+		if err := validateNodeEndpoint(req.Endpoint); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else if node.Endpoint == "" {
+		writeError(w, http.StatusBadRequest, "endpoint is required: set it on the node or report it from the agent")
+		return
+	}
+
+	if node.Registered() && node.WGPublicKey != req.PublicKey {
+		// Existing client configs name the old key and stop working
+		slog.Warn("node registered with a new WireGuard key", "node", node.ID, "name", node.Name)
+	}
+
+	node, err := s.nodeStore.Register(node.ID, req.PublicKey, req.Endpoint, req.Version, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to register node: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": nodeResponse(node)})
+}
+
+// handleAgentState returns everything the calling agent applies to its node:
+// the tunnels and routes placed on it, with PSKs not yet applied, and the
+// firewall rules, which apply on every node.
+func (s *Server) handleAgentState(w http.ResponseWriter, r *http.Request) {
+	node, ok := s.agentNode(w, r)
+	if !ok {
+		return
+	}
+
+	tunnels, err := s.tunnels(r).ListByNodeID(node.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	routes, err := s.routes(r).ListByNodeID(node.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rules, err := s.firewall(r).List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tunnelList := make([]map[string]interface{}, 0, len(tunnels))
+	for _, t := range tunnels {
+		entry := s.tunnelResponse(t)
+		if t.PendingPSK != "" {
+			acked, err := s.tunnels(r).PendingPSKAcked(t.ID, node.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !acked {
+				entry["preshared_key"] = t.PendingPSK
+			}
+		}
+		tunnelList = append(tunnelList, entry)
+	}
+	routeList := make([]map[string]interface{}, 0, len(routes))
+	for _, route := range routes {
+		routeList = append(routeList, routeResponse(route))
+	}
+	ruleList := make([]map[string]interface{}, 0, len(rules))
+	for _, rule := range rules {
+		ruleList = append(ruleList, firewallRuleResponse(rule))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"node":           nodeResponse(node),
+			"tunnels":        tunnelList,
+			"routes":         routeList,
+			"firewall_rules": ruleList,
+		},
+	})
+}
+
+// handleAgentReport stores the peer stats and reconciliation error the
+// calling agent observed, and acknowledges the PSKs it has applied.
+func (s *Server) handleAgentReport(w http.ResponseWriter, r *http.Request) {
+	node, ok := s.agentNode(w, r)
+	if !ok {
+		return
+	}
+
+	var req agentReportRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	for _, applied := range req.AppliedPSKs {
+		t, err := s.tunnels(r).Get(applied.TunnelID)
+		if err != nil || !servesTunnel(node.ID, t) || t.PendingPSK == "" {
+			continue
+		}
+		// A PSK rotated since the agent fetched its state stays pending
+		if wireguard.HashPSK(t.PendingPSK) != applied.PSKHash {
+			continue
+		}
+		if err := s.tunnels(r).AckPendingPSK(t.ID, t.PendingPSK, node.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	now := time.Now()
+	if s.reconciler != nil {
+		peers := make([]wireguard.PeerInfo, 0, len(req.Peers))
+		for _, p := range req.Peers {
+			peer := wireguard.PeerInfo{
+				PublicKey:     p.PublicKey,
+				Endpoint:      p.Endpoint,
+				ReceiveBytes:  p.RxBytes,
+				TransmitBytes: p.TxBytes,
+			}
+			if p.LastHandshake != nil {
+				peer.LastHandshakeTime = *p.LastHandshake
+			}
+			peers = append(peers, peer)
+		}
+		if err := s.reconciler.RecordNodePeers(node.ID, peers, now); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to record peer stats: %v", err))
+			return
+		}
+	}
+
+	if err := s.nodeStore.RecordSeen(node.ID, now, req.Error); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// agentNode returns the node whose agent sent the request, identified by the
+// CN of its client certificate, or writes an error response.
+func (s *Server) agentNode(w http.ResponseWriter, r *http.Request) (*store.Node, bool) {
+	cn := clientCN(r)
+	if cn == "" {
+		writeError(w, http.StatusUnauthorized, "client certificate required")
+		return nil, false
+	}
+	node, err := s.nodeStore.GetByClientCN(cn)
+	if err != nil {
+		writeError(w, http.StatusForbidden, "client certificate is not registered to a node")
+		return nil, false
+	}
+	return node, true
+}
+
+// validateFailoverNodes checks the failover nodes of a tunnel placed on
+// primary. Clients keep one server key and endpoint, so failover nodes must
+// share the primary's WireGuard key and be reachable at its endpoint, e.g.
+// through an anycast address.
+func (s *Server) validateFailoverNodes(primary *store.Node, ids []string) (int, error) {
+	seen := map[string]bool{primary.ID: true}
+	for _, id := range ids {
+		if seen[id] {
+			return http.StatusBadRequest, fmt.Errorf("failover node %q is listed twice or is the primary node", id)
+		}
+		seen[id] = true
+
+		node, err := s.nodeStore.Get(id)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("failover node %q not found", id)
+		}
+		if !node.Registered() {
+			return http.StatusConflict, fmt.Errorf("failover node %q has not registered yet", id)
+		}
+		if node.WGPublicKey != primary.WGPublicKey {
+			return http.StatusConflict, fmt.Errorf("failover node %q does not share the WireGuard key of node %q", id, primary.ID)
+		}
+	}
+	return 0, nil
+}
+
+// servesTunnel reports whether the node is the tunnel's primary or one of
+// its failover nodes.
+func servesTunnel(nodeID string, t *store.Tunnel) bool {
+	return t.NodeID == nodeID || slices.Contains(t.FailoverNodeIDs, nodeID)
+}
+
+// serverFor returns the WireGuard public key and endpoint a tunnel's client
+// connects to: its node's, or this host's.
+func (s *Server) serverFor(t *store.Tunnel) (string, string) {
+	if t.NodeID != "" {
+		node, err := s.nodeStore.Get(t.NodeID)
+		if err != nil {
+			return "", ""
+		}
+		return node.WGPublicKey, node.Endpoint
+	}
+	pubKey, _ := s.wgManager.GetServerPublicKey()
+	return pubKey, s.cfg.ServerEndpoint
+}
+
+// validateNodeEndpoint checks a public WireGuard endpoint of the form host:port.
+func validateNodeEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid endpoint %q: expected host:port", endpoint)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid endpoint %q: port must be between 1 and 65535", endpoint)
+	}
+	return nil
+}
+
+// nodeResponse is the JSON representation of a stored node.
+func nodeResponse(n *store.Node) map[string]interface{} {
+	online := nodeOnline(n)
+	return map[string]interface{}{
+		"id":            n.ID,
+		"name":          n.Name,
+		"client_cn":     n.ClientCN,
+		"wg_public_key": n.WGPublicKey,
+		"endpoint":      n.Endpoint,
+		"agent_version": n.AgentVersion,
+		"registered":    n.Registered(),
+		"online":        online,
+		"last_seen_at":  formatTimePtr(n.LastSeenAt),
+		"last_error":    n.LastError,
+		"created_at":    n.CreatedAt.UTC().Format(time.RFC3339),
+		"updated_at":    n.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// nodeOnline reports whether the node's agent has checked in recently.
+func nodeOnline(n *store.Node) bool {
+	return n.LastSeenAt != nil && time.Since(*n.LastSeenAt) < nodeOnlineWindow
+}
+
+// nodeStatus summarizes a node's health for failover: "serving" when its
+// agent checks in and applies state cleanly, "degraded" when it checks in
+// but reports an error, and "offline" otherwise.
+func nodeStatus(n *store.Node) string {
+	switch {
+	case !nodeOnline(n):
+		return "offline"
+	case n.LastError != "":
+		return "degraded"
+	default:
+		return "serving"
+	}
+}
+
+// handleGetRouteNodes returns the status of a route on each node serving it,
+// in failover order, and the node traffic should be sent to: the first one
+// that is serving. A route served by this host has no nodes.
+func (s *Server) handleGetRouteNodes(w http.ResponseWriter, r *http.Request) {
+	route, err := s.routes(r).Get(r.PathValue("id"))
+	if err != nil || !identityFrom(r.Context()).canAccess(route.TenantID) {
+		writeError(w, http.StatusNotFound, "route not found")
+		return
+	}
+	tunnel, err := s.tunnels(r).Get(route.TunnelID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var ids []string
+	if tunnel.NodeID != "" {
+		ids = append([]string{tunnel.NodeID}, tunnel.FailoverNodeIDs...)
+	}
+	active := ""
+	nodes := make([]map[string]interface{}, 0, len(ids))
+	for i, id := range ids {
+		node, err := s.nodeStore.Get(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("node %s: %v", id, err))
+			return
+		}
+		status := nodeStatus(node)
+		if active == "" && status == "serving" {
+			active = node.ID
+		}
+		nodes = append(nodes, map[string]interface{}{
+			"node_id":      node.ID,
+			"name":         node.Name,
+			"endpoint":     node.Endpoint,
+			"primary":      i == 0,
+			"status":       status,
+			"active":       active == node.ID,
+			"last_seen_at": formatTimePtr(node.LastSeenAt),
+			"last_error":   node.LastError,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"route_id":       route.ID,
+			"active_node_id": active,
+			"nodes":          nodes,
+		},
+	})
+}
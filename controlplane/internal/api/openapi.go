@@ -0,0 +1,237 @@
+package api
+
+import (
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// openAPIVersion is the version of the API document, not of the spec format.
+const openAPIVersion = "1.0.0"
+
+var pathParamRegex = regexp.MustCompile(`\{([a-zA-Z_]+)\}`)
+
+// queryParams documents query string parameters that handlers read directly.
+var queryParams = map[string][]map[string]interface{}{
+	"GET /api/v1/tunnels": {{
+		"name":        "label",
+		"in":          "query",
+		"description": "Label selector in key=value form. Repeat to require several labels.",
+		"schema":      map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		"style":       "form",
+		"explode":     true,
+	}},
+	"GET /api/v1/status": {
+		{"name": "live", "in": "query", "description": "Set to true to also read WireGuard, Caddy, and nftables and report in_sync per resource", "schema": map[string]interface{}{"type": "boolean"}},
+	},
+	"GET /api/v1/tunnels/{id}/stats": {
+		{"name": "from", "in": "query", "description": "RFC 3339 start time (default: 24h before to)", "schema": map[string]interface{}{"type": "string", "format": "date-time"}},
+		{"name": "to", "in": "query", "description": "RFC 3339 end time (default: now)", "schema": map[string]interface{}{"type": "string", "format": "date-time"}},
+		{"name": "resolution", "in": "query", "description": "Bucket size as a Go duration, e.g. 5m or 1h (default: 1h)", "schema": map[string]interface{}{"type": "string"}},
+	},
+	"POST /api/v1/firewall/rules/bulk": {
+		{"name": "mode", "in": "query", "description": "atomic (default) creates every rule or none; best_effort creates the valid rules", "schema": map[string]interface{}{"type": "string", "enum": []string{"atomic", "best_effort"}}},
+	},
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildOpenAPI(s.endpoints()))
+}
+
+// buildOpenAPI renders an OpenAPI 3.1 document from the endpoint table.
+// Request body schemas are derived from the handlers' request structs.
+func buildOpenAPI(endpoints []endpoint) map[string]interface{} {
+	paths := map[string]interface{}{}
+	schemas := map[string]interface{}{}
+
+	for _, e := range endpoints {
+		item, ok := paths[e.path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[e.path] = item
+		}
+
+		op := map[string]interface{}{
+			"operationId": operationID(e.handler),
+			"summary":     e.summary,
+			"responses":   operationResponses(e),
+		}
+
+		var params []map[string]interface{}
+		for _, m := range pathParamRegex.FindAllStringSubmatch(e.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		params = append(params, queryParams[e.method+" "+e.path]...)
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if e.request != nil {
+			t := reflect.TypeOf(e.request)
+			name := schemaName(t.Name())
+			schemas[name] = schemaFor(t)
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"$ref": "#/components/schemas/" + name},
+					},
+				},
+			}
+		}
+
+		if e.role == 0 {
+			op["security"] = []interface{}{}
+		} else {
+			op["x-required-role"] = e.role.String()
+		}
+
+		item[strings.ToLower(e.method)] = op
+	}
+
+	schemas["Error"] = map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"error": map[string]interface{}{"type": "string"}},
+		"required":   []string{"error"},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "Proxy Manager Control Plane API",
+			"version": openAPIVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"mtls":   map[string]interface{}{"type": "mutualTLS"},
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"mtls": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+		},
+	}
+}
+
+func operationResponses(e endpoint) map[string]interface{} {
+	errorRef := map[string]interface{}{
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+			},
+		},
+	}
+	withDesc := func(desc string) map[string]interface{} {
+		m := map[string]interface{}{"description": desc}
+		for k, v := range errorRef {
+			m[k] = v
+		}
+		return m
+	}
+
+	success := map[string]interface{}{"description": http.StatusText(e.status)}
+	if e.status != http.StatusNoContent {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "object"},
+			},
+		}
+	}
+
+	responses := map[string]interface{}{
+		strconv.Itoa(e.status): success,
+	}
+	if e.method == http.MethodPut && strings.HasSuffix(e.path, "/by-name/{name}") {
+		// A PUT by name creates the resource when no resource has the name
+		created := maps.Clone(success)
+		created["description"] = http.StatusText(http.StatusCreated)
+		responses["201"] = created
+	}
+	if e.request != nil {
+		responses["400"] = withDesc("Invalid request")
+	}
+	if strings.Contains(e.path, "{") {
+		responses["404"] = withDesc("Not found")
+	}
+	if e.role != 0 {
+		responses["401"] = withDesc("Invalid API token")
+		responses["403"] = withDesc("Insufficient role")
+	}
+	return responses
+}
+
+// operationID derives an operation ID from the handler's method name,
+// e.g. handleCreateTunnel -> createTunnel.
+func operationID(h http.HandlerFunc) string {
+	// Method values are named like "pkg.(*Server).handleCreateTunnel-fm".
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	name = strings.TrimSuffix(name[strings.LastIndex(name, ".")+1:], "-fm")
+	name = strings.TrimPrefix(name, "handle")
+	if name == "" {
+		return ""
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// schemaName converts a request type name to a schema name,
+// e.g. createTunnelRequest -> CreateTunnelRequest.
+func schemaName(typeName string) string {
+	if typeName == "" {
+		return ""
+	}
+	return strings.ToUpper(typeName[:1]) + typeName[1:]
+}
+
+// schemaFor builds a JSON Schema for a Go type using its json struct tags.
+// Required fields are enforced by the handlers and are not listed here.
+func schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = schemaFor(f.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,293 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// globalPolicy is the {scope} of the policy that applies to every resource.
+const globalPolicy = "global"
+
+// maxPolicyEntries bounds each list of a policy.
+const maxPolicyEntries = 256
+
+type policyRequest struct {
+	DomainSuffixes []string          `json:"domain_suffixes,omitempty"` // SNI domains must equal or end in one of these
+	PortRanges     []store.PortRange `json:"port_ranges,omitempty"`     // listen and firewall ports must fall in one of these
+	ForbiddenCIDRs []string          `json:"forbidden_cidrs,omitempty"` // CIDRs no source, firewall rule, or advertised route may claim
+}
+
+// policyClaim is what a new or updated resource would claim.
+type policyClaim struct {
+	Domains     []string          // SNI domains, possibly wildcards
+	Ports       []store.PortRange // listen ports of port forwards and firewall rules
+	SourceCIDRs []string          // addresses allowed in; may not overlap a forbidden CIDR
+	DestCIDRs   []string          // addresses allowed to; may not overlap a forbidden CIDR
+	Routes      []string          // advertised routes; may not overlap a forbidden CIDR
+}
+
+// policyScope maps the {scope} path value to a tenant ID, "" for global.
+func policyScope(scope string) string {
+	if scope == globalPolicy {
+		return ""
+	}
+	return scope
+}
+
+// checkPolicy checks claim against the global policy and the policy of
+// tenantID, and against the domain suffixes of other tenants: a domain under
+// a suffix in some tenant's policy belongs to the tenant with the longest
+// such suffix, so no one else can route it. It returns 403 with the reason
+// for a violation.
+func (s *Server) checkPolicy(tenantID string, claim policyClaim) (int, error) {
+	policies, err := s.tenantStore.ListPolicies()
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to load policies: %v", err)
+	}
+	if len(policies) == 0 {
+		return 0, nil
+	}
+
+	for _, d := range claim.Domains {
+		d = strings.ToLower(d)
+		if owner, suffix, ok := domainOwner(policies, d); ok && owner != tenantID {
+			return http.StatusForbidden, fmt.Errorf("domain %s is reserved for another tenant by policy (%s)", d, suffix)
+		}
+	}
+
+	for _, p := range policies {
+		if p.TenantID != "" && p.TenantID != tenantID {
+			continue
+		}
+		name := "the global policy"
+		if p.TenantID != "" {
+			name = "the tenant's policy"
+		}
+		for _, d := range claim.Domains {
+			if len(p.DomainSuffixes) > 0 && !matchesSuffix(p.DomainSuffixes, strings.ToLower(strings.TrimPrefix(d, "*."))) {
+				return http.StatusForbidden, fmt.Errorf("domain %s is not under a domain suffix allowed by %s", d, name)
+			}
+		}
+		for _, r := range claim.Ports {
+			if len(p.PortRanges) > 0 && !portsAllowed(p.PortRanges, r) {
+				return http.StatusForbidden, fmt.Errorf("port %s is outside the port ranges allowed by %s", portSpan(r.Start, endOrZero(r)), name)
+			}
+		}
+		for _, f := range p.ForbiddenCIDRs {
+			forbidden, err := netip.ParsePrefix(f)
+			if err != nil {
+				continue
+			}
+			for _, c := range claim.SourceCIDRs {
+				if prefix, err := netip.ParsePrefix(c); err == nil && forbidden.Overlaps(prefix) {
+					return http.StatusForbidden, fmt.Errorf("source %s overlaps %s, forbidden by %s", prefix, forbidden, name)
+				}
+			}
+			for _, c := range claim.DestCIDRs {
+				if prefix, err := netip.ParsePrefix(c); err == nil && forbidden.Overlaps(prefix) {
+					return http.StatusForbidden, fmt.Errorf("destination %s overlaps %s, forbidden by %s", prefix, forbidden, name)
+				}
+			}
+			for _, c := range claim.Routes {
+				if prefix, err := netip.ParsePrefix(c); err == nil && forbidden.Overlaps(prefix) {
+					return http.StatusForbidden, fmt.Errorf("advertised route %s overlaps %s, forbidden by %s", prefix, forbidden, name)
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// domainOwner returns the tenant whose policy lists the longest suffix of
+// the domain d. A wildcard also belongs to a tenant whose suffix it covers,
+// since it would capture that suffix's name.
+func domainOwner(policies []*store.Policy, d string) (owner, suffix string, ok bool) {
+	name := strings.TrimPrefix(d, "*.")
+	for _, p := range policies {
+		if p.TenantID == "" {
+			continue
+		}
+		for _, s := range p.DomainSuffixes {
+			if (name == s || strings.HasSuffix(name, "."+s) || wildcardCovers(d, s)) && len(s) > len(suffix) {
+				owner, suffix, ok = p.TenantID, s, true
+			}
+		}
+	}
+	return owner, suffix, ok
+}
+
+// matchesSuffix reports whether name equals or is under one of suffixes.
+func matchesSuffix(suffixes []string, name string) bool {
+	for _, s := range suffixes {
+		if name == s || strings.HasSuffix(name, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// portsAllowed reports whether r lies entirely within one of ranges.
+func portsAllowed(ranges []store.PortRange, r store.PortRange) bool {
+	for _, allowed := range ranges {
+		if allowed.Contains(r.Start) && allowed.Contains(r.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// endOrZero returns the end of r, or 0 for a single port, as portSpan expects.
+func endOrZero(r store.PortRange) int {
+	if r.End == r.Start {
+		return 0
+	}
+	return r.End
+}
+
+// handleListPolicies returns the policies that apply to the caller: all of
+// them for cross-tenant callers, the global and their own for tenants.
+func (s *Server) handleListPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := s.tenantStore.ListPolicies()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list policies: %v", err))
+		return
+	}
+	caller := identityFrom(r.Context())
+	result := make([]map[string]interface{}, 0, len(policies))
+	for _, p := range policies {
+		if p.TenantID == "" || caller.canAccess(p.TenantID) {
+			result = append(result, policyResponse(p))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+// handleGetPolicy returns the global policy or a tenant's.
+func (s *Server) handleGetPolicy(w http.ResponseWriter, r *http.Request) {
+	tenantID := policyScope(r.PathValue("scope"))
+	if tenantID != "" && !identityFrom(r.Context()).canAccess(tenantID) {
+		writeError(w, http.StatusNotFound, "policy not found")
+		return
+	}
+	p, err := s.tenantStore.GetPolicy(tenantID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "policy not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": policyResponse(p)})
+}
+
+// handlePutPolicy sets the global policy or a tenant's. It applies to
+// resources created or changed from then on; existing ones are kept.
+func (s *Server) handlePutPolicy(w http.ResponseWriter, r *http.Request) {
+	var req policyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	tenantID := policyScope(r.PathValue("scope"))
+	if tenantID != "" {
+		if _, err := s.tenantStore.Get(tenantID); err != nil {
+			writeError(w, http.StatusNotFound, "tenant not found")
+			return
+		}
+	}
+	if len(req.DomainSuffixes) > maxPolicyEntries || len(req.PortRanges) > maxPolicyEntries || len(req.ForbiddenCIDRs) > maxPolicyEntries {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("each policy list accepts at most %d entries", maxPolicyEntries))
+		return
+	}
+
+	p := &store.Policy{TenantID: tenantID, UpdatedBy: identityFrom(r.Context()).ClientCN}
+	for _, d := range req.DomainSuffixes {
+		suffix := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(d, "*."), "."))
+		if err := validateSNI(suffix); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid domain suffix: %q", d))
+			return
+		}
+		p.DomainSuffixes = append(p.DomainSuffixes, suffix)
+	}
+	for _, pr := range req.PortRanges {
+		if pr.End == 0 {
+			pr.End = pr.Start
+		}
+		if pr.Start < 1 || pr.End > 65535 || pr.Start > pr.End {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid port range %d-%d: ports must be between 1 and 65535 and start must not exceed end", pr.Start, pr.End))
+			return
+		}
+		p.PortRanges = append(p.PortRanges, pr)
+	}
+	for _, c := range req.ForbiddenCIDRs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid forbidden CIDR: %q", c))
+			return
+		}
+		p.ForbiddenCIDRs = append(p.ForbiddenCIDRs, prefix.Masked().String())
+	}
+
+	// A suffix can be reserved by one tenant only
+	if tenantID != "" && len(p.DomainSuffixes) > 0 {
+		policies, err := s.tenantStore.ListPolicies()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list policies: %v", err))
+			return
+		}
+		for _, other := range policies {
+			if other.TenantID == "" || other.TenantID == tenantID {
+				continue
+			}
+			for _, suffix := range p.DomainSuffixes {
+				for _, taken := range other.DomainSuffixes {
+					if suffix == taken {
+						writeError(w, http.StatusConflict, fmt.Sprintf("domain suffix %s is already in the policy of tenant %s", suffix, other.TenantID))
+						return
+					}
+				}
+			}
+		}
+	}
+
+	if err := s.tenantStore.SetPolicy(p); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to set policy: %v", err))
+		return
+	}
+	p, err := s.tenantStore.GetPolicy(tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get policy: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": policyResponse(p)})
+}
+
+// handleDeletePolicy removes the global policy or a tenant's.
+func (s *Server) handleDeletePolicy(w http.ResponseWriter, r *http.Request) {
+	if err := s.tenantStore.DeletePolicy(policyScope(r.PathValue("scope"))); err != nil {
+		writeError(w, http.StatusNotFound, "policy not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func policyResponse(p *store.Policy) map[string]interface{} {
+	scope, tenantID := globalPolicy, interface{}(nil)
+	if p.TenantID != "" {
+		scope, tenantID = p.TenantID, p.TenantID
+	}
+	var updatedBy interface{}
+	if p.UpdatedBy != "" {
+		updatedBy = p.UpdatedBy
+	}
+	return map[string]interface{}{
+		"scope":           scope,
+		"tenant_id":       tenantID,
+		"domain_suffixes": p.DomainSuffixes,
+		"port_ranges":     p.PortRanges,
+		"forbidden_cidrs": p.ForbiddenCIDRs,
+		"updated_by":      updatedBy,
+		"updated_at":      p.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
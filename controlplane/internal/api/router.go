@@ -1,17 +1,28 @@
 package api
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/proxy-manager/controlplane/internal/admission"
+	"github.com/proxy-manager/controlplane/internal/audit"
+	"github.com/proxy-manager/controlplane/internal/backup"
+	"github.com/proxy-manager/controlplane/internal/ca"
 	"github.com/proxy-manager/controlplane/internal/caddy"
 	"github.com/proxy-manager/controlplane/internal/config"
+	"github.com/proxy-manager/controlplane/internal/dns"
 	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/housekeeping"
+	"github.com/proxy-manager/controlplane/internal/leader"
+	"github.com/proxy-manager/controlplane/internal/notify"
 	"github.com/proxy-manager/controlplane/internal/reconciler"
 	"github.com/proxy-manager/controlplane/internal/store"
 	"github.com/proxy-manager/controlplane/internal/wireguard"
@@ -23,11 +34,34 @@ type Server struct {
 	tunnelStore *store.TunnelStore
 	routeStore  *store.RouteStore
 	fwStore     *store.FirewallStore
+	idempotency *store.IdempotencyStore
+	tenantStore *store.TenantStore
+	nodeStore   *store.NodeStore
 	caddyClient caddy.Client
 	wgManager   *wireguard.Manager
 	fwManager   *firewall.Manager
 	reconciler  *reconciler.Reconciler
+	keeper      *housekeeping.Keeper
+	dns         *dns.Updater       // nil when no DNS provider is configured
+	auditSink   audit.Sink         // nil when the audit log is kept only in SQLite
+	elector     *leader.Elector    // nil when this is the only instance
+	backup      *backup.Replicator // nil when backups are not configured
+	validator   *admission.Webhook // nil when no validation webhook is configured
+	escrow      *keyEscrow         // recently generated client keys, for config and QR downloads
+	tokens      *tokenCache        // token lookups made by rateLimitKey
+	notifier    notify.Notifier    // nil when no webhooks are configured
+	ca          *ca.Authority      // nil when no client CA key is configured
+	certStore   *store.CertStore   // client certificates issued by ca
+	version     string             // control plane build version, reported by GET /api/v1/server
 	mux         *http.ServeMux
+	writeMu     sync.Mutex               // serializes If-Match writes
+	rateLimits  *store.RateLimitStore    // buckets saved by the rate limiters
+	runStore    *store.ReconcileRunStore // history of reconciliation passes
+	readLimit   *RateLimiter             // started by the first Handler
+	mutateLimit *RateLimiter             // started by the first Handler
+	limitOnce   sync.Once
+	maintMode   maintenanceCache
+	background  backgroundQueue // DNS updates and webhooks queued by requests
 }
 
 // NewServer creates a new API server with all routes mounted.
@@ -36,6 +70,8 @@ func NewServer(
 	tunnelStore *store.TunnelStore,
 	routeStore *store.RouteStore,
 	fwStore *store.FirewallStore,
+	tenantStore *store.TenantStore,
+	nodeStore *store.NodeStore,
 	caddyClient caddy.Client,
 	wgManager *wireguard.Manager,
 	fwManager *firewall.Manager,
@@ -46,10 +82,18 @@ func NewServer(
 		tunnelStore: tunnelStore,
 		routeStore:  routeStore,
 		fwStore:     fwStore,
+		idempotency: store.NewIdempotencyStore(fwStore.DB()),
+		rateLimits:  store.NewRateLimitStore(fwStore.DB()),
+		runStore:    store.NewReconcileRunStore(fwStore.DB()),
+		tenantStore: tenantStore,
+		nodeStore:   nodeStore,
 		caddyClient: caddyClient,
 		wgManager:   wgManager,
 		fwManager:   fwManager,
 		reconciler:  rec,
+		escrow:      newKeyEscrow(),
+		tokens:      newTokenCache(),
+		version:     "dev",
 		mux:         http.NewServeMux(),
 	}
 
@@ -57,77 +101,198 @@ func NewServer(
 	return s
 }
 
-func (s *Server) registerRoutes() {
-	// Tunnel endpoints
-	s.mux.HandleFunc("POST /api/v1/tunnels", s.handleCreateTunnel)
-	s.mux.HandleFunc("GET /api/v1/tunnels", s.handleListTunnels)
-	s.mux.HandleFunc("DELETE /api/v1/tunnels/{id}", s.handleDeleteTunnel)
-	s.mux.HandleFunc("GET /api/v1/tunnels/{id}/config", s.handleGetTunnelConfig)
-	s.mux.HandleFunc("GET /api/v1/tunnels/{id}/qr", s.handleGetTunnelQR)
-	s.mux.HandleFunc("POST /api/v1/tunnels/{id}/rotate", s.handleRotateTunnel)
-	s.mux.HandleFunc("PATCH /api/v1/tunnels/{id}/rotation-policy", s.handleUpdateRotationPolicy)
-	s.mux.HandleFunc("GET /api/v1/tunnels/{id}/rotation-policy", s.handleGetRotationPolicy)
-
-	// Route endpoints
-	s.mux.HandleFunc("POST /api/v1/routes", s.handleCreateRoute)
-	s.mux.HandleFunc("GET /api/v1/routes", s.handleListRoutes)
-	s.mux.HandleFunc("DELETE /api/v1/routes/{id}", s.handleDeleteRoute)
-
-	// Firewall endpoints
-	s.mux.HandleFunc("POST /api/v1/firewall/rules", s.handleCreateFirewallRule)
-	s.mux.HandleFunc("GET /api/v1/firewall/rules", s.handleListFirewallRules)
-	s.mux.HandleFunc("DELETE /api/v1/firewall/rules/{id}", s.handleDeleteFirewallRule)
-
-	// System endpoints
-	s.mux.HandleFunc("GET /api/v1/health", s.handleHealth)
-	s.mux.HandleFunc("GET /api/v1/status", s.handleStatus)
-	s.mux.HandleFunc("POST /api/v1/reconcile", s.handleForceReconcile)
-	s.mux.HandleFunc("GET /api/v1/server/pubkey", s.handleGetServerPubkey)
+// tunnels, routes, and firewall return the stores bound to r's context, so
+// a handler's queries stop once its client has gone away.
+func (s *Server) tunnels(r *http.Request) *store.TunnelStore {
+	return s.tunnelStore.WithContext(storeContext(r))
 }
 
-// Handler returns the mux wrapped with middleware.
-func (s *Server) Handler() http.Handler {
-	auditLogger := NewAuditLogger(s.fwStore)
-	rateLimiter := NewRateLimiter(100, time.Minute)
-
-	var handler http.Handler = s.mux
-	handler = AuditMiddleware(auditLogger)(handler)
-	handler = rateLimiter.RateLimitMiddleware(handler)
-	handler = LoggingMiddleware(handler)
+func (s *Server) routes(r *http.Request) *store.RouteStore {
+	return s.routeStore.WithContext(storeContext(r))
+}
 
-	return handler
+func (s *Server) firewall(r *http.Request) *store.FirewallStore {
+	return s.fwStore.WithContext(storeContext(r))
 }
 
-// NewTLSConfig creates a TLS configuration for mTLS with TLS 1.3 only.
-func NewTLSConfig(cfg *config.Config) (*tls.Config, error) {
-	if cfg.TLSCert == "" || cfg.TLSKey == "" {
-		return nil, nil // No TLS configured (for testing)
+// storeContext is the context of r's queries. A write must not be cut short
+// by its client: it usually records a change already made to nftables,
+// Caddy, or WireGuard, which the store would otherwise miss. Its queries
+// are bounded by the store's query timeout instead.
+func storeContext(r *http.Request) context.Context {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r.Context()
 	}
+	return context.WithoutCancel(r.Context())
+}
 
-	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
-	if err != nil {
-		return nil, fmt.Errorf("load TLS cert/key: %w", err)
-	}
+// endpoint describes a single API operation. The same table drives route
+// registration and the OpenAPI document, so the two cannot drift apart.
+type endpoint struct {
+	method  string
+	path    string
+	role    role // minimum role; zero means unauthenticated
+	handler http.HandlerFunc
+	summary string
+	request interface{} // zero value of the JSON request body type, if any
+	status  int         // success status code
+}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS13,
+// endpoints returns every API operation served by the control plane.
+// Tunnel config and QR downloads describe how to join the VPN, so they
+// require operator rather than read-only.
+func (s *Server) endpoints() []endpoint {
+	return []endpoint{
+		// Tunnel endpoints
+		{"POST", "/api/v1/tunnels", roleOperator, s.handleCreateTunnel, "Create tunnel", createTunnelRequest{}, http.StatusCreated},
+		{"GET", "/api/v1/tunnels", roleReadOnly, s.handleListTunnels, "List tunnels", nil, http.StatusOK},
+		{"GET", "/api/v1/tunnels/{id}", roleReadOnly, s.handleGetTunnel, "Get tunnel with its routes", nil, http.StatusOK},
+		{"PATCH", "/api/v1/tunnels/{id}", roleOperator, s.handleUpdateTunnel, "Update tunnel labels, source CIDR, or enabled state", updateTunnelRequest{}, http.StatusOK},
+		{"DELETE", "/api/v1/tunnels/{id}", roleOperator, s.handleDeleteTunnel, "Delete tunnel and cascade its routes", nil, http.StatusNoContent},
+		{"POST", "/api/v1/tunnels/{id}/restore", roleOperator, s.handleRestoreTunnel, "Restore a deleted tunnel and its routes", nil, http.StatusOK},
+		{"POST", "/api/v1/tunnels/{id}/approve", roleAdmin, s.handleApproveTunnel, "Approve a tunnel awaiting approval", nil, http.StatusOK},
+		{"POST", "/api/v1/tunnels/{id}/reject", roleAdmin, s.handleRejectTunnel, "Reject and discard a tunnel awaiting approval", rejectTunnelRequest{}, http.StatusNoContent},
+		{"GET", "/api/v1/tunnels/{id}/routes", roleReadOnly, s.handleListTunnelRoutes, "List a tunnel's routes", nil, http.StatusOK},
+		{"GET", "/api/v1/tunnels/{id}/config", roleOperator, s.handleGetTunnelConfig, "Download WireGuard config", nil, http.StatusOK},
+		{"GET", "/api/v1/tunnels/{id}/qr", roleOperator, s.handleGetTunnelQR, "Download WireGuard config as QR code", nil, http.StatusOK},
+		{"POST", "/api/v1/tunnels/{id}/rotate", roleOperator, s.handleRotateTunnel, "Rotate tunnel keys", nil, http.StatusOK},
+		{"PATCH", "/api/v1/tunnels/{id}/rotation-policy", roleOperator, s.handleUpdateRotationPolicy, "Update rotation policy", updateRotationPolicyRequest{}, http.StatusOK},
+		{"GET", "/api/v1/tunnels/{id}/rotation-policy", roleReadOnly, s.handleGetRotationPolicy, "Get rotation policy", nil, http.StatusOK},
+		{"GET", "/api/v1/tunnels/{id}/stats", roleReadOnly, s.handleGetTunnelStats, "Traffic history", nil, http.StatusOK},
+		{"GET", "/api/v1/tunnels/{id}/endpoints", roleReadOnly, s.handleGetTunnelEndpoints, "Endpoint change history", nil, http.StatusOK},
+		{"GET", "/api/v1/tunnels/{id}/events", roleReadOnly, s.handleGetTunnelEvents, "Peer connect and disconnect events", nil, http.StatusOK},
+		{"POST", "/api/v1/tunnels/{id}/defer-revocation", roleOperator, s.handleDeferRevocation, "Postpone inactivity revocation", deferRevocationRequest{}, http.StatusOK},
+		{"PUT", "/api/v1/tunnels/by-name/{name}", roleOperator, s.handlePutTunnelByName, "Create or update the tunnel with a name", createTunnelRequest{}, http.StatusOK},
+
+		// Route endpoints
+		{"POST", "/api/v1/routes", roleOperator, s.handleCreateRoute, "Create route", createRouteRequest{}, http.StatusCreated},
+		{"GET", "/api/v1/routes", roleReadOnly, s.handleListRoutes, "List routes", nil, http.StatusOK},
+		{"GET", "/api/v1/routes/{id}", roleReadOnly, s.handleGetRoute, "Get route with its tunnel", nil, http.StatusOK},
+		{"PATCH", "/api/v1/routes/{id}", roleOperator, s.handleUpdateRoute, "Update route priority", updateRouteRequest{}, http.StatusOK},
+		{"DELETE", "/api/v1/routes/{id}", roleOperator, s.handleDeleteRoute, "Delete route", nil, http.StatusNoContent},
+		{"GET", "/api/v1/routes/{id}/nodes", roleReadOnly, s.handleGetRouteNodes, "Get route status on each serving node", nil, http.StatusOK},
+		{"GET", "/api/v1/routes/{id}/stats", roleReadOnly, s.handleGetRouteStats, "Connection and traffic history", nil, http.StatusOK},
+		{"PUT", "/api/v1/routes/by-name/{name}", roleOperator, s.handlePutRouteByName, "Create or update the route with a name", createRouteRequest{}, http.StatusOK},
+
+		// Firewall endpoints
+		{"POST", "/api/v1/firewall/rules", roleOperator, s.handleCreateFirewallRule, "Create firewall rule", createFirewallRuleRequest{}, http.StatusCreated},
+		{"GET", "/api/v1/firewall/rules", roleReadOnly, s.handleListFirewallRules, "List firewall rules", nil, http.StatusOK},
+		{"PATCH", "/api/v1/firewall/rules/{id}", roleOperator, s.handleUpdateFirewallRule, "Update firewall rule", updateFirewallRuleRequest{}, http.StatusOK},
+		{"DELETE", "/api/v1/firewall/rules/{id}", roleOperator, s.handleDeleteFirewallRule, "Delete firewall rule", nil, http.StatusNoContent},
+		{"PUT", "/api/v1/firewall/rules/by-name/{name}", roleOperator, s.handlePutFirewallRuleByName, "Create or update the firewall rule with a name", createFirewallRuleRequest{}, http.StatusOK},
+		{"POST", "/api/v1/firewall/rules/bulk", roleOperator, s.handleBulkFirewallRules, "Create many firewall rules from JSON or CSV", bulkFirewallRulesRequest{}, http.StatusOK},
+		{"POST", simulatePath, roleReadOnly, s.handleSimulateFirewall, "Evaluate the firewall rules against a connection", simulateFirewallRequest{}, http.StatusOK},
+		{"DELETE", "/api/v1/firewall/groups/{group}", roleOperator, s.handleDeleteFirewallGroup, "Delete every firewall rule in a group", nil, http.StatusOK},
+		{"GET", "/api/v1/firewall/bans", roleAdmin, s.handleListBans, "List automatic bans", nil, http.StatusOK},
+
+		// Declarative state
+		{"PUT", "/api/v1/state", roleOperator, s.handlePutState, "Apply a desired set of tunnels, routes, and firewall rules", stateDocument{}, http.StatusOK},
+		{"POST", "/api/v1/import", roleAdmin, s.handleImport, "Adopt existing WireGuard peers and Caddy routes", nil, http.StatusOK},
+
+		// Tenant endpoints
+		{"POST", "/api/v1/tenants", roleAdmin, s.handleCreateTenant, "Create tenant", createTenantRequest{}, http.StatusCreated},
+		{"GET", "/api/v1/tenants", roleAdmin, s.handleListTenants, "List tenants", nil, http.StatusOK},
+		{"DELETE", "/api/v1/tenants/{id}", roleAdmin, s.handleDeleteTenant, "Delete tenant", nil, http.StatusNoContent},
+
+		// Policy endpoints; {scope} is "global" or a tenant ID
+		{"GET", "/api/v1/policies", roleReadOnly, s.handleListPolicies, "List the policies that apply to the caller", nil, http.StatusOK},
+		{"GET", "/api/v1/policies/{scope}", roleReadOnly, s.handleGetPolicy, "Get the global policy or a tenant's", nil, http.StatusOK},
+		{"PUT", "/api/v1/policies/{scope}", roleAdmin, s.handlePutPolicy, "Set the allowed domains, ports, and forbidden CIDRs of a scope", policyRequest{}, http.StatusOK},
+		{"DELETE", "/api/v1/policies/{scope}", roleAdmin, s.handleDeletePolicy, "Remove the global policy or a tenant's", nil, http.StatusNoContent},
+
+		// Client certificate endpoints
+		{"POST", "/api/v1/certs", roleAdmin, s.handleIssueCert, "Issue an API client certificate", issueCertRequest{}, http.StatusCreated},
+		{"GET", "/api/v1/certs", roleAdmin, s.handleListCerts, "List issued client certificates", nil, http.StatusOK},
+		{"GET", "/api/v1/certs/crl", roleReadOnly, s.handleGetCRL, "Revocation list of issued client certificates", nil, http.StatusOK},
+		{"GET", "/api/v1/certs/{id}", roleAdmin, s.handleGetCert, "Get an issued client certificate", nil, http.StatusOK},
+		{"POST", "/api/v1/certs/{id}/revoke", roleAdmin, s.handleRevokeCert, "Revoke a client certificate", revokeCertRequest{}, http.StatusOK},
+
+		// Node endpoints
+		{"POST", "/api/v1/nodes", roleAdmin, s.handleCreateNode, "Create node", createNodeRequest{}, http.StatusCreated},
+		{"GET", "/api/v1/nodes", roleReadOnly, s.handleListNodes, "List nodes", nil, http.StatusOK},
+		{"GET", "/api/v1/nodes/{id}", roleReadOnly, s.handleGetNode, "Get node", nil, http.StatusOK},
+		{"DELETE", "/api/v1/nodes/{id}", roleAdmin, s.handleDeleteNode, "Delete node with no tunnels", nil, http.StatusNoContent},
+
+		// Agent endpoints, authenticated by the node's client certificate
+		{"POST", "/api/v1/agent/register", 0, s.handleAgentRegister, "Register a node agent", agentRegisterRequest{}, http.StatusOK},
+		{"GET", "/api/v1/agent/state", 0, s.handleAgentState, "Desired state of the agent's node", nil, http.StatusOK},
+		{"POST", "/api/v1/agent/report", 0, s.handleAgentReport, "Report node peer stats and errors", agentReportRequest{}, http.StatusOK},
+
+		// System endpoints
+		{"GET", "/api/v1/health", 0, s.handleHealth, "Liveness check", nil, http.StatusOK},
+		{"GET", "/api/v1/health/ready", 0, s.handleReady, "Readiness check of SQLite, Caddy, WireGuard, and nftables", nil, http.StatusOK},
+		{"GET", "/api/v1/status", roleReadOnly, s.handleStatus, "Full system status", nil, http.StatusOK},
+		{"POST", "/api/v1/reconcile", roleOperator, s.handleForceReconcile, "Force reconciliation", nil, http.StatusOK},
+		{"GET", "/api/v1/reconcile/history", roleReadOnly, s.handleReconcileHistory, "Reconciliation passes with their operation counts", nil, http.StatusOK},
+		{"GET", "/api/v1/reconcile/startup-report", roleReadOnly, s.handleStartupReport, "What the first reconciliation after the last start repaired", nil, http.StatusOK},
+		{"GET", maintenancePath, roleReadOnly, s.handleGetMaintenance, "Get read-only maintenance mode", nil, http.StatusOK},
+		{"POST", maintenancePath, roleAdmin, s.handleSetMaintenance, "Turn read-only maintenance mode on or off", maintenanceRequest{}, http.StatusOK},
+		{"POST", "/api/v1/backup/snapshot", roleAdmin, s.handleBackupSnapshot, "Upload a database snapshot to S3", nil, http.StatusOK},
+		{"GET", "/api/v1/monitoring/metrics", roleReadOnly, s.handleGetMetrics, "Tunnel, reconciliation, and address pool gauges for Prometheus", nil, http.StatusOK},
+		{"GET", "/api/v1/monitoring/rules", roleReadOnly, s.handleGetMonitoringRules, "Prometheus alerting rules for the current tunnels", nil, http.StatusOK},
+		{"GET", "/api/v1/server", roleReadOnly, s.handleGetServer, "Server WireGuard settings and version", nil, http.StatusOK},
+		{"GET", "/api/v1/server/pubkey", roleReadOnly, s.handleGetServerPubkey, "Server WireGuard public key", nil, http.StatusOK},
+		{"GET", "/api/v1/openapi.json", roleReadOnly, s.handleOpenAPI, "OpenAPI document", nil, http.StatusOK},
 	}
+}
 
-	if cfg.TLSClientCA != "" {
-		caCert, err := os.ReadFile(cfg.TLSClientCA)
-		if err != nil {
-			return nil, fmt.Errorf("read CA cert: %w", err)
+// registerRoutes mounts every endpoint, wrapped with its role requirement.
+// Authenticated POSTs also honor Idempotency-Key.
+func (s *Server) registerRoutes() {
+	for _, e := range s.endpoints() {
+		h := e.handler
+		if e.method == http.MethodPost && e.role != 0 {
+			h = s.idempotent(h)
 		}
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(caCert) {
-			return nil, fmt.Errorf("failed to parse CA certificate")
+		if e.role != 0 {
+			h = s.require(e.role, h)
 		}
-		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-		tlsConfig.ClientCAs = caCertPool
+		s.mux.HandleFunc(e.method+" "+e.path, h)
 	}
+}
+
+// Handler returns the mux wrapped with middleware. The rate limiters are
+// started by the first call and shared by later ones; they run until that
+// call's ctx is canceled, and Close waits for them to save their state.
+func (s *Server) Handler(ctx context.Context) http.Handler {
+	auditLogger := NewAuditLogger(s.fwStore)
+	if s.cfg.AuditBodyLimit > 0 {
+		auditLogger.RecordBodies(s.cfg.AuditBodyLimit, s.auditSnapshot)
+	}
+	if s.auditSink != nil {
+		auditLogger.SetSink(s.auditSink)
+	}
+	s.limitOnce.Do(func() {
+		s.readLimit = NewRateLimiter(ctx, s.cfg.RateLimitRead, time.Minute)
+		s.mutateLimit = NewRateLimiter(ctx, s.cfg.RateLimitMutate, time.Minute)
+		for scope, rl := range map[string]*RateLimiter{"read": s.readLimit, "mutate": s.mutateLimit} {
+			rl.SetKeyFunc(s.rateLimitKey)
+			if err := rl.Persist(s.rateLimits, scope); err != nil {
+				slog.Warn("failed to load saved rate limits", "scope", scope, "error", err)
+			}
+		}
+	})
 
-	return tlsConfig, nil
+	var handler http.Handler = s.mux
+	handler = s.maintenanceGuard(handler)
+	handler = s.standbyGuard(handler)
+	handler = AuditMiddleware(auditLogger)(handler)
+	handler = BodyLimitMiddleware(s.cfg.MaxBodyBytes)(handler)
+	handler = ReadWriteRateLimit(s.readLimit, s.mutateLimit)(handler)
+	handler = LoggingMiddleware(handler)
+
+	return handler
+}
+
+// Close waits until the rate limiters have stopped and saved their buckets,
+// and until the queued DNS updates and webhooks have run. Cancel the context
+// of the first Handler call first.
+func (s *Server) Close() {
+	if s.readLimit != nil {
+		<-s.readLimit.Done()
+		<-s.mutateLimit.Done()
+	}
+	s.background.wait()
 }
 
 // writeJSON writes a JSON response with the given status code.
@@ -141,3 +306,29 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 func writeError(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, map[string]string{"error": msg})
 }
+
+// decodeJSON decodes the request body into v. Unknown fields, such as a
+// misspelled option, and anything after the JSON value are rejected rather
+// than ignored. On failure it writes a 400 (413 for a body over the size
+// limit) and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		if _, extra := dec.Token(); extra != io.EOF {
+			err = errors.New("unexpected data after the JSON body")
+		}
+	}
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+		return false
+	}
+	writeError(w, http.StatusBadRequest, "invalid JSON body: "+strings.TrimPrefix(err.Error(), "json: "))
+	return false
+}
@@ -2,65 +2,102 @@ package api
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/proxy-manager/controlplane/internal/admission"
 	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/reconciler"
 	"github.com/proxy-manager/controlplane/internal/store"
 	"github.com/proxy-manager/controlplane/internal/wireguard"
 )
 
 type createRouteRequest struct {
-	TunnelID     string   `json:"tunnel_id"`
-	MatchType    string   `json:"match_type"`    // "sni" or "port_forward"
-	MatchValue   []string `json:"match_value"`   // required for sni, ignored for port_forward
-	UpstreamPort int      `json:"upstream_port"`
-	Protocol     string   `json:"protocol"`      // "tcp" or "udp" (port_forward only, defaults to "tcp")
-	ListenPort   int      `json:"listen_port"`   // required for port_forward
+	Name          string   `json:"name,omitempty"` // unique per tenant; see PUT /api/v1/routes/by-name/{name}
+	TunnelID      string   `json:"tunnel_id"`
+	MatchType     string   `json:"match_type"`  // "sni" or "port_forward"
+	MatchValue    []string `json:"match_value"` // required for sni, ignored for port_forward
+	UpstreamPort  int      `json:"upstream_port"`
+	Protocol      string   `json:"protocol"`                  // "tcp" or "udp" (port_forward only, defaults to "tcp")
+	ListenPort    int      `json:"listen_port"`               // required for port_forward
+	ListenPortEnd int      `json:"listen_port_end,omitempty"` // last port of a range starting at listen_port (port_forward only)
+	ProxyProtocol string   `json:"proxy_protocol,omitempty"`  // "v1" or "v2" to send a PROXY header upstream (tcp only)
+	QUIC          bool     `json:"quic,omitempty"`            // also forward UDP/443 (QUIC/HTTP3) for the domains (sni only)
+	Priority      int      `json:"priority,omitempty"`        // higher matches first among sni routes
+	AllowOverlap  bool     `json:"allow_overlap,omitempty"`   // permit a wildcard to overlap another tunnel's names (sni only)
+	TerminateTLS  bool     `json:"terminate_tls,omitempty"`   // Caddy terminates TLS with an ACME certificate (sni only)
+	UpstreamIP    string   `json:"upstream_ip,omitempty"`     // a host in the tunnel's advertised routes; defaults to its VPN IP
+	TTLMinutes    int      `json:"ttl_minutes,omitempty"`     // delete the route this long after creation; 0 keeps it
+}
+
+// maxPortRange caps how many ports one port-forward route may cover; each
+// port is a dedicated Caddy server.
+const maxPortRange = 1000
+
+// maxRouteTTLMinutes caps the TTL of a temporary route at a week.
+const maxRouteTTLMinutes = 7 * 24 * 60
+
+type updateRouteRequest struct {
+	Priority *int `json:"priority,omitempty"`
 }
 
 func (s *Server) handleCreateRoute(w http.ResponseWriter, r *http.Request) {
 	var req createRouteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Validate tunnel exists
-	tunnel, err := s.tunnelStore.Get(req.TunnelID)
-	if err != nil {
+	tunnel, err := s.tunnels(r).Get(req.TunnelID)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
 		writeError(w, http.StatusBadRequest, "tunnel not found")
 		return
 	}
-
-	// Validate upstream is in the WireGuard subnet
-	if !strings.HasPrefix(tunnel.VpnIP, extractSubnetPrefix(s.cfg.WGServerIP)) {
-		writeError(w, http.StatusBadRequest, "upstream must be within the WireGuard subnet")
+	if err := s.validateRouteRequest(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Validate upstream port
-	if req.UpstreamPort < 1 || req.UpstreamPort > 65535 {
-		writeError(w, http.StatusBadRequest, "upstream_port must be between 1 and 65535")
+	if status, err := s.checkName("route", tunnel.TenantID, req.Name); err != nil {
+		writeError(w, status, err.Error())
 		return
 	}
-	if reservedPorts[req.UpstreamPort] {
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("port %d is reserved", req.UpstreamPort))
+
+	// Validate upstream is in the WireGuard subnet
+	if !s.inVPNSubnet(tunnel.VpnIP) {
+		writeError(w, http.StatusBadRequest, "upstream must be within the WireGuard subnet")
 		return
 	}
 
-	// Default protocol
-	if req.Protocol == "" {
-		req.Protocol = "tcp"
+	upstreamIP := tunnel.VpnIP
+	if req.UpstreamIP != "" {
+		if upstreamIP, err = upstreamInAdvertisedRoutes(tunnel, req.UpstreamIP); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 	}
-	if req.Protocol != "tcp" && req.Protocol != "udp" {
-		writeError(w, http.StatusBadRequest, "protocol must be 'tcp' or 'udp'")
+
+	// A port range forwards to as many consecutive upstream ports
+	upstreamEnd := 0
+	if req.MatchType == "port_forward" && req.ListenPortEnd > req.ListenPort {
+		upstreamEnd = req.UpstreamPort + req.ListenPortEnd - req.ListenPort
+	}
+	if len(tunnel.AllowedUpstreamPorts) > 0 && !portsAllowed(tunnel.AllowedUpstreamPorts, store.PortRange{Start: req.UpstreamPort, End: max(req.UpstreamPort, upstreamEnd)}) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("upstream port %s is outside the tunnel's allowed_upstream_ports", portSpan(req.UpstreamPort, upstreamEnd)))
 		return
 	}
 
+	var expiresAt *time.Time
+	if req.TTLMinutes > 0 {
+		t := time.Now().Add(time.Duration(req.TTLMinutes) * time.Minute)
+		expiresAt = &t
+	}
+
 	var (
 		routeID    string
 		caddyID    string
@@ -70,165 +107,568 @@ func (s *Server) handleCreateRoute(w http.ResponseWriter, r *http.Request) {
 
 	switch req.MatchType {
 	case "sni":
-		// Validate match values
-		if len(req.MatchValue) == 0 {
-			writeError(w, http.StatusBadRequest, "match_value must have at least one entry")
+		conflict, err := s.findSNIConflict(req.TunnelID, req.MatchValue, req.AllowOverlap)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to check SNI conflicts")
 			return
 		}
-		for _, v := range req.MatchValue {
-			if !sniRegex.MatchString(v) {
-				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid SNI value: %q", v))
-				return
-			}
+		if conflict != nil {
+			conflict.write(w, identityFrom(r.Context()))
+			return
 		}
 
 		listenPort = 443
-		upstream = fmt.Sprintf("%s:%d", tunnel.VpnIP, req.UpstreamPort)
+		upstream = fmt.Sprintf("%s:%d", upstreamIP, req.UpstreamPort)
 		routeID = wireguard.GenerateRandomID("route_")
-		caddyID = fmt.Sprintf("route-%s-%d", req.TunnelID, req.UpstreamPort)
+		caddyID = caddy.SNIRouteID(routeID)
+		if status, err := s.checkPolicy(tunnel.TenantID, policyClaim{Domains: req.MatchValue}); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		if status, err := s.checkSharedUpstream(r, &store.Route{TunnelID: req.TunnelID, Protocol: req.Protocol, Upstream: upstream, QUIC: req.QUIC}); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		if !s.admit(w, r, admission.OperationCreate, "route", routeID, tunnel.TenantID, req) {
+			return
+		}
+
+		if tunnel.NodeID != "" {
+			break
+		}
 
 		// Add to Caddy SNI server
-		caddyRoute := caddy.BuildCaddyRoute(caddyID, req.MatchValue, upstream)
+		caddyRoute := caddy.BuildCaddyRoute(caddyID, req.MatchValue, upstream, req.ProxyProtocol, req.TerminateTLS)
 		_ = s.caddyClient.CreateServer(r.Context())
 		if err := s.caddyClient.AddRoute(r.Context(), caddyRoute); err != nil {
 			fmt.Printf("warning: failed to add caddy route: %v\n", err)
 		}
 
-	case "port_forward":
-		// Validate listen port
-		if req.ListenPort < 1 || req.ListenPort > 65535 {
-			writeError(w, http.StatusBadRequest, "listen_port must be between 1 and 65535")
-			return
-		}
-		if reservedPorts[req.ListenPort] {
-			writeError(w, http.StatusBadRequest, fmt.Sprintf("port %d is reserved", req.ListenPort))
-			return
+		// Pair with a UDP/443 route so HTTP/3 clients reach the same upstream
+		if req.QUIC {
+			_ = s.caddyClient.CreateQUICServer(r.Context())
+			if err := s.caddyClient.AddQUICRoute(r.Context(), caddy.BuildQUICRoute(caddyID, req.MatchValue, upstream)); err != nil {
+				fmt.Printf("warning: failed to add caddy quic route: %v\n", err)
+			}
 		}
 
-		// Check for port conflict
-		existing, err := s.routeStore.FindByPortAndProtocol(req.ListenPort, req.Protocol)
+	case "port_forward":
+		// Check for port conflict anywhere in the range
+		lastPort := max(req.ListenPort, req.ListenPortEnd)
+		existing, err := s.routes(r).FindByPortRange(req.ListenPort, lastPort, req.Protocol)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, "failed to check port conflict")
 			return
 		}
 		if existing != nil {
-			writeError(w, http.StatusConflict, fmt.Sprintf("port %d/%s is already in use by route %s", req.ListenPort, req.Protocol, existing.ID))
+			writeError(w, http.StatusConflict, fmt.Sprintf("port %s/%s is already in use by route %s",
+				portSpan(existing.ListenPort, existing.ListenPortEnd), req.Protocol, existing.ID))
 			return
 		}
 
 		listenPort = req.ListenPort
-		upstream = caddy.FormatUpstream(tunnel.VpnIP, req.UpstreamPort, req.Protocol)
+		upstream = caddy.FormatUpstream(upstreamIP, req.UpstreamPort, req.Protocol)
 		routeID = wireguard.GenerateRandomID("route_")
-		caddyID = fmt.Sprintf("pf-%s", routeID)
+		caddyID = caddy.ManagedID("pf-" + routeID)
+		if status, err := s.checkPolicy(tunnel.TenantID, policyClaim{Ports: []store.PortRange{{Start: req.ListenPort, End: lastPort}}}); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		sharing := &store.Route{TunnelID: req.TunnelID, Protocol: req.Protocol, Upstream: upstream, ListenPort: req.ListenPort, ListenPortEnd: req.ListenPortEnd}
+		if status, err := s.checkSharedUpstream(r, sharing); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		if !s.admit(w, r, admission.OperationCreate, "route", routeID, tunnel.TenantID, req) {
+			return
+		}
 
-		// Create dedicated Caddy server
-		serverName := caddy.PortForwardServerName(req.ListenPort, req.Protocol)
-		listenAddr := caddy.FormatListenAddr(req.ListenPort, req.Protocol)
-		if err := s.caddyClient.CreatePortForwardServer(r.Context(), serverName, listenAddr, upstream, caddyID); err != nil {
-			fmt.Printf("warning: failed to create caddy port-forward server: %v\n", err)
+		if tunnel.NodeID != "" {
+			break
 		}
 
-	default:
-		writeError(w, http.StatusBadRequest, "match_type must be 'sni' or 'port_forward'")
-		return
+		// Create a dedicated Caddy server per listen port
+		for _, server := range caddy.PortForwardServers(caddyID, req.ListenPort, req.ListenPortEnd, req.Protocol, upstream, req.ProxyProtocol) {
+			if err := s.caddyClient.CreatePortForwardServer(r.Context(), server.Name, server.ListenAddr, server.Upstream, server.CaddyID, server.ProxyProtocol); err != nil {
+				fmt.Printf("warning: failed to create caddy port-forward server: %v\n", err)
+			}
+		}
 	}
 
 	// Persist to SQLite
 	route := &store.Route{
-		ID:         routeID,
-		TunnelID:   req.TunnelID,
-		ListenPort: listenPort,
-		Protocol:   req.Protocol,
-		MatchType:  req.MatchType,
-		MatchValue: req.MatchValue,
-		Upstream:   upstream,
-		CaddyID:    caddyID,
-		Enabled:    true,
+		ID:            routeID,
+		Name:          req.Name,
+		TunnelID:      req.TunnelID,
+		ListenPort:    listenPort,
+		Protocol:      req.Protocol,
+		MatchType:     req.MatchType,
+		MatchValue:    req.MatchValue,
+		Upstream:      upstream,
+		CaddyID:       caddyID,
+		Enabled:       true,
+		TenantID:      tunnel.TenantID,
+		ProxyProtocol: req.ProxyProtocol,
+		QUIC:          req.QUIC,
+		Priority:      req.Priority,
+		TerminateTLS:  req.TerminateTLS,
+		ListenPortEnd: req.ListenPortEnd,
+		NodeID:        tunnel.NodeID,
+		ExpiresAt:     expiresAt,
 	}
 	if route.MatchValue == nil {
 		route.MatchValue = []string{}
 	}
-	if err := s.routeStore.Create(route); err != nil {
+	if err := s.routes(r).Create(route); errors.Is(err, store.ErrNameInUse) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("name %q is already used by another route", req.Name))
+		return
+	} else if errors.Is(err, store.ErrDomainInUse) {
+		s.writeDomainTaken(w, r, req.TunnelID, route.MatchValue)
+		return
+	} else if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to persist route: %v", err))
 		return
 	}
 
+	// Caddy appended the SNI route; the reconciler moves it to its place in
+	// the priority order
+	if route.MatchType == "sni" && s.reconciler != nil {
+		s.reconciler.ForceReconcile()
+	}
+	if route.MatchType == "sni" {
+		s.publishDNS(route.MatchValue)
+	}
+
 	writeJSON(w, http.StatusCreated, map[string]interface{}{
 		"data": map[string]interface{}{
-			"id":          routeID,
-			"tunnel_id":   req.TunnelID,
-			"listen_port": listenPort,
-			"protocol":    req.Protocol,
-			"match_type":  req.MatchType,
-			"match_value": route.MatchValue,
-			"upstream":    upstream,
-			"caddy_id":    caddyID,
-			"enabled":     true,
-			"status":      "active",
-			"created_at":  route.CreatedAt.UTC().Format(time.RFC3339),
-			"updated_at":  route.UpdatedAt.UTC().Format(time.RFC3339),
+			"id":                    routeID,
+			"name":                  route.Name,
+			"tunnel_id":             req.TunnelID,
+			"listen_port":           listenPort,
+			"listen_port_end":       route.ListenPortEnd,
+			"protocol":              req.Protocol,
+			"match_type":            req.MatchType,
+			"match_value":           route.MatchValue,
+			"upstream":              upstream,
+			"caddy_id":              caddyID,
+			"enabled":               true,
+			"tenant_id":             route.TenantID,
+			"proxy_protocol":        route.ProxyProtocol,
+			"quic":                  route.QUIC,
+			"priority":              route.Priority,
+			"terminate_tls":         route.TerminateTLS,
+			"node_id":               route.NodeID,
+			"expires_at":            formatTimePtr(route.ExpiresAt),
+			"ttl_remaining_seconds": ttlRemainingSeconds(route),
+			"status":                "active",
+			"created_at":            route.CreatedAt.UTC().Format(time.RFC3339),
+			"updated_at":            route.UpdatedAt.UTC().Format(time.RFC3339),
 		},
 	})
 }
 
+// checkSharedUpstream returns an error if another route of route's tunnel
+// forwards to one of its upstream ports on the same protocol. Route traffic
+// is counted on the upstream, so two such routes could not be accounted
+// for apart; SNI routes to the same upstream are one route with several
+// domains.
+func (s *Server) checkSharedUpstream(r *http.Request, route *store.Route) (int, error) {
+	routes, err := s.routes(r).ListByTunnelID(route.TunnelID)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to list routes: %v", err)
+	}
+	counters := reconciler.RouteCounters(route)
+	for _, other := range routes {
+		for _, c := range reconciler.RouteCounters(other) {
+			if slices.ContainsFunc(counters, c.Overlaps) {
+				return http.StatusConflict, fmt.Errorf("route %s already forwards to upstream %s; add the domains to it instead of sharing its upstream",
+					other.ID, other.Upstream)
+			}
+		}
+	}
+	return 0, nil
+}
+
+// validateRouteRequest applies the defaults to a create request and checks
+// the fields that do not depend on the tunnel or on other routes, without
+// changing anything.
+func (s *Server) validateRouteRequest(req *createRouteRequest) error {
+	// Validate upstream port
+	if req.UpstreamPort < 1 || req.UpstreamPort > 65535 {
+		return errors.New("upstream_port must be between 1 and 65535")
+	}
+	if s.cfg.ReservedPorts[req.UpstreamPort] {
+		return fmt.Errorf("port %d is reserved", req.UpstreamPort)
+	}
+
+	// Default protocol
+	if req.Protocol == "" {
+		req.Protocol = "tcp"
+	}
+	if req.Protocol != "tcp" && req.Protocol != "udp" {
+		return errors.New("protocol must be 'tcp' or 'udp'")
+	}
+
+	switch req.ProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return errors.New("proxy_protocol must be 'v1' or 'v2'")
+	}
+	if req.ProxyProtocol != "" && req.Protocol != "tcp" {
+		return errors.New("proxy_protocol is only supported on tcp routes")
+	}
+	if req.TTLMinutes < 0 || req.TTLMinutes > maxRouteTTLMinutes {
+		return fmt.Errorf("ttl_minutes must be between 1 and %d", maxRouteTTLMinutes)
+	}
+
+	switch req.MatchType {
+	case "sni":
+		// Validate match values
+		if len(req.MatchValue) == 0 {
+			return errors.New("match_value must have at least one entry")
+		}
+		for _, v := range req.MatchValue {
+			if err := validateSNI(v); err != nil {
+				return err
+			}
+		}
+		if req.ListenPortEnd != 0 {
+			return errors.New("listen_port_end is only supported on port_forward routes")
+		}
+		if req.QUIC && slices.Contains(s.cfg.WGAltPorts, 443) {
+			return errors.New("quic is unavailable while UDP/443 is redirected to WireGuard (WG_ALT_PORTS)")
+		}
+		if req.TerminateTLS {
+			if req.QUIC {
+				return errors.New("quic cannot be combined with terminate_tls")
+			}
+			for _, v := range req.MatchValue {
+				if strings.HasPrefix(v, "*.") {
+					return errors.New("terminate_tls does not support wildcard domains")
+				}
+			}
+		}
+
+	case "port_forward":
+		if req.QUIC {
+			return errors.New("quic is only supported on sni routes")
+		}
+		if req.TerminateTLS {
+			return errors.New("terminate_tls is only supported on sni routes")
+		}
+		if req.Priority != 0 {
+			return errors.New("priority is only supported on sni routes")
+		}
+
+		// Validate listen port or range
+		if req.ListenPort < 1 || req.ListenPort > 65535 {
+			return errors.New("listen_port must be between 1 and 65535")
+		}
+		lastPort := req.ListenPort
+		if req.ListenPortEnd != 0 {
+			if req.ListenPortEnd <= req.ListenPort || req.ListenPortEnd > 65535 {
+				return errors.New("listen_port_end must be greater than listen_port and at most 65535")
+			}
+			if req.ListenPortEnd-req.ListenPort+1 > maxPortRange {
+				return fmt.Errorf("a port range may cover at most %d ports", maxPortRange)
+			}
+			if req.UpstreamPort+req.ListenPortEnd-req.ListenPort > 65535 {
+				return errors.New("upstream port range exceeds 65535")
+			}
+			lastPort = req.ListenPortEnd
+		}
+		for port := req.ListenPort; port <= lastPort; port++ {
+			if s.cfg.ReservedPorts[port] {
+				return fmt.Errorf("port %d is reserved", port)
+			}
+			if req.Protocol == "udp" && slices.Contains(s.cfg.WGAltPorts, port) {
+				return fmt.Errorf("port %d/udp is redirected to WireGuard (WG_ALT_PORTS)", port)
+			}
+			if up := req.UpstreamPort + port - req.ListenPort; s.cfg.ReservedPorts[up] {
+				return fmt.Errorf("port %d is reserved", up)
+			}
+		}
+
+	default:
+		return errors.New("match_type must be 'sni' or 'port_forward'")
+	}
+	return nil
+}
+
 func (s *Server) handleListRoutes(w http.ResponseWriter, r *http.Request) {
-	routes, err := s.routeStore.List()
+	routes, err := s.routes(r).List()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list routes: %v", err))
 		return
 	}
+	stats, err := s.routes(r).LatestStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load route stats: %v", err))
+		return
+	}
 
+	caller := identityFrom(r.Context())
+	named := nameFilter(r)
 	result := make([]map[string]interface{}, 0, len(routes))
 	for _, route := range routes {
-		entry := map[string]interface{}{
-			"id":          route.ID,
-			"tunnel_id":   route.TunnelID,
-			"listen_port": route.ListenPort,
-			"protocol":    route.Protocol,
-			"match_type":  route.MatchType,
-			"match_value": route.MatchValue,
-			"upstream":    route.Upstream,
-			"caddy_id":    route.CaddyID,
-			"enabled":     route.Enabled,
-			"created_at":  route.CreatedAt.UTC().Format(time.RFC3339),
-			"updated_at":  route.UpdatedAt.UTC().Format(time.RFC3339),
-		}
-		result = append(result, entry)
+		if !caller.canAccess(route.TenantID) || !named(route.Name) {
+			continue
+		}
+		resp := routeResponse(route)
+		resp["connections"] = connectionsResponse(stats, route.ID)
+		result = append(result, resp)
 	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
 }
 
-func (s *Server) handleDeleteRoute(w http.ResponseWriter, r *http.Request) {
+// handleListTunnelRoutes returns the routes of one tunnel.
+func (s *Server) handleListTunnelRoutes(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id is required")
+		return
+	}
+
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	routes, err := s.routes(r).ListByTunnelID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list routes: %v", err))
+		return
+	}
+	stats, err := s.routes(r).LatestStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load route stats: %v", err))
+		return
+	}
+
+	result := make([]map[string]interface{}, 0, len(routes))
+	for _, route := range routes {
+		resp := routeResponse(route)
+		resp["connections"] = connectionsResponse(stats, route.ID)
+		result = append(result, resp)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+// handleGetRoute returns one route with a summary of its tunnel and its
+// latest connection stats embedded. The tunnel is null if it is missing
+// (see routes.orphaned in the status).
+func (s *Server) handleGetRoute(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
 		writeError(w, http.StatusBadRequest, "route id is required")
 		return
 	}
 
-	route, err := s.routeStore.Get(id)
+	route, err := s.routes(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(route.TenantID) {
+		writeError(w, http.StatusNotFound, "route not found")
+		return
+	}
+
+	stats, err := s.routes(r).LatestStats()
 	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load route stats: %v", err))
+		return
+	}
+
+	resp := routeResponse(route)
+	resp["connections"] = connectionsResponse(stats, route.ID)
+	resp["tunnel"] = nil
+	if tunnel, err := s.tunnels(r).Get(route.TunnelID); err == nil {
+		resp["tunnel"] = map[string]interface{}{
+			"id":             tunnel.ID,
+			"vpn_ip":         tunnel.VpnIP,
+			"enabled":        tunnel.Enabled,
+			"connected":      tunnel.Connected(time.Now(), s.cfg.ConnectedWindow),
+			"last_handshake": formatTimePtr(tunnel.LastHandshake),
+			"labels":         tunnel.Labels,
+			"node_id":        tunnel.NodeID,
+		}
+	}
+
+	w.Header().Set("ETag", routeETag(route))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": resp})
+}
+
+// handleUpdateRoute changes a route's priority.
+func (s *Server) handleUpdateRoute(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "route id is required")
+		return
+	}
+
+	var req updateRouteRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	defer s.lockIfMatch(r)()
+	route, err := s.routes(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(route.TenantID) {
 		writeError(w, http.StatusNotFound, "route not found")
 		return
 	}
+	if !checkIfMatch(w, r, routeETag(route)) {
+		return
+	}
 
-	// Remove from Caddy
-	if route.MatchType == "port_forward" {
-		serverName := caddy.PortForwardServerName(route.ListenPort, route.Protocol)
-		if err := s.caddyClient.DeleteServer(context.Background(), serverName); err != nil {
-			fmt.Printf("warning: failed to delete caddy port-forward server: %v\n", err)
+	if req.Priority != nil && *req.Priority != route.Priority {
+		route, err = s.routes(r).UpdatePriority(id, *req.Priority)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update priority: %v", err))
+			return
 		}
-	} else {
-		if err := s.caddyClient.DeleteRoute(context.Background(), route.CaddyID); err != nil {
-			fmt.Printf("warning: failed to delete caddy route: %v\n", err)
+		// The reconciler reorders the Caddy route list
+		if s.reconciler != nil {
+			s.reconciler.ForceReconcile()
+		}
+	}
+
+	w.Header().Set("ETag", routeETag(route))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": routeResponse(route)})
+}
+
+func (s *Server) handleDeleteRoute(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "route id is required")
+		return
+	}
+
+	defer s.lockIfMatch(r)()
+	route, err := s.routes(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(route.TenantID) {
+		writeError(w, http.StatusNotFound, "route not found")
+		return
+	}
+	if !checkIfMatch(w, r, routeETag(route)) {
+		return
+	}
+	if !s.admit(w, r, admission.OperationDelete, "route", route.ID, route.TenantID, routeResponse(route)) {
+		return
+	}
+
+	// Remove from Caddy; a node's agent removes routes once they leave its state
+	if route.NodeID == "" {
+		if route.MatchType == "port_forward" {
+			for _, server := range portForwardServers(route) {
+				if err := s.caddyClient.DeleteServer(context.Background(), server.Name); err != nil {
+					fmt.Printf("warning: failed to delete caddy port-forward server: %v\n", err)
+				}
+			}
+		} else {
+			if err := s.caddyClient.DeleteRoute(context.Background(), route.CaddyID); err != nil {
+				fmt.Printf("warning: failed to delete caddy route: %v\n", err)
+			}
+			if route.QUIC {
+				if err := s.caddyClient.DeleteRoute(context.Background(), caddy.QUICRouteID(route.CaddyID)); err != nil {
+					fmt.Printf("warning: failed to delete caddy quic route: %v\n", err)
+				}
+			}
 		}
 	}
 
 	// Delete from DB
-	if err := s.routeStore.Delete(id); err != nil {
+	if err := s.routes(r).Delete(id); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete route: %v", err))
 		return
 	}
+	if route.MatchType == "sni" {
+		s.unpublishDNS(route.MatchValue)
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// portForwardServers returns the Caddy servers backing a port-forward route.
+func portForwardServers(route *store.Route) []caddy.PortForwardServer {
+	return caddy.PortForwardServers(route.CaddyID, route.ListenPort, route.ListenPortEnd, route.Protocol, route.Upstream, route.ProxyProtocol)
+}
+
+// portSpan formats a listen port or port range for messages.
+func portSpan(port, end int) string {
+	if end == 0 {
+		return fmt.Sprint(port)
+	}
+	return fmt.Sprintf("%d-%d", port, end)
+}
+
+// routeResponse is the JSON representation of a stored route.
+func routeResponse(route *store.Route) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                    route.ID,
+		"name":                  route.Name,
+		"tunnel_id":             route.TunnelID,
+		"listen_port":           route.ListenPort,
+		"listen_port_end":       route.ListenPortEnd,
+		"protocol":              route.Protocol,
+		"match_type":            route.MatchType,
+		"match_value":           route.MatchValue,
+		"upstream":              route.Upstream,
+		"caddy_id":              route.CaddyID,
+		"enabled":               route.Enabled,
+		"tenant_id":             route.TenantID,
+		"proxy_protocol":        route.ProxyProtocol,
+		"quic":                  route.QUIC,
+		"priority":              route.Priority,
+		"terminate_tls":         route.TerminateTLS,
+		"node_id":               route.NodeID,
+		"expires_at":            formatTimePtr(route.ExpiresAt),
+		"ttl_remaining_seconds": ttlRemainingSeconds(route),
+		"imported":              route.Imported,
+		"etag":                  routeETag(route),
+		"created_at":            route.CreatedAt.UTC().Format(time.RFC3339),
+		"updated_at":            route.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// ttlRemainingSeconds reports the whole seconds a route has left before
+// the reconciler deletes it, or nil if it does not expire.
+func ttlRemainingSeconds(route *store.Route) interface{} {
+	left, ok := route.TTLRemaining(time.Now())
+	if !ok {
+		return nil
+	}
+	return int(left / time.Second)
+}
+
+// connectionsResponse reports a route's latest traffic sample, or nil if it
+// has none: route stats are disabled, or the route is served by a remote
+// node.
+func connectionsResponse(stats map[string]store.RouteStatsSample, routeID string) interface{} {
+	sample, ok := stats[routeID]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"active":     sample.ActiveConns,
+		"rx_bytes":   sample.RxBytes,
+		"tx_bytes":   sample.TxBytes,
+		"sampled_at": sample.SampledAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// upstreamInAdvertisedRoutes checks that ip is the tunnel's VPN IP or a host
+// in one of its advertised routes, and returns it in canonical form.
+func upstreamInAdvertisedRoutes(tunnel *store.Tunnel, ip string) (string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return "", fmt.Errorf("upstream_ip must be an IPv4 address")
+	}
+	if addr.String() == tunnel.VpnIP {
+		return tunnel.VpnIP, nil
+	}
+	for _, r := range tunnel.AdvertisedRoutes {
+		if p, err := netip.ParsePrefix(r); err == nil && p.Contains(addr) {
+			return addr.String(), nil
+		}
+	}
+	return "", fmt.Errorf("upstream_ip must be the tunnel's VPN IP or in its advertised routes")
+}
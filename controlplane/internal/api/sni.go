@@ -0,0 +1,130 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+	"github.com/proxy-manager/controlplane/internal/wireguard"
+)
+
+// validateSNI checks a domain used for SNI matching. Caddy's tls matcher only
+// supports exact names and a wildcard for the whole leftmost label, so
+// anything else (regexes, partial wildcards) would never match.
+func validateSNI(d string) error {
+	if !sniRegex.MatchString(d) {
+		return fmt.Errorf("invalid domain: %q", d)
+	}
+	name := strings.TrimPrefix(d, "*.")
+	if strings.Contains(name, "*") {
+		return fmt.Errorf("invalid domain: %q: a wildcard must be the entire leftmost label", d)
+	}
+	labels := strings.Split(name, ".")
+	if strings.HasPrefix(d, "*.") && len(labels) < 2 {
+		return fmt.Errorf("invalid domain: %q: wildcard must cover a subdomain", d)
+	}
+	for _, l := range labels {
+		if l == "" || len(l) > 63 || strings.HasPrefix(l, "-") || strings.HasSuffix(l, "-") {
+			return fmt.Errorf("invalid domain: %q: bad label %q", d, l)
+		}
+	}
+	return nil
+}
+
+// sniOverlap reports whether a TLS ClientHello could match both a and b, and
+// whether that is because they are the same name. A wildcard covers exactly
+// one label, as in Caddy.
+func sniOverlap(a, b string) (overlap, exact bool) {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if a == b {
+		return true, true
+	}
+	return wildcardCovers(a, b) || wildcardCovers(b, a), false
+}
+
+// wildcardCovers reports whether wildcard pattern w matches name n.
+func wildcardCovers(w, n string) bool {
+	if !strings.HasPrefix(w, "*.") || strings.HasPrefix(n, "*.") {
+		return false
+	}
+	i := strings.Index(n, ".")
+	return i > 0 && n[i+1:] == w[2:]
+}
+
+// sniConflict describes an existing route whose SNI match overlaps a new one.
+type sniConflict struct {
+	route    *store.Route
+	existing string
+	domain   string
+}
+
+// findSNIConflict returns the first existing SNI route that would match the
+// same ClientHello as domains. Identical names always conflict; a wildcard
+// overlapping a specific name on another tunnel conflicts unless
+// allowOverlap is set, since route priority then decides which one wins.
+func (s *Server) findSNIConflict(tunnelID string, domains []string, allowOverlap bool) (*sniConflict, error) {
+	routes, err := s.routeStore.List()
+	if err != nil {
+		return nil, err
+	}
+	// The wstunnel fallback holds its host like a route
+	if s.cfg.WGFallbackTransport == wireguard.TransportWSTunnel {
+		routes = append(routes, &store.Route{ID: "wg-fallback", MatchType: "sni", MatchValue: []string{s.cfg.WGFallbackHost}, Enabled: true})
+	}
+	for _, route := range routes {
+		// Disabled routes, such as those of tunnels awaiting approval, do
+		// not hold their domains
+		if route.MatchType != "sni" || !route.Enabled {
+			continue
+		}
+		for _, existing := range route.MatchValue {
+			for _, d := range domains {
+				overlap, exact := sniOverlap(existing, d)
+				if !overlap {
+					continue
+				}
+				if !exact && (allowOverlap || route.TunnelID == tunnelID) {
+					continue
+				}
+				return &sniConflict{route: route, existing: existing, domain: d}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// message describes the conflict to caller, naming the route only if the
+// caller can see it.
+func (c *sniConflict) message(caller *identity) string {
+	if !caller.canAccess(c.route.TenantID) {
+		return fmt.Sprintf("domain %q overlaps %q on an existing route", c.domain, c.existing)
+	}
+	return fmt.Sprintf("domain %q overlaps %q on route %s", c.domain, c.existing, c.route.ID)
+}
+
+// write responds 409 with the conflict. Callers who can see the owning
+// route also get its ID and tunnel under "conflict".
+func (c *sniConflict) write(w http.ResponseWriter, caller *identity) {
+	body := map[string]interface{}{"error": c.message(caller)}
+	if caller.canAccess(c.route.TenantID) {
+		body["conflict"] = map[string]interface{}{
+			"route_id":  c.route.ID,
+			"tunnel_id": c.route.TunnelID,
+			"domain":    c.domain,
+			"existing":  c.existing,
+		}
+	}
+	writeJSON(w, http.StatusConflict, body)
+}
+
+// writeDomainTaken responds to store.ErrDomainInUse: another route claimed
+// one of domains between the conflict check and the insert.
+func (s *Server) writeDomainTaken(w http.ResponseWriter, r *http.Request, tunnelID string, domains []string) {
+	conflict, err := s.findSNIConflict(tunnelID, domains, true)
+	if err != nil || conflict == nil {
+		writeError(w, http.StatusConflict, store.ErrDomainInUse.Error())
+		return
+	}
+	conflict.write(w, identityFrom(r.Context()))
+}
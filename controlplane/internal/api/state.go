@@ -0,0 +1,879 @@
+package api
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// stateDocument is the body of PUT /api/v1/state: the complete desired set
+// of tunnels, routes, and firewall rules. A section that is left out is not
+// managed by the document; an empty list deletes every resource of its kind.
+type stateDocument struct {
+	Tunnels       *[]stateTunnel       `json:"tunnels,omitempty"`
+	Routes        *[]stateRoute        `json:"routes,omitempty"`
+	FirewallRules *[]stateFirewallRule `json:"firewall_rules,omitempty"`
+}
+
+// stateTunnel is a tunnel in a state document, identified by its public key.
+// Keys are generated client-side, so no private key is kept in the document.
+type stateTunnel struct {
+	PublicKey            string            `json:"public_key"`
+	Enabled              *bool             `json:"enabled,omitempty"` // default true
+	Labels               map[string]string `json:"labels,omitempty"`
+	SourceCIDR           string            `json:"source_cidr,omitempty"`
+	Isolate              bool              `json:"isolate,omitempty"`
+	PersistentKeepalive  *int              `json:"persistent_keepalive,omitempty"`
+	ConnectedThreshold   *int              `json:"connected_threshold,omitempty"`
+	ClientRouting        string            `json:"client_routing,omitempty"`
+	AdvertisedRoutes     []string          `json:"advertised_routes,omitempty"`
+	Description          string            `json:"description,omitempty"`
+	OwnerEmail           string            `json:"owner_email,omitempty"`
+	DeviceName           string            `json:"device_name,omitempty"`
+	ExpiresAt            string            `json:"expires_at,omitempty"`
+	AllowedUpstreamPorts []store.PortRange `json:"allowed_upstream_ports,omitempty"`
+
+	// Set when the tunnel is created; changing them later is a conflict.
+	TenantID string `json:"tenant_id,omitempty"`
+	NodeID   string `json:"node_id,omitempty"`
+	VpnIP    string `json:"vpn_ip,omitempty"`
+}
+
+// stateRoute is a route in a state document. Routes have no name, so a
+// route is identified by everything but its priority: changing any other
+// field replaces it.
+type stateRoute struct {
+	TunnelPublicKey string   `json:"tunnel_public_key"`
+	MatchType       string   `json:"match_type"`
+	MatchValue      []string `json:"match_value,omitempty"`
+	UpstreamPort    int      `json:"upstream_port"`
+	UpstreamIP      string   `json:"upstream_ip,omitempty"`
+	Protocol        string   `json:"protocol,omitempty"`
+	ListenPort      int      `json:"listen_port,omitempty"`
+	ListenPortEnd   int      `json:"listen_port_end,omitempty"`
+	ProxyProtocol   string   `json:"proxy_protocol,omitempty"`
+	QUIC            bool     `json:"quic,omitempty"`
+	TerminateTLS    bool     `json:"terminate_tls,omitempty"`
+	Priority        int      `json:"priority,omitempty"`
+	AllowOverlap    bool     `json:"allow_overlap,omitempty"`
+}
+
+// stateFirewallRule is a firewall rule in a state document, identified by
+// its port, protocol, chain, direction, and source and destination CIDRs.
+type stateFirewallRule struct {
+	Port       int    `json:"port"`
+	Proto      string `json:"proto"`
+	Chain      string `json:"chain,omitempty"`
+	Direction  string `json:"direction,omitempty"`
+	SourceCIDR string `json:"source_cidr,omitempty"`
+	DestCIDR   string `json:"dest_cidr,omitempty"`
+	Action     string `json:"action,omitempty"`
+	Enabled    *bool  `json:"enabled,omitempty"` // default true
+	TenantID   string `json:"tenant_id,omitempty"`
+
+	ActiveHours string `json:"active_hours,omitempty"`
+	Description string `json:"description,omitempty"`
+	Group       string `json:"group,omitempty"`
+}
+
+// stateChange is one step of applying a state document, carried out as a
+// request to the matching endpoint.
+type stateChange struct {
+	Action string          `json:"action"` // "create", "update", or "delete"
+	Kind   string          `json:"kind"`   // "tunnel", "route", or "firewall_rule"
+	ID     string          `json:"id,omitempty"`
+	Key    string          `json:"key"`              // what identifies the resource in the document
+	Result json.RawMessage `json:"result,omitempty"` // the response to an applied create
+
+	method string
+	path   string
+	body   interface{}
+	// tunnelKey names the tunnel a route create belongs to; its ID is looked
+	// up when the change is applied, after the tunnel may have been created.
+	tunnelKey string
+	// disable is set on the create of a tunnel or rule that starts disabled.
+	disable bool
+	// needs holds the deletes that must run before this change: routes it
+	// would collide with, or that its upstream restriction would exclude.
+	needs []*stateChange
+}
+
+// handlePutState diffs a state document against the store and applies the
+// creates, updates, and deletes that make the store match it. With
+// ?dry_run=true only the change set is returned.
+func (s *Server) handlePutState(w http.ResponseWriter, r *http.Request) {
+	var doc stateDocument
+	if !decodeJSON(w, r, &doc) {
+		return
+	}
+
+	changes, status, err := s.planState(r, &doc)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	for _, c := range changes {
+		if status, err := s.validateStateChange(r, c); err != nil {
+			writeError(w, status, fmt.Sprintf("%s %s %s: %v", c.Action, c.Kind, c.Key, err))
+			return
+		}
+	}
+	if r.URL.Query().Get("dry_run") == "true" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{"dry_run": true, "changes": changes},
+		})
+		return
+	}
+
+	// Changes are applied one at a time and not rolled back: on failure the
+	// ones already made are reported, and re-applying the document resumes
+	for i, c := range changes {
+		if status, msg := s.applyStateChange(r, c); status >= 300 {
+			writeJSON(w, status, map[string]interface{}{
+				"error":   fmt.Sprintf("%s %s %s: %s", c.Action, c.Kind, c.Key, msg),
+				"applied": changes[:i],
+			})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{"dry_run": false, "changes": changes},
+	})
+}
+
+// planState computes the changes that make the caller's resources match doc,
+// in the order they must be applied: tunnels before the routes on them, and
+// deletes last, so a failure leaves everything the document keeps in place.
+// Only the deletes a create or update depends on run before it.
+func (s *Server) planState(r *http.Request, doc *stateDocument) ([]*stateChange, int, error) {
+	caller := identityFrom(r.Context())
+
+	allTunnels, err := s.tunnels(r).List()
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to list tunnels: %v", err)
+	}
+	tunnels := make(map[string]*store.Tunnel) // by public key
+	tunnelsByID := make(map[string]*store.Tunnel)
+	for _, t := range allTunnels {
+		if caller.canAccess(t.TenantID) {
+			tunnels[t.PublicKey] = t
+			tunnelsByID[t.ID] = t
+		}
+	}
+
+	var (
+		tunnelDeletes, tunnelWrites []*stateChange
+		routeDeletes, routeWrites   []*stateChange
+		ruleDeletes, ruleWrites     []*stateChange
+	)
+
+	// Tunnels
+	declared := make(map[string]bool) // public keys of tunnels the document keeps
+	upstreamPorts := make(map[string][]store.PortRange)
+	for key, t := range tunnels {
+		upstreamPorts[key] = t.AllowedUpstreamPorts
+	}
+	if doc.Tunnels != nil {
+		for _, t := range *doc.Tunnels {
+			if t.PublicKey == "" {
+				return nil, http.StatusBadRequest, fmt.Errorf("every tunnel needs a public_key")
+			}
+			if declared[t.PublicKey] {
+				return nil, http.StatusBadRequest, fmt.Errorf("tunnel %s is declared twice", t.PublicKey)
+			}
+			declared[t.PublicKey] = true
+			// An invalid list is rejected with the tunnel's change
+			upstreamPorts[t.PublicKey], _ = validateUpstreamPorts(t.AllowedUpstreamPorts)
+
+			current, ok := tunnels[t.PublicKey]
+			if !ok {
+				tunnelWrites = append(tunnelWrites, &stateChange{
+					Action: "create", Kind: "tunnel", Key: t.PublicKey,
+					method: http.MethodPost, path: "/api/v1/tunnels",
+					body: createTunnelRequest{
+						PublicKey:            t.PublicKey,
+						Labels:               t.Labels,
+						TenantID:             t.TenantID,
+						SourceCIDR:           t.SourceCIDR,
+						Isolate:              t.Isolate,
+						NodeID:               t.NodeID,
+						PersistentKeepalive:  t.PersistentKeepalive,
+						ConnectedThreshold:   t.ConnectedThreshold,
+						ClientRouting:        t.ClientRouting,
+						VpnIP:                t.VpnIP,
+						AdvertisedRoutes:     t.AdvertisedRoutes,
+						Description:          t.Description,
+						OwnerEmail:           t.OwnerEmail,
+						DeviceName:           t.DeviceName,
+						ExpiresAt:            t.ExpiresAt,
+						AllowedUpstreamPorts: t.AllowedUpstreamPorts,
+					},
+					disable: t.Enabled != nil && !*t.Enabled,
+				})
+				continue
+			}
+
+			if field := fixedTunnelFieldChanged(current, t); field != "" {
+				return nil, http.StatusConflict, fmt.Errorf("tunnel %s: %s cannot be changed in place; remove the tunnel from the document, apply, and add it back", t.PublicKey, field)
+			}
+			if update, changed := tunnelUpdate(current, t); changed {
+				tunnelWrites = append(tunnelWrites, &stateChange{
+					Action: "update", Kind: "tunnel", ID: current.ID, Key: t.PublicKey,
+					method: http.MethodPatch, path: "/api/v1/tunnels/" + current.ID, body: update,
+				})
+			}
+		}
+		for _, t := range allTunnels {
+			if caller.canAccess(t.TenantID) && !declared[t.PublicKey] {
+				tunnelDeletes = append(tunnelDeletes, &stateChange{
+					Action: "delete", Kind: "tunnel", ID: t.ID, Key: t.PublicKey,
+					method: http.MethodDelete, path: "/api/v1/tunnels/" + t.ID + "?force=true",
+				})
+			}
+		}
+	}
+	// kept reports whether a tunnel survives the document
+	kept := func(t *store.Tunnel) bool { return doc.Tunnels == nil || declared[t.PublicKey] }
+
+	// Routes
+	if doc.Routes != nil {
+		routes, err := s.routes(r).List()
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to list routes: %v", err)
+		}
+		deleted := make(map[*stateChange]*store.Route)
+		// Routes of tunnels that are deleted go with them
+		existing := make(map[string][]*store.Route)
+		for _, route := range routes {
+			if t, ok := tunnelsByID[route.TunnelID]; ok && kept(t) {
+				key := existingRouteKey(route)
+				existing[key] = append(existing[key], route)
+			}
+		}
+
+		for _, desired := range *doc.Routes {
+			t, exists := tunnels[desired.TunnelPublicKey]
+			if !declared[desired.TunnelPublicKey] && (!exists || !kept(t)) {
+				return nil, http.StatusBadRequest, fmt.Errorf("route on %s: tunnel not found", desired.TunnelPublicKey)
+			}
+			// A port range forwards to as many consecutive upstream ports
+			upstream := store.PortRange{Start: desired.UpstreamPort, End: desired.UpstreamPort}
+			if desired.MatchType == "port_forward" && desired.ListenPortEnd > desired.ListenPort {
+				upstream.End += desired.ListenPortEnd - desired.ListenPort
+			}
+			if ports := upstreamPorts[desired.TunnelPublicKey]; len(ports) > 0 && !portsAllowed(ports, upstream) {
+				return nil, http.StatusForbidden, fmt.Errorf("route on %s: upstream port %s is outside the tunnel's allowed_upstream_ports",
+					desired.TunnelPublicKey, portSpan(upstream.Start, endOrZero(upstream)))
+			}
+			create := &stateChange{
+				Action: "create", Kind: "route", Key: desiredRouteLabel(desired),
+				method: http.MethodPost, path: "/api/v1/routes",
+				body:      desired,
+				tunnelKey: desired.TunnelPublicKey,
+			}
+			if !exists {
+				routeWrites = append(routeWrites, create)
+				continue
+			}
+			key := desiredRouteKey(t, desired)
+			matches := existing[key]
+			if len(matches) == 0 {
+				routeWrites = append(routeWrites, create)
+				continue
+			}
+			current := matches[0]
+			existing[key] = matches[1:]
+			if current.Priority != desired.Priority {
+				priority := desired.Priority
+				routeWrites = append(routeWrites, &stateChange{
+					Action: "update", Kind: "route", ID: current.ID, Key: create.Key,
+					method: http.MethodPatch, path: "/api/v1/routes/" + current.ID,
+					body: updateRouteRequest{Priority: &priority},
+				})
+			}
+		}
+		for _, route := range routes {
+			if t, ok := tunnelsByID[route.TunnelID]; ok && kept(t) && slices.Contains(existing[existingRouteKey(route)], route) {
+				c := &stateChange{
+					Action: "delete", Kind: "route", ID: route.ID, Key: existingRouteLabel(t, route),
+					method: http.MethodDelete, path: "/api/v1/routes/" + route.ID,
+				}
+				routeDeletes = append(routeDeletes, c)
+				deleted[c] = route
+			}
+		}
+
+		// A route replaced by one on the same ports or domains goes just
+		// before its replacement, and a tunnel's routes before an upstream
+		// restriction that could exclude them
+		for _, c := range routeWrites {
+			if desired, ok := c.body.(stateRoute); ok {
+				for _, d := range routeDeletes {
+					if routesCollide(desired, deleted[d]) {
+						c.needs = append(c.needs, d)
+					}
+				}
+			}
+		}
+		for _, c := range tunnelWrites {
+			if update, ok := c.body.(updateTunnelRequest); ok && update.AllowedUpstreamPorts != nil {
+				for _, d := range routeDeletes {
+					if deleted[d].TunnelID == c.ID {
+						c.needs = append(c.needs, d)
+					}
+				}
+			}
+		}
+	}
+
+	// Firewall rules
+	if doc.FirewallRules != nil {
+		rules, err := s.firewall(r).List()
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to list firewall rules: %v", err)
+		}
+		existing := make(map[string][]*store.FirewallRule)
+		for _, rule := range rules {
+			if caller.canAccess(rule.TenantID) {
+				key := stateRuleKey(rule.Port, rule.Proto, rule.Chain, rule.Direction, rule.SourceCIDR, rule.DestCIDR, rule.TenantID)
+				existing[key] = append(existing[key], rule)
+			}
+		}
+
+		for _, desired := range *doc.FirewallRules {
+			desired = withRuleDefaults(desired)
+			// Rules without a tenant go to the caller's
+			key := stateRuleKey(desired.Port, desired.Proto, desired.Chain, desired.Direction, desired.SourceCIDR,
+				desired.DestCIDR, cmp.Or(desired.TenantID, caller.TenantID))
+			matches := existing[key]
+			if len(matches) == 0 {
+				ruleWrites = append(ruleWrites, &stateChange{
+					Action: "create", Kind: "firewall_rule", Key: key,
+					method: http.MethodPost, path: "/api/v1/firewall/rules",
+					body: createFirewallRuleRequest{
+						Port: desired.Port, Proto: desired.Proto, Chain: desired.Chain, Direction: desired.Direction,
+						SourceCIDR: desired.SourceCIDR, DestCIDR: desired.DestCIDR, Action: desired.Action,
+						TenantID: desired.TenantID, ActiveHours: desired.ActiveHours, Description: desired.Description,
+						Group: desired.Group,
+					},
+					disable: !*desired.Enabled,
+				})
+				continue
+			}
+			current := matches[0]
+			existing[key] = matches[1:]
+			var update updateFirewallRuleRequest
+			if current.Action != desired.Action {
+				update.Action = &desired.Action
+			}
+			if current.Enabled != *desired.Enabled {
+				update.Enabled = desired.Enabled
+			}
+			if current.ActiveHours != desired.ActiveHours {
+				update.ActiveHours = &desired.ActiveHours
+			}
+			if current.Description != desired.Description {
+				update.Description = &desired.Description
+			}
+			if current.Group != desired.Group {
+				update.Group = &desired.Group
+			}
+			if update != (updateFirewallRuleRequest{}) {
+				ruleWrites = append(ruleWrites, &stateChange{
+					Action: "update", Kind: "firewall_rule", ID: current.ID, Key: key,
+					method: http.MethodPatch, path: "/api/v1/firewall/rules/" + current.ID, body: update,
+				})
+			}
+		}
+		for _, rule := range rules {
+			key := stateRuleKey(rule.Port, rule.Proto, rule.Chain, rule.Direction, rule.SourceCIDR, rule.DestCIDR, rule.TenantID)
+			if caller.canAccess(rule.TenantID) && slices.Contains(existing[key], rule) {
+				ruleDeletes = append(ruleDeletes, &stateChange{
+					Action: "delete", Kind: "firewall_rule", ID: rule.ID, Key: key,
+					method: http.MethodDelete, path: "/api/v1/firewall/rules/" + rule.ID,
+				})
+			}
+		}
+	}
+
+	changes := []*stateChange{}
+	ordered := make(map[*stateChange]bool)
+	for _, c := range slices.Concat(tunnelWrites, routeWrites, ruleWrites) {
+		for _, d := range c.needs {
+			if !ordered[d] {
+				ordered[d] = true
+				changes = append(changes, d)
+			}
+		}
+		changes = append(changes, c)
+	}
+	for _, d := range slices.Concat(routeDeletes, ruleDeletes, tunnelDeletes) {
+		if !ordered[d] {
+			changes = append(changes, d)
+		}
+	}
+	return changes, 0, nil
+}
+
+// validateStateChange checks a change the way its endpoint would, as far
+// as that does not depend on the changes applied before it, so an invalid
+// document is rejected before anything is applied. It returns the status
+// to reject the document with.
+func (s *Server) validateStateChange(r *http.Request, c *stateChange) (int, error) {
+	switch body := c.body.(type) {
+	case createTunnelRequest:
+		if decoded, err := base64.StdEncoding.DecodeString(body.PublicKey); err != nil || len(decoded) != 32 {
+			return http.StatusBadRequest, errors.New("public_key must be valid base64 encoding of 32 bytes")
+		}
+		if err := cmp.Or(validateLabels(body.Labels), validateConnectionSettings(body.PersistentKeepalive, body.ConnectedThreshold),
+			validateClientRouting("client_routing", body.ClientRouting),
+			validateNotes(body.Description, body.OwnerEmail, body.DeviceName)); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if _, err := normalizeSourceCIDR(body.SourceCIDR); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if _, err := parseExpiresAt(body.ExpiresAt); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if _, err := validateUpstreamPorts(body.AllowedUpstreamPorts); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if _, status, err := s.validateAdvertisedRoutes(r, "", body.AdvertisedRoutes); err != nil {
+			return status, err
+		}
+		if _, status, err := s.tenantForCreate(r, body.TenantID); err != nil {
+			return status, err
+		}
+		if body.VpnIP != "" {
+			if _, status, err := s.validateStaticVPNIP(body.VpnIP); err != nil {
+				return status, err
+			}
+		}
+
+	case updateTunnelRequest:
+		if body.Labels != nil {
+			if err := validateLabels(*body.Labels); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+		if body.SourceCIDR != nil {
+			if _, err := normalizeSourceCIDR(*body.SourceCIDR); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+		if err := validateConnectionSettings(body.PersistentKeepalive, body.ConnectedThreshold); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if body.ClientRouting != nil {
+			if err := validateClientRouting("client_routing", *body.ClientRouting); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+		if err := validateNotes(deref(body.Description), deref(body.OwnerEmail), deref(body.DeviceName)); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if body.ExpiresAt != nil {
+			if _, err := parseExpiresAt(*body.ExpiresAt); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+		if body.AllowedUpstreamPorts != nil {
+			if _, err := validateUpstreamPorts(*body.AllowedUpstreamPorts); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+		if body.AdvertisedRoutes != nil {
+			if _, status, err := s.validateAdvertisedRoutes(r, c.ID, *body.AdvertisedRoutes); err != nil {
+				return status, err
+			}
+		}
+
+	case stateRoute:
+		req := routeRequest(body, "")
+		if err := s.validateRouteRequest(&req); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+	case createFirewallRuleRequest:
+		if _, status, err := s.prepareFirewallRule(r, &body); err != nil {
+			return status, err
+		}
+
+	case updateFirewallRuleRequest:
+		if body.Action != nil && *body.Action != "allow" && *body.Action != "deny" {
+			return http.StatusBadRequest, errors.New("action must be 'allow' or 'deny'")
+		}
+		if body.ActiveHours != nil {
+			if _, _, err := store.ParseActiveHours(*body.ActiveHours); err != nil {
+				return http.StatusBadRequest, fmt.Errorf("invalid active_hours: %v", err)
+			}
+		}
+		if err := validateRuleNotes(deref(body.Description), deref(body.Group)); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	return 0, nil
+}
+
+// applyStateChange makes one change by sending it to its endpoint with the
+// caller's credentials, so it is validated and authorized exactly like the
+// equivalent API call. It returns the response status and, on failure, the
+// error message.
+func (s *Server) applyStateChange(r *http.Request, c *stateChange) (int, string) {
+	if c.tunnelKey != "" {
+		t, err := s.tunnels(r).GetByPublicKey(c.tunnelKey)
+		if err != nil {
+			return http.StatusBadRequest, "tunnel not found"
+		}
+		c.body = routeRequest(c.body.(stateRoute), t.ID)
+	}
+
+	status, body := s.subRequest(r, c.method, c.path, c.body)
+	if status >= 300 {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &resp)
+		return status, resp.Error
+	}
+	if c.Action != "create" {
+		return status, ""
+	}
+
+	// Creates report the new resource, which for a tunnel includes its PSK
+	c.Result = body
+	var created struct {
+		ID   string `json:"id"`
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	json.Unmarshal(body, &created)
+	c.ID = cmp.Or(created.ID, created.Data.ID)
+	if !c.disable {
+		return status, ""
+	}
+
+	disabled := false
+	path := "/api/v1/tunnels/" + c.ID
+	var update interface{} = updateTunnelRequest{Enabled: &disabled}
+	if c.Kind == "firewall_rule" {
+		path = "/api/v1/firewall/rules/" + c.ID
+		update = updateFirewallRuleRequest{Enabled: &disabled}
+	}
+	if status, body := s.subRequest(r, http.MethodPatch, path, update); status >= 300 {
+		return status, "created, but failed to disable: " + string(bytes.TrimSpace(body))
+	}
+	return status, ""
+}
+
+// subRequest serves a request with r's credentials through the router and
+// returns the response status and body.
+func (s *Server) subRequest(r *http.Request, method, path string, body interface{}) (int, []byte) {
+	sub := r.Clone(r.Context())
+	sub.Method = method
+	sub.URL, _ = url.Parse(path)
+	sub.RequestURI = ""
+	sub.Header.Del("Idempotency-Key")
+	sub.Header.Del("If-Match")
+	sub.Body = http.NoBody
+	sub.ContentLength = 0
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
+		}
+		sub.Body = io.NopCloser(bytes.NewReader(b))
+		sub.ContentLength = int64(len(b))
+		sub.Header.Set("Content-Type", "application/json")
+	}
+
+	resp := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	s.mux.ServeHTTP(resp, sub)
+	return resp.status, resp.body.Bytes()
+}
+
+// bufferedResponse keeps the response of a sub-request.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header         { return w.header }
+func (w *bufferedResponse) WriteHeader(status int)      { w.status = status }
+func (w *bufferedResponse) Write(b []byte) (int, error) { return w.body.Write(b) }
+
+// routeRequest is the create request of a route of a state document, on
+// the tunnel with ID tunnelID.
+func routeRequest(route stateRoute, tunnelID string) createRouteRequest {
+	return createRouteRequest{
+		TunnelID:      tunnelID,
+		MatchType:     route.MatchType,
+		MatchValue:    route.MatchValue,
+		UpstreamPort:  route.UpstreamPort,
+		Protocol:      route.Protocol,
+		ListenPort:    route.ListenPort,
+		ListenPortEnd: route.ListenPortEnd,
+		ProxyProtocol: route.ProxyProtocol,
+		QUIC:          route.QUIC,
+		Priority:      route.Priority,
+		AllowOverlap:  route.AllowOverlap,
+		TerminateTLS:  route.TerminateTLS,
+		UpstreamIP:    route.UpstreamIP,
+	}
+}
+
+// routesCollide reports whether desired cannot be created while current
+// exists: port forwards of the same protocol on overlapping ports, or SNI
+// routes sharing a domain.
+func routesCollide(desired stateRoute, current *store.Route) bool {
+	if desired.MatchType != current.MatchType {
+		return false
+	}
+	if desired.MatchType == "port_forward" {
+		return cmp.Or(desired.Protocol, "tcp") == current.Protocol &&
+			desired.ListenPort <= max(current.ListenPort, current.ListenPortEnd) &&
+			current.ListenPort <= max(desired.ListenPort, desired.ListenPortEnd)
+	}
+	for _, v := range desired.MatchValue {
+		if slices.Contains(current.MatchValue, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// fixedTunnelFieldChanged returns the name of a field of desired that
+// differs from current and can only be set when the tunnel is created, or "".
+func fixedTunnelFieldChanged(current *store.Tunnel, desired stateTunnel) string {
+	switch {
+	case desired.TenantID != "" && desired.TenantID != current.TenantID:
+		return "tenant_id"
+	case desired.NodeID != current.NodeID:
+		return "node_id"
+	case desired.VpnIP != "" && desired.VpnIP != current.VpnIP:
+		return "vpn_ip"
+	}
+	return ""
+}
+
+// tunnelUpdate returns the PATCH that brings current in line with desired,
+// and whether anything differs.
+func tunnelUpdate(current *store.Tunnel, desired stateTunnel) (updateTunnelRequest, bool) {
+	var update updateTunnelRequest
+	changed := false
+
+	desiredExpiry, err := time.Parse(time.RFC3339, desired.ExpiresAt)
+	expiryChanged := (desired.ExpiresAt == "") != (current.ExpiresAt == nil) ||
+		desired.ExpiresAt != "" && (err != nil || !desiredExpiry.Equal(*current.ExpiresAt))
+	if expiryChanged {
+		// An invalid or past time is rejected by the PATCH
+		update.ExpiresAt = &desired.ExpiresAt
+		changed = true
+	}
+
+	// A tunnel past its expiry date or awaiting approval stays disabled
+	enabled := (desired.Enabled == nil || *desired.Enabled) && (expiryChanged || !current.Expired(time.Now())) &&
+		!current.PendingApproval
+	if current.Enabled != enabled {
+		update.Enabled = &enabled
+		changed = true
+	}
+	if !maps.Equal(current.Labels, desired.Labels) {
+		labels := desired.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		update.Labels = &labels
+		changed = true
+	}
+	if cidr, err := normalizeSourceCIDR(desired.SourceCIDR); err != nil || cidr != current.SourceCIDR {
+		// An invalid CIDR is rejected by the PATCH
+		update.SourceCIDR = &desired.SourceCIDR
+		changed = true
+	}
+	if current.Isolate != desired.Isolate {
+		update.Isolate = &desired.Isolate
+		changed = true
+	}
+	if !equalIntPtr(current.PersistentKeepalive, desired.PersistentKeepalive) && desired.PersistentKeepalive != nil {
+		update.PersistentKeepalive = desired.PersistentKeepalive
+		changed = true
+	}
+	if !equalIntPtr(current.ConnectedThreshold, desired.ConnectedThreshold) && desired.ConnectedThreshold != nil {
+		update.ConnectedThreshold = desired.ConnectedThreshold
+		changed = true
+	}
+	if cmp.Or(current.ClientRouting, "split") != cmp.Or(desired.ClientRouting, "split") {
+		routing := cmp.Or(desired.ClientRouting, "split")
+		update.ClientRouting = &routing
+		changed = true
+	}
+	if !samePrefixes(current.AdvertisedRoutes, desired.AdvertisedRoutes) {
+		routes := desired.AdvertisedRoutes
+		if routes == nil {
+			routes = []string{}
+		}
+		update.AdvertisedRoutes = &routes
+		changed = true
+	}
+	if !samePortRanges(current.AllowedUpstreamPorts, desired.AllowedUpstreamPorts) {
+		ports := desired.AllowedUpstreamPorts
+		if ports == nil {
+			ports = []store.PortRange{}
+		}
+		update.AllowedUpstreamPorts = &ports
+		changed = true
+	}
+	if current.Description != desired.Description {
+		update.Description = &desired.Description
+		changed = true
+	}
+	if current.OwnerEmail != desired.OwnerEmail {
+		update.OwnerEmail = &desired.OwnerEmail
+		changed = true
+	}
+	if current.DeviceName != desired.DeviceName {
+		update.DeviceName = &desired.DeviceName
+		changed = true
+	}
+	return update, changed
+}
+
+// existingRouteKey identifies a stored route the way desiredRouteKey
+// identifies a route in a state document.
+func existingRouteKey(route *store.Route) string {
+	values := slices.Sorted(slices.Values(route.MatchValue))
+	return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%s|%s|%t|%t", route.TunnelID, route.MatchType, strings.Join(values, ","),
+		route.Protocol, route.ListenPort, route.ListenPortEnd, route.Upstream, route.ProxyProtocol, route.QUIC, route.TerminateTLS)
+}
+
+// desiredRouteKey identifies route, to be created on tunnel, by the fields
+// POST /api/v1/routes would store for it.
+func desiredRouteKey(tunnel *store.Tunnel, route stateRoute) string {
+	upstreamIP := tunnel.VpnIP
+	if addr, err := netip.ParseAddr(route.UpstreamIP); err == nil {
+		upstreamIP = addr.String()
+	}
+	protocol := cmp.Or(route.Protocol, "tcp")
+	listenPort, upstream := 443, fmt.Sprintf("%s:%d", upstreamIP, route.UpstreamPort)
+	if route.MatchType == "port_forward" {
+		listenPort = route.ListenPort
+		upstream = caddy.FormatUpstream(upstreamIP, route.UpstreamPort, protocol)
+	}
+	return existingRouteKey(&store.Route{
+		TunnelID: tunnel.ID, MatchType: route.MatchType, MatchValue: route.MatchValue,
+		Protocol: protocol, ListenPort: listenPort, ListenPortEnd: route.ListenPortEnd, Upstream: upstream,
+		ProxyProtocol: route.ProxyProtocol, QUIC: route.QUIC, TerminateTLS: route.TerminateTLS,
+	})
+}
+
+// desiredRouteLabel names a route of a state document in the change set.
+func desiredRouteLabel(route stateRoute) string {
+	if route.MatchType == "port_forward" {
+		return fmt.Sprintf("%s %s/%s", route.TunnelPublicKey, portSpan(route.ListenPort, route.ListenPortEnd), cmp.Or(route.Protocol, "tcp"))
+	}
+	return fmt.Sprintf("%s %s", route.TunnelPublicKey, strings.Join(route.MatchValue, ","))
+}
+
+// existingRouteLabel names a stored route of tunnel in the change set.
+func existingRouteLabel(tunnel *store.Tunnel, route *store.Route) string {
+	if route.MatchType == "port_forward" {
+		return fmt.Sprintf("%s %s/%s", tunnel.PublicKey, portSpan(route.ListenPort, route.ListenPortEnd), route.Protocol)
+	}
+	return fmt.Sprintf("%s %s", tunnel.PublicKey, strings.Join(route.MatchValue, ","))
+}
+
+// withRuleDefaults fills in the defaults POST /api/v1/firewall/rules
+// applies, so a rule can be compared with the stored ones.
+func withRuleDefaults(rule stateFirewallRule) stateFirewallRule {
+	rule.Chain = cmp.Or(rule.Chain, firewall.ChainInput)
+	if rule.Chain == firewall.ChainOutput {
+		rule.Direction = cmp.Or(rule.Direction, "out")
+	}
+	rule.Direction = cmp.Or(rule.Direction, "in")
+	rule.Action = cmp.Or(rule.Action, "allow")
+	if p, err := netip.ParsePrefix(rule.DestCIDR); err == nil {
+		rule.DestCIDR = ""
+		if p.Bits() > 0 {
+			rule.DestCIDR = p.Masked().String()
+		}
+		if rule.SourceCIDR == "" && p.Addr().Is6() {
+			rule.SourceCIDR = "::/0"
+		}
+	}
+	rule.SourceCIDR = cmp.Or(rule.SourceCIDR, "0.0.0.0/0")
+	if p, err := netip.ParsePrefix(rule.SourceCIDR); err == nil {
+		rule.SourceCIDR = p.Masked().String()
+	}
+	if rule.Enabled == nil {
+		enabled := true
+		rule.Enabled = &enabled
+	}
+	return rule
+}
+
+// stateRuleKey identifies a firewall rule in a state document. Rules of
+// different tenants are different rules, even on the same port.
+func stateRuleKey(port int, proto, chain, direction, sourceCIDR, destCIDR, tenantID string) string {
+	key := fmt.Sprintf("%s %d/%s %s from %s", chain, port, proto, direction, sourceCIDR)
+	if destCIDR != "" {
+		key += " to " + destCIDR
+	}
+	if tenantID != "" {
+		key += " for tenant " + tenantID
+	}
+	return key
+}
+
+// samePrefixes reports whether two lists of CIDRs hold the same prefixes,
+// in any order.
+func samePrefixes(a, b []string) bool {
+	normalize := func(list []string) []string {
+		out := make([]string, 0, len(list))
+		for _, c := range list {
+			if p, err := netip.ParsePrefix(c); err == nil {
+				c = p.Masked().String()
+			}
+			out = append(out, c)
+		}
+		slices.Sort(out)
+		return out
+	}
+	return slices.Equal(normalize(a), normalize(b))
+}
+
+// samePortRanges reports whether two lists of port ranges hold the same
+// ranges, in any order. A range without an end is a single port.
+func samePortRanges(a, b []store.PortRange) bool {
+	normalize := func(list []store.PortRange) []store.PortRange {
+		out := make([]store.PortRange, 0, len(list))
+		for _, r := range list {
+			out = append(out, store.PortRange{Start: r.Start, End: max(r.Start, r.End)})
+		}
+		slices.SortFunc(out, func(x, y store.PortRange) int { return cmp.Or(x.Start-y.Start, x.End-y.End) })
+		return out
+	}
+	return slices.Equal(normalize(a), normalize(b))
+}
+
+func equalIntPtr(a, b *int) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultStatsWindow     = 24 * time.Hour
+	defaultStatsResolution = time.Hour
+	minStatsResolution     = time.Minute
+	maxStatsBuckets        = 2000
+)
+
+// parseStatsRange reads the from, to, and resolution query parameters of a
+// stats request. It writes the error response and returns false if they are
+// invalid.
+func parseStatsRange(w http.ResponseWriter, r *http.Request) (from, to time.Time, resolution time.Duration, ok bool) {
+	q := r.URL.Query()
+	to = time.Now()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "to must be an RFC 3339 timestamp")
+			return from, to, 0, false
+		}
+		to = t
+	}
+	from = to.Add(-defaultStatsWindow)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "from must be an RFC 3339 timestamp")
+			return from, to, 0, false
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return from, to, 0, false
+	}
+
+	resolution = defaultStatsResolution
+	if v := q.Get("resolution"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minStatsResolution {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("resolution must be a duration of at least %s", minStatsResolution))
+			return from, to, 0, false
+		}
+		resolution = d
+	}
+	if to.Sub(from)/resolution > maxStatsBuckets {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("range too large for resolution: at most %d buckets", maxStatsBuckets))
+		return from, to, 0, false
+	}
+	return from, to, resolution, true
+}
+
+func (s *Server) handleGetTunnelStats(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id is required")
+		return
+	}
+	from, to, resolution, ok := parseStatsRange(w, r)
+	if !ok {
+		return
+	}
+
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+
+	buckets, err := s.tunnels(r).StatsHistory(id, from, to, resolution)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load stats: %v", err))
+		return
+	}
+
+	seconds := resolution.Seconds()
+	result := make([]map[string]interface{}, 0, len(buckets))
+	for _, b := range buckets {
+		result = append(result, map[string]interface{}{
+			"start":    b.Start.UTC().Format(time.RFC3339),
+			"rx_bytes": b.RxBytes,
+			"tx_bytes": b.TxBytes,
+			"rx_bps":   float64(b.RxBytes*8) / seconds,
+			"tx_bps":   float64(b.TxBytes*8) / seconds,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"tunnel_id":          id,
+			"from":               from.UTC().Format(time.RFC3339),
+			"to":                 to.UTC().Format(time.RFC3339),
+			"resolution_seconds": int64(seconds),
+			"buckets":            result,
+		},
+	})
+}
+
+// handleGetRouteStats returns the traffic and peak connection count of a
+// route's upstream connections, summed into buckets like the tunnel stats.
+func (s *Server) handleGetRouteStats(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "route id is required")
+		return
+	}
+	from, to, resolution, ok := parseStatsRange(w, r)
+	if !ok {
+		return
+	}
+
+	route, err := s.routes(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(route.TenantID) {
+		writeError(w, http.StatusNotFound, "route not found")
+		return
+	}
+
+	buckets, err := s.routes(r).StatsHistory(id, from, to, resolution)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load stats: %v", err))
+		return
+	}
+
+	seconds := resolution.Seconds()
+	result := make([]map[string]interface{}, 0, len(buckets))
+	for _, b := range buckets {
+		result = append(result, map[string]interface{}{
+			"start":      b.Start.UTC().Format(time.RFC3339),
+			"rx_bytes":   b.RxBytes,
+			"tx_bytes":   b.TxBytes,
+			"rx_bps":     float64(b.RxBytes*8) / seconds,
+			"tx_bps":     float64(b.TxBytes*8) / seconds,
+			"max_active": b.MaxActiveConns,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"route_id":           id,
+			"from":               from.UTC().Format(time.RFC3339),
+			"to":                 to.UTC().Format(time.RFC3339),
+			"resolution_seconds": int64(seconds),
+			"buckets":            result,
+		},
+	})
+}
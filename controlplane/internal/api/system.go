@@ -1,9 +1,20 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"time"
+
+	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/reconciler"
+	"github.com/proxy-manager/controlplane/internal/store"
 )
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -12,72 +23,195 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// readyCheckTimeout bounds each dependency check of the readiness probe.
+const readyCheckTimeout = 2 * time.Second
+
+// readyCheck is one dependency check of the readiness probe.
+type readyCheck struct {
+	name string
+	run  func() error
+}
+
+// handleReady checks every dependency the control plane needs to apply
+// changes and returns 503 if any of them fails. The endpoint is
+// unauthenticated, so it only says which checks failed; the errors, which
+// name paths and addresses, go to the log.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+
+	checks := []readyCheck{
+		{"sqlite", s.firewall(r).CheckWritable},
+		{"caddy", func() error {
+			_, err := s.caddyClient.GetL4Config(ctx)
+			return err
+		}},
+		{"wireguard", func() error {
+			_, err := s.wgManager.ListPeers()
+			return err
+		}},
+		{"nftables", func() error {
+			_, err := s.fwManager.ListRules()
+			return err
+		}},
+	}
+	if s.elector != nil {
+		// A standby is alive but must not receive traffic
+		checks = append(checks, readyCheck{"leader", func() error {
+			if s.elector.IsLeader() {
+				return nil
+			}
+			current, _ := s.elector.Leader()
+			return fmt.Errorf("standby; leader is %q", current)
+		}})
+	}
+
+	ready := true
+	results := make(map[string]interface{}, len(checks))
+	for _, c := range checks {
+		err := c.run()
+		if err != nil {
+			ready = false
+			slog.Warn("readiness check failed", "check", c.name, "error", err)
+		}
+		results[c.name] = map[string]interface{}{"ok": err == nil}
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"status": status,
+		"checks": results,
+	})
+}
+
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	// Tunnels
-	tunnels, err := s.tunnelStore.List()
+	tunnels, err := s.tunnels(r).List()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list tunnels: %v", err))
 		return
 	}
 
+	caller := identityFrom(r.Context())
+	tunnels = filterOwned(tunnels, caller, func(t *store.Tunnel) string { return t.TenantID })
+
+	var live *liveState
+	if r.URL.Query().Get("live") == "true" {
+		live = s.readLiveState(r)
+	}
+
+	probes, err := s.tunnels(r).ProbeSummaries()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load latency probes: %v", err))
+		return
+	}
+
 	connectedCount := 0
+	expiringCount := 0
+	expiredCount := 0
+	pendingCount := 0
 	peers := make([]map[string]interface{}, 0, len(tunnels))
 	for _, t := range tunnels {
-		connected := false
-		if t.LastHandshake != nil && time.Since(*t.LastHandshake) < 5*time.Minute {
-			connected = true
+		connected := t.Connected(time.Now(), s.cfg.ConnectedWindow)
+		if connected {
 			connectedCount++
 		}
-		peers = append(peers, map[string]interface{}{
+		expiring := s.expiringSoon(t)
+		if expiring {
+			expiringCount++
+		}
+		expired := t.Expired(time.Now())
+		if expired {
+			expiredCount++
+		}
+		if t.PendingApproval {
+			pendingCount++
+		}
+		peer := map[string]interface{}{
 			"id":             t.ID,
 			"vpn_ip":         t.VpnIP,
 			"last_handshake": formatTimePtr(t.LastHandshake),
 			"tx_bytes":       t.TxBytes,
 			"rx_bytes":       t.RxBytes,
 			"connected":      connected,
-		})
+			"expiring_soon":  expiring,
+			"expires_at":     formatTimePtr(t.ExpiresAt),
+			"expired":        expired,
+			"latency":        probeResponse(probes, t.ID),
+		}
+		if live != nil {
+			peer["in_sync"] = live.tunnelInSync(t)
+		}
+		peers = append(peers, peer)
 	}
 
 	// Routes
-	routes, err := s.routeStore.List()
+	routes, err := s.routes(r).List()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list routes: %v", err))
 		return
 	}
 
+	routes = filterOwned(routes, caller, func(r *store.Route) string { return r.TenantID })
+
 	routeList := make([]map[string]interface{}, 0, len(routes))
 	for _, route := range routes {
-		routeList = append(routeList, map[string]interface{}{
+		entry := map[string]interface{}{
 			"id":          route.ID,
 			"tunnel_id":   route.TunnelID,
 			"match_type":  route.MatchType,
 			"match_value": route.MatchValue,
 			"upstream":    route.Upstream,
 			"enabled":     route.Enabled,
-		})
+		}
+		if live != nil {
+			entry["in_sync"] = live.routeInSync(route)
+		}
+		routeList = append(routeList, entry)
+	}
+
+	// Routes left behind by a missing tunnel
+	orphans, err := s.routes(r).ListOrphaned()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list orphaned routes: %v", err))
+		return
+	}
+	orphanIDs := []string{}
+	for _, route := range filterOwned(orphans, caller, func(r *store.Route) string { return r.TenantID }) {
+		orphanIDs = append(orphanIDs, route.ID)
 	}
 
 	// Firewall
-	fwRules, err := s.fwStore.List()
+	fwRules, err := s.firewall(r).List()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list firewall rules: %v", err))
 		return
 	}
 
+	fwRules = filterOwned(fwRules, caller, func(r *store.FirewallRule) string { return r.TenantID })
+
 	fwList := make([]map[string]interface{}, 0, len(fwRules))
 	for _, rule := range fwRules {
-		fwList = append(fwList, map[string]interface{}{
+		entry := map[string]interface{}{
 			"id":          rule.ID,
 			"port":        rule.Port,
 			"proto":       rule.Proto,
 			"source_cidr": rule.SourceCIDR,
+			"dest_cidr":   rule.DestCIDR,
 			"action":      rule.Action,
 			"enabled":     rule.Enabled,
-		})
+		}
+		if live != nil {
+			entry["in_sync"] = live.ruleInSync(rule)
+		}
+		fwList = append(fwList, entry)
 	}
 
 	// Reconciliation state
-	reconcState, err := s.fwStore.GetReconciliationState()
+	reconcState, err := s.firewall(r).GetReconciliationState()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get reconciliation state: %v", err))
 		return
@@ -88,28 +222,256 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		lastError = reconcState.LastError
 	}
 
-	writeJSON(w, http.StatusOK, map[string]interface{}{
+	// Operation counts of the last pass, left null if the history cannot be
+	// read rather than failing the whole status
+	var lastOps interface{}
+	if runs, err := s.runStore.List(1); err != nil {
+		fmt.Printf("warning: failed to get reconcile history: %v\n", err)
+	} else if len(runs) > 0 {
+		lastOps = runs[0].Ops
+	}
+
+	var maintenance interface{}
+	if m, err := s.maintenance(r); err != nil {
+		fmt.Printf("warning: failed to get maintenance mode: %v\n", err)
+	} else {
+		maintenance = maintenanceResponse(m)
+	}
+
+	// Caddy availability, as seen by the admin client
+	var caddyStatus interface{}
+	if hr, ok := s.caddyClient.(caddy.HealthReporter); ok {
+		h := hr.Health()
+		var caddyErr interface{}
+		if h.LastError != "" {
+			caddyErr = h.LastError
+		}
+		caddyStatus = map[string]interface{}{
+			"available":            h.Available,
+			"breaker_state":        h.BreakerState,
+			"consecutive_failures": h.ConsecutiveFailures,
+			"last_error":           caddyErr,
+			"last_success_at":      formatTimePtr(h.LastSuccessAt),
+			"last_failure_at":      formatTimePtr(h.LastFailureAt),
+		}
+	}
+
+	status := map[string]interface{}{
 		"tunnels": map[string]interface{}{
-			"total":     len(tunnels),
-			"connected": connectedCount,
-			"peers":     peers,
+			"total":            len(tunnels),
+			"connected":        connectedCount,
+			"expiring_soon":    expiringCount,
+			"expired":          expiredCount,
+			"pending_approval": pendingCount,
+			"peers":            peers,
 		},
 		"routes": map[string]interface{}{
-			"total":  len(routes),
-			"routes": routeList,
+			"total":    len(routes),
+			"routes":   routeList,
+			"orphaned": orphanIDs,
 		},
 		"firewall": map[string]interface{}{
 			"dynamic_rules": len(fwRules),
 			"rules":         fwList,
 		},
+		"caddy":       caddyStatus,
+		"maintenance": maintenance,
 		"reconciliation": map[string]interface{}{
 			"interval_seconds":       reconcState.IntervalSeconds,
 			"last_run_at":            formatTimePtr(reconcState.LastRunAt),
 			"last_status":            reconcState.LastStatus,
 			"last_error":             lastError,
 			"drift_corrections_total": reconcState.DriftCorrections,
+			"last_operations":         lastOps,
+			"mode":                    s.reconcileMode(),
+			"subsystems":              s.subsystemStatus(),
 		},
-	})
+	}
+	if s.elector != nil {
+		status["leader"] = s.leaderStatus()
+	}
+	if s.keeper != nil && caller.TenantID == "" {
+		status["database"] = s.databaseStatus()
+	}
+	if live != nil {
+		status["live"] = map[string]interface{}{
+			"errors": live.errors,
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// probeResponse returns the latency and loss of a tunnel's latest probes, or
+// nil when it has not been probed.
+func probeResponse(probes map[string]store.ProbeSummary, tunnelID string) interface{} {
+	p, ok := probes[tunnelID]
+	if !ok {
+		return nil
+	}
+	var avg, last interface{}
+	if p.Lost < p.Samples {
+		avg = float64(p.AvgRTT.Microseconds()) / 1000
+	}
+	if p.LastRTT > 0 {
+		last = float64(p.LastRTT.Microseconds()) / 1000
+	}
+	return map[string]interface{}{
+		"rtt_avg_ms":  avg,
+		"rtt_last_ms": last,
+		"loss":        p.Loss(),
+		"samples":     p.Samples,
+		"probed_at":   p.ProbedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// reconcileMode returns whether the reconciler corrects drift ("enforce") or
+// only reports it ("observe"), or nil without a reconciler.
+func (s *Server) reconcileMode() interface{} {
+	if s.reconciler == nil {
+		return nil
+	}
+	return s.reconciler.Mode()
+}
+
+// subsystemStatus reports the consecutive failures and backoff of each
+// subsystem the reconciler manages, or nil without a reconciler.
+func (s *Server) subsystemStatus() map[string]interface{} {
+	if s.reconciler == nil {
+		return nil
+	}
+	states := s.reconciler.Subsystems()
+	unmanaged := s.reconciler.Unmanaged()
+	drift := s.reconciler.Drift()
+	out := map[string]interface{}{}
+	for _, system := range slices.Sorted(maps.Keys(states)) {
+		st := states[system]
+		var lastErr interface{}
+		if st.LastError != "" {
+			lastErr = st.LastError
+		}
+		found := unmanaged[system]
+		if found == nil {
+			found = []reconciler.UnmanagedResource{}
+		}
+		observed := drift[system]
+		if observed == nil {
+			observed = []reconciler.ObservedDrift{}
+		}
+		out[system] = map[string]interface{}{
+			"consecutive_failures": st.ConsecutiveFailures,
+			"last_error":           lastErr,
+			"retry_at":             formatTimePtr(st.RetryAt),
+			"unmanaged_policy":     s.reconciler.UnmanagedPolicy(system),
+			"unmanaged":            found,
+			"drift":                observed,
+		}
+	}
+	return out
+}
+
+// liveState is what WireGuard, Caddy, and nftables are actually running,
+// read for GET /api/v1/status?live=true. A subsystem that could not be read
+// has a nil view and its resources report in_sync as null.
+type liveState struct {
+	peers   map[string]bool // public keys configured on the interface
+	servers map[string]*caddy.L4Server
+	rules   map[firewallKey]bool
+	errors  map[string]string
+}
+
+// firewallKey identifies a firewall rule by content, as the reconciler does.
+type firewallKey struct {
+	port       int
+	proto      string
+	chain      string
+	direction  string
+	sourceCIDR string
+	destCIDR   string
+	action     string
+}
+
+func ruleKey(port int, proto, chain, direction, sourceCIDR, destCIDR, action string) firewallKey {
+	if chain == "" {
+		chain = firewall.ChainInput
+	}
+	return firewallKey{port, proto, chain, direction, sourceCIDR, destCIDR, action}
+}
+
+func (s *Server) readLiveState(r *http.Request) *liveState {
+	live := &liveState{errors: map[string]string{}}
+
+	if peers, err := s.wgManager.ListPeers(); err != nil {
+		live.errors["wireguard"] = err.Error()
+	} else {
+		live.peers = make(map[string]bool, len(peers))
+		for _, p := range peers {
+			live.peers[p.PublicKey] = true
+		}
+	}
+
+	if cfg, err := s.caddyClient.GetL4Config(r.Context()); err != nil {
+		live.errors["caddy"] = err.Error()
+	} else {
+		live.servers = cfg.Servers
+		if live.servers == nil {
+			live.servers = map[string]*caddy.L4Server{}
+		}
+	}
+
+	if rules, err := s.fwManager.ListRules(); err != nil {
+		live.errors["firewall"] = err.Error()
+	} else {
+		live.rules = make(map[firewallKey]bool, len(rules))
+		for _, rule := range rules {
+			live.rules[ruleKey(rule.Port, rule.Proto, rule.Chain, rule.Direction, rule.SourceCIDR, rule.DestCIDR, rule.Action)] = true
+		}
+	}
+	return live
+}
+
+// tunnelInSync reports whether the tunnel's peer is on the interface exactly
+// when the tunnel is enabled.
+func (l *liveState) tunnelInSync(t *store.Tunnel) interface{} {
+	if l.peers == nil {
+		return nil
+	}
+	return l.peers[t.PublicKey] == t.Enabled
+}
+
+// routeInSync reports whether Caddy serves the route exactly when it is
+// enabled: the SNI route in the proxy server, or every port-forward server.
+func (l *liveState) routeInSync(route *store.Route) interface{} {
+	if l.servers == nil {
+		return nil
+	}
+	if route.MatchType == "port_forward" {
+		for _, pf := range caddy.PortForwardServers(route.CaddyID, route.ListenPort, route.ListenPortEnd, route.Protocol, route.Upstream, route.ProxyProtocol) {
+			if _, ok := l.servers[pf.Name]; ok != route.Enabled {
+				return false
+			}
+		}
+		return true
+	}
+	present := false
+	if proxy, ok := l.servers["proxy"]; ok && proxy != nil {
+		for _, cr := range proxy.Routes {
+			if cr.ID == route.CaddyID {
+				present = true
+				break
+			}
+		}
+	}
+	return present == route.Enabled
+}
+
+// ruleInSync reports whether nftables holds the rule exactly when it is
+// enabled and within its active hours.
+func (l *liveState) ruleInSync(rule *store.FirewallRule) interface{} {
+	if l.rules == nil {
+		return nil
+	}
+	active := rule.Enabled && rule.InActiveHours(time.Now())
+	return l.rules[ruleKey(rule.Port, rule.Proto, rule.Chain, rule.Direction, rule.SourceCIDR, rule.DestCIDR, rule.Action)] == active
 }
 
 func (s *Server) handleForceReconcile(w http.ResponseWriter, r *http.Request) {
@@ -122,6 +484,125 @@ func (s *Server) handleForceReconcile(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleReconcileHistory returns the last passes of the reconciler, newest
+// first, with the operations each attempted, and how many succeeded and
+// failed. ?limit= caps the number of passes (default 100).
+func (s *Server) handleReconcileHistory(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	runs, err := s.runStore.List(limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load reconcile history: %v", err))
+		return
+	}
+
+	result := make([]map[string]interface{}, 0, len(runs))
+	for _, run := range runs {
+		var runErr interface{}
+		if run.Error != "" {
+			runErr = run.Error
+		}
+		result = append(result, map[string]interface{}{
+			"started_at":  run.StartedAt.UTC().Format(time.RFC3339),
+			"duration_ms": run.Duration.Milliseconds(),
+			"status":      run.Status,
+			"error":       runErr,
+			"attempted":   run.Ops.Attempted,
+			"succeeded":   run.Ops.Succeeded,
+			"failed":      run.Ops.Failed,
+			"observed":    run.Ops.Observed,
+			"subsystems":  run.Subsystems,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+// handleStartupReport returns what the first reconciliation pass after the
+// control plane last started found and repaired, and whether the process
+// before it shut down cleanly.
+func (s *Server) handleStartupReport(w http.ResponseWriter, r *http.Request) {
+	report, err := s.firewall(r).GetStartupReport()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load startup report: %v", err))
+		return
+	}
+	if report == nil {
+		writeError(w, http.StatusNotFound, "no reconciliation pass has run yet")
+		return
+	}
+
+	var reportErr, clean interface{}
+	if report.Error != "" {
+		reportErr = report.Error
+	}
+	if report.PreviousStatus != "pending" {
+		clean = report.PreviousStatus == "shutdown"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+		"started_at":      report.StartedAt.UTC().Format(time.RFC3339),
+		"duration_ms":     report.Duration.Milliseconds(),
+		"mode":            report.Mode,
+		"previous_status": report.PreviousStatus,
+		"previous_run_at": formatTimePtr(report.PreviousRunAt),
+		"clean_shutdown":  clean,
+		"status":          report.Status,
+		"error":           reportErr,
+		"attempted":       report.Ops.Attempted,
+		"succeeded":       report.Ops.Succeeded,
+		"failed":          report.Ops.Failed,
+		"observed":        report.Ops.Observed,
+		"subsystems":      report.Subsystems,
+	}})
+}
+
+// SetVersion sets the build version reported by GET /api/v1/server.
+func (s *Server) SetVersion(version string) {
+	s.version = version
+}
+
+// handleGetServer returns what a client needs to configure its side of a
+// tunnel, read from the live interface where the config could be stale.
+func (s *Server) handleGetServer(w http.ResponseWriter, r *http.Request) {
+	dev, err := s.wgManager.GetDevice()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to get server interface: %v", err))
+		return
+	}
+
+	var mtu interface{}
+	if dev.MTU > 0 {
+		mtu = dev.MTU
+	}
+	// Clients on networks that block UDP download their config with
+	// ?transport=tcp to use the fallback
+	var fallback interface{}
+	if f, ok := s.wgFallback(); ok {
+		fallback = map[string]interface{}{
+			"transport": f.Transport,
+			"endpoint":  net.JoinHostPort(f.Host, strconv.Itoa(f.Port)),
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+		"public_key":  dev.PublicKey,
+		"listen_port": dev.ListenPort,
+		"endpoint":    s.cfg.ServerEndpoint,
+		"wg_subnet":   s.cfg.WGSubnet,
+		"server_ip":   s.cfg.WGServerIP,
+		"mtu":         mtu,
+		"version":     s.version,
+		"fallback":    fallback,
+		"alt_ports":   append([]int{}, s.cfg.WGAltPorts...),
+	}})
+}
+
 func (s *Server) handleGetServerPubkey(w http.ResponseWriter, r *http.Request) {
 	pubkey, err := s.wgManager.GetServerPublicKey()
 	if err != nil {
@@ -133,3 +614,17 @@ func (s *Server) handleGetServerPubkey(w http.ResponseWriter, r *http.Request) {
 		"public_key": pubkey,
 	})
 }
+
+// filterOwned returns the items the caller is allowed to see.
+func filterOwned[T any](items []T, caller *identity, tenantOf func(T) string) []T {
+	if caller.TenantID == "" {
+		return items
+	}
+	out := make([]T, 0, len(items))
+	for _, item := range items {
+		if caller.canAccess(tenantOf(item)) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+	"github.com/proxy-manager/controlplane/internal/wireguard"
+)
+
+// tenantNameRegex validates tenant names.
+var tenantNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_\-]{0,62}$`)
+
+type createTenantRequest struct {
+	Name       string `json:"name"`
+	ClientCN   string `json:"client_cn,omitempty"`
+	IssueToken bool   `json:"issue_token,omitempty"`
+	TokenScope string `json:"token_scope,omitempty"` // "operator" (default) or "read-only"
+}
+
+func (s *Server) handleCreateTenant(w http.ResponseWriter, r *http.Request) {
+	var req createTenantRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if !tenantNameRegex.MatchString(req.Name) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid tenant name: %q", req.Name))
+		return
+	}
+	if req.ClientCN == "" && !req.IssueToken {
+		writeError(w, http.StatusBadRequest, "client_cn or issue_token is required")
+		return
+	}
+
+	if req.TokenScope == "" {
+		req.TokenScope = "operator"
+	}
+	if req.TokenScope != "operator" && req.TokenScope != "read-only" {
+		writeError(w, http.StatusBadRequest, "token_scope must be 'operator' or 'read-only'")
+		return
+	}
+
+	tenant := &store.Tenant{
+		ID:         wireguard.GenerateRandomID("tnt_"),
+		Name:       req.Name,
+		ClientCN:   req.ClientCN,
+		TokenScope: req.TokenScope,
+	}
+
+	var token string
+	if req.IssueToken {
+		var err error
+		token, err = generateAPIToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to generate API token")
+			return
+		}
+		tenant.TokenHash = hashToken(token)
+	}
+
+	if err := s.tenantStore.Create(tenant); err != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("failed to create tenant: %v", err))
+		return
+	}
+
+	data := tenantToMap(tenant)
+	if token != "" {
+		data["api_token"] = token
+		data["warning"] = "Save this API token now. It will not be shown again."
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"data": data})
+}
+
+func (s *Server) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := s.tenantStore.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list tenants: %v", err))
+		return
+	}
+
+	result := make([]map[string]interface{}, 0, len(tenants))
+	for _, t := range tenants {
+		result = append(result, tenantToMap(t))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+func (s *Server) handleDeleteTenant(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.tenantStore.Get(id); err != nil {
+		writeError(w, http.StatusNotFound, "tenant not found")
+		return
+	}
+
+	n, err := s.tenantStore.CountResources(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n > 0 {
+		writeError(w, http.StatusConflict, fmt.Sprintf("tenant still owns %d resources", n))
+		return
+	}
+
+	if err := s.tenantStore.Delete(id); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete tenant: %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tenantToMap(t *store.Tenant) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          t.ID,
+		"name":        t.Name,
+		"client_cn":   t.ClientCN,
+		"has_token":   t.TokenHash != "",
+		"token_scope": t.TokenScope,
+		"created_at":  t.CreatedAt.UTC().Format(time.RFC3339),
+		"updated_at":  t.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/config"
+)
+
+// CertReloader serves the API's TLS certificate and client CA bundle from
+// disk and picks up renewed files without a restart. Handshakes always see a
+// complete key pair: a reload that fails (e.g. the cert was replaced but the
+// key not yet) keeps the previous one and is retried on the next check.
+type CertReloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time // newest modification time of the files last loaded
+
+	revocationCheck func(*x509.Certificate) error
+}
+
+// NewCertReloader loads the TLS files named in cfg. It returns nil if TLS is
+// not configured.
+func NewCertReloader(cfg *config.Config) (*CertReloader, error) {
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, nil // No TLS configured (for testing)
+	}
+	r := &CertReloader{certFile: cfg.TLSCert, keyFile: cfg.TLSKey, caFile: cfg.TLSClientCA}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns an mTLS configuration, TLS 1.3 only, that always uses
+// the most recently loaded certificate and client CAs.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS13,
+		GetCertificate: r.getCertificate,
+	}
+	if r.caFile != "" {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := tlsConfig.Clone()
+			r.mu.RLock()
+			c.ClientCAs = r.pool
+			r.mu.RUnlock()
+			return c, nil
+		}
+		tlsConfig.VerifyConnection = r.verifyConnection
+	}
+	return tlsConfig
+}
+
+// SetRevocationCheck makes handshakes fail for verified client certificates
+// that check rejects, such as revoked ones.
+func (r *CertReloader) SetRevocationCheck(check func(*x509.Certificate) error) {
+	r.mu.Lock()
+	r.revocationCheck = check
+	r.mu.Unlock()
+}
+
+func (r *CertReloader) verifyConnection(cs tls.ConnectionState) error {
+	r.mu.RLock()
+	check := r.revocationCheck
+	r.mu.RUnlock()
+	if check == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	return check(cs.PeerCertificates[0])
+}
+
+// Watch checks the files every interval and reloads them when any has
+// changed, until ctx is cancelled.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reloadIfChanged()
+		}
+	}
+}
+
+func (r *CertReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reloadIfChanged reloads the files if any is newer than the loaded set.
+func (r *CertReloader) reloadIfChanged() {
+	modTime, err := r.newestModTime()
+	if err != nil {
+		slog.Warn("failed to stat TLS files", "error", err)
+		return
+	}
+	r.mu.RLock()
+	unchanged := !modTime.After(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	if err := r.load(); err != nil {
+		slog.Warn("failed to reload TLS files; keeping the current certificate", "error", err)
+		return
+	}
+	r.mu.RLock()
+	notAfter := r.cert.Leaf.NotAfter
+	r.mu.RUnlock()
+	slog.Info("reloaded TLS certificate", "cert", r.certFile, "not_after", notAfter)
+}
+
+// load reads the key pair and CA bundle and swaps them in together.
+func (r *CertReloader) load() error {
+	// Stat before reading so a file replaced mid-load is picked up next time.
+	modTime, err := r.newestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS cert/key: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		caCert, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("read CA cert: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("failed to parse CA certificate")
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// newestModTime returns the latest modification time across the files.
+// os.Stat follows symlinks, so atomic symlink swaps (as done by Kubernetes
+// secret mounts) are seen as changes.
+func (r *CertReloader) newestModTime() (time.Time, error) {
+	var newest time.Time
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
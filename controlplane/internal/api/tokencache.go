@@ -0,0 +1,63 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// tokenCacheTTL is how long rateLimitKey trusts a token lookup. A token
+	// revoked meanwhile is still refused by authentication; it is only
+	// counted against its own bucket a little longer.
+	tokenCacheTTL = 30 * time.Second
+	// tokenCacheSize bounds the cache, so a flood of made-up tokens cannot
+	// grow it without limit.
+	tokenCacheSize = 10000
+)
+
+// tokenCache remembers whether API token hashes belong to a tenant, so the
+// rate limiter does not query the database for every request it may shed.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[string]tokenEntry // by token hash
+}
+
+type tokenEntry struct {
+	valid   bool
+	expires time.Time
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{entries: make(map[string]tokenEntry)}
+}
+
+// get returns whether hash was a valid token, if it was looked up less than
+// tokenCacheTTL ago.
+func (c *tokenCache) get(hash string, now time.Time) (valid, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[hash]
+	if !ok || now.After(e.expires) {
+		delete(c.entries, hash)
+		return false, false
+	}
+	return e.valid, true
+}
+
+// put records the result of looking up hash, dropping expired entries, or
+// every entry when the cache is full.
+func (c *tokenCache) put(hash string, valid bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= tokenCacheSize {
+		for h, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, h)
+			}
+		}
+		if len(c.entries) >= tokenCacheSize {
+			clear(c.entries)
+		}
+	}
+	c.entries[hash] = tokenEntry{valid: valid, expires: now.Add(tokenCacheTTL)}
+}
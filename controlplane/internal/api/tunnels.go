@@ -1,15 +1,26 @@
 package api
 
 import (
+	"cmp"
+	"context"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/netip"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/proxy-manager/controlplane/internal/admission"
 	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/notify"
 	"github.com/proxy-manager/controlplane/internal/store"
 	"github.com/proxy-manager/controlplane/internal/wireguard"
 	qrcode "github.com/skip2/go-qrcode"
@@ -18,31 +29,186 @@ import (
 // sniRegex validates FQDN values used for SNI matching.
 var sniRegex = regexp.MustCompile(`^(\*\.)?[a-zA-Z0-9][a-zA-Z0-9\-\.]{0,252}[a-zA-Z0-9]$`)
 
-// reservedPorts are management ports that cannot be used for tunnels or firewall rules.
-var reservedPorts = map[int]bool{22: true, 2019: true, 7443: true, 51820: true}
+// labelKeyRegex validates tunnel label keys (Kubernetes-style, optional prefix).
+var labelKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._/\-]{0,61}[a-zA-Z0-9])?$`)
+
+// maxLabelValueLen is the maximum length of a tunnel label value.
+const maxLabelValueLen = 63
 
 // createTunnelRequest represents the request body for POST /api/v1/tunnels.
 type createTunnelRequest struct {
-	PublicKey    string   `json:"public_key,omitempty"`
-	Domains      []string `json:"domains,omitempty"`
-	UpstreamPort int      `json:"upstream_port,omitempty"`
+	Name         string            `json:"name,omitempty"` // unique per tenant; see PUT /api/v1/tunnels/by-name/{name}
+	PublicKey    string            `json:"public_key,omitempty"`
+	Domains      []string          `json:"domains,omitempty"`
+	UpstreamPort int               `json:"upstream_port,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	TenantID     string            `json:"tenant_id,omitempty"`
+	SourceCIDR   string            `json:"source_cidr,omitempty"`
+	Isolate      bool              `json:"isolate,omitempty"`
+	NodeID       string            `json:"node_id,omitempty"` // remote node serving the tunnel; empty for this host
+	// Further nodes serving the tunnel and its routes, in failover order.
+	// They must share the WireGuard key of node_id.
+	FailoverNodeIDs []string `json:"failover_node_ids,omitempty"`
+	// Seconds; omitted uses WG_PERSISTENT_KEEPALIVE and CONNECTED_THRESHOLD.
+	PersistentKeepalive *int `json:"persistent_keepalive,omitempty"` // 0 disables keepalives
+	ConnectedThreshold  *int `json:"connected_threshold,omitempty"`
+	// Destinations client configs route through the tunnel: "split" (the
+	// server only, default), "subnet" (the VPN subnet), or "full" (everything).
+	ClientRouting string `json:"client_routing,omitempty"`
+	// Interface settings of client configs. DNS takes resolver IPs and
+	// search domains; omitted uses 1.1.1.1 and an empty list leaves DNS out.
+	DNS []string `json:"dns"`
+	MTU int      `json:"mtu,omitempty"`
+	// Requested VPN IP, e.g. to keep a replaced device's address; allocated
+	// when empty.
+	VpnIP string `json:"vpn_ip,omitempty"`
+	// LAN prefixes behind the peer (e.g. an on-prem gateway) that the proxy
+	// routes through the tunnel.
+	AdvertisedRoutes []string `json:"advertised_routes,omitempty"`
+	// Ports routes may forward to on the peer and its LAN, also enforced by
+	// the firewall; omitted allows any.
+	AllowedUpstreamPorts []store.PortRange `json:"allowed_upstream_ports,omitempty"`
+	// Notes on who and what the peer is, for telling peers apart later.
+	Description string `json:"description,omitempty"`
+	OwnerEmail  string `json:"owner_email,omitempty"`
+	DeviceName  string `json:"device_name,omitempty"`
+	// RFC 3339 time at which the reconciler disables the tunnel.
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// updateTunnelRequest represents the request body for PATCH /api/v1/tunnels/{id}.
+type updateTunnelRequest struct {
+	Labels     *map[string]string `json:"labels,omitempty"`
+	SourceCIDR *string            `json:"source_cidr,omitempty"` // "" clears the restriction
+	Enabled    *bool              `json:"enabled,omitempty"`
+	Isolate    *bool              `json:"isolate,omitempty"`
+
+	PersistentKeepalive *int    `json:"persistent_keepalive,omitempty"` // seconds, 0 disables keepalives
+	ConnectedThreshold  *int    `json:"connected_threshold,omitempty"`  // seconds
+	ClientRouting       *string `json:"client_routing,omitempty"`       // "split", "subnet", or "full"
+
+	AdvertisedRoutes *[]string `json:"advertised_routes,omitempty"` // an empty list removes them
+
+	AllowedUpstreamPorts *[]store.PortRange `json:"allowed_upstream_ports,omitempty"` // an empty list allows any port
+
+	Description *string `json:"description,omitempty"` // "" clears a note
+	OwnerEmail  *string `json:"owner_email,omitempty"`
+	DeviceName  *string `json:"device_name,omitempty"`
+
+	ExpiresAt *string `json:"expires_at,omitempty"` // "" removes the expiry date
 }
 
 func (s *Server) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
 	var req createTunnelRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Validate domains
 	for _, d := range req.Domains {
-		if !sniRegex.MatchString(d) {
-			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid domain: %q", d))
+		if err := validateSNI(d); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if len(req.Domains) > 0 {
+		conflict, err := s.findSNIConflict("", req.Domains, false)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to check SNI conflicts")
+			return
+		}
+		if conflict != nil {
+			conflict.write(w, identityFrom(r.Context()))
 			return
 		}
 	}
 
+	if err := validateLabels(req.Labels); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sourceCIDR, err := normalizeSourceCIDR(req.SourceCIDR)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := validateConnectionSettings(req.PersistentKeepalive, req.ConnectedThreshold); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateClientRouting("client_routing", req.ClientRouting); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateClientInterface(req.DNS, req.MTU); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateNotes(req.Description, req.OwnerEmail, req.DeviceName); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expiresAt, err := parseExpiresAt(req.ExpiresAt)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	advertisedRoutes, status, err := s.validateAdvertisedRoutes(r, "", req.AdvertisedRoutes)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	allowedPorts, err := validateUpstreamPorts(req.AllowedUpstreamPorts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tenantID, status, err := s.tenantForCreate(r, req.TenantID)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	claim := policyClaim{Domains: req.Domains, Routes: advertisedRoutes}
+	if sourceCIDR != "" {
+		claim.SourceCIDRs = []string{sourceCIDR}
+	}
+	if status, err := s.checkPolicy(tenantID, claim); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	if status, err := s.checkName("tunnel", tenantID, req.Name); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	// With TUNNEL_APPROVAL a non-admin's tunnel is only recorded: its peer,
+	// routes, and DNS records wait for an admin to approve it
+	pending := s.cfg.TunnelApproval && identityFrom(r.Context()).Role < roleAdmin
+
+	// A tunnel on a remote node is applied by the node's agent, not here
+	remote := req.NodeID != ""
+	if remote {
+		node, err := s.nodeStore.Get(req.NodeID)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "node not found")
+			return
+		}
+		if !node.Registered() {
+			writeError(w, http.StatusConflict, "node has not registered yet")
+			return
+		}
+		if status, err := s.validateFailoverNodes(node, req.FailoverNodeIDs); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+	} else if len(req.FailoverNodeIDs) > 0 {
+		writeError(w, http.StatusBadRequest, "failover_node_ids requires node_id")
+		return
+	}
+
 	// Validate upstream port
 	if req.UpstreamPort == 0 {
 		req.UpstreamPort = 443
@@ -51,10 +217,14 @@ func (s *Server) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "upstream_port must be between 1 and 65535")
 		return
 	}
-	if reservedPorts[req.UpstreamPort] {
+	if s.cfg.ReservedPorts[req.UpstreamPort] {
 		writeError(w, http.StatusBadRequest, fmt.Sprintf("port %d is reserved", req.UpstreamPort))
 		return
 	}
+	if len(req.Domains) > 0 && len(allowedPorts) > 0 && !portsAllowed(allowedPorts, store.PortRange{Start: req.UpstreamPort, End: req.UpstreamPort}) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("upstream_port %d is outside allowed_upstream_ports", req.UpstreamPort))
+		return
+	}
 
 	// Validate public key if provided (Flow B)
 	if req.PublicKey != "" {
@@ -65,12 +235,15 @@ func (s *Server) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Allocate VPN IP
-	subnetPrefix := extractSubnetPrefix(s.cfg.WGServerIP)
-	vpnIP, err := s.tunnelStore.AllocateIP(s.cfg.WGServerIP, subnetPrefix)
-	if err != nil {
-		writeError(w, http.StatusServiceUnavailable, "no available VPN IP addresses")
-		return
+	// Use the requested VPN IP; otherwise one is allocated when the tunnel
+	// is persisted
+	var vpnIP string
+	if req.VpnIP != "" {
+		var status int
+		if vpnIP, status, err = s.validateStaticVPNIP(req.VpnIP); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
 	}
 
 	tunnelID := wireguard.GenerateRandomID("tun_")
@@ -98,155 +271,977 @@ func (s *Server) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
 		publicKey = req.PublicKey
 	}
 
-	// Add WireGuard peer
-	if err := s.wgManager.AddPeer(publicKey, psk, vpnIP); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to add WireGuard peer: %v", err))
+	// Reject a public key that is already in use before touching the kernel:
+	// AddPeer would overwrite the existing peer, and rolling that back would
+	// remove it.
+	if req.PublicKey != "" {
+		if existing, err := s.tunnels(r).GetByPublicKey(publicKey); err == nil {
+			if existing.DeletedAt != nil {
+				writeError(w, http.StatusConflict, fmt.Sprintf("public_key is held by deleted tunnel %s until it is purged; restore it instead", existing.ID))
+				return
+			}
+			writeError(w, http.StatusConflict, "public_key is already used by another tunnel")
+			return
+		}
+	}
+
+	if !s.admit(w, r, admission.OperationCreate, "tunnel", tunnelID, tenantID, req) {
 		return
 	}
 
-	// Persist tunnel to SQLite
+	// Each step below registers how to undo itself; any failure unwinds the
+	// steps taken so far so no kernel peer, Caddy route, or row is left behind.
+	var undo rollback
+	fail := func(status int, msg string) {
+		undo.run()
+		writeError(w, status, msg)
+	}
+
+	// Persisted below; built first so the peer gets its keepalive
 	tunnel := &store.Tunnel{
-		ID:                 tunnelID,
+		ID:                  tunnelID,
+		Name:                req.Name,
 		PublicKey:           publicKey,
-		VpnIP:              vpnIP,
-		Domains:            req.Domains,
-		Enabled:            true,
-		AutoRevokeInactive: true,
-		InactiveExpiryDays: 90,
-		GracePeriodMinutes: 30,
+		VpnIP:               vpnIP,
+		PSKHash:             wireguard.HashPSK(psk),
+		Domains:             req.Domains,
+		Labels:              req.Labels,
+		TenantID:            tenantID,
+		SourceCIDR:          sourceCIDR,
+		Isolate:             req.Isolate,
+		Enabled:             !pending,
+		PendingApproval:     pending,
+		AutoRevokeInactive:  true,
+		InactiveExpiryDays:  90,
+		GracePeriodMinutes:  30,
+		NodeID:              req.NodeID,
+		FailoverNodeIDs:     req.FailoverNodeIDs,
+		PersistentKeepalive: req.PersistentKeepalive,
+		ConnectedThreshold:  req.ConnectedThreshold,
+		ClientRouting:       req.ClientRouting,
+		ClientDNS:           req.DNS,
+		ClientMTU:           req.MTU,
+		AdvertisedRoutes:    advertisedRoutes,
+		Description:         req.Description,
+		OwnerEmail:          req.OwnerEmail,
+		DeviceName:          req.DeviceName,
+		ExpiresAt:           expiresAt,
+		ServerKey:           req.PublicKey == "",
+		ClientKey:           req.PublicKey != "",
+	}
+	tunnel.AllowedUpstreamPorts = allowedPorts
+	keepalive := tunnel.Keepalive(s.cfg.WGKeepalive)
+
+	// Persist tunnel to SQLite before touching the kernel: the row reserves
+	// the VPN IP, so a concurrent create cannot give its peer the same address
+	if remote || pending {
+		// Delivered to the agents of the tunnel's nodes with their next
+		// state, or kept for the peer added on approval
+		tunnel.PendingPSK = psk
 	}
-	if err := s.tunnelStore.Create(tunnel); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to persist tunnel: %v", err))
+	if vpnIP != "" {
+		err = s.tunnels(r).Create(tunnel)
+	} else {
+		err = s.tunnels(r).CreateWithAllocatedIP(tunnel, s.cfg.WGServerIP, s.cfg.AddressPools())
+	}
+	switch {
+	case errors.Is(err, store.ErrIPAllocated) && vpnIP != "":
+		fail(http.StatusConflict, fmt.Sprintf("vpn_ip %s is already used by another tunnel", vpnIP))
+		return
+	case errors.Is(err, store.ErrNoFreeIP):
+		fail(http.StatusServiceUnavailable, "no available VPN IP addresses")
+		return
+	case errors.Is(err, store.ErrNameInUse):
+		fail(http.StatusConflict, fmt.Sprintf("name %q is already used by another tunnel", req.Name))
+		return
+	case err != nil:
+		fail(http.StatusInternalServerError, fmt.Sprintf("failed to persist tunnel: %v", err))
 		return
 	}
+	vpnIP = tunnel.VpnIP
+	undo.add("delete tunnel", func() error { return s.tunnels(r).Delete(tunnelID) })
+
+	// Add WireGuard peer
+	if !remote && !pending {
+		if err := s.wgManager.AddPeer(publicKey, psk, vpnIP, advertisedRoutes, keepalive); err != nil {
+			fail(http.StatusInternalServerError, fmt.Sprintf("failed to add WireGuard peer: %v", err))
+			return
+		}
+		undo.add("remove WireGuard peer", func() error { return s.wgManager.RemovePeer(publicKey) })
+	}
+
+	if req.Isolate && !remote && !pending {
+		if err := s.fwManager.IsolatePeer(vpnIP); err != nil {
+			// Non-fatal: reconciler will fix this
+			fmt.Printf("warning: failed to isolate peer: %v\n", err)
+		} else {
+			undo.add("remove peer isolation", func() error { return s.fwManager.UnisolatePeer(vpnIP) })
+		}
+	}
+	if len(allowedPorts) > 0 && !remote && !pending && s.reconciler != nil {
+		// The reconciler adds the firewall rules
+		s.reconciler.ForceReconcile()
+	}
 
 	// Add Caddy L4 routes for each domain
 	if len(req.Domains) > 0 {
 		upstream := fmt.Sprintf("%s:%d", vpnIP, req.UpstreamPort)
-		caddyID := fmt.Sprintf("route-%s-%d", tunnelID, req.UpstreamPort)
-
-		caddyRoute := caddy.BuildCaddyRoute(caddyID, req.Domains, upstream)
-
-		// Ensure Caddy server exists
-		_ = s.caddyClient.CreateServer(r.Context())
-
-		if err := s.caddyClient.AddRoute(r.Context(), caddyRoute); err != nil {
-			// Non-fatal: reconciler will fix this
-			fmt.Printf("warning: failed to add caddy route: %v\n", err)
+		routeID := wireguard.GenerateRandomID("route_")
+		caddyID := caddy.SNIRouteID(routeID)
+
+		if !remote && !pending {
+			caddyRoute := caddy.BuildCaddyRoute(caddyID, req.Domains, upstream, "", false)
+
+			// Ensure Caddy server exists
+			_ = s.caddyClient.CreateServer(r.Context())
+
+			if err := s.caddyClient.AddRoute(r.Context(), caddyRoute); err != nil {
+				// Non-fatal: reconciler will fix this
+				fmt.Printf("warning: failed to add caddy route: %v\n", err)
+			} else {
+				undo.add("delete caddy route", func() error {
+					return s.caddyClient.DeleteRoute(context.Background(), caddyID)
+				})
+			}
 		}
 
 		// Persist route to SQLite
 		route := &store.Route{
-			ID:         wireguard.GenerateRandomID("route_"),
+			ID:         routeID,
 			TunnelID:   tunnelID,
 			ListenPort: 443,
 			MatchType:  "sni",
 			MatchValue: req.Domains,
 			Upstream:   upstream,
 			CaddyID:    caddyID,
-			Enabled:    true,
+			Enabled:    !pending,
+			TenantID:   tenantID,
+			NodeID:     req.NodeID,
+		}
+		if err := s.routes(r).Create(route); errors.Is(err, store.ErrDomainInUse) {
+			undo.run()
+			s.writeDomainTaken(w, r, "", req.Domains)
+			return
+		} else if err != nil {
+			fail(http.StatusInternalServerError, fmt.Sprintf("failed to persist route: %v", err))
+			return
+		}
+		if !pending {
+			if s.reconciler != nil {
+				// Move the appended route to its place in the priority order
+				s.reconciler.ForceReconcile()
+			}
+			s.publishDNS(route.MatchValue)
+		}
+	}
+
+	code := http.StatusCreated
+	if pending {
+		code = http.StatusAccepted
+		s.notify(notify.Event{
+			Type: notify.EventTunnelApprovalRequested, TunnelID: tunnelID, Time: time.Now(),
+			Data: map[string]interface{}{"requested_by": identityFrom(r.Context()).ClientCN, "vpn_ip": vpnIP, "domains": req.Domains},
+		})
+	}
+
+	// Build response
+	serverPubKey, serverEndpoint := s.serverFor(tunnel)
+
+	if req.PublicKey == "" {
+		// Flow A response: includes config, which stays downloadable as a
+		// QR code for the escrow window
+		config := s.clientConfig(tunnel, privateKey, psk, "")
+		s.escrow.put(tunnelID, privateKey, psk, s.cfg.KeyEscrow)
+
+		writeJSON(w, code, map[string]interface{}{
+			"id":                     tunnelID,
+			"name":                   tunnel.Name,
+			"vpn_ip":                 vpnIP,
+			"pending_approval":       pending,
+			"config":                 config,
+			"qr_code_url":            fmt.Sprintf("/api/v1/tunnels/%s/qr", tunnelID),
+			"server_public_key":      serverPubKey,
+			"labels":                 tunnel.Labels,
+			"tenant_id":              tunnel.TenantID,
+			"isolate":                tunnel.Isolate,
+			"node_id":                tunnel.NodeID,
+			"failover_node_ids":      tunnel.FailoverNodeIDs,
+			"persistent_keepalive":   s.keepaliveSeconds(tunnel),
+			"connected_threshold":    s.connectedThreshold(tunnel),
+			"client_routing":         clientRouting(tunnel),
+			"dns":                    clientDNS(tunnel),
+			"mtu":                    tunnel.ClientMTU,
+			"advertised_routes":      tunnel.AdvertisedRoutes,
+			"allowed_upstream_ports": tunnel.AllowedUpstreamPorts,
+			"description":            tunnel.Description,
+			"owner_email":            tunnel.OwnerEmail,
+			"device_name":            tunnel.DeviceName,
+			"expires_at":             formatTimePtr(tunnel.ExpiresAt),
+			"warning":                "Save this config now. The private key will not be available again.",
+		})
+	} else {
+		// Flow B response
+		writeJSON(w, code, map[string]interface{}{
+			"id":                     tunnelID,
+			"name":                   tunnel.Name,
+			"vpn_ip":                 vpnIP,
+			"pending_approval":       pending,
+			"server_public_key":      serverPubKey,
+			"server_endpoint":        serverEndpoint,
+			"preshared_key":          psk,
+			"labels":                 tunnel.Labels,
+			"tenant_id":              tunnel.TenantID,
+			"isolate":                tunnel.Isolate,
+			"node_id":                tunnel.NodeID,
+			"failover_node_ids":      tunnel.FailoverNodeIDs,
+			"persistent_keepalive":   s.keepaliveSeconds(tunnel),
+			"connected_threshold":    s.connectedThreshold(tunnel),
+			"client_routing":         clientRouting(tunnel),
+			"dns":                    clientDNS(tunnel),
+			"mtu":                    tunnel.ClientMTU,
+			"advertised_routes":      tunnel.AdvertisedRoutes,
+			"allowed_upstream_ports": tunnel.AllowedUpstreamPorts,
+			"description":            tunnel.Description,
+			"owner_email":            tunnel.OwnerEmail,
+			"device_name":            tunnel.DeviceName,
+			"expires_at":             formatTimePtr(tunnel.ExpiresAt),
+		})
+	}
+}
+
+func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	selector, err := parseLabelSelector(r.URL.Query()["label"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// ?deleted=true lists the soft-deleted tunnels that can still be restored
+	list := s.tunnels(r).List
+	if r.URL.Query().Get("deleted") == "true" {
+		list = s.tunnels(r).ListDeleted
+	}
+	tunnels, err := list()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list tunnels: %v", err))
+		return
+	}
+
+	caller := identityFrom(r.Context())
+	named := nameFilter(r)
+	owner := r.URL.Query().Get("owner_email")
+	pendingOnly := r.URL.Query().Get("pending_approval") == "true"
+	result := make([]map[string]interface{}, 0, len(tunnels))
+	for _, t := range tunnels {
+		if !caller.canAccess(t.TenantID) || !t.MatchesLabels(selector) || !named(t.Name) {
+			continue
+		}
+		if owner != "" && !strings.EqualFold(t.OwnerEmail, owner) || pendingOnly && !t.PendingApproval {
+			continue
+		}
+		result = append(result, s.tunnelResponse(t))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+func (s *Server) handleUpdateTunnel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id is required")
+		return
+	}
+
+	var req updateTunnelRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	defer s.lockIfMatch(r)()
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	if !checkIfMatch(w, r, tunnelETag(tunnel)) {
+		return
+	}
+
+	if req.Labels != nil {
+		if err := validateLabels(*req.Labels); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	var sourceCIDR string
+	if req.SourceCIDR != nil {
+		if sourceCIDR, err = normalizeSourceCIDR(*req.SourceCIDR); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := validateConnectionSettings(req.PersistentKeepalive, req.ConnectedThreshold); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.ClientRouting != nil {
+		if err := validateClientRouting("client_routing", *req.ClientRouting); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := validateNotes(deref(req.Description), deref(req.OwnerEmail), deref(req.DeviceName)); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expiresAt := tunnel.ExpiresAt
+	if req.ExpiresAt != nil {
+		if expiresAt, err = parseExpiresAt(*req.ExpiresAt); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.Enabled != nil && *req.Enabled && tunnel.PendingApproval {
+		writeError(w, http.StatusConflict, "tunnel is awaiting approval; an admin enables it with POST /api/v1/tunnels/{id}/approve")
+		return
+	}
+	if req.Enabled != nil && *req.Enabled && !tunnel.Enabled && expiresAt != nil && !time.Now().Before(*expiresAt) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("tunnel expired at %s; move or remove expires_at to enable it", expiresAt.UTC().Format(time.RFC3339)))
+		return
+	}
+	var advertisedRoutes []string
+	if req.AdvertisedRoutes != nil {
+		var status int
+		if advertisedRoutes, status, err = s.validateAdvertisedRoutes(r, id, *req.AdvertisedRoutes); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+	}
+	var allowedPorts []store.PortRange
+	if req.AllowedUpstreamPorts != nil {
+		if allowedPorts, err = validateUpstreamPorts(*req.AllowedUpstreamPorts); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if status, err := s.checkRoutesUpstream(r, id, allowedPorts); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+	}
+	claim := policyClaim{Routes: advertisedRoutes}
+	if sourceCIDR != "" {
+		claim.SourceCIDRs = []string{sourceCIDR}
+	}
+	if status, err := s.checkPolicy(tunnel.TenantID, claim); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	if req.Labels != nil {
+		tunnel, err = s.tunnels(r).UpdateLabels(id, *req.Labels)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update labels: %v", err))
+			return
+		}
+	}
+	if req.SourceCIDR != nil {
+		tunnel, err = s.tunnels(r).UpdateSourceCIDR(id, sourceCIDR)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update source_cidr: %v", err))
+			return
+		}
+	}
+	if req.Isolate != nil && *req.Isolate != tunnel.Isolate {
+		tunnel, err = s.tunnels(r).SetIsolate(id, *req.Isolate)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update isolate: %v", err))
+			return
+		}
+		// A node's agent applies the change at its next sync
+		if tunnel.NodeID == "" {
+			apply := s.fwManager.UnisolatePeer
+			if tunnel.Isolate {
+				apply = s.fwManager.IsolatePeer
+			}
+			if err := apply(tunnel.VpnIP); err != nil {
+				// Non-fatal: reconciler will fix this
+				fmt.Printf("warning: failed to update peer isolation: %v\n", err)
+			}
+		}
+	}
+	if req.PersistentKeepalive != nil || req.ConnectedThreshold != nil {
+		tunnel, err = s.tunnels(r).UpdateConnectionSettings(id, req.PersistentKeepalive, req.ConnectedThreshold)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update connection settings: %v", err))
+			return
+		}
+		// A node's agent applies the change at its next sync
+		if req.PersistentKeepalive != nil && tunnel.NodeID == "" && tunnel.Enabled {
+			// No PSK: the peer keeps its current one
+			if err := s.wgManager.AddPeer(tunnel.PublicKey, "", tunnel.VpnIP, tunnel.AdvertisedRoutes, tunnel.Keepalive(s.cfg.WGKeepalive)); err != nil {
+				// Non-fatal: reconciler will fix this
+				fmt.Printf("warning: failed to update peer keepalive: %v\n", err)
+			}
+		}
+	}
+	if req.AdvertisedRoutes != nil {
+		tunnel, err = s.tunnels(r).SetAdvertisedRoutes(id, advertisedRoutes)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update advertised_routes: %v", err))
+			return
+		}
+		// A node's agent applies the change at its next sync
+		if tunnel.NodeID == "" && tunnel.Enabled {
+			if err := s.wgManager.AddPeer(tunnel.PublicKey, "", tunnel.VpnIP, tunnel.AdvertisedRoutes, tunnel.Keepalive(s.cfg.WGKeepalive)); err != nil {
+				// Non-fatal: reconciler will fix this
+				fmt.Printf("warning: failed to update peer routes: %v\n", err)
+			}
+		}
+	}
+	if req.AllowedUpstreamPorts != nil {
+		tunnel, err = s.tunnels(r).SetAllowedUpstreamPorts(id, allowedPorts)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update allowed_upstream_ports: %v", err))
+			return
+		}
+	}
+	if req.Description != nil || req.OwnerEmail != nil || req.DeviceName != nil {
+		tunnel, err = s.tunnels(r).UpdateNotes(id, req.Description, req.OwnerEmail, req.DeviceName)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update notes: %v", err))
+			return
+		}
+	}
+	if req.ExpiresAt != nil {
+		tunnel, err = s.tunnels(r).SetExpiry(id, expiresAt)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update expires_at: %v", err))
+			return
+		}
+	}
+	if req.ClientRouting != nil {
+		// Only affects configs generated from now on
+		tunnel, err = s.tunnels(r).SetClientRouting(id, *req.ClientRouting)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update client_routing: %v", err))
+			return
+		}
+	}
+	if req.Enabled != nil && *req.Enabled != tunnel.Enabled {
+		tunnel, err = s.tunnels(r).SetEnabled(id, *req.Enabled)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to update enabled: %v", err))
+			return
+		}
+		// The reconciler adds or removes the kernel peer
+		if s.reconciler != nil {
+			s.reconciler.ForceReconcile()
+		}
+	} else if req.AllowedUpstreamPorts != nil && s.reconciler != nil {
+		// The reconciler replaces the firewall rules; a node's agent does
+		// at its next sync
+		s.reconciler.ForceReconcile()
+	}
+
+	w.Header().Set("ETag", tunnelETag(tunnel))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": s.tunnelResponse(tunnel)})
+}
+
+// handleGetTunnel returns one tunnel with its routes embedded.
+func (s *Server) handleGetTunnel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id is required")
+		return
+	}
+
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	routes, err := s.routes(r).ListByTunnelID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list routes: %v", err))
+		return
+	}
+
+	routeList := make([]map[string]interface{}, 0, len(routes))
+	for _, route := range routes {
+		routeList = append(routeList, routeResponse(route))
+	}
+	resp := s.tunnelResponse(tunnel)
+	resp["routes"] = routeList
+
+	w.Header().Set("ETag", tunnelETag(tunnel))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": resp})
+}
+
+// tunnelResponse is the JSON representation of a stored tunnel.
+func (s *Server) tunnelResponse(t *store.Tunnel) map[string]interface{} {
+	resp := map[string]interface{}{
+		"id":                     t.ID,
+		"name":                   t.Name,
+		"public_key":             t.PublicKey,
+		"vpn_ip":                 t.VpnIP,
+		"domains":                t.Domains,
+		"enabled":                t.Enabled,
+		"pending_approval":       t.PendingApproval,
+		"imported":               t.Imported,
+		"endpoint":               t.Endpoint,
+		"last_handshake":         formatTimePtr(t.LastHandshake),
+		"tx_bytes":               t.TxBytes,
+		"rx_bytes":               t.RxBytes,
+		"connected":              t.Connected(time.Now(), s.cfg.ConnectedWindow),
+		"expiring_soon":          s.expiringSoon(t),
+		"revocation_at":          formatTimePtr(t.RevocationAt()),
+		"expires_at":             formatTimePtr(t.ExpiresAt),
+		"expired":                t.Expired(time.Now()),
+		"labels":                 t.Labels,
+		"tenant_id":              t.TenantID,
+		"source_cidr":            t.SourceCIDR,
+		"isolate":                t.Isolate,
+		"node_id":                t.NodeID,
+		"failover_node_ids":      t.FailoverNodeIDs,
+		"persistent_keepalive":   s.keepaliveSeconds(t),
+		"connected_threshold":    s.connectedThreshold(t),
+		"client_routing":         clientRouting(t),
+		"dns":                    clientDNS(t),
+		"mtu":                    t.ClientMTU,
+		"advertised_routes":      t.AdvertisedRoutes,
+		"allowed_upstream_ports": t.AllowedUpstreamPorts,
+		"description":            t.Description,
+		"owner_email":            t.OwnerEmail,
+		"device_name":            t.DeviceName,
+		"etag":                   tunnelETag(t),
+		"created_at":             t.CreatedAt.UTC().Format(time.RFC3339),
+		"updated_at":             t.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if t.DeletedAt != nil {
+		resp["deleted_at"] = t.DeletedAt.UTC().Format(time.RFC3339)
+		resp["purge_at"] = t.DeletedAt.Add(s.cfg.TunnelRetention).UTC().Format(time.RFC3339)
+	}
+	return resp
+}
+
+// expiringSoon reports whether the tunnel will be revoked for inactivity or
+// reach its expiry date within the warning window.
+func (s *Server) expiringSoon(t *store.Tunnel) bool {
+	now := time.Now()
+	return t.ExpiringSoon(now, s.cfg.InactivityWarning) || t.ReachesExpiryDateWithin(now, s.cfg.InactivityWarning)
+}
+
+// keepaliveSeconds returns the tunnel's persistent keepalive in seconds,
+// falling back to the configured default.
+func (s *Server) keepaliveSeconds(t *store.Tunnel) int {
+	return int(t.Keepalive(s.cfg.WGKeepalive) / time.Second)
+}
+
+// connectedThreshold returns the tunnel's connected threshold in seconds,
+// falling back to the configured default.
+func (s *Server) connectedThreshold(t *store.Tunnel) int {
+	return int(t.ConnectedWithin(s.cfg.ConnectedWindow) / time.Second)
+}
+
+// clientRouting returns the tunnel's client routing mode, naming the default.
+func clientRouting(t *store.Tunnel) string {
+	if t.ClientRouting == "" {
+		return wireguard.RoutingSplit
+	}
+	return t.ClientRouting
+}
+
+// clientDNS returns the DNS settings of the tunnel's client configs.
+func clientDNS(t *store.Tunnel) []string {
+	if t.ClientDNS == nil {
+		return wireguard.DefaultDNS
+	}
+	return t.ClientDNS
+}
+
+// clientConfig renders the client config of t in wg-quick format. routing
+// overrides the tunnel's own mode when non-empty; an empty psk leaves the
+// line out.
+func (s *Server) clientConfig(t *store.Tunnel, privateKey, psk, routing string) string {
+	return s.peerConfig(t, privateKey, psk, routing).Render()
+}
+
+// peerConfig returns the values of t's client config, for rendering in any
+// format.
+func (s *Server) peerConfig(t *store.Tunnel, privateKey, psk, routing string) wireguard.ClientConfig {
+	if routing == "" {
+		routing = t.ClientRouting
+	}
+	serverPubKey, serverEndpoint := s.serverFor(t)
+	return wireguard.ClientConfig{
+		PrivateKey:     privateKey,
+		Address:        t.VpnIP,
+		DNS:            clientDNS(t),
+		MTU:            t.ClientMTU,
+		ServerPubKey:   serverPubKey,
+		PresharedKey:   psk,
+		ServerEndpoint: serverEndpoint,
+		AllowedIPs:     wireguard.ClientAllowedIPs(routing, s.cfg.WGServerIP, s.cfg.WGSubnet),
+		Keepalive:      t.Keepalive(s.cfg.WGKeepalive),
+		Notes:          endpointNote(serverEndpoint, s.serverEndpoints(t)),
+	}
+}
+
+// serverEndpoints returns every endpoint t's client can reach its server
+// at: SERVER_ENDPOINT, then the same host on each of WG_ALT_PORTS, which
+// the firewall redirects to the WireGuard port. It is nil without alternative
+// ports and for tunnels on remote nodes, whose agents install no redirects.
+func (s *Server) serverEndpoints(t *store.Tunnel) []string {
+	host, _, err := net.SplitHostPort(s.cfg.ServerEndpoint)
+	if t.NodeID != "" || len(s.cfg.WGAltPorts) == 0 || err != nil {
+		return nil
+	}
+	endpoints := []string{s.cfg.ServerEndpoint}
+	for _, port := range s.cfg.WGAltPorts {
+		endpoints = append(endpoints, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return endpoints
+}
+
+// endpointNote lists the endpoints other than current as a config comment,
+// for clients on networks that block it. It is nil when there are none.
+func endpointNote(current string, endpoints []string) []string {
+	others := slices.DeleteFunc(slices.Clone(endpoints), func(e string) bool { return e == current })
+	if len(others) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("If %s is blocked, use one of: %s", current, strings.Join(others, ", "))}
+}
+
+// wgFallback returns the WireGuard over TCP fallback of the local server, or
+// false if none is configured.
+func (s *Server) wgFallback() (wireguard.Fallback, bool) {
+	if s.cfg.WGFallbackTransport == "" {
+		return wireguard.Fallback{}, false
+	}
+	return wireguard.Fallback{
+		Transport: s.cfg.WGFallbackTransport,
+		Host:      s.cfg.WGFallbackHost,
+		Port:      s.cfg.WGFallbackPort,
+		WGPort:    s.cfg.WGPort(),
+	}, true
+}
+
+// handleGetTunnelEndpoints returns the endpoints a tunnel's peer has connected
+// from, newest first.
+func (s *Server) handleGetTunnelEndpoints(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+
+	changes, err := s.tunnels(r).EndpointHistory(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load endpoint history: %v", err))
+		return
+	}
+
+	result := make([]map[string]interface{}, 0, len(changes))
+	for _, c := range changes {
+		result = append(result, map[string]interface{}{
+			"endpoint": c.Endpoint,
+			"seen_at":  c.SeenAt.UTC().Format(time.RFC3339),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+// handleGetTunnelEvents returns a tunnel's peer connect and disconnect
+// events, newest first.
+func (s *Server) handleGetTunnelEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+
+	events, err := s.tunnels(r).PeerEvents(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load peer events: %v", err))
+		return
+	}
+
+	result := make([]map[string]interface{}, 0, len(events))
+	for _, e := range events {
+		result = append(result, map[string]interface{}{
+			"type":     e.Type,
+			"endpoint": e.Endpoint,
+			"at":       e.At.UTC().Format(time.RFC3339),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+func (s *Server) handleDeleteTunnel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id is required")
+		return
+	}
+
+	defer s.lockIfMatch(r)()
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	if !checkIfMatch(w, r, tunnelETag(tunnel)) {
+		return
+	}
+
+	// Deleting takes the tunnel's routes with it and leaves firewall rules
+	// for its addresses behind, so either must be confirmed with ?force=true
+	if r.URL.Query().Get("force") != "true" {
+		routeIDs, ruleIDs, err := s.tunnelDependents(tunnel, identityFrom(r.Context()))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to check dependents: %v", err))
+			return
+		}
+		if len(routeIDs) > 0 || len(ruleIDs) > 0 {
+			writeJSON(w, http.StatusConflict, map[string]interface{}{
+				"error": fmt.Sprintf("tunnel has %d route(s) and %d firewall rule(s) referencing it; delete with ?force=true to remove the routes and keep the rules",
+					len(routeIDs), len(ruleIDs)),
+				"dependents": map[string]interface{}{
+					"routes":         routeIDs,
+					"firewall_rules": ruleIDs,
+				},
+			})
+			return
+		}
+	}
+	if !s.admit(w, r, admission.OperationDelete, "tunnel", tunnel.ID, tunnel.TenantID, s.tunnelResponse(tunnel)) {
+		return
+	}
+
+	// A node's agent removes the peer and routes once they leave its state
+	local := tunnel.NodeID == ""
+
+	// Remove WireGuard peer
+	if local {
+		if err := s.wgManager.RemovePeer(tunnel.PublicKey); err != nil {
+			// Log but continue — reconciler will clean up
+			fmt.Printf("warning: failed to remove WG peer: %v\n", err)
+		}
+	}
+	if local && tunnel.Isolate {
+		if err := s.fwManager.UnisolatePeer(tunnel.VpnIP); err != nil {
+			fmt.Printf("warning: failed to remove peer isolation: %v\n", err)
+		}
+	}
+
+	// Delete associated Caddy routes
+	routes, _ := s.routes(r).ListByTunnelID(id)
+	var domains []string
+	for _, route := range routes {
+		if route.MatchType == "sni" {
+			domains = append(domains, route.MatchValue...)
+		}
+		if !local {
+			continue
 		}
-		if err := s.routeStore.Create(route); err != nil {
-			fmt.Printf("warning: failed to persist route: %v\n", err)
+		if route.MatchType == "port_forward" {
+			for _, server := range portForwardServers(route) {
+				_ = s.caddyClient.DeleteServer(r.Context(), server.Name)
+			}
+			continue
+		}
+		_ = s.caddyClient.DeleteRoute(r.Context(), route.CaddyID)
+		if route.QUIC {
+			_ = s.caddyClient.DeleteRoute(r.Context(), caddy.QUICRouteID(route.CaddyID))
 		}
 	}
 
-	// Build response
-	serverPubKey, _ := s.wgManager.GetServerPublicKey()
-
-	if req.PublicKey == "" {
-		// Flow A response: includes config
-		config := buildWGConfig(privateKey, vpnIP, serverPubKey, psk, s.cfg.ServerEndpoint)
-
-		writeJSON(w, http.StatusCreated, map[string]interface{}{
-			"id":                tunnelID,
-			"vpn_ip":            vpnIP,
-			"config":            config,
-			"qr_code_url":       fmt.Sprintf("/api/v1/tunnels/%s/qr", tunnelID),
-			"server_public_key": serverPubKey,
-			"warning":           "Save this config now. The private key will not be available again.",
-		})
+	// Within the retention window the tunnel keeps its keys, VPN IP, and a
+	// snapshot of its routes, so POST /tunnels/{id}/restore can bring it back
+	if s.cfg.TunnelRetention > 0 {
+		if err := s.tunnels(r).SoftDelete(id, time.Now()); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete tunnel: %v", err))
+			return
+		}
 	} else {
-		// Flow B response
-		writeJSON(w, http.StatusCreated, map[string]interface{}{
-			"id":                tunnelID,
-			"vpn_ip":            vpnIP,
-			"server_public_key": serverPubKey,
-			"server_endpoint":   s.cfg.ServerEndpoint,
-			"preshared_key":     psk,
-		})
+		// Delete routes from DB
+		_ = s.routes(r).DeleteByTunnelID(id)
+
+		// Delete tunnel from DB
+		if err := s.tunnels(r).Delete(id); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete tunnel: %v", err))
+			return
+		}
 	}
+	s.escrow.drop(id)
+	s.unpublishDNS(domains)
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
-	tunnels, err := s.tunnelStore.List()
+// tunnelDependents returns the IDs of the tunnel's routes and of the
+// firewall rules visible to caller whose source is the tunnel's VPN IP or
+// one of its advertised routes.
+func (s *Server) tunnelDependents(t *store.Tunnel, caller *identity) ([]string, []string, error) {
+	routes, err := s.routeStore.ListByTunnelID(t.ID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list tunnels: %v", err))
-		return
+		return nil, nil, err
+	}
+	routeIDs := make([]string, 0, len(routes))
+	for _, route := range routes {
+		routeIDs = append(routeIDs, route.ID)
 	}
 
-	result := make([]map[string]interface{}, 0, len(tunnels))
-	for _, t := range tunnels {
-		connected := false
-		if t.LastHandshake != nil {
-			connected = time.Since(*t.LastHandshake) < 5*time.Minute
+	rules, err := s.fwStore.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	sources := append([]string{t.VpnIP + "/32"}, t.AdvertisedRoutes...)
+	ruleIDs := []string{}
+	for _, rule := range rules {
+		if !caller.canAccess(rule.TenantID) {
+			continue
 		}
-
-		entry := map[string]interface{}{
-			"id":                  t.ID,
-			"public_key":          t.PublicKey,
-			"vpn_ip":              t.VpnIP,
-			"domains":             t.Domains,
-			"enabled":             t.Enabled,
-			"endpoint":            t.Endpoint,
-			"last_handshake":      formatTimePtr(t.LastHandshake),
-			"tx_bytes":            t.TxBytes,
-			"rx_bytes":            t.RxBytes,
-			"connected":           connected,
-			"created_at":          t.CreatedAt.UTC().Format(time.RFC3339),
-			"updated_at":          t.UpdatedAt.UTC().Format(time.RFC3339),
+		p, err := netip.ParsePrefix(rule.SourceCIDR)
+		if err != nil {
+			continue
+		}
+		if slices.Contains(sources, p.Masked().String()) {
+			ruleIDs = append(ruleIDs, rule.ID)
 		}
-		result = append(result, entry)
 	}
-
-	writeJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+	return routeIDs, ruleIDs, nil
 }
 
-func (s *Server) handleDeleteTunnel(w http.ResponseWriter, r *http.Request) {
+// handleRestoreTunnel brings back a soft-deleted tunnel with the routes it
+// had when it was deleted. Only the hash of the old PSK was kept, so the
+// tunnel gets a new one, returned once.
+func (s *Server) handleRestoreTunnel(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
 		writeError(w, http.StatusBadRequest, "tunnel id is required")
 		return
 	}
 
-	tunnel, err := s.tunnelStore.Get(id)
-	if err != nil {
-		writeError(w, http.StatusNotFound, "tunnel not found")
+	tunnel, routes, err := s.tunnels(r).GetDeleted(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "deleted tunnel not found")
 		return
 	}
-
-	// Remove WireGuard peer
-	if err := s.wgManager.RemovePeer(tunnel.PublicKey); err != nil {
-		// Log but continue — reconciler will clean up
-		fmt.Printf("warning: failed to remove WG peer: %v\n", err)
+	if time.Since(*tunnel.DeletedAt) > s.cfg.TunnelRetention {
+		writeError(w, http.StatusGone, "tunnel was deleted before the retention window and can no longer be restored")
+		return
+	}
+	if tunnel.NodeID != "" {
+		if _, err := s.nodeStore.Get(tunnel.NodeID); err != nil {
+			writeError(w, http.StatusConflict, fmt.Sprintf("node %s no longer exists", tunnel.NodeID))
+			return
+		}
 	}
 
-	// Delete associated Caddy routes
-	routes, _ := s.routeStore.ListByTunnelID(id)
+	// Other routes may have taken the domains or ports since the deletion
+	var domains []string
 	for _, route := range routes {
-		_ = s.caddyClient.DeleteRoute(r.Context(), route.CaddyID)
+		switch route.MatchType {
+		case "sni":
+			conflict, err := s.findSNIConflict(id, route.MatchValue, true)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to check SNI conflicts")
+				return
+			}
+			if conflict != nil {
+				conflict.write(w, identityFrom(r.Context()))
+				return
+			}
+			domains = append(domains, route.MatchValue...)
+		case "port_forward":
+			existing, err := s.routes(r).FindByPortRange(route.ListenPort, max(route.ListenPort, route.ListenPortEnd), route.Protocol)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to check port conflict")
+				return
+			}
+			if existing != nil {
+				writeError(w, http.StatusConflict, fmt.Sprintf("port %s/%s is already in use by route %s",
+					portSpan(existing.ListenPort, existing.ListenPortEnd), route.Protocol, existing.ID))
+				return
+			}
+		}
 	}
 
-	// Delete routes from DB
-	_ = s.routeStore.DeleteByTunnelID(id)
-
-	// Delete tunnel from DB
-	if err := s.tunnelStore.Delete(id); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete tunnel: %v", err))
+	psk, err := wireguard.GeneratePSK()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate PSK")
+		return
+	}
+	deletedAt := *tunnel.DeletedAt
+	tunnel, routes, err = s.tunnels(r).Restore(id, wireguard.HashPSK(psk))
+	if errors.Is(err, store.ErrNameInUse) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("a route name of the tunnel has been taken since the deletion: %v", err))
+		return
+	}
+	if errors.Is(err, store.ErrDomainInUse) {
+		s.writeDomainTaken(w, r, id, domains)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to restore tunnel: %v", err))
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	if tunnel.NodeID != "" {
+		// The serving nodes' agents add the peer and routes and apply the PSK
+		if err := s.tunnels(r).SetPendingPSK(id, psk); err != nil {
+			_ = s.tunnels(r).SoftDelete(id, deletedAt)
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to queue PSK for node: %v", err))
+			return
+		}
+	} else {
+		if tunnel.Enabled {
+			keepalive := tunnel.Keepalive(s.cfg.WGKeepalive)
+			if err := s.wgManager.AddPeer(tunnel.PublicKey, psk, tunnel.VpnIP, tunnel.AdvertisedRoutes, keepalive); err != nil {
+				_ = s.tunnels(r).SoftDelete(id, deletedAt)
+				writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to add WG peer: %v", err))
+				return
+			}
+		}
+		if tunnel.Enabled && tunnel.Isolate {
+			if err := s.fwManager.IsolatePeer(tunnel.VpnIP); err != nil {
+				// Non-fatal: reconciler will fix this
+				fmt.Printf("warning: failed to isolate peer: %v\n", err)
+			}
+		}
+		for _, route := range routes {
+			if route.MatchType != "port_forward" {
+				continue
+			}
+			for _, server := range portForwardServers(route) {
+				if err := s.caddyClient.CreatePortForwardServer(r.Context(), server.Name, server.ListenAddr, server.Upstream, server.CaddyID, server.ProxyProtocol); err != nil {
+					fmt.Printf("warning: failed to create caddy port-forward server: %v\n", err)
+				}
+			}
+		}
+	}
+
+	// The reconciler adds the SNI routes to Caddy in priority order
+	if s.reconciler != nil {
+		s.reconciler.ForceReconcile()
+	}
+	s.publishDNS(domains)
+
+	routeIDs := make([]string, 0, len(routes))
+	for _, route := range routes {
+		routeIDs = append(routeIDs, route.ID)
+	}
+	resp := s.tunnelResponse(tunnel)
+	resp["routes"] = routeIDs
+	resp["preshared_key"] = psk
+	if tunnel.NodeID == "" {
+		resp["config"] = s.clientConfig(tunnel, wireguard.PrivateKeyPlaceholder, psk, "")
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": resp})
 }
 
 func (s *Server) handleGetTunnelConfig(w http.ResponseWriter, r *http.Request) {
@@ -256,35 +1251,109 @@ func (s *Server) handleGetTunnelConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tunnel, err := s.tunnelStore.Get(id)
-	if err != nil {
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
 		writeError(w, http.StatusNotFound, "tunnel not found")
 		return
 	}
 
-	// Config is only available for server-generated keys (Flow A).
-	// We can't reconstruct the private key, so we return a template
-	// that indicates the config was one-time only.
-	serverPubKey, _ := s.wgManager.GetServerPublicKey()
+	routing := r.URL.Query().Get("routing")
+	if err := validateClientRouting("routing", routing); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := cmp.Or(r.URL.Query().Get("format"), wireguard.FormatWGQuick)
+	if !wireguard.ValidFormat(format) {
+		writeError(w, http.StatusBadRequest, "format must be 'wg-quick', 'nmconnection', 'mikrotik', or 'systemd-networkd'")
+		return
+	}
+	iface := cmp.Or(r.URL.Query().Get("interface"), wireguard.DefaultInterface)
+	if !interfaceNameRegex.MatchString(iface) {
+		writeError(w, http.StatusBadRequest, "interface must be 1-15 letters, digits, '.', '_', or '-'")
+		return
+	}
+
+	// ?port= picks one of the server's endpoints on WG_ALT_PORTS
+	endpoint := ""
+	if portStr := r.URL.Query().Get("port"); portStr != "" {
+		endpoints := s.serverEndpoints(tunnel)
+		if endpoints == nil {
+			_, current := s.serverFor(tunnel)
+			endpoints = []string{current}
+		}
+		host, _, _ := net.SplitHostPort(endpoints[0])
+		if endpoint = net.JoinHostPort(host, portStr); !slices.Contains(endpoints, endpoint) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("port must be that of one of the server's endpoints: %s", strings.Join(endpoints, ", ")))
+			return
+		}
+	}
 
-	config := fmt.Sprintf(`[Interface]
-PrivateKey = <your-private-key>
-Address = %s/32
-DNS = 1.1.1.1
+	// ?transport=tcp reaches the server through the WireGuard over TCP
+	// fallback, for networks that block UDP
+	var fallback *wireguard.Fallback
+	switch r.URL.Query().Get("transport") {
+	case "", "udp":
+	case "tcp":
+		f, ok := s.wgFallback()
+		switch {
+		case !ok:
+			writeError(w, http.StatusBadRequest, "no WireGuard over TCP fallback is configured (WG_FALLBACK_TRANSPORT)")
+			return
+		case tunnel.NodeID != "":
+			writeError(w, http.StatusBadRequest, "the TCP fallback only reaches tunnels of the control plane's own server")
+			return
+		case cmp.Or(routing, tunnel.ClientRouting) == wireguard.RoutingFull:
+			writeError(w, http.StatusBadRequest, "the TCP fallback cannot be used with full routing, which would send the relay's own connection into the tunnel")
+			return
+		}
+		if endpoint != "" {
+			writeError(w, http.StatusBadRequest, "port cannot be combined with transport=tcp")
+			return
+		}
+		fallback = &f
+	default:
+		writeError(w, http.StatusBadRequest, "transport must be 'udp' or 'tcp'")
+		return
+	}
 
-[Peer]
-PublicKey = %s
-Endpoint = %s
-AllowedIPs = %s/32
-PersistentKeepalive = 25
-`, tunnel.VpnIP, serverPubKey, s.cfg.ServerEndpoint, s.cfg.WGServerIP)
+	// The private key is only known for server-generated keys (Flow A),
+	// within the escrow window after a create or rotate. Otherwise return a
+	// template for the client to fill in.
+	peer := s.peerConfig(tunnel, wireguard.PrivateKeyPlaceholder, "", routing)
+	if key, ok := s.escrow.get(id); ok {
+		peer = s.peerConfig(tunnel, key.privateKey, key.psk, routing)
+	}
+	if endpoint != "" {
+		peer.ServerEndpoint, peer.Notes = endpoint, endpointNote(endpoint, s.serverEndpoints(tunnel))
+	}
+	if fallback != nil {
+		peer = peer.Via(*fallback)
+	}
+	config, err := peer.RenderFormat(format, iface)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to render config: %v", err))
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.conf", id))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s%s", id, configFileExtensions[format]))
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(config))
 }
 
+// interfaceNameRegex validates client interface names, which Linux caps at
+// 15 bytes.
+var interfaceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{1,15}$`)
+
+// configFileExtensions maps config formats to the extension of the
+// downloaded file.
+var configFileExtensions = map[string]string{
+	wireguard.FormatWGQuick:         ".conf",
+	wireguard.FormatNMConnection:    ".nmconnection",
+	wireguard.FormatMikroTik:        ".rsc",
+	wireguard.FormatSystemdNetworkd: ".networkd.txt",
+}
+
 func (s *Server) handleGetTunnelQR(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
@@ -292,25 +1361,38 @@ func (s *Server) handleGetTunnelQR(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tunnel, err := s.tunnelStore.Get(id)
-	if err != nil {
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
 		writeError(w, http.StatusNotFound, "tunnel not found")
 		return
 	}
 
-	serverPubKey, _ := s.wgManager.GetServerPublicKey()
-
-	config := fmt.Sprintf(`[Interface]
-PrivateKey = <your-private-key>
-Address = %s/32
-DNS = 1.1.1.1
+	routing := r.URL.Query().Get("routing")
+	if err := validateClientRouting("routing", routing); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-[Peer]
-PublicKey = %s
-Endpoint = %s
-AllowedIPs = %s/32
-PersistentKeepalive = 25
-`, tunnel.VpnIP, serverPubKey, s.cfg.ServerEndpoint, s.cfg.WGServerIP)
+	// A QR code is scanned straight into a client, so unlike the config
+	// download it is useless with a placeholder private key
+	key, ok := s.escrow.get(id)
+	switch {
+	case ok:
+	case tunnel.ClientKey:
+		writeError(w, http.StatusConflict, fmt.Sprintf("tunnel %s uses a client-generated key, which the server never sees; "+
+			"download GET /api/v1/tunnels/%s/config, fill in the private key, and make the QR code on the client", id, id))
+		return
+	case tunnel.ServerKey:
+		writeError(w, http.StatusGone, fmt.Sprintf("the private key of tunnel %s is only kept for %s after it is created or rotated; "+
+			"rotate the tunnel for a new config", id, s.cfg.KeyEscrow))
+		return
+	default:
+		// Created before the origin of keys was recorded
+		writeError(w, http.StatusGone, fmt.Sprintf("the server does not hold the private key of tunnel %s, which predates key escrow; "+
+			"rotate the tunnel for a new config, or make the QR code on the client if it generated the key", id))
+		return
+	}
+	config := s.clientConfig(tunnel, key.privateKey, key.psk, routing)
 
 	png, err := qrcode.Encode(config, qrcode.Medium, 512)
 	if err != nil {
@@ -330,11 +1412,19 @@ func (s *Server) handleRotateTunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tunnel, err := s.tunnelStore.Get(id)
-	if err != nil {
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
 		writeError(w, http.StatusNotFound, "tunnel not found")
 		return
 	}
+	if tunnel.NodeID != "" {
+		writeError(w, http.StatusConflict, "key rotation is not supported for tunnels on remote nodes; recreate the tunnel instead")
+		return
+	}
+	if tunnel.PendingApproval {
+		writeError(w, http.StatusConflict, "tunnel is awaiting approval; reject it and create a new one instead")
+		return
+	}
 
 	// Generate new keypair and PSK
 	newPrivKey, newPubKey, err := wireguard.GenerateKeyPair()
@@ -350,7 +1440,8 @@ func (s *Server) handleRotateTunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add new peer to WireGuard (same VPN IP, new keys)
-	if err := s.wgManager.AddPeer(newPubKey, newPSK, tunnel.VpnIP); err != nil {
+	keepalive := tunnel.Keepalive(s.cfg.WGKeepalive)
+	if err := s.wgManager.AddPeer(newPubKey, newPSK, tunnel.VpnIP, tunnel.AdvertisedRoutes, keepalive); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to add new WG peer: %v", err))
 		return
 	}
@@ -368,17 +1459,23 @@ func (s *Server) handleRotateTunnel(w http.ResponseWriter, r *http.Request) {
 		AutoRevokeInactive:      tunnel.AutoRevokeInactive,
 		InactiveExpiryDays:      tunnel.InactiveExpiryDays,
 		GracePeriodMinutes:      tunnel.GracePeriodMinutes,
+		PersistentKeepalive:     tunnel.PersistentKeepalive,
+		ConnectedThreshold:      tunnel.ConnectedThreshold,
+		ClientRouting:           tunnel.ClientRouting,
+		ClientDNS:               tunnel.ClientDNS,
+		ClientMTU:               tunnel.ClientMTU,
+		AdvertisedRoutes:        tunnel.AdvertisedRoutes,
 	}
 
 	// Mark the old tunnel as having a pending rotation
-	if err := s.tunnelStore.SetPendingRotation(id, newTunnelID); err != nil {
+	if err := s.tunnels(r).SetPendingRotation(id, newTunnelID); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to set pending rotation: %v", err))
 		return
 	}
 
 	// Build new config
-	serverPubKey, _ := s.wgManager.GetServerPublicKey()
-	config := buildWGConfig(newPrivKey, tunnel.VpnIP, serverPubKey, newPSK, s.cfg.ServerEndpoint)
+	config := s.clientConfig(tunnel, newPrivKey, newPSK, "")
+	s.escrow.put(id, newPrivKey, newPSK, s.cfg.KeyEscrow)
 
 	_ = newTunnel // Rotation creates a pending state, actual cutover happens after grace period
 
@@ -390,23 +1487,70 @@ func (s *Server) handleRotateTunnel(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s *Server) handleUpdateRotationPolicy(w http.ResponseWriter, r *http.Request) {
+// deferRevocationRequest represents the request body for
+// POST /api/v1/tunnels/{id}/defer-revocation.
+type deferRevocationRequest struct {
+	Days int `json:"days"`
+}
+
+// maxDeferDays bounds how far a single override can push out revocation.
+const maxDeferDays = 365
+
+func (s *Server) handleDeferRevocation(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
 		writeError(w, http.StatusBadRequest, "tunnel id is required")
 		return
 	}
 
-	var req struct {
-		AutoRotatePSK           *bool `json:"auto_rotate_psk,omitempty"`
-		PSKRotationIntervalDays *int  `json:"psk_rotation_interval_days,omitempty"`
-		AutoRevokeInactive      *bool `json:"auto_revoke_inactive,omitempty"`
-		InactiveExpiryDays      *int  `json:"inactive_expiry_days,omitempty"`
-		GracePeriodMinutes      *int  `json:"grace_period_minutes,omitempty"`
+	var req deferRevocationRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Days < 1 || req.Days > maxDeferDays {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", maxDeferDays))
+		return
+	}
+
+	if tunnel, err := s.tunnels(r).Get(id); err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+
+	until := time.Now().Add(time.Duration(req.Days) * 24 * time.Hour)
+	tunnel, err := s.tunnels(r).DeferRevocation(id, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to defer revocation: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tunnel_id":             id,
+		"revoke_deferred_until": formatTimePtr(tunnel.RevokeDeferredUntil),
+		"revocation_at":         formatTimePtr(tunnel.RevocationAt()),
+		"expiring_soon":         tunnel.ExpiringSoon(time.Now(), s.cfg.InactivityWarning),
+	})
+}
+
+// updateRotationPolicyRequest represents the request body for
+// PATCH /api/v1/tunnels/{id}/rotation-policy. Omitted fields are left unchanged.
+type updateRotationPolicyRequest struct {
+	AutoRotatePSK           *bool `json:"auto_rotate_psk,omitempty"`
+	PSKRotationIntervalDays *int  `json:"psk_rotation_interval_days,omitempty"`
+	AutoRevokeInactive      *bool `json:"auto_revoke_inactive,omitempty"`
+	InactiveExpiryDays      *int  `json:"inactive_expiry_days,omitempty"`
+	GracePeriodMinutes      *int  `json:"grace_period_minutes,omitempty"`
+}
+
+func (s *Server) handleUpdateRotationPolicy(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "tunnel id is required")
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON body")
+	var req updateRotationPolicyRequest
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
@@ -424,7 +1568,17 @@ func (s *Server) handleUpdateRotationPolicy(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	updated, err := s.tunnelStore.UpdateRotationPolicy(
+	defer s.lockIfMatch(r)()
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	if !checkIfMatch(w, r, tunnelETag(tunnel)) {
+		return
+	}
+
+	updated, err := s.tunnels(r).UpdateRotationPolicy(
 		id, req.AutoRotatePSK, req.PSKRotationIntervalDays,
 		req.AutoRevokeInactive, req.InactiveExpiryDays, req.GracePeriodMinutes,
 	)
@@ -451,6 +1605,7 @@ func (s *Server) handleUpdateRotationPolicy(w http.ResponseWriter, r *http.Reque
 		nextRotation = &nextStr
 	}
 
+	w.Header().Set("ETag", tunnelETag(updated))
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"tunnel_id":                   id,
 		"auto_rotate_psk":             updated.AutoRotatePSK,
@@ -460,6 +1615,7 @@ func (s *Server) handleUpdateRotationPolicy(w http.ResponseWriter, r *http.Reque
 		"grace_period_minutes":        updated.GracePeriodMinutes,
 		"last_rotation_at":            formatTimePtr(updated.LastRotationAt),
 		"next_rotation_at":            nextRotation,
+		"etag":                        tunnelETag(updated),
 	})
 }
 
@@ -470,8 +1626,8 @@ func (s *Server) handleGetRotationPolicy(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	tunnel, err := s.tunnelStore.Get(id)
-	if err != nil {
+	tunnel, err := s.tunnels(r).Get(id)
+	if err != nil || !identityFrom(r.Context()).canAccess(tunnel.TenantID) {
 		writeError(w, http.StatusNotFound, "tunnel not found")
 		return
 	}
@@ -489,6 +1645,7 @@ func (s *Server) handleGetRotationPolicy(w http.ResponseWriter, r *http.Request)
 		nextRotation = &nextStr
 	}
 
+	w.Header().Set("ETag", tunnelETag(tunnel))
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"tunnel_id":                   id,
 		"auto_rotate_psk":             tunnel.AutoRotatePSK,
@@ -498,32 +1655,338 @@ func (s *Server) handleGetRotationPolicy(w http.ResponseWriter, r *http.Request)
 		"grace_period_minutes":        tunnel.GracePeriodMinutes,
 		"last_rotation_at":            formatTimePtr(tunnel.LastRotationAt),
 		"next_rotation_at":            nextRotation,
+		"etag":                        tunnelETag(tunnel),
 	})
 }
 
-// buildWGConfig creates a WireGuard client config file content.
-func buildWGConfig(privateKey, vpnIP, serverPubKey, psk, serverEndpoint string) string {
-	return fmt.Sprintf(`[Interface]
-PrivateKey = %s
-Address = %s/32
-DNS = 1.1.1.1
+// normalizeSourceCIDR validates a tunnel source restriction and returns it in
+// canonical form. An empty string means no restriction.
+func normalizeSourceCIDR(cidr string) (string, error) {
+	if cidr == "" {
+		return "", nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid source_cidr: %q", cidr)
+	}
+	return prefix.Masked().String(), nil
+}
+
+// maxConnectedThreshold bounds a tunnel's connected threshold, in seconds.
+const maxConnectedThreshold = 86400
+
+// validateConnectionSettings checks a requested keepalive and connected
+// threshold, either of which may be nil.
+func validateConnectionSettings(keepalive, connectedThreshold *int) error {
+	if keepalive != nil && (*keepalive < 0 || *keepalive > 65535) {
+		return fmt.Errorf("persistent_keepalive must be between 0 and 65535 seconds")
+	}
+	if connectedThreshold != nil && (*connectedThreshold < 1 || *connectedThreshold > maxConnectedThreshold) {
+		return fmt.Errorf("connected_threshold must be between 1 and %d seconds", maxConnectedThreshold)
+	}
+	return nil
+}
+
+// validateClientRouting checks a client routing mode given in field; ""
+// keeps the default.
+func validateClientRouting(field, mode string) error {
+	if mode != "" && !wireguard.ValidRouting(mode) {
+		return fmt.Errorf("%s must be one of split, subnet, full", field)
+	}
+	return nil
+}
+
+// Length limits of tunnel notes, in characters.
+const (
+	maxDescriptionLen = 1024
+	maxDeviceNameLen  = 128
+)
+
+// validateNotes checks the notes of a tunnel; "" leaves a note out.
+func validateNotes(description, ownerEmail, deviceName string) error {
+	if utf8.RuneCountInString(description) > maxDescriptionLen {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLen)
+	}
+	if ownerEmail != "" {
+		addr, err := mail.ParseAddress(ownerEmail)
+		if err != nil || addr.Address != ownerEmail || addr.Name != "" {
+			return fmt.Errorf("owner_email must be an email address such as alice@example.com")
+		}
+	}
+	if utf8.RuneCountInString(deviceName) > maxDeviceNameLen {
+		return fmt.Errorf("device_name must be at most %d characters", maxDeviceNameLen)
+	}
+	if strings.ContainsFunc(deviceName, unicode.IsControl) {
+		return fmt.Errorf("device_name must not contain control characters")
+	}
+	return nil
+}
+
+// parseExpiresAt parses the RFC 3339 expiry date of a tunnel, which must lie
+// in the future. "" means no expiry date.
+func parseExpiresAt(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("expires_at must be an RFC 3339 time such as 2025-12-31T18:00:00Z")
+	}
+	if !at.After(time.Now()) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+	return &at, nil
+}
+
+// deref returns *s, or "" for nil.
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// validateStaticVPNIP checks a requested VPN IP: it must be a host address
+// of the VPN subnet other than the server's, and unused. It returns the
+// address in canonical form, or the status to reject it with.
+func (s *Server) validateStaticVPNIP(ip string) (string, int, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return "", http.StatusBadRequest, fmt.Errorf("vpn_ip must be an IPv4 address")
+	}
+	subnet, err := netip.ParsePrefix(s.cfg.WGSubnet)
+	if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("invalid WG_SUBNET")
+	}
+	subnet = subnet.Masked()
+	if !subnet.Contains(addr) {
+		return "", http.StatusBadRequest, fmt.Errorf("vpn_ip must be in %s", subnet)
+	}
+	if addr == subnet.Addr() || addr == lastAddr(subnet) {
+		return "", http.StatusBadRequest, fmt.Errorf("vpn_ip cannot be the network or broadcast address")
+	}
+	if addr.String() == s.cfg.WGServerIP {
+		return "", http.StatusBadRequest, fmt.Errorf("vpn_ip is the server's address")
+	}
+	holder, err := s.tunnelStore.VpnIPHolder(addr.String())
+	if err != nil {
+		return "", http.StatusInternalServerError, fmt.Errorf("failed to check vpn_ip")
+	}
+	if holder != nil && holder.DeletedAt != nil {
+		return "", http.StatusConflict, fmt.Errorf("vpn_ip %s is held by deleted tunnel %s until it is purged; restore it instead", addr, holder.ID)
+	}
+	if holder != nil {
+		return "", http.StatusConflict, fmt.Errorf("vpn_ip %s is already used by another tunnel", addr)
+	}
+	return addr.String(), http.StatusOK, nil
+}
+
+// lastAddr returns the highest address of an IPv4 prefix.
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As4()
+	host := uint32(1)<<(32-p.Bits()) - 1
+	v := uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3]) | host
+	return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+// maxUpstreamPortRanges bounds the allowed upstream port ranges of a tunnel.
+const maxUpstreamPortRanges = 16
 
-[Peer]
-PublicKey = %s
-PresharedKey = %s
-Endpoint = %s
-AllowedIPs = 10.0.0.1/32
-PersistentKeepalive = 25
-`, privateKey, vpnIP, serverPubKey, psk, serverEndpoint)
+// validateUpstreamPorts checks the allowed upstream ports requested for a
+// tunnel. A range without an end is a single port.
+func validateUpstreamPorts(ranges []store.PortRange) ([]store.PortRange, error) {
+	if len(ranges) > maxUpstreamPortRanges {
+		return nil, fmt.Errorf("allowed_upstream_ports accepts at most %d entries", maxUpstreamPortRanges)
+	}
+	var valid []store.PortRange
+	for _, pr := range ranges {
+		if pr.End == 0 {
+			pr.End = pr.Start
+		}
+		if pr.Start < 1 || pr.End > 65535 || pr.Start > pr.End {
+			return nil, fmt.Errorf("invalid allowed upstream port range %d-%d: ports must be between 1 and 65535 and start must not exceed end", pr.Start, pr.End)
+		}
+		valid = append(valid, pr)
+	}
+	return valid, nil
+}
+
+// checkRoutesUpstream returns an error if a route of the tunnel forwards to
+// a port outside ports, which it would no longer reach.
+func (s *Server) checkRoutesUpstream(r *http.Request, tunnelID string, ports []store.PortRange) (int, error) {
+	if len(ports) == 0 {
+		return http.StatusOK, nil
+	}
+	routes, err := s.routes(r).ListByTunnelID(tunnelID)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to list routes: %v", err)
+	}
+	for _, route := range routes {
+		// A port range forwards to as many consecutive upstream ports
+		_, start := caddy.SplitUpstream(route.Upstream)
+		end := 0
+		if route.ListenPortEnd > route.ListenPort {
+			end = start + route.ListenPortEnd - route.ListenPort
+		}
+		if !portsAllowed(ports, store.PortRange{Start: start, End: max(start, end)}) {
+			return http.StatusForbidden, fmt.Errorf("route %s forwards to upstream port %s, outside allowed_upstream_ports", route.ID, portSpan(start, end))
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// maxAdvertisedRoutes bounds the LAN prefixes one tunnel may advertise.
+const maxAdvertisedRoutes = 16
+
+// minAdvertisedRouteBits is the shortest advertised prefix: anything broader
+// would take over large parts of the host's routing table.
+const minAdvertisedRouteBits = 8
+
+// reservedRoutePrefixes can never be advertised: the host's own, link-local
+// (including cloud metadata at 169.254.169.254), multicast, and reserved
+// addresses.
+var reservedRoutePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// validateAdvertisedRoutes checks the LAN prefixes requested for a tunnel:
+// IPv4 CIDRs of at least /8 that overlap neither the VPN subnet, reserved
+// ranges, the host's own networks and routes, each other, nor any other
+// tunnel's advertised routes. Only admins may advertise routes. tunnelID is
+// the tunnel being updated, or "" for a new one. It returns the prefixes in
+// canonical form, or the status to reject them with.
+func (s *Server) validateAdvertisedRoutes(r *http.Request, tunnelID string, routes []string) ([]string, int, error) {
+	if len(routes) > maxAdvertisedRoutes {
+		return nil, http.StatusBadRequest, fmt.Errorf("advertised_routes accepts at most %d entries", maxAdvertisedRoutes)
+	}
+	if len(routes) > 0 && identityFrom(r.Context()).Role < roleAdmin {
+		return nil, http.StatusForbidden, fmt.Errorf("advertised_routes requires the admin role")
+	}
+	subnet, err := netip.ParsePrefix(s.cfg.WGSubnet)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("invalid WG_SUBNET")
+	}
+	prefixes := make([]netip.Prefix, 0, len(routes))
+	for _, r := range routes {
+		p, err := netip.ParsePrefix(r)
+		if err != nil || !p.Addr().Is4() {
+			return nil, http.StatusBadRequest, fmt.Errorf("advertised route %q must be an IPv4 CIDR", r)
+		}
+		p = p.Masked()
+		if p.Bits() < minAdvertisedRouteBits {
+			return nil, http.StatusBadRequest, fmt.Errorf("advertised route %s is broader than /%d", p, minAdvertisedRouteBits)
+		}
+		if p.Overlaps(subnet) {
+			return nil, http.StatusBadRequest, fmt.Errorf("advertised route %s overlaps the VPN subnet %s", p, subnet.Masked())
+		}
+		for _, reserved := range reservedRoutePrefixes {
+			if p.Overlaps(reserved) {
+				return nil, http.StatusBadRequest, fmt.Errorf("advertised route %s overlaps reserved range %s", p, reserved)
+			}
+		}
+		for _, q := range prefixes {
+			if p.Overlaps(q) {
+				return nil, http.StatusBadRequest, fmt.Errorf("advertised routes %s and %s overlap", q, p)
+			}
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	if len(prefixes) == 0 {
+		return []string{}, http.StatusOK, nil
+	}
+	host, err := s.wgManager.HostPrefixes()
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to check advertised routes")
+	}
+	tunnels, err := s.tunnelStore.List()
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to check advertised routes")
+	}
+	normalized := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		for _, q := range host {
+			if p.Overlaps(q) {
+				return nil, http.StatusConflict, fmt.Errorf("advertised route %s overlaps the host's network or route %s", p, q)
+			}
+		}
+		for _, t := range tunnels {
+			if t.ID == tunnelID {
+				continue
+			}
+			for _, other := range t.AdvertisedRoutes {
+				if q, err := netip.ParsePrefix(other); err == nil && p.Overlaps(q) {
+					return nil, http.StatusConflict, fmt.Errorf("advertised route %s overlaps %s of tunnel %s", p, q, t.ID)
+				}
+			}
+		}
+		normalized = append(normalized, p.String())
+	}
+	return normalized, http.StatusOK, nil
+}
+
+// maxClientDNS bounds the DNS entries of a client config.
+const maxClientDNS = 8
+
+// validateClientInterface checks the DNS entries and MTU requested for a
+// tunnel's client configs.
+func validateClientInterface(dns []string, mtu int) error {
+	if len(dns) > maxClientDNS {
+		return fmt.Errorf("dns accepts at most %d entries", maxClientDNS)
+	}
+	for _, d := range dns {
+		if _, err := netip.ParseAddr(d); err == nil {
+			continue
+		}
+		// wg-quick treats anything else as a search domain
+		if strings.HasPrefix(d, "*.") || !sniRegex.MatchString(d) {
+			return fmt.Errorf("dns entry %q must be an IP address or a domain", d)
+		}
+	}
+	if mtu != 0 && (mtu < 576 || mtu > 9000) {
+		return fmt.Errorf("mtu must be between 576 and 9000")
+	}
+	return nil
+}
+
+// validateLabels checks label keys and values for a tunnel.
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKeyRegex.MatchString(k) {
+			return fmt.Errorf("invalid label key: %q", k)
+		}
+		if len(v) > maxLabelValueLen {
+			return fmt.Errorf("label %q value exceeds %d characters", k, maxLabelValueLen)
+		}
+	}
+	return nil
+}
+
+// parseLabelSelector parses repeated ?label=key=value query parameters into a selector.
+func parseLabelSelector(params []string) (map[string]string, error) {
+	selector := make(map[string]string, len(params))
+	for _, p := range params {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label selector %q: expected key=value", p)
+		}
+		selector[k] = v
+	}
+	return selector, nil
 }
 
-// extractSubnetPrefix extracts the first 3 octets of an IP (e.g., "10.0.0" from "10.0.0.1").
-func extractSubnetPrefix(ip string) string {
-	parts := strings.Split(ip, ".")
-	if len(parts) >= 3 {
-		return strings.Join(parts[:3], ".")
+// inVPNSubnet reports whether ip is an address in WG_SUBNET.
+func (s *Server) inVPNSubnet(ip string) bool {
+	subnet, err := netip.ParsePrefix(s.cfg.WGSubnet)
+	if err != nil {
+		return false
 	}
-	return "10.0.0"
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && subnet.Contains(addr)
 }
 
 // formatTimePtr formats a *time.Time as RFC3339 or returns nil.
@@ -533,3 +1996,27 @@ func formatTimePtr(t *time.Time) interface{} {
 	}
 	return t.UTC().Format(time.RFC3339)
 }
+
+// rollback collects compensating actions for a multi-step operation that
+// spans the kernel, Caddy, and SQLite, which cannot share a transaction.
+type rollback []rollbackStep
+
+type rollbackStep struct {
+	name string
+	fn   func() error
+}
+
+// add registers the undo action for a step that just succeeded.
+func (rb *rollback) add(name string, fn func() error) {
+	*rb = append(*rb, rollbackStep{name: name, fn: fn})
+}
+
+// run undoes the registered steps in reverse order. Failures are logged and
+// left for the reconciler, which converges the kernel and Caddy on SQLite.
+func (rb rollback) run() {
+	for i := len(rb) - 1; i >= 0; i-- {
+		if err := rb[i].fn(); err != nil {
+			fmt.Printf("warning: rollback: failed to %s: %v\n", rb[i].name, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Package audit copies the audit log to sinks outside SQLite, so the trail
+// survives loss of the database and can feed a SIEM.
+//
+// SQLite stays the primary audit store; sinks receive the same entries as
+// they are written.
+package audit
+
+import (
+	"errors"
+	"time"
+)
+
+// Event is one audit log entry as delivered to sinks.
+type Event struct {
+	Time        time.Time `json:"time"`
+	ClientCN    string    `json:"client_cn,omitempty"`
+	SourceIP    string    `json:"source_ip,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	BodyHash    string    `json:"body_hash,omitempty"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+	RequestBody string    `json:"request_body,omitempty"`
+	Diff        string    `json:"diff,omitempty"`
+}
+
+// Sink receives audit events. Write must not block on slow receivers for
+// long, since it runs on the request path.
+type Sink interface {
+	Write(e Event) error
+	Close() error
+}
+
+// Multi is a Sink that writes to every sink it holds.
+type Multi []Sink
+
+// Write delivers e to every sink and returns the combined error of those
+// that failed.
+func (m Multi) Write(e Event) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink.
+func (m Multi) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
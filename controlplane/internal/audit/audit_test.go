@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/notify"
+)
+
+func readEvents(t *testing.T, path string) []Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []Event
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("invalid line %q: %v", sc.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	e := Event{Time: time.Unix(1700000000, 0).UTC(), Method: "POST", Path: "/api/v1/tunnels", Result: "ok"}
+	line, _ := json.Marshal(e)
+
+	// Room for two events per file, keeping two rotated files
+	s, err := NewFileSink(path, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := s.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	for file, want := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		if got := len(readEvents(t, file)); got != want {
+			t.Errorf("%s: expected %d events, got %d", filepath.Base(file), want, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only two rotated files to be kept")
+	}
+	if err := s.Write(e); err == nil {
+		t.Error("expected error writing to a closed sink")
+	}
+}
+
+func TestHTTPSinkDeliversSigned(t *testing.T) {
+	got := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if want := "sha256=" + notify.Sign([]byte("k"), body); r.Header.Get(notify.SignatureHeader) != want {
+			t.Errorf("bad signature %q", r.Header.Get(notify.SignatureHeader))
+		}
+		var e Event
+		json.Unmarshal(body, &e)
+		got <- e
+	}))
+	defer srv.Close()
+
+	s := NewHTTPSink(srv.URL, "k")
+	if err := (Multi{s}).Write(Event{Method: "DELETE", Path: "/api/v1/routes/r1", Result: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	select {
+	case e := <-got:
+		if e.Path != "/api/v1/routes/r1" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	default:
+		t.Fatal("expected the queued event to be delivered before Close returns")
+	}
+}
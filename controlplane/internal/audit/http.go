@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/notify"
+)
+
+// httpQueueSize is how many events an HTTPSink buffers while the receiver
+// is slow or down. Events beyond it are dropped and reported.
+const httpQueueSize = 1024
+
+// HTTPSink POSTs each event as JSON to a collector URL. Delivery happens in
+// the background so a slow collector does not delay API requests; when
+// secret is set, requests carry the same HMAC signature header as webhooks.
+type HTTPSink struct {
+	url        string
+	secret     []byte
+	httpClient *http.Client
+	logger     *slog.Logger
+
+	queue chan Event
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewHTTPSink starts a sink delivering to url.
+func NewHTTPSink(url, secret string) *HTTPSink {
+	s := &HTTPSink{
+		url:        url,
+		secret:     []byte(secret),
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		logger:     slog.Default(),
+		queue:      make(chan Event, httpQueueSize),
+		done:       make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write implements Sink. It only queues the event.
+func (s *HTTPSink) Write(e Event) error {
+	select {
+	case s.queue <- e:
+		return nil
+	default:
+		return errors.New("audit HTTP queue full, event dropped")
+	}
+}
+
+func (s *HTTPSink) run() {
+	defer close(s.done)
+	for e := range s.queue {
+		// Retry briefly; a collector outage longer than this loses events,
+		// which remain in SQLite and any other sink
+		for attempt := 0; attempt < 3; attempt++ {
+			err := s.post(e)
+			if err == nil {
+				break
+			}
+			if attempt == 2 {
+				s.logger.Error("failed to forward audit event", "url", s.url, "path", e.Path, "error", err)
+				break
+			}
+			time.Sleep(time.Duration(attempt+1) * time.Second)
+		}
+	}
+}
+
+func (s *HTTPSink) post(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode audit event: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.secret) > 0 {
+		req.Header.Set(notify.SignatureHeader, "sha256="+notify.Sign(s.secret, body))
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close implements Sink. It delivers the queued events before returning.
+func (s *HTTPSink) Close() error {
+	s.once.Do(func() { close(s.queue) })
+	<-s.done
+	return nil
+}
@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+)
+
+// SyslogSink sends each event as a JSON message to syslog with facility
+// authpriv, so it lands with other security logs.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog daemon at addr over network ("udp"
+// or "tcp"), or to the local daemon if network is empty.
+func NewSyslogSink(network, addr string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "proxy-manager-audit")
+	if err != nil {
+		return nil, fmt.Errorf("connect to syslog: %w", err)
+	}
+	return &SyslogSink{w: w}, nil
+}
+
+// Write implements Sink. Failed requests are logged at warning level.
+func (s *SyslogSink) Write(e Event) error {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode audit event: %w", err)
+	}
+	if e.Result == "error" {
+		err = s.w.Warning(string(msg))
+	} else {
+		err = s.w.Notice(string(msg))
+	}
+	if err != nil {
+		return fmt.Errorf("write to syslog: %w", err)
+	}
+	return nil
+}
+
+// Close implements Sink.
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
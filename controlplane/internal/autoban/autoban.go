@@ -0,0 +1,226 @@
+// Package autoban temporarily bans source IPs that cause too many warnings
+// or errors in Caddy's JSON log, in the spirit of fail2ban.
+//
+// The Watcher only records bans in SQLite. The reconciler turns active bans
+// into nftables drop rules and removes them once they expire.
+package autoban
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// Options configures a Watcher.
+type Options struct {
+	LogFile   string         // Caddy JSON log to follow
+	Threshold int            // Events within Window that trigger a ban
+	Window    time.Duration  // Sliding window events are counted in
+	Duration  time.Duration  // How long a ban lasts
+	Ignore    []netip.Prefix // Sources that are never banned
+}
+
+// Watcher follows a Caddy log file and bans abusive sources.
+type Watcher struct {
+	opts   Options
+	store  *store.FirewallStore
+	onBan  func()
+	logger *slog.Logger
+	now    func() time.Time
+
+	file   os.FileInfo // the file offset refers to
+	offset int64
+	events map[netip.Addr][]time.Time
+	banned map[netip.Addr]time.Time // ban expiry, to skip sources already banned
+}
+
+// New creates a Watcher that records bans in fs.
+func New(fs *store.FirewallStore, opts Options) *Watcher {
+	return &Watcher{
+		opts:   opts,
+		store:  fs,
+		onBan:  func() {},
+		logger: slog.Default(),
+		now:    time.Now,
+		events: make(map[netip.Addr][]time.Time),
+		banned: make(map[netip.Addr]time.Time),
+	}
+}
+
+// SetOnBan sets a function called after a ban is recorded, typically to
+// apply it right away instead of at the next reconciliation.
+func (w *Watcher) SetOnBan(f func()) {
+	w.onBan = f
+}
+
+// Run follows the log until ctx is canceled. Only lines written after Run
+// starts are considered; a file that is replaced or truncated (log rotation)
+// is read again from the beginning.
+func (w *Watcher) Run(ctx context.Context) {
+	if fi, err := os.Stat(w.opts.LogFile); err == nil {
+		w.file, w.offset = fi, fi.Size()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.poll(); err != nil {
+				w.logger.Warn("failed to read log for automatic bans", "file", w.opts.LogFile, "error", err)
+			}
+		}
+	}
+}
+
+// poll reads the complete lines appended since the last call.
+func (w *Watcher) poll() error {
+	f, err := os.Open(w.opts.LogFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if w.file == nil || !os.SameFile(w.file, fi) || fi.Size() < w.offset {
+		w.offset = 0
+	}
+	w.file = fi
+	if _, err := f.Seek(w.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// A partial last line is read again once it is complete
+			break
+		}
+		w.offset += int64(len(line))
+		w.handle(line)
+	}
+	w.prune()
+	return nil
+}
+
+// handle counts a log line against its source and bans the source once it
+// reaches the threshold.
+func (w *Watcher) handle(line []byte) {
+	ip, ok := sourceOf(line)
+	if !ok || w.ignored(ip) {
+		return
+	}
+	now := w.now()
+	if until, ok := w.banned[ip]; ok && now.Before(until) {
+		return
+	}
+
+	events := append(recent(w.events[ip], now.Add(-w.opts.Window)), now)
+	if len(events) < w.opts.Threshold {
+		w.events[ip] = events
+		return
+	}
+	delete(w.events, ip)
+
+	ban := &store.Ban{
+		IP:        ip.String(),
+		Reason:    fmt.Sprintf("%d errors in %s", len(events), w.opts.Window),
+		Hits:      len(events),
+		CreatedAt: now,
+		ExpiresAt: now.Add(w.opts.Duration),
+	}
+	if err := w.store.AddBan(ban); err != nil {
+		w.logger.Error("failed to record ban", "ip", ban.IP, "error", err)
+		return
+	}
+	w.banned[ip] = ban.ExpiresAt
+	w.logger.Warn("banned source IP", "ip", ban.IP, "reason", ban.Reason, "until", ban.ExpiresAt)
+	w.onBan()
+}
+
+func (w *Watcher) ignored(ip netip.Addr) bool {
+	for _, p := range w.opts.Ignore {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune forgets sources without recent events and bans that have expired,
+// so memory stays bounded by the number of active sources.
+func (w *Watcher) prune() {
+	now := w.now()
+	for ip, events := range w.events {
+		if events = recent(events, now.Add(-w.opts.Window)); len(events) == 0 {
+			delete(w.events, ip)
+		} else {
+			w.events[ip] = events
+		}
+	}
+	for ip, until := range w.banned {
+		if !now.Before(until) {
+			delete(w.banned, ip)
+		}
+	}
+}
+
+// recent returns the events after since. events is in time order.
+func recent(events []time.Time, since time.Time) []time.Time {
+	for i, t := range events {
+		if t.After(since) {
+			return events[i:]
+		}
+	}
+	return events[:0]
+}
+
+// sourceOf returns the client address of a Caddy log entry at warn level or
+// above. Layer4 entries carry it as "remote"; HTTP entries as
+// request.remote_ip.
+func sourceOf(line []byte) (netip.Addr, bool) {
+	var entry struct {
+		Level      string `json:"level"`
+		Remote     string `json:"remote"`
+		RemoteAddr string `json:"remote_addr"`
+		RemoteIP   string `json:"remote_ip"`
+		Request    struct {
+			RemoteIP string `json:"remote_ip"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return netip.Addr{}, false
+	}
+	switch entry.Level {
+	case "warn", "error", "panic", "fatal":
+	default:
+		return netip.Addr{}, false
+	}
+	for _, v := range []string{entry.Remote, entry.RemoteAddr, entry.RemoteIP, entry.Request.RemoteIP} {
+		if v == "" {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(v); err == nil {
+			v = host
+		}
+		if ip, err := netip.ParseAddr(v); err == nil {
+			return ip.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,117 @@
+package autoban
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+func setupWatcher(t *testing.T) (*Watcher, *store.FirewallStore, string) {
+	t.Helper()
+	db, err := store.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	fs := store.NewFirewallStore(db)
+
+	logFile := filepath.Join(t.TempDir(), "caddy.log")
+	os.WriteFile(logFile, nil, 0o644)
+	w := New(fs, Options{
+		LogFile:   logFile,
+		Threshold: 3,
+		Window:    time.Minute,
+		Duration:  time.Hour,
+		Ignore:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+	})
+	return w, fs, logFile
+}
+
+func appendLog(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(strings.Join(lines, "\n") + "\n")
+}
+
+func TestWatcherBansAfterThreshold(t *testing.T) {
+	w, fs, logFile := setupWatcher(t)
+	now := time.Unix(1700000000, 0)
+	w.now = func() time.Time { return now }
+	bans := 0
+	w.SetOnBan(func() { bans++ })
+
+	const l4Err = `{"level":"error","logger":"layer4","msg":"handling connection","remote":"198.51.100.7:40112"}`
+	appendLog(t, logFile,
+		l4Err,
+		`{"level":"info","logger":"layer4","msg":"handling connection","remote":"198.51.100.7:40113"}`,
+		`{"level":"error","logger":"http.log.error","request":{"remote_ip":"198.51.100.7"}}`,
+		`{"level":"error","logger":"layer4","remote":"10.0.0.2:5000"}`,
+		`not json`,
+	)
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := fs.ListBans(now); len(active) != 0 || bans != 0 {
+		t.Fatalf("expected no ban below threshold, got %+v", active)
+	}
+
+	// The third error is written without its newline first
+	f, _ := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(l4Err)
+	f.Close()
+	w.poll()
+	if bans != 0 {
+		t.Fatal("a partial line must not be counted")
+	}
+	appendLog(t, logFile, "")
+	w.poll()
+
+	active, _ := fs.ListBans(now)
+	if len(active) != 1 || active[0].IP != "198.51.100.7" || !active[0].ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected 198.51.100.7 banned for an hour, got %+v", active)
+	}
+	if bans != 1 {
+		t.Errorf("expected onBan called once, got %d", bans)
+	}
+
+	// Further errors from a banned source don't extend the ban
+	appendLog(t, logFile, l4Err, l4Err, l4Err)
+	w.poll()
+	if bans != 1 {
+		t.Errorf("expected no second ban, got %d", bans)
+	}
+}
+
+func TestWatcherWindowAndRotation(t *testing.T) {
+	w, fs, logFile := setupWatcher(t)
+	now := time.Unix(1700000000, 0)
+	w.now = func() time.Time { return now }
+
+	const l4Err = `{"level":"warn","logger":"layer4","remote":"[2001:db8::7]:40112"}`
+	appendLog(t, logFile, l4Err, l4Err)
+	w.poll()
+
+	// Events older than the window no longer count
+	now = now.Add(2 * time.Minute)
+	os.WriteFile(logFile, nil, 0o644) // rotated
+	appendLog(t, logFile, l4Err)
+	w.poll()
+	if active, _ := fs.ListBans(now); len(active) != 0 {
+		t.Fatalf("expected no ban, got %+v", active)
+	}
+
+	appendLog(t, logFile, l4Err, l4Err)
+	w.poll()
+	if active, _ := fs.ListBans(now); len(active) != 1 || active[0].IP != "2001:db8::7" {
+		t.Errorf("expected 2001:db8::7 banned, got %+v", active)
+	}
+}
@@ -0,0 +1,251 @@
+// Package backup replicates the SQLite database to S3-compatible storage so
+// a rebuilt VPS can recover its full state.
+//
+// Each snapshot is a consistent copy of the database (VACUUM INTO),
+// gzipped and uploaded under <prefix>snapshots/. Snapshots whose
+// configuration did not change since the previous upload are skipped, so a
+// short interval costs little on an idle control plane. Stats, samples,
+// and other bookkeeping (see store.ContentDigest) are uploaded along with
+// the next change but do not cause an upload themselves.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// snapshotDir is where snapshots live under the configured prefix.
+const snapshotDir = "snapshots/"
+
+// Result describes one snapshot request.
+type Result struct {
+	Key      string    `json:"key"`
+	Size     int       `json:"size"`     // Compressed bytes
+	Uploaded bool      `json:"uploaded"` // false when nothing changed since the last upload
+	Time     time.Time `json:"time"`
+}
+
+// Replicator uploads database snapshots and prunes old ones.
+type Replicator struct {
+	db     *store.DB
+	s3     *S3
+	prefix string
+	retain int
+	logger *slog.Logger
+	now    func() time.Time
+
+	leaderCheck func() bool
+
+	mu       sync.Mutex // Serializes snapshots
+	lastHash [sha256.Size]byte
+	last     Result
+}
+
+// New creates a Replicator storing snapshots of db under prefix and keeping
+// the newest retain of them (0 keeps all).
+func New(db *store.DB, s3 *S3, prefix string, retain int) *Replicator {
+	return &Replicator{
+		db:     db,
+		s3:     s3,
+		prefix: normalizePrefix(prefix),
+		retain: retain,
+		logger: slog.Default(),
+		now:    time.Now,
+	}
+}
+
+// SetLeaderCheck makes periodic snapshots run only while isLeader reports
+// true, so standbys sharing the database do not upload duplicates.
+func (r *Replicator) SetLeaderCheck(isLeader func() bool) {
+	r.leaderCheck = isLeader
+}
+
+// Run takes a snapshot at start and then every interval until ctx is
+// canceled.
+func (r *Replicator) Run(ctx context.Context, interval time.Duration) {
+	r.runOnce(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.runOnce(ctx)
+		}
+	}
+}
+
+func (r *Replicator) runOnce(ctx context.Context) {
+	if r.leaderCheck != nil && !r.leaderCheck() {
+		return
+	}
+	res, err := r.Snapshot(ctx)
+	if err != nil {
+		r.logger.Error("database backup failed", "error", err)
+		return
+	}
+	if res.Uploaded {
+		r.logger.Info("database backed up", "key", res.Key, "bytes", res.Size)
+	}
+}
+
+// Snapshot copies the database and uploads it unless its configuration
+// matches the last upload, in which case the result names that upload.
+func (r *Replicator) Snapshot(ctx context.Context) (*Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dir, err := os.MkdirTemp("", "controlplane-backup-")
+	if err != nil {
+		return nil, fmt.Errorf("create snapshot directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.db")
+	if err := r.db.Snapshot(path); err != nil {
+		return nil, err
+	}
+	hash, err := store.ContentDigest(path)
+	if err != nil {
+		return nil, fmt.Errorf("hash snapshot: %w", err)
+	}
+	if r.last.Key != "" && hash == r.lastHash {
+		res := r.last
+		res.Uploaded = false
+		return &res, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(raw)
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compress snapshot: %w", err)
+	}
+
+	now := r.now().UTC()
+	key := r.prefix + snapshotDir + now.Format("20060102T150405.000Z") + ".db.gz"
+	if err := r.s3.Put(ctx, key, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("upload snapshot: %w", err)
+	}
+	r.lastHash = hash
+	r.last = Result{Key: key, Size: buf.Len(), Uploaded: true, Time: now}
+
+	// A failed prune only leaves extra snapshots behind
+	if err := r.prune(ctx); err != nil {
+		r.logger.Warn("failed to prune old backups", "error", err)
+	}
+
+	res := r.last
+	return &res, nil
+}
+
+// prune deletes all but the newest retain snapshots.
+func (r *Replicator) prune(ctx context.Context) error {
+	if r.retain <= 0 {
+		return nil
+	}
+	keys, err := snapshotKeys(ctx, r.s3, r.prefix)
+	if err != nil {
+		return err
+	}
+	for len(keys) > r.retain {
+		if err := r.s3.Delete(ctx, keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// Latest returns the key of the newest snapshot under prefix.
+func Latest(ctx context.Context, s3 *S3, prefix string) (string, error) {
+	keys, err := snapshotKeys(ctx, s3, normalizePrefix(prefix))
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", errors.New("no snapshots found")
+	}
+	return keys[len(keys)-1], nil
+}
+
+// Restore downloads the snapshot key (the newest if empty) and writes it
+// as a database at path, which must not exist yet. It returns the key
+// restored.
+func Restore(ctx context.Context, s3 *S3, prefix, key, path string) (string, error) {
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists; move it aside before restoring", path)
+	}
+	if key == "" {
+		var err error
+		if key, err = Latest(ctx, s3, prefix); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := s3.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("download snapshot: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("decompress snapshot: %w", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return "", fmt.Errorf("decompress snapshot: %w", err)
+	}
+
+	// Write beside the target and rename, so a failure leaves no partial database
+	tmp := path + ".restore"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return "", fmt.Errorf("write database: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("write database: %w", err)
+	}
+	return key, nil
+}
+
+// snapshotKeys lists snapshots oldest first; keys sort by timestamp.
+func snapshotKeys(ctx context.Context, s3 *S3, prefix string) ([]string, error) {
+	keys, err := s3.List(ctx, prefix+snapshotDir)
+	if err != nil {
+		return nil, fmt.Errorf("list snapshots: %w", err)
+	}
+	var out []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, ".db.gz") {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
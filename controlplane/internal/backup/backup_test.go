@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/sigv4"
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// fakeS3 stores objects of one bucket in memory.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		io.WriteString(w, "<ListBucketResult>")
+		for _, k := range keys {
+			io.WriteString(w, "<Contents><Key>"+k+"</Key></Contents>")
+		}
+		io.WriteString(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+	case r.Method == http.MethodPut:
+		f.objects[key], _ = io.ReadAll(r.Body)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	client := NewS3(ts.URL, "us-east-1", "bucket", sigv4.Credentials{AccessKey: "AKID", SecretKey: "secret"})
+
+	db, err := store.New(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tenants := store.NewTenantStore(db)
+	leases := store.NewLeaseStore(db)
+	now := time.Unix(1700000000, 0)
+	tenants.Create(&store.Tenant{ID: "first", Name: "first"})
+
+	r := New(db, client, "/pm/", 2)
+	tick := now
+	r.now = func() time.Time { tick = tick.Add(time.Second); return tick }
+	ctx := context.Background()
+
+	first, err := r.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Uploaded || !strings.HasPrefix(first.Key, "pm/snapshots/") {
+		t.Fatalf("expected an upload under pm/snapshots/, got %+v", first)
+	}
+
+	// Nothing changed: no new upload
+	again, err := r.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Uploaded || again.Key != first.Key {
+		t.Errorf("expected unchanged database to be skipped, got %+v", again)
+	}
+
+	// Bookkeeping alone is not worth an upload
+	leases.Acquire("leader", "a", now, time.Hour)
+	if res, err := r.Snapshot(ctx); err != nil || res.Uploaded {
+		t.Errorf("expected a lease change to be skipped, got %+v %v", res, err)
+	}
+
+	// Each change uploads; only the newest two are kept
+	for _, name := range []string{"second", "third"} {
+		tenants.Create(&store.Tenant{ID: name, Name: name})
+		if res, err := r.Snapshot(ctx); err != nil || !res.Uploaded {
+			t.Fatalf("expected upload after change, got %+v %v", res, err)
+		}
+	}
+	if len(fake.objects) != 2 {
+		t.Errorf("expected 2 retained snapshots, got %d", len(fake.objects))
+	}
+	if _, ok := fake.objects[first.Key]; ok {
+		t.Error("expected the oldest snapshot to be pruned")
+	}
+
+	path := filepath.Join(t.TempDir(), "restored.db")
+	key, err := Restore(ctx, client, "pm", "", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest, _ := Latest(ctx, client, "pm"); key != latest {
+		t.Errorf("expected newest snapshot %q to be restored, got %q", latest, key)
+	}
+	restored, err := store.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if _, err := store.NewTenantStore(restored).Get("third"); err != nil {
+		t.Errorf("expected restored database to hold the last change: %v", err)
+	}
+	if holder, _, _ := store.NewLeaseStore(restored).Holder("leader", now); holder != "a" {
+		t.Errorf("expected restored database to carry skipped bookkeeping, got holder %q", holder)
+	}
+
+	if _, err := Restore(ctx, client, "pm", "", path); err == nil {
+		t.Error("expected restore over an existing database to fail")
+	}
+}
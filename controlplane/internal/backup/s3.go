@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/sigv4"
+)
+
+// S3 is a minimal client for an S3-compatible bucket (AWS, MinIO, R2, B2).
+// Objects are addressed path-style, endpoint/bucket/key, which every
+// compatible service accepts.
+type S3 struct {
+	endpoint   string
+	region     string
+	bucket     string
+	creds      sigv4.Credentials
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewS3 creates a client for bucket. An empty endpoint means AWS S3 in
+// region.
+func NewS3(endpoint, region, bucket string, creds sigv4.Credentials) *S3 {
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return &S3{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		region:     region,
+		bucket:     bucket,
+		creds:      creds,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		now:        time.Now,
+	}
+}
+
+// Put uploads body as key.
+func (c *S3) Put(ctx context.Context, key string, body []byte) error {
+	_, err := c.do(ctx, http.MethodPut, key, nil, body)
+	return err
+}
+
+// Get downloads key.
+func (c *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, key, nil, nil)
+}
+
+// Delete removes key.
+func (c *S3) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, key, nil, nil)
+	return err
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the keys under prefix in lexical order.
+func (c *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		body, err := c.do(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		if err := xml.Unmarshal(body, &res); err != nil {
+			return nil, fmt.Errorf("decode S3 listing: %w", err)
+		}
+		for _, obj := range res.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (c *S3) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	u, err := url.Parse(c.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// SigV4 needs sorted, strictly escaped query parameters
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	sigv4.Sign(req, body, c.creds, c.region, "s3", c.now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 %s %s: %w", method, u.Path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("S3 %s %s: read response: %w", method, u.Path, err)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("S3 %s %s returned %d: %s", method, u.Path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
@@ -0,0 +1,195 @@
+// Package ca issues the mTLS client certificates of API callers from a CA
+// the API already trusts, so operators need not sign them by hand with
+// openssl, and renders the revocation list of the certificates it issued.
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// backdate is subtracted from NotBefore so clients with a slightly slow
+// clock accept a certificate right away.
+const backdate = 5 * time.Minute
+
+// ErrBeyondCA is returned for a validity that ends after the CA's own
+// certificate, which verifiers would reject.
+var ErrBeyondCA = errors.New("validity ends after the CA certificate expires")
+
+// Authority signs client certificates with a CA key.
+type Authority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	now  func() time.Time
+}
+
+// Load reads the CA from certFile, a PEM bundle that may hold other CAs,
+// and keyFile, the private key of one of them.
+func Load(certFile, keyFile string) (*Authority, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA cert: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA key: %w", err)
+	}
+	for rest := certPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate in %s matches the CA key", certFile)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		pair, err := tls.X509KeyPair(pem.EncodeToMemory(block), keyPEM)
+		if err != nil {
+			continue
+		}
+		if !pair.Leaf.IsCA {
+			return nil, fmt.Errorf("certificate %q is not a CA", pair.Leaf.Subject.CommonName)
+		}
+		key, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+		}
+		return &Authority{cert: pair.Leaf, key: key, now: time.Now}, nil
+	}
+}
+
+// Request describes a client certificate to issue.
+type Request struct {
+	CommonName         string
+	OrganizationalUnit string // optional, matched by ROLE_MAP "ou:" entries
+	Validity           time.Duration
+	CSR                []byte // PEM certificate request supplying the public key; nil generates a key pair
+}
+
+// Certificate is an issued client certificate.
+type Certificate struct {
+	Serial    string // lowercase hex
+	CertPEM   string
+	KeyPEM    string // empty when the request carried a CSR
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// CertPEM returns the CA certificate, for clients to verify against.
+func (a *Authority) CertPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.cert.Raw}))
+}
+
+// Issued reports whether cert names this CA as its issuer. It checks no
+// signature: use it on certificates already verified, e.g. in a handshake.
+func (a *Authority) Issued(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, a.cert.RawSubject)
+}
+
+// Issue signs a client certificate for req. Only the public key of a CSR is
+// used: the subject always comes from req.
+func (a *Authority) Issue(req Request) (*Certificate, error) {
+	now := a.now()
+	notAfter := now.Add(req.Validity)
+	if notAfter.After(a.cert.NotAfter) {
+		return nil, ErrBeyondCA
+	}
+
+	var pub crypto.PublicKey
+	var keyPEM string
+	if len(req.CSR) > 0 {
+		block, _ := pem.Decode(req.CSR)
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("csr is not a PEM certificate request")
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse csr: %w", err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			return nil, fmt.Errorf("csr signature: %w", err)
+		}
+		pub = csr.PublicKey
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate key: %w", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("marshal key: %w", err)
+		}
+		pub = &key.PublicKey
+		keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial: %w", err)
+	}
+	subject := pkix.Name{CommonName: req.CommonName}
+	if req.OrganizationalUnit != "" {
+		subject.OrganizationalUnit = []string{req.OrganizationalUnit}
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    now.Add(-backdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, pub, a.key)
+	if err != nil {
+		return nil, fmt.Errorf("sign certificate: %w", err)
+	}
+	return &Certificate{
+		Serial:    serial.Text(16),
+		CertPEM:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:    keyPEM,
+		NotBefore: tmpl.NotBefore,
+		NotAfter:  tmpl.NotAfter,
+	}, nil
+}
+
+// Revoked is an entry of the revocation list.
+type Revoked struct {
+	Serial    string // lowercase hex, as in Certificate
+	RevokedAt time.Time
+}
+
+// CRL returns a PEM revocation list of the given certificates, valid for
+// validity. Its number is the issue time, so a newer list has a higher one.
+func (a *Authority) CRL(revoked []Revoked, validity time.Duration) (string, error) {
+	now := a.now()
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, r := range revoked {
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			return "", fmt.Errorf("invalid serial %q", r.Serial)
+		}
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: r.RevokedAt})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+		RevokedCertificateEntries: entries,
+	}, a.cert, a.key)
+	if err != nil {
+		return "", fmt.Errorf("sign CRL: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})), nil
+}
@@ -0,0 +1,140 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCA writes a CA certificate, after an unrelated one, and its key.
+func writeCA(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	var bundle []byte
+	var keyDER []byte
+	for i, cn := range []string{"other-ca", "test-ca"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(i + 1)),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+		keyDER, _ = x509.MarshalECPrivateKey(key)
+	}
+	certFile, keyFile = filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	os.WriteFile(certFile, bundle, 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func parseCert(t *testing.T, s string) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		t.Fatalf("no PEM in %q", s)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIssue(t *testing.T) {
+	a, err := Load(writeCA(t, t.TempDir()))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if a.cert.Subject.CommonName != "test-ca" {
+		t.Fatalf("expected the CA matching the key, got %s", a.cert.Subject.CommonName)
+	}
+
+	issued, err := a.Issue(Request{CommonName: "alice", OrganizationalUnit: "ops", Validity: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if issued.KeyPEM == "" {
+		t.Error("expected a generated private key")
+	}
+	cert := parseCert(t, issued.CertPEM)
+	if cert.Subject.CommonName != "alice" || len(cert.Subject.OrganizationalUnit) != 1 || cert.Subject.OrganizationalUnit[0] != "ops" {
+		t.Errorf("unexpected subject %v", cert.Subject)
+	}
+	if cert.SerialNumber.Text(16) != issued.Serial {
+		t.Errorf("serial %s does not match %s", cert.SerialNumber.Text(16), issued.Serial)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(a.cert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("issued certificate does not verify as a client cert: %v", err)
+	}
+	if !a.Issued(cert) {
+		t.Error("expected Issued to recognize the certificate")
+	}
+
+	// A CSR keeps the private key with the client; the subject comes from the request
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "mallory"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	issued, err = a.Issue(Request{CommonName: "bob", Validity: time.Hour, CSR: csrPEM})
+	if err != nil {
+		t.Fatalf("Issue with CSR: %v", err)
+	}
+	cert = parseCert(t, issued.CertPEM)
+	if issued.KeyPEM != "" || cert.Subject.CommonName != "bob" || !cert.PublicKey.(*ecdsa.PublicKey).Equal(&key.PublicKey) {
+		t.Errorf("expected the CSR's key under the requested CN, got %v", cert.Subject)
+	}
+
+	if _, err := a.Issue(Request{CommonName: "carol", Validity: 365 * 24 * time.Hour}); err != ErrBeyondCA {
+		t.Errorf("expected ErrBeyondCA, got %v", err)
+	}
+	if _, err := a.Issue(Request{CommonName: "carol", Validity: time.Hour, CSR: []byte("junk")}); err == nil {
+		t.Error("expected an invalid CSR to be rejected")
+	}
+}
+
+func TestCRL(t *testing.T) {
+	a, err := Load(writeCA(t, t.TempDir()))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	revokedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	out, err := a.CRL([]Revoked{{Serial: "1f", RevokedAt: revokedAt}}, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("CRL: %v", err)
+	}
+	block, _ := pem.Decode([]byte(out))
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(a.cert); err != nil {
+		t.Errorf("CRL signature: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Int64() != 0x1f ||
+		!crl.RevokedCertificateEntries[0].RevocationTime.Equal(revokedAt) {
+		t.Errorf("unexpected entries %+v", crl.RevokedCertificateEntries)
+	}
+}
@@ -0,0 +1,167 @@
+package caddy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting Caddy while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("caddy admin API unavailable (circuit open)")
+
+// Breaker states reported in Health.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// RetryPolicy controls how the HTTPClient retries failed admin API calls and
+// when it stops calling Caddy altogether.
+type RetryPolicy struct {
+	MaxRetries       int           // retries after the first attempt
+	Backoff          time.Duration // delay before the first retry; doubles per retry
+	MaxBackoff       time.Duration // upper bound for a single delay
+	BreakerThreshold int           // consecutive failures that open the breaker (0 disables it)
+	BreakerCooldown  time.Duration // how long the breaker stays open before a trial call
+}
+
+// DefaultRetryPolicy returns the policy used by NewHTTPClient.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:       3,
+		Backoff:          200 * time.Millisecond,
+		MaxBackoff:       5 * time.Second,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// delay returns the backoff before the given retry (1-based).
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// Health describes the client's view of Caddy availability.
+type Health struct {
+	Available           bool
+	BreakerState        string
+	ConsecutiveFailures int
+	LastError           string
+	LastSuccessAt       *time.Time
+	LastFailureAt       *time.Time
+}
+
+// HealthReporter is implemented by clients that track Caddy availability.
+type HealthReporter interface {
+	Health() Health
+}
+
+// breaker is a consecutive-failure circuit breaker. After threshold failures
+// it rejects calls for cooldown, then lets a single trial call through; the
+// trial's outcome closes or re-opens it.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	onRecover func()
+
+	failures    int
+	openedAt    time.Time
+	trialActive bool
+	lastErr     string
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+func (b *breaker) state(now time.Time) string {
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return BreakerClosed
+	}
+	if now.Sub(b.openedAt) < b.cooldown {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// allow reports whether a call may proceed, and whether it is the half-open
+// trial call, whose slot the caller must give back with endTrial.
+func (b *breaker) allow(now time.Time) (ok, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state(now) {
+	case BreakerOpen:
+		return false, false
+	case BreakerHalfOpen:
+		if b.trialActive {
+			return false, false
+		}
+		b.trialActive = true
+		return true, true
+	}
+	return true, false
+}
+
+// endTrial frees the trial slot, so a trial that ended without an outcome,
+// such as one its caller abandoned, does not keep the breaker from trying
+// again.
+func (b *breaker) endTrial() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialActive = false
+}
+
+func (b *breaker) success(now time.Time) {
+	b.mu.Lock()
+	recovered := b.failures > 0
+	b.failures = 0
+	b.trialActive = false
+	b.lastErr = ""
+	b.lastSuccess = now
+	onRecover := b.onRecover
+	b.mu.Unlock()
+
+	if recovered && onRecover != nil {
+		go onRecover()
+	}
+}
+
+func (b *breaker) failure(now time.Time, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trialActive = false
+	b.lastErr = err.Error()
+	b.lastFailure = now
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openedAt = now
+	}
+}
+
+func (b *breaker) health(now time.Time) Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := Health{
+		Available:           b.failures == 0,
+		BreakerState:        b.state(now),
+		ConsecutiveFailures: b.failures,
+		LastError:           b.lastErr,
+	}
+	if !b.lastSuccess.IsZero() {
+		t := b.lastSuccess
+		h.LastSuccessAt = &t
+	}
+	if !b.lastFailure.IsZero() {
+		t := b.lastFailure
+		h.LastFailureAt = &t
+	}
+	return h
+}
@@ -3,24 +3,31 @@ package caddy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // CaddyRoute represents a single L4 route in Caddy config.
 type CaddyRoute struct {
 	ID      string        `json:"@id"`
-	Match   []RouteMatch  `json:"match"`
+	Match   []RouteMatch  `json:"match,omitempty"`
 	Handle  []RouteHandle `json:"handle"`
 }
 
 // RouteMatch represents the match block of a Caddy L4 route.
 type RouteMatch struct {
-	TLS *TLSMatch `json:"tls,omitempty"`
+	TLS  *TLSMatch `json:"tls,omitempty"`
+	QUIC *TLSMatch `json:"quic,omitempty"` // SNI from the QUIC Initial packet
 }
 
 // TLSMatch represents a TLS SNI match.
@@ -28,10 +35,15 @@ type TLSMatch struct {
 	SNI []string `json:"sni"`
 }
 
+// QUICServerName is the Caddy server that carries UDP/443 (QUIC/HTTP3)
+// routes paired with SNI routes.
+const QUICServerName = "quic"
+
 // RouteHandle represents the handle block of a Caddy L4 route.
 type RouteHandle struct {
-	Handler   string           `json:"handler"`
-	Upstreams []RouteUpstream  `json:"upstreams"`
+	Handler       string          `json:"handler"`
+	Upstreams     []RouteUpstream `json:"upstreams,omitempty"`
+	ProxyProtocol string          `json:"proxy_protocol,omitempty"` // "v1" or "v2"
 }
 
 // RouteUpstream represents an upstream in a proxy handler.
@@ -55,16 +67,29 @@ type L4Server struct {
 type Client interface {
 	GetL4Config(ctx context.Context) (*L4Config, error)
 	AddRoute(ctx context.Context, route CaddyRoute) error
+	UpdateRoute(ctx context.Context, route CaddyRoute) error
+	ReplaceRoutes(ctx context.Context, routes []CaddyRoute) error
 	DeleteRoute(ctx context.Context, caddyID string) error
 	CreateServer(ctx context.Context) error
-	CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID string) error
+	CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID, proxyProtocol string) error
+	CreateQUICServer(ctx context.Context) error
+	AddQUICRoute(ctx context.Context, route CaddyRoute) error
 	DeleteServer(ctx context.Context, serverName string) error
+	SyncManagedCertificates(ctx context.Context, subjects []string, issuer ACMEIssuer) (bool, error)
+	CheckManagedCertificates(ctx context.Context, subjects []string, issuer ACMEIssuer) (bool, error)
 }
 
-// HTTPClient implements Client using HTTP calls to Caddy's admin Unix socket.
+// HTTPClient implements Client using HTTP calls to Caddy's admin API, over
+// its Unix socket or a TCP endpoint. Failed calls are retried according to its RetryPolicy, and a circuit
+// breaker stops calling Caddy while it is down.
 type HTTPClient struct {
 	httpClient *http.Client
 	baseURL    string
+	policy     RetryPolicy
+	breaker    *breaker
+	username   string // basic auth, remote endpoints only
+	password   string
+	onWrite    func()
 }
 
 // NewHTTPClient creates a new Caddy admin API client connected via Unix socket.
@@ -75,49 +100,220 @@ func NewHTTPClient(socketPath string) *HTTPClient {
 		},
 	}
 
-	return &HTTPClient{
-		httpClient: &http.Client{
-			Transport: transport,
-			Timeout:   10 * time.Second,
-		},
-		baseURL: "http://localhost",
-	}
+	return newHTTPClient(&http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+	}, "http://localhost")
+}
+
+// RemoteConfig describes a Caddy admin endpoint reached over TCP, e.g. when
+// Caddy runs in a separate container or host.
+type RemoteConfig struct {
+	URL      string // http:// or https:// base URL of the admin API
+	Username string // optional basic auth (typically checked by a proxy in front of Caddy)
+	Password string
+	CertFile string // optional client certificate and key for mTLS
+	KeyFile  string
+	CAFile   string // optional CA bundle for the admin server certificate (default: system roots)
+}
+
+// NewRemoteHTTPClient creates a Caddy admin API client for a TCP endpoint.
+func NewRemoteHTTPClient(rc RemoteConfig) (*HTTPClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if rc.CertFile != "" || rc.CAFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if rc.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(rc.CertFile, rc.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("load caddy admin client cert: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if rc.CAFile != "" {
+			caPEM, err := os.ReadFile(rc.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("read caddy admin CA: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("failed to parse caddy admin CA")
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	c := newHTTPClient(&http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+	}, strings.TrimSuffix(rc.URL, "/"))
+	c.username = rc.Username
+	c.password = rc.Password
+	return c, nil
 }
 
 // NewHTTPClientWithHTTPClient creates a Caddy client using a provided *http.Client.
 // This is useful for testing with httptest.NewServer.
 func NewHTTPClientWithHTTPClient(httpClient *http.Client, baseURL string) *HTTPClient {
-	return &HTTPClient{
+	return newHTTPClient(httpClient, baseURL)
+}
+
+func newHTTPClient(httpClient *http.Client, baseURL string) *HTTPClient {
+	c := &HTTPClient{
 		httpClient: httpClient,
 		baseURL:    baseURL,
+		breaker:    &breaker{},
 	}
+	c.SetRetryPolicy(DefaultRetryPolicy())
+	return c
 }
 
-// GetL4Config reads the current L4 configuration from Caddy.
-func (c *HTTPClient) GetL4Config(ctx context.Context) (*L4Config, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/config/apps/layer4", nil)
+// SetRetryPolicy replaces the retry and circuit breaker settings.
+func (c *HTTPClient) SetRetryPolicy(p RetryPolicy) {
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+	c.policy = p
+	c.breaker.threshold = p.BreakerThreshold
+	c.breaker.cooldown = p.BreakerCooldown
+}
+
+// SetOnRecover registers fn to be called (in its own goroutine) when Caddy
+// answers again after one or more failed calls, e.g. to reconcile routes a
+// Caddy restart dropped without waiting for the next interval.
+func (c *HTTPClient) SetOnRecover(fn func()) {
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+	c.breaker.onRecover = fn
+}
+
+// SetOnWrite registers fn to be called after each request that may have
+// changed Caddy's config, so a watcher can tell the control plane's own
+// writes from edits made elsewhere. Call it before the client is used.
+func (c *HTTPClient) SetOnWrite(fn func()) {
+	c.onWrite = fn
+}
+
+// Health implements HealthReporter.
+func (c *HTTPClient) Health() Health {
+	return c.breaker.health(time.Now())
+}
+
+// do sends a request to the admin API, retrying transient failures, and
+// returns the response status and body. Transport errors are returned as-is.
+func (c *HTTPClient) do(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	ok, trial := c.breaker.allow(time.Now())
+	if !ok {
+		return 0, nil, ErrCircuitOpen
+	}
+	if trial {
+		defer c.breaker.endTrial()
+	}
+
+	var (
+		status   int
+		respBody []byte
+		err      error
+	)
+	for attempt := 0; ; attempt++ {
+		status, respBody, err = c.attempt(ctx, method, path, body)
+		if attempt >= c.policy.MaxRetries || !retryable(method, status, err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return status, respBody, ctx.Err()
+		case <-time.After(c.policy.delay(attempt + 1)):
+		}
+	}
+
+	if method != http.MethodGet && err == nil && c.onWrite != nil {
+		c.onWrite()
+	}
+
+	// Only failures that mean Caddy is unreachable count against the
+	// breaker; a 4xx/500 for a bad config still proves it is up. Calls
+	// abandoned by the caller count for neither.
+	if ctx.Err() == nil {
+		now := time.Now()
+		switch {
+		case err != nil:
+			c.breaker.failure(now, err)
+		case unavailableStatus(status):
+			c.breaker.failure(now, fmt.Errorf("caddy returned status %d", status))
+		default:
+			c.breaker.success(now)
+		}
+	}
+	return status, respBody, err
+}
+
+func (c *HTTPClient) attempt(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
 	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+		return 0, nil, fmt.Errorf("create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
 	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("get l4 config: %w", err)
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("read response: %w", err)
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+// retryable reports whether a failed attempt should be retried. Connection
+// failures are always safe to retry since the request never reached Caddy;
+// other transport errors only for idempotent methods, because a POST may
+// already have been applied.
+func retryable(method string, status int, err error) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return method != http.MethodPost
+	}
+	return unavailableStatus(status)
+}
+
+// unavailableStatus reports whether status means Caddy (or a proxy in front
+// of it) could not handle the request at all.
+func unavailableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// GetL4Config reads the current L4 configuration from Caddy.
+func (c *HTTPClient) GetL4Config(ctx context.Context) (*L4Config, error) {
+	status, body, err := c.do(ctx, http.MethodGet, "/config/apps/layer4", nil)
 	if err != nil {
-		return nil, fmt.Errorf("read response: %w", err)
+		return nil, fmt.Errorf("get l4 config: %w", err)
 	}
 
-	if resp.StatusCode == http.StatusNotFound {
+	if status == http.StatusNotFound {
 		// No layer4 config exists yet; return empty
 		return &L4Config{Servers: map[string]*L4Server{}}, nil
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("caddy returned status %d: %s", resp.StatusCode, string(body))
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("caddy returned status %d: %s", status, string(body))
 	}
 
 	var cfg L4Config
@@ -143,97 +339,140 @@ func (c *HTTPClient) CreateServer(ctx context.Context) error {
 		return fmt.Errorf("marshal server config: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		c.baseURL+"/config/apps/layer4/servers/proxy", bytes.NewReader(body))
+	status, respBody, err := c.do(ctx, http.MethodPost, "/config/apps/layer4/servers/proxy", body)
 	if err != nil {
-		return fmt.Errorf("create request: %w", err)
+		return fmt.Errorf("create server: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	return nil
+}
+
+// AddRoute adds a new L4 route to the Caddy proxy server.
+func (c *HTTPClient) AddRoute(ctx context.Context, route CaddyRoute) error {
+	body, err := json.Marshal(route)
 	if err != nil {
-		return fmt.Errorf("create server: %w", err)
+		return fmt.Errorf("marshal route: %w", err)
+	}
+
+	status, respBody, err := c.do(ctx, http.MethodPost, "/config/apps/layer4/servers/proxy/routes", body)
+	if err != nil {
+		return fmt.Errorf("add route: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
-	defer resp.Body.Close()
 
-	respBody, _ := io.ReadAll(resp.Body)
+	return nil
+}
+
+// CreateQUICServer creates the UDP/443 server for QUIC routes if it doesn't exist.
+func (c *HTTPClient) CreateQUICServer(ctx context.Context) error {
+	server := map[string]interface{}{
+		"@id":    "l4-quic",
+		"listen": []string{"udp/0.0.0.0:443"},
+		"routes": []interface{}{},
+	}
+
+	body, err := json.Marshal(server)
+	if err != nil {
+		return fmt.Errorf("marshal server config: %w", err)
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("caddy returned status %d: %s", resp.StatusCode, string(respBody))
+	status, respBody, err := c.do(ctx, http.MethodPost, "/config/apps/layer4/servers/"+QUICServerName, body)
+	if err != nil {
+		return fmt.Errorf("create quic server: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
 
 	return nil
 }
 
-// AddRoute adds a new L4 route to the Caddy proxy server.
-func (c *HTTPClient) AddRoute(ctx context.Context, route CaddyRoute) error {
+// AddQUICRoute adds a route to the QUIC server.
+func (c *HTTPClient) AddQUICRoute(ctx context.Context, route CaddyRoute) error {
 	body, err := json.Marshal(route)
 	if err != nil {
 		return fmt.Errorf("marshal route: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		c.baseURL+"/config/apps/layer4/servers/proxy/routes", bytes.NewReader(body))
+	status, respBody, err := c.do(ctx, http.MethodPost, "/config/apps/layer4/servers/"+QUICServerName+"/routes", body)
 	if err != nil {
-		return fmt.Errorf("create request: %w", err)
+		return fmt.Errorf("add quic route: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	return nil
+}
+
+// ReplaceRoutes replaces the proxy server's route list in one call. Caddy
+// matches routes in list order, so this is how route priority is applied.
+func (c *HTTPClient) ReplaceRoutes(ctx context.Context, routes []CaddyRoute) error {
+	if routes == nil {
+		routes = []CaddyRoute{}
+	}
+	body, err := json.Marshal(routes)
 	if err != nil {
-		return fmt.Errorf("add route: %w", err)
+		return fmt.Errorf("marshal routes: %w", err)
 	}
-	defer resp.Body.Close()
 
-	respBody, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("caddy returned status %d: %s", resp.StatusCode, string(respBody))
+	status, respBody, err := c.do(ctx, http.MethodPatch, "/config/apps/layer4/servers/proxy/routes", body)
+	if err != nil {
+		return fmt.Errorf("replace routes: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
 
 	return nil
 }
 
-// DeleteRoute removes a route from Caddy by its @id.
-func (c *HTTPClient) DeleteRoute(ctx context.Context, caddyID string) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodDelete,
-		c.baseURL+"/id/"+caddyID, nil)
+// UpdateRoute replaces the route with route's @id in place, keeping its
+// position in whichever server's route list holds it.
+func (c *HTTPClient) UpdateRoute(ctx context.Context, route CaddyRoute) error {
+	body, err := json.Marshal(route)
 	if err != nil {
-		return fmt.Errorf("create request: %w", err)
+		return fmt.Errorf("marshal route: %w", err)
 	}
 
-	resp, err := c.httpClient.Do(req)
+	status, respBody, err := c.do(ctx, http.MethodPatch, "/id/"+route.ID, body)
 	if err != nil {
-		return fmt.Errorf("delete route: %w", err)
+		return fmt.Errorf("update route: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
-	defer resp.Body.Close()
 
-	respBody, _ := io.ReadAll(resp.Body)
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("caddy returned status %d: %s", resp.StatusCode, string(respBody))
+// DeleteRoute removes a route from Caddy by its @id.
+func (c *HTTPClient) DeleteRoute(ctx context.Context, caddyID string) error {
+	status, respBody, err := c.do(ctx, http.MethodDelete, "/id/"+caddyID, nil)
+	if err != nil {
+		return fmt.Errorf("delete route: %w", err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
 
 	return nil
 }
 
-// CreatePortForwardServer creates a dedicated L4 server for port forwarding.
-func (c *HTTPClient) CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID string) error {
+// CreatePortForwardServer creates a dedicated L4 server for port forwarding,
+// or replaces the server of that name: Caddy rejects a PUT on an existing
+// key, so the server is POSTed, which sets it either way.
+// proxyProtocol ("v1", "v2", or "") selects the PROXY protocol header sent upstream.
+func (c *HTTPClient) CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID, proxyProtocol string) error {
+	desired := PortForwardServer{ListenAddr: listenAddr, Upstream: upstream, CaddyID: caddyID, ProxyProtocol: proxyProtocol}
 	server := map[string]interface{}{
 		"listen": []string{listenAddr},
-		"routes": []map[string]interface{}{
-			{
-				"@id": caddyID,
-				"handle": []map[string]interface{}{
-					{
-						"handler": "proxy",
-						"upstreams": []map[string]interface{}{
-							{"dial": []string{upstream}},
-						},
-					},
-				},
-			},
-		},
+		"routes": []CaddyRoute{desired.Route()},
 	}
 
 	body, err := json.Marshal(server)
@@ -241,22 +480,12 @@ func (c *HTTPClient) CreatePortForwardServer(ctx context.Context, serverName, li
 		return fmt.Errorf("marshal server config: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut,
-		c.baseURL+"/config/apps/layer4/servers/"+serverName, bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
+	status, respBody, err := c.do(ctx, http.MethodPost, "/config/apps/layer4/servers/"+serverName, body)
 	if err != nil {
 		return fmt.Errorf("create port-forward server: %w", err)
 	}
-	defer resp.Body.Close()
-
-	respBody, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("caddy returned status %d: %s", resp.StatusCode, string(respBody))
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
 
 	return nil
@@ -264,21 +493,12 @@ func (c *HTTPClient) CreatePortForwardServer(ctx context.Context, serverName, li
 
 // DeleteServer removes an entire L4 server from Caddy.
 func (c *HTTPClient) DeleteServer(ctx context.Context, serverName string) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodDelete,
-		c.baseURL+"/config/apps/layer4/servers/"+serverName, nil)
-	if err != nil {
-		return fmt.Errorf("create request: %w", err)
-	}
-
-	resp, err := c.httpClient.Do(req)
+	status, respBody, err := c.do(ctx, http.MethodDelete, "/config/apps/layer4/servers/"+serverName, nil)
 	if err != nil {
 		return fmt.Errorf("delete server: %w", err)
 	}
-	defer resp.Body.Close()
-
-	respBody, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("caddy returned status %d: %s", resp.StatusCode, string(respBody))
+	if status != http.StatusOK {
+		return fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
 	}
 
 	return nil
@@ -305,8 +525,87 @@ func FormatUpstream(vpnIP string, port int, protocol string) string {
 	return fmt.Sprintf("%s:%d", vpnIP, port)
 }
 
-// BuildCaddyRoute constructs a CaddyRoute from route parameters.
-func BuildCaddyRoute(caddyID string, sniDomains []string, upstream string) CaddyRoute {
+// PortForwardServer is one dedicated L4 server of a port-forward route.
+type PortForwardServer struct {
+	Name          string
+	ListenAddr    string
+	Upstream      string
+	CaddyID       string
+	ProxyProtocol string
+}
+
+// Route returns the server's only route, which proxies every connection to
+// the upstream.
+func (s PortForwardServer) Route() CaddyRoute {
+	return CaddyRoute{
+		ID:     s.CaddyID,
+		Handle: []RouteHandle{proxyHandle(s.Upstream, s.ProxyProtocol)},
+	}
+}
+
+// Matches reports whether actual, a server read from Caddy, listens and
+// forwards as s would.
+func (s PortForwardServer) Matches(actual *L4Server) bool {
+	return actual != nil &&
+		len(actual.Listen) == 1 && actual.Listen[0] == s.ListenAddr &&
+		len(actual.Routes) == 1 && RoutesEqual(actual.Routes[0], s.Route())
+}
+
+// PortForwardServers expands a port-forward route into one server per listen
+// port. The layer4 proxy dials a fixed address, so a range needs a server per
+// port: listenPort+i forwards to the upstream port +i. A single-port route
+// (listenPortEnd 0) keeps caddyID as its route @id; range members get a
+// "-{port}" suffix.
+func PortForwardServers(caddyID string, listenPort, listenPortEnd int, protocol, upstream, proxyProtocol string) []PortForwardServer {
+	if listenPortEnd == 0 {
+		return []PortForwardServer{{
+			Name:          PortForwardServerName(listenPort, protocol),
+			ListenAddr:    FormatListenAddr(listenPort, protocol),
+			Upstream:      upstream,
+			CaddyID:       caddyID,
+			ProxyProtocol: proxyProtocol,
+		}}
+	}
+
+	host, upstreamPort := SplitUpstream(upstream)
+	servers := make([]PortForwardServer, 0, listenPortEnd-listenPort+1)
+	for port := listenPort; port <= listenPortEnd; port++ {
+		servers = append(servers, PortForwardServer{
+			Name:          PortForwardServerName(port, protocol),
+			ListenAddr:    FormatListenAddr(port, protocol),
+			Upstream:      FormatUpstream(host, upstreamPort+port-listenPort, protocol),
+			CaddyID:       fmt.Sprintf("%s-%d", caddyID, port),
+			ProxyProtocol: proxyProtocol,
+		})
+	}
+	return servers
+}
+
+// SplitUpstream parses an address built by FormatUpstream into host and port.
+func SplitUpstream(upstream string) (string, int) {
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream, "udp/"))
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// proxyHandle builds the layer4 proxy handler for an upstream.
+func proxyHandle(upstream, proxyProtocol string) RouteHandle {
+	return RouteHandle{
+		Handler:       "proxy",
+		Upstreams:     []RouteUpstream{{Dial: []string{upstream}}},
+		ProxyProtocol: proxyProtocol,
+	}
+}
+
+// BuildCaddyRoute constructs a CaddyRoute from route parameters. proxyProtocol
+// ("v1", "v2", or "") selects the PROXY protocol header sent upstream. With
+// terminateTLS, Caddy completes the TLS handshake using a certificate from
+// its tls app and proxies the decrypted stream.
+func BuildCaddyRoute(caddyID string, sniDomains []string, upstream, proxyProtocol string, terminateTLS bool) CaddyRoute {
+	handle := []RouteHandle{proxyHandle(upstream, proxyProtocol)}
+	if terminateTLS {
+		handle = append([]RouteHandle{{Handler: "tls"}}, handle...)
+	}
 	return CaddyRoute{
 		ID: caddyID,
 		Match: []RouteMatch{
@@ -316,13 +615,59 @@ func BuildCaddyRoute(caddyID string, sniDomains []string, upstream string) Caddy
 				},
 			},
 		},
-		Handle: []RouteHandle{
+		Handle: handle,
+	}
+}
+
+// RoutesEqual reports whether two routes would produce the same Caddy
+// config, e.g. a route read back from Caddy and the one the store wants.
+func RoutesEqual(a, b CaddyRoute) bool {
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aj, bj)
+}
+
+// ManagedIDPrefix starts the @id of every route the control plane creates,
+// so that routes and servers configured by hand in the same Caddy are told
+// apart and left alone. Caddy rejects unknown fields in route JSON, so the
+// @id is the only place such a tag can go.
+const ManagedIDPrefix = "pm-"
+
+// ManagedID tags id as created by the control plane.
+func ManagedID(id string) string {
+	return ManagedIDPrefix + id
+}
+
+// IsManagedID reports whether the @id id carries the control plane's tag.
+// Routes created before tagging are only known by their ID in the store.
+func IsManagedID(id string) bool {
+	return strings.HasPrefix(id, ManagedIDPrefix)
+}
+
+// SNIRouteID returns the @id of the Caddy route of the SNI route routeID.
+// It is derived from the route alone, so every route has its own.
+func SNIRouteID(routeID string) string {
+	return ManagedID("route-" + routeID)
+}
+
+// QUICRouteID returns the @id of the QUIC route paired with an SNI route.
+func QUICRouteID(caddyID string) string {
+	return caddyID + "-quic"
+}
+
+// BuildQUICRoute constructs the UDP/443 route paired with an SNI route. It
+// matches the SNI in the QUIC Initial packet and forwards the datagrams over
+// UDP to the SNI route's upstream host and port.
+func BuildQUICRoute(caddyID string, sniDomains []string, upstream string) CaddyRoute {
+	return CaddyRoute{
+		ID: QUICRouteID(caddyID),
+		Match: []RouteMatch{
 			{
-				Handler: "proxy",
-				Upstreams: []RouteUpstream{
-					{Dial: []string{upstream}},
+				QUIC: &TLSMatch{
+					SNI: sniDomains,
 				},
 			},
 		},
+		Handle: []RouteHandle{proxyHandle("udp/"+upstream, "")},
 	}
 }
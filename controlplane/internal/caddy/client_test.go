@@ -3,10 +3,17 @@ package caddy
 import (
 	"context"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGetL4Config(t *testing.T) {
@@ -116,6 +123,44 @@ func TestCreateServer(t *testing.T) {
 	}
 }
 
+func TestCreatePortForwardServerReplaces(t *testing.T) {
+	// Like Caddy's admin API, PUT only creates a key and POST sets it
+	servers := map[string]json.RawMessage{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, "/config/apps/layer4/servers/")
+		if !ok {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		switch r.Method {
+		case http.MethodPut:
+			if _, exists := servers[name]; exists {
+				http.Error(w, `{"error":"key already exists: `+name+`"}`, http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+		default:
+			t.Errorf("unexpected method: %s", r.Method)
+		}
+		servers[name] = body
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
+
+	for _, upstream := range []string{"10.0.0.2:25565", "10.0.0.3:25565"} {
+		if err := client.CreatePortForwardServer(context.Background(), "pf-tcp-25565", "0.0.0.0:25565", upstream, "pf-route_a", ""); err != nil {
+			t.Fatalf("create port-forward server to %s: %v", upstream, err)
+		}
+	}
+	if !strings.Contains(string(servers["pf-tcp-25565"]), "10.0.0.3:25565") {
+		t.Errorf("expected the server to be replaced, got %s", servers["pf-tcp-25565"])
+	}
+}
+
 func TestAddRoute(t *testing.T) {
 	var receivedRoute CaddyRoute
 
@@ -138,7 +183,7 @@ func TestAddRoute(t *testing.T) {
 
 	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
 
-	route := BuildCaddyRoute("route-tun_1-443", []string{"app.example.com"}, "10.0.0.2:443")
+	route := BuildCaddyRoute("route-tun_1-443", []string{"app.example.com"}, "10.0.0.2:443", "", false)
 
 	err := client.AddRoute(context.Background(), route)
 	if err != nil {
@@ -171,11 +216,16 @@ func TestDeleteRoute(t *testing.T) {
 	defer server.Close()
 
 	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
+	writes := 0
+	client.SetOnWrite(func() { writes++ })
 
 	err := client.DeleteRoute(context.Background(), "route-tun_1-443")
 	if err != nil {
 		t.Fatalf("delete route: %v", err)
 	}
+	if writes != 1 {
+		t.Errorf("expected the write reported once, got %d", writes)
+	}
 }
 
 func TestDeleteRouteError(t *testing.T) {
@@ -196,7 +246,7 @@ func TestDeleteRouteError(t *testing.T) {
 }
 
 func TestBuildCaddyRoute(t *testing.T) {
-	route := BuildCaddyRoute("route-tun_abc-443", []string{"a.com", "b.com"}, "10.0.0.2:443")
+	route := BuildCaddyRoute("route-tun_abc-443", []string{"a.com", "b.com"}, "10.0.0.2:443", "v2", false)
 
 	if route.ID != "route-tun_abc-443" {
 		t.Errorf("expected ID route-tun_abc-443, got %s", route.ID)
@@ -216,4 +266,364 @@ func TestBuildCaddyRoute(t *testing.T) {
 	if route.Handle[0].Upstreams[0].Dial[0] != "10.0.0.2:443" {
 		t.Errorf("expected upstream 10.0.0.2:443, got %s", route.Handle[0].Upstreams[0].Dial[0])
 	}
+	if route.Handle[0].ProxyProtocol != "v2" {
+		t.Errorf("expected proxy_protocol v2, got %q", route.Handle[0].ProxyProtocol)
+	}
+}
+
+func TestBuildQUICRoute(t *testing.T) {
+	route := BuildQUICRoute("route-tun_abc-443", []string{"a.com"}, "10.0.0.2:443")
+
+	body, err := json.Marshal(route)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	want := `{"@id":"route-tun_abc-443-quic","match":[{"quic":{"sni":["a.com"]}}],"handle":[{"handler":"proxy","upstreams":[{"dial":["udp/10.0.0.2:443"]}]}]}`
+	if string(body) != want {
+		t.Errorf("unexpected route JSON:\n got %s\nwant %s", body, want)
+	}
+}
+
+func TestBuildCaddyRouteTerminateTLS(t *testing.T) {
+	route := BuildCaddyRoute("route-tun_abc-8080", []string{"a.com"}, "10.0.0.2:8080", "", true)
+
+	body, err := json.Marshal(route)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	want := `{"@id":"route-tun_abc-8080","match":[{"tls":{"sni":["a.com"]}}],"handle":[{"handler":"tls"},{"handler":"proxy","upstreams":[{"dial":["10.0.0.2:8080"]}]}]}`
+	if string(body) != want {
+		t.Errorf("unexpected route JSON:\n got %s\nwant %s", body, want)
+	}
+}
+
+func TestPortForwardServers(t *testing.T) {
+	single := PortForwardServers("pf-route_a", 25565, 0, "tcp", "10.0.0.2:25565", "v2")
+	if len(single) != 1 || single[0].Name != "pf-tcp-25565" || single[0].CaddyID != "pf-route_a" ||
+		single[0].ListenAddr != "0.0.0.0:25565" || single[0].ProxyProtocol != "v2" {
+		t.Errorf("unexpected single-port server: %+v", single)
+	}
+
+	servers := PortForwardServers("pf-route_b", 30000, 30002, "udp", "udp/10.0.0.2:40000", "")
+	if len(servers) != 3 {
+		t.Fatalf("expected 3 servers, got %d", len(servers))
+	}
+	last := servers[2]
+	if last.Name != "pf-udp-30002" || last.ListenAddr != "udp/0.0.0.0:30002" ||
+		last.Upstream != "udp/10.0.0.2:40002" || last.CaddyID != "pf-route_b-30002" {
+		t.Errorf("unexpected range member: %+v", last)
+	}
+}
+
+func TestSyncManagedCertificates(t *testing.T) {
+	// An operator-managed tls app with its own policy and automated name
+	tlsApp := `{"automation":{"policies":[{"subjects":["admin.example.com"],"issuers":[{"module":"internal"}]}]},` +
+		`"certificates":{"automate":["admin.example.com"]}}`
+	var posts int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config/apps/tls" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		switch r.Method {
+		case http.MethodGet:
+			io.WriteString(w, tlsApp)
+		case http.MethodPost:
+			posts++
+			body, _ := io.ReadAll(r.Body)
+			tlsApp = string(body)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
+	issuer := ACMEIssuer{Email: "ops@example.com"}
+
+	// A check reports the change without making it
+	changed, err := client.CheckManagedCertificates(context.Background(), []string{"b.com", "a.com"}, issuer)
+	if err != nil || !changed || posts != 0 {
+		t.Fatalf("expected a change found and not made, got %v %v (posts=%d)", changed, err, posts)
+	}
+
+	changed, err = client.SyncManagedCertificates(context.Background(), []string{"b.com", "a.com"}, issuer)
+	if err != nil || !changed {
+		t.Fatalf("expected change, got %v %v", changed, err)
+	}
+	var app struct {
+		Automation struct {
+			Policies []map[string]interface{} `json:"policies"`
+		} `json:"automation"`
+		Certificates struct {
+			Automate []string `json:"automate"`
+		} `json:"certificates"`
+	}
+	json.Unmarshal([]byte(tlsApp), &app)
+	if len(app.Automation.Policies) != 2 || app.Automation.Policies[0]["@id"] != ACMEPolicyID {
+		t.Fatalf("expected managed policy first, got %v", app.Automation.Policies)
+	}
+	if got := app.Certificates.Automate; len(got) != 3 || got[0] != "admin.example.com" || got[1] != "a.com" {
+		t.Errorf("unexpected automate list: %v", got)
+	}
+
+	// Same subjects in another order: nothing to do
+	changed, err = client.SyncManagedCertificates(context.Background(), []string{"a.com", "b.com"}, issuer)
+	if err != nil || changed || posts != 1 {
+		t.Errorf("expected no change, got %v %v (posts=%d)", changed, err, posts)
+	}
+
+	// Dropping all subjects removes only what the control plane owned
+	if _, err := client.SyncManagedCertificates(context.Background(), nil, issuer); err != nil {
+		t.Fatal(err)
+	}
+	app.Automation.Policies, app.Certificates.Automate = nil, nil
+	json.Unmarshal([]byte(tlsApp), &app)
+	if len(app.Automation.Policies) != 1 || app.Automation.Policies[0]["@id"] != nil {
+		t.Errorf("expected only the operator policy, got %v", app.Automation.Policies)
+	}
+	if got := app.Certificates.Automate; len(got) != 1 || got[0] != "admin.example.com" {
+		t.Errorf("expected only admin.example.com, got %v", got)
+	}
+}
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:       2,
+		Backoff:          time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	}
+}
+
+func TestRetryOnUnavailable(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
+	client.SetRetryPolicy(testRetryPolicy())
+
+	if err := client.DeleteRoute(context.Background(), "route-tun_1-443"); err != nil {
+		t.Fatalf("expected success after retries: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+	if h := client.Health(); !h.Available || h.BreakerState != BreakerClosed {
+		t.Errorf("unexpected health: %+v", h)
+	}
+}
+
+func TestNoRetryOnConfigError(t *testing.T) {
+	var calls int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
+	client.SetRetryPolicy(testRetryPolicy())
+
+	if err := client.DeleteRoute(context.Background(), "route-bad"); err == nil {
+		t.Fatal("expected error on 500 response")
+	}
+	if calls != 1 {
+		t.Errorf("expected a single attempt, got %d", calls)
+	}
+	// Caddy answered, so it still counts as available
+	if h := client.Health(); !h.Available {
+		t.Errorf("expected caddy to be reported available: %+v", h)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int32
+	var healthy atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
+	policy := testRetryPolicy()
+	policy.MaxRetries = 0
+	client.SetRetryPolicy(policy)
+	recovered := make(chan struct{}, 1)
+	client.SetOnRecover(func() { recovered <- struct{}{} })
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetL4Config(ctx); err == nil {
+			t.Fatal("expected error while caddy is down")
+		}
+	}
+	h := client.Health()
+	if h.Available || h.BreakerState != BreakerOpen || h.ConsecutiveFailures != 2 {
+		t.Fatalf("expected open breaker, got %+v", h)
+	}
+
+	// Open breaker fails fast without calling Caddy
+	if _, err := client.GetL4Config(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected no call while open, got %d calls", calls)
+	}
+
+	// After the cooldown a trial call goes through and closes the breaker
+	healthy.Store(true)
+	client.breaker.openedAt = time.Now().Add(-2 * time.Hour)
+	if client.Health().BreakerState != BreakerHalfOpen {
+		t.Fatalf("expected half-open breaker, got %+v", client.Health())
+	}
+	if _, err := client.GetL4Config(ctx); err != nil {
+		t.Fatalf("trial call: %v", err)
+	}
+	if h := client.Health(); !h.Available || h.BreakerState != BreakerClosed {
+		t.Errorf("expected closed breaker, got %+v", h)
+	}
+	select {
+	case <-recovered:
+	case <-time.After(time.Second):
+		t.Error("expected recovery callback")
+	}
+}
+
+func TestCircuitBreakerCancelledTrial(t *testing.T) {
+	var healthy, hang atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if hang.Load() {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
+	policy := testRetryPolicy()
+	policy.MaxRetries = 0
+	client.SetRetryPolicy(policy)
+	for i := 0; i < 2; i++ {
+		client.GetL4Config(context.Background())
+	}
+
+	// The trial call is abandoned by its caller before Caddy answers
+	healthy.Store(true)
+	hang.Store(true)
+	client.breaker.openedAt = time.Now().Add(-2 * time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetL4Config(ctx); err == nil {
+		t.Fatal("expected the cancelled trial call to fail")
+	}
+	if h := client.Health(); h.BreakerState != BreakerHalfOpen || h.ConsecutiveFailures != 2 {
+		t.Fatalf("expected a cancelled trial to count for nothing, got %+v", h)
+	}
+
+	// The slot was given back, so the next trial goes through
+	hang.Store(false)
+	if _, err := client.GetL4Config(context.Background()); err != nil {
+		t.Fatalf("second trial call: %v", err)
+	}
+	if h := client.Health(); h.BreakerState != BreakerClosed {
+		t.Errorf("expected closed breaker, got %+v", h)
+	}
+}
+
+func TestRemoteClientBasicAuthAndCA(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "admin" || pass != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+
+	client, err := NewRemoteHTTPClient(RemoteConfig{
+		URL:      server.URL + "/",
+		Username: "admin",
+		Password: "s3cret",
+		CAFile:   caFile,
+	})
+	if err != nil {
+		t.Fatalf("new remote client: %v", err)
+	}
+	if _, err := client.GetL4Config(context.Background()); err != nil {
+		t.Fatalf("get l4 config: %v", err)
+	}
+
+	// Without the CA the server certificate is rejected
+	untrusted, _ := NewRemoteHTTPClient(RemoteConfig{URL: server.URL, Username: "admin", Password: "s3cret"})
+	untrusted.SetRetryPolicy(RetryPolicy{})
+	if _, err := untrusted.GetL4Config(context.Background()); err == nil {
+		t.Error("expected TLS verification error without CA")
+	}
+
+	if _, err := NewRemoteHTTPClient(RemoteConfig{URL: server.URL, CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("expected error for missing CA file")
+	}
+}
+
+func TestUpdateRoute(t *testing.T) {
+	var got CaddyRoute
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/id/route-tun_1-443" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		if r.Method != http.MethodPatch {
+			t.Errorf("unexpected method: %s", r.Method)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewHTTPClientWithHTTPClient(server.Client(), server.URL)
+
+	route := BuildCaddyRoute("route-tun_1-443", []string{"app.example.com"}, "10.0.0.2:8443", "", false)
+	if err := client.UpdateRoute(context.Background(), route); err != nil {
+		t.Fatalf("update route: %v", err)
+	}
+	if !RoutesEqual(got, route) {
+		t.Errorf("expected the full route to be sent, got %+v", got)
+	}
+	if RoutesEqual(got, BuildCaddyRoute("route-tun_1-443", []string{"app.example.com"}, "10.0.0.2:443", "", false)) {
+		t.Error("expected routes with different upstreams to differ")
+	}
 }
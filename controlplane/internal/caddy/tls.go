@@ -0,0 +1,187 @@
+package caddy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// ACMEPolicyID is the @id of the tls app automation policy the control plane
+// owns. Its subjects are the domains of routes that terminate TLS in Caddy.
+const ACMEPolicyID = "proxy-manager-acme"
+
+// ACMEIssuer configures how certificates for terminated routes are obtained.
+type ACMEIssuer struct {
+	Email string // ACME account contact (optional)
+	CA    string // ACME directory URL (default: Let's Encrypt)
+}
+
+// automationPolicy builds the tls app policy for subjects. Only the
+// TLS-ALPN challenge is enabled: it is answered on :443 by the same L4 tls
+// handler that terminates the route, while nothing listens on :80.
+func (i ACMEIssuer) automationPolicy(subjects []string) map[string]interface{} {
+	issuer := map[string]interface{}{
+		"module":     "acme",
+		"challenges": map[string]interface{}{"http": map[string]interface{}{"disabled": true}},
+	}
+	if i.Email != "" {
+		issuer["email"] = i.Email
+	}
+	if i.CA != "" {
+		issuer["ca"] = i.CA
+	}
+	return map[string]interface{}{
+		"@id":      ACMEPolicyID,
+		"subjects": subjects,
+		"issuers":  []interface{}{issuer},
+	}
+}
+
+// SyncManagedCertificates makes Caddy's tls app manage certificates for
+// exactly subjects under the control plane's automation policy, leaving the
+// rest of the tls app untouched. It reports whether the config changed.
+func (c *HTTPClient) SyncManagedCertificates(ctx context.Context, subjects []string, issuer ACMEIssuer) (bool, error) {
+	app, err := c.getTLSApp(ctx)
+	if err != nil {
+		return false, err
+	}
+	updated, changed := mergeManagedCertificates(app, subjects, issuer)
+	if !changed {
+		return false, nil
+	}
+
+	body, err := json.Marshal(updated)
+	if err != nil {
+		return false, fmt.Errorf("marshal tls config: %w", err)
+	}
+	// POST creates the tls app or replaces it wholesale
+	status, respBody, err := c.do(ctx, http.MethodPost, "/config/apps/tls", body)
+	if err != nil {
+		return false, fmt.Errorf("set tls config: %w", err)
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("caddy returned status %d: %s", status, string(respBody))
+	}
+	return true, nil
+}
+
+// CheckManagedCertificates reports whether SyncManagedCertificates would
+// change the tls app, without changing it.
+func (c *HTTPClient) CheckManagedCertificates(ctx context.Context, subjects []string, issuer ACMEIssuer) (bool, error) {
+	app, err := c.getTLSApp(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, changed := mergeManagedCertificates(app, subjects, issuer)
+	return changed, nil
+}
+
+// getTLSApp returns Caddy's tls app, or nil if it has none.
+func (c *HTTPClient) getTLSApp(ctx context.Context) (map[string]interface{}, error) {
+	status, body, err := c.do(ctx, http.MethodGet, "/config/apps/tls", nil)
+	if err != nil {
+		return nil, fmt.Errorf("get tls config: %w", err)
+	}
+	var app map[string]interface{}
+	switch status {
+	case http.StatusOK:
+		if err := json.Unmarshal(body, &app); err != nil {
+			return nil, fmt.Errorf("decode tls config: %w", err)
+		}
+	case http.StatusNotFound:
+	default:
+		return nil, fmt.Errorf("caddy returned status %d: %s", status, string(body))
+	}
+	return app, nil
+}
+
+// mergeManagedCertificates returns app with the control plane's policy and
+// automate entries set to subjects, and whether anything changed. Entries
+// in certificates.automate that the previous policy did not own are kept.
+func mergeManagedCertificates(app map[string]interface{}, subjects []string, issuer ACMEIssuer) (map[string]interface{}, bool) {
+	subjects = append([]string(nil), subjects...)
+	sort.Strings(subjects)
+	if app == nil {
+		if len(subjects) == 0 {
+			return nil, false
+		}
+		app = map[string]interface{}{}
+	}
+
+	automation, _ := app["automation"].(map[string]interface{})
+	if automation == nil {
+		automation = map[string]interface{}{}
+	}
+	policies, _ := automation["policies"].([]interface{})
+
+	var current map[string]interface{}
+	var others []interface{}
+	for _, p := range policies {
+		if m, ok := p.(map[string]interface{}); ok && m["@id"] == ACMEPolicyID {
+			current = m
+			continue
+		}
+		others = append(others, p)
+	}
+
+	var desired map[string]interface{}
+	if len(subjects) > 0 {
+		desired = roundTrip(issuer.automationPolicy(subjects))
+	}
+	if jsonEqual(current, desired) {
+		return app, false
+	}
+
+	// Our policy goes first so it wins for our subjects
+	if desired != nil {
+		others = append([]interface{}{desired}, others...)
+	}
+	automation["policies"] = others
+	app["automation"] = automation
+
+	owned := map[string]bool{}
+	if current != nil {
+		prev, _ := current["subjects"].([]interface{})
+		for _, s := range prev {
+			owned[fmt.Sprint(s)] = true
+		}
+	}
+	certs, _ := app["certificates"].(map[string]interface{})
+	if certs == nil {
+		certs = map[string]interface{}{}
+	}
+	automate, _ := certs["automate"].([]interface{})
+	kept := []interface{}{}
+	present := map[string]bool{}
+	for _, d := range automate {
+		if !owned[fmt.Sprint(d)] {
+			kept = append(kept, d)
+			present[fmt.Sprint(d)] = true
+		}
+	}
+	for _, s := range subjects {
+		if !present[s] {
+			kept = append(kept, s)
+		}
+	}
+	certs["automate"] = kept
+	app["certificates"] = certs
+	return app, true
+}
+
+// roundTrip converts v to its generic JSON form so it compares equal to
+// config decoded from Caddy.
+func roundTrip(v interface{}) map[string]interface{} {
+	b, _ := json.Marshal(v)
+	var m map[string]interface{}
+	json.Unmarshal(b, &m)
+	return m
+}
+
+func jsonEqual(a, b map[string]interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AgentConfig holds the configuration of a node agent, loaded from
+// environment variables and an optional config file like Config.
+type AgentConfig struct {
+	ControlPlaneURL  string // Base URL of the central control plane API (https://)
+	TLSCert          string // Agent client certificate; its CN identifies the node
+	TLSKey           string
+	TLSCA            string        // CA that signed the control plane's server certificate
+	Endpoint         string        // Public WireGuard host:port of this node ("" = the one set on the node)
+	SyncInterval     time.Duration // How often desired state is fetched and applied
+	CaddyAdminSocket string
+	WGInterface      string
+	LogLevel         string
+	ReservedPorts    map[int]bool
+	ACMEEmail        string
+	ACMECA           string
+}
+
+// LoadAgent reads the agent configuration and returns it validated.
+func LoadAgent() (*AgentConfig, error) {
+	src, err := newSource()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &AgentConfig{
+		ControlPlaneURL:  strings.TrimSuffix(src.get("AGENT_CONTROL_PLANE_URL"), "/"),
+		TLSCert:          src.get("AGENT_TLS_CERT"),
+		TLSKey:           src.get("AGENT_TLS_KEY"),
+		TLSCA:            src.get("AGENT_TLS_CA"),
+		Endpoint:         src.get("AGENT_ENDPOINT"),
+		CaddyAdminSocket: src.getOr("CADDY_ADMIN_SOCKET", "/run/caddy/admin.sock"),
+		WGInterface:      src.getOr("WG_INTERFACE", "wg0"),
+		LogLevel:         src.getOr("LOG_LEVEL", "info"),
+		ACMEEmail:        src.get("ACME_EMAIL"),
+		ACMECA:           src.get("ACME_CA"),
+	}
+
+	intervalStr := src.getOr("AGENT_SYNC_INTERVAL", "30")
+	intervalSec, err := strconv.Atoi(intervalStr)
+	if err != nil || intervalSec < 1 {
+		return nil, fmt.Errorf("invalid AGENT_SYNC_INTERVAL: %q", intervalStr)
+	}
+	cfg.SyncInterval = time.Duration(intervalSec) * time.Second
+
+	reservedStr := src.getOr("RESERVED_PORTS", DefaultReservedPorts)
+	cfg.ReservedPorts, err = parsePorts(reservedStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RESERVED_PORTS: %w", err)
+	}
+
+	if unknown := src.unknownKeys(); len(unknown) > 0 {
+		return nil, fmt.Errorf("CONFIG_FILE has unknown keys: %s", strings.Join(unknown, ", "))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that all required fields are present and valid.
+func (c *AgentConfig) Validate() error {
+	var errs []string
+
+	if u, err := url.Parse(c.ControlPlaneURL); c.ControlPlaneURL == "" || err != nil || u.Scheme != "https" || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("AGENT_CONTROL_PLANE_URL must be an https URL; got %q", c.ControlPlaneURL))
+	}
+	if c.TLSCert == "" || c.TLSKey == "" || c.TLSCA == "" {
+		errs = append(errs, "AGENT_TLS_CERT, AGENT_TLS_KEY, and AGENT_TLS_CA are required")
+	}
+	if c.CaddyAdminSocket == "" {
+		errs = append(errs, "CADDY_ADMIN_SOCKET is required")
+	}
+	if c.WGInterface == "" {
+		errs = append(errs, "WG_INTERFACE is required")
+	}
+
+	validLevels := map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+	if !validLevels[c.LogLevel] {
+		errs = append(errs, fmt.Sprintf("LOG_LEVEL must be one of debug, info, warn, error; got %q", c.LogLevel))
+	}
+
+	if c.ACMECA != "" && !strings.HasPrefix(c.ACMECA, "https://") {
+		errs = append(errs, fmt.Sprintf("ACME_CA must be an https URL; got %q", c.ACMECA))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -2,52 +2,666 @@ package config
 
 import (
 	"fmt"
+	"maps"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/proxy-manager/controlplane/internal/wireguard"
 )
 
-// Config holds all configuration values for the control plane, loaded from environment variables.
+// Config holds all configuration values for the control plane, loaded from environment variables and an optional config file.
 type Config struct {
 	ListenAddr        string
 	CaddyAdminSocket  string
+	CaddyAdminURL     string // TCP admin endpoint (http:// or https://); overrides CaddyAdminSocket
+	CaddyAdminUser    string // Basic auth for CaddyAdminURL
+	CaddyAdminPass    string
+	CaddyAdminCert    string // Client certificate/key for mTLS to CaddyAdminURL
+	CaddyAdminKey     string
+	CaddyAdminCA      string // CA bundle that signed Caddy's admin certificate (default: system roots)
 	SQLitePath        string
 	ReconcileInterval time.Duration
+
+	// How often each subsystem is reconciled and stats collected
+	// (0 = ReconcileInterval)
+	ReconcileIntervalCaddy time.Duration
+	ReconcileIntervalWG    time.Duration
+	ReconcileIntervalFW    time.Duration
+	ReconcileIntervalStats time.Duration
+
+	ReconcileMode string // "enforce" corrects drift; "observe" only records and reports it
+
 	LogLevel          string
 	WGInterface       string
 	WGSubnet          string
 	WGServerIP        string
+	WGAddressPools    []netip.Prefix // Pools within WGSubnet that VPN IPs are allocated from, in order (nil = all of WGSubnet)
 	TLSCert           string
 	TLSKey            string
 	TLSClientCA       string
-	ServerEndpoint    string // Public IP:port for WireGuard endpoint (VPS_PUBLIC_IP:51820)
+	TLSClientCAKey    string            // Key of a CA in TLSClientCA; enables client certificate issuance ("" = disabled)
+	TLSReloadInterval time.Duration     // How often TLS files are checked for renewal
+	ServerEndpoint    string            // Public IP:port for WireGuard endpoint (VPS_PUBLIC_IP:51820)
+	AdminCNs          []string          // Client certificate CNs with cross-tenant admin access
+	RoleMap           map[string]string // "cn:<name>" or "ou:<unit>" -> admin|operator|read-only
+	DefaultRole       string            // Role for clients matching no mapping ("" = deny once mappings exist)
+	StatsRetention    time.Duration     // How long per-tunnel traffic samples are kept (0 = history disabled)
+	RouteStatsHistory time.Duration     // How long per-route traffic samples are kept (0 = route stats disabled)
+	TunnelRetention   time.Duration     // How long deleted tunnels can be restored before they are purged (0 = delete immediately)
+	KeyEscrow         time.Duration     // How long server-generated private keys stay downloadable as a config or QR code (0 = never)
+	TunnelApproval    bool              // Tunnels created by non-admins wait for an admin to approve them
+	ApprovalTTL       time.Duration     // How long a tunnel waits for approval before it is discarded (0 = until an admin decides)
+	ImportOnStart     bool              // Adopt unknown WireGuard peers and Caddy routes before the first reconciliation
+	UnmanagedPolicy   map[string]string // "caddy", "wireguard", "firewall" -> ignore|report|delete for resources the control plane did not create
+	InactivityWarning time.Duration     // Warn this long before inactivity revocation or expires_at (0 = no warning)
+	WGKeepalive       time.Duration     // Default persistent keepalive of tunnels (0 = disabled)
+	ConnectedWindow   time.Duration     // Default age of the last handshake under which a peer counts as connected
+	WebhookURLs       []string          // Receivers for event webhooks
+	WebhookSecret     string            // HMAC key for signing webhook bodies
+	ValidateURL       string            // Webhook that approves or vetoes tunnel and route creates and deletes ("" = none)
+	ValidateSecret    string            // HMAC key for signing validation requests
+	ValidateTimeout   time.Duration     // How long a validation request may take
+	ValidateFailOpen  bool              // Allow changes when the validation webhook fails instead of rejecting them
+	CaddyRetries      int               // Retries per Caddy admin call after the first attempt
+	BreakerThreshold  int               // Consecutive Caddy failures that open the circuit breaker (0 = disabled)
+	BreakerCooldown   time.Duration     // How long the Caddy breaker stays open before a trial call
+	CaddyWatch        time.Duration     // How often Caddy's config is polled for out-of-band changes (0 = disabled)
+	ACMEEmail         string            // ACME account contact for certificates of routes that terminate TLS
+	ACMECA            string            // ACME directory URL (default: Let's Encrypt)
+	ReservedPorts     map[int]bool      // Management ports no route, tunnel, or firewall rule may use
+	AuditBodyLimit    int               // Max bytes of redacted request body per audit entry (0 = no bodies or diffs)
+	MaxBodyBytes      int64             // Largest accepted API request body
+	RateLimitRead     int               // GET requests per minute per client
+	RateLimitMutate   int               // Other API requests per minute per client
+	TrustedProxies    []netip.Prefix    // Peers whose X-Forwarded-For names the client
+	AuditFile         string            // JSON lines copy of the audit log ("" = none)
+	AuditFileMaxBytes int64             // Size at which AuditFile is rotated
+	AuditFileKeep     int               // Rotated audit files kept
+	AuditSyslog       string            // "local", "udp://host:port", or "tcp://host:port" ("" = none)
+	AuditHTTPURL      string            // Collector receiving each audit entry as a JSON POST ("" = none)
+	AuditHTTPSecret   string            // HMAC key for signing audit POSTs
+	AuditRetention    time.Duration     // Age at which audit log entries are pruned (0 = kept forever)
+	AuditArchiveDir   string            // Directory pruned audit entries are archived to ("" = not archived)
+	HALeaseTTL        time.Duration     // Leader lease duration for active/standby instances (0 = single instance)
+	HAInstanceID      string            // This instance's identity in leader election (default: hostname)
+
+	DNSProvider      string // "cloudflare", "route53", "rfc2136", or "" to manage no DNS records
+	DNSTargetIPv4    string // Address published in A records (default: SERVER_ENDPOINT host, if IPv4)
+	DNSTargetIPv6    string // Address published in AAAA records (default: SERVER_ENDPOINT host, if IPv6)
+	DNSTTL           int
+	CloudflareToken  string
+	CloudflareZoneID string
+	Route53ZoneID    string
+	AWSAccessKeyID   string
+	AWSSecretKey     string
+	AWSSessionToken  string
+	RFC2136Server    string // host:port of the primary accepting DNS UPDATE
+	RFC2136Zone      string
+	RFC2136KeyName   string // TSIG key name; empty sends unsigned updates
+	RFC2136Secret    string // base64 TSIG secret
+	RFC2136Algorithm string // TSIG algorithm (default hmac-sha256)
+
+	BanLogFile   string         // Caddy JSON log watched for abusive sources ("" = automatic bans disabled)
+	BanThreshold int            // Warnings/errors from one source within BanWindow that trigger a ban
+	BanWindow    time.Duration  // Sliding window events are counted in
+	BanDuration  time.Duration  // How long a source stays banned
+	BanIgnore    []netip.Prefix // Sources that are never banned
+
+	FirewallPolicy        string // "accept", or "drop" to deny traffic to the VPS no rule or service allows
+	FirewallForwardPolicy string // The same for traffic forwarded through the WireGuard interface
+	FirewallPriority      int    // Hook priority of the dynamic chains (0 = filter)
+	FirewallSSHPort       int    // SSH port kept open under a drop policy (0 = none)
+
+	WGFallbackTransport string // "wstunnel" or "udp2tcp" to offer WireGuard over TCP to clients without UDP ("" = no fallback)
+	WGFallbackHost      string // Public host clients reach the fallback at; the SNI routed to it for wstunnel
+	WGFallbackPort      int    // Public TCP port of the fallback: 443 for wstunnel, the listener Caddy opens for udp2tcp
+	WGFallbackUpstream  string // host:port of the server-side relay Caddy forwards fallback connections to
+
+	WGAltPorts []int // Extra UDP ports nftables redirects to the WireGuard port, advertised in client configs (sorted)
+
+	ProbeInterval time.Duration // How often each peer's latency is probed (0 = probing disabled)
+	ProbeMethod   string        // "icmp" (echo to the VPN IP) or "tcp" (connect to a route's upstream)
+	ProbeTimeout  time.Duration // How long a probe waits before counting as lost
+	ProbeWindow   int           // Latest probes per peer that latency and loss are computed over
+
+	BackupS3Bucket     string        // Bucket receiving database snapshots ("" = backups disabled)
+	BackupS3Endpoint   string        // S3-compatible endpoint URL (default: AWS S3 in BackupS3Region)
+	BackupS3Region     string        // Region requests are signed for
+	BackupS3Prefix     string        // Key prefix for snapshots
+	BackupAccessKey    string        // Default: AWS_ACCESS_KEY_ID
+	BackupSecretKey    string        // Default: AWS_SECRET_ACCESS_KEY
+	BackupSessionToken string        // Default: AWS_SESSION_TOKEN
+	BackupInterval     time.Duration // How often the database is checked for changes and uploaded
+	BackupRetain       int           // Snapshots kept in the bucket (0 = all)
+
+	DBCheckpointInterval time.Duration // How often the WAL is checkpointed and truncated (0 = SQLite's automatic checkpoints only)
+	DBIntegrityInterval  time.Duration // How often the database is checked for corruption (0 = never)
+	DBVacuumInterval     time.Duration // How often free pages are returned to the OS (0 = never)
+	DBQueryTimeout       time.Duration // Longest a tunnel, route, or firewall query may run (0 = unbounded)
 }
 
-// Load reads configuration from environment variables and returns a validated Config.
+// DefaultReservedPorts protects SSH, the Caddy admin API, the control plane
+// API, and WireGuard when RESERVED_PORTS is not set.
+const DefaultReservedPorts = "22,2019,7443,51820"
+
+// ValidRoles are the API roles accepted in ROLE_MAP, DEFAULT_ROLE, and token scopes.
+var ValidRoles = map[string]bool{"admin": true, "operator": true, "read-only": true}
+
+// What the reconciler does with a resource it finds in Caddy, WireGuard, or
+// nftables that the control plane did not create.
+const (
+	UnmanagedIgnore = "ignore" // leave it alone
+	UnmanagedReport = "report" // leave it alone, log it once, and list it in the status
+	UnmanagedDelete = "delete" // remove it like any other drift
+)
+
+// ValidUnmanagedPolicies are the accepted unmanaged resource policies.
+var ValidUnmanagedPolicies = map[string]bool{UnmanagedIgnore: true, UnmanagedReport: true, UnmanagedDelete: true}
+
+// DefaultUnmanagedPolicies only reports WireGuard peers added by hand, which
+// are often someone's working connection, and Caddy routes and servers
+// configured next to the control plane's. Stray rules in the control
+// plane's own nftables chains are removed.
+var DefaultUnmanagedPolicies = map[string]string{
+	"caddy":     UnmanagedReport,
+	"wireguard": UnmanagedReport,
+	"firewall":  UnmanagedDelete,
+}
+
+// Load reads configuration from environment variables and, if CONFIG_FILE
+// names a YAML or TOML file, from that file, and returns a validated Config.
+// Environment variables override values from the file.
 func Load() (*Config, error) {
+	src, err := newSource()
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := &Config{
-		ListenAddr:       envOrDefault("LISTEN_ADDR", ":7443"),
-		CaddyAdminSocket: envOrDefault("CADDY_ADMIN_SOCKET", "/run/caddy/admin.sock"),
-		SQLitePath:       envOrDefault("SQLITE_PATH", "/var/lib/controlplane/config.db"),
-		LogLevel:         envOrDefault("LOG_LEVEL", "info"),
-		WGInterface:      envOrDefault("WG_INTERFACE", "wg0"),
-		WGSubnet:         envOrDefault("WG_SUBNET", "10.0.0.0/24"),
-		WGServerIP:       envOrDefault("WG_SERVER_IP", "10.0.0.1"),
-		TLSCert:          os.Getenv("TLS_CERT"),
-		TLSKey:           os.Getenv("TLS_KEY"),
-		TLSClientCA:      os.Getenv("TLS_CLIENT_CA"),
-		ServerEndpoint:   envOrDefault("SERVER_ENDPOINT", ""),
-	}
-
-	intervalStr := envOrDefault("RECONCILE_INTERVAL", "30")
+		ListenAddr:       src.getOr("LISTEN_ADDR", ":7443"),
+		CaddyAdminSocket: src.getOr("CADDY_ADMIN_SOCKET", "/run/caddy/admin.sock"),
+		CaddyAdminURL:    strings.TrimSuffix(src.get("CADDY_ADMIN_URL"), "/"),
+		CaddyAdminUser:   src.get("CADDY_ADMIN_USER"),
+		CaddyAdminPass:   src.get("CADDY_ADMIN_PASSWORD"),
+		CaddyAdminCert:   src.get("CADDY_ADMIN_CERT"),
+		CaddyAdminKey:    src.get("CADDY_ADMIN_KEY"),
+		CaddyAdminCA:     src.get("CADDY_ADMIN_CA"),
+		SQLitePath:       src.getOr("SQLITE_PATH", "/var/lib/controlplane/config.db"),
+		ReconcileMode:    src.getOr("RECONCILE_MODE", "enforce"),
+		LogLevel:         src.getOr("LOG_LEVEL", "info"),
+		WGInterface:      src.getOr("WG_INTERFACE", "wg0"),
+		WGSubnet:         src.getOr("WG_SUBNET", "10.0.0.0/24"),
+		WGServerIP:       src.getOr("WG_SERVER_IP", "10.0.0.1"),
+		TLSCert:          src.get("TLS_CERT"),
+		TLSKey:           src.get("TLS_KEY"),
+		TLSClientCA:      src.get("TLS_CLIENT_CA"),
+		TLSClientCAKey:   src.get("TLS_CLIENT_CA_KEY"),
+		ServerEndpoint:   src.getOr("SERVER_ENDPOINT", ""),
+		AdminCNs:         splitList(src.get("ADMIN_CNS")),
+		DefaultRole:      src.get("DEFAULT_ROLE"),
+		WebhookURLs:      splitList(src.get("WEBHOOK_URLS")),
+		WebhookSecret:    src.get("WEBHOOK_SECRET"),
+		ValidateURL:      src.get("VALIDATION_WEBHOOK_URL"),
+		ValidateSecret:   src.get("VALIDATION_WEBHOOK_SECRET"),
+		ACMEEmail:        src.get("ACME_EMAIL"),
+		ACMECA:           src.get("ACME_CA"),
+		DNSProvider:      src.get("DNS_PROVIDER"),
+		DNSTargetIPv4:    src.get("DNS_TARGET_IPV4"),
+		DNSTargetIPv6:    src.get("DNS_TARGET_IPV6"),
+		CloudflareToken:  src.get("CLOUDFLARE_API_TOKEN"),
+		CloudflareZoneID: src.get("CLOUDFLARE_ZONE_ID"),
+		Route53ZoneID:    src.get("ROUTE53_HOSTED_ZONE_ID"),
+		AWSAccessKeyID:   src.get("AWS_ACCESS_KEY_ID"),
+		AWSSecretKey:     src.get("AWS_SECRET_ACCESS_KEY"),
+		AWSSessionToken:  src.get("AWS_SESSION_TOKEN"),
+		RFC2136Server:    src.get("RFC2136_SERVER"),
+		RFC2136Zone:      src.get("RFC2136_ZONE"),
+		RFC2136KeyName:   src.get("RFC2136_TSIG_KEY"),
+		RFC2136Secret:    src.get("RFC2136_TSIG_SECRET"),
+		RFC2136Algorithm: src.get("RFC2136_TSIG_ALGORITHM"),
+		BanLogFile:       src.get("BAN_LOG_FILE"),
+		FirewallPolicy:   src.getOr("FIREWALL_POLICY", "accept"),
+		ProbeMethod:      src.getOr("PROBE_METHOD", "icmp"),
+		AuditFile:        src.get("AUDIT_FILE"),
+		AuditSyslog:      src.get("AUDIT_SYSLOG"),
+		AuditHTTPURL:     src.get("AUDIT_HTTP_URL"),
+		AuditHTTPSecret:  src.get("AUDIT_HTTP_SECRET"),
+		AuditArchiveDir:  src.get("AUDIT_ARCHIVE_DIR"),
+		HAInstanceID:     src.get("HA_INSTANCE_ID"),
+
+		BackupS3Bucket:     src.get("BACKUP_S3_BUCKET"),
+		BackupS3Endpoint:   strings.TrimSuffix(src.get("BACKUP_S3_ENDPOINT"), "/"),
+		BackupS3Region:     src.getOr("BACKUP_S3_REGION", "us-east-1"),
+		BackupS3Prefix:     src.getOr("BACKUP_S3_PREFIX", "controlplane"),
+		BackupAccessKey:    src.get("BACKUP_S3_ACCESS_KEY_ID"),
+		BackupSecretKey:    src.get("BACKUP_S3_SECRET_ACCESS_KEY"),
+		BackupSessionToken: src.get("BACKUP_S3_SESSION_TOKEN"),
+	}
+	// Backups use the AWS credentials unless given their own
+	if cfg.BackupAccessKey == "" && cfg.BackupSecretKey == "" {
+		cfg.BackupAccessKey, cfg.BackupSecretKey = cfg.AWSAccessKeyID, cfg.AWSSecretKey
+		if cfg.BackupSessionToken == "" {
+			cfg.BackupSessionToken = cfg.AWSSessionToken
+		}
+	}
+
+	roleMap, err := parseRoleMap(src.get("ROLE_MAP"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ROLE_MAP: %w", err)
+	}
+	cfg.RoleMap = roleMap
+
+	intervalStr := src.getOr("RECONCILE_INTERVAL", "30")
 	intervalSec, err := strconv.Atoi(intervalStr)
 	if err != nil || intervalSec < 1 {
 		return nil, fmt.Errorf("invalid RECONCILE_INTERVAL: %q", intervalStr)
 	}
 	cfg.ReconcileInterval = time.Duration(intervalSec) * time.Second
 
+	caddyIntervalStr := src.getOr("RECONCILE_INTERVAL_CADDY", "0")
+	caddyIntervalSec, err := strconv.Atoi(caddyIntervalStr)
+	if err != nil || caddyIntervalSec < 0 {
+		return nil, fmt.Errorf("invalid RECONCILE_INTERVAL_CADDY: %q", caddyIntervalStr)
+	}
+	cfg.ReconcileIntervalCaddy = time.Duration(caddyIntervalSec) * time.Second
+
+	wgIntervalStr := src.getOr("RECONCILE_INTERVAL_WG", "0")
+	wgIntervalSec, err := strconv.Atoi(wgIntervalStr)
+	if err != nil || wgIntervalSec < 0 {
+		return nil, fmt.Errorf("invalid RECONCILE_INTERVAL_WG: %q", wgIntervalStr)
+	}
+	cfg.ReconcileIntervalWG = time.Duration(wgIntervalSec) * time.Second
+
+	fwIntervalStr := src.getOr("RECONCILE_INTERVAL_FW", "0")
+	fwIntervalSec, err := strconv.Atoi(fwIntervalStr)
+	if err != nil || fwIntervalSec < 0 {
+		return nil, fmt.Errorf("invalid RECONCILE_INTERVAL_FW: %q", fwIntervalStr)
+	}
+	cfg.ReconcileIntervalFW = time.Duration(fwIntervalSec) * time.Second
+
+	statsIntervalStr := src.getOr("RECONCILE_INTERVAL_STATS", "0")
+	statsIntervalSec, err := strconv.Atoi(statsIntervalStr)
+	if err != nil || statsIntervalSec < 0 {
+		return nil, fmt.Errorf("invalid RECONCILE_INTERVAL_STATS: %q", statsIntervalStr)
+	}
+	cfg.ReconcileIntervalStats = time.Duration(statsIntervalSec) * time.Second
+
+	retentionStr := src.getOr("STATS_RETENTION_DAYS", "30")
+	retentionDays, err := strconv.Atoi(retentionStr)
+	if err != nil || retentionDays < 0 {
+		return nil, fmt.Errorf("invalid STATS_RETENTION_DAYS: %q", retentionStr)
+	}
+	cfg.StatsRetention = time.Duration(retentionDays) * 24 * time.Hour
+
+	routeRetentionStr := src.getOr("ROUTE_STATS_RETENTION_HOURS", "24")
+	routeRetentionHours, err := strconv.Atoi(routeRetentionStr)
+	if err != nil || routeRetentionHours < 0 {
+		return nil, fmt.Errorf("invalid ROUTE_STATS_RETENTION_HOURS: %q", routeRetentionStr)
+	}
+	cfg.RouteStatsHistory = time.Duration(routeRetentionHours) * time.Hour
+
+	tunnelRetentionStr := src.getOr("TUNNEL_RETENTION_DAYS", "7")
+	tunnelRetentionDays, err := strconv.Atoi(tunnelRetentionStr)
+	if err != nil || tunnelRetentionDays < 0 {
+		return nil, fmt.Errorf("invalid TUNNEL_RETENTION_DAYS: %q", tunnelRetentionStr)
+	}
+	cfg.TunnelRetention = time.Duration(tunnelRetentionDays) * 24 * time.Hour
+
+	escrowStr := src.getOr("KEY_ESCROW_MINUTES", "15")
+	escrowMinutes, err := strconv.Atoi(escrowStr)
+	if err != nil || escrowMinutes < 0 {
+		return nil, fmt.Errorf("invalid KEY_ESCROW_MINUTES: %q", escrowStr)
+	}
+	cfg.KeyEscrow = time.Duration(escrowMinutes) * time.Minute
+
+	warningStr := src.getOr("INACTIVITY_WARNING_DAYS", "7")
+	warningDays, err := strconv.Atoi(warningStr)
+	if err != nil || warningDays < 0 {
+		return nil, fmt.Errorf("invalid INACTIVITY_WARNING_DAYS: %q", warningStr)
+	}
+	cfg.InactivityWarning = time.Duration(warningDays) * 24 * time.Hour
+
+	approvalStr := src.getOr("TUNNEL_APPROVAL", "false")
+	cfg.TunnelApproval, err = strconv.ParseBool(approvalStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUNNEL_APPROVAL: %q", approvalStr)
+	}
+
+	approvalTTLStr := src.getOr("TUNNEL_APPROVAL_TTL_HOURS", "72")
+	approvalTTLHours, err := strconv.Atoi(approvalTTLStr)
+	if err != nil || approvalTTLHours < 0 {
+		return nil, fmt.Errorf("invalid TUNNEL_APPROVAL_TTL_HOURS: %q", approvalTTLStr)
+	}
+	cfg.ApprovalTTL = time.Duration(approvalTTLHours) * time.Hour
+
+	importStr := src.getOr("IMPORT_ON_START", "false")
+	cfg.ImportOnStart, err = strconv.ParseBool(importStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IMPORT_ON_START: %q", importStr)
+	}
+
+	validateTimeoutStr := src.getOr("VALIDATION_WEBHOOK_TIMEOUT", "5")
+	validateTimeoutSec, err := strconv.Atoi(validateTimeoutStr)
+	if err != nil || validateTimeoutSec < 1 {
+		return nil, fmt.Errorf("invalid VALIDATION_WEBHOOK_TIMEOUT: %q", validateTimeoutStr)
+	}
+	cfg.ValidateTimeout = time.Duration(validateTimeoutSec) * time.Second
+
+	failOpenStr := src.getOr("VALIDATION_WEBHOOK_FAIL_OPEN", "false")
+	cfg.ValidateFailOpen, err = strconv.ParseBool(failOpenStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VALIDATION_WEBHOOK_FAIL_OPEN: %q", failOpenStr)
+	}
+
+	// UNMANAGED_POLICY sets every subsystem; UNMANAGED_POLICY_<SUBSYSTEM>
+	// overrides it for one. The global value is checked here, so that
+	// Validate can name the subsystem variable a bad policy came from.
+	unmanagedPolicy := src.get("UNMANAGED_POLICY")
+	if unmanagedPolicy != "" && !ValidUnmanagedPolicies[unmanagedPolicy] {
+		return nil, fmt.Errorf("invalid UNMANAGED_POLICY: %q (must be ignore, report, or delete)", unmanagedPolicy)
+	}
+	cfg.UnmanagedPolicy = maps.Clone(DefaultUnmanagedPolicies)
+	for system := range cfg.UnmanagedPolicy {
+		if policy := src.getOr("UNMANAGED_POLICY_"+strings.ToUpper(system), unmanagedPolicy); policy != "" {
+			cfg.UnmanagedPolicy[system] = policy
+		}
+	}
+
+	keepaliveStr := src.getOr("WG_PERSISTENT_KEEPALIVE", "25")
+	keepaliveSec, err := strconv.Atoi(keepaliveStr)
+	if err != nil || keepaliveSec < 0 || keepaliveSec > 65535 {
+		return nil, fmt.Errorf("invalid WG_PERSISTENT_KEEPALIVE: %q", keepaliveStr)
+	}
+	cfg.WGKeepalive = time.Duration(keepaliveSec) * time.Second
+
+	for _, p := range splitList(src.get("WG_ADDRESS_POOLS")) {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WG_ADDRESS_POOLS: %w", err)
+		}
+		cfg.WGAddressPools = append(cfg.WGAddressPools, prefix.Masked())
+	}
+
+	connectedStr := src.getOr("CONNECTED_THRESHOLD", "300")
+	connectedSec, err := strconv.Atoi(connectedStr)
+	if err != nil || connectedSec < 1 {
+		return nil, fmt.Errorf("invalid CONNECTED_THRESHOLD: %q", connectedStr)
+	}
+	cfg.ConnectedWindow = time.Duration(connectedSec) * time.Second
+
+	retriesStr := src.getOr("CADDY_RETRIES", "3")
+	cfg.CaddyRetries, err = strconv.Atoi(retriesStr)
+	if err != nil || cfg.CaddyRetries < 0 {
+		return nil, fmt.Errorf("invalid CADDY_RETRIES: %q", retriesStr)
+	}
+
+	thresholdStr := src.getOr("CADDY_BREAKER_THRESHOLD", "5")
+	cfg.BreakerThreshold, err = strconv.Atoi(thresholdStr)
+	if err != nil || cfg.BreakerThreshold < 0 {
+		return nil, fmt.Errorf("invalid CADDY_BREAKER_THRESHOLD: %q", thresholdStr)
+	}
+
+	cooldownStr := src.getOr("CADDY_BREAKER_COOLDOWN", "30")
+	cooldownSec, err := strconv.Atoi(cooldownStr)
+	if err != nil || cooldownSec < 1 {
+		return nil, fmt.Errorf("invalid CADDY_BREAKER_COOLDOWN: %q", cooldownStr)
+	}
+	cfg.BreakerCooldown = time.Duration(cooldownSec) * time.Second
+
+	watchStr := src.getOr("CADDY_WATCH_INTERVAL", "5")
+	watchSec, err := strconv.Atoi(watchStr)
+	if err != nil || watchSec < 0 {
+		return nil, fmt.Errorf("invalid CADDY_WATCH_INTERVAL: %q", watchStr)
+	}
+	cfg.CaddyWatch = time.Duration(watchSec) * time.Second
+
+	ttlStr := src.getOr("DNS_TTL", "300")
+	cfg.DNSTTL, err = strconv.Atoi(ttlStr)
+	if err != nil || cfg.DNSTTL < 1 {
+		return nil, fmt.Errorf("invalid DNS_TTL: %q", ttlStr)
+	}
+	if cfg.DNSProvider != "" && cfg.DNSTargetIPv4 == "" && cfg.DNSTargetIPv6 == "" {
+		if host, _, err := net.SplitHostPort(cfg.ServerEndpoint); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+				cfg.DNSTargetIPv4 = host
+			} else if ip != nil {
+				cfg.DNSTargetIPv6 = host
+			}
+		}
+	}
+
+	reservedStr := src.getOr("RESERVED_PORTS", DefaultReservedPorts)
+	cfg.ReservedPorts, err = parsePorts(reservedStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RESERVED_PORTS: %w", err)
+	}
+
+	cfg.FirewallForwardPolicy = src.getOr("FIREWALL_FORWARD_POLICY", "accept")
+
+	cfg.WGFallbackTransport = src.get("WG_FALLBACK_TRANSPORT")
+	cfg.WGFallbackHost = src.get("WG_FALLBACK_HOST")
+	cfg.WGFallbackUpstream = src.get("WG_FALLBACK_UPSTREAM")
+	fallbackPortStr := src.get("WG_FALLBACK_PORT")
+	if fallbackPortStr == "" && cfg.WGFallbackTransport == wireguard.TransportWSTunnel {
+		fallbackPortStr = "443"
+	}
+	if fallbackPortStr != "" {
+		cfg.WGFallbackPort, err = strconv.Atoi(fallbackPortStr)
+		if err != nil || cfg.WGFallbackPort < 1 || cfg.WGFallbackPort > 65535 {
+			return nil, fmt.Errorf("invalid WG_FALLBACK_PORT: %q", fallbackPortStr)
+		}
+	}
+	if cfg.WGFallbackTransport == wireguard.TransportUDP2TCP {
+		// Caddy listens on the port itself, so nothing else may claim it
+		if cfg.WGFallbackHost == "" {
+			cfg.WGFallbackHost, _, _ = net.SplitHostPort(cfg.ServerEndpoint)
+		}
+		if cfg.WGFallbackPort > 0 {
+			cfg.ReservedPorts[cfg.WGFallbackPort] = true
+		}
+	}
+
+	altPorts, err := parsePorts(src.get("WG_ALT_PORTS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WG_ALT_PORTS: %w", err)
+	}
+	for port := range altPorts {
+		cfg.WGAltPorts = append(cfg.WGAltPorts, port)
+	}
+	sort.Ints(cfg.WGAltPorts)
+
+	fwPriorityStr := src.getOr("FIREWALL_PRIORITY", "0")
+	fwPriority, err := strconv.ParseInt(fwPriorityStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FIREWALL_PRIORITY: %q", fwPriorityStr)
+	}
+	cfg.FirewallPriority = int(fwPriority)
+
+	sshPortStr := src.getOr("FIREWALL_SSH_PORT", "22")
+	cfg.FirewallSSHPort, err = strconv.Atoi(sshPortStr)
+	if err != nil || cfg.FirewallSSHPort < 0 || cfg.FirewallSSHPort > 65535 {
+		return nil, fmt.Errorf("invalid FIREWALL_SSH_PORT: %q", sshPortStr)
+	}
+
+	banThresholdStr := src.getOr("BAN_THRESHOLD", "20")
+	cfg.BanThreshold, err = strconv.Atoi(banThresholdStr)
+	if err != nil || cfg.BanThreshold < 1 {
+		return nil, fmt.Errorf("invalid BAN_THRESHOLD: %q", banThresholdStr)
+	}
+
+	banWindowStr := src.getOr("BAN_WINDOW", "60")
+	banWindowSec, err := strconv.Atoi(banWindowStr)
+	if err != nil || banWindowSec < 1 {
+		return nil, fmt.Errorf("invalid BAN_WINDOW: %q", banWindowStr)
+	}
+	cfg.BanWindow = time.Duration(banWindowSec) * time.Second
+
+	banDurationStr := src.getOr("BAN_DURATION", "3600")
+	banDurationSec, err := strconv.Atoi(banDurationStr)
+	if err != nil || banDurationSec < 1 {
+		return nil, fmt.Errorf("invalid BAN_DURATION: %q", banDurationStr)
+	}
+	cfg.BanDuration = time.Duration(banDurationSec) * time.Second
+
+	for _, p := range splitList(src.getOr("BAN_IGNORE_CIDRS", "127.0.0.0/8,::1/128")) {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BAN_IGNORE_CIDRS: %w", err)
+		}
+		cfg.BanIgnore = append(cfg.BanIgnore, prefix.Masked())
+	}
+
+	probeIntervalStr := src.getOr("PROBE_INTERVAL", "0")
+	probeIntervalSec, err := strconv.Atoi(probeIntervalStr)
+	if err != nil || probeIntervalSec < 0 {
+		return nil, fmt.Errorf("invalid PROBE_INTERVAL: %q", probeIntervalStr)
+	}
+	cfg.ProbeInterval = time.Duration(probeIntervalSec) * time.Second
+
+	probeTimeoutStr := src.getOr("PROBE_TIMEOUT", "2")
+	probeTimeoutSec, err := strconv.Atoi(probeTimeoutStr)
+	if err != nil || probeTimeoutSec < 1 {
+		return nil, fmt.Errorf("invalid PROBE_TIMEOUT: %q", probeTimeoutStr)
+	}
+	cfg.ProbeTimeout = time.Duration(probeTimeoutSec) * time.Second
+
+	probeWindowStr := src.getOr("PROBE_WINDOW", "20")
+	cfg.ProbeWindow, err = strconv.Atoi(probeWindowStr)
+	if err != nil || cfg.ProbeWindow < 1 {
+		return nil, fmt.Errorf("invalid PROBE_WINDOW: %q", probeWindowStr)
+	}
+
+	auditBodyStr := src.getOr("AUDIT_BODY_LIMIT", "0")
+	cfg.AuditBodyLimit, err = strconv.Atoi(auditBodyStr)
+	if err != nil || cfg.AuditBodyLimit < 0 {
+		return nil, fmt.Errorf("invalid AUDIT_BODY_LIMIT: %q", auditBodyStr)
+	}
+
+	maxBodyStr := src.getOr("MAX_BODY_BYTES", "1048576")
+	cfg.MaxBodyBytes, err = strconv.ParseInt(maxBodyStr, 10, 64)
+	if err != nil || cfg.MaxBodyBytes < 1 {
+		return nil, fmt.Errorf("invalid MAX_BODY_BYTES: %q", maxBodyStr)
+	}
+
+	rateReadStr := src.getOr("RATE_LIMIT_READ", "300")
+	cfg.RateLimitRead, err = strconv.Atoi(rateReadStr)
+	if err != nil || cfg.RateLimitRead < 1 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_READ: %q", rateReadStr)
+	}
+
+	rateMutateStr := src.getOr("RATE_LIMIT_MUTATE", "100")
+	cfg.RateLimitMutate, err = strconv.Atoi(rateMutateStr)
+	if err != nil || cfg.RateLimitMutate < 1 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_MUTATE: %q", rateMutateStr)
+	}
+
+	for _, p := range splitList(src.get("TRUSTED_PROXIES")) {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, prefix.Masked())
+	}
+
+	auditMaxStr := src.getOr("AUDIT_FILE_MAX_MB", "100")
+	auditMaxMB, err := strconv.Atoi(auditMaxStr)
+	if err != nil || auditMaxMB < 1 {
+		return nil, fmt.Errorf("invalid AUDIT_FILE_MAX_MB: %q", auditMaxStr)
+	}
+	cfg.AuditFileMaxBytes = int64(auditMaxMB) << 20
+
+	auditKeepStr := src.getOr("AUDIT_FILE_KEEP", "5")
+	cfg.AuditFileKeep, err = strconv.Atoi(auditKeepStr)
+	if err != nil || cfg.AuditFileKeep < 0 {
+		return nil, fmt.Errorf("invalid AUDIT_FILE_KEEP: %q", auditKeepStr)
+	}
+
+	auditRetentionStr := src.getOr("AUDIT_RETENTION_DAYS", "0")
+	auditRetentionDays, err := strconv.Atoi(auditRetentionStr)
+	if err != nil || auditRetentionDays < 0 {
+		return nil, fmt.Errorf("invalid AUDIT_RETENTION_DAYS: %q", auditRetentionStr)
+	}
+	cfg.AuditRetention = time.Duration(auditRetentionDays) * 24 * time.Hour
+	if cfg.AuditArchiveDir != "" && cfg.AuditRetention == 0 {
+		return nil, fmt.Errorf("AUDIT_ARCHIVE_DIR requires AUDIT_RETENTION_DAYS")
+	}
+
+	if _, _, err := ParseSyslogTarget(cfg.AuditSyslog); err != nil {
+		return nil, fmt.Errorf("invalid AUDIT_SYSLOG: %w", err)
+	}
+
+	leaseStr := src.getOr("HA_LEASE_TTL", "0")
+	leaseSec, err := strconv.Atoi(leaseStr)
+	if err != nil || leaseSec < 0 || (leaseSec > 0 && leaseSec < 3) {
+		return nil, fmt.Errorf("invalid HA_LEASE_TTL: %q (0 to disable, or at least 3)", leaseStr)
+	}
+	cfg.HALeaseTTL = time.Duration(leaseSec) * time.Second
+	if cfg.HALeaseTTL > 0 && cfg.HAInstanceID == "" {
+		if cfg.HAInstanceID, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("HA_INSTANCE_ID not set and hostname unavailable: %w", err)
+		}
+	}
+
+	backupIntervalStr := src.getOr("BACKUP_INTERVAL", "60")
+	backupIntervalSec, err := strconv.Atoi(backupIntervalStr)
+	if err != nil || backupIntervalSec < 1 {
+		return nil, fmt.Errorf("invalid BACKUP_INTERVAL: %q", backupIntervalStr)
+	}
+	cfg.BackupInterval = time.Duration(backupIntervalSec) * time.Second
+
+	backupRetainStr := src.getOr("BACKUP_RETAIN", "168")
+	cfg.BackupRetain, err = strconv.Atoi(backupRetainStr)
+	if err != nil || cfg.BackupRetain < 0 {
+		return nil, fmt.Errorf("invalid BACKUP_RETAIN: %q", backupRetainStr)
+	}
+
+	checkpointStr := src.getOr("DB_CHECKPOINT_INTERVAL", "300")
+	checkpointSec, err := strconv.Atoi(checkpointStr)
+	if err != nil || checkpointSec < 0 {
+		return nil, fmt.Errorf("invalid DB_CHECKPOINT_INTERVAL: %q", checkpointStr)
+	}
+	cfg.DBCheckpointInterval = time.Duration(checkpointSec) * time.Second
+
+	integrityStr := src.getOr("DB_INTEGRITY_INTERVAL", "86400")
+	integritySec, err := strconv.Atoi(integrityStr)
+	if err != nil || integritySec < 0 {
+		return nil, fmt.Errorf("invalid DB_INTEGRITY_INTERVAL: %q", integrityStr)
+	}
+	cfg.DBIntegrityInterval = time.Duration(integritySec) * time.Second
+
+	vacuumStr := src.getOr("DB_VACUUM_INTERVAL", "86400")
+	vacuumSec, err := strconv.Atoi(vacuumStr)
+	if err != nil || vacuumSec < 0 {
+		return nil, fmt.Errorf("invalid DB_VACUUM_INTERVAL: %q", vacuumStr)
+	}
+	cfg.DBVacuumInterval = time.Duration(vacuumSec) * time.Second
+
+	// A query must give up before the API's 30s write timeout cuts off the
+	// response it is for.
+	queryTimeoutStr := src.getOr("DB_QUERY_TIMEOUT", "10")
+	queryTimeoutSec, err := strconv.Atoi(queryTimeoutStr)
+	if err != nil || queryTimeoutSec < 0 || queryTimeoutSec >= 30 {
+		return nil, fmt.Errorf("invalid DB_QUERY_TIMEOUT: %q", queryTimeoutStr)
+	}
+	cfg.DBQueryTimeout = time.Duration(queryTimeoutSec) * time.Second
+
+	tlsReloadStr := src.getOr("TLS_RELOAD_INTERVAL", "60")
+	tlsReloadSec, err := strconv.Atoi(tlsReloadStr)
+	if err != nil || tlsReloadSec < 1 {
+		return nil, fmt.Errorf("invalid TLS_RELOAD_INTERVAL: %q", tlsReloadStr)
+	}
+	cfg.TLSReloadInterval = time.Duration(tlsReloadSec) * time.Second
+
+	if unknown := src.unknownKeys(); len(unknown) > 0 {
+		return nil, fmt.Errorf("CONFIG_FILE has unknown keys: %s", strings.Join(unknown, ", "))
+	}
+
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
@@ -63,8 +677,26 @@ func (c *Config) Validate() error {
 		errs = append(errs, "LISTEN_ADDR is required")
 	}
 
-	if c.CaddyAdminSocket == "" {
-		errs = append(errs, "CADDY_ADMIN_SOCKET is required")
+	if c.CaddyAdminURL == "" {
+		if c.CaddyAdminSocket == "" {
+			errs = append(errs, "CADDY_ADMIN_SOCKET or CADDY_ADMIN_URL is required")
+		}
+		if c.CaddyAdminUser != "" || c.CaddyAdminCert != "" || c.CaddyAdminCA != "" {
+			errs = append(errs, "CADDY_ADMIN_USER, CADDY_ADMIN_CERT, and CADDY_ADMIN_CA require CADDY_ADMIN_URL")
+		}
+	} else {
+		u, err := url.Parse(c.CaddyAdminURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("CADDY_ADMIN_URL must be an http(s) URL; got %q", c.CaddyAdminURL))
+		} else if u.Scheme != "https" && (c.CaddyAdminCert != "" || c.CaddyAdminCA != "") {
+			errs = append(errs, "CADDY_ADMIN_CERT and CADDY_ADMIN_CA require an https CADDY_ADMIN_URL")
+		}
+		if (c.CaddyAdminUser == "") != (c.CaddyAdminPass == "") {
+			errs = append(errs, "CADDY_ADMIN_USER and CADDY_ADMIN_PASSWORD must be set together")
+		}
+		if (c.CaddyAdminCert == "") != (c.CaddyAdminKey == "") {
+			errs = append(errs, "CADDY_ADMIN_CERT and CADDY_ADMIN_KEY must be set together")
+		}
 	}
 
 	if c.SQLitePath == "" {
@@ -75,12 +707,16 @@ func (c *Config) Validate() error {
 		errs = append(errs, "WG_INTERFACE is required")
 	}
 
+	var subnet netip.Prefix
 	if c.WGSubnet == "" {
 		errs = append(errs, "WG_SUBNET is required")
 	} else {
 		_, _, err := net.ParseCIDR(c.WGSubnet)
 		if err != nil {
 			errs = append(errs, fmt.Sprintf("WG_SUBNET is not a valid CIDR: %v", err))
+		} else if subnet = netip.MustParsePrefix(c.WGSubnet).Masked(); !subnet.Addr().Is4() || subnet.Bits() > 30 {
+			errs = append(errs, fmt.Sprintf("WG_SUBNET must be an IPv4 CIDR of /30 or larger; got %s", c.WGSubnet))
+			subnet = netip.Prefix{}
 		}
 	}
 
@@ -88,6 +724,23 @@ func (c *Config) Validate() error {
 		errs = append(errs, "WG_SERVER_IP is required")
 	} else if ip := net.ParseIP(c.WGServerIP); ip == nil {
 		errs = append(errs, fmt.Sprintf("WG_SERVER_IP is not a valid IP: %s", c.WGServerIP))
+	} else if addr := netip.MustParseAddr(c.WGServerIP); subnet.IsValid() && !subnet.Contains(addr) {
+		errs = append(errs, fmt.Sprintf("WG_SERVER_IP %s is outside WG_SUBNET %s", c.WGServerIP, subnet))
+	}
+
+	for i, pool := range c.WGAddressPools {
+		if !pool.Addr().Is4() || pool.Bits() > 30 {
+			errs = append(errs, fmt.Sprintf("WG_ADDRESS_POOLS entry %s must be an IPv4 CIDR of /30 or larger", pool))
+			continue
+		}
+		if subnet.IsValid() && (pool.Bits() < subnet.Bits() || !subnet.Contains(pool.Addr())) {
+			errs = append(errs, fmt.Sprintf("WG_ADDRESS_POOLS entry %s is outside WG_SUBNET %s", pool, subnet))
+		}
+		for _, other := range c.WGAddressPools[:i] {
+			if pool.Overlaps(other) {
+				errs = append(errs, fmt.Sprintf("WG_ADDRESS_POOLS entries %s and %s overlap", other, pool))
+			}
+		}
 	}
 
 	validLevels := map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
@@ -99,6 +752,73 @@ func (c *Config) Validate() error {
 		errs = append(errs, "RECONCILE_INTERVAL must be at least 1 second")
 	}
 
+	if c.DefaultRole != "" && !ValidRoles[c.DefaultRole] {
+		errs = append(errs, fmt.Sprintf("DEFAULT_ROLE must be one of admin, operator, read-only; got %q", c.DefaultRole))
+	}
+	for subject, role := range c.RoleMap {
+		if !ValidRoles[role] {
+			errs = append(errs, fmt.Sprintf("ROLE_MAP entry %q has invalid role %q", subject, role))
+		}
+	}
+
+	if c.ReconcileMode != "enforce" && c.ReconcileMode != "observe" {
+		errs = append(errs, fmt.Sprintf("RECONCILE_MODE must be enforce or observe; got %q", c.ReconcileMode))
+	}
+
+	if c.FirewallPolicy != "accept" && c.FirewallPolicy != "drop" {
+		errs = append(errs, fmt.Sprintf("FIREWALL_POLICY must be accept or drop; got %q", c.FirewallPolicy))
+	}
+	if c.FirewallForwardPolicy != "accept" && c.FirewallForwardPolicy != "drop" {
+		errs = append(errs, fmt.Sprintf("FIREWALL_FORWARD_POLICY must be accept or drop; got %q", c.FirewallForwardPolicy))
+	}
+
+	errs = append(errs, c.validateFallback()...)
+	for _, port := range c.WGAltPorts {
+		if port == c.WGPort() {
+			errs = append(errs, fmt.Sprintf("WG_ALT_PORTS cannot include the WireGuard port %d itself", port))
+		}
+	}
+
+	for system, policy := range c.UnmanagedPolicy {
+		if !ValidUnmanagedPolicies[policy] {
+			errs = append(errs, fmt.Sprintf("UNMANAGED_POLICY_%s must be ignore, report, or delete; got %q", strings.ToUpper(system), policy))
+		}
+	}
+
+	for _, u := range c.WebhookURLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			errs = append(errs, fmt.Sprintf("WEBHOOK_URLS entry %q must be an http(s) URL", u))
+		}
+	}
+
+	if c.ValidateURL != "" && !strings.HasPrefix(c.ValidateURL, "http://") && !strings.HasPrefix(c.ValidateURL, "https://") {
+		errs = append(errs, fmt.Sprintf("VALIDATION_WEBHOOK_URL must be an http(s) URL; got %q", c.ValidateURL))
+	}
+
+	if c.ACMECA != "" && !strings.HasPrefix(c.ACMECA, "https://") {
+		errs = append(errs, fmt.Sprintf("ACME_CA must be an https URL; got %q", c.ACMECA))
+	}
+
+	errs = append(errs, c.validateDNS()...)
+
+	if c.BackupS3Bucket != "" {
+		if c.BackupAccessKey == "" || c.BackupSecretKey == "" {
+			errs = append(errs, "BACKUP_S3_BUCKET requires BACKUP_S3_ACCESS_KEY_ID and BACKUP_S3_SECRET_ACCESS_KEY (or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+		}
+		if u, err := url.Parse(c.BackupS3Endpoint); c.BackupS3Endpoint != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			errs = append(errs, fmt.Sprintf("BACKUP_S3_ENDPOINT must be an http(s) URL; got %q", c.BackupS3Endpoint))
+		}
+	}
+
+	if c.ProbeInterval > 0 {
+		if c.ProbeMethod != "icmp" && c.ProbeMethod != "tcp" {
+			errs = append(errs, fmt.Sprintf("PROBE_METHOD must be icmp or tcp; got %q", c.ProbeMethod))
+		}
+		if c.ProbeTimeout >= c.ProbeInterval {
+			errs = append(errs, "PROBE_TIMEOUT must be shorter than PROBE_INTERVAL")
+		}
+	}
+
 	// TLS fields must be all set or all empty (mTLS is required in production)
 	tlsFields := []string{c.TLSCert, c.TLSKey, c.TLSClientCA}
 	tlsSet := 0
@@ -110,6 +830,9 @@ func (c *Config) Validate() error {
 	if tlsSet > 0 && tlsSet < len(tlsFields) {
 		errs = append(errs, "TLS_CERT, TLS_KEY, and TLS_CLIENT_CA must all be set together or all be empty")
 	}
+	if c.TLSClientCAKey != "" && c.TLSClientCA == "" {
+		errs = append(errs, "TLS_CLIENT_CA_KEY requires TLS_CLIENT_CA")
+	}
 
 	if len(errs) > 0 {
 		return fmt.Errorf("%s", strings.Join(errs, "; "))
@@ -118,9 +841,156 @@ func (c *Config) Validate() error {
 	return nil
 }
 
-func envOrDefault(key, defaultVal string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// AddressPools returns the prefixes VPN IPs are allocated from, in order:
+// WG_ADDRESS_POOLS, or the whole WG_SUBNET when that is not set.
+func (c *Config) AddressPools() []netip.Prefix {
+	if len(c.WGAddressPools) > 0 {
+		return c.WGAddressPools
+	}
+	if subnet, err := netip.ParsePrefix(c.WGSubnet); err == nil {
+		return []netip.Prefix{subnet.Masked()}
+	}
+	return nil
+}
+
+// WGPort returns the WireGuard port of SERVER_ENDPOINT, or 51820.
+func (c *Config) WGPort() int {
+	if _, port, err := net.SplitHostPort(c.ServerEndpoint); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			return p
+		}
+	}
+	return 51820
+}
+
+// validateFallback checks the WireGuard over TCP settings.
+func (c *Config) validateFallback() []string {
+	if c.WGFallbackTransport == "" {
+		return nil
+	}
+	if !wireguard.ValidTransport(c.WGFallbackTransport) {
+		return []string{fmt.Sprintf("WG_FALLBACK_TRANSPORT must be %s or %s; got %q",
+			wireguard.TransportWSTunnel, wireguard.TransportUDP2TCP, c.WGFallbackTransport)}
+	}
+	var errs []string
+	switch c.WGFallbackTransport {
+	case wireguard.TransportWSTunnel:
+		if c.WGFallbackHost == "" {
+			errs = append(errs, "WG_FALLBACK_TRANSPORT=wstunnel requires WG_FALLBACK_HOST, the name clients connect to")
+		} else if net.ParseIP(c.WGFallbackHost) != nil || strings.Contains(c.WGFallbackHost, "*") {
+			errs = append(errs, fmt.Sprintf("WG_FALLBACK_HOST must be a domain name for wstunnel, which is routed by SNI; got %q", c.WGFallbackHost))
+		}
+	case wireguard.TransportUDP2TCP:
+		if c.WGFallbackHost == "" {
+			errs = append(errs, "WG_FALLBACK_TRANSPORT=udp2tcp requires WG_FALLBACK_HOST (or SERVER_ENDPOINT)")
+		}
+		if c.WGFallbackPort == 0 {
+			errs = append(errs, "WG_FALLBACK_TRANSPORT=udp2tcp requires WG_FALLBACK_PORT, the TCP port Caddy listens on")
+		} else if c.WGFallbackPort == 443 {
+			errs = append(errs, "WG_FALLBACK_PORT cannot be 443 for udp2tcp, which is where Caddy routes SNI")
+		}
+	}
+	if host, port, err := net.SplitHostPort(c.WGFallbackUpstream); err != nil || host == "" || port == "" {
+		errs = append(errs, fmt.Sprintf("WG_FALLBACK_UPSTREAM must be the host:port of the server-side relay; got %q", c.WGFallbackUpstream))
+	}
+	return errs
+}
+
+// validateDNS checks the DNS provider settings.
+func (c *Config) validateDNS() []string {
+	var errs []string
+	required := map[string]map[string]string{
+		"cloudflare": {"CLOUDFLARE_API_TOKEN": c.CloudflareToken, "CLOUDFLARE_ZONE_ID": c.CloudflareZoneID},
+		"route53": {
+			"ROUTE53_HOSTED_ZONE_ID": c.Route53ZoneID,
+			"AWS_ACCESS_KEY_ID":      c.AWSAccessKeyID,
+			"AWS_SECRET_ACCESS_KEY":  c.AWSSecretKey,
+		},
+		"rfc2136": {"RFC2136_SERVER": c.RFC2136Server, "RFC2136_ZONE": c.RFC2136Zone},
+	}
+	if c.DNSProvider == "" {
+		return nil
+	}
+	fields, ok := required[c.DNSProvider]
+	if !ok {
+		return []string{fmt.Sprintf("DNS_PROVIDER must be one of cloudflare, route53, rfc2136; got %q", c.DNSProvider)}
+	}
+	for name, v := range fields {
+		if v == "" {
+			errs = append(errs, fmt.Sprintf("%s is required when DNS_PROVIDER=%s", name, c.DNSProvider))
+		}
+	}
+	if c.DNSProvider == "rfc2136" {
+		if _, _, err := net.SplitHostPort(c.RFC2136Server); c.RFC2136Server != "" && err != nil {
+			errs = append(errs, fmt.Sprintf("RFC2136_SERVER must be host:port; got %q", c.RFC2136Server))
+		}
+		if (c.RFC2136KeyName == "") != (c.RFC2136Secret == "") {
+			errs = append(errs, "RFC2136_TSIG_KEY and RFC2136_TSIG_SECRET must be set together")
+		}
+	}
+	if c.DNSTargetIPv4 == "" && c.DNSTargetIPv6 == "" {
+		errs = append(errs, "DNS_PROVIDER requires DNS_TARGET_IPV4 or DNS_TARGET_IPV6 (or an IP in SERVER_ENDPOINT)")
+	}
+	if ip := net.ParseIP(c.DNSTargetIPv4); c.DNSTargetIPv4 != "" && (ip == nil || ip.To4() == nil) {
+		errs = append(errs, fmt.Sprintf("DNS_TARGET_IPV4 is not a valid IPv4 address: %s", c.DNSTargetIPv4))
+	}
+	if ip := net.ParseIP(c.DNSTargetIPv6); c.DNSTargetIPv6 != "" && (ip == nil || ip.To4() != nil) {
+		errs = append(errs, fmt.Sprintf("DNS_TARGET_IPV6 is not a valid IPv6 address: %s", c.DNSTargetIPv6))
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// parseRoleMap parses "cn:ops=admin,ou:viewers=read-only" into a subject -> role map.
+func parseRoleMap(v string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, entry := range splitList(v) {
+		subject, role, ok := strings.Cut(entry, "=")
+		if !ok || (!strings.HasPrefix(subject, "cn:") && !strings.HasPrefix(subject, "ou:")) {
+			return nil, fmt.Errorf("entry %q must be cn:<name>=<role> or ou:<unit>=<role>", entry)
+		}
+		m[strings.TrimSpace(subject)] = strings.TrimSpace(role)
+	}
+	return m, nil
+}
+
+// parsePorts parses a comma-separated list of port numbers into a set.
+func parsePorts(v string) (map[int]bool, error) {
+	ports := map[int]bool{}
+	for _, p := range splitList(v) {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("%q is not a port between 1 and 65535", p)
+		}
+		ports[n] = true
+	}
+	return ports, nil
+}
+
+// splitList splits a comma-separated value into trimmed, non-empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if p := strings.TrimSpace(part); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ParseSyslogTarget splits an AUDIT_SYSLOG value into the network and
+// address log/syslog expects. "local" yields empty strings, which select
+// the local syslog daemon.
+func ParseSyslogTarget(target string) (network, addr string, err error) {
+	if target == "" || target == "local" {
+		return "", "", nil
+	}
+	network, addr, ok := strings.Cut(target, "://")
+	if !ok || (network != "udp" && network != "tcp") {
+		return "", "", fmt.Errorf("%q: expected local, udp://host:port, or tcp://host:port", target)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("%q: %w", target, err)
 	}
-	return defaultVal
+	return network, addr, nil
 }
@@ -2,15 +2,46 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func clearEnv() {
 	for _, key := range []string{
 		"LISTEN_ADDR", "CADDY_ADMIN_SOCKET", "SQLITE_PATH",
-		"RECONCILE_INTERVAL", "LOG_LEVEL", "WG_INTERFACE",
+		"RECONCILE_INTERVAL", "RECONCILE_INTERVAL_CADDY", "RECONCILE_INTERVAL_WG", "RECONCILE_INTERVAL_FW",
+		"RECONCILE_INTERVAL_STATS", "RECONCILE_MODE", "LOG_LEVEL", "WG_INTERFACE",
 		"WG_SUBNET", "WG_SERVER_IP", "TLS_CERT", "TLS_KEY",
-		"TLS_CLIENT_CA", "SERVER_ENDPOINT",
+		"TLS_CLIENT_CA", "TLS_CLIENT_CA_KEY", "SERVER_ENDPOINT", "ADMIN_CNS",
+		"ROLE_MAP", "DEFAULT_ROLE", "STATS_RETENTION_DAYS", "ROUTE_STATS_RETENTION_HOURS", "TUNNEL_RETENTION_DAYS",
+		"INACTIVITY_WARNING_DAYS", "KEY_ESCROW_MINUTES", "TUNNEL_APPROVAL", "IMPORT_ON_START", "UNMANAGED_POLICY",
+		"UNMANAGED_POLICY_CADDY", "UNMANAGED_POLICY_WIREGUARD", "UNMANAGED_POLICY_FIREWALL", "WEBHOOK_URLS", "WEBHOOK_SECRET",
+		"VALIDATION_WEBHOOK_URL", "VALIDATION_WEBHOOK_SECRET", "VALIDATION_WEBHOOK_TIMEOUT", "VALIDATION_WEBHOOK_FAIL_OPEN",
+		"CADDY_RETRIES", "CADDY_BREAKER_THRESHOLD", "CADDY_BREAKER_COOLDOWN", "CADDY_WATCH_INTERVAL",
+		"CADDY_ADMIN_URL", "CADDY_ADMIN_USER", "CADDY_ADMIN_PASSWORD",
+		"CADDY_ADMIN_CERT", "CADDY_ADMIN_KEY", "CADDY_ADMIN_CA",
+		"CONFIG_FILE", "TLS_RELOAD_INTERVAL",
+		"DNS_PROVIDER", "DNS_TARGET_IPV4", "DNS_TARGET_IPV6", "DNS_TTL",
+		"CLOUDFLARE_API_TOKEN", "CLOUDFLARE_ZONE_ID", "ROUTE53_HOSTED_ZONE_ID",
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+		"RFC2136_SERVER", "RFC2136_ZONE", "RFC2136_TSIG_KEY", "RFC2136_TSIG_SECRET",
+		"RFC2136_TSIG_ALGORITHM", "ACME_EMAIL", "ACME_CA",
+		"RESERVED_PORTS", "BAN_LOG_FILE", "BAN_THRESHOLD", "BAN_WINDOW",
+		"BAN_DURATION", "BAN_IGNORE_CIDRS", "FIREWALL_POLICY", "FIREWALL_FORWARD_POLICY",
+		"FIREWALL_PRIORITY", "FIREWALL_SSH_PORT", "AUDIT_BODY_LIMIT",
+		"AUDIT_FILE", "MAX_BODY_BYTES", "RATE_LIMIT_READ", "RATE_LIMIT_MUTATE", "TRUSTED_PROXIES", "AUDIT_FILE_MAX_MB", "AUDIT_FILE_KEEP", "AUDIT_SYSLOG",
+		"AUDIT_HTTP_URL", "AUDIT_HTTP_SECRET", "HA_LEASE_TTL", "HA_INSTANCE_ID",
+		"BACKUP_S3_BUCKET", "BACKUP_S3_ENDPOINT", "BACKUP_S3_REGION", "BACKUP_S3_PREFIX",
+		"BACKUP_S3_ACCESS_KEY_ID", "BACKUP_S3_SECRET_ACCESS_KEY", "BACKUP_S3_SESSION_TOKEN",
+		"BACKUP_INTERVAL", "BACKUP_RETAIN", "DB_CHECKPOINT_INTERVAL", "DB_INTEGRITY_INTERVAL", "DB_VACUUM_INTERVAL",
+		"AUDIT_RETENTION_DAYS", "AUDIT_ARCHIVE_DIR", "DB_QUERY_TIMEOUT",
+		"AGENT_CONTROL_PLANE_URL", "AGENT_TLS_CERT", "AGENT_TLS_KEY", "AGENT_TLS_CA",
+		"AGENT_ENDPOINT", "AGENT_SYNC_INTERVAL", "WG_PERSISTENT_KEEPALIVE", "CONNECTED_THRESHOLD",
+		"WG_ADDRESS_POOLS", "PROBE_INTERVAL", "PROBE_METHOD", "PROBE_TIMEOUT", "PROBE_WINDOW",
+		"WG_FALLBACK_TRANSPORT", "WG_FALLBACK_HOST", "WG_FALLBACK_PORT", "WG_FALLBACK_UPSTREAM", "WG_ALT_PORTS",
 	} {
 		os.Unsetenv(key)
 	}
@@ -47,6 +78,21 @@ func TestLoadDefaults(t *testing.T) {
 	if cfg.WGServerIP != "10.0.0.1" {
 		t.Errorf("expected WGServerIP 10.0.0.1, got %q", cfg.WGServerIP)
 	}
+	if cfg.TunnelRetention != 7*24*time.Hour {
+		t.Errorf("expected TunnelRetention 7 days, got %v", cfg.TunnelRetention)
+	}
+	if cfg.KeyEscrow != 15*time.Minute {
+		t.Errorf("expected KeyEscrow 15 minutes, got %v", cfg.KeyEscrow)
+	}
+	if cfg.MaxBodyBytes != 1048576 {
+		t.Errorf("expected MaxBodyBytes 1048576, got %d", cfg.MaxBodyBytes)
+	}
+	if cfg.ProbeInterval != 0 || cfg.ProbeMethod != "icmp" || cfg.ProbeTimeout != 2*time.Second || cfg.ProbeWindow != 20 {
+		t.Errorf("unexpected probe defaults: %v %q %v %d", cfg.ProbeInterval, cfg.ProbeMethod, cfg.ProbeTimeout, cfg.ProbeWindow)
+	}
+	if cfg.RateLimitRead != 300 || cfg.RateLimitMutate != 100 || len(cfg.TrustedProxies) != 0 {
+		t.Errorf("unexpected rate limit defaults: %d %d %v", cfg.RateLimitRead, cfg.RateLimitMutate, cfg.TrustedProxies)
+	}
 }
 
 func TestLoadFromEnv(t *testing.T) {
@@ -87,6 +133,154 @@ func TestInvalidReconcileInterval(t *testing.T) {
 	clearEnv()
 }
 
+func TestSubsystemReconcileIntervals(t *testing.T) {
+	clearEnv()
+	os.Setenv("RECONCILE_INTERVAL_WG", "10")
+	os.Setenv("RECONCILE_INTERVAL_FW", "300")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ReconcileIntervalWG != 10*time.Second || cfg.ReconcileIntervalFW != 300*time.Second {
+		t.Errorf("expected 10s and 300s, got %v and %v", cfg.ReconcileIntervalWG, cfg.ReconcileIntervalFW)
+	}
+	if cfg.ReconcileIntervalCaddy != 0 || cfg.ReconcileIntervalStats != 0 {
+		t.Errorf("expected unset intervals to be 0, got %v and %v", cfg.ReconcileIntervalCaddy, cfg.ReconcileIntervalStats)
+	}
+
+	os.Setenv("RECONCILE_INTERVAL_STATS", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for negative RECONCILE_INTERVAL_STATS")
+	}
+	clearEnv()
+}
+
+func TestReconcileMode(t *testing.T) {
+	clearEnv()
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ReconcileMode != "enforce" {
+		t.Errorf("expected enforce by default, got %q", cfg.ReconcileMode)
+	}
+
+	os.Setenv("RECONCILE_MODE", "observe")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ReconcileMode != "observe" {
+		t.Errorf("expected observe, got %q", cfg.ReconcileMode)
+	}
+	os.Setenv("RECONCILE_MODE", "dry-run")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for invalid RECONCILE_MODE")
+	}
+	clearEnv()
+}
+
+func TestFirewallPolicy(t *testing.T) {
+	clearEnv()
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.FirewallPolicy != "accept" || cfg.FirewallForwardPolicy != "accept" || cfg.FirewallPriority != 0 || cfg.FirewallSSHPort != 22 {
+		t.Errorf("unexpected firewall defaults: %q %q %d %d", cfg.FirewallPolicy, cfg.FirewallForwardPolicy, cfg.FirewallPriority, cfg.FirewallSSHPort)
+	}
+
+	os.Setenv("FIREWALL_POLICY", "drop")
+	os.Setenv("FIREWALL_PRIORITY", "-10")
+	os.Setenv("FIREWALL_SSH_PORT", "2222")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.FirewallPolicy != "drop" || cfg.FirewallPriority != -10 || cfg.FirewallSSHPort != 2222 {
+		t.Errorf("unexpected firewall settings: %q %d %d", cfg.FirewallPolicy, cfg.FirewallPriority, cfg.FirewallSSHPort)
+	}
+
+	for key, value := range map[string]string{
+		"FIREWALL_POLICY":         "reject",
+		"FIREWALL_FORWARD_POLICY": "deny",
+		"FIREWALL_PRIORITY":       "filter",
+		"FIREWALL_SSH_PORT":       "70000",
+	} {
+		clearEnv()
+		os.Setenv(key, value)
+		if _, err := Load(); err == nil {
+			t.Errorf("expected error for %s=%s", key, value)
+		}
+	}
+	clearEnv()
+}
+
+func TestLoadWGFallback(t *testing.T) {
+	clearEnv()
+	os.Setenv("WG_FALLBACK_TRANSPORT", "wstunnel")
+	os.Setenv("WG_FALLBACK_HOST", "wg.example.com")
+	os.Setenv("WG_FALLBACK_UPSTREAM", "127.0.0.1:8080")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WGFallbackPort != 443 {
+		t.Errorf("expected wstunnel on port 443, got %d", cfg.WGFallbackPort)
+	}
+
+	// udp2tcp listens on a port of its own, on the server's address
+	clearEnv()
+	os.Setenv("SERVER_ENDPOINT", "203.0.113.1:51820")
+	os.Setenv("WG_FALLBACK_TRANSPORT", "udp2tcp")
+	os.Setenv("WG_FALLBACK_PORT", "8443")
+	os.Setenv("WG_FALLBACK_UPSTREAM", "127.0.0.1:51821")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WGFallbackHost != "203.0.113.1" || !cfg.ReservedPorts[8443] {
+		t.Errorf("expected host 203.0.113.1 and port 8443 reserved, got %q %v", cfg.WGFallbackHost, cfg.ReservedPorts)
+	}
+
+	for _, env := range []map[string]string{
+		{"WG_FALLBACK_TRANSPORT": "udp2raw", "WG_FALLBACK_UPSTREAM": "127.0.0.1:8080"},
+		{"WG_FALLBACK_TRANSPORT": "wstunnel", "WG_FALLBACK_HOST": "203.0.113.1", "WG_FALLBACK_UPSTREAM": "127.0.0.1:8080"},
+		{"WG_FALLBACK_TRANSPORT": "wstunnel", "WG_FALLBACK_HOST": "wg.example.com"},
+		{"WG_FALLBACK_TRANSPORT": "udp2tcp", "WG_FALLBACK_HOST": "203.0.113.1", "WG_FALLBACK_UPSTREAM": "127.0.0.1:51821"},
+		{"WG_FALLBACK_TRANSPORT": "udp2tcp", "WG_FALLBACK_HOST": "203.0.113.1", "WG_FALLBACK_PORT": "443", "WG_FALLBACK_UPSTREAM": "127.0.0.1:51821"},
+	} {
+		clearEnv()
+		for key, value := range env {
+			os.Setenv(key, value)
+		}
+		if _, err := Load(); err == nil {
+			t.Errorf("expected error for %v", env)
+		}
+	}
+	clearEnv()
+}
+
+func TestLoadWGAltPorts(t *testing.T) {
+	clearEnv()
+	os.Setenv("WG_ALT_PORTS", "4500, 443")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(cfg.WGAltPorts, []int{443, 4500}) {
+		t.Errorf("expected [443 4500], got %v", cfg.WGAltPorts)
+	}
+
+	for _, value := range []string{"quic", "70000", "51820"} {
+		os.Setenv("WG_ALT_PORTS", value)
+		if _, err := Load(); err == nil {
+			t.Errorf("expected error for WG_ALT_PORTS=%s", value)
+		}
+	}
+	clearEnv()
+}
+
 func TestInvalidLogLevel(t *testing.T) {
 	clearEnv()
 	os.Setenv("LOG_LEVEL", "trace")
@@ -117,6 +311,33 @@ func TestInvalidWGServerIP(t *testing.T) {
 	clearEnv()
 }
 
+func TestWGAddressPools(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("WG_SUBNET", "10.0.0.0/16")
+	os.Setenv("WG_ADDRESS_POOLS", "10.0.1.0/24, 10.0.2.0/24")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pools := cfg.AddressPools(); len(pools) != 2 || pools[1].String() != "10.0.2.0/24" {
+		t.Errorf("expected both pools in order, got %v", pools)
+	}
+
+	for _, pools := range []string{"10.1.0.0/24", "10.0.1.0/24,10.0.1.128/25", "not-a-cidr"} {
+		os.Setenv("WG_ADDRESS_POOLS", pools)
+		if _, err := Load(); err == nil {
+			t.Errorf("expected error for WG_ADDRESS_POOLS %q", pools)
+		}
+	}
+
+	os.Unsetenv("WG_ADDRESS_POOLS")
+	os.Setenv("WG_SERVER_IP", "10.1.0.1")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a WG_SERVER_IP outside WG_SUBNET")
+	}
+}
+
 func TestPartialTLSConfigFails(t *testing.T) {
 	clearEnv()
 	os.Setenv("TLS_CERT", "/path/to/cert.pem")
@@ -143,6 +364,26 @@ func TestAllTLSFieldsSetSucceeds(t *testing.T) {
 	clearEnv()
 }
 
+func TestTLSClientCAKeyRequiresCA(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("TLS_CLIENT_CA_KEY", "/path/to/ca.key")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for TLS_CLIENT_CA_KEY without TLS_CLIENT_CA")
+	}
+
+	os.Setenv("TLS_CERT", "/path/to/cert.pem")
+	os.Setenv("TLS_KEY", "/path/to/key.pem")
+	os.Setenv("TLS_CLIENT_CA", "/path/to/ca.pem")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.TLSClientCAKey != "/path/to/ca.key" {
+		t.Errorf("expected TLSClientCAKey /path/to/ca.key, got %q", cfg.TLSClientCAKey)
+	}
+}
+
 func TestValidateEmptyListenAddr(t *testing.T) {
 	cfg := &Config{
 		ListenAddr:       "",
@@ -159,3 +400,624 @@ func TestValidateEmptyListenAddr(t *testing.T) {
 		t.Fatal("expected validation error for empty ListenAddr")
 	}
 }
+
+func TestLoadAdminCNs(t *testing.T) {
+	clearEnv()
+	os.Setenv("ADMIN_CNS", "ops-admin, dashboard ,")
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.AdminCNs) != 2 || cfg.AdminCNs[0] != "ops-admin" || cfg.AdminCNs[1] != "dashboard" {
+		t.Errorf("expected [ops-admin dashboard], got %v", cfg.AdminCNs)
+	}
+}
+
+func TestLoadRoleMap(t *testing.T) {
+	clearEnv()
+	os.Setenv("ROLE_MAP", "cn:ops=admin, ou:viewers=read-only")
+	os.Setenv("DEFAULT_ROLE", "read-only")
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RoleMap["cn:ops"] != "admin" || cfg.RoleMap["ou:viewers"] != "read-only" {
+		t.Errorf("unexpected role map: %v", cfg.RoleMap)
+	}
+	if cfg.DefaultRole != "read-only" {
+		t.Errorf("expected DefaultRole read-only, got %q", cfg.DefaultRole)
+	}
+}
+
+func TestLoadRoleMapInvalid(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	os.Setenv("ROLE_MAP", "ops=admin")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for entry without cn:/ou: prefix")
+	}
+
+	os.Setenv("ROLE_MAP", "cn:ops=superuser")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for unknown role")
+	}
+}
+
+func TestLoadStatsRetention(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StatsRetention != 30*24*time.Hour {
+		t.Errorf("expected default retention of 30 days, got %v", cfg.StatsRetention)
+	}
+
+	os.Setenv("STATS_RETENTION_DAYS", "0")
+	if cfg, err = Load(); err != nil || cfg.StatsRetention != 0 {
+		t.Errorf("expected retention 0, got %v (err %v)", cfg.StatsRetention, err)
+	}
+
+	os.Setenv("STATS_RETENTION_DAYS", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for negative STATS_RETENTION_DAYS")
+	}
+	os.Unsetenv("STATS_RETENTION_DAYS")
+
+	if cfg, err = Load(); err != nil || cfg.RouteStatsHistory != 24*time.Hour {
+		t.Errorf("expected default route stats retention of 24 hours, got %v (err %v)", cfg.RouteStatsHistory, err)
+	}
+	os.Setenv("ROUTE_STATS_RETENTION_HOURS", "0")
+	if cfg, err = Load(); err != nil || cfg.RouteStatsHistory != 0 {
+		t.Errorf("expected route stats retention 0, got %v (err %v)", cfg.RouteStatsHistory, err)
+	}
+}
+
+func TestLoadReservedPorts(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, port := range []int{22, 2019, 7443, 51820} {
+		if !cfg.ReservedPorts[port] {
+			t.Errorf("expected port %d reserved by default", port)
+		}
+	}
+
+	os.Setenv("RESERVED_PORTS", "2222, 2020,7443")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.ReservedPorts) != 3 || !cfg.ReservedPorts[2222] || cfg.ReservedPorts[22] {
+		t.Errorf("unexpected reserved ports %v", cfg.ReservedPorts)
+	}
+
+	os.Setenv("RESERVED_PORTS", "22,ssh")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for non-numeric RESERVED_PORTS entry")
+	}
+}
+
+func TestLoadWebhooks(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	os.Setenv("WEBHOOK_URLS", "https://hooks.example.com/a, http://10.0.0.5/b")
+	os.Setenv("INACTIVITY_WARNING_DAYS", "3")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.WebhookURLs) != 2 || cfg.WebhookURLs[1] != "http://10.0.0.5/b" {
+		t.Errorf("unexpected webhook URLs: %v", cfg.WebhookURLs)
+	}
+	if cfg.InactivityWarning != 3*24*time.Hour {
+		t.Errorf("expected 3 day warning, got %v", cfg.InactivityWarning)
+	}
+
+	os.Setenv("TUNNEL_APPROVAL", "yes")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for invalid TUNNEL_APPROVAL")
+	}
+	os.Setenv("TUNNEL_APPROVAL", "true")
+	if cfg, err := Load(); err != nil || !cfg.TunnelApproval {
+		t.Errorf("expected tunnel approval to be on, got %v", err)
+	}
+	os.Setenv("IMPORT_ON_START", "true")
+	if cfg, err := Load(); err != nil || !cfg.ImportOnStart {
+		t.Errorf("expected import on start to be on, got %v", err)
+	}
+
+	if cfg, err := Load(); err != nil || cfg.UnmanagedPolicy["wireguard"] != "report" || cfg.UnmanagedPolicy["caddy"] != "report" {
+		t.Errorf("expected unmanaged peers to be reported by default, got %v, %v", cfg.UnmanagedPolicy, err)
+	}
+	os.Setenv("UNMANAGED_POLICY", "ignore")
+	os.Setenv("UNMANAGED_POLICY_FIREWALL", "delete")
+	if cfg, err := Load(); err != nil || cfg.UnmanagedPolicy["caddy"] != "ignore" || cfg.UnmanagedPolicy["wireguard"] != "ignore" || cfg.UnmanagedPolicy["firewall"] != "delete" {
+		t.Errorf("expected the subsystem policy to override the global one, got %v, %v", cfg.UnmanagedPolicy, err)
+	}
+	os.Setenv("UNMANAGED_POLICY_CADDY", "keep")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "UNMANAGED_POLICY_CADDY") {
+		t.Errorf("expected an error naming UNMANAGED_POLICY_CADDY, got %v", err)
+	}
+	os.Unsetenv("UNMANAGED_POLICY_CADDY")
+	os.Setenv("UNMANAGED_POLICY", "keep")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "invalid UNMANAGED_POLICY:") {
+		t.Errorf("expected an error naming UNMANAGED_POLICY, got %v", err)
+	}
+	os.Unsetenv("UNMANAGED_POLICY")
+
+	os.Setenv("WEBHOOK_URLS", "ftp://example.com")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for non-http webhook URL")
+	}
+}
+
+func TestLoadPeerDefaults(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WGKeepalive != 25*time.Second || cfg.ConnectedWindow != 5*time.Minute {
+		t.Errorf("unexpected peer defaults: %v %v", cfg.WGKeepalive, cfg.ConnectedWindow)
+	}
+
+	os.Setenv("WG_PERSISTENT_KEEPALIVE", "0")
+	os.Setenv("CONNECTED_THRESHOLD", "600")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WGKeepalive != 0 || cfg.ConnectedWindow != 10*time.Minute {
+		t.Errorf("unexpected peer settings: %v %v", cfg.WGKeepalive, cfg.ConnectedWindow)
+	}
+
+	os.Setenv("WG_PERSISTENT_KEEPALIVE", "70000")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for keepalive above 65535")
+	}
+}
+
+func TestLoadAutomaticBans(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.BanLogFile != "" || cfg.BanThreshold != 20 || cfg.BanWindow != time.Minute || cfg.BanDuration != time.Hour {
+		t.Errorf("unexpected ban defaults: %q %d %v %v", cfg.BanLogFile, cfg.BanThreshold, cfg.BanWindow, cfg.BanDuration)
+	}
+	if len(cfg.BanIgnore) != 2 {
+		t.Errorf("expected loopback ignored by default, got %v", cfg.BanIgnore)
+	}
+
+	os.Setenv("BAN_LOG_FILE", "/var/log/caddy/access.log")
+	os.Setenv("BAN_THRESHOLD", "5")
+	os.Setenv("BAN_IGNORE_CIDRS", "192.0.2.10/24")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.BanThreshold != 5 || len(cfg.BanIgnore) != 1 || cfg.BanIgnore[0].String() != "192.0.2.0/24" {
+		t.Errorf("unexpected ban settings: %d %v", cfg.BanThreshold, cfg.BanIgnore)
+	}
+
+	os.Setenv("BAN_IGNORE_CIDRS", "192.0.2.10")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for BAN_IGNORE_CIDRS entry without prefix length")
+	}
+	os.Setenv("BAN_IGNORE_CIDRS", "")
+	os.Setenv("BAN_DURATION", "0")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for zero BAN_DURATION")
+	}
+}
+
+func TestLoadAuditSinks(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.AuditFile != "" || cfg.AuditFileMaxBytes != 100<<20 || cfg.AuditFileKeep != 5 || cfg.AuditSyslog != "" {
+		t.Errorf("unexpected audit defaults: %+v", cfg)
+	}
+
+	os.Setenv("AUDIT_SYSLOG", "udp://siem.example.com:514")
+	if _, err := Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, v := range []string{"siem.example.com:514", "tls://siem.example.com:6514", "tcp://siem.example.com"} {
+		os.Setenv("AUDIT_SYSLOG", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("expected error for AUDIT_SYSLOG %q", v)
+		}
+	}
+}
+
+func TestLoadLeaderElection(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.HALeaseTTL != 0 || cfg.HAInstanceID != "" {
+		t.Errorf("expected leader election off by default, got %v %q", cfg.HALeaseTTL, cfg.HAInstanceID)
+	}
+
+	os.Setenv("HA_LEASE_TTL", "15")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if host, _ := os.Hostname(); cfg.HALeaseTTL != 15*time.Second || cfg.HAInstanceID != host {
+		t.Errorf("expected 15s lease for %q, got %v %q", host, cfg.HALeaseTTL, cfg.HAInstanceID)
+	}
+
+	os.Setenv("HA_LEASE_TTL", "1")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a lease too short to renew")
+	}
+}
+
+func TestLoadBackup(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	os.Setenv("BACKUP_S3_BUCKET", "backups")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a bucket without credentials")
+	}
+
+	// AWS credentials are shared with Route 53 unless overridden
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.BackupAccessKey != "AKID" || cfg.BackupS3Region != "us-east-1" || cfg.BackupInterval != time.Minute {
+		t.Errorf("unexpected backup defaults: %+v", cfg)
+	}
+
+	os.Setenv("BACKUP_S3_ACCESS_KEY_ID", "backup-key")
+	os.Setenv("BACKUP_S3_SECRET_ACCESS_KEY", "backup-secret")
+	os.Setenv("BACKUP_S3_ENDPOINT", "https://minio.example.com/")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.BackupAccessKey != "backup-key" || cfg.BackupS3Endpoint != "https://minio.example.com" {
+		t.Errorf("expected backup-specific settings, got %q %q", cfg.BackupAccessKey, cfg.BackupS3Endpoint)
+	}
+
+	os.Setenv("BACKUP_S3_ENDPOINT", "minio:9000")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for an endpoint without scheme")
+	}
+}
+
+func TestLoadDatabaseHousekeeping(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.DBCheckpointInterval != 5*time.Minute || cfg.DBIntegrityInterval != 24*time.Hour || cfg.DBVacuumInterval != 24*time.Hour {
+		t.Errorf("unexpected housekeeping defaults: %v %v %v", cfg.DBCheckpointInterval, cfg.DBIntegrityInterval, cfg.DBVacuumInterval)
+	}
+
+	os.Setenv("DB_VACUUM_INTERVAL", "0")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.DBVacuumInterval != 0 {
+		t.Errorf("expected vacuum disabled, got %v", cfg.DBVacuumInterval)
+	}
+
+	os.Setenv("DB_INTEGRITY_INTERVAL", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a negative interval")
+	}
+	os.Unsetenv("DB_INTEGRITY_INTERVAL")
+
+	if cfg.DBQueryTimeout != 10*time.Second {
+		t.Errorf("expected a 10s query timeout by default, got %v", cfg.DBQueryTimeout)
+	}
+	os.Setenv("DB_QUERY_TIMEOUT", "30")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a query timeout outliving the API's write timeout")
+	}
+}
+
+func TestLoadAuditRetention(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	os.Setenv("AUDIT_ARCHIVE_DIR", "/var/lib/controlplane/audit")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for an archive without retention")
+	}
+
+	os.Setenv("AUDIT_RETENTION_DAYS", "90")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.AuditRetention != 90*24*time.Hour || cfg.AuditArchiveDir != "/var/lib/controlplane/audit" {
+		t.Errorf("unexpected audit retention: %v %q", cfg.AuditRetention, cfg.AuditArchiveDir)
+	}
+}
+
+func TestLoadAgent(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	if _, err := LoadAgent(); err == nil {
+		t.Error("expected error without a control plane URL and certificate")
+	}
+
+	os.Setenv("AGENT_CONTROL_PLANE_URL", "https://cp.example.com:7443/")
+	os.Setenv("AGENT_TLS_CERT", "/etc/agent/agent.crt")
+	os.Setenv("AGENT_TLS_KEY", "/etc/agent/agent.key")
+	os.Setenv("AGENT_TLS_CA", "/etc/agent/ca.crt")
+	cfg, err := LoadAgent()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ControlPlaneURL != "https://cp.example.com:7443" || cfg.SyncInterval != 30*time.Second || cfg.WGInterface != "wg0" {
+		t.Errorf("unexpected agent defaults: %+v", cfg)
+	}
+
+	os.Setenv("AGENT_CONTROL_PLANE_URL", "http://cp.example.com:7443")
+	if _, err := LoadAgent(); err == nil {
+		t.Error("expected error for a plaintext control plane URL")
+	}
+}
+
+func TestLoadCaddyRetryPolicy(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.CaddyRetries != 3 || cfg.BreakerThreshold != 5 || cfg.BreakerCooldown != 30*time.Second || cfg.CaddyWatch != 5*time.Second {
+		t.Errorf("unexpected defaults: retries=%d threshold=%d cooldown=%v watch=%v", cfg.CaddyRetries, cfg.BreakerThreshold, cfg.BreakerCooldown, cfg.CaddyWatch)
+	}
+
+	os.Setenv("CADDY_RETRIES", "0")
+	os.Setenv("CADDY_BREAKER_COOLDOWN", "5")
+	os.Setenv("CADDY_WATCH_INTERVAL", "0")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.CaddyRetries != 0 || cfg.BreakerCooldown != 5*time.Second || cfg.CaddyWatch != 0 {
+		t.Errorf("expected retries=0 cooldown=5s watch=0, got %d %v %v", cfg.CaddyRetries, cfg.BreakerCooldown, cfg.CaddyWatch)
+	}
+
+	os.Setenv("CADDY_BREAKER_THRESHOLD", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for negative CADDY_BREAKER_THRESHOLD")
+	}
+}
+
+func TestLoadValidationWebhook(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ValidateURL != "" || cfg.ValidateTimeout != 5*time.Second || cfg.ValidateFailOpen {
+		t.Errorf("unexpected defaults: url=%q timeout=%v fail_open=%v", cfg.ValidateURL, cfg.ValidateTimeout, cfg.ValidateFailOpen)
+	}
+
+	os.Setenv("VALIDATION_WEBHOOK_URL", "https://policy.internal/validate")
+	os.Setenv("VALIDATION_WEBHOOK_TIMEOUT", "2")
+	os.Setenv("VALIDATION_WEBHOOK_FAIL_OPEN", "true")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ValidateURL != "https://policy.internal/validate" || cfg.ValidateTimeout != 2*time.Second || !cfg.ValidateFailOpen {
+		t.Errorf("unexpected config: url=%q timeout=%v fail_open=%v", cfg.ValidateURL, cfg.ValidateTimeout, cfg.ValidateFailOpen)
+	}
+
+	os.Setenv("VALIDATION_WEBHOOK_URL", "policy.internal")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for VALIDATION_WEBHOOK_URL without a scheme")
+	}
+	os.Setenv("VALIDATION_WEBHOOK_URL", "")
+	os.Setenv("VALIDATION_WEBHOOK_TIMEOUT", "0")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for zero VALIDATION_WEBHOOK_TIMEOUT")
+	}
+}
+
+func TestLoadCaddyAdminURL(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	os.Setenv("CADDY_ADMIN_URL", "https://caddy.internal:2019/")
+	os.Setenv("CADDY_ADMIN_CERT", "/etc/controlplane/caddy-client.crt")
+	os.Setenv("CADDY_ADMIN_KEY", "/etc/controlplane/caddy-client.key")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.CaddyAdminURL != "https://caddy.internal:2019" {
+		t.Errorf("expected trailing slash trimmed, got %q", cfg.CaddyAdminURL)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"bad scheme", map[string]string{"CADDY_ADMIN_URL": "tcp://caddy:2019"}},
+		{"user without password", map[string]string{"CADDY_ADMIN_URL": "http://caddy:2019", "CADDY_ADMIN_USER": "admin"}},
+		{"cert without key", map[string]string{"CADDY_ADMIN_URL": "https://caddy:2019", "CADDY_ADMIN_CERT": "/c.crt"}},
+		{"mTLS over http", map[string]string{"CADDY_ADMIN_URL": "http://caddy:2019", "CADDY_ADMIN_CERT": "/c.crt", "CADDY_ADMIN_KEY": "/c.key"}},
+		{"auth without URL", map[string]string{"CADDY_ADMIN_USER": "admin", "CADDY_ADMIN_PASSWORD": "x"}},
+	}
+	for _, tt := range tests {
+		clearEnv()
+		for k, v := range tt.env {
+			os.Setenv(k, v)
+		}
+		if _, err := Load(); err == nil {
+			t.Errorf("%s: expected validation error", tt.name)
+		}
+	}
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadYAMLFile(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("CONFIG_FILE", writeConfigFile(t, "config.yaml", `
+listen_addr: ":9443"
+reconcile_interval: 60
+admin_cns: [ops, sre]
+role_map:
+  cn:ops: admin
+  ou:viewers: read-only
+log_level: warn
+`))
+	os.Setenv("LOG_LEVEL", "debug")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ListenAddr != ":9443" {
+		t.Errorf("expected ListenAddr from file, got %q", cfg.ListenAddr)
+	}
+	if cfg.ReconcileInterval != 60*time.Second {
+		t.Errorf("expected 60s interval, got %v", cfg.ReconcileInterval)
+	}
+	if len(cfg.AdminCNs) != 2 || cfg.AdminCNs[1] != "sre" {
+		t.Errorf("expected admin CNs [ops sre], got %v", cfg.AdminCNs)
+	}
+	if cfg.RoleMap["cn:ops"] != "admin" || cfg.RoleMap["ou:viewers"] != "read-only" {
+		t.Errorf("unexpected role map: %v", cfg.RoleMap)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("expected env to override file log level, got %q", cfg.LogLevel)
+	}
+}
+
+func TestLoadTOMLFile(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+	os.Setenv("CONFIG_FILE", writeConfigFile(t, "config.toml", `
+wg_subnet = "10.8.0.0/24"
+wg_server_ip = "10.8.0.1"
+webhook_urls = ["https://hooks.example.com/a"]
+`))
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WGSubnet != "10.8.0.0/24" || cfg.WGServerIP != "10.8.0.1" {
+		t.Errorf("unexpected WG settings: %s %s", cfg.WGSubnet, cfg.WGServerIP)
+	}
+	if len(cfg.WebhookURLs) != 1 {
+		t.Errorf("expected 1 webhook URL, got %v", cfg.WebhookURLs)
+	}
+}
+
+func TestLoadFileValidation(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	os.Setenv("CONFIG_FILE", writeConfigFile(t, "config.yaml", "wg_subnet: not-a-cidr\n"))
+	if _, err := Load(); err == nil {
+		t.Error("expected invalid file value to fail validation")
+	}
+
+	os.Setenv("CONFIG_FILE", writeConfigFile(t, "config.yaml", "listen_adr: \":9443\"\n"))
+	if _, err := Load(); err == nil {
+		t.Error("expected unknown key to be rejected")
+	}
+
+	os.Setenv("CONFIG_FILE", writeConfigFile(t, "config.json", "{}"))
+	if _, err := Load(); err == nil {
+		t.Error("expected unsupported extension to be rejected")
+	}
+
+	os.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := Load(); err == nil {
+		t.Error("expected missing file to fail")
+	}
+}
+
+func TestLoadDNSProvider(t *testing.T) {
+	clearEnv()
+	defer clearEnv()
+
+	os.Setenv("DNS_PROVIDER", "cloudflare")
+	os.Setenv("SERVER_ENDPOINT", "203.0.113.10:51820")
+	if _, err := Load(); err == nil {
+		t.Error("expected missing Cloudflare credentials to fail")
+	}
+
+	os.Setenv("CLOUDFLARE_API_TOKEN", "tok")
+	os.Setenv("CLOUDFLARE_ZONE_ID", "zone1")
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.DNSTargetIPv4 != "203.0.113.10" || cfg.DNSTTL != 300 {
+		t.Errorf("expected target from SERVER_ENDPOINT and default TTL, got %q %d", cfg.DNSTargetIPv4, cfg.DNSTTL)
+	}
+
+	os.Setenv("DNS_TARGET_IPV6", "203.0.113.10")
+	if _, err := Load(); err == nil {
+		t.Error("expected IPv4 address in DNS_TARGET_IPV6 to fail")
+	}
+	os.Unsetenv("DNS_TARGET_IPV6")
+
+	os.Setenv("DNS_PROVIDER", "rfc2136")
+	os.Setenv("RFC2136_SERVER", "ns1.example.com:53")
+	os.Setenv("RFC2136_ZONE", "example.com")
+	os.Setenv("RFC2136_TSIG_KEY", "update-key")
+	if _, err := Load(); err == nil {
+		t.Error("expected TSIG key without secret to fail")
+	}
+
+	os.Setenv("DNS_PROVIDER", "godaddy")
+	if _, err := Load(); err == nil {
+		t.Error("expected unknown provider to fail")
+	}
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// source resolves configuration keys. Environment variables win over values
+// from the optional config file, which win over defaults.
+type source struct {
+	file map[string]string // KEY -> value, keyed like the environment variables
+	used map[string]bool
+}
+
+// newSource reads the file named by CONFIG_FILE, if any.
+func newSource() (*source, error) {
+	s := &source{file: map[string]string{}, used: map[string]bool{}}
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return s, nil
+	}
+	values, err := readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE %s: %w", path, err)
+	}
+	s.file = values
+	return s, nil
+}
+
+// get returns the value for key, or "" if it is set nowhere.
+func (s *source) get(key string) string {
+	s.used[key] = true
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return s.file[key]
+}
+
+// getOr returns the value for key, or defaultVal if it is set nowhere.
+func (s *source) getOr(key, defaultVal string) string {
+	if v := s.get(key); v != "" {
+		return v
+	}
+	return defaultVal
+}
+
+// unknownKeys returns file keys that Load never asked for, which are most
+// likely typos.
+func (s *source) unknownKeys() []string {
+	var out []string
+	for k := range s.file {
+		if !s.used[k] {
+			out = append(out, strings.ToLower(k))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// readFile parses a YAML or TOML config file, chosen by extension, into
+// environment-style keys: "listen_addr" becomes LISTEN_ADDR. Lists are
+// joined with commas and maps become "key=value" pairs, matching the
+// formats the environment variables take.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported extension %q (use .yaml, .yml, or .toml)", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	out := make(map[string]string, len(raw))
+	for k, v := range raw {
+		s, err := flatten(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		out[strings.ToUpper(strings.ReplaceAll(k, "-", "_"))] = s
+	}
+	return out, nil
+}
+
+// flatten renders a parsed value in its environment variable form.
+func flatten(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := flatten(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(v))
+		for _, k := range keys {
+			s, err := flatten(v[k])
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, k+"="+s)
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
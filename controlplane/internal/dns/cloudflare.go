@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// cloudflareAPI is the Cloudflare v4 API base URL.
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareOwner is the comment of the records the control plane creates.
+// Records without it were created by someone else and are never changed.
+const cloudflareOwner = "managed by proxy-manager"
+
+// Cloudflare manages records through the Cloudflare API with a scoped API
+// token (Zone.DNS:Edit on the zone).
+type Cloudflare struct {
+	token      string
+	zoneID     string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewCloudflare creates a provider for the zone with the given ID.
+func NewCloudflare(token, zoneID string) *Cloudflare {
+	return &Cloudflare{
+		token:      token,
+		zoneID:     zoneID,
+		baseURL:    cloudflareAPI,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// SetRecords implements Provider. Records with other values are removed and
+// missing ones created; matching records are left untouched. A name that
+// has records the control plane did not create is left alone, with
+// ErrForeignRecords, rather than overwritten or joined.
+func (c *Cloudflare) SetRecords(ctx context.Context, name, rtype string, values []string, ttl int) error {
+	existing, err := c.list(ctx, name, rtype)
+	if err != nil {
+		return err
+	}
+	for _, rec := range existing {
+		if rec.Comment != cloudflareOwner {
+			return fmt.Errorf("%s %s: %w", rtype, name, ErrForeignRecords)
+		}
+	}
+	want := map[string]bool{}
+	for _, v := range values {
+		want[v] = true
+	}
+	for _, rec := range existing {
+		if want[rec.Content] && rec.TTL == ttl {
+			delete(want, rec.Content)
+			continue
+		}
+		if err := c.do(ctx, "DELETE", "/zones/"+c.zoneID+"/dns_records/"+rec.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	for _, v := range values {
+		if !want[v] {
+			continue
+		}
+		rec := cloudflareRecord{Type: rtype, Name: name, Content: v, TTL: ttl, Comment: cloudflareOwner}
+		if err := c.do(ctx, "POST", "/zones/"+c.zoneID+"/dns_records", rec, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRecords implements Provider. Only the records the control plane
+// created are removed.
+func (c *Cloudflare) DeleteRecords(ctx context.Context, name, rtype string) error {
+	existing, err := c.list(ctx, name, rtype)
+	if err != nil {
+		return err
+	}
+	for _, rec := range existing {
+		if rec.Comment != cloudflareOwner {
+			continue
+		}
+		if err := c.do(ctx, "DELETE", "/zones/"+c.zoneID+"/dns_records/"+rec.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cloudflare) list(ctx context.Context, name, rtype string) ([]cloudflareRecord, error) {
+	q := url.Values{"name": {name}, "type": {rtype}, "per_page": {"100"}}
+	var records []cloudflareRecord
+	err := c.do(ctx, "GET", "/zones/"+c.zoneID+"/dns_records?"+q.Encode(), nil, &records)
+	return records, err
+}
+
+// do sends a request and decodes the result field of Cloudflare's response
+// envelope into out, if non-nil.
+func (c *Cloudflare) do(ctx context.Context, method, path string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloudflare %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare %s: status %d: %w", method, resp.StatusCode, err)
+	}
+	if !envelope.Success || resp.StatusCode >= 400 {
+		msg := http.StatusText(resp.StatusCode)
+		if len(envelope.Errors) > 0 {
+			msg = fmt.Sprintf("%d %s", envelope.Errors[0].Code, envelope.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare %s: %s", method, msg)
+	}
+	if out != nil {
+		if err := json.Unmarshal(envelope.Result, out); err != nil {
+			return fmt.Errorf("decode response: %w", err)
+		}
+	}
+	return nil
+}
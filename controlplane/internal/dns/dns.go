@@ -0,0 +1,85 @@
+// Package dns publishes A/AAAA records for route domains through a pluggable
+// DNS provider, so a domain routed through the VPS resolves to it without
+// manual DNS changes.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ErrForeignRecords is returned by SetRecords for a name that already has
+// records the control plane did not create, on providers that can tell.
+var ErrForeignRecords = errors.New("records not created by proxy-manager exist")
+
+// Provider manages record sets in one DNS zone.
+type Provider interface {
+	// SetRecords replaces the name's record set of type rtype ("A" or
+	// "AAAA") with values, creating it if needed.
+	SetRecords(ctx context.Context, name, rtype string, values []string, ttl int) error
+	// DeleteRecords removes the name's record set of type rtype. Deleting a
+	// record set that does not exist is not an error.
+	DeleteRecords(ctx context.Context, name, rtype string) error
+}
+
+// Updater points route domains at the VPS's public addresses.
+type Updater struct {
+	provider Provider
+	ipv4     netip.Addr
+	ipv6     netip.Addr
+	ttl      int
+}
+
+// NewUpdater creates an Updater that publishes A records for ipv4 and AAAA
+// records for ipv6. Either address may be the zero Addr to skip that type.
+func NewUpdater(p Provider, ipv4, ipv6 netip.Addr, ttl int) *Updater {
+	return &Updater{provider: p, ipv4: ipv4, ipv6: ipv6, ttl: ttl}
+}
+
+// Publish creates or updates the records for every domain. It attempts all
+// domains and returns the combined error of those that failed.
+func (u *Updater) Publish(ctx context.Context, domains []string) error {
+	var errs []error
+	for _, d := range domains {
+		for rtype, addr := range u.targets() {
+			if err := u.provider.SetRecords(ctx, normalize(d), rtype, []string{addr.String()}, u.ttl); err != nil {
+				errs = append(errs, fmt.Errorf("set %s %s: %w", rtype, d, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Unpublish removes the records for every domain. It attempts all domains
+// and returns the combined error of those that failed.
+func (u *Updater) Unpublish(ctx context.Context, domains []string) error {
+	var errs []error
+	for _, d := range domains {
+		for rtype := range u.targets() {
+			if err := u.provider.DeleteRecords(ctx, normalize(d), rtype); err != nil {
+				errs = append(errs, fmt.Errorf("delete %s %s: %w", rtype, d, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (u *Updater) targets() map[string]netip.Addr {
+	t := map[string]netip.Addr{}
+	if u.ipv4.IsValid() {
+		t["A"] = u.ipv4
+	}
+	if u.ipv6.IsValid() {
+		t["AAAA"] = u.ipv6
+	}
+	return t
+}
+
+// normalize lower-cases a domain and strips any trailing dot; providers add
+// their own.
+func normalize(d string) string {
+	return strings.TrimSuffix(strings.ToLower(d), ".")
+}
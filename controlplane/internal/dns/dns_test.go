@@ -0,0 +1,233 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type fakeProvider struct {
+	set     []string
+	deleted []string
+	err     error
+}
+
+func (f *fakeProvider) SetRecords(_ context.Context, name, rtype string, values []string, ttl int) error {
+	f.set = append(f.set, rtype+" "+name+" "+strings.Join(values, ","))
+	return f.err
+}
+
+func (f *fakeProvider) DeleteRecords(_ context.Context, name, rtype string) error {
+	f.deleted = append(f.deleted, rtype+" "+name)
+	return f.err
+}
+
+func TestUpdaterPublishesConfiguredFamilies(t *testing.T) {
+	p := &fakeProvider{}
+	u := NewUpdater(p, netip.MustParseAddr("203.0.113.10"), netip.Addr{}, 300)
+
+	if err := u.Publish(context.Background(), []string{"App.Example.com."}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.set) != 1 || p.set[0] != "A app.example.com 203.0.113.10" {
+		t.Errorf("unexpected records: %v", p.set)
+	}
+
+	u = NewUpdater(p, netip.MustParseAddr("203.0.113.10"), netip.MustParseAddr("2001:db8::10"), 300)
+	p.err = errors.New("boom")
+	if err := u.Unpublish(context.Background(), []string{"a.example.com", "b.example.com"}); err == nil {
+		t.Error("expected combined error")
+	}
+	// Every record is attempted despite failures
+	if len(p.deleted) != 4 {
+		t.Errorf("expected 4 deletions, got %v", p.deleted)
+	}
+}
+
+func TestCloudflareSetRecords(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			t.Errorf("missing token, got %q", r.Header.Get("Authorization"))
+		}
+		switch r.Method {
+		case "GET":
+			if r.URL.Query().Get("name") != "app.example.com" || r.URL.Query().Get("type") != "A" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			io.WriteString(w, `{"success":true,"result":[
+				{"id":"keep","type":"A","name":"app.example.com","content":"203.0.113.10","ttl":300,"comment":"managed by proxy-manager"},
+				{"id":"stale","type":"A","name":"app.example.com","content":"198.51.100.1","ttl":300,"comment":"managed by proxy-manager"}]}`)
+		case "POST":
+			var rec cloudflareRecord
+			json.NewDecoder(r.Body).Decode(&rec)
+			if rec.Content != "203.0.113.11" || rec.Proxied || rec.Comment != cloudflareOwner {
+				t.Errorf("unexpected record %+v", rec)
+			}
+			io.WriteString(w, `{"success":true,"result":{}}`)
+		default:
+			io.WriteString(w, `{"success":true,"result":{}}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewCloudflare("tok", "zone1")
+	c.baseURL = srv.URL
+	err := c.SetRecords(context.Background(), "app.example.com", "A", []string{"203.0.113.10", "203.0.113.11"}, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /zones/zone1/dns_records",
+		"DELETE /zones/zone1/dns_records/stale",
+		"POST /zones/zone1/dns_records",
+	}
+	if strings.Join(calls, "|") != strings.Join(want, "|") {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestCloudflareForeignRecords(t *testing.T) {
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			io.WriteString(w, `{"success":true,"result":[
+				{"id":"ours","type":"A","name":"app.example.com","content":"203.0.113.10","ttl":300,"comment":"managed by proxy-manager"},
+				{"id":"theirs","type":"A","name":"app.example.com","content":"198.51.100.1","ttl":300}]}`)
+		case "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			io.WriteString(w, `{"success":true,"result":{}}`)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			io.WriteString(w, `{"success":true,"result":{}}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewCloudflare("tok", "zone1")
+	c.baseURL = srv.URL
+	err := c.SetRecords(context.Background(), "app.example.com", "A", []string{"203.0.113.10"}, 300)
+	if !errors.Is(err, ErrForeignRecords) {
+		t.Errorf("expected ErrForeignRecords, got %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("expected nothing deleted by SetRecords, got %v", deleted)
+	}
+
+	// Only our record is removed
+	if err := c.DeleteRecords(context.Background(), "app.example.com", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "/zones/zone1/dns_records/ours" {
+		t.Errorf("expected only our record deleted, got %v", deleted)
+	}
+}
+
+func TestCloudflareError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`)
+	}))
+	defer srv.Close()
+
+	c := NewCloudflare("bad", "zone1")
+	c.baseURL = srv.URL
+	err := c.DeleteRecords(context.Background(), "app.example.com", "A")
+	if err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+}
+
+func TestRoute53DeleteLooksUpRecordSet(t *testing.T) {
+	var change string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20240102/us-east-1/route53/aws4_request, SignedHeaders=") {
+			t.Errorf("unexpected Authorization %q", auth)
+		}
+		if r.URL.Path != "/2013-04-01/hostedzone/Z123/rrset" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.Method == "GET" {
+			io.WriteString(w, `<ListResourceRecordSetsResponse><ResourceRecordSets><ResourceRecordSet>
+				<Name>\052.example.com.</Name><Type>A</Type><TTL>60</TTL>
+				<ResourceRecords><ResourceRecord><Value>203.0.113.10</Value></ResourceRecord></ResourceRecords>
+				</ResourceRecordSet></ResourceRecordSets></ListResourceRecordSetsResponse>`)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		change = string(body)
+	}))
+	defer srv.Close()
+
+	c := NewRoute53("/hostedzone/Z123", "AKID", "secret", "")
+	c.baseURL = srv.URL
+	c.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	if err := c.DeleteRecords(context.Background(), "*.example.com", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(change, "<Action>DELETE</Action>") || !strings.Contains(change, "<TTL>60</TTL>") ||
+		!strings.Contains(change, "<Value>203.0.113.10</Value>") {
+		t.Errorf("delete must send the current record set, got %s", change)
+	}
+}
+
+func TestRFC2136SetRecords(t *testing.T) {
+	const key, secret = "update-key.", "c2VjcmV0c2VjcmV0c2VjcmV0"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan *dns.Msg, 1)
+	srv := &dns.Server{
+		Listener:   l,
+		TsigSecret: map[string]string{key: secret},
+		// The default accept func refuses UPDATE messages
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg).SetReply(req)
+			if req.IsTsig() == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeRefused
+			} else {
+				got <- req
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	c := NewRFC2136(l.Addr().String(), "example.com", "update-key", secret, "")
+	if err := c.SetRecords(context.Background(), "app.example.com", "A", []string{"203.0.113.10"}, 300); err != nil {
+		t.Fatal(err)
+	}
+	req := <-got
+	if req.Question[0].Name != "example.com." {
+		t.Errorf("expected zone example.com., got %s", req.Question[0].Name)
+	}
+	// Remove the old RRset, then insert the new record
+	if len(req.Ns) != 2 || req.Ns[0].Header().Class != dns.ClassANY || req.Ns[1].(*dns.A).A.String() != "203.0.113.10" {
+		t.Errorf("unexpected update section: %v", req.Ns)
+	}
+
+	unsigned := NewRFC2136(l.Addr().String(), "example.com", "", "", "")
+	if err := unsigned.DeleteRecords(context.Background(), "app.example.com", "A"); err == nil {
+		t.Error("expected unsigned update to be refused")
+	}
+}
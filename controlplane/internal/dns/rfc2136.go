@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC2136 manages records with DNS UPDATE messages, as accepted by BIND,
+// Knot, PowerDNS, and most self-hosted authoritative servers. Updates are
+// signed with TSIG when a key is configured.
+type RFC2136 struct {
+	server  string // host:port of the primary
+	zone    string // FQDN of the zone
+	keyName string // FQDN of the TSIG key
+	secret  string // base64 TSIG secret
+	alg     string
+	timeout time.Duration
+}
+
+// NewRFC2136 creates a provider that sends updates for zone to server
+// (host:port). keyName and secret may be empty for unsigned updates;
+// algorithm defaults to hmac-sha256.
+func NewRFC2136(server, zone, keyName, secret, algorithm string) *RFC2136 {
+	alg := dns.HmacSHA256
+	if algorithm != "" {
+		alg = dns.Fqdn(strings.ToLower(algorithm))
+	}
+	if keyName != "" {
+		keyName = dns.Fqdn(keyName)
+	}
+	return &RFC2136{
+		server:  server,
+		zone:    dns.Fqdn(zone),
+		keyName: keyName,
+		secret:  secret,
+		alg:     alg,
+		timeout: 10 * time.Second,
+	}
+}
+
+// SetRecords implements Provider. The old record set is removed and the new
+// one inserted in a single atomic update.
+func (c *RFC2136) SetRecords(ctx context.Context, name, rtype string, values []string, ttl int) error {
+	rrs := make([]dns.RR, 0, len(values))
+	for _, v := range values {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), ttl, rtype, v))
+		if err != nil {
+			return fmt.Errorf("build record: %w", err)
+		}
+		rrs = append(rrs, rr)
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(c.zone)
+	m.RemoveRRset([]dns.RR{rrsetOf(name, rtype)})
+	m.Insert(rrs)
+	return c.send(ctx, m)
+}
+
+// DeleteRecords implements Provider.
+func (c *RFC2136) DeleteRecords(ctx context.Context, name, rtype string) error {
+	m := new(dns.Msg)
+	m.SetUpdate(c.zone)
+	m.RemoveRRset([]dns.RR{rrsetOf(name, rtype)})
+	return c.send(ctx, m)
+}
+
+// rrsetOf returns a placeholder RR naming the record set.
+func rrsetOf(name, rtype string) dns.RR {
+	return &dns.ANY{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.StringToType[rtype], Class: dns.ClassINET}}
+}
+
+func (c *RFC2136) send(ctx context.Context, m *dns.Msg) error {
+	client := &dns.Client{Net: "tcp", Timeout: c.timeout}
+	if c.keyName != "" {
+		client.TsigSecret = map[string]string{c.keyName: c.secret}
+		m.SetTsig(c.keyName, c.alg, 300, time.Now().Unix())
+	}
+	resp, _, err := client.ExchangeContext(ctx, m, c.server)
+	if err != nil {
+		return fmt.Errorf("rfc2136 update: %w", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136 update: server returned %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
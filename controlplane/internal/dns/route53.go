@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/sigv4"
+)
+
+const (
+	route53API     = "https://route53.amazonaws.com"
+	route53Version = "2013-04-01"
+	route53Region  = "us-east-1" // Route 53 is global; requests are signed for us-east-1
+)
+
+// Route53 manages records in an AWS Route 53 hosted zone. Requests are
+// signed with AWS Signature Version 4 using static credentials.
+type Route53 struct {
+	zoneID     string
+	creds      sigv4.Credentials
+	baseURL    string
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewRoute53 creates a provider for the hosted zone with the given ID.
+// sessionToken is only needed for temporary credentials.
+func NewRoute53(zoneID, accessKey, secretKey, sessionToken string) *Route53 {
+	return &Route53{
+		zoneID:     strings.TrimPrefix(zoneID, "/hostedzone/"),
+		creds:      sigv4.Credentials{AccessKey: accessKey, SecretKey: secretKey, SessionToken: sessionToken},
+		baseURL:    route53API,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+}
+
+type route53RecordSet struct {
+	Name            string          `xml:"Name"`
+	Type            string          `xml:"Type"`
+	TTL             int             `xml:"TTL"`
+	ResourceRecords []route53Record `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Record struct {
+	Value string `xml:"Value"`
+}
+
+type route53Change struct {
+	Action    string           `xml:"Action"`
+	RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+// SetRecords implements Provider.
+func (c *Route53) SetRecords(ctx context.Context, name, rtype string, values []string, ttl int) error {
+	set := route53RecordSet{Name: name + ".", Type: rtype, TTL: ttl}
+	for _, v := range values {
+		set.ResourceRecords = append(set.ResourceRecords, route53Record{Value: v})
+	}
+	return c.change(ctx, route53Change{Action: "UPSERT", RecordSet: set})
+}
+
+// DeleteRecords implements Provider. Route 53 only deletes a record set
+// given its exact current contents, so it is looked up first.
+func (c *Route53) DeleteRecords(ctx context.Context, name, rtype string) error {
+	set, err := c.get(ctx, name, rtype)
+	if err != nil || set == nil {
+		return err
+	}
+	return c.change(ctx, route53Change{Action: "DELETE", RecordSet: *set})
+}
+
+func (c *Route53) change(ctx context.Context, ch route53Change) error {
+	body, err := xml.Marshal(route53ChangeRequest{Changes: []route53Change{ch}})
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+	return c.do(ctx, "POST", "/rrset", nil, body, nil)
+}
+
+// get returns the record set for name and rtype, or nil if there is none.
+func (c *Route53) get(ctx context.Context, name, rtype string) (*route53RecordSet, error) {
+	q := url.Values{"name": {name + "."}, "type": {rtype}, "maxitems": {"1"}}
+	var resp struct {
+		RecordSets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	if err := c.do(ctx, "GET", "/rrset", q, nil, &resp); err != nil {
+		return nil, err
+	}
+	// The listing starts at name but may return the next set in the zone.
+	for _, set := range resp.RecordSets {
+		got := strings.ReplaceAll(normalize(set.Name), `\052`, "*")
+		if got == name && set.Type == rtype {
+			return &set, nil
+		}
+	}
+	return nil, nil
+}
+
+// do sends a signed request to the hosted zone's path and decodes the XML
+// response into out, if non-nil.
+func (c *Route53) do(ctx context.Context, method, path string, query url.Values, body []byte, out interface{}) error {
+	u := c.baseURL + "/" + route53Version + "/hostedzone/" + c.zoneID + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	sigv4.Sign(req, body, c.creds, route53Region, "route53", c.now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("route53 %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(respBody, &e) == nil && e.Code != "" {
+			return fmt.Errorf("route53 %s: %s: %s", method, e.Code, e.Message)
+		}
+		return fmt.Errorf("route53 %s: status %d", method, resp.StatusCode)
+	}
+	if out != nil {
+		if err := xml.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("decode response: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// RouteCounter counts the traffic between the VPS and the upstream of a
+// route: what Caddy proxies to the peer, and what the peer sends back.
+type RouteCounter struct {
+	ID      string // route ID
+	Proto   string // "tcp" or "udp"; a route with QUIC has a counter for each
+	Addr    string // upstream IP
+	Port    int    // upstream port
+	PortEnd int    // last upstream port of a port-forward range, or 0
+	RxBytes uint64 // from the upstream; only set by ListRouteCounters
+	TxBytes uint64 // to the upstream
+}
+
+// Key identifies the counter in the chains; a route has one per protocol.
+func (c RouteCounter) Key() string {
+	return counterPrefix + c.Proto + ":" + c.ID
+}
+
+// Overlaps reports whether c and o count some of the same packets: the same
+// protocol and address, and overlapping ports.
+func (c RouteCounter) Overlaps(o RouteCounter) bool {
+	return c.Proto == o.Proto && c.Addr == o.Addr &&
+		c.Port <= max(o.Port, o.PortEnd) && o.Port <= max(c.Port, c.PortEnd)
+}
+
+// ValidateRouteCounter checks that a route counter is well-formed.
+func ValidateRouteCounter(c RouteCounter) error {
+	if c.ID == "" {
+		return fmt.Errorf("route ID is required")
+	}
+	if c.Proto != "tcp" && c.Proto != "udp" {
+		return fmt.Errorf("protocol must be tcp or udp, got %q", c.Proto)
+	}
+	if _, err := netip.ParseAddr(c.Addr); err != nil {
+		return fmt.Errorf("invalid upstream address %q: %w", c.Addr, err)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.PortEnd != 0 && (c.PortEnd < c.Port || c.PortEnd > 65535) {
+		return fmt.Errorf("port range end %d must be between %d and 65535", c.PortEnd, c.Port)
+	}
+	return nil
+}
+
+// AddRouteCounter starts counting the traffic of a route's upstream.
+func (m *Manager) AddRouteCounter(c RouteCounter) error {
+	if err := ValidateRouteCounter(c); err != nil {
+		return fmt.Errorf("invalid route counter: %w", err)
+	}
+	addr, _ := netip.ParseAddr(c.Addr)
+	c.Addr = addr.Unmap().String()
+	return m.conn.AddRouteCounter(c)
+}
+
+// DeleteRouteCounter removes the counter with the given key.
+func (m *Manager) DeleteRouteCounter(key string) error {
+	return m.conn.DeleteRouteCounter(key)
+}
+
+// ListRouteCounters returns the route counters in nftables with the bytes
+// they counted so far.
+func (m *Manager) ListRouteCounters() ([]RouteCounter, error) {
+	return m.conn.ListRouteCounters()
+}
+
+const counterPrefix = "counter:"
+
+// Port offsets in the transport header
+const sportOffset = 0
+
+// AddRouteCounter appends a rule to each counter chain in one transaction:
+// "ip saddr <addr> th sport <ports> counter" on input for replies from the
+// upstream, and "ip daddr <addr> th dport <ports> counter" on output. The
+// rules have no verdict, so packets go on to the filter chains.
+func (c *RealNFTConn) AddRouteCounter(rc RouteCounter) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addr, err := netip.ParseAddr(rc.Addr)
+	if err != nil {
+		return fmt.Errorf("add route counter: %w", err)
+	}
+	host := netip.PrefixFrom(addr, addr.BitLen())
+	c.conn.AddRule(c.newRule(c.countIn, rc.Key(), counterExprs(sourceExprs(host), rc, sportOffset)))
+	c.conn.AddRule(c.newRule(c.countOut, rc.Key(), counterExprs(destExprs(host), rc, dportOffset)))
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("add route counter: %w", err)
+	}
+	return nil
+}
+
+// counterExprs appends the protocol, port, and counter expressions of rc to
+// an address match. The port is read at portOffset in the transport header.
+func counterExprs(match []expr.Any, rc RouteCounter, portOffset uint32) []expr.Any {
+	proto := byte(unix.IPPROTO_TCP)
+	if rc.Proto == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+	exprs := append(append([]expr.Any{}, match...),
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: portOffset, Len: 2},
+	)
+	if rc.PortEnd > rc.Port {
+		exprs = append(exprs, &expr.Range{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			FromData: binaryutil.BigEndian.PutUint16(uint16(rc.Port)),
+			ToData:   binaryutil.BigEndian.PutUint16(uint16(rc.PortEnd)),
+		})
+	} else {
+		exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(rc.Port))})
+	}
+	return append(exprs, &expr.Counter{})
+}
+
+// DeleteRouteCounter removes both rules of a route counter in one
+// transaction.
+func (c *RealNFTConn) DeleteRouteCounter(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var found bool
+	for _, chain := range []*nftables.Chain{c.countIn, c.countOut} {
+		rules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return fmt.Errorf("list %s rules: %w", chain.Name, err)
+		}
+		for _, r := range rules {
+			if comment, _ := userdata.GetString(r.UserData, userdata.TypeComment); comment == key {
+				r.Table, r.Chain = c.table, chain
+				if err := c.conn.DelRule(r); err != nil {
+					return fmt.Errorf("delete route counter: %w", err)
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("route counter %q not found", key)
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("delete route counter: %w", err)
+	}
+	return nil
+}
+
+// ListRouteCounters reads the counter chains. A counter missing the rule of
+// one direction is still listed, with zero bytes in that direction, so the
+// reconciler replaces it.
+func (c *RealNFTConn) ListRouteCounters() ([]RouteCounter, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byKey := map[string]*RouteCounter{}
+	var order []string
+	for _, chain := range []*nftables.Chain{c.countIn, c.countOut} {
+		rules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("list %s rules: %w", chain.Name, err)
+		}
+		for _, r := range rules {
+			comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+			rest, ok := strings.CutPrefix(comment, counterPrefix)
+			if !ok {
+				continue
+			}
+			proto, id, _ := strings.Cut(rest, ":")
+			parsed, bytes, ok := parseCounterExprs(r.Exprs)
+			if !ok {
+				continue
+			}
+			rc := byKey[comment]
+			if rc == nil {
+				parsed.ID, parsed.Proto = id, proto
+				rc = &parsed
+				byKey[comment] = rc
+				order = append(order, comment)
+			}
+			if chain == c.countIn {
+				rc.RxBytes = bytes
+			} else {
+				rc.TxBytes = bytes
+			}
+		}
+	}
+
+	counters := make([]RouteCounter, 0, len(order))
+	for _, key := range order {
+		counters = append(counters, *byKey[key])
+	}
+	return counters, nil
+}
+
+// parseCounterExprs is the inverse of counterExprs: it returns the upstream
+// address and ports matched, and the bytes counted.
+func parseCounterExprs(exprs []expr.Any) (RouteCounter, uint64, bool) {
+	var (
+		rc    RouteCounter
+		bytes uint64
+		load  expr.Any
+		found bool
+	)
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta, *expr.Payload:
+			load = e
+		case *expr.Cmp:
+			p, ok := load.(*expr.Payload)
+			if !ok {
+				continue
+			}
+			switch p.Base {
+			case expr.PayloadBaseNetworkHeader:
+				addr, ok := netip.AddrFromSlice(e.Data)
+				if !ok {
+					return RouteCounter{}, 0, false
+				}
+				rc.Addr = addr.String()
+			case expr.PayloadBaseTransportHeader:
+				if len(e.Data) != 2 {
+					return RouteCounter{}, 0, false
+				}
+				rc.Port = int(binaryutil.BigEndian.Uint16(e.Data))
+			}
+		case *expr.Range:
+			if len(e.FromData) != 2 || len(e.ToData) != 2 {
+				return RouteCounter{}, 0, false
+			}
+			rc.Port = int(binaryutil.BigEndian.Uint16(e.FromData))
+			rc.PortEnd = int(binaryutil.BigEndian.Uint16(e.ToData))
+		case *expr.Counter:
+			bytes, found = e.Bytes, true
+		}
+	}
+	if !found || rc.Addr == "" || rc.Port == 0 {
+		return RouteCounter{}, 0, false
+	}
+	return rc, bytes, true
+}
+
+// addRuleCounters replaces the API rules that have no counter, added before
+// rules counted their hits, with counting copies at the same position, in
+// one transaction.
+func (c *RealNFTConn) addRuleCounters() error {
+	var replaced bool
+	for _, chain := range c.ruleChains() {
+		rules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return fmt.Errorf("list %s rules: %w", chain.Name, err)
+		}
+		for _, r := range rules {
+			comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+			if comment == "" || internalComment(comment) || hasCounter(r.Exprs) {
+				continue
+			}
+			if _, ok := parseRuleExprs(r.Exprs); !ok {
+				continue
+			}
+			// The verdict is always last
+			exprs := append(append([]expr.Any{}, r.Exprs[:len(r.Exprs)-1]...), &expr.Counter{}, r.Exprs[len(r.Exprs)-1])
+			counted := c.newRule(chain, comment, exprs)
+			counted.Position = r.Handle
+			c.conn.AddRule(counted)
+			r.Table, r.Chain = c.table, chain
+			if err := c.conn.DelRule(r); err != nil {
+				return fmt.Errorf("replace %s: %w", comment, err)
+			}
+			replaced = true
+		}
+	}
+	if !replaced {
+		return nil
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("add rule counters: %w", err)
+	}
+	return nil
+}
+
+func hasCounter(exprs []expr.Any) bool {
+	for _, e := range exprs {
+		if _, ok := e.(*expr.Counter); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -1,41 +1,108 @@
 package firewall
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
-	"os/exec"
-	"strconv"
+	"net/netip"
 	"strings"
 	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// Chains a rule can be placed in.
+const (
+	ChainInput   = "input"   // traffic addressed to the VPS
+	ChainForward = "forward" // traffic routed through the WireGuard interface
+	ChainOutput  = "output"  // traffic the VPS sends, such as Caddy's to upstreams
 )
 
 // Rule represents a firewall rule in the dynamic chain.
 type Rule struct {
-	ID         string
-	Port       int
-	Proto      string
+	ID    string
+	Port  int
+	Proto string
+	// Chain is ChainInput (the default when empty), ChainForward, or
+	// ChainOutput.
+	Chain string
+	// Direction is "in" or "out". Forward rules match packets arriving on
+	// the WireGuard interface ("in", from peers) or leaving through it
+	// ("out", to peers); input rules are always "in" and output rules
+	// always "out".
 	Direction  string
 	SourceCIDR string
-	Action     string
+	// DestCIDR restricts the rule to packets addressed to it; empty
+	// matches every destination.
+	DestCIDR string
+	Action   string
+	// Packets and Bytes count the traffic the rule matched since it was
+	// added or last replaced; only set by ListRules.
+	Packets uint64
+	Bytes   uint64
 }
 
 // NFTConn is the interface for interacting with nftables.
 // This abstraction allows mocking in tests.
 type NFTConn interface {
-	// Init creates the dynamic-api-rules chain if it doesn't exist.
-	Init() error
-	// AddRule adds a rule to the dynamic chain.
+	// Init creates the dynamic-api-rules, dynamic-api-forward,
+	// dynamic-api-output, and route counter chains if they don't exist, and sets the policy and priority
+	// of the dynamic chains.
+	Init(opts ChainOptions) error
+	// AddRule adds a rule to the dynamic chain, deny rules ahead of allow
+	// rules.
 	AddRule(rule Rule) error
 	// DeleteRule removes a rule from the dynamic chain by ID.
 	DeleteRule(id string) error
-	// ListRules returns all rules in the dynamic chain.
+	// ReplaceRule swaps the rule with rule.ID for rule in one transaction,
+	// so no packet sees both rules or neither.
+	ReplaceRule(rule Rule) error
+	// ListRules returns all rules in the dynamic chains.
 	ListRules() ([]Rule, error)
+	// AddBan drops all traffic from ip, ahead of every other dynamic rule.
+	AddBan(ip string) error
+	// DeleteBan removes the ban on ip.
+	DeleteBan(ip string) error
+	// ListBans returns the banned IPs.
+	ListBans() ([]string, error)
+	// AddIsolation drops forwarded traffic between ip and every other peer.
+	AddIsolation(ip string) error
+	// DeleteIsolation lets ip exchange traffic with other peers again.
+	DeleteIsolation(ip string) error
+	// ListIsolated returns the isolated peer IPs.
+	ListIsolated() ([]string, error)
+	// RestrictUpstream drops new connections to a peer on ports outside
+	// the allowed ones, replacing its previous restriction.
+	RestrictUpstream(r UpstreamRestriction) error
+	// DeleteUpstreamRestriction lifts the restriction of the peer with
+	// the given VPN IP.
+	DeleteUpstreamRestriction(ip string) error
+	// ListUpstreamRestrictions returns the Digest of each restriction, by
+	// peer VPN IP.
+	ListUpstreamRestrictions() (map[string]string, error)
+	// AddRouteCounter starts counting the traffic to and from a route's
+	// upstream.
+	AddRouteCounter(c RouteCounter) error
+	// DeleteRouteCounter removes the route counter with the given Key.
+	DeleteRouteCounter(key string) error
+	// ListRouteCounters returns the route counters and their byte counts.
+	ListRouteCounters() ([]RouteCounter, error)
+	// AddService accepts traffic to a service in the input chain.
+	AddService(s Service) error
+	// DeleteService removes the service with the given name.
+	DeleteService(name string) error
+	// ListServices returns the services open in the input chain.
+	ListServices() ([]Service, error)
 }
 
 // Manager wraps nftables operations for the control plane.
 type Manager struct {
-	conn NFTConn
+	conn     NFTConn
+	reserved map[int]bool
+	chain    ChainOptions
 }
 
 // NewManager creates a new firewall manager.
@@ -43,17 +110,42 @@ func NewManager(conn NFTConn) *Manager {
 	return &Manager{conn: conn}
 }
 
-// Init initializes the dynamic-api-rules chain.
+// SetReservedPorts sets the management ports rules may not open or close.
+func (m *Manager) SetReservedPorts(ports map[int]bool) {
+	m.reserved = ports
+}
+
+// Init initializes the dynamic chains with the options set by
+// SetChainOptions.
 func (m *Manager) Init() error {
-	return m.conn.Init()
+	return m.conn.Init(m.chain)
 }
 
 // AddRule adds a firewall rule after validation.
 func (m *Manager) AddRule(rule Rule) error {
+	if err := m.validate(rule); err != nil {
+		return err
+	}
+	return m.conn.AddRule(rule)
+}
+
+// ReplaceRule validates rule and swaps it in for the existing rule with the
+// same ID.
+func (m *Manager) ReplaceRule(rule Rule) error {
+	if err := m.validate(rule); err != nil {
+		return err
+	}
+	return m.conn.ReplaceRule(rule)
+}
+
+func (m *Manager) validate(rule Rule) error {
 	if err := ValidateRule(rule); err != nil {
 		return fmt.Errorf("invalid rule: %w", err)
 	}
-	return m.conn.AddRule(rule)
+	if m.reserved[rule.Port] && (rule.Chain == "" || rule.Chain == ChainInput) {
+		return fmt.Errorf("invalid rule: port %d is reserved", rule.Port)
+	}
+	return nil
 }
 
 // DeleteRule removes a firewall rule by ID.
@@ -66,30 +158,88 @@ func (m *Manager) ListRules() ([]Rule, error) {
 	return m.conn.ListRules()
 }
 
-// ValidateRule checks that a firewall rule is valid.
+// BanIP drops all traffic from ip until UnbanIP is called.
+func (m *Manager) BanIP(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("invalid ban: %w", err)
+	}
+	return m.conn.AddBan(addr.Unmap().String())
+}
+
+// UnbanIP lifts the ban on ip.
+func (m *Manager) UnbanIP(ip string) error {
+	return m.conn.DeleteBan(ip)
+}
+
+// ListBans returns the IPs currently banned in nftables.
+func (m *Manager) ListBans() ([]string, error) {
+	return m.conn.ListBans()
+}
+
+// IsolatePeer drops forwarded traffic between the peer with VPN address ip
+// and the other peers. Traffic between the peer and the VPS is unaffected.
+func (m *Manager) IsolatePeer(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("invalid peer address: %w", err)
+	}
+	return m.conn.AddIsolation(addr.Unmap().String())
+}
+
+// UnisolatePeer removes the isolation of the peer with VPN address ip.
+func (m *Manager) UnisolatePeer(ip string) error {
+	return m.conn.DeleteIsolation(ip)
+}
+
+// ListIsolated returns the VPN addresses of the isolated peers.
+func (m *Manager) ListIsolated() ([]string, error) {
+	return m.conn.ListIsolated()
+}
+
+// ValidateRule checks that a firewall rule is well-formed. Reserved ports
+// are checked by Manager.AddRule; they only apply to the input chain, since
+// forward and output rules cannot lock anyone out of the VPS.
 func ValidateRule(rule Rule) error {
 	if rule.Port < 1 || rule.Port > 65535 {
 		return fmt.Errorf("port must be between 1 and 65535, got %d", rule.Port)
 	}
 
-	reservedPorts := map[int]bool{22: true, 2019: true, 7443: true, 51820: true}
-	if reservedPorts[rule.Port] {
-		return fmt.Errorf("port %d is reserved", rule.Port)
-	}
-
 	if rule.Proto != "tcp" && rule.Proto != "udp" {
 		return fmt.Errorf("protocol must be tcp or udp, got %q", rule.Proto)
 	}
 
+	if rule.Chain != "" && rule.Chain != ChainInput && rule.Chain != ChainForward && rule.Chain != ChainOutput {
+		return fmt.Errorf("chain must be input, forward, or output, got %q", rule.Chain)
+	}
+
 	if rule.Direction != "" && rule.Direction != "in" && rule.Direction != "out" {
 		return fmt.Errorf("direction must be in or out, got %q", rule.Direction)
 	}
+	if rule.Direction == "out" && rule.Chain != ChainForward && rule.Chain != ChainOutput {
+		return fmt.Errorf("direction out is only valid on the forward and output chains")
+	}
+	if rule.Direction == "in" && rule.Chain == ChainOutput {
+		return fmt.Errorf("direction in is not valid on the output chain")
+	}
 
+	var source, dest netip.Prefix
 	if rule.SourceCIDR != "" {
 		_, _, err := net.ParseCIDR(rule.SourceCIDR)
 		if err != nil {
 			return fmt.Errorf("invalid source CIDR %q: %w", rule.SourceCIDR, err)
 		}
+		source = netip.MustParsePrefix(rule.SourceCIDR)
+	}
+	if rule.DestCIDR != "" {
+		_, _, err := net.ParseCIDR(rule.DestCIDR)
+		if err != nil {
+			return fmt.Errorf("invalid destination CIDR %q: %w", rule.DestCIDR, err)
+		}
+		dest = netip.MustParsePrefix(rule.DestCIDR)
+	}
+	if source.IsValid() && dest.IsValid() && source.Addr().Unmap().Is4() != dest.Addr().Unmap().Is4() {
+		return fmt.Errorf("source CIDR %q and destination CIDR %q are of different address families", rule.SourceCIDR, rule.DestCIDR)
 	}
 
 	if rule.Action != "" && rule.Action != "allow" && rule.Action != "deny" {
@@ -99,154 +249,639 @@ func ValidateRule(rule Rule) error {
 	return nil
 }
 
-// RealNFTConn implements NFTConn using the nft CLI.
+// RealNFTConn implements NFTConn on top of netlink via google/nftables.
+// Rules are identified by their comment, so the kernel is the only source
+// of truth and nothing is lost when the control plane restarts.
 // This requires CAP_NET_ADMIN and only works on Linux.
 type RealNFTConn struct {
-	mu    sync.Mutex
-	rules map[string]Rule
+	mu      sync.Mutex
+	conn    *nftables.Conn
+	table   *nftables.Table
+	input   *nftables.Chain
+	forward *nftables.Chain
+	output  *nftables.Chain
+	iface   string // WireGuard interface forward rules are scoped to
+
+	countIn  *nftables.Chain // route counters, see AddRouteCounter
+	countOut *nftables.Chain
+	redirect *nftables.Chain // nat chain of ChainOptions.Redirects
 }
 
-// NewRealNFTConn creates a new real nftables connection.
-func NewRealNFTConn() *RealNFTConn {
-	return &RealNFTConn{
-		rules: make(map[string]Rule),
+// NewRealNFTConn creates a new real nftables connection. Forward rules are
+// scoped to wgInterface.
+func NewRealNFTConn(wgInterface string) (*RealNFTConn, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("open netlink connection: %w", err)
 	}
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: "filter"}
+	return &RealNFTConn{
+		conn:    conn,
+		table:   table,
+		input:   &nftables.Chain{Name: "dynamic-api-rules", Table: table},
+		forward: &nftables.Chain{Name: "dynamic-api-forward", Table: table},
+		output:  &nftables.Chain{Name: "dynamic-api-output", Table: table},
+		iface:   wgInterface,
+
+		countIn:  &nftables.Chain{Name: "route-counters-in", Table: table},
+		countOut: &nftables.Chain{Name: "route-counters-out", Table: table},
+		redirect: &nftables.Chain{Name: "dynamic-api-redirect", Table: table},
+	}, nil
 }
 
-// nftExec runs an nft command and returns combined output.
-func nftExec(args ...string) ([]byte, error) {
-	cmd := exec.Command("nft", args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return out, fmt.Errorf("nft %s: %s: %w", strings.Join(args, " "), strings.TrimSpace(string(out)), err)
+// Init creates the dynamic-api-rules, dynamic-api-forward, and
+// dynamic-api-output chains, and the route-counters-in and route-counters-out
+// chains on the input and output hooks, if they don't exist. The three
+// dynamic chains get the priority in opts, and the input and forward chains
+// its policies; the output chain always accepts. Under a drop policy the
+// same transaction installs accept rules for established connections,
+// loopback, and opts.Services, replacing those of the previous start. Deny
+// rules found after allow rules are then moved ahead of them, and rules
+// without a hit counter get one. opts.Redirects replace those of the
+// previous start in the dynamic-api-redirect chain, a nat chain on the
+// prerouting hook created when there are any.
+func (c *RealNFTConn) Init(opts ChainOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.checkPriority(opts.Priority); err != nil {
+		return err
+	}
+	// Read before queueing the batch; the chains may not exist yet
+	var stale []*nftables.Rule
+	for _, chain := range []*nftables.Chain{c.input, c.forward, c.redirect} {
+		rules, _ := c.conn.GetRules(c.table, chain)
+		for _, r := range rules {
+			comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+			if strings.HasPrefix(comment, servicePrefix) || strings.HasPrefix(comment, basePrefix) || strings.HasPrefix(comment, redirectPrefix) {
+				r.Table, r.Chain = c.table, chain
+				stale = append(stale, r)
+			}
+		}
 	}
-	return out, nil
-}
 
-// Init creates the dynamic-api-rules chain if it doesn't exist.
-func (c *RealNFTConn) Init() error {
-	// Create table (idempotent — nft add doesn't fail if it exists)
-	if _, err := nftExec("add", "table", "inet", "filter"); err != nil {
-		return fmt.Errorf("create table: %w", err)
+	// Adding an existing table or chain only updates its policy
+	c.conn.AddTable(c.table)
+	accept, drop := nftables.ChainPolicyAccept, nftables.ChainPolicyDrop
+	priority := nftables.ChainPriorityRef(nftables.ChainPriority(opts.Priority))
+	for _, base := range []struct {
+		chain    *nftables.Chain
+		hook     *nftables.ChainHook
+		priority *nftables.ChainPriority
+		drop     bool
+	}{
+		{c.input, nftables.ChainHookInput, priority, opts.dropInput()},
+		{c.forward, nftables.ChainHookForward, priority, opts.dropForward()},
+		{c.output, nftables.ChainHookOutput, priority, false},
+		{c.countIn, nftables.ChainHookInput, nftables.ChainPriorityFilter, false},
+		{c.countOut, nftables.ChainHookOutput, nftables.ChainPriorityFilter, false},
+	} {
+		policy := &accept
+		if base.drop {
+			policy = &drop
+		}
+		c.conn.AddChain(&nftables.Chain{
+			Name:     base.chain.Name,
+			Table:    c.table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  base.hook,
+			Priority: base.priority,
+			Policy:   policy,
+		})
+	}
+	if len(opts.Redirects) > 0 {
+		c.conn.AddChain(&nftables.Chain{
+			Name:     c.redirect.Name,
+			Table:    c.table,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityNATDest,
+			Policy:   &accept,
+		})
+	}
+	for _, r := range stale {
+		if err := c.conn.DelRule(r); err != nil {
+			return fmt.Errorf("delete policy rule: %w", err)
+		}
+	}
+	for _, r := range c.policyRules(opts) {
+		c.conn.AddRule(c.newRule(r.chain, r.comment, r.exprs))
+	}
+	for _, r := range opts.Redirects {
+		c.conn.AddRule(c.newRule(c.redirect, redirectComment(r), redirectExprs(r)))
 	}
-	// Create chain (idempotent)
-	if _, err := nftExec("add", "chain", "inet", "filter", "dynamic-api-rules", "{ type filter hook input priority 0 ; policy accept ; }"); err != nil {
-		return fmt.Errorf("create chain: %w", err)
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("create chains: %w", err)
+	}
+	if err := c.orderDenies(); err != nil {
+		return err
+	}
+	return c.addRuleCounters()
+}
+
+// chainFor returns the nftables chain a rule belongs in.
+func (c *RealNFTConn) chainFor(rule Rule) *nftables.Chain {
+	switch rule.Chain {
+	case ChainForward:
+		return c.forward
+	case ChainOutput:
+		return c.output
 	}
-	// Load existing rules into memory
-	return c.syncRulesFromKernel()
+	return c.input
+}
+
+// ruleChains returns the chains API rules are placed in.
+func (c *RealNFTConn) ruleChains() []*nftables.Chain {
+	return []*nftables.Chain{c.input, c.forward, c.output}
 }
 
-// AddRule adds a rule via nft CLI.
+// AddRule inserts a deny rule at the head of the chain and appends an allow
+// rule, so every deny rule is evaluated before every allow rule.
 func (c *RealNFTConn) AddRule(rule Rule) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	expr := buildNftRuleExpr(rule)
-	args := append([]string{"add", "rule", "inet", "filter", "dynamic-api-rules"}, expr...)
-	if _, err := nftExec(args...); err != nil {
+	exprs, err := ruleExprs(rule, c.iface)
+	if err != nil {
+		return fmt.Errorf("add rule: %w", err)
+	}
+	if rule.Action == "deny" {
+		c.conn.InsertRule(c.newRule(c.chainFor(rule), rule.ID, exprs))
+	} else {
+		c.conn.AddRule(c.newRule(c.chainFor(rule), rule.ID, exprs))
+	}
+	if err := c.conn.Flush(); err != nil {
 		return fmt.Errorf("add rule: %w", err)
 	}
-	c.rules[rule.ID] = rule
 	return nil
 }
 
-// DeleteRule removes a rule by finding its handle and deleting it.
+// DeleteRule removes a rule by ID.
 func (c *RealNFTConn) DeleteRule(id string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	handle, err := c.findRuleHandle(id)
+	return c.deleteByComment(id)
+}
+
+// ReplaceRule adds the new rule right after the old one and deletes the old
+// one in a single netlink batch, which the kernel applies atomically. A rule
+// whose action changes moves instead: to the head of the chain for deny,
+// to its end for allow.
+func (c *RealNFTConn) ReplaceRule(rule Rule) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old, err := c.findRule(rule.ID)
 	if err != nil {
-		return fmt.Errorf("find rule handle: %w", err)
+		return fmt.Errorf("find rule: %w", err)
 	}
-	if _, err := nftExec("delete", "rule", "inet", "filter", "dynamic-api-rules", "handle", strconv.Itoa(handle)); err != nil {
-		return fmt.Errorf("delete rule: %w", err)
+	exprs, err := ruleExprs(rule, c.iface)
+	if err != nil {
+		return fmt.Errorf("replace rule: %w", err)
+	}
+	replacement := c.newRule(old.Chain, rule.ID, exprs)
+	switch verdict := verdictOf(exprs); {
+	case verdict == verdictOf(old.Exprs):
+		replacement.Position = old.Handle
+		c.conn.AddRule(replacement)
+	case verdict == expr.VerdictDrop:
+		c.conn.InsertRule(replacement)
+	default:
+		c.conn.AddRule(replacement)
+	}
+	if err := c.conn.DelRule(old); err != nil {
+		return fmt.Errorf("replace rule: %w", err)
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("replace rule: %w", err)
 	}
-	delete(c.rules, id)
 	return nil
 }
 
-// ListRules returns all rules from the in-memory cache.
+// ListRules reads the rules in the three chains from the kernel. Bans, isolation,
+// services, policy rules, and rules that were not added by the control
+// plane are skipped.
 func (c *RealNFTConn) ListRules() ([]Rule, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	rules := make([]Rule, 0, len(c.rules))
-	for _, r := range c.rules {
-		rules = append(rules, r)
+	var rules []Rule
+	for _, chain := range c.ruleChains() {
+		nftRules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("list %s rules: %w", chain.Name, err)
+		}
+		for _, r := range nftRules {
+			id, ok := userdata.GetString(r.UserData, userdata.TypeComment)
+			if !ok || id == "" || internalComment(id) {
+				continue
+			}
+			rule, ok := parseRuleExprs(r.Exprs)
+			if !ok {
+				continue
+			}
+			rule.ID = id
+			switch chain {
+			case c.forward:
+				rule.Chain = ChainForward
+			case c.output:
+				rule.Chain, rule.Direction = ChainOutput, "out"
+			default:
+				rule.Chain = ChainInput
+			}
+			rules = append(rules, rule)
+		}
 	}
 	return rules, nil
 }
 
-// buildNftRuleExpr builds the nft rule expression for a given Rule.
-func buildNftRuleExpr(rule Rule) []string {
-	var parts []string
+// AddBan inserts a drop rule for ip at the head of the chain, so it wins
+// over allow rules. The rule's comment is "ban:<ip>".
+func (c *RealNFTConn) AddBan(ip string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if rule.SourceCIDR != "" {
-		parts = append(parts, "ip", "saddr", rule.SourceCIDR)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("add ban: %w", err)
 	}
-
-	proto := rule.Proto
-	if proto == "" {
-		proto = "tcp"
+	exprs := append(sourceExprs(netip.PrefixFrom(addr, addr.BitLen())), &expr.Verdict{Kind: expr.VerdictDrop})
+	c.conn.InsertRule(c.newRule(c.input, banComment(ip), exprs))
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("add ban: %w", err)
 	}
-	parts = append(parts, proto, "dport", strconv.Itoa(rule.Port))
+	return nil
+}
 
-	action := rule.Action
-	if action == "" || action == "allow" {
-		parts = append(parts, "accept")
-	} else {
-		parts = append(parts, "drop")
+// DeleteBan removes the drop rule for ip.
+func (c *RealNFTConn) DeleteBan(ip string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.deleteByComment(banComment(ip))
+}
+
+// ListBans returns the banned IPs found in the chain.
+func (c *RealNFTConn) ListBans() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nftRules, err := c.conn.GetRules(c.table, c.input)
+	if err != nil {
+		return nil, fmt.Errorf("list bans: %w", err)
 	}
+	var ips []string
+	for _, r := range nftRules {
+		comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+		if ip, ok := strings.CutPrefix(comment, banPrefix); ok {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
 
-	// Add comment with rule ID for identification
-	parts = append(parts, "comment", fmt.Sprintf("%q", rule.ID))
+const banPrefix = "ban:"
 
-	return parts
+func banComment(ip string) string {
+	return banPrefix + ip
 }
 
-// findRuleHandle finds the nftables handle for a rule by its comment (ID).
-func (c *RealNFTConn) findRuleHandle(id string) (int, error) {
-	out, err := nftExec("-a", "list", "chain", "inet", "filter", "dynamic-api-rules")
+// AddIsolation inserts two drop rules at the head of the forward chain, for
+// traffic from ip to other peers and from other peers to ip. Both carry the
+// comment "isolate:<ip>".
+func (c *RealNFTConn) AddIsolation(ip string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return 0, err
-	}
-	// Parse lines like: tcp dport 8080 accept comment "fw_rule_abc" # handle 5
-	for _, line := range strings.Split(string(out), "\n") {
-		if strings.Contains(line, fmt.Sprintf("comment %q", id)) || strings.Contains(line, fmt.Sprintf(`comment "%s"`, id)) {
-			parts := strings.Split(line, "# handle ")
-			if len(parts) == 2 {
-				h, err := strconv.Atoi(strings.TrimSpace(parts[1]))
-				if err != nil {
-					return 0, fmt.Errorf("parse handle: %w", err)
-				}
-				return h, nil
+		return fmt.Errorf("add isolation: %w", err)
+	}
+	host := netip.PrefixFrom(addr, addr.BitLen())
+	// Peer-to-peer packets enter and leave through the WireGuard interface
+	peerToPeer := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(c.iface)},
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(c.iface)},
+	}
+	drop := &expr.Verdict{Kind: expr.VerdictDrop}
+	for _, match := range [][]expr.Any{sourceExprs(host), destExprs(host)} {
+		exprs := append(append(append([]expr.Any{}, peerToPeer...), match...), drop)
+		c.conn.InsertRule(c.newRule(c.forward, isolateComment(ip), exprs))
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("add isolation: %w", err)
+	}
+	return nil
+}
+
+// DeleteIsolation removes both isolation rules for ip in one transaction.
+func (c *RealNFTConn) DeleteIsolation(ip string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rules, err := c.conn.GetRules(c.table, c.forward)
+	if err != nil {
+		return fmt.Errorf("list forward rules: %w", err)
+	}
+	var found bool
+	for _, r := range rules {
+		if comment, _ := userdata.GetString(r.UserData, userdata.TypeComment); comment == isolateComment(ip) {
+			r.Table, r.Chain = c.table, c.forward
+			if err := c.conn.DelRule(r); err != nil {
+				return fmt.Errorf("delete isolation: %w", err)
 			}
+			found = true
 		}
 	}
-	return 0, fmt.Errorf("rule %q not found in chain", id)
+	if !found {
+		return fmt.Errorf("isolation of %q not found in chain", ip)
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("delete isolation: %w", err)
+	}
+	return nil
 }
 
-// syncRulesFromKernel loads existing rules with comments into the in-memory map.
-func (c *RealNFTConn) syncRulesFromKernel() error {
+// ListIsolated returns the isolated peer IPs found in the forward chain.
+func (c *RealNFTConn) ListIsolated() ([]string, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	out, err := nftExec("-j", "list", "chain", "inet", "filter", "dynamic-api-rules")
+	rules, err := c.conn.GetRules(c.table, c.forward)
 	if err != nil {
-		// Chain might be empty, that's fine
-		return nil
+		return nil, fmt.Errorf("list isolated peers: %w", err)
+	}
+	seen := map[string]bool{}
+	var ips []string
+	for _, r := range rules {
+		comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+		if ip, ok := strings.CutPrefix(comment, isolatePrefix); ok && !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
 	}
+	return ips, nil
+}
+
+const isolatePrefix = "isolate:"
 
-	// Parse JSON output to extract rules with comments
-	var result struct {
-		Nftables []json.RawMessage `json:"nftables"`
+func isolateComment(ip string) string {
+	return isolatePrefix + ip
+}
+
+func (c *RealNFTConn) newRule(chain *nftables.Chain, comment string, exprs []expr.Any) *nftables.Rule {
+	return &nftables.Rule{
+		Table:    c.table,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: userdata.AppendString(nil, userdata.TypeComment, comment),
 	}
-	if err := json.Unmarshal(out, &result); err != nil {
-		// Not critical — just start with empty map
-		return nil
+}
+
+// findRule returns the rule whose comment is comment, from any rule chain.
+func (c *RealNFTConn) findRule(comment string) (*nftables.Rule, error) {
+	for _, chain := range c.ruleChains() {
+		rules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			if got, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok && got == comment {
+				// GetRules leaves Chain with only its name
+				r.Table, r.Chain = c.table, chain
+				return r, nil
+			}
+		}
 	}
+	return nil, fmt.Errorf("rule %q not found in chain", comment)
+}
 
+func (c *RealNFTConn) deleteByComment(comment string) error {
+	r, err := c.findRule(comment)
+	if err != nil {
+		return fmt.Errorf("find rule handle: %w", err)
+	}
+	if err := c.conn.DelRule(r); err != nil {
+		return fmt.Errorf("delete rule: %w", err)
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("delete rule: %w", err)
+	}
 	return nil
 }
+
+// Header offsets of the fields rules match on
+const (
+	ipv4SaddrOffset = 12
+	ipv4DaddrOffset = 16
+	ipv6SaddrOffset = 8
+	ipv6DaddrOffset = 24
+	dportOffset     = 2
+)
+
+// ruleExprs builds the expressions for rule, equivalent to
+// "ip saddr <cidr> ip daddr <cidr> tcp dport <port> counter accept", without
+// the daddr match when rule has no destination. Forward rules are prefixed
+// with "iifname <iface>" for direction in, or "oifname <iface>" for out.
+func ruleExprs(rule Rule, iface string) ([]expr.Any, error) {
+	var exprs []expr.Any
+	if rule.Chain == ChainForward {
+		key := expr.MetaKeyIIFNAME
+		if rule.Direction == "out" {
+			key = expr.MetaKeyOIFNAME
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: key, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(iface)},
+		)
+	}
+	if rule.SourceCIDR != "" {
+		prefix, err := netip.ParsePrefix(rule.SourceCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source CIDR %q: %w", rule.SourceCIDR, err)
+		}
+		exprs = append(exprs, sourceExprs(prefix)...)
+	}
+	if rule.DestCIDR != "" {
+		prefix, err := netip.ParsePrefix(rule.DestCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination CIDR %q: %w", rule.DestCIDR, err)
+		}
+		exprs = append(exprs, destExprs(prefix)...)
+	}
+
+	proto := byte(unix.IPPROTO_TCP)
+	if rule.Proto == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+	exprs = append(exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: dportOffset, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(rule.Port))},
+	)
+
+	verdict := expr.VerdictAccept
+	if rule.Action == "deny" {
+		verdict = expr.VerdictDrop
+	}
+	return append(exprs, &expr.Counter{}, &expr.Verdict{Kind: verdict}), nil
+}
+
+// ifname encodes an interface name the way nft compares it: NUL-padded to
+// IFNAMSIZ.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// sourceExprs matches packets from prefix. A /0 prefix only matches the
+// address family, like "ip saddr 0.0.0.0/0" does.
+func sourceExprs(prefix netip.Prefix) []expr.Any {
+	return addrExprs(prefix, ipv4SaddrOffset, ipv6SaddrOffset)
+}
+
+// destExprs matches packets to prefix.
+func destExprs(prefix netip.Prefix) []expr.Any {
+	return addrExprs(prefix, ipv4DaddrOffset, ipv6DaddrOffset)
+}
+
+// addrExprs matches the address at v4Offset or v6Offset in the network
+// header, depending on prefix's family, against prefix.
+func addrExprs(prefix netip.Prefix, v4Offset, v6Offset uint32) []expr.Any {
+	prefix = prefix.Masked()
+	family, offset := byte(unix.NFPROTO_IPV4), v4Offset
+	if prefix.Addr().Is6() && !prefix.Addr().Is4In6() {
+		family, offset = unix.NFPROTO_IPV6, v6Offset
+	}
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	}
+	if prefix.Bits() == 0 {
+		return exprs
+	}
+
+	addr := prefix.Addr().Unmap().AsSlice()
+	exprs = append(exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))})
+	if prefix.Bits() < len(addr)*8 {
+		mask := net.CIDRMask(prefix.Bits(), len(addr)*8)
+		exprs = append(exprs, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(addr)), Mask: mask, Xor: make([]byte, len(addr))})
+	}
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr})
+}
+
+// parseRuleExprs is the inverse of ruleExprs, including the counter's hits.
+// It reports false for expressions ruleExprs does not produce; rules added
+// before hit counting have no counter and parse with zero hits.
+func parseRuleExprs(exprs []expr.Any) (Rule, bool) {
+	rule := Rule{Direction: "in"}
+	var family byte
+	var load expr.Any // the load the next comparison applies to
+	var mask []byte
+	var hasPort, hasVerdict bool
+
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta, *expr.Payload:
+			load, mask = e, nil
+		case *expr.Bitwise:
+			mask = e.Mask
+		case *expr.Cmp:
+			if e.Op != expr.CmpOpEq || !applyCmp(&rule, &family, load, mask, e.Data, &hasPort) {
+				return Rule{}, false
+			}
+			load = nil
+		case *expr.Verdict:
+			switch e.Kind {
+			case expr.VerdictAccept:
+				rule.Action = "allow"
+			case expr.VerdictDrop:
+				rule.Action = "deny"
+			default:
+				return Rule{}, false
+			}
+			hasVerdict = true
+		case *expr.Counter:
+			rule.Packets, rule.Bytes = e.Packets, e.Bytes
+		default:
+			return Rule{}, false
+		}
+	}
+	if !hasPort || !hasVerdict {
+		return Rule{}, false
+	}
+	if rule.SourceCIDR == "" {
+		switch family {
+		case unix.NFPROTO_IPV4:
+			rule.SourceCIDR = "0.0.0.0/0"
+		case unix.NFPROTO_IPV6:
+			rule.SourceCIDR = "::/0"
+		}
+	}
+	return rule, true
+}
+
+// prefixOf returns the prefix an address comparison matches, given the mask
+// applied before it, if any.
+func prefixOf(data, mask []byte) string {
+	addr, _ := netip.AddrFromSlice(data)
+	bits := addr.BitLen()
+	if mask != nil {
+		bits, _ = net.IPMask(mask).Size()
+	}
+	return netip.PrefixFrom(addr, bits).String()
+}
+
+// applyCmp records the value a comparison matches against load in rule.
+func applyCmp(rule *Rule, family *byte, load expr.Any, mask, data []byte, hasPort *bool) bool {
+	switch l := load.(type) {
+	case *expr.Meta:
+		if l.Key == expr.MetaKeyIIFNAME || l.Key == expr.MetaKeyOIFNAME {
+			// The interface is always the WireGuard one; only the direction
+			// is recorded
+			rule.Direction = "in"
+			if l.Key == expr.MetaKeyOIFNAME {
+				rule.Direction = "out"
+			}
+			return true
+		}
+		if len(data) != 1 {
+			return false
+		}
+		switch l.Key {
+		case expr.MetaKeyNFPROTO:
+			*family = data[0]
+		case expr.MetaKeyL4PROTO:
+			switch data[0] {
+			case unix.IPPROTO_TCP:
+				rule.Proto = "tcp"
+			case unix.IPPROTO_UDP:
+				rule.Proto = "udp"
+			default:
+				return false
+			}
+		default:
+			return false
+		}
+	case *expr.Payload:
+		switch {
+		case l.Base == expr.PayloadBaseTransportHeader && l.Offset == dportOffset && len(data) == 2:
+			rule.Port = int(binaryutil.BigEndian.Uint16(data))
+			*hasPort = true
+		case l.Base == expr.PayloadBaseNetworkHeader && (l.Offset == ipv4SaddrOffset && len(data) == 4 || l.Offset == ipv6SaddrOffset && len(data) == 16):
+			rule.SourceCIDR = prefixOf(data, mask)
+		case l.Base == expr.PayloadBaseNetworkHeader && (l.Offset == ipv4DaddrOffset && len(data) == 4 || l.Offset == ipv6DaddrOffset && len(data) == 16):
+			rule.DestCIDR = prefixOf(data, mask)
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
@@ -2,18 +2,31 @@ package firewall
 
 import (
 	"fmt"
+	"net/netip"
+	"slices"
 	"strings"
 	"testing"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
 )
 
 // MockNFTConn implements NFTConn for testing.
 type MockNFTConn struct {
 	rules      map[string]Rule
+	bans       map[string]bool
+	isolated   map[string]bool
+	counters   map[string]RouteCounter
 	initialized bool
 	initErr    error
 	addErr     error
 	deleteErr  error
 	listErr    error
+
+	services map[string]Service
+	chain    ChainOptions // as passed to Init
+
+	upstream map[string]UpstreamRestriction
 }
 
 func NewMockNFTConn() *MockNFTConn {
@@ -22,11 +35,11 @@ func NewMockNFTConn() *MockNFTConn {
 	}
 }
 
-func (m *MockNFTConn) Init() error {
+func (m *MockNFTConn) Init(opts ChainOptions) error {
 	if m.initErr != nil {
 		return m.initErr
 	}
-	m.initialized = true
+	m.initialized, m.chain = true, opts
 	return nil
 }
 
@@ -49,6 +62,122 @@ func (m *MockNFTConn) DeleteRule(id string) error {
 	return nil
 }
 
+func (m *MockNFTConn) ReplaceRule(rule Rule) error {
+	if _, ok := m.rules[rule.ID]; !ok {
+		return fmt.Errorf("rule not found: %s", rule.ID)
+	}
+	m.rules[rule.ID] = rule
+	return nil
+}
+
+func (m *MockNFTConn) AddBan(ip string) error {
+	if m.bans == nil {
+		m.bans = make(map[string]bool)
+	}
+	m.bans[ip] = true
+	return nil
+}
+
+func (m *MockNFTConn) DeleteBan(ip string) error {
+	delete(m.bans, ip)
+	return nil
+}
+
+func (m *MockNFTConn) ListBans() ([]string, error) {
+	var ips []string
+	for ip := range m.bans {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (m *MockNFTConn) AddIsolation(ip string) error {
+	if m.isolated == nil {
+		m.isolated = make(map[string]bool)
+	}
+	m.isolated[ip] = true
+	return nil
+}
+
+func (m *MockNFTConn) DeleteIsolation(ip string) error {
+	delete(m.isolated, ip)
+	return nil
+}
+
+func (m *MockNFTConn) ListIsolated() ([]string, error) {
+	var ips []string
+	for ip := range m.isolated {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (m *MockNFTConn) RestrictUpstream(r UpstreamRestriction) error {
+	if m.upstream == nil {
+		m.upstream = make(map[string]UpstreamRestriction)
+	}
+	m.upstream[r.IP] = r
+	return nil
+}
+
+func (m *MockNFTConn) DeleteUpstreamRestriction(ip string) error {
+	delete(m.upstream, ip)
+	return nil
+}
+
+func (m *MockNFTConn) ListUpstreamRestrictions() (map[string]string, error) {
+	digests := map[string]string{}
+	for ip, r := range m.upstream {
+		digests[ip] = r.Digest()
+	}
+	return digests, nil
+}
+
+func (m *MockNFTConn) AddRouteCounter(c RouteCounter) error {
+	if m.counters == nil {
+		m.counters = make(map[string]RouteCounter)
+	}
+	m.counters[c.Key()] = c
+	return nil
+}
+
+func (m *MockNFTConn) DeleteRouteCounter(key string) error {
+	if _, ok := m.counters[key]; !ok {
+		return fmt.Errorf("route counter not found: %s", key)
+	}
+	delete(m.counters, key)
+	return nil
+}
+
+func (m *MockNFTConn) ListRouteCounters() ([]RouteCounter, error) {
+	var counters []RouteCounter
+	for _, c := range m.counters {
+		counters = append(counters, c)
+	}
+	return counters, nil
+}
+
+func (m *MockNFTConn) AddService(s Service) error {
+	if m.services == nil {
+		m.services = make(map[string]Service)
+	}
+	m.services[s.Name] = s
+	return nil
+}
+
+func (m *MockNFTConn) DeleteService(name string) error {
+	delete(m.services, name)
+	return nil
+}
+
+func (m *MockNFTConn) ListServices() ([]Service, error) {
+	var services []Service
+	for _, s := range m.services {
+		services = append(services, s)
+	}
+	return services, nil
+}
+
 func (m *MockNFTConn) ListRules() ([]Rule, error) {
 	if m.listErr != nil {
 		return nil, m.listErr
@@ -121,8 +250,9 @@ func TestManagerAddRuleInvalidPort(t *testing.T) {
 func TestManagerAddRuleReservedPort(t *testing.T) {
 	mock := NewMockNFTConn()
 	mgr := NewManager(mock)
+	mgr.SetReservedPorts(map[int]bool{2222: true, 2019: true, 7443: true, 51820: true})
 
-	for _, port := range []int{22, 2019, 7443, 51820} {
+	for _, port := range []int{2222, 2019, 7443, 51820} {
 		rule := Rule{ID: "fw_res", Port: port, Proto: "tcp", SourceCIDR: "0.0.0.0/0", Action: "allow"}
 		err := mgr.AddRule(rule)
 		if err == nil {
@@ -132,6 +262,16 @@ func TestManagerAddRuleReservedPort(t *testing.T) {
 			t.Errorf("expected reserved error, got %v", err)
 		}
 	}
+
+	// Ports are only reserved if configured
+	if err := mgr.AddRule(Rule{ID: "fw_ssh", Port: 22, Proto: "tcp", SourceCIDR: "0.0.0.0/0", Action: "allow"}); err != nil {
+		t.Errorf("expected port 22 to be allowed, got %v", err)
+	}
+
+	// Forward rules filter peer traffic, not access to the VPS itself
+	if err := mgr.AddRule(Rule{ID: "fw_fwd", Port: 2222, Proto: "tcp", Chain: ChainForward, Action: "deny"}); err != nil {
+		t.Errorf("expected reserved port to be allowed on the forward chain, got %v", err)
+	}
 }
 
 func TestManagerAddRuleInvalidProto(t *testing.T) {
@@ -167,6 +307,27 @@ func TestManagerAddRuleInvalidAction(t *testing.T) {
 	}
 }
 
+func TestManagerReplaceRule(t *testing.T) {
+	mock := NewMockNFTConn()
+	mgr := NewManager(mock)
+	mgr.SetReservedPorts(map[int]bool{22: true})
+
+	mgr.AddRule(Rule{ID: "fw_1", Port: 8080, Proto: "tcp", SourceCIDR: "0.0.0.0/0", Action: "allow"})
+	if err := mgr.ReplaceRule(Rule{ID: "fw_1", Port: 8080, Proto: "tcp", SourceCIDR: "10.0.0.0/8", Action: "deny"}); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if r := mock.rules["fw_1"]; r.SourceCIDR != "10.0.0.0/8" || r.Action != "deny" {
+		t.Errorf("expected replaced rule, got %+v", r)
+	}
+
+	if err := mgr.ReplaceRule(Rule{ID: "fw_1", Port: 8080, Proto: "tcp", SourceCIDR: "bad"}); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+	if err := mgr.ReplaceRule(Rule{ID: "fw_1", Port: 22, Proto: "tcp"}); err == nil {
+		t.Error("expected error for reserved port")
+	}
+}
+
 func TestManagerDeleteRule(t *testing.T) {
 	mock := NewMockNFTConn()
 	mgr := NewManager(mock)
@@ -229,14 +390,17 @@ func TestValidateRule(t *testing.T) {
 		{"valid udp", Rule{Port: 5000, Proto: "udp", SourceCIDR: "10.0.0.0/8", Action: "deny"}, false},
 		{"port too low", Rule{Port: 0, Proto: "tcp"}, true},
 		{"port too high", Rule{Port: 70000, Proto: "tcp"}, true},
-		{"reserved 22", Rule{Port: 22, Proto: "tcp"}, true},
-		{"reserved 2019", Rule{Port: 2019, Proto: "tcp"}, true},
-		{"reserved 7443", Rule{Port: 7443, Proto: "tcp"}, true},
-		{"reserved 51820", Rule{Port: 51820, Proto: "udp"}, true},
 		{"bad proto", Rule{Port: 8080, Proto: "icmp"}, true},
 		{"bad cidr", Rule{Port: 8080, Proto: "tcp", SourceCIDR: "bad"}, true},
 		{"bad action", Rule{Port: 8080, Proto: "tcp", Action: "reject"}, true},
 		{"bad direction", Rule{Port: 8080, Proto: "tcp", Direction: "both"}, true},
+		{"bad chain", Rule{Port: 8080, Proto: "tcp", Chain: "postrouting"}, true},
+		{"out on output chain", Rule{Port: 80, Proto: "tcp", Chain: ChainOutput, Direction: "out", DestCIDR: "169.254.169.254/32"}, false},
+		{"in on output chain", Rule{Port: 80, Proto: "tcp", Chain: ChainOutput, Direction: "in"}, true},
+		{"bad dest cidr", Rule{Port: 8080, Proto: "tcp", DestCIDR: "bad"}, true},
+		{"mixed families", Rule{Port: 8080, Proto: "tcp", SourceCIDR: "10.0.0.0/8", DestCIDR: "fd00::/8"}, true},
+		{"out on input chain", Rule{Port: 8080, Proto: "tcp", Direction: "out"}, true},
+		{"out on forward chain", Rule{Port: 8080, Proto: "tcp", Chain: ChainForward, Direction: "out"}, false},
 		{"empty cidr ok", Rule{Port: 8080, Proto: "tcp", SourceCIDR: ""}, false},
 		{"empty action ok", Rule{Port: 8080, Proto: "tcp", Action: ""}, false},
 	}
@@ -253,3 +417,331 @@ func TestValidateRule(t *testing.T) {
 		})
 	}
 }
+
+func TestRuleExprsRoundTrip(t *testing.T) {
+	tests := []Rule{
+		{Port: 8080, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow"},
+		{Port: 5000, Proto: "udp", Direction: "in", SourceCIDR: "10.0.0.0/8", Action: "deny"},
+		{Port: 443, Proto: "tcp", Direction: "in", SourceCIDR: "203.0.113.7/32", Action: "allow"},
+		{Port: 443, Proto: "tcp", Direction: "in", SourceCIDR: "2001:db8::/32", Action: "deny"},
+		{Port: 53, Proto: "udp", Direction: "in", SourceCIDR: "::/0", Action: "allow"},
+		{Port: 22000, Proto: "tcp", Direction: "in", Action: "allow"},
+		{Port: 5432, Proto: "tcp", Chain: ChainForward, Direction: "in", SourceCIDR: "10.0.0.5/32", Action: "deny"},
+		{Port: 8080, Proto: "tcp", Chain: ChainForward, Direction: "out", SourceCIDR: "0.0.0.0/0", Action: "allow"},
+		{Port: 443, Proto: "tcp", Chain: ChainForward, Direction: "in", SourceCIDR: "10.0.0.0/24", DestCIDR: "192.168.0.0/16", Action: "deny"},
+		// ListRules sets direction out from the chain
+		{Port: 80, Proto: "tcp", Chain: ChainOutput, Direction: "in", SourceCIDR: "0.0.0.0/0", DestCIDR: "169.254.169.254/32", Action: "deny"},
+		{Port: 53, Proto: "udp", Direction: "in", SourceCIDR: "::/0", DestCIDR: "fd00::/8", Action: "allow"},
+	}
+	for _, want := range tests {
+		exprs, err := ruleExprs(want, "wg0")
+		if err != nil {
+			t.Fatalf("ruleExprs(%+v): %v", want, err)
+		}
+		// The chain comes from where the rule is listed, not its expressions
+		got, ok := parseRuleExprs(exprs)
+		got.Chain = want.Chain
+		if !ok || got != want {
+			t.Errorf("round trip of %+v = %+v, %v", want, got, ok)
+		}
+	}
+
+	// Hits are read from the counter; rules from before counting have none
+	exprs, _ := ruleExprs(tests[0], "wg0")
+	counter := exprs[len(exprs)-2].(*expr.Counter)
+	counter.Packets, counter.Bytes = 12, 3400
+	if got, ok := parseRuleExprs(exprs); !ok || got.Packets != 12 || got.Bytes != 3400 {
+		t.Errorf("expected 12 packets and 3400 bytes, got %+v, %v", got, ok)
+	}
+	uncounted := append(append([]expr.Any{}, exprs[:len(exprs)-2]...), exprs[len(exprs)-1])
+	if hasCounter(uncounted) || !hasCounter(exprs) {
+		t.Error("hasCounter disagrees with the expressions")
+	}
+	if got, ok := parseRuleExprs(uncounted); !ok || got.Packets != 0 {
+		t.Errorf("expected an uncounted rule to parse with no hits, got %+v, %v", got, ok)
+	}
+
+	// Bans carry no port and are not dynamic rules
+	ban := append(sourceExprs(netip.MustParsePrefix("198.51.100.7/32")), &expr.Verdict{Kind: expr.VerdictDrop})
+	if _, ok := parseRuleExprs(ban); ok {
+		t.Error("expected ban expressions not to parse as a rule")
+	}
+}
+
+func TestManagerRouteCounters(t *testing.T) {
+	mock := NewMockNFTConn()
+	mgr := NewManager(mock)
+
+	c := RouteCounter{ID: "route_1", Proto: "tcp", Addr: "::ffff:10.0.0.2", Port: 443}
+	if err := mgr.AddRouteCounter(c); err != nil {
+		t.Fatalf("add route counter: %v", err)
+	}
+	if got := mock.counters["counter:tcp:route_1"]; got.Addr != "10.0.0.2" {
+		t.Errorf("expected the address to be unmapped, got %q", got.Addr)
+	}
+
+	for _, bad := range []RouteCounter{
+		{ID: "route_1", Proto: "icmp", Addr: "10.0.0.2", Port: 443},
+		{ID: "route_1", Proto: "tcp", Addr: "not-an-ip", Port: 443},
+		{ID: "route_1", Proto: "tcp", Addr: "10.0.0.2", Port: 0},
+		{ID: "route_1", Proto: "tcp", Addr: "10.0.0.2", Port: 443, PortEnd: 400},
+		{Proto: "tcp", Addr: "10.0.0.2", Port: 443},
+	} {
+		if err := mgr.AddRouteCounter(bad); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+
+	if err := mgr.DeleteRouteCounter(c.Key()); err != nil {
+		t.Fatalf("delete route counter: %v", err)
+	}
+	if counters, _ := mgr.ListRouteCounters(); len(counters) != 0 {
+		t.Errorf("expected no counters, got %v", counters)
+	}
+}
+
+func TestCounterExprsRoundTrip(t *testing.T) {
+	tests := []RouteCounter{
+		{Proto: "tcp", Addr: "10.0.0.2", Port: 443},
+		{Proto: "udp", Addr: "10.0.0.3", Port: 30000, PortEnd: 30100},
+		{Proto: "tcp", Addr: "fd00::2", Port: 8080},
+	}
+	for _, want := range tests {
+		addr := netip.MustParseAddr(want.Addr)
+		host := netip.PrefixFrom(addr, addr.BitLen())
+		for _, exprs := range [][]expr.Any{
+			counterExprs(sourceExprs(host), want, sportOffset),
+			counterExprs(destExprs(host), want, dportOffset),
+		} {
+			exprs[len(exprs)-1].(*expr.Counter).Bytes = 1234
+			got, bytes, ok := parseCounterExprs(exprs)
+			got.Proto = want.Proto // from the comment, not the expressions
+			if !ok || got != want || bytes != 1234 {
+				t.Errorf("round trip of %+v = %+v, %d, %v", want, got, bytes, ok)
+			}
+		}
+	}
+
+	// Dynamic rules carry no counter
+	rule, _ := ruleExprs(Rule{Port: 443, Proto: "tcp", Action: "allow"}, "wg0")
+	if _, _, ok := parseCounterExprs(rule); ok {
+		t.Error("expected a dynamic rule not to parse as a route counter")
+	}
+}
+
+func TestManagerChainOptions(t *testing.T) {
+	mock := NewMockNFTConn()
+	mgr := NewManager(mock)
+	if mgr.Policy() != PolicyAccept {
+		t.Errorf("expected accept by default, got %q", mgr.Policy())
+	}
+
+	ssh := Service{Name: "ssh", Proto: "tcp", Port: 22}
+	mgr.SetChainOptions(ChainOptions{Policy: PolicyDrop, Priority: -10, Services: []Service{ssh}})
+	if err := mgr.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if mock.chain.Policy != PolicyDrop || mock.chain.Priority != -10 || len(mock.chain.Services) != 1 {
+		t.Errorf("chain options not passed to Init: %+v", mock.chain)
+	}
+	if mgr.Policy() != PolicyDrop || len(mgr.Services()) != 1 {
+		t.Errorf("unexpected policy %q and services %v", mgr.Policy(), mgr.Services())
+	}
+
+	if err := mgr.AddService(RouteService("tcp", 30000, 30100)); err != nil {
+		t.Fatalf("add service: %v", err)
+	}
+	if _, ok := mock.services["tcp/30000-30100"]; !ok {
+		t.Errorf("expected service tcp/30000-30100, got %v", mock.services)
+	}
+	for _, bad := range []Service{
+		{Name: "", Proto: "tcp", Port: 80},
+		{Name: "web ui", Proto: "tcp", Port: 80},
+		{Name: "dns", Proto: "icmp", Port: 53},
+		{Name: "web", Proto: "tcp", Port: 0},
+		{Name: "games", Proto: "udp", Port: 3000, PortEnd: 2000},
+	} {
+		if err := mgr.AddService(bad); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+	if err := ValidatePolicy("reject"); err == nil {
+		t.Error("expected error for policy reject")
+	}
+}
+
+func TestRedirectExprs(t *testing.T) {
+	exprs := redirectExprs(Redirect{Port: 443, ToPort: 51820})
+	if len(exprs) != 6 {
+		t.Fatalf("expected 6 expressions, got %d", len(exprs))
+	}
+	if cmp := exprs[3].(*expr.Cmp); binaryutil.BigEndian.Uint16(cmp.Data) != 443 {
+		t.Errorf("expected a match on port 443, got %v", cmp.Data)
+	}
+	if imm := exprs[4].(*expr.Immediate); binaryutil.BigEndian.Uint16(imm.Data) != 51820 {
+		t.Errorf("expected a redirect to 51820, got %v", imm.Data)
+	}
+	if redir, ok := exprs[5].(*expr.Redir); !ok || redir.RegisterProtoMin != 1 {
+		t.Errorf("expected a redirect to the port in register 1, got %+v", exprs[5])
+	}
+	if got := redirectComment(Redirect{Port: 443, ToPort: 51820}); got != "redirect:udp/443" {
+		t.Errorf("unexpected comment %q", got)
+	}
+	if _, ok := parseRuleExprs(exprs); ok {
+		t.Error("expected a redirect not to parse as a rule")
+	}
+}
+
+func TestBlockedRanges(t *testing.T) {
+	tests := []struct {
+		allowed []PortRange
+		want    []PortRange
+	}{
+		{[]PortRange{{443, 443}}, []PortRange{{1, 442}, {444, 65535}}},
+		{[]PortRange{{8000, 8099}, {22, 22}, {8050, 8200}}, []PortRange{{1, 21}, {23, 7999}, {8201, 65535}}},
+		{[]PortRange{{1, 1024}, {60000, 65535}}, []PortRange{{1025, 59999}}},
+		{[]PortRange{{1, 65535}}, nil},
+	}
+	for _, tt := range tests {
+		if got := blockedRanges(tt.allowed); !slices.Equal(got, tt.want) {
+			t.Errorf("blockedRanges(%v) = %v, want %v", tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestManagerUpstreamRestrictions(t *testing.T) {
+	conn := NewMockNFTConn()
+	mgr := NewManager(conn)
+
+	r := UpstreamRestriction{IP: "10.0.0.2", Dests: []string{"10.0.0.2/32", "192.168.1.0/24"}, Allowed: []PortRange{{443, 443}}}
+	if err := mgr.RestrictUpstream(r); err != nil {
+		t.Fatalf("restrict upstream: %v", err)
+	}
+	for _, bad := range []UpstreamRestriction{
+		{IP: "nope", Dests: []string{"10.0.0.3/32"}, Allowed: []PortRange{{443, 443}}},
+		{IP: "10.0.0.3", Dests: []string{"10.0.0.3"}, Allowed: []PortRange{{443, 443}}},
+		{IP: "10.0.0.3", Dests: []string{"10.0.0.3/32"}},
+		{IP: "10.0.0.3", Dests: []string{"10.0.0.3/32"}, Allowed: []PortRange{{0, 443}}},
+	} {
+		if err := mgr.RestrictUpstream(bad); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+	digests, _ := mgr.ListUpstreamRestrictions()
+	if len(digests) != 1 || digests["10.0.0.2"] != r.Digest() {
+		t.Errorf("unexpected restrictions %v", digests)
+	}
+	if comment := upstreamComment(r); !internalComment(comment) {
+		t.Errorf("expected %q to be an internal comment", comment)
+	} else if ip, digest, ok := parseUpstreamComment(comment); !ok || ip != "10.0.0.2" || digest != r.Digest() {
+		t.Errorf("unexpected parse of %q: %q %q %v", comment, ip, digest, ok)
+	}
+	if err := mgr.LiftUpstreamRestriction("10.0.0.2"); err != nil {
+		t.Fatalf("lift upstream restriction: %v", err)
+	}
+	if digests, _ := mgr.ListUpstreamRestrictions(); len(digests) != 0 {
+		t.Errorf("expected no restrictions, got %v", digests)
+	}
+}
+
+func TestRouteService(t *testing.T) {
+	if s := RouteService("tcp", 443, 0); s.Name != "tcp/443" || s.PortEnd != 0 {
+		t.Errorf("unexpected single-port service %+v", s)
+	}
+	if s := RouteService("udp", 443, 443); s.Name != "udp/443" || s.PortEnd != 0 {
+		t.Errorf("expected a one-port range to be a single port, got %+v", s)
+	}
+	if s := RouteService("udp", 30000, 30100); s.Name != "udp/30000-30100" || s.PortEnd != 30100 {
+		t.Errorf("unexpected range service %+v", s)
+	}
+}
+
+func TestServiceExprsRoundTrip(t *testing.T) {
+	for _, want := range []Service{
+		{Proto: "tcp", Port: 22},
+		{Proto: "udp", Port: 51820},
+		{Proto: "tcp", Port: 30000, PortEnd: 30100},
+	} {
+		exprs := serviceExprs(want)
+		got, ok := parseServiceExprs(exprs)
+		if !ok || got != want {
+			t.Errorf("round trip of %+v = %+v, %v", want, got, ok)
+		}
+		if verdictOf(exprs) != expr.VerdictAccept {
+			t.Errorf("expected service %+v to accept", want)
+		}
+	}
+
+	// Policy rules are neither services nor dynamic rules
+	if _, ok := parseServiceExprs(establishedExprs()); ok {
+		t.Error("expected established expressions not to parse as a service")
+	}
+	if _, ok := parseRuleExprs(establishedExprs()); ok {
+		t.Error("expected established expressions not to parse as a rule")
+	}
+	for _, m := range baseICMP {
+		exprs := icmpExprs(m.proto, m.typ)
+		if _, ok := parseServiceExprs(exprs); ok {
+			t.Errorf("expected %s not to parse as a service", m.name)
+		}
+		if _, ok := parseRuleExprs(exprs); ok {
+			t.Errorf("expected %s not to parse as a rule", m.name)
+		}
+	}
+	for _, comment := range []string{"service:ssh", "base:established", "ban:198.51.100.7", "isolate:10.0.0.2"} {
+		if !internalComment(comment) {
+			t.Errorf("expected %q to be internal", comment)
+		}
+	}
+	if internalComment("fw_rule_001") {
+		t.Error("expected fw_rule_001 to be a dynamic rule")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	set := Ruleset{
+		Rules: []Rule{
+			{ID: "deny_db", Port: 5432, Proto: "tcp", SourceCIDR: "203.0.113.0/24", Action: "deny"},
+			{ID: "deny_meta", Port: 80, Proto: "tcp", Chain: ChainForward, DestCIDR: "169.254.169.254/32", Action: "deny"},
+			{ID: "allow_db", Port: 5432, Proto: "tcp", SourceCIDR: "0.0.0.0/0", Action: "allow"},
+			{ID: "allow_db6", Port: 5432, Proto: "tcp", SourceCIDR: "::/0", Action: "allow"},
+		},
+		Bans:     []string{"198.51.100.7"},
+		Isolated: []string{"10.0.0.9"},
+	}
+	services := []Service{{Name: "ssh", Proto: "tcp", Port: 22}, RouteService("udp", 27015, 27016)}
+	addr := netip.MustParseAddr
+	for _, tc := range []struct {
+		name   string
+		packet Packet
+		drop   bool // with FIREWALL_POLICY=drop
+		accept bool
+		match  string
+		detail string // rule ID, or the verdict's detail
+	}{
+		{"deny rule", Packet{Source: addr("203.0.113.5"), Port: 5432, Proto: "tcp"}, false, false, MatchRule, "deny_db"},
+		{"allow rule", Packet{Source: addr("192.0.2.1"), Port: 5432, Proto: "tcp"}, true, true, MatchRule, "allow_db"},
+		{"allow rule v6", Packet{Source: addr("2001:db8::1"), Port: 5432, Proto: "tcp"}, true, true, MatchRule, "allow_db6"},
+		{"ban", Packet{Source: addr("198.51.100.7"), Port: 5432, Proto: "tcp"}, false, false, MatchBan, "198.51.100.7"},
+		{"accept policy", Packet{Source: addr("192.0.2.1"), Port: 8080, Proto: "tcp"}, false, true, MatchPolicy, PolicyAccept},
+		{"drop policy", Packet{Source: addr("192.0.2.1"), Port: 8080, Proto: "tcp"}, true, false, MatchPolicy, PolicyDrop},
+		{"service", Packet{Source: addr("192.0.2.1"), Port: 27016, Proto: "udp"}, true, true, MatchService, "udp/27015-27016"},
+		{"loopback", Packet{Source: addr("127.0.0.1"), Port: 8080, Proto: "tcp"}, true, true, MatchLoopback, ""},
+		{"isolated peer", Packet{Chain: ChainForward, Source: addr("10.0.0.9"), Port: 22, Proto: "tcp"}, false, false, MatchIsolation, "10.0.0.9"},
+		{"egress", Packet{Chain: ChainForward, Source: addr("10.0.0.2"), Dest: addr("169.254.169.254"), Port: 80, Proto: "tcp"}, false, false, MatchRule, "deny_meta"},
+		{"egress without dest", Packet{Chain: ChainForward, Source: addr("10.0.0.2"), Port: 80, Proto: "tcp"}, false, true, MatchPolicy, PolicyAccept},
+	} {
+		set := set
+		if tc.drop {
+			set.Options = ChainOptions{Policy: PolicyDrop, Services: services}
+		}
+		v := Simulate(tc.packet, set)
+		detail := v.Detail
+		if v.Rule != nil {
+			detail = v.Rule.ID
+		}
+		if v.Accept != tc.accept || v.Match != tc.match || detail != tc.detail {
+			t.Errorf("%s: got accept %v, %s %q; want %v, %s %q", tc.name, v.Accept, v.Match, detail, tc.accept, tc.match, tc.detail)
+		}
+	}
+}
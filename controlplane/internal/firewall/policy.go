@@ -0,0 +1,409 @@
+package firewall
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// Verdicts for packets no rule of a dynamic chain decides on.
+const (
+	PolicyAccept = "accept" // only deny rules and bans have an effect
+	PolicyDrop   = "drop"   // default deny: only services and allow rules get through
+)
+
+// ChainOptions configures the dynamic base chains.
+type ChainOptions struct {
+	Policy        string // PolicyAccept (the default when empty) or PolicyDrop, for dynamic-api-rules
+	ForwardPolicy string // the same, for dynamic-api-forward
+	Priority      int    // hook priority of the dynamic chains; 0 is the filter priority
+	// Services stay open when Policy is PolicyDrop. They are installed by
+	// Init in the transaction that sets the policy, so the host is never
+	// cut off between the two.
+	Services []Service
+	// Redirects are installed by Init in the dynamic-api-redirect chain,
+	// replacing those of the previous start, whatever the policy.
+	Redirects []Redirect
+}
+
+func (o ChainOptions) dropInput() bool   { return o.Policy == PolicyDrop }
+func (o ChainOptions) dropForward() bool { return o.ForwardPolicy == PolicyDrop }
+
+// ValidatePolicy checks that policy is a chain policy; empty means accept.
+func ValidatePolicy(policy string) error {
+	if policy != "" && policy != PolicyAccept && policy != PolicyDrop {
+		return fmt.Errorf("policy must be accept or drop, got %q", policy)
+	}
+	return nil
+}
+
+// Service is a port on the VPS that the input chain accepts when its policy
+// is drop: a management port, or the listen port of a route.
+type Service struct {
+	Name    string // "ssh", "api", ... or "tcp/443" for route listen ports
+	Proto   string // "tcp" or "udp"
+	Port    int
+	PortEnd int // last port of a range, or 0
+}
+
+// RouteService returns the service of a route listen port or range. Routes
+// sharing a port share the service.
+func RouteService(proto string, port, portEnd int) Service {
+	name := fmt.Sprintf("%s/%d", proto, port)
+	if portEnd > port {
+		name = fmt.Sprintf("%s-%d", name, portEnd)
+	} else {
+		portEnd = 0
+	}
+	return Service{Name: name, Proto: proto, Port: port, PortEnd: portEnd}
+}
+
+// ValidateService checks that a service is well-formed.
+func ValidateService(s Service) error {
+	if s.Name == "" || strings.ContainsAny(s.Name, " \t\n") {
+		return fmt.Errorf("invalid service name %q", s.Name)
+	}
+	if s.Proto != "tcp" && s.Proto != "udp" {
+		return fmt.Errorf("protocol must be tcp or udp, got %q", s.Proto)
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", s.Port)
+	}
+	if s.PortEnd != 0 && (s.PortEnd < s.Port || s.PortEnd > 65535) {
+		return fmt.Errorf("port range end %d must be between %d and 65535", s.PortEnd, s.Port)
+	}
+	return nil
+}
+
+// SetChainOptions sets the policy and priority Init gives the dynamic
+// chains, and the services kept open under a drop policy.
+func (m *Manager) SetChainOptions(opts ChainOptions) {
+	m.chain = opts
+}
+
+// Policy returns the policy of the input chain.
+func (m *Manager) Policy() string {
+	if m.chain.Policy == "" {
+		return PolicyAccept
+	}
+	return m.chain.Policy
+}
+
+// Options returns the options set with SetChainOptions.
+func (m *Manager) Options() ChainOptions {
+	opts := m.chain
+	opts.Services = m.Services()
+	return opts
+}
+
+// Services returns the management services configured with
+// SetChainOptions.
+func (m *Manager) Services() []Service {
+	return append([]Service(nil), m.chain.Services...)
+}
+
+// AddService opens a service in the input chain.
+func (m *Manager) AddService(s Service) error {
+	if err := ValidateService(s); err != nil {
+		return fmt.Errorf("invalid service: %w", err)
+	}
+	return m.conn.AddService(s)
+}
+
+// DeleteService closes the service with the given name.
+func (m *Manager) DeleteService(name string) error {
+	return m.conn.DeleteService(name)
+}
+
+// ListServices returns the services open in the input chain.
+func (m *Manager) ListServices() ([]Service, error) {
+	return m.conn.ListServices()
+}
+
+// Comment prefixes of the accept rules a drop policy needs.
+const (
+	servicePrefix = "service:"
+	basePrefix    = "base:" // connection tracking and loopback
+)
+
+// internalComment reports whether a rule with comment was added for a ban,
+// isolation, upstream restriction, service, or policy rather than by the API.
+func internalComment(comment string) bool {
+	for _, prefix := range []string{banPrefix, isolatePrefix, upstreamPrefix, servicePrefix, basePrefix} {
+		if strings.HasPrefix(comment, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyRule is an accept rule a drop policy needs.
+type policyRule struct {
+	chain   *nftables.Chain
+	comment string
+	exprs   []expr.Any
+}
+
+// baseICMP lists the ICMP messages a drop policy still accepts: echo
+// requests and unreachables, and on IPv6 packet-too-big and neighbour and
+// router discovery, without which the host loses its IPv6 connectivity.
+var baseICMP = []struct {
+	name  string
+	proto byte
+	typ   byte
+}{
+	{"icmp-echo", unix.IPPROTO_ICMP, 8},
+	{"icmp-unreachable", unix.IPPROTO_ICMP, 3},
+	{"icmpv6-echo", unix.IPPROTO_ICMPV6, 128},
+	{"icmpv6-unreachable", unix.IPPROTO_ICMPV6, 1},
+	{"icmpv6-too-big", unix.IPPROTO_ICMPV6, 2},
+	{"icmpv6-router-advert", unix.IPPROTO_ICMPV6, 134},
+	{"icmpv6-neighbor-solicit", unix.IPPROTO_ICMPV6, 135},
+	{"icmpv6-neighbor-advert", unix.IPPROTO_ICMPV6, 136},
+}
+
+// policyRules returns the rules that keep a drop policy from cutting off
+// replies, loopback traffic, essential ICMP, and the services in opts.
+func (c *RealNFTConn) policyRules(opts ChainOptions) []policyRule {
+	var rules []policyRule
+	if opts.dropInput() {
+		rules = append(rules,
+			policyRule{c.input, basePrefix + "established", establishedExprs()},
+			policyRule{c.input, basePrefix + "loopback", []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname("lo")},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			}},
+		)
+		for _, m := range baseICMP {
+			rules = append(rules, policyRule{c.input, basePrefix + m.name, icmpExprs(m.proto, m.typ)})
+		}
+		for _, s := range opts.Services {
+			rules = append(rules, policyRule{c.input, servicePrefix + s.Name, serviceExprs(s)})
+		}
+	}
+	if opts.dropForward() {
+		rules = append(rules, policyRule{c.forward, basePrefix + "established", establishedExprs()})
+	}
+	return rules
+}
+
+// establishedExprs accepts packets of known connections, like
+// "ct state established,related accept".
+func establishedExprs() []expr.Any {
+	state := binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED)
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: state, Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}
+}
+
+// icmpExprs accepts one ICMP or ICMPv6 message type, like
+// "meta l4proto icmpv6 icmpv6 type nd-neighbor-solicit accept".
+func icmpExprs(proto, typ byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{typ}},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}
+}
+
+// checkPriority returns an error if a dynamic chain already exists with
+// another priority, which the kernel cannot change in place.
+func (c *RealNFTConn) checkPriority(priority int) error {
+	chains, err := c.conn.ListChainsOfTableFamily(c.table.Family)
+	if err != nil {
+		return fmt.Errorf("list chains: %w", err)
+	}
+	for _, ch := range chains {
+		if ch.Table.Name != c.table.Name || !slices.ContainsFunc(c.ruleChains(), func(r *nftables.Chain) bool { return r.Name == ch.Name }) || ch.Priority == nil {
+			continue
+		}
+		if int(*ch.Priority) != priority {
+			return fmt.Errorf("chain %s has priority %d, not %d; delete it to change the priority", ch.Name, *ch.Priority, priority)
+		}
+	}
+	return nil
+}
+
+// orderDenies moves drop rules that follow an accept rule of the control
+// plane to the head of their chain, in one transaction, so deny rules and
+// bans win over allow rules added before them. Chains written by older
+// versions appended deny rules in creation order.
+func (c *RealNFTConn) orderDenies() error {
+	var moved bool
+	for _, chain := range c.ruleChains() {
+		rules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return fmt.Errorf("list %s rules: %w", chain.Name, err)
+		}
+		var accepted bool
+		for _, r := range rules {
+			comment, ok := userdata.GetString(r.UserData, userdata.TypeComment)
+			if !ok || comment == "" {
+				continue
+			}
+			switch verdictOf(r.Exprs) {
+			case expr.VerdictAccept:
+				accepted = true
+			case expr.VerdictDrop:
+				if !accepted {
+					continue
+				}
+				r.Table, r.Chain = c.table, chain
+				c.conn.InsertRule(c.newRule(chain, comment, r.Exprs))
+				if err := c.conn.DelRule(r); err != nil {
+					return fmt.Errorf("move %s: %w", comment, err)
+				}
+				moved = true
+			}
+		}
+	}
+	if !moved {
+		return nil
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("order deny rules: %w", err)
+	}
+	return nil
+}
+
+// verdictOf returns the verdict a rule ends with, or -1 if it has none.
+func verdictOf(exprs []expr.Any) expr.VerdictKind {
+	if len(exprs) == 0 {
+		return -1
+	}
+	if v, ok := exprs[len(exprs)-1].(*expr.Verdict); ok {
+		return v.Kind
+	}
+	return -1
+}
+
+// AddService appends an accept rule for s to the input chain, commented
+// "service:<name>". Being an accept rule, it comes after every deny rule.
+func (c *RealNFTConn) AddService(s Service) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.AddRule(c.newRule(c.input, servicePrefix+s.Name, serviceExprs(s)))
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("add service: %w", err)
+	}
+	return nil
+}
+
+// DeleteService removes the accept rule of the named service.
+func (c *RealNFTConn) DeleteService(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.deleteByComment(servicePrefix + name)
+}
+
+// ListServices returns the services open in the input chain.
+func (c *RealNFTConn) ListServices() ([]Service, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rules, err := c.conn.GetRules(c.table, c.input)
+	if err != nil {
+		return nil, fmt.Errorf("list services: %w", err)
+	}
+	var services []Service
+	for _, r := range rules {
+		comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+		name, ok := strings.CutPrefix(comment, servicePrefix)
+		if !ok {
+			continue
+		}
+		s, ok := parseServiceExprs(r.Exprs)
+		if !ok {
+			continue
+		}
+		s.Name = name
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// serviceExprs builds "meta l4proto <proto> th dport <ports> accept".
+func serviceExprs(s Service) []expr.Any {
+	proto := byte(unix.IPPROTO_TCP)
+	if s.Proto == "udp" {
+		proto = unix.IPPROTO_UDP
+	}
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: dportOffset, Len: 2},
+	}
+	if s.PortEnd > s.Port {
+		exprs = append(exprs, &expr.Range{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			FromData: binaryutil.BigEndian.PutUint16(uint16(s.Port)),
+			ToData:   binaryutil.BigEndian.PutUint16(uint16(s.PortEnd)),
+		})
+	} else {
+		exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(s.Port))})
+	}
+	return append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+}
+
+// parseServiceExprs is the inverse of serviceExprs, without the name.
+func parseServiceExprs(exprs []expr.Any) (Service, bool) {
+	var (
+		s    Service
+		load expr.Any
+	)
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta, *expr.Payload:
+			load = e
+		case *expr.Cmp:
+			switch l := load.(type) {
+			case *expr.Meta:
+				if l.Key != expr.MetaKeyL4PROTO || len(e.Data) != 1 {
+					return Service{}, false
+				}
+				switch e.Data[0] {
+				case unix.IPPROTO_TCP:
+					s.Proto = "tcp"
+				case unix.IPPROTO_UDP:
+					s.Proto = "udp"
+				default:
+					return Service{}, false
+				}
+			case *expr.Payload:
+				if len(e.Data) != 2 {
+					return Service{}, false
+				}
+				s.Port = int(binaryutil.BigEndian.Uint16(e.Data))
+			}
+		case *expr.Range:
+			if len(e.FromData) != 2 || len(e.ToData) != 2 {
+				return Service{}, false
+			}
+			s.Port = int(binaryutil.BigEndian.Uint16(e.FromData))
+			s.PortEnd = int(binaryutil.BigEndian.Uint16(e.ToData))
+		case *expr.Verdict:
+			if e.Kind != expr.VerdictAccept {
+				return Service{}, false
+			}
+		}
+	}
+	if s.Proto == "" || s.Port == 0 {
+		return Service{}, false
+	}
+	return s, true
+}
@@ -0,0 +1,40 @@
+package firewall
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Redirect sends UDP packets arriving on one port of the VPS to another
+// local port, so WireGuard answers on extra ports, such as 443 on networks
+// that only let well-known ports out. Connection tracking rewrites the
+// replies, so clients see them come from the port they sent to.
+type Redirect struct {
+	Port   int // port clients send to
+	ToPort int // port the packets are delivered to
+}
+
+// redirectPrefix is the comment prefix of redirect rules, as in
+// "redirect:udp/443".
+const redirectPrefix = "redirect:"
+
+// redirectComment identifies the rule of a redirect.
+func redirectComment(r Redirect) string {
+	return fmt.Sprintf("%sudp/%d", redirectPrefix, r.Port)
+}
+
+// redirectExprs redirects UDP packets sent to r.Port to r.ToPort, like
+// "udp dport 443 redirect to :51820".
+func redirectExprs(r Redirect) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: dportOffset, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(r.Port))},
+		&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(r.ToPort))},
+		&expr.Redir{RegisterProtoMin: 1},
+	}
+}
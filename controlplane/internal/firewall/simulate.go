@@ -0,0 +1,151 @@
+package firewall
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// Packet is the first packet of a connection, as Simulate evaluates it.
+type Packet struct {
+	Chain     string // ChainInput (the default when empty), ChainForward, or ChainOutput
+	Direction string // "in" or "out", as for rules; defaults to the chain's
+	Source    netip.Addr
+	Dest      netip.Addr // optional; without it, rules with a DestCIDR do not match
+	Port      int
+	Proto     string
+}
+
+// Ruleset is what Simulate evaluates a packet against.
+type Ruleset struct {
+	Rules    []Rule   // API rules in chain order
+	Bans     []string // banned source IPs
+	Isolated []string // VPN IPs of isolated peers
+	// Options holds the chain policies, and the services a drop input
+	// policy accepts.
+	Options ChainOptions
+}
+
+// Outcomes of Simulate, naming what decided on the packet.
+const (
+	MatchRule      = "rule"
+	MatchBan       = "ban"
+	MatchIsolation = "isolation"
+	MatchService   = "service"
+	MatchLoopback  = "loopback"
+	MatchPolicy    = "policy"
+)
+
+// Verdict is what Simulate decided on a packet, and why.
+type Verdict struct {
+	Accept bool
+	Match  string // one of the Match constants
+	Rule   *Rule  // the deciding rule, for MatchRule
+	Detail string // the banned or isolated IP, the service name, or the policy
+}
+
+// Simulate evaluates p the way the dynamic chains would: drop rules (bans,
+// isolation, and deny rules) come before every accept rule, so the first
+// matching drop rule decides, then the first matching accept rule, then
+// the chain policy. Connection tracking is not simulated; p is taken to
+// open a new connection.
+func Simulate(p Packet, set Ruleset) Verdict {
+	chain := p.Chain
+	if chain == "" {
+		chain = ChainInput
+	}
+	direction := p.Direction
+	if direction == "" {
+		direction = "in"
+		if chain == ChainOutput {
+			direction = "out"
+		}
+	}
+	source, dest := p.Source.Unmap(), p.Dest.Unmap()
+
+	switch {
+	case chain == ChainInput && slices.ContainsFunc(set.Bans, sameAddr(source)):
+		return Verdict{Match: MatchBan, Detail: source.String()}
+	case chain == ChainForward && direction == "in" && slices.ContainsFunc(set.Isolated, sameAddr(source)):
+		return Verdict{Match: MatchIsolation, Detail: source.String()}
+	case chain == ChainForward && direction == "out" && dest.IsValid() && slices.ContainsFunc(set.Isolated, sameAddr(dest)):
+		return Verdict{Match: MatchIsolation, Detail: dest.String()}
+	}
+
+	var accept *Rule
+	for i := range set.Rules {
+		rule := &set.Rules[i]
+		if !rule.matches(chain, direction, source, dest, p.Port, p.Proto) {
+			continue
+		}
+		if rule.Action == "deny" {
+			return Verdict{Match: MatchRule, Rule: rule}
+		}
+		if accept == nil {
+			accept = rule
+		}
+	}
+
+	policy := PolicyAccept
+	switch chain {
+	case ChainInput:
+		if set.Options.dropInput() {
+			policy = PolicyDrop
+			if source.IsLoopback() {
+				return Verdict{Accept: true, Match: MatchLoopback}
+			}
+			for _, s := range set.Options.Services {
+				if s.Proto == p.Proto && p.Port >= s.Port && p.Port <= max(s.Port, s.PortEnd) {
+					return Verdict{Accept: true, Match: MatchService, Detail: s.Name}
+				}
+			}
+		}
+	case ChainForward:
+		if set.Options.dropForward() {
+			policy = PolicyDrop
+		}
+	}
+	if accept != nil {
+		return Verdict{Accept: true, Match: MatchRule, Rule: accept}
+	}
+	return Verdict{Accept: policy == PolicyAccept, Match: MatchPolicy, Detail: policy}
+}
+
+// matches reports whether the rule matches a packet of the given chain and
+// direction, like its nftables expressions do.
+func (r *Rule) matches(chain, direction string, source, dest netip.Addr, port int, proto string) bool {
+	ruleChain, ruleDirection := r.Chain, r.Direction
+	if ruleChain == "" {
+		ruleChain = ChainInput
+	}
+	if ruleDirection == "" {
+		ruleDirection = "in"
+		if ruleChain == ChainOutput {
+			ruleDirection = "out"
+		}
+	}
+	if ruleChain != chain || ruleDirection != direction || r.Port != port || r.Proto != proto {
+		return false
+	}
+	if r.SourceCIDR != "" && !prefixContains(r.SourceCIDR, source) {
+		return false
+	}
+	return r.DestCIDR == "" || prefixContains(r.DestCIDR, dest)
+}
+
+// prefixContains reports whether addr is valid and within cidr. A /0 prefix
+// only holds addresses of its family, as in nftables.
+func prefixContains(cidr string, addr netip.Addr) bool {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil || !addr.IsValid() {
+		return false
+	}
+	return prefix.Contains(addr)
+}
+
+// sameAddr returns a func reporting whether an IP string is addr.
+func sameAddr(addr netip.Addr) func(string) bool {
+	return func(ip string) bool {
+		parsed, err := netip.ParseAddr(ip)
+		return err == nil && parsed.Unmap() == addr
+	}
+}
@@ -0,0 +1,273 @@
+package firewall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start int
+	End   int
+}
+
+// UpstreamRestriction limits the connections the VPS and other peers may
+// open to a peer, and to the LAN behind it, to some ports, so routes cannot
+// expose anything else through it. Replies, and connections the peer opens
+// itself, are not affected.
+type UpstreamRestriction struct {
+	IP      string      // VPN IP of the peer, which identifies the restriction
+	Dests   []string    // prefixes covered: the VPN IP and the peer's advertised routes
+	Allowed []PortRange // ports that stay reachable
+}
+
+// Digest identifies the contents of r, so an outdated restriction can be
+// told from the one in nftables.
+func (r UpstreamRestriction) Digest() string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(r.IP, r.Dests, r.Allowed)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// ValidateUpstreamRestriction checks that an upstream restriction is
+// well-formed.
+func ValidateUpstreamRestriction(r UpstreamRestriction) error {
+	if _, err := netip.ParseAddr(r.IP); err != nil {
+		return fmt.Errorf("invalid peer address %q: %w", r.IP, err)
+	}
+	for _, d := range r.Dests {
+		if _, err := netip.ParsePrefix(d); err != nil {
+			return fmt.Errorf("invalid destination %q: %w", d, err)
+		}
+	}
+	if len(r.Allowed) == 0 {
+		return fmt.Errorf("at least one allowed port range is required")
+	}
+	for _, p := range r.Allowed {
+		if p.Start < 1 || p.End > 65535 || p.Start > p.End {
+			return fmt.Errorf("invalid port range %d-%d", p.Start, p.End)
+		}
+	}
+	return nil
+}
+
+// RestrictUpstream drops new connections to the destinations of r on ports
+// outside r.Allowed, replacing any restriction of the same peer.
+func (m *Manager) RestrictUpstream(r UpstreamRestriction) error {
+	if err := ValidateUpstreamRestriction(r); err != nil {
+		return fmt.Errorf("invalid upstream restriction: %w", err)
+	}
+	addr, _ := netip.ParseAddr(r.IP)
+	r.IP = addr.Unmap().String()
+	return m.conn.RestrictUpstream(r)
+}
+
+// LiftUpstreamRestriction removes the restriction of the peer with VPN
+// address ip.
+func (m *Manager) LiftUpstreamRestriction(ip string) error {
+	return m.conn.DeleteUpstreamRestriction(ip)
+}
+
+// ListUpstreamRestrictions returns the Digest of each restriction in
+// nftables, by peer VPN address.
+func (m *Manager) ListUpstreamRestrictions() (map[string]string, error) {
+	return m.conn.ListUpstreamRestrictions()
+}
+
+const upstreamPrefix = "upstream:"
+
+// upstreamComment tags the rules of r as "upstream:<ip>/<digest>".
+func upstreamComment(r UpstreamRestriction) string {
+	return upstreamPrefix + r.IP + "/" + r.Digest()
+}
+
+// blockedRanges returns the ports outside allowed, in order.
+func blockedRanges(allowed []PortRange) []PortRange {
+	sorted := slices.Clone(allowed)
+	slices.SortFunc(sorted, func(a, b PortRange) int { return a.Start - b.Start })
+	var blocked []PortRange
+	next := 1
+	for _, p := range sorted {
+		if p.Start > next {
+			blocked = append(blocked, PortRange{Start: next, End: p.Start - 1})
+		}
+		next = max(next, p.End+1)
+	}
+	if next <= 65535 {
+		blocked = append(blocked, PortRange{Start: next, End: 65535})
+	}
+	return blocked
+}
+
+// upstreamSets returns the constant sets matched by the restriction rules:
+// the TCP and UDP protocols, and the intervals of blocked ports. Anonymous
+// sets are bound to the rule using them, so each rule needs its own pair,
+// and deleting the rule deletes them.
+func (c *RealNFTConn) upstreamSets(blocked []PortRange) (protos, ports *nftables.Set, err error) {
+	protos = &nftables.Set{Table: c.table, Anonymous: true, Constant: true, KeyType: nftables.TypeInetProto}
+	if err := c.conn.AddSet(protos, []nftables.SetElement{
+		{Key: []byte{unix.IPPROTO_TCP}},
+		{Key: []byte{unix.IPPROTO_UDP}},
+	}); err != nil {
+		return nil, nil, err
+	}
+	var elems []nftables.SetElement
+	for _, b := range blocked {
+		elems = append(elems, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(uint16(b.Start))})
+		// an interval reaching the last port is left open
+		if b.End < 65535 {
+			elems = append(elems, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(uint16(b.End + 1)), IntervalEnd: true})
+		}
+	}
+	ports = &nftables.Set{Table: c.table, Anonymous: true, Constant: true, Interval: true, KeyType: nftables.TypeInetService}
+	if err := c.conn.AddSet(ports, elems); err != nil {
+		return nil, nil, err
+	}
+	return protos, ports, nil
+}
+
+// upstreamExprs drops new connections leaving through iface to dest on the
+// ports of the ports set, like "oifname wg0 ip daddr 10.0.0.2 meta l4proto
+// { tcp, udp } th dport { 1-442, 444-65535 } ct state new drop".
+func upstreamExprs(iface string, dest netip.Prefix, protos, ports *nftables.Set) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(iface)},
+	}
+	exprs = append(exprs, destExprs(dest)...)
+	return append(exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Lookup{SourceRegister: 1, SetName: protos.Name, SetID: protos.ID},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: dportOffset, Len: 2},
+		&expr.Lookup{SourceRegister: 1, SetName: ports.Name, SetID: ports.ID},
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitNEW), Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+}
+
+// RestrictUpstream inserts drop rules at the head of the output chain, for
+// Caddy's connections, and of the forward chain, for other peers', one per
+// destination, matching the blocked ports with a set. They replace the
+// rules of any previous restriction of r.IP in the same transaction.
+func (c *RealNFTConn) RestrictUpstream(r UpstreamRestriction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stale, err := c.upstreamRules(r.IP)
+	if err != nil {
+		return err
+	}
+	for _, rule := range stale {
+		if err := c.conn.DelRule(rule); err != nil {
+			return fmt.Errorf("restrict upstream: %w", err)
+		}
+	}
+	comment := upstreamComment(r)
+	blocked := blockedRanges(r.Allowed)
+	if len(blocked) == 0 {
+		// every port is allowed: nothing to drop
+		r.Dests = nil
+	}
+	for _, d := range r.Dests {
+		dest, err := netip.ParsePrefix(d)
+		if err != nil {
+			return fmt.Errorf("restrict upstream: %w", err)
+		}
+		for _, chain := range []*nftables.Chain{c.output, c.forward} {
+			protos, ports, err := c.upstreamSets(blocked)
+			if err != nil {
+				return fmt.Errorf("restrict upstream: %w", err)
+			}
+			c.conn.InsertRule(c.newRule(chain, comment, upstreamExprs(c.iface, dest, protos, ports)))
+		}
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("restrict upstream: %w", err)
+	}
+	return nil
+}
+
+// DeleteUpstreamRestriction removes the rules restricting ip in one
+// transaction.
+func (c *RealNFTConn) DeleteUpstreamRestriction(ip string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rules, err := c.upstreamRules(ip)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("upstream restriction of %q not found in chain", ip)
+	}
+	for _, r := range rules {
+		if err := c.conn.DelRule(r); err != nil {
+			return fmt.Errorf("delete upstream restriction: %w", err)
+		}
+	}
+	if err := c.conn.Flush(); err != nil {
+		return fmt.Errorf("delete upstream restriction: %w", err)
+	}
+	return nil
+}
+
+// ListUpstreamRestrictions returns the digests found in the comments of
+// the restriction rules, by peer VPN address.
+func (c *RealNFTConn) ListUpstreamRestrictions() (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	digests := map[string]string{}
+	for _, chain := range []*nftables.Chain{c.output, c.forward} {
+		rules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("list upstream restrictions: %w", err)
+		}
+		for _, r := range rules {
+			comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+			if ip, digest, ok := parseUpstreamComment(comment); ok {
+				digests[ip] = digest
+			}
+		}
+	}
+	return digests, nil
+}
+
+// upstreamRules returns the rules restricting ip, ready for deletion.
+func (c *RealNFTConn) upstreamRules(ip string) ([]*nftables.Rule, error) {
+	var found []*nftables.Rule
+	for _, chain := range []*nftables.Chain{c.output, c.forward} {
+		rules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("list %s rules: %w", chain.Name, err)
+		}
+		for _, r := range rules {
+			comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+			if got, _, ok := parseUpstreamComment(comment); ok && got == ip {
+				r.Table, r.Chain = c.table, chain
+				found = append(found, r)
+			}
+		}
+	}
+	return found, nil
+}
+
+// parseUpstreamComment is the inverse of upstreamComment.
+func parseUpstreamComment(comment string) (ip, digest string, ok bool) {
+	rest, ok := strings.CutPrefix(comment, upstreamPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, "/")
+}
@@ -0,0 +1,179 @@
+package housekeeping
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/audit"
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// pruneBatch is how many audit entries are read at a time.
+const pruneBatch = 1000
+
+// PruneAudit deletes the audit entries older than the retention. With an
+// archive directory, the entries are first written to a new gzipped file
+// of JSON lines in the AUDIT_FILE format, and are only deleted once it is
+// safely on disk and recorded in the database. A run that fails to delete
+// them leaves the deletion to the next one, which does not archive them
+// again.
+func (k *Keeper) PruneAudit() *PruneRun {
+	start := k.now()
+	res := &PruneRun{Run: Run{At: start}}
+	deleted, archive, err := k.pruneAudit(start.Add(-k.opts.AuditRetention))
+	res.Deleted, res.Archive = deleted, archive
+	if err != nil {
+		res.Err = err.Error()
+		k.logger.Error("audit log pruning failed", "error", err)
+	} else if deleted > 0 {
+		k.logger.Info("audit log pruned", "deleted", deleted, "archive", archive)
+	}
+	res.Duration = k.now().Sub(start)
+
+	k.mu.Lock()
+	k.status.AuditPrune = res
+	k.mu.Unlock()
+	return res
+}
+
+func (k *Keeper) pruneAudit(before time.Time) (int64, string, error) {
+	if k.opts.AuditArchiveDir == "" {
+		deleted, err := k.audit.DeleteBefore(before)
+		return deleted, "", err
+	}
+
+	// Entries archived by a run that failed to delete them go first
+	var deleted int64
+	pending, err := k.audit.PendingArchives()
+	if err != nil {
+		return 0, "", err
+	}
+	for _, a := range pending {
+		n, err := k.audit.DeleteArchived(a)
+		if err != nil {
+			return deleted, "", err
+		}
+		deleted += n
+	}
+
+	var (
+		maxID   int64
+		archive *auditArchive
+	)
+	for {
+		batch, err := k.audit.EntriesBefore(before, maxID, pruneBatch)
+		if err != nil {
+			archive.abort()
+			return deleted, "", err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if archive == nil {
+			if archive, err = newAuditArchive(k.opts.AuditArchiveDir, k.now()); err != nil {
+				return deleted, "", err
+			}
+		}
+		if err := archive.write(batch); err != nil {
+			archive.abort()
+			return deleted, "", err
+		}
+		maxID = batch[len(batch)-1].ID
+		if len(batch) < pruneBatch {
+			break
+		}
+	}
+	if maxID == 0 {
+		return deleted, "", nil
+	}
+
+	path, err := archive.commit()
+	if err != nil {
+		return deleted, "", err
+	}
+	a := store.AuditArchive{Path: path, Before: before, MaxID: maxID}
+	if err := k.audit.RecordArchive(a); err != nil {
+		// Unrecorded, the entries would be archived again by the next run
+		os.Remove(path)
+		return deleted, "", err
+	}
+	n, err := k.audit.DeleteArchived(a)
+	return deleted + n, path, err
+}
+
+// auditArchive is a gzipped JSON lines file being written under a
+// temporary name, renamed into place by commit.
+type auditArchive struct {
+	f    *os.File
+	zw   *gzip.Writer
+	enc  *json.Encoder
+	path string
+}
+
+func newAuditArchive(dir string, now time.Time) (*auditArchive, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create audit archive directory: %w", err)
+	}
+	path := filepath.Join(dir, "audit-"+now.UTC().Format("20060102T150405Z")+".jsonl.gz")
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create audit archive: %w", err)
+	}
+	zw := gzip.NewWriter(f)
+	return &auditArchive{f: f, zw: zw, enc: json.NewEncoder(zw), path: path}, nil
+}
+
+func (a *auditArchive) write(records []*store.AuditRecord) error {
+	for _, r := range records {
+		err := a.enc.Encode(audit.Event{
+			Time:        r.Timestamp.UTC(),
+			ClientCN:    r.ClientCN,
+			SourceIP:    r.SourceIP,
+			Method:      r.Method,
+			Path:        r.Path,
+			BodyHash:    r.BodyHash,
+			Result:      r.Result,
+			Error:       r.ErrorMsg,
+			RequestBody: r.RequestBody,
+			Diff:        r.Diff,
+		})
+		if err != nil {
+			return fmt.Errorf("write audit archive: %w", err)
+		}
+	}
+	return nil
+}
+
+// commit flushes the archive to disk and gives it its final name.
+func (a *auditArchive) commit() (string, error) {
+	if err := a.zw.Close(); err != nil {
+		a.abort()
+		return "", fmt.Errorf("write audit archive: %w", err)
+	}
+	if err := a.f.Sync(); err != nil {
+		a.abort()
+		return "", fmt.Errorf("sync audit archive: %w", err)
+	}
+	if err := a.f.Close(); err != nil {
+		os.Remove(a.f.Name())
+		return "", fmt.Errorf("close audit archive: %w", err)
+	}
+	if err := os.Rename(a.f.Name(), a.path); err != nil {
+		os.Remove(a.f.Name())
+		return "", fmt.Errorf("rename audit archive: %w", err)
+	}
+	return a.path, nil
+}
+
+// abort removes a partly written archive. It does nothing on nil.
+func (a *auditArchive) abort() {
+	if a == nil {
+		return
+	}
+	a.f.Close()
+	os.Remove(a.f.Name())
+}
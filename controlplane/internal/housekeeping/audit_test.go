@@ -0,0 +1,145 @@
+package housekeeping
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/audit"
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+func TestPruneAudit(t *testing.T) {
+	db, err := store.New(":memory:")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	for i, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour} {
+		_, err := db.Conn().Exec(`INSERT INTO audit_log (timestamp, client_cn, method, path, result) VALUES (?, 'admin', 'POST', ?, 'ok')`,
+			now.Add(-age).Unix(), "/api/v1/tunnels/"+string(rune('a'+i)))
+		if err != nil {
+			t.Fatalf("insert audit entry: %v", err)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "archive")
+	k := New(db, Options{AuditRetention: 24 * time.Hour, AuditArchiveDir: dir})
+	res := k.PruneAudit()
+	if res.Err != "" || res.Deleted != 2 {
+		t.Fatalf("expected 2 entries pruned, got %+v", res)
+	}
+
+	var left int
+	db.Conn().QueryRow(`SELECT COUNT(*) FROM audit_log`).Scan(&left)
+	if left != 1 {
+		t.Errorf("expected 1 entry left, got %d", left)
+	}
+
+	// The pruned entries were archived, oldest first
+	f, err := os.Open(res.Archive)
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	var paths []string
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var e audit.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("parse archived entry: %v", err)
+		}
+		paths = append(paths, e.Path)
+	}
+	if len(paths) != 2 || paths[0] != "/api/v1/tunnels/a" || paths[1] != "/api/v1/tunnels/b" {
+		t.Errorf("unexpected archived entries: %v", paths)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("expected no temporary files, got %v", tmp)
+	}
+
+	// Nothing left to prune writes no archive
+	if res := k.PruneAudit(); res.Err != "" || res.Deleted != 0 || res.Archive != "" {
+		t.Errorf("expected nothing pruned, got %+v", res)
+	}
+	if k.Status().AuditPrune == nil {
+		t.Error("expected the pruning recorded in the status")
+	}
+}
+
+func TestPruneAuditWithoutArchive(t *testing.T) {
+	db, err := store.New(":memory:")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	for _, age := range []time.Duration{48 * time.Hour, time.Hour} {
+		db.Conn().Exec(`INSERT INTO audit_log (timestamp, client_cn, method, path, result) VALUES (?, 'admin', 'POST', '/api/v1/tunnels', 'ok')`,
+			now.Add(-age).Unix())
+	}
+
+	k := New(db, Options{AuditRetention: 24 * time.Hour})
+	if res := k.PruneAudit(); res.Err != "" || res.Deleted != 1 || res.Archive != "" {
+		t.Fatalf("expected 1 entry pruned without an archive, got %+v", res)
+	}
+}
+
+func TestPruneAuditFinishesArchivedDeletion(t *testing.T) {
+	db, err := store.New(":memory:")
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	for _, age := range []time.Duration{72 * time.Hour, 48 * time.Hour} {
+		db.Conn().Exec(`INSERT INTO audit_log (timestamp, client_cn, method, path, result) VALUES (?, 'admin', 'POST', '/api/v1/tunnels', 'ok')`,
+			now.Add(-age).Unix())
+	}
+
+	// A previous run archived the first entry but failed to delete it
+	audits := store.NewAuditStore(db)
+	if err := audits.RecordArchive(store.AuditArchive{Path: "/archive/old.jsonl.gz", Before: now.Add(-60 * time.Hour), MaxID: 1}); err != nil {
+		t.Fatalf("record archive: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "archive")
+	k := New(db, Options{AuditRetention: 24 * time.Hour, AuditArchiveDir: dir})
+	res := k.PruneAudit()
+	if res.Err != "" || res.Deleted != 2 {
+		t.Fatalf("expected 2 entries pruned, got %+v", res)
+	}
+
+	// Only the second entry went into the new archive
+	f, err := os.Open(res.Archive)
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	lines := 0
+	for scanner := bufio.NewScanner(zr); scanner.Scan(); {
+		lines++
+	}
+	if lines != 1 {
+		t.Errorf("expected 1 archived entry, got %d", lines)
+	}
+	if pending, _ := audits.PendingArchives(); len(pending) != 0 {
+		t.Errorf("expected no pending archives, got %+v", pending)
+	}
+}
@@ -0,0 +1,238 @@
+// Package housekeeping keeps the SQLite database in shape: it checkpoints
+// the WAL so it does not grow between SQLite's own checkpoints, checks the
+// database for corruption, returns the pages freed by deleted rows to the
+// OS, and prunes audit entries past their retention, optionally archiving
+// them first. The outcome of each task is kept for GET /api/v1/status.
+package housekeeping
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// Options sets how often each task runs; 0 disables it.
+type Options struct {
+	CheckpointInterval time.Duration
+	IntegrityInterval  time.Duration
+	VacuumInterval     time.Duration
+
+	AuditRetention  time.Duration // audit entries older than this are pruned hourly (0 = kept forever)
+	AuditArchiveDir string        // pruned entries are written here first as gzipped JSON lines ("" = not archived)
+}
+
+// pruneInterval is how often entries past their retention are pruned.
+const pruneInterval = time.Hour
+
+// Run is the outcome of the latest run of a task.
+type Run struct {
+	At       time.Time
+	Duration time.Duration
+	Err      string // "" if the task succeeded
+}
+
+// CheckpointRun is the outcome of the latest WAL checkpoint.
+type CheckpointRun struct {
+	Run
+	store.Checkpoint
+}
+
+// IntegrityRun is the outcome of the latest integrity check.
+type IntegrityRun struct {
+	Run
+	Problems []string // empty for a sound database
+}
+
+// VacuumRun is the outcome of the latest vacuum.
+type VacuumRun struct {
+	Run
+	FreedBytes int64
+}
+
+// PruneRun is the outcome of the latest audit log pruning.
+type PruneRun struct {
+	Run
+	Deleted int64
+	Archive string // file the pruned entries were archived to, if any
+}
+
+// Status holds the latest run of each task, nil until it first runs.
+type Status struct {
+	Checkpoint *CheckpointRun
+	Integrity  *IntegrityRun
+	Vacuum     *VacuumRun
+	AuditPrune *PruneRun
+}
+
+// Keeper runs the housekeeping tasks on their intervals.
+type Keeper struct {
+	db     *store.DB
+	audit  *store.AuditStore
+	opts   Options
+	logger *slog.Logger
+	now    func() time.Time
+
+	leaderCheck func() bool
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New creates a Keeper for db.
+func New(db *store.DB, opts Options) *Keeper {
+	return &Keeper{
+		db:     db,
+		audit:  store.NewAuditStore(db),
+		opts:   opts,
+		logger: slog.Default(),
+		now:    time.Now,
+	}
+}
+
+// SetLeaderCheck makes the tasks run only while isLeader reports true, so
+// instances sharing the database do not repeat each other's work.
+func (k *Keeper) SetLeaderCheck(isLeader func() bool) {
+	k.leaderCheck = isLeader
+}
+
+// Run runs each enabled task every interval until ctx is canceled.
+func (k *Keeper) Run(ctx context.Context) {
+	checkpoint := tick(k.opts.CheckpointInterval)
+	integrity := tick(k.opts.IntegrityInterval)
+	vacuum := tick(k.opts.VacuumInterval)
+	prune := tick(0)
+	if k.opts.AuditRetention > 0 {
+		prune = tick(pruneInterval)
+	}
+	defer checkpoint.stop()
+	defer integrity.stop()
+	defer vacuum.stop()
+	defer prune.stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-checkpoint.c:
+			if k.leading() {
+				k.Checkpoint()
+			}
+		case <-integrity.c:
+			if k.leading() {
+				k.IntegrityCheck()
+			}
+		case <-vacuum.c:
+			if k.leading() {
+				k.Vacuum()
+			}
+		case <-prune.c:
+			if k.leading() {
+				k.PruneAudit()
+			}
+		}
+	}
+}
+
+func (k *Keeper) leading() bool {
+	return k.leaderCheck == nil || k.leaderCheck()
+}
+
+// Status returns the latest run of each task.
+func (k *Keeper) Status() Status {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.status
+}
+
+// Stats returns the size of the database files.
+func (k *Keeper) Stats() (*store.FileStats, error) {
+	return k.db.Stats()
+}
+
+// Checkpoint checkpoints and truncates the WAL.
+func (k *Keeper) Checkpoint() *CheckpointRun {
+	start := k.now()
+	res := &CheckpointRun{Run: Run{At: start}}
+	c, err := k.db.Checkpoint()
+	if err != nil {
+		res.Err = err.Error()
+		k.logger.Error("database checkpoint failed", "error", err)
+	} else {
+		res.Checkpoint = *c
+		if c.Busy {
+			k.logger.Warn("database checkpoint could not complete", "log_frames", c.LogFrames, "checkpointed", c.Checkpointed)
+		}
+	}
+	res.Duration = k.now().Sub(start)
+
+	k.mu.Lock()
+	k.status.Checkpoint = res
+	k.mu.Unlock()
+	return res
+}
+
+// IntegrityCheck checks the database for corruption.
+func (k *Keeper) IntegrityCheck() *IntegrityRun {
+	start := k.now()
+	res := &IntegrityRun{Run: Run{At: start}}
+	problems, err := k.db.IntegrityCheck()
+	switch {
+	case err != nil:
+		res.Err = err.Error()
+		k.logger.Error("database integrity check failed", "error", err)
+	case len(problems) > 0:
+		res.Problems = problems
+		k.logger.Error("database integrity check found problems", "problems", problems)
+	}
+	res.Duration = k.now().Sub(start)
+
+	k.mu.Lock()
+	k.status.Integrity = res
+	k.mu.Unlock()
+	return res
+}
+
+// Vacuum returns free pages to the OS.
+func (k *Keeper) Vacuum() *VacuumRun {
+	start := k.now()
+	res := &VacuumRun{Run: Run{At: start}}
+	freed, err := k.db.Vacuum()
+	if err != nil {
+		res.Err = err.Error()
+		k.logger.Error("database vacuum failed", "error", err)
+	} else {
+		res.FreedBytes = freed
+		if freed > 0 {
+			k.logger.Info("database vacuumed", "freed_bytes", freed)
+		}
+	}
+	res.Duration = k.now().Sub(start)
+
+	k.mu.Lock()
+	k.status.Vacuum = res
+	k.mu.Unlock()
+	return res
+}
+
+// ticker is a time.Ticker that never fires when its interval is 0.
+type ticker struct {
+	t *time.Ticker
+	c <-chan time.Time
+}
+
+func tick(interval time.Duration) ticker {
+	if interval <= 0 {
+		return ticker{}
+	}
+	t := time.NewTicker(interval)
+	return ticker{t: t, c: t.C}
+}
+
+func (t ticker) stop() {
+	if t.t != nil {
+		t.t.Stop()
+	}
+}
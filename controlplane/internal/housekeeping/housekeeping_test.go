@@ -0,0 +1,78 @@
+package housekeeping
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+func TestKeeper(t *testing.T) {
+	db, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	defer db.Close()
+
+	// Rows written and then deleted leave free pages behind
+	conn := db.Conn()
+	if _, err := conn.Exec(`CREATE TABLE filler (data TEXT)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		if _, err := conn.Exec(`INSERT INTO filler (data) VALUES (?)`, strings.Repeat("x", 4096)); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	if _, err := conn.Exec(`DELETE FROM filler`); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	k := New(db, Options{})
+	if s := k.Status(); s.Checkpoint != nil || s.Integrity != nil || s.Vacuum != nil {
+		t.Fatalf("expected no runs yet, got %+v", s)
+	}
+
+	if res := k.Checkpoint(); res.Err != "" || res.Busy {
+		t.Errorf("unexpected checkpoint result: %+v", res)
+	}
+	stats, err := k.Stats()
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if stats.WALBytes != 0 {
+		t.Errorf("expected the WAL to be truncated, got %d bytes", stats.WALBytes)
+	}
+	if stats.FreePages == 0 {
+		t.Fatal("expected free pages after deleting rows")
+	}
+
+	if res := k.IntegrityCheck(); res.Err != "" || len(res.Problems) > 0 {
+		t.Errorf("unexpected integrity result: %+v", res)
+	}
+
+	// The first vacuum switches to incremental mode, later ones keep it
+	if res := k.Vacuum(); res.Err != "" || res.FreedBytes <= 0 {
+		t.Errorf("expected freed bytes, got %+v", res)
+	}
+	if res := k.Vacuum(); res.Err != "" {
+		t.Errorf("second vacuum: %+v", res)
+	}
+	after, err := k.Stats()
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if after.FreePages != 0 {
+		t.Errorf("expected no free pages after vacuum, got %d", after.FreePages)
+	}
+
+	s := k.Status()
+	if s.Checkpoint == nil || s.Integrity == nil || s.Vacuum == nil {
+		t.Fatalf("expected every task recorded, got %+v", s)
+	}
+	if time.Since(s.Vacuum.At) > time.Minute {
+		t.Errorf("unexpected vacuum time %v", s.Vacuum.At)
+	}
+}
@@ -0,0 +1,127 @@
+// Package leader elects one active control plane among instances sharing a
+// database. Only the leader changes Caddy, WireGuard, and nftables; the
+// others stand by and take over when the leader's lease expires.
+package leader
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// leaseName is the lease row all instances compete for.
+const leaseName = "controlplane-leader"
+
+// Elector holds or waits for the leader lease on behalf of one instance.
+type Elector struct {
+	leases *store.LeaseStore
+	id     string
+	ttl    time.Duration
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu        sync.Mutex
+	leader    bool
+	renewedAt time.Time
+	onElected func()
+}
+
+// New creates an Elector for the instance id. A leader that cannot renew
+// its lease for ttl is replaced.
+func New(leases *store.LeaseStore, id string, ttl time.Duration) *Elector {
+	return &Elector{
+		leases:    leases,
+		id:        id,
+		ttl:       ttl,
+		logger:    slog.Default(),
+		now:       time.Now,
+		onElected: func() {},
+	}
+}
+
+// SetOnElected sets a function called when this instance becomes leader,
+// typically to reconcile right away.
+func (e *Elector) SetOnElected(f func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onElected = f
+}
+
+// ID returns this instance's identity.
+func (e *Elector) ID() string {
+	return e.id
+}
+
+// IsLeader reports whether this instance holds the lease. Leadership lapses
+// on its own once the lease could not be renewed for ttl, so a leader cut
+// off from the database stops acting before another instance takes over.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader && e.now().Sub(e.renewedAt) < e.ttl
+}
+
+// Leader returns the identity of the current leader, or "" if there is none.
+func (e *Elector) Leader() (string, error) {
+	holder, _, err := e.leases.Holder(leaseName, e.now())
+	return holder, err
+}
+
+// Run competes for the lease until ctx is canceled, renewing it three times
+// per ttl while held. On return the lease is released so a standby can take
+// over at once.
+func (e *Elector) Run(ctx context.Context) {
+	e.tick()
+
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.mu.Lock()
+			wasLeader := e.leader
+			e.leader = false
+			e.mu.Unlock()
+			if wasLeader {
+				if err := e.leases.Release(leaseName, e.id); err != nil {
+					e.logger.Warn("failed to release leader lease", "error", err)
+				}
+			}
+			return
+		case <-ticker.C:
+			e.tick()
+		}
+	}
+}
+
+// tick tries to acquire or renew the lease and reports transitions.
+func (e *Elector) tick() {
+	now := e.now()
+	ok, err := e.leases.Acquire(leaseName, e.id, now, e.ttl)
+	if err != nil {
+		e.logger.Error("failed to renew leader lease", "error", err)
+	}
+
+	e.mu.Lock()
+	was := e.leader && now.Sub(e.renewedAt) < e.ttl
+	if err == nil {
+		e.leader = ok
+		if ok {
+			e.renewedAt = now
+		}
+	}
+	is := e.leader && now.Sub(e.renewedAt) < e.ttl
+	onElected := e.onElected
+	e.mu.Unlock()
+
+	switch {
+	case is && !was:
+		e.logger.Info("elected leader", "instance", e.id)
+		onElected()
+	case was && !is:
+		e.logger.Warn("lost leadership", "instance", e.id)
+	}
+}
@@ -0,0 +1,52 @@
+package leader
+
+import (
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+func TestFailover(t *testing.T) {
+	db, err := store.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	leases := store.NewLeaseStore(db)
+
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	a, b := New(leases, "a", 15*time.Second), New(leases, "b", 15*time.Second)
+	a.now, b.now = clock, clock
+	elected := ""
+	a.SetOnElected(func() { elected += "a" })
+	b.SetOnElected(func() { elected += "b" })
+
+	a.tick()
+	b.tick()
+	if !a.IsLeader() || b.IsLeader() || elected != "a" {
+		t.Fatalf("expected a elected alone, got a=%v b=%v elected=%q", a.IsLeader(), b.IsLeader(), elected)
+	}
+
+	// a keeps renewing while b waits
+	now = now.Add(10 * time.Second)
+	a.tick()
+	b.tick()
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatal("expected a to stay leader")
+	}
+
+	// a dies: its leadership lapses and b takes over once the lease expires
+	now = now.Add(16 * time.Second)
+	if a.IsLeader() {
+		t.Error("expected a's leadership to lapse without renewal")
+	}
+	b.tick()
+	if !b.IsLeader() || elected != "ab" {
+		t.Errorf("expected b elected, got b=%v elected=%q", b.IsLeader(), elected)
+	}
+	if id, _ := a.Leader(); id != "b" {
+		t.Errorf("expected leader b, got %q", id)
+	}
+}
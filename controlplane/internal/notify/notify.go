@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Event types delivered to notifiers.
+const (
+	EventTunnelExpiring        = "tunnel.expiring"
+	EventTunnelRevoked         = "tunnel.revoked"
+	EventTunnelExpired         = "tunnel.expired"
+	EventTunnelPSKRotated      = "tunnel.psk_rotated"
+	EventTunnelEndpointBlocked = "tunnel.endpoint_blocked"
+	EventTunnelConnected       = "tunnel.connected"
+	EventTunnelDisconnected    = "tunnel.disconnected"
+
+	EventTunnelApprovalRequested = "tunnel.approval_requested"
+	EventTunnelApproved          = "tunnel.approved"
+	EventTunnelRejected          = "tunnel.rejected"
+
+	EventRouteExpired = "route.expired"
+
+	EventDriftDetected = "reconcile.drift_detected"
+)
+
+// Event is a control plane event delivered to webhook receivers.
+type Event struct {
+	Type     string                 `json:"type"`
+	TunnelID string                 `json:"tunnel_id,omitempty"`
+	Time     time.Time              `json:"time"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// Notifier delivers events to operators.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// Nop is a Notifier that discards every event.
+type Nop struct{}
+
+// Notify implements Notifier.
+func (Nop) Notify(context.Context, Event) error { return nil }
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body when a secret is configured.
+const SignatureHeader = "X-Proxy-Manager-Signature"
+
+// WebhookNotifier POSTs events as JSON to a list of URLs.
+type WebhookNotifier struct {
+	urls       []string
+	secret     []byte
+	httpClient *http.Client
+}
+
+// NewWebhookNotifier creates a notifier for the given URLs. When secret is
+// non-empty every request is signed with it (see SignatureHeader).
+func NewWebhookNotifier(urls []string, secret string) *WebhookNotifier {
+	return &WebhookNotifier{
+		urls:       urls,
+		secret:     []byte(secret),
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Notify delivers the event to every URL. It attempts all URLs and returns
+// the combined error of those that failed.
+func (n *WebhookNotifier) Notify(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+
+	var errs []error
+	for _, url := range n.urls {
+		if err := n.post(ctx, url, body); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", url, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *WebhookNotifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(n.secret, body))
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body under secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifierSignsAndDelivers(t *testing.T) {
+	var got Event
+	var signature string
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature = r.Header.Get(SignatureHeader)
+		if want := "sha256=" + Sign([]byte("s3cret"), body); signature != want {
+			t.Errorf("signature mismatch: got %q want %q", signature, want)
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer ok.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	n := NewWebhookNotifier([]string{failing.URL, ok.URL}, "s3cret")
+	err := n.Notify(context.Background(), Event{Type: EventTunnelExpiring, TunnelID: "tun_1", Time: time.Now()})
+	if err == nil {
+		t.Error("expected error from failing receiver")
+	}
+
+	// The healthy receiver still got the event
+	if got.Type != EventTunnelExpiring || got.TunnelID != "tun_1" {
+		t.Errorf("unexpected event: %+v", got)
+	}
+	if signature == "" {
+		t.Error("expected signature header")
+	}
+}
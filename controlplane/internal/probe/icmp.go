@@ -0,0 +1,87 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// listenICMP opens a raw ICMP socket, or without CAP_NET_RAW an
+// unprivileged ping socket (see net.ipv4.ping_group_range).
+func listenICMP() (*icmp.PacketConn, bool, error) {
+	if conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0"); err == nil {
+		return conn, true, nil
+	}
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		return nil, false, fmt.Errorf("open ICMP socket: %w", err)
+	}
+	return conn, false, nil
+}
+
+// pingICMP sends an echo request to target, an IPv4 address, and waits for
+// the matching reply. Each probe has its own socket and a random payload,
+// so concurrent probes do not take each other's replies.
+func pingICMP(ctx context.Context, target string, timeout time.Duration) (time.Duration, bool, error) {
+	addr, err := netip.ParseAddr(target)
+	if err != nil || !addr.Is4() {
+		return 0, false, fmt.Errorf("ICMP probes need an IPv4 address; got %q", target)
+	}
+	conn, raw, err := listenICMP()
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	payload := make([]byte, 16)
+	rand.Read(payload)
+	echo := &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: int(payload[0])<<8 | int(payload[1]), Data: payload}
+	msg, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: echo}).Marshal(nil)
+	if err != nil {
+		return 0, false, err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: addr.AsSlice()}
+	if raw {
+		dst = &net.IPAddr{IP: addr.AsSlice()}
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	start := time.Now()
+	if _, err := conn.WriteTo(msg, dst); err != nil {
+		// No route to the peer is loss, not a broken prober
+		return 0, false, nil
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, false, nil
+			}
+			return 0, false, fmt.Errorf("read ICMP reply: %w", err)
+		}
+		reply, err := icmp.ParseMessage(1, buf[:n]) // protocol 1 = ICMP
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		// Unprivileged sockets rewrite the ID, so match on the payload
+		if body, ok := reply.Body.(*icmp.Echo); ok && body.Seq == echo.Seq && bytes.Equal(body.Data, payload) {
+			return time.Since(start), true, nil
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package probe measures the latency and loss of the path to each tunnel's
+// peer, which the handshake age alone does not show: a peer can handshake
+// every two minutes over a link that drops half its packets.
+//
+// The Prober sends one probe per tunnel per interval and records the
+// outcome in SQLite, which keeps the latest probes of each tunnel as a
+// rolling window.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// Probe methods.
+const (
+	MethodICMP = "icmp" // echo request to the peer's VPN IP
+	MethodTCP  = "tcp"  // connect to the upstream of one of the tunnel's TCP routes
+)
+
+// maxInFlight bounds the probes sent at once, so a round over many
+// unreachable peers takes a few timeouts rather than one per peer.
+const maxInFlight = 16
+
+// Options configures a Prober.
+type Options struct {
+	Method  string        // MethodICMP or MethodTCP
+	Timeout time.Duration // Wait for a reply before counting a probe as lost
+	Window  int           // Latest probes kept per tunnel
+}
+
+// pinger sends one probe to target and returns the round-trip time. ok is
+// false when no reply came in time; err reports a probe that could not be
+// sent at all, which is not counted.
+type pinger func(ctx context.Context, target string, timeout time.Duration) (rtt time.Duration, ok bool, err error)
+
+// Prober probes the peers of the tunnels served by this host.
+type Prober struct {
+	tunnels *store.TunnelStore
+	routes  *store.RouteStore
+	opts    Options
+	ping    pinger
+	logger  *slog.Logger
+	now     func() time.Time
+
+	leaderCheck func() bool
+}
+
+// New creates a Prober recording probes in ts; rs supplies the upstreams
+// probed by MethodTCP.
+func New(ts *store.TunnelStore, rs *store.RouteStore, opts Options) *Prober {
+	ping := pingICMP
+	if opts.Method == MethodTCP {
+		ping = pingTCP
+	}
+	return &Prober{
+		tunnels: ts,
+		routes:  rs,
+		opts:    opts,
+		ping:    ping,
+		logger:  slog.Default(),
+		now:     time.Now,
+	}
+}
+
+// SetLeaderCheck makes probe rounds run only while isLeader reports true,
+// since a standby has no WireGuard peers to reach.
+func (p *Prober) SetLeaderCheck(isLeader func() bool) {
+	p.leaderCheck = isLeader
+}
+
+// Run probes every peer every interval until ctx is canceled.
+func (p *Prober) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if p.leaderCheck != nil && !p.leaderCheck() {
+				continue
+			}
+			if err := p.probeAll(ctx); err != nil {
+				p.logger.Error("latency probe round failed", "error", err)
+			}
+		}
+	}
+}
+
+// probeAll probes each enabled tunnel served by this host once and records
+// the outcomes. Tunnels on remote nodes are not reachable from here, and
+// with MethodTCP neither are tunnels without a TCP route.
+func (p *Prober) probeAll(ctx context.Context) error {
+	tunnels, err := p.tunnels.ListEnabled()
+	if err != nil {
+		return err
+	}
+	targets := make(map[string]string, len(tunnels)) // tunnel ID -> target
+	for _, t := range tunnels {
+		if t.NodeID == "" {
+			targets[t.ID] = t.VpnIP
+		}
+	}
+	if p.opts.Method == MethodTCP {
+		routes, err := p.routes.ListEnabled()
+		if err != nil {
+			return err
+		}
+		upstreams := make(map[string]string, len(targets))
+		for _, r := range routes {
+			if _, local := targets[r.TunnelID]; local && upstreams[r.TunnelID] == "" && r.Protocol == "tcp" {
+				upstreams[r.TunnelID] = r.Upstream
+			}
+		}
+		targets = upstreams
+	}
+
+	type result struct {
+		rtt *time.Duration
+		err error
+	}
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]result, len(targets))
+		slots   = make(chan struct{}, maxInFlight)
+	)
+	for id, target := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			rtt, ok, err := p.ping(ctx, target, p.opts.Timeout)
+			res := result{err: err}
+			if ok {
+				res.rtt = &rtt
+			}
+			mu.Lock()
+			results[id] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	now := p.now()
+	var failed error
+	for id, res := range results {
+		if res.err != nil {
+			failed = res.err
+			continue
+		}
+		if err := p.tunnels.RecordProbe(id, now, res.rtt, p.opts.Window); err != nil {
+			return err
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("could not send every probe: %w", failed)
+	}
+	return nil
+}
+
+// pingTCP connects to target, a host:port. A refused connection still
+// crossed the path and counts as a reply.
+func pingTCP(ctx context.Context, target string, timeout time.Duration) (time.Duration, bool, error) {
+	d := net.Dialer{Timeout: timeout}
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", target)
+	rtt := time.Since(start)
+	if err != nil {
+		return rtt, errors.Is(err, syscall.ECONNREFUSED), nil
+	}
+	conn.Close()
+	return rtt, true, nil
+}
@@ -0,0 +1,104 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+func setupStores(t *testing.T) (*store.TunnelStore, *store.RouteStore) {
+	t.Helper()
+	db, err := store.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ts := store.NewTunnelStore(db)
+	for _, tun := range []*store.Tunnel{
+		{ID: "tun_up", PublicKey: "pk_up", VpnIP: "10.0.0.2", Enabled: true},
+		{ID: "tun_down", PublicKey: "pk_down", VpnIP: "10.0.0.3", Enabled: true},
+		{ID: "tun_off", PublicKey: "pk_off", VpnIP: "10.0.0.4", Enabled: false},
+		{ID: "tun_remote", PublicKey: "pk_remote", VpnIP: "10.0.0.5", Enabled: true, NodeID: "node_1"},
+	} {
+		tun.Domains = []string{}
+		if err := ts.Create(tun); err != nil {
+			t.Fatalf("create tunnel: %v", err)
+		}
+	}
+	return ts, store.NewRouteStore(db)
+}
+
+func TestProbeAll(t *testing.T) {
+	ts, rs := setupStores(t)
+	p := New(ts, rs, Options{Method: MethodICMP, Timeout: time.Second, Window: 3})
+	probed := make(chan string, 10)
+	p.ping = func(ctx context.Context, target string, timeout time.Duration) (time.Duration, bool, error) {
+		probed <- target
+		return 15 * time.Millisecond, target == "10.0.0.2", nil
+	}
+
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 4; i++ {
+		p.now = func() time.Time { return now.Add(time.Duration(i) * time.Minute) }
+		if err := p.probeAll(context.Background()); err != nil {
+			t.Fatalf("probe round %d: %v", i, err)
+		}
+	}
+	close(probed)
+	counts := map[string]int{}
+	for target := range probed {
+		counts[target]++
+	}
+	if len(counts) != 2 || counts["10.0.0.2"] != 4 || counts["10.0.0.3"] != 4 {
+		t.Errorf("expected only the enabled local peers probed each round, got %v", counts)
+	}
+
+	summaries, err := ts.ProbeSummaries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up := summaries["tun_up"]; up.Samples != 3 || up.Lost != 0 || up.AvgRTT != 15*time.Millisecond {
+		t.Errorf("expected 3 replies of 15ms for tun_up, got %+v", up)
+	}
+	if down := summaries["tun_down"]; down.Samples != 3 || down.Loss() != 1 {
+		t.Errorf("expected every probe of tun_down lost, got %+v", down)
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	ts, rs := setupStores(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	rs.Create(&store.Route{ID: "r_up", TunnelID: "tun_up", ListenPort: 443, Protocol: "tcp", MatchType: "sni",
+		MatchValue: []string{"a.example.com"}, Upstream: ln.Addr().String(), Enabled: true})
+
+	p := New(ts, rs, Options{Method: MethodTCP, Timeout: time.Second, Window: 5})
+	if err := p.probeAll(context.Background()); err != nil {
+		t.Fatalf("probe round: %v", err)
+	}
+	summaries, _ := ts.ProbeSummaries()
+	if len(summaries) != 1 || summaries["tun_up"].Samples != 1 || summaries["tun_up"].Lost != 0 {
+		t.Errorf("expected one reply from the route's upstream and no other tunnel probed, got %+v", summaries)
+	}
+
+	// A refused connection crossed the path too
+	ln.Close()
+	if _, ok, err := pingTCP(context.Background(), ln.Addr().String(), time.Second); !ok || err != nil {
+		t.Errorf("expected a refused connection to count as a reply, got ok=%v err=%v", ok, err)
+	}
+}
@@ -0,0 +1,108 @@
+package reconciler
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Subsystems the reconciler backs off from independently.
+const (
+	SubsystemCaddy     = "caddy"
+	SubsystemWireGuard = "wireguard"
+	SubsystemFirewall  = "firewall"
+)
+
+// maxBackoff caps the pause between attempts on a failing subsystem.
+const maxBackoff = 10 * time.Minute
+
+// SubsystemStatus is the failure state of one subsystem.
+type SubsystemStatus struct {
+	ConsecutiveFailures int
+	LastError           string     // "" while the subsystem is healthy
+	RetryAt             *time.Time // nil unless passes are skipping it
+}
+
+// backoffs tracks consecutive failures per subsystem. After the second
+// failure in a row a subsystem is skipped by timer passes for an
+// exponentially growing, jittered delay, so an unreachable Caddy is not
+// retried (and logged) every interval.
+type backoffs struct {
+	mu       sync.Mutex
+	interval time.Duration
+	state    map[string]*SubsystemStatus
+}
+
+func newBackoffs(interval time.Duration) *backoffs {
+	return &backoffs{interval: interval, state: map[string]*SubsystemStatus{}}
+}
+
+// add starts tracking system, so it is listed before its first attempt.
+func (b *backoffs) add(system string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.state[system]; !ok {
+		b.state[system] = &SubsystemStatus{}
+	}
+}
+
+// skip reports whether system is still backing off at now, and if so its
+// status.
+func (b *backoffs) skip(system string, now time.Time) (SubsystemStatus, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.state[system]
+	if !ok || s.RetryAt == nil || !now.Before(*s.RetryAt) {
+		return SubsystemStatus{}, false
+	}
+	return *s, true
+}
+
+// record notes the outcome of an attempt on system made at now. On failure
+// it returns the delay before timer passes try again (0 for a first failure).
+func (b *backoffs) record(system string, err error, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.state[system]
+	if !ok {
+		s = &SubsystemStatus{}
+		b.state[system] = s
+	}
+	if err == nil {
+		*s = SubsystemStatus{}
+		return 0
+	}
+	s.ConsecutiveFailures++
+	s.LastError = err.Error()
+	s.RetryAt = nil
+	if s.ConsecutiveFailures < 2 {
+		return 0
+	}
+	delay := backoffDelay(b.interval, s.ConsecutiveFailures)
+	retryAt := now.Add(delay)
+	s.RetryAt = &retryAt
+	return delay
+}
+
+// snapshot returns a copy of every subsystem's status.
+func (b *backoffs) snapshot() map[string]SubsystemStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]SubsystemStatus, len(b.state))
+	for system, s := range b.state {
+		out[system] = *s
+	}
+	return out
+}
+
+// backoffDelay doubles base for each failure after the first, up to
+// maxBackoff, and adds ±10% jitter so that instances sharing a failing
+// dependency do not retry in lockstep.
+func backoffDelay(base time.Duration, failures int) time.Duration {
+	d := base
+	for i := 1; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, maxBackoff)
+	return d - d/10 + time.Duration(rand.Int64N(int64(d/5)+1))
+}
@@ -0,0 +1,380 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/store"
+	"github.com/proxy-manager/controlplane/internal/wireguard"
+)
+
+// ImportResult reports the tunnels and routes Import adopted, or would adopt
+// in a dry run, and what it left alone.
+type ImportResult struct {
+	Tunnels []*store.Tunnel
+	Routes  []*store.Route
+	Skipped []ImportSkip
+}
+
+// ImportSkip is a kernel peer, Caddy route, or Caddy server that Import did
+// not adopt.
+type ImportSkip struct {
+	Kind   string `json:"kind"` // "peer", "caddy_route", or "caddy_server"
+	ID     string `json:"id"`   // public key, route @id (server#index if it has none), or server name
+	Reason string `json:"reason"`
+}
+
+// Import adopts WireGuard peers and Caddy layer4 routes that the store does
+// not know, such as those of a server configured by hand, by creating
+// tunnel and route records marked imported. Without them the reconciler
+// would remove the peers and routes as drift.
+//
+// Peers become tunnels at their /32 allowed IP, with any further allowed
+// IPs as advertised routes. SNI routes of the "proxy" server and pf-*
+// port-forward servers become routes of the tunnel their upstream points
+// into. Routes without an @id are given one in Caddy so the reconciler can
+// track them. Other servers are not touched by the reconciler and are only
+// reported. With dryRun nothing is written.
+func (r *Reconciler) Import(ctx context.Context, dryRun bool) (*ImportResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tunnels, err := r.tunnelStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("list tunnels: %w", err)
+	}
+	routes, err := r.routeStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("list routes: %w", err)
+	}
+	if r.wgFallback != nil {
+		routes = append(routes, r.wgFallback)
+	}
+	peers, err := r.wgManager.ListPeers()
+	if err != nil {
+		return nil, fmt.Errorf("list wg peers: %w", err)
+	}
+	config, err := r.caddyClient.GetL4Config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get caddy config: %w", err)
+	}
+
+	res := &ImportResult{}
+	skip := func(kind, id, reason string) {
+		res.Skipped = append(res.Skipped, ImportSkip{Kind: kind, ID: id, Reason: reason})
+	}
+
+	// Peers
+	knownKeys := make(map[string]bool)
+	usedIPs := make(map[string]bool)
+	for _, t := range tunnels {
+		knownKeys[t.PublicKey] = true
+		usedIPs[t.VpnIP] = true
+	}
+	for _, p := range peers {
+		if knownKeys[p.PublicKey] {
+			continue
+		}
+		t, reason := r.importedTunnel(p)
+		if reason == "" && usedIPs[t.VpnIP] {
+			reason = fmt.Sprintf("vpn ip %s is already allocated", t.VpnIP)
+		}
+		if reason != "" {
+			skip("peer", p.PublicKey, reason)
+			continue
+		}
+		usedIPs[t.VpnIP] = true
+		tunnels = append(tunnels, t)
+		res.Tunnels = append(res.Tunnels, t)
+	}
+
+	// What the stored routes already own in Caddy
+	managedIDs := make(map[string]bool)
+	managedServers := make(map[string]bool)
+	claimed := make(map[string]string) // SNI domain -> route ID
+	for _, route := range routes {
+		if route.MatchType == "port_forward" {
+			for _, server := range caddy.PortForwardServers(route.CaddyID, route.ListenPort, route.ListenPortEnd, route.Protocol, route.Upstream, route.ProxyProtocol) {
+				managedServers[server.Name] = true
+			}
+			continue
+		}
+		managedIDs[route.CaddyID] = true
+		for _, domain := range route.MatchValue {
+			claimed[domain] = route.ID
+		}
+	}
+
+	// SNI routes of the shared server; ID-less ones get an @id by index
+	var proxyRoutes []caddy.CaddyRoute
+	assigned := make(map[int]*store.Route)
+	if server, ok := config.Servers["proxy"]; ok {
+		proxyRoutes = slices.Clone(server.Routes)
+	}
+	for i, actual := range proxyRoutes {
+		if actual.ID != "" && managedIDs[actual.ID] {
+			continue
+		}
+		id := actual.ID
+		if id == "" {
+			id = fmt.Sprintf("proxy#%d", i)
+		}
+		route, reason := importedSNIRoute(actual, tunnels)
+		if reason == "" {
+			for _, domain := range route.MatchValue {
+				if owner, ok := claimed[domain]; ok {
+					reason = fmt.Sprintf("%s is already routed by %s", domain, owner)
+					break
+				}
+			}
+		}
+		if reason != "" {
+			skip("caddy_route", id, reason)
+			continue
+		}
+		if actual.ID == "" {
+			route.CaddyID = caddy.SNIRouteID(route.ID)
+			assigned[i] = route
+		} else if quic, ok := config.Servers[caddy.QUICServerName]; ok {
+			paired := caddy.BuildQUICRoute(route.CaddyID, route.MatchValue, route.Upstream)
+			route.QUIC = slices.ContainsFunc(quic.Routes, func(q caddy.CaddyRoute) bool { return caddy.RoutesEqual(q, paired) })
+		}
+		for _, domain := range route.MatchValue {
+			claimed[domain] = route.ID
+		}
+		res.Routes = append(res.Routes, route)
+	}
+
+	// Port-forward servers, in name order for a stable report
+	names := make([]string, 0, len(config.Servers))
+	for name := range config.Servers {
+		if name != "proxy" && name != caddy.QUICServerName && !managedServers[name] {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "pf-") {
+			skip("caddy_server", name, "not a server the control plane manages; the reconciler leaves it as is")
+			continue
+		}
+		route, reason := importedPortForward(name, config.Servers[name], tunnels)
+		if reason != "" {
+			skip("caddy_server", name, reason)
+			continue
+		}
+		res.Routes = append(res.Routes, route)
+	}
+
+	if dryRun {
+		return res, nil
+	}
+
+	// Tunnels first; the routes of one that fails are skipped with it
+	failed := make(map[string]bool)
+	created := res.Tunnels[:0]
+	for _, t := range res.Tunnels {
+		if err := r.tunnelStore.Create(t); err != nil {
+			skip("peer", t.PublicKey, err.Error())
+			failed[t.ID] = true
+			continue
+		}
+		created = append(created, t)
+	}
+	res.Tunnels = created
+
+	createdRoutes := res.Routes[:0]
+	for _, route := range res.Routes {
+		if failed[route.TunnelID] {
+			skip("caddy_route", route.CaddyID, "its tunnel could not be imported")
+			continue
+		}
+		if err := r.routeStore.Create(route); err != nil {
+			skip("caddy_route", route.CaddyID, err.Error())
+			continue
+		}
+		createdRoutes = append(createdRoutes, route)
+	}
+	res.Routes = createdRoutes
+
+	// Tag the adopted ID-less routes in place, keeping the list order
+	tagged := false
+	for i, route := range assigned {
+		if !route.CreatedAt.IsZero() {
+			proxyRoutes[i].ID = route.CaddyID
+			tagged = true
+		}
+	}
+	if tagged {
+		if err := r.caddyClient.ReplaceRoutes(ctx, proxyRoutes); err != nil {
+			// Non-fatal: the next pass adds the routes by their new @id
+			r.logger.Error("failed to tag imported caddy routes", "error", err)
+		}
+	}
+
+	r.logger.Info("imported existing state", "tunnels", len(res.Tunnels), "routes", len(res.Routes), "skipped", len(res.Skipped))
+	return res, nil
+}
+
+// importedTunnel builds the tunnel of a kernel peer, or returns why it
+// cannot be adopted.
+func (r *Reconciler) importedTunnel(p wireguard.PeerInfo) (*store.Tunnel, string) {
+	subnet, subnetErr := netip.ParsePrefix(r.vpnSubnet)
+	var vpnIP string
+	var advertised []string
+	for _, allowed := range p.AllowedIPs {
+		prefix, err := netip.ParsePrefix(allowed)
+		if err != nil {
+			return nil, fmt.Sprintf("invalid allowed ip %q", allowed)
+		}
+		if vpnIP == "" && prefix.Addr().Is4() && prefix.Bits() == 32 && (subnetErr != nil || subnet.Contains(prefix.Addr())) {
+			vpnIP = prefix.Addr().String()
+			continue
+		}
+		advertised = append(advertised, prefix.Masked().String())
+	}
+	if vpnIP == "" {
+		return nil, "no /32 allowed ip in the VPN subnet"
+	}
+
+	t := &store.Tunnel{
+		ID:               wireguard.GenerateRandomID("tun_"),
+		PublicKey:        p.PublicKey,
+		VpnIP:            vpnIP,
+		Endpoint:         p.Endpoint,
+		Domains:          []string{},
+		Enabled:          true,
+		AdvertisedRoutes: advertised,
+		Imported:         true,
+	}
+	if p.Keepalive != r.keepalive {
+		secs := int(p.Keepalive / time.Second)
+		t.PersistentKeepalive = &secs
+	}
+	return t, ""
+}
+
+// importedSNIRoute builds the route of an SNI route of the "proxy" server,
+// or returns why it cannot be adopted.
+func importedSNIRoute(actual caddy.CaddyRoute, tunnels []*store.Tunnel) (*store.Route, string) {
+	if len(actual.Match) != 1 || actual.Match[0].TLS == nil || actual.Match[0].QUIC != nil || len(actual.Match[0].TLS.SNI) == 0 {
+		return nil, "only routes matching on TLS SNI can be imported"
+	}
+	handle := actual.Handle
+	terminateTLS := len(handle) == 2 && handle[0].Handler == "tls"
+	if terminateTLS {
+		handle = handle[1:]
+	}
+	upstream, ok := singleUpstream(handle)
+	if !ok {
+		return nil, "only routes proxying to a single upstream can be imported"
+	}
+	tunnel, reason := upstreamTunnel(upstream, tunnels)
+	if reason != "" {
+		return nil, reason
+	}
+	return &store.Route{
+		ID:            wireguard.GenerateRandomID("route_"),
+		TunnelID:      tunnel.ID,
+		ListenPort:    443,
+		Protocol:      "tcp",
+		MatchType:     "sni",
+		MatchValue:    actual.Match[0].TLS.SNI,
+		Upstream:      upstream,
+		CaddyID:       actual.ID,
+		Enabled:       true,
+		ProxyProtocol: handle[0].ProxyProtocol,
+		TerminateTLS:  terminateTLS,
+		Imported:      true,
+	}, ""
+}
+
+// importedPortForward builds the route of a pf-* server, or returns why it
+// cannot be adopted.
+func importedPortForward(name string, server *caddy.L4Server, tunnels []*store.Tunnel) (*store.Route, string) {
+	if len(server.Listen) != 1 || len(server.Routes) != 1 || len(server.Routes[0].Match) != 0 {
+		return nil, "only servers with one listen address and one unconditional route can be imported"
+	}
+	protocol := "tcp"
+	listen := server.Listen[0]
+	if strings.HasPrefix(listen, "udp/") {
+		protocol = "udp"
+		listen = strings.TrimPrefix(listen, "udp/")
+	}
+	_, portStr, err := net.SplitHostPort(listen)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil || port == 0 || caddy.PortForwardServerName(port, protocol) != name {
+		return nil, fmt.Sprintf("listen address %q does not match the server name", server.Listen[0])
+	}
+	upstream, ok := singleUpstream(server.Routes[0].Handle)
+	if !ok || strings.HasPrefix(upstream, "udp/") != (protocol == "udp") {
+		return nil, "only servers proxying to a single upstream of their protocol can be imported"
+	}
+	tunnel, reason := upstreamTunnel(upstream, tunnels)
+	if reason != "" {
+		return nil, reason
+	}
+	id := wireguard.GenerateRandomID("route_")
+	caddyID := server.Routes[0].ID
+	if caddyID == "" {
+		caddyID = caddy.ManagedID("pf-" + id)
+	}
+	return &store.Route{
+		ID:            id,
+		TunnelID:      tunnel.ID,
+		ListenPort:    port,
+		Protocol:      protocol,
+		MatchType:     "port_forward",
+		MatchValue:    []string{},
+		Upstream:      upstream,
+		CaddyID:       caddyID,
+		Enabled:       true,
+		ProxyProtocol: server.Routes[0].Handle[0].ProxyProtocol,
+		Imported:      true,
+	}, ""
+}
+
+// singleUpstream returns the dial address of a handler list that is a
+// single proxy to a single upstream.
+func singleUpstream(handle []caddy.RouteHandle) (string, bool) {
+	if len(handle) != 1 || handle[0].Handler != "proxy" || len(handle[0].Upstreams) != 1 || len(handle[0].Upstreams[0].Dial) != 1 {
+		return "", false
+	}
+	return handle[0].Upstreams[0].Dial[0], true
+}
+
+// upstreamTunnel returns the local tunnel whose VPN IP or advertised routes
+// contain the host of upstream.
+func upstreamTunnel(upstream string, tunnels []*store.Tunnel) (*store.Tunnel, string) {
+	host, _, err := net.SplitHostPort(strings.TrimPrefix(upstream, "udp/"))
+	if err != nil {
+		return nil, fmt.Sprintf("invalid upstream %q", upstream)
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, fmt.Sprintf("upstream %q is not an IP address", upstream)
+	}
+	for _, t := range tunnels {
+		if t.NodeID == "" && t.VpnIP == addr.String() {
+			return t, ""
+		}
+	}
+	for _, t := range tunnels {
+		if t.NodeID != "" {
+			continue
+		}
+		for _, advertised := range t.AdvertisedRoutes {
+			if p, err := netip.ParsePrefix(advertised); err == nil && p.Contains(addr) {
+				return t, ""
+			}
+		}
+	}
+	return nil, fmt.Sprintf("upstream %s is not in a tunnel's VPN IP or advertised routes", upstream)
+}
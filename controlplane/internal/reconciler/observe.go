@@ -0,0 +1,132 @@
+package reconciler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/notify"
+)
+
+// Whether the reconciler corrects the drift it finds.
+const (
+	ModeEnforce = "enforce" // correct drift in Caddy, WireGuard, and nftables
+	ModeObserve = "observe" // only record and report it
+)
+
+// ObservedDrift is a correction the last pass found necessary but did not
+// make because the reconciler is in observe mode.
+type ObservedDrift struct {
+	Type      string    `json:"type"`   // "add", "remove", "update"
+	ID        string    `json:"id"`     // Caddy @id, peer key, rule ID, ...
+	Detail    string    `json:"detail"` // what kind of resource
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// driftTracker holds the mode and the drift each subsystem's last pass left
+// in place, so the API can read them while a pass runs.
+type driftTracker struct {
+	mu    sync.Mutex
+	mode  string
+	found map[string][]ObservedDrift
+}
+
+func newDriftTracker() *driftTracker {
+	return &driftTracker{mode: ModeEnforce, found: map[string][]ObservedDrift{}}
+}
+
+// SetMode sets whether passes correct drift (ModeEnforce) or only record
+// and report it (ModeObserve). In observe mode the reconciler reads Caddy,
+// WireGuard, and nftables but changes none of them: the corrections a pass
+// would make are counted as observed, listed in the status, and sent in a
+// reconcile.drift_detected event when first found. Expiry, revocation, and
+// endpoint blocking still disable tunnels in the store, leaving their peers
+// in place as drift; inactive tunnels are not revoked but listed as drift,
+// and automatic PSK rotations wait.
+func (r *Reconciler) SetMode(mode string) {
+	t := r.driftTracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mode = mode
+	if mode != ModeObserve {
+		t.found = map[string][]ObservedDrift{}
+	}
+}
+
+// Mode returns ModeEnforce or ModeObserve.
+func (r *Reconciler) Mode() string {
+	t := r.driftTracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.mode
+}
+
+func (r *Reconciler) observing() bool {
+	return r.Mode() == ModeObserve
+}
+
+// Drift returns the drift of each subsystem that the last pass found and
+// left in place in observe mode. Tunnels left unrevoked are listed with the
+// WireGuard drift.
+func (r *Reconciler) Drift() map[string][]ObservedDrift {
+	t := r.driftTracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string][]ObservedDrift, len(t.found))
+	for system, found := range t.found {
+		if system == lifecycleDrift {
+			system = SubsystemWireGuard
+		}
+		out[system] = append(out[system], found...)
+	}
+	return out
+}
+
+// recordDrift replaces the drift system reported with the observed
+// operations among ops. Drift seen for the first time is logged and sent
+// to the notifier; the rest keeps the time it was first seen.
+func (r *Reconciler) recordDrift(system string, ops []DriftOp, now time.Time) {
+	t := r.driftTracker
+	t.mu.Lock()
+	seen := make(map[string]time.Time)
+	for _, d := range t.found[system] {
+		seen[d.Type+"/"+d.ID] = d.FirstSeen
+	}
+	var found, fresh []ObservedDrift
+	for _, op := range ops {
+		if !op.Observed {
+			continue
+		}
+		d := ObservedDrift{Type: op.Type, ID: op.ID, Detail: op.Detail, FirstSeen: now}
+		if first, ok := seen[op.Type+"/"+op.ID]; ok {
+			d.FirstSeen = first
+		} else {
+			fresh = append(fresh, d)
+		}
+		found = append(found, d)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].ID != found[j].ID {
+			return found[i].ID < found[j].ID
+		}
+		return found[i].Type < found[j].Type
+	})
+	if len(found) > 0 {
+		t.found[system] = found
+	} else {
+		delete(t.found, system)
+	}
+	t.mu.Unlock()
+
+	if len(fresh) == 0 {
+		return
+	}
+	for _, d := range fresh {
+		r.logger.Warn("drift detected in "+system+", not correcting it in observe mode",
+			"type", d.Type, "id", d.ID, "detail", d.Detail)
+	}
+	r.notify(notify.Event{
+		Type: notify.EventDriftDetected, Time: now,
+		Data: map[string]interface{}{"subsystem": system, "drift": fresh},
+	})
+}
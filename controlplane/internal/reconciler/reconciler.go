@@ -2,36 +2,69 @@ package reconciler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"net/netip"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/dns"
 	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/notify"
+	"github.com/proxy-manager/controlplane/internal/sockstats"
 	"github.com/proxy-manager/controlplane/internal/store"
 	"github.com/proxy-manager/controlplane/internal/wireguard"
 )
 
-// DriftOp represents a single drift correction operation.
-type DriftOp struct {
-	Type     string // "add", "remove", "update"
-	System   string // "caddy", "wireguard", "firewall"
-	ID       string
-	Detail   string
-}
-
 // Reconciler implements the reconciliation loop.
 type Reconciler struct {
 	tunnelStore *store.TunnelStore
 	routeStore  *store.RouteStore
 	fwStore     *store.FirewallStore
+	runStore    *store.ReconcileRunStore
 	caddyClient caddy.Client
 	wgManager   *wireguard.Manager
 	fwManager   *firewall.Manager
 	interval    time.Duration
 
+	statsRetention    time.Duration
+	tunnelRetention   time.Duration // how long soft-deleted tunnels are kept; 0 deletes immediately
+	approvalTTL       time.Duration // how long tunnels wait for approval; 0 is no limit
+	inactivityWarning time.Duration
+	notifier          notify.Notifier
+	serverEndpoint    string
+	vpnServerIP       string // AllowedIPs of rotated client configs derive from these
+	vpnSubnet         string
+	dns               *dns.Updater
+	acmeIssuer        caddy.ACMEIssuer
+	isLeader          func() bool // nil when this is the only instance
+	nodes             *store.NodeStore
+	wgFallback        *store.Route  // the Caddy route of the WireGuard over TCP fallback; nil without one
+	keepalive         time.Duration // for tunnels that do not set their own
+	connectedWindow   time.Duration // for tunnels that do not set their own
+	drainTimeout      time.Duration // how long a pass may run on after shutdown
+
+	dumpConns           func() ([]sockstats.Conn, error) // lists open connections for route stats
+	routeStatsRetention time.Duration                    // 0 disables route stats
+
+	orphans  map[string]bool // IDs of routes already reported as orphaned
+	backoffs *backoffs
+
+	startupDone   bool                 // the startup report was written
+	subsystems    []Subsystem          // reconciled in order on each pass
+	lastRun       map[string]time.Time // when each scheduled subsystem, and stats collection, last ran
+	statsInterval time.Duration        // 0 collects stats on every pass
+
+	unmanagedTracker *unmanagedTracker
+	driftTracker     *driftTracker
+	caddyWatch       caddyWatch
+
 	mu        sync.Mutex
 	forceCh   chan struct{}
 	logger    *slog.Logger
@@ -47,45 +80,237 @@ func New(
 	fwManager *firewall.Manager,
 	interval time.Duration,
 ) *Reconciler {
-	return &Reconciler{
+	r := &Reconciler{
 		tunnelStore: tunnelStore,
 		routeStore:  routeStore,
 		fwStore:     fwStore,
+		runStore:    store.NewReconcileRunStore(fwStore.DB()),
 		caddyClient: caddyClient,
 		wgManager:   wgManager,
 		fwManager:   fwManager,
 		interval:    interval,
+		notifier:    notify.Nop{},
 		forceCh:     make(chan struct{}, 1),
 		logger:      slog.Default(),
+		backoffs:    newBackoffs(interval),
+		lastRun:     map[string]time.Time{},
+
+		unmanagedTracker: newUnmanagedTracker(),
+		driftTracker:     newDriftTracker(),
+
+		keepalive:       wireguard.DefaultKeepalive,
+		connectedWindow: store.DefaultConnectedThreshold,
+		drainTimeout:    DefaultDrainTimeout,
+	}
+	r.subsystems = r.builtins()
+	for _, s := range r.subsystems {
+		r.backoffs.add(s.Name())
 	}
+	return r
+}
+
+// DefaultDrainTimeout bounds how long a pass in progress at shutdown may take
+// to finish.
+const DefaultDrainTimeout = 20 * time.Second
+
+// SetDrainTimeout sets how long a pass in progress when Run's context is
+// canceled may keep running before its own context is canceled too.
+func (r *Reconciler) SetDrainTimeout(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drainTimeout = d
+}
+
+// SetStatsRetention enables per-tunnel traffic history. Each pass records a
+// sample per peer and drops samples older than d. Zero disables history.
+func (r *Reconciler) SetStatsRetention(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statsRetention = d
+}
+
+// SetTunnelRetention sets how long soft-deleted tunnels stay restorable.
+// Each pass purges tunnels deleted longer ago than d, and inactivity
+// revocation soft-deletes. Zero makes revocation delete tunnels outright.
+func (r *Reconciler) SetTunnelRetention(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tunnelRetention = d
+}
+
+// SetApprovalTTL sets how long a tunnel created with TUNNEL_APPROVAL waits
+// for an admin. Each pass discards older requests, so the PSK issued for
+// them is not kept indefinitely. Zero keeps them until an admin decides.
+func (r *Reconciler) SetApprovalTTL(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.approvalTTL = d
+}
+
+// SetPeerDefaults sets the persistent keepalive and connected threshold of
+// tunnels that do not set their own.
+func (r *Reconciler) SetPeerDefaults(keepalive, connectedThreshold time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keepalive = keepalive
+	r.connectedWindow = connectedThreshold
+}
+
+// SetNotifier sets where tunnel lifecycle events are delivered.
+func (r *Reconciler) SetNotifier(n notify.Notifier) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifier = n
+}
+
+// SetInactivityWarning sets how long before inactivity revocation or a
+// tunnel's expiry date a tunnel.expiring event is sent. Zero disables
+// warnings.
+func (r *Reconciler) SetInactivityWarning(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inactivityWarning = d
+}
+
+// SetServerEndpoint sets the public endpoint written into client configs
+// delivered with tunnel.psk_rotated events.
+func (r *Reconciler) SetServerEndpoint(endpoint string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.serverEndpoint = endpoint
+}
+
+// SetVPNNetwork sets the server's VPN IP and the VPN subnet, from which the
+// AllowedIPs of client configs delivered with tunnel.psk_rotated events are
+// derived.
+func (r *Reconciler) SetVPNNetwork(serverIP, subnet string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.vpnServerIP = serverIP
+	r.vpnSubnet = subnet
+}
+
+// SetACMEIssuer sets how Caddy obtains certificates for routes that
+// terminate TLS.
+func (r *Reconciler) SetACMEIssuer(issuer caddy.ACMEIssuer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.acmeIssuer = issuer
+}
+
+// SetWGFallback makes Caddy forward WireGuard over TCP fallback connections
+// to the server-side relay at upstream: wstunnel connections by their SNI
+// host on the shared port 443, with TLS terminated by Caddy, and udp2tcp
+// connections on a port-forward server listening on port. An empty
+// transport removes the fallback listener.
+func (r *Reconciler) SetWGFallback(transport, host string, port int, upstream string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wgFallback = nil
+	switch transport {
+	case wireguard.TransportWSTunnel:
+		// Ahead of every route, so no wildcard domain shadows it
+		r.wgFallback = &store.Route{ID: fallbackRouteID, CaddyID: caddy.ManagedID(fallbackRouteID), MatchType: "sni",
+			MatchValue: []string{host}, Upstream: upstream, Protocol: "tcp", TerminateTLS: true, Priority: math.MaxInt32, Enabled: true}
+	case wireguard.TransportUDP2TCP:
+		r.wgFallback = &store.Route{ID: fallbackRouteID, CaddyID: caddy.ManagedID(fallbackRouteID), MatchType: "port_forward",
+			ListenPort: port, Upstream: upstream, Protocol: "tcp", Enabled: true}
+	}
+}
+
+// fallbackRouteID names the WireGuard over TCP fallback listener in Caddy.
+const fallbackRouteID = "wg-fallback"
+
+// SetDNS removes the DNS records of tunnels revoked for inactivity.
+func (r *Reconciler) SetDNS(u *dns.Updater) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dns = u
+}
+
+// SetLeaderCheck makes the reconciler skip passes while isLeader reports
+// false, so only the elected instance changes Caddy, WireGuard, and
+// nftables.
+func (r *Reconciler) SetLeaderCheck(isLeader func() bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.isLeader = isLeader
+}
+
+// SetNodes lets the reconciler look up remote nodes. Tunnels and routes
+// placed on a node are applied by its agent, never to this host.
+func (r *Reconciler) SetNodes(nodes *store.NodeStore) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes = nodes
 }
 
 // Run starts the reconciliation loop. It runs an immediate reconciliation first,
-// then continues on a timer. It stops when the context is canceled.
+// then continues on a timer. It stops when the context is canceled, after the
+// pass in progress has finished, and records the "shutdown" status.
 func (r *Reconciler) Run(ctx context.Context) {
 	r.logger.Info("running initial reconciliation")
-	r.reconcileOnce(ctx)
+	r.reconcileOnce(ctx, false)
 
-	ticker := time.NewTicker(r.interval)
+	r.mu.Lock()
+	tick := r.tickInterval()
+	r.mu.Unlock()
+	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
+			r.recordShutdown()
 			r.logger.Info("reconciliation loop stopped")
 			return
 		case <-ticker.C:
-			r.reconcileOnce(ctx)
+			r.reconcileOnce(ctx, false)
 		case <-r.forceCh:
 			r.logger.Info("forced reconciliation triggered")
-			r.reconcileOnce(ctx)
+			r.reconcileOnce(ctx, true)
 			// Reset the ticker after a forced reconciliation
-			ticker.Reset(r.interval)
+			ticker.Reset(tick)
 		}
 	}
 }
 
-// ForceReconcile triggers an immediate reconciliation outside the regular timer.
+// drainContext returns a context for one pass that outlives ctx by up to the
+// drain timeout. Call release when the pass is done.
+func (r *Reconciler) drainContext(ctx context.Context) (pass context.Context, release func()) {
+	pass, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	timeout := r.drainTimeout
+	stop := context.AfterFunc(ctx, func() {
+		r.logger.Info("shutting down, finishing the reconciliation in progress", "timeout", timeout)
+		select {
+		case <-pass.Done():
+		case <-time.After(timeout):
+			r.logger.Warn("reconciliation did not finish in time, canceling it")
+			cancel()
+		}
+	})
+	return pass, func() {
+		stop()
+		cancel()
+	}
+}
+
+// recordShutdown sets the reconciliation status to "shutdown", keeping the
+// error of the last pass if it failed.
+func (r *Reconciler) recordShutdown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var lastErr *string
+	if rs, err := r.fwStore.GetReconciliationState(); err == nil && rs.LastStatus == "error" {
+		lastErr = &rs.LastError
+	}
+	if err := r.fwStore.UpdateReconciliationState("shutdown", lastErr, 0); err != nil {
+		r.logger.Error("failed to record shutdown", "error", err)
+	}
+}
+
+// ForceReconcile triggers an immediate reconciliation outside the regular
+// timer. Forced passes also retry subsystems that are backing off.
 func (r *Reconciler) ForceReconcile() {
 	select {
 	case r.forceCh <- struct{}{}:
@@ -94,83 +319,193 @@ func (r *Reconciler) ForceReconcile() {
 	}
 }
 
-func (r *Reconciler) reconcileOnce(ctx context.Context) {
+// Reconcile runs one reconciliation pass and returns when it is done. Node
+// agents call it after refreshing their local store instead of running the
+// timer loop.
+func (r *Reconciler) Reconcile(ctx context.Context) {
+	r.reconcileOnce(ctx, false)
+}
+
+// Subsystems returns the failure state of each subsystem, by name: the
+// built-in ones and those added with Register. One not reconciled yet has
+// a zero state.
+func (r *Reconciler) Subsystems() map[string]SubsystemStatus {
+	return r.backoffs.snapshot()
+}
+
+// attempt reconciles one subsystem and records the outcome. Unless force is
+// set it skips a subsystem that is backing off and returns the error that
+// put it there. Individual operations that failed make the subsystem's pass
+// an error too, but do not back it off: the rest of its operations went
+// through. It returns the subsystem's corrections with their counts.
+func (r *Reconciler) attempt(ctx context.Context, s Subsystem, force bool, now time.Time) ([]DriftOp, store.OpCounts, error) {
+	system := s.Name()
+	if !force {
+		if s, ok := r.backoffs.skip(system, now); ok {
+			r.logger.Debug("backing off, skipping "+system+" reconciliation",
+				"consecutive_failures", s.ConsecutiveFailures, "retry_at", s.RetryAt)
+			return nil, store.OpCounts{}, fmt.Errorf("%s (failed %d times, next attempt at %s)",
+				s.LastError, s.ConsecutiveFailures, s.RetryAt.UTC().Format(time.RFC3339))
+		}
+	}
+
+	r.lastRun[system] = now
+	ops, err := s.Reconcile(ctx)
+	r.recordDrift(system, ops, now)
+	ok, seen := succeeded(ops), observed(ops)
+	counts := store.OpCounts{Attempted: len(ops) - seen, Succeeded: ok, Failed: len(ops) - seen - ok, Observed: seen}
+	failures := r.backoffs.snapshot()[system].ConsecutiveFailures
+	delay := r.backoffs.record(system, err, now)
+	switch {
+	case err != nil:
+		r.logger.Error(system+" reconciliation failed", "error", err,
+			"consecutive_failures", failures+1, "retry_in", delay)
+	case failures > 0:
+		r.logger.Info(system+" reconciliation recovered", "after_failures", failures)
+	}
+	if err == nil && counts.Failed > 0 {
+		err = fmt.Errorf("%d of %d operations failed", counts.Failed, counts.Attempted)
+	}
+	return ops, counts, err
+}
+
+func (r *Reconciler) reconcileOnce(ctx context.Context, force bool) {
+	if ctx.Err() != nil {
+		return
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	// A pass interrupted half-way can leave Caddy and nftables partly
+	// updated, so shutdown lets it finish within the drain timeout
+	ctx, release := r.drainContext(ctx)
+	defer release()
+
+	if r.isLeader != nil && !r.isLeader() {
+		r.logger.Debug("standby, skipping reconciliation")
+		return
+	}
+
 	startTime := time.Now()
-	var totalOps int
+	var total store.OpCounts
 	var reconcileErr error
+	subsystems := map[string]store.OpCounts{}
+
+	// The first pass of the process compares the database with Caddy and
+	// the kernel like any other, and is kept as the startup report
+	startup := r.newStartupPass()
 
 	defer func() {
+		if len(subsystems) == 0 {
+			// No subsystem was due, as on a tick that only collects stats;
+			// the last reconciliation's status stands
+			return
+		}
+		run := &store.ReconcileRun{
+			StartedAt:  startTime,
+			Duration:   time.Since(startTime),
+			Status:     "ok",
+			Ops:        total,
+			Subsystems: subsystems,
+		}
 		if reconcileErr != nil {
-			errMsg := reconcileErr.Error()
-			r.fwStore.UpdateReconciliationState("error", &errMsg, 0)
-		} else if totalOps > 0 {
-			r.fwStore.UpdateReconciliationState("drift_corrected", nil, totalOps)
+			run.Status = "error"
+			run.Error = reconcileErr.Error()
+			r.fwStore.UpdateReconciliationState("error", &run.Error, total.Succeeded)
+		} else if total.Succeeded > 0 {
+			run.Status = "drift_corrected"
+			r.fwStore.UpdateReconciliationState("drift_corrected", nil, total.Succeeded)
+		} else if total.Observed > 0 {
+			run.Status = "drift_detected"
+			r.fwStore.UpdateReconciliationState("drift_detected", nil, 0)
 		} else {
 			r.fwStore.UpdateReconciliationState("ok", nil, 0)
 		}
+		if err := r.runStore.Record(run); err != nil {
+			r.logger.Error("failed to record reconcile run", "error", err)
+		}
+		if startup != nil {
+			r.saveStartup(startup, run)
+		}
 	}()
 
-	// 1. Reconcile Caddy L4 routes
-	caddyOps, err := r.reconcileCaddy(ctx)
-	if err != nil {
-		r.logger.Error("caddy reconciliation failed", "error", err)
-		reconcileErr = fmt.Errorf("caddy: %w", err)
-		// Continue with other systems
-	}
-	totalOps += caddyOps
+	// Delete routes past their TTL first, so this pass removes them from
+	// Caddy and the nodes
+	r.expireRoutes(time.Now())
 
-	// 2. Reconcile WireGuard peers
-	wgOps, err := r.reconcileWireGuard()
-	if err != nil {
-		r.logger.Error("wireguard reconciliation failed", "error", err)
-		if reconcileErr == nil {
-			reconcileErr = fmt.Errorf("wireguard: %w", err)
+	// 1. Reconcile each subsystem that is due: Caddy L4 routes, WireGuard
+	// peers, then nftables (firewall rules, automatic bans, peer isolation,
+	// and route counters), then any registered ones. A failing subsystem
+	// does not stop the others.
+	var summary []any
+	for _, s := range r.subsystems {
+		if !force && !r.due(s, startTime) {
+			continue
+		}
+		ops, counts, err := r.attempt(ctx, s, force, startTime)
+		startup.add(s.Name(), ops, err)
+		if err != nil && reconcileErr == nil {
+			reconcileErr = fmt.Errorf("%s: %w", s.Name(), err)
 		}
+		subsystems[s.Name()] = counts
+		total = total.Add(counts)
+		summary = append(summary, s.Name()+"_ops", counts.Succeeded)
 	}
-	totalOps += wgOps
 
-	// 3. Reconcile firewall rules
-	fwOps, err := r.reconcileFirewall()
-	if err != nil {
-		r.logger.Error("firewall reconciliation failed", "error", err)
-		if reconcileErr == nil {
-			reconcileErr = fmt.Errorf("firewall: %w", err)
-		}
+	// 2. Update peer and route stats from kernel
+	if force || r.dueEvery(statsRun, r.statsInterval, startTime) {
+		r.lastRun[statsRun] = startTime
+		r.updatePeerStats()
+		r.updateRouteStats()
 	}
-	totalOps += fwOps
 
-	// 4. Update peer stats from kernel
-	r.updatePeerStats()
+	// 3. Check rotation policies. The revocations observe mode leaves out
+	// count as WireGuard drift in a pass that reconciled something.
+	lifecycle := r.checkRotations()
+	r.recordDrift(lifecycleDrift, lifecycle, startTime)
+	if seen := observed(lifecycle); seen > 0 && len(subsystems) > 0 {
+		counts := store.OpCounts{Observed: seen}
+		subsystems[SubsystemWireGuard] = subsystems[SubsystemWireGuard].Add(counts)
+		total = total.Add(counts)
+	}
+
+	// 4. Purge soft-deleted tunnels past retention
+	r.purgeDeletedTunnels(time.Now())
 
-	// 5. Check rotation policies
-	r.checkRotations()
+	// 5. Discard approval requests past their TTL
+	r.expirePendingApprovals(time.Now())
+
+	// 6. Report routes whose tunnel is missing
+	r.checkOrphanedRoutes()
 
 	duration := time.Since(startTime)
-	if totalOps > 0 {
-		r.logger.Info("drift corrected",
-			"caddy_ops", caddyOps,
-			"wg_ops", wgOps,
-			"fw_ops", fwOps,
-			"duration", duration)
+	if total.Attempted > 0 {
+		r.logger.Info("drift corrected", append(summary,
+			"failed_ops", total.Failed,
+			"duration", duration)...)
+	} else if total.Observed > 0 {
+		r.logger.Info("drift detected, left in place in observe mode",
+			"observed_ops", total.Observed, "duration", duration)
 	} else {
 		r.logger.Debug("reconciliation complete, no drift", "duration", duration)
 	}
 }
 
-func (r *Reconciler) reconcileCaddy(ctx context.Context) (int, error) {
+func (r *Reconciler) reconcileCaddy(ctx context.Context) ([]DriftOp, error) {
 	// Read desired state from SQLite
 	desiredRoutes, err := r.routeStore.ListEnabled()
 	if err != nil {
-		return 0, fmt.Errorf("list desired routes: %w", err)
+		return nil, fmt.Errorf("list desired routes: %w", err)
+	}
+	desiredRoutes = localRoutes(desiredRoutes)
+	if r.wgFallback != nil {
+		desiredRoutes = append(desiredRoutes, r.wgFallback)
 	}
 
 	// Read actual state from Caddy
 	actualConfig, err := r.caddyClient.GetL4Config(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("get caddy config: %w", err)
+		return nil, fmt.Errorf("get caddy config: %w", err)
 	}
 
 	// Separate desired routes by type
@@ -184,14 +519,32 @@ func (r *Reconciler) reconcileCaddy(ctx context.Context) (int, error) {
 		}
 	}
 
-	var ops int
+	d := r.newDrift(SubsystemCaddy)
 
 	// --- Reconcile SNI routes (shared "proxy" server) ---
+	// Caddy matches routes in list order, so the desired order is part of
+	// the desired state.
+	sortSNIRoutes(sniRoutes)
+
+	owned, err := r.ownedCaddyIDs()
+	if err != nil {
+		return nil, err
+	}
+	pass := r.unmanaged(SubsystemCaddy)
+
+	// Routes without an @id were never the control plane's; routes with
+	// one it did not create follow the unmanaged policy. Both are kept
+	// after the managed routes.
+	var actualOrder []string
+	var unmanaged []caddy.CaddyRoute
 	actualSNIRouteIDs := make(map[string]caddy.CaddyRoute)
 	if proxyServer, ok := actualConfig.Servers["proxy"]; ok {
 		for _, route := range proxyServer.Routes {
-			if route.ID != "" {
+			if route.ID != "" && (owned(route.ID) || !pass.keep("route", route.ID)) {
 				actualSNIRouteIDs[route.ID] = route
+				actualOrder = append(actualOrder, route.ID)
+			} else {
+				unmanaged = append(unmanaged, route)
 			}
 		}
 	}
@@ -204,86 +557,235 @@ func (r *Reconciler) reconcileCaddy(ctx context.Context) (int, error) {
 	// Ensure the proxy server exists if there are SNI routes
 	if len(sniRoutes) > 0 {
 		if _, exists := actualConfig.Servers["proxy"]; !exists {
-			if err := r.caddyClient.CreateServer(ctx); err != nil {
-				return 0, fmt.Errorf("create caddy server: %w", err)
+			if err := d.apply("add", "proxy", "server", func() error { return r.caddyClient.CreateServer(ctx) }); err != nil {
+				return nil, fmt.Errorf("create caddy server: %w", err)
 			}
-			ops++
 		}
 	}
 
-	// Add missing SNI routes
-	for caddyID, desired := range desiredSNIMap {
-		if _, exists := actualSNIRouteIDs[caddyID]; !exists {
-			route := caddy.BuildCaddyRoute(caddyID, desired.MatchValue, desired.Upstream)
-			if err := r.caddyClient.AddRoute(ctx, route); err != nil {
-				r.logger.Error("failed to add caddy route", "caddy_id", caddyID, "error", err)
+	// Remove extra SNI routes
+	removed := make(map[string]bool)
+	for caddyID := range actualSNIRouteIDs {
+		if _, exists := desiredSNIMap[caddyID]; !exists {
+			if err := d.apply("remove", caddyID, "route", func() error { return r.caddyClient.DeleteRoute(ctx, caddyID) }); err != nil {
+				d.failed("remove", caddyID, err, "failed to delete caddy route", "caddy_id", caddyID)
 				continue
 			}
-			ops++
+			removed[caddyID] = true
 		}
 	}
 
-	// Remove extra SNI routes
-	for caddyID := range actualSNIRouteIDs {
-		if _, exists := desiredSNIMap[caddyID]; !exists {
-			if err := r.caddyClient.DeleteRoute(ctx, caddyID); err != nil {
-				r.logger.Error("failed to delete caddy route", "caddy_id", caddyID, "error", err)
+	// Update SNI routes whose domains, upstream, or options changed in the
+	// store; a PATCH by @id keeps each route's place in the list
+	for _, desired := range sniRoutes {
+		actual, exists := actualSNIRouteIDs[desired.CaddyID]
+		if !exists {
+			continue
+		}
+		route := caddy.BuildCaddyRoute(desired.CaddyID, desired.MatchValue, desired.Upstream, desired.ProxyProtocol, desired.TerminateTLS)
+		if caddy.RoutesEqual(actual, route) {
+			continue
+		}
+		if err := d.apply("update", desired.CaddyID, "route", func() error { return r.caddyClient.UpdateRoute(ctx, route) }); err != nil {
+			d.failed("update", desired.CaddyID, err, "failed to update caddy route", "caddy_id", desired.CaddyID)
+		}
+	}
+
+	// Add missing SNI routes; Caddy appends them to the end of the list
+	var resultOrder []string
+	for _, id := range actualOrder {
+		if !removed[id] {
+			resultOrder = append(resultOrder, id)
+		}
+	}
+	for _, desired := range sniRoutes {
+		if _, exists := actualSNIRouteIDs[desired.CaddyID]; !exists {
+			route := caddy.BuildCaddyRoute(desired.CaddyID, desired.MatchValue, desired.Upstream, desired.ProxyProtocol, desired.TerminateTLS)
+			if err := d.apply("add", desired.CaddyID, "route", func() error { return r.caddyClient.AddRoute(ctx, route) }); err != nil {
+				d.failed("add", desired.CaddyID, err, "failed to add caddy route", "caddy_id", desired.CaddyID)
 				continue
 			}
-			ops++
+			resultOrder = append(resultOrder, desired.CaddyID)
+		}
+	}
+
+	// Rewrite the route list if it is out of priority order
+	if !sameOrder(resultOrder, sniRoutes) {
+		routes := make([]caddy.CaddyRoute, 0, len(sniRoutes)+len(unmanaged))
+		for _, desired := range sniRoutes {
+			routes = append(routes, caddy.BuildCaddyRoute(desired.CaddyID, desired.MatchValue, desired.Upstream, desired.ProxyProtocol, desired.TerminateTLS))
+		}
+		routes = append(routes, unmanaged...)
+		if err := d.apply("update", "proxy", "route order", func() error { return r.caddyClient.ReplaceRoutes(ctx, routes) }); err != nil {
+			d.failed("update", "proxy", err, "failed to reorder caddy routes")
 		}
 	}
 
+	// --- Reconcile QUIC routes paired with SNI routes ("quic" server) ---
+	actualQUICRouteIDs := make(map[string]caddy.CaddyRoute)
+	if quicServer, ok := actualConfig.Servers[caddy.QUICServerName]; ok {
+		for _, route := range quicServer.Routes {
+			if route.ID != "" && (owned(route.ID) || !pass.keep("route", route.ID)) {
+				actualQUICRouteIDs[route.ID] = route
+			}
+		}
+	}
+
+	desiredQUICMap := make(map[string]*store.Route)
+	for _, route := range sniRoutes {
+		if route.QUIC {
+			desiredQUICMap[caddy.QUICRouteID(route.CaddyID)] = route
+		}
+	}
+
+	if len(desiredQUICMap) > 0 {
+		if _, exists := actualConfig.Servers[caddy.QUICServerName]; !exists {
+			if err := d.apply("add", caddy.QUICServerName, "server", func() error { return r.caddyClient.CreateQUICServer(ctx) }); err != nil {
+				return d.ops, fmt.Errorf("create caddy quic server: %w", err)
+			}
+		}
+	}
+
+	for quicID, desired := range desiredQUICMap {
+		route := caddy.BuildQUICRoute(desired.CaddyID, desired.MatchValue, desired.Upstream)
+		actual, exists := actualQUICRouteIDs[quicID]
+		switch {
+		case !exists:
+			if err := d.apply("add", quicID, "quic route", func() error { return r.caddyClient.AddQUICRoute(ctx, route) }); err != nil {
+				d.failed("add", quicID, err, "failed to add caddy quic route", "caddy_id", quicID)
+			}
+		case !caddy.RoutesEqual(actual, route):
+			if err := d.apply("update", quicID, "quic route", func() error { return r.caddyClient.UpdateRoute(ctx, route) }); err != nil {
+				d.failed("update", quicID, err, "failed to update caddy quic route", "caddy_id", quicID)
+			}
+		}
+	}
+
+	for quicID := range actualQUICRouteIDs {
+		if _, exists := desiredQUICMap[quicID]; !exists {
+			if err := d.apply("remove", quicID, "quic route", func() error { return r.caddyClient.DeleteRoute(ctx, quicID) }); err != nil {
+				d.failed("remove", quicID, err, "failed to delete caddy quic route", "caddy_id", quicID)
+			}
+		}
+	}
+
+	// --- Reconcile certificates for routes that terminate TLS (tls app) ---
+	var tlsSubjects []string
+	for _, route := range sniRoutes {
+		if route.TerminateTLS {
+			tlsSubjects = append(tlsSubjects, route.MatchValue...)
+		}
+	}
+	sort.Strings(tlsSubjects)
+	syncCerts := r.caddyClient.SyncManagedCertificates
+	if d.observe {
+		syncCerts = r.caddyClient.CheckManagedCertificates
+	}
+	if changed, err := syncCerts(ctx, tlsSubjects, r.acmeIssuer); err != nil {
+		d.failed("update", "tls", err, "failed to sync caddy managed certificates")
+	} else if changed {
+		d.done("update", "tls", "managed certificates")
+	}
+
 	// --- Reconcile port-forward servers (pf-* servers) ---
-	desiredPFServers := make(map[string]*store.Route)
+	desiredPFServers := make(map[string]caddy.PortForwardServer)
 	for _, route := range pfRoutes {
-		serverName := caddy.PortForwardServerName(route.ListenPort, route.Protocol)
-		desiredPFServers[serverName] = route
+		for _, server := range caddy.PortForwardServers(route.CaddyID, route.ListenPort, route.ListenPortEnd, route.Protocol, route.Upstream, route.ProxyProtocol) {
+			desiredPFServers[server.Name] = server
+		}
 	}
 
-	// Find actual pf-* servers
-	actualPFServers := make(map[string]bool)
-	for name := range actualConfig.Servers {
-		if strings.HasPrefix(name, "pf-") {
-			actualPFServers[name] = true
+	// Find actual pf-* servers. One is the control plane's if it holds a
+	// route the control plane created; the others follow the unmanaged
+	// policy.
+	actualPFServers := make(map[string]*caddy.L4Server)
+	keptPFServers := make(map[string]bool)
+	for name, server := range actualConfig.Servers {
+		if !strings.HasPrefix(name, "pf-") {
+			continue
+		}
+		if slices.ContainsFunc(server.Routes, func(route caddy.CaddyRoute) bool { return owned(route.ID) }) || !pass.keep("server", name) {
+			actualPFServers[name] = server
+		} else {
+			keptPFServers[name] = true
 		}
 	}
 
-	// Add missing port-forward servers
+	// Add missing port-forward servers (all of them after a Caddy restart)
+	// and rewrite those whose upstream or options changed; the PUT replaces
+	// a server wholesale, so one configured by hand is never overwritten
 	for serverName, desired := range desiredPFServers {
-		if !actualPFServers[serverName] {
-			listenAddr := caddy.FormatListenAddr(desired.ListenPort, desired.Protocol)
-			if err := r.caddyClient.CreatePortForwardServer(ctx, serverName, listenAddr, desired.Upstream, desired.CaddyID); err != nil {
-				r.logger.Error("failed to create port-forward server", "server", serverName, "error", err)
-				continue
-			}
-			ops++
+		if desired.Matches(actualPFServers[serverName]) {
+			continue
+		}
+		if keptPFServers[serverName] {
+			d.failed("add", serverName, errNotManaged, "port-forward server is configured outside the control plane", "server", serverName, "caddy_id", desired.CaddyID)
+			continue
+		}
+		if err := d.apply("add", serverName, "port-forward server", func() error {
+			return r.caddyClient.CreatePortForwardServer(ctx, serverName, desired.ListenAddr, desired.Upstream, desired.CaddyID, desired.ProxyProtocol)
+		}); err != nil {
+			d.failed("add", serverName, err, "failed to create port-forward server", "server", serverName)
 		}
 	}
 
 	// Remove extra port-forward servers
 	for serverName := range actualPFServers {
 		if _, exists := desiredPFServers[serverName]; !exists {
-			if err := r.caddyClient.DeleteServer(ctx, serverName); err != nil {
-				r.logger.Error("failed to delete port-forward server", "server", serverName, "error", err)
-				continue
+			if err := d.apply("remove", serverName, "port-forward server", func() error { return r.caddyClient.DeleteServer(ctx, serverName) }); err != nil {
+				d.failed("remove", serverName, err, "failed to delete port-forward server", "server", serverName)
 			}
-			ops++
 		}
 	}
 
-	return ops, nil
+	r.finishUnmanaged(pass, time.Now())
+	r.caddySynced(ctx, actualConfig, succeeded(d.ops))
+	return d.ops, nil
 }
 
-func (r *Reconciler) reconcileWireGuard() (int, error) {
+// ownedCaddyIDs returns whether a Caddy route @id was created by the
+// control plane: it carries the control plane's tag, belongs to a route in
+// the store, such as an imported one, or is the retired untagged @id of a
+// route created before tagging.
+func (r *Reconciler) ownedCaddyIDs() (func(id string) bool, error) {
+	routes, err := r.routeStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("list routes: %w", err)
+	}
+	retired, err := r.routeStore.RetiredCaddyIDs()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(routes)+2*len(retired))
+	for _, id := range retired {
+		known[id] = true
+		known[caddy.QUICRouteID(id)] = true
+	}
+	for _, route := range routes {
+		if route.MatchType == "port_forward" {
+			for _, server := range caddy.PortForwardServers(route.CaddyID, route.ListenPort, route.ListenPortEnd, route.Protocol, route.Upstream, route.ProxyProtocol) {
+				known[server.CaddyID] = true
+			}
+			continue
+		}
+		known[route.CaddyID] = true
+		known[caddy.QUICRouteID(route.CaddyID)] = true
+	}
+	return func(id string) bool {
+		return id != "" && (known[id] || caddy.IsManagedID(id))
+	}, nil
+}
+
+func (r *Reconciler) reconcileWireGuard() ([]DriftOp, error) {
 	desiredPeers, err := r.tunnelStore.ListEnabled()
 	if err != nil {
-		return 0, fmt.Errorf("list desired peers: %w", err)
+		return nil, fmt.Errorf("list desired peers: %w", err)
 	}
+	desiredPeers = localTunnels(desiredPeers)
 
 	actualPeers, err := r.wgManager.ListPeers()
 	if err != nil {
-		return 0, fmt.Errorf("list actual peers: %w", err)
+		return nil, fmt.Errorf("list actual peers: %w", err)
 	}
 
 	// Build maps
@@ -297,68 +799,233 @@ func (r *Reconciler) reconcileWireGuard() (int, error) {
 		actualMap[p.PublicKey] = p
 	}
 
-	var ops int
+	// Changes are collected and applied in one batch. pendingPSK maps the
+	// key of each peer given a pending PSK to its tunnel.
+	var changes []wireguard.PeerConfig
+	pendingPSK := make(map[string]string)
 
-	// Add missing peers
+	// Add missing peers and fix changed keepalives and advertised routes
 	for pubkey, desired := range desiredMap {
-		if _, exists := actualMap[pubkey]; !exists {
-			// We don't have the PSK in the store (only the hash), so we can only
-			// re-add without PSK on reconciliation. The PSK is set at creation time only.
-			if err := r.wgManager.AddPeer(pubkey, "", desired.VpnIP); err != nil {
-				r.logger.Error("failed to add wg peer", "pubkey", pubkey, "error", err)
-				continue
-			}
-			ops++
+		keepalive := desired.Keepalive(r.keepalive)
+		actual, exists := actualMap[pubkey]
+		if exists && actual.Keepalive == keepalive &&
+			sameAllowedIPs(actual.AllowedIPs, wireguard.PeerAllowedIPs(desired.VpnIP, desired.AdvertisedRoutes)) {
+			continue
+		}
+		// We don't have the PSK in the store (only the hash), so we can only
+		// re-add without PSK on reconciliation. The PSK is set at creation time only.
+		// Updating an existing peer without one keeps its PSK. An approved
+		// tunnel whose peer could not be added yet still holds its PSK.
+		psk := ""
+		if !exists {
+			psk = desired.PendingPSK
+		}
+		changes = append(changes, wireguard.PeerConfig{
+			PublicKey: pubkey,
+			PSK:       psk,
+			VpnIP:     desired.VpnIP,
+			Routes:    desired.AdvertisedRoutes,
+			Keepalive: keepalive,
+		})
+		if psk != "" {
+			pendingPSK[pubkey] = desired.ID
 		}
 	}
 
-	// Remove extra peers
+	// Remove extra peers. Peers whose key the store never held were not
+	// created by the control plane and follow the unmanaged policy.
+	known, err := r.tunnelStore.KnownPublicKeys()
+	if err != nil {
+		return r.applyPeers(changes, pendingPSK), err
+	}
+	pass := r.unmanaged(SubsystemWireGuard)
 	for pubkey := range actualMap {
 		if _, exists := desiredMap[pubkey]; !exists {
-			if err := r.wgManager.RemovePeer(pubkey); err != nil {
-				r.logger.Error("failed to remove wg peer", "pubkey", pubkey, "error", err)
+			if !known[pubkey] && pass.keep("peer", pubkey) {
+				continue
+			}
+			changes = append(changes, wireguard.PeerConfig{PublicKey: pubkey, Remove: true})
+		}
+	}
+
+	ops := r.applyPeers(changes, pendingPSK)
+	r.finishUnmanaged(pass, time.Now())
+	return ops, nil
+}
+
+// applyPeers applies the peer changes in a single batch. If the batch
+// fails, they are applied one at a time so a bad peer does not hold back
+// the others. The pending PSKs of the peers that were added are cleared.
+// In observe mode the changes are only recorded.
+func (r *Reconciler) applyPeers(changes []wireguard.PeerConfig, pendingPSK map[string]string) []DriftOp {
+	if len(changes) == 0 {
+		return nil
+	}
+	d := r.newDrift(SubsystemWireGuard)
+	if d.observe {
+		for _, c := range changes {
+			if c.Remove {
+				d.done("remove", c.PublicKey, "peer")
+			} else {
+				d.done("add", c.PublicKey, "peer")
+			}
+		}
+		return d.ops
+	}
+	applied := changes
+	if err := r.wgManager.ApplyPeers(changes); err != nil {
+		r.logger.Warn("batched wg peer update failed, applying peers one at a time", "peers", len(changes), "error", err)
+		applied = nil
+		for _, c := range changes {
+			if c.Remove {
+				if err := r.wgManager.RemovePeer(c.PublicKey); err != nil {
+					d.failed("remove", c.PublicKey, err, "failed to remove wg peer", "pubkey", c.PublicKey)
+					continue
+				}
+			} else if err := r.wgManager.AddPeer(c.PublicKey, c.PSK, c.VpnIP, c.Routes, c.Keepalive); err != nil {
+				d.failed("add", c.PublicKey, err, "failed to add wg peer", "pubkey", c.PublicKey)
 				continue
 			}
-			ops++
+			applied = append(applied, c)
 		}
 	}
 
+	for _, c := range applied {
+		if c.Remove {
+			d.done("remove", c.PublicKey, "peer")
+			continue
+		}
+		d.done("add", c.PublicKey, "peer")
+		if id, ok := pendingPSK[c.PublicKey]; ok {
+			if err := r.tunnelStore.SetPendingPSK(id, ""); err != nil {
+				r.logger.Error("failed to clear applied PSK", "id", id, "error", err)
+			}
+		}
+	}
+	return d.ops
+}
+
+// sameAllowedIPs reports whether two AllowedIPs lists hold the same
+// prefixes, in any order.
+func sameAllowedIPs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// reconcileNFTables applies firewall rules, bans, peer isolation, upstream
+// port restrictions, services, and route counters, which back off together
+// since they share nftables. Each part runs even if an earlier one failed;
+// the errors are joined.
+func (r *Reconciler) reconcileNFTables() ([]DriftOp, error) {
+	var (
+		ops  []DriftOp
+		errs []string
+	)
+	part, err := r.reconcileFirewall(time.Now())
+	ops = append(ops, part...)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	part, err = r.reconcileBans(time.Now())
+	ops = append(ops, part...)
+	if err != nil {
+		errs = append(errs, "bans: "+err.Error())
+	}
+	part, err = r.reconcileIsolation()
+	ops = append(ops, part...)
+	if err != nil {
+		errs = append(errs, "isolation: "+err.Error())
+	}
+	part, err = r.reconcileUpstreamPorts()
+	ops = append(ops, part...)
+	if err != nil {
+		errs = append(errs, "upstream ports: "+err.Error())
+	}
+	part, err = r.reconcileServices()
+	ops = append(ops, part...)
+	if err != nil {
+		errs = append(errs, "services: "+err.Error())
+	}
+	part, err = r.reconcileRouteCounters()
+	ops = append(ops, part...)
+	if err != nil {
+		errs = append(errs, "route counters: "+err.Error())
+	}
+	if len(errs) > 0 {
+		return ops, errors.New(strings.Join(errs, "; "))
+	}
 	return ops, nil
 }
 
-func (r *Reconciler) reconcileFirewall() (int, error) {
-	desiredRules, err := r.fwStore.ListEnabled()
+// reconcileFirewall makes the API rules in nftables match the enabled rules
+// whose active hours include now, so scheduled rules are added and removed
+// within one pass of their window opening and closing.
+func (r *Reconciler) reconcileFirewall(now time.Time) ([]DriftOp, error) {
+	enabledRules, err := r.fwStore.ListEnabled()
 	if err != nil {
-		return 0, fmt.Errorf("list desired fw rules: %w", err)
+		return nil, fmt.Errorf("list desired fw rules: %w", err)
+	}
+	var desiredRules []*store.FirewallRule
+	for _, rule := range enabledRules {
+		if rule.InActiveHours(now) {
+			desiredRules = append(desiredRules, rule)
+		}
 	}
 
 	actualRules, err := r.fwManager.ListRules()
 	if err != nil {
-		return 0, fmt.Errorf("list actual fw rules: %w", err)
+		return nil, fmt.Errorf("list actual fw rules: %w", err)
 	}
 
+	// Rules the control plane did not create follow the unmanaged policy
+	storedRules, err := r.fwStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("list fw rules: %w", err)
+	}
+	known := make(map[string]bool, len(storedRules))
+	for _, rule := range storedRules {
+		known[rule.ID] = true
+	}
+	pass := r.unmanaged(SubsystemFirewall)
+
 	// Build maps by composite key
 	type ruleKey struct {
 		Port       int
 		Proto      string
+		Chain      string
 		Direction  string
 		SourceCIDR string
+		DestCIDR   string
 		Action     string
 	}
+	chainOf := func(chain string) string {
+		if chain == "" {
+			return firewall.ChainInput
+		}
+		return chain
+	}
 
 	desiredMap := make(map[ruleKey]*store.FirewallRule)
 	for _, r := range desiredRules {
-		key := ruleKey{r.Port, r.Proto, r.Direction, r.SourceCIDR, r.Action}
+		key := ruleKey{r.Port, r.Proto, chainOf(r.Chain), r.Direction, r.SourceCIDR, r.DestCIDR, r.Action}
 		desiredMap[key] = r
 	}
 
 	actualMap := make(map[ruleKey]firewall.Rule)
 	for _, r := range actualRules {
-		key := ruleKey{r.Port, r.Proto, r.Direction, r.SourceCIDR, r.Action}
+		if !known[r.ID] && !strings.HasPrefix(r.ID, "fw_rule_") && pass.keep("firewall_rule", r.ID) {
+			continue
+		}
+		key := ruleKey{r.Port, r.Proto, chainOf(r.Chain), r.Direction, r.SourceCIDR, r.DestCIDR, r.Action}
 		actualMap[key] = r
 	}
 
-	var ops int
+	d := r.newDrift(SubsystemFirewall)
 
 	// Add missing rules
 	for key, desired := range desiredMap {
@@ -367,30 +1034,241 @@ func (r *Reconciler) reconcileFirewall() (int, error) {
 				ID:         desired.ID,
 				Port:       desired.Port,
 				Proto:      desired.Proto,
+				Chain:      desired.Chain,
 				Direction:  desired.Direction,
 				SourceCIDR: desired.SourceCIDR,
+				DestCIDR:   desired.DestCIDR,
 				Action:     desired.Action,
 			}
-			if err := r.fwManager.AddRule(fwRule); err != nil {
-				r.logger.Error("failed to add fw rule", "id", desired.ID, "error", err)
-				continue
+			if err := d.apply("add", desired.ID, "rule", func() error { return r.fwManager.AddRule(fwRule) }); err != nil {
+				d.failed("add", desired.ID, err, "failed to add fw rule", "id", desired.ID)
 			}
-			ops++
 		}
 	}
 
 	// Remove extra rules
 	for key, actual := range actualMap {
 		if _, exists := desiredMap[key]; !exists {
-			if err := r.fwManager.DeleteRule(actual.ID); err != nil {
-				r.logger.Error("failed to delete fw rule", "id", actual.ID, "error", err)
-				continue
+			if err := d.apply("remove", actual.ID, "rule", func() error { return r.fwManager.DeleteRule(actual.ID) }); err != nil {
+				d.failed("remove", actual.ID, err, "failed to delete fw rule", "id", actual.ID)
 			}
-			ops++
 		}
 	}
 
-	return ops, nil
+	r.finishUnmanaged(pass, now)
+	return d.ops, nil
+}
+
+// reconcileBans expires bans that ran out and makes the nftables ban rules
+// match the active ones.
+func (r *Reconciler) reconcileBans(now time.Time) ([]DriftOp, error) {
+	if n, err := r.fwStore.DeleteExpiredBans(now); err != nil {
+		return nil, fmt.Errorf("delete expired bans: %w", err)
+	} else if n > 0 {
+		r.logger.Info("expired automatic bans", "count", n)
+	}
+
+	bans, err := r.fwStore.ListBans(now)
+	if err != nil {
+		return nil, fmt.Errorf("list desired bans: %w", err)
+	}
+	actual, err := r.fwManager.ListBans()
+	if err != nil {
+		return nil, fmt.Errorf("list actual bans: %w", err)
+	}
+
+	desired := make(map[string]bool, len(bans))
+	for _, b := range bans {
+		desired[b.IP] = true
+	}
+	actualSet := make(map[string]bool, len(actual))
+	for _, ip := range actual {
+		actualSet[ip] = true
+	}
+
+	d := r.newDrift(SubsystemFirewall)
+	for ip := range desired {
+		if !actualSet[ip] {
+			if err := d.apply("add", ip, "ban", func() error { return r.fwManager.BanIP(ip) }); err != nil {
+				d.failed("add", ip, err, "failed to add ban", "ip", ip)
+			}
+		}
+	}
+	for ip := range actualSet {
+		if !desired[ip] {
+			if err := d.apply("remove", ip, "ban", func() error { return r.fwManager.UnbanIP(ip) }); err != nil {
+				d.failed("remove", ip, err, "failed to remove ban", "ip", ip)
+			}
+		}
+	}
+	return d.ops, nil
+}
+
+// reconcileIsolation makes the forward-chain isolation rules match the
+// enabled tunnels with isolate set.
+func (r *Reconciler) reconcileIsolation() ([]DriftOp, error) {
+	tunnels, err := r.tunnelStore.ListEnabled()
+	if err != nil {
+		return nil, fmt.Errorf("list tunnels: %w", err)
+	}
+	tunnels = localTunnels(tunnels)
+	actual, err := r.fwManager.ListIsolated()
+	if err != nil {
+		return nil, fmt.Errorf("list isolated peers: %w", err)
+	}
+
+	desired := make(map[string]bool)
+	for _, t := range tunnels {
+		if t.Isolate {
+			desired[t.VpnIP] = true
+		}
+	}
+	actualSet := make(map[string]bool, len(actual))
+	for _, ip := range actual {
+		actualSet[ip] = true
+	}
+
+	d := r.newDrift(SubsystemFirewall)
+	for ip := range desired {
+		if !actualSet[ip] {
+			if err := d.apply("add", ip, "isolation", func() error { return r.fwManager.IsolatePeer(ip) }); err != nil {
+				d.failed("add", ip, err, "failed to isolate peer", "vpn_ip", ip)
+			}
+		}
+	}
+	for ip := range actualSet {
+		if !desired[ip] {
+			if err := d.apply("remove", ip, "isolation", func() error { return r.fwManager.UnisolatePeer(ip) }); err != nil {
+				d.failed("remove", ip, err, "failed to remove peer isolation", "vpn_ip", ip)
+			}
+		}
+	}
+	return d.ops, nil
+}
+
+// reconcileUpstreamPorts makes the upstream port restrictions in nftables
+// match the enabled local tunnels with allowed upstream ports. A tunnel whose
+// ports or advertised routes changed has its restriction replaced.
+func (r *Reconciler) reconcileUpstreamPorts() ([]DriftOp, error) {
+	tunnels, err := r.tunnelStore.ListEnabled()
+	if err != nil {
+		return nil, fmt.Errorf("list tunnels: %w", err)
+	}
+	tunnels = localTunnels(tunnels)
+	actual, err := r.fwManager.ListUpstreamRestrictions()
+	if err != nil {
+		return nil, fmt.Errorf("list upstream restrictions: %w", err)
+	}
+
+	desired := make(map[string]firewall.UpstreamRestriction)
+	for _, t := range tunnels {
+		if len(t.AllowedUpstreamPorts) > 0 {
+			desired[t.VpnIP] = upstreamRestriction(t)
+		}
+	}
+
+	d := r.newDrift(SubsystemFirewall)
+	for ip, restriction := range desired {
+		digest, ok := actual[ip]
+		if ok && digest == restriction.Digest() {
+			continue
+		}
+		action := "add"
+		if ok {
+			action = "update"
+		}
+		if err := d.apply(action, ip, "upstream ports", func() error { return r.fwManager.RestrictUpstream(restriction) }); err != nil {
+			d.failed(action, ip, err, "failed to restrict upstream ports", "vpn_ip", ip)
+		}
+	}
+	for ip := range actual {
+		if _, ok := desired[ip]; !ok {
+			if err := d.apply("remove", ip, "upstream ports", func() error { return r.fwManager.LiftUpstreamRestriction(ip) }); err != nil {
+				d.failed("remove", ip, err, "failed to lift upstream port restriction", "vpn_ip", ip)
+			}
+		}
+	}
+	return d.ops, nil
+}
+
+// upstreamRestriction returns the restriction enforcing t's allowed upstream
+// ports on its VPN IP and advertised routes.
+func upstreamRestriction(t *store.Tunnel) firewall.UpstreamRestriction {
+	restriction := firewall.UpstreamRestriction{
+		IP:    t.VpnIP,
+		Dests: append([]string{t.VpnIP + "/32"}, t.AdvertisedRoutes...),
+	}
+	for _, p := range t.AllowedUpstreamPorts {
+		restriction.Allowed = append(restriction.Allowed, firewall.PortRange{Start: p.Start, End: p.End})
+	}
+	return restriction
+}
+
+// reconcileServices keeps the input chain's services open under a drop
+// policy: the configured management services and the listen ports of the
+// enabled local routes. Under an accept policy every service is removed.
+func (r *Reconciler) reconcileServices() ([]DriftOp, error) {
+	desired := make(map[string]firewall.Service)
+	if r.fwManager.Policy() == firewall.PolicyDrop {
+		routes, err := r.routeStore.ListEnabled()
+		if err != nil {
+			return nil, fmt.Errorf("list routes: %w", err)
+		}
+		covered := make(map[firewall.Service]bool)
+		for _, s := range r.fwManager.Services() {
+			desired[s.Name] = s
+			covered[firewall.RouteService(s.Proto, s.Port, s.PortEnd)] = true
+		}
+		for _, rt := range localRoutes(routes) {
+			services := []firewall.Service{firewall.RouteService(rt.Protocol, rt.ListenPort, rt.ListenPortEnd)}
+			if rt.QUIC && rt.Protocol == "tcp" {
+				services = append(services, firewall.RouteService("udp", rt.ListenPort, rt.ListenPortEnd))
+			}
+			for _, s := range services {
+				if !covered[s] {
+					desired[s.Name] = s
+				}
+			}
+		}
+	}
+	actual, err := r.fwManager.ListServices()
+	if err != nil {
+		return nil, fmt.Errorf("list services: %w", err)
+	}
+	actualMap := make(map[string]firewall.Service, len(actual))
+	for _, s := range actual {
+		actualMap[s.Name] = s
+	}
+
+	d := r.newDrift(SubsystemFirewall)
+	for name, s := range desired {
+		current, exists := actualMap[name]
+		if exists && current == s {
+			continue
+		}
+		typ := "add"
+		if exists {
+			typ = "update"
+		}
+		if err := d.apply(typ, name, "service", func() error {
+			if exists {
+				if err := r.fwManager.DeleteService(name); err != nil {
+					return err
+				}
+			}
+			return r.fwManager.AddService(s)
+		}); err != nil {
+			d.failed(typ, name, err, "failed to open service", "service", name)
+		}
+	}
+	for name := range actualMap {
+		if _, ok := desired[name]; !ok {
+			if err := d.apply("remove", name, "service", func() error { return r.fwManager.DeleteService(name) }); err != nil {
+				d.failed("remove", name, err, "failed to close service", "service", name)
+			}
+		}
+	}
+	return d.ops, nil
 }
 
 func (r *Reconciler) updatePeerStats() {
@@ -400,7 +1278,77 @@ func (r *Reconciler) updatePeerStats() {
 		return
 	}
 
+	tunnels, err := r.tunnelStore.ListEnabled()
+	if err != nil {
+		r.logger.Error("failed to list tunnels for stats update", "error", err)
+		return
+	}
+	byKey := make(map[string]*store.Tunnel, len(tunnels))
+	for _, t := range tunnels {
+		byKey[t.PublicKey] = t
+	}
+	now := time.Now()
+	r.recordPeers(peers, byKey, now)
+
+	if r.statsRetention > 0 {
+		if _, err := r.tunnelStore.PruneStatsHistory(now.Add(-r.statsRetention)); err != nil {
+			r.logger.Error("failed to prune stats history", "error", err)
+		}
+	}
+}
+
+// RecordNodePeers stores the peer stats a node's agent reported, and
+// disables tunnels whose peer connected from outside their source CIDR, as
+// each pass does for local peers. Peers of tunnels the node does not serve
+// are ignored. A tunnel with failover nodes has a peer on each of them, so
+// only the node the peer last handshook with reports its stats.
+func (r *Reconciler) RecordNodePeers(nodeID string, peers []wireguard.PeerInfo, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tunnels, err := r.tunnelStore.ListEnabled()
+	if err != nil {
+		return fmt.Errorf("list tunnels: %w", err)
+	}
+	byKey := make(map[string]*store.Tunnel)
+	for _, t := range tunnels {
+		if t.NodeID == nodeID || slices.Contains(t.FailoverNodeIDs, nodeID) {
+			byKey[t.PublicKey] = t
+		}
+	}
+	var own []wireguard.PeerInfo
+	for _, peer := range peers {
+		t := byKey[peer.PublicKey]
+		if t == nil {
+			continue
+		}
+		if len(t.FailoverNodeIDs) > 0 {
+			if peer.LastHandshakeTime.IsZero() ||
+				(t.LastHandshake != nil && peer.LastHandshakeTime.Before(*t.LastHandshake)) {
+				continue
+			}
+		}
+		own = append(own, peer)
+	}
+	r.recordPeers(own, byKey, now)
+	return nil
+}
+
+// recordPeers stores endpoints and traffic counters of peers. Called with
+// r.mu held.
+func (r *Reconciler) recordPeers(peers []wireguard.PeerInfo, byKey map[string]*store.Tunnel, now time.Time) {
 	for _, peer := range peers {
+		if t := byKey[peer.PublicKey]; t != nil && !endpointAllowed(peer.Endpoint, t.SourceCIDR) {
+			r.blockEndpoint(t, peer.Endpoint, now)
+			continue
+		}
+		changed, err := r.tunnelStore.RecordEndpoint(peer.PublicKey, peer.Endpoint, now)
+		if err != nil {
+			r.logger.Error("failed to record peer endpoint", "pubkey", peer.PublicKey, "error", err)
+		} else if changed {
+			r.logger.Info("peer endpoint changed", "pubkey", peer.PublicKey, "endpoint", peer.Endpoint)
+		}
+
 		hs := peer.LastHandshakeTime
 		var hsPtr *time.Time
 		if !hs.IsZero() {
@@ -409,32 +1357,309 @@ func (r *Reconciler) updatePeerStats() {
 		if err := r.tunnelStore.UpdatePeerStats(peer.PublicKey, hsPtr, peer.ReceiveBytes, peer.TransmitBytes); err != nil {
 			r.logger.Error("failed to update peer stats", "pubkey", peer.PublicKey, "error", err)
 		}
+		if t := byKey[peer.PublicKey]; t != nil {
+			r.recordConnection(t, peer, now)
+		}
+		if r.statsRetention > 0 {
+			if err := r.tunnelStore.RecordStatsSample(peer.PublicKey, peer.ReceiveBytes, peer.TransmitBytes, now); err != nil {
+				r.logger.Error("failed to record stats sample", "pubkey", peer.PublicKey, "error", err)
+			}
+		}
 	}
 }
 
-func (r *Reconciler) checkRotations() {
+// recordConnection records a peer event and notifies when the peer's
+// latest handshake changes whether it counts as connected. Disconnects are
+// noticed once the handshake is older than the tunnel's connected threshold.
+func (r *Reconciler) recordConnection(t *store.Tunnel, peer wireguard.PeerInfo, now time.Time) {
+	connected := !peer.LastHandshakeTime.IsZero() && now.Sub(peer.LastHandshakeTime) < t.ConnectedWithin(r.connectedWindow)
+	at := now
+	if connected {
+		at = peer.LastHandshakeTime
+	}
+	changed, err := r.tunnelStore.RecordConnection(t.ID, connected, peer.Endpoint, at)
+	if err != nil {
+		r.logger.Error("failed to record peer event", "id", t.ID, "error", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	eventType := notify.EventTunnelDisconnected
+	if connected {
+		eventType = notify.EventTunnelConnected
+	}
+	r.logger.Info("peer connection changed", "id", t.ID, "connected", connected, "endpoint", peer.Endpoint)
+	data := map[string]interface{}{"endpoint": peer.Endpoint}
+	if !peer.LastHandshakeTime.IsZero() {
+		data["last_handshake"] = peer.LastHandshakeTime.UTC().Format(time.RFC3339)
+	}
+	r.notify(notify.Event{Type: eventType, TunnelID: t.ID, Time: at, Data: data})
+}
+
+// endpointAllowed reports whether a peer endpoint ("ip:port") lies in the
+// tunnel's source CIDR. An empty CIDR or a peer that has not connected yet is
+// always allowed.
+func endpointAllowed(endpoint, cidr string) bool {
+	if cidr == "" || endpoint == "" {
+		return true
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		return false
+	}
+	return prefix.Contains(addrPort.Addr().Unmap())
+}
+
+// blockEndpoint disables a tunnel whose peer connected from outside its
+// source CIDR. WireGuard cannot filter peers by source address, so this
+// happens after the handshake: the peer is removed from the kernel and stays
+// down until the tunnel is re-enabled through the API. A node's agent drops
+// the peer once it syncs the disabled tunnel.
+func (r *Reconciler) blockEndpoint(t *store.Tunnel, endpoint string, now time.Time) {
+	r.logger.Warn("peer connected from outside its source CIDR, disabling tunnel",
+		"id", t.ID, "endpoint", endpoint, "source_cidr", t.SourceCIDR)
+	if t.NodeID == "" && !r.observing() {
+		if err := r.wgManager.RemovePeer(t.PublicKey); err != nil {
+			r.logger.Error("failed to remove blocked peer", "id", t.ID, "error", err)
+		}
+	}
+	if _, err := r.tunnelStore.SetEnabled(t.ID, false); err != nil {
+		r.logger.Error("failed to disable blocked tunnel", "id", t.ID, "error", err)
+	}
+	r.notify(notify.Event{
+		Type: notify.EventTunnelEndpointBlocked, TunnelID: t.ID, Time: now,
+		Data: map[string]interface{}{"endpoint": endpoint, "source_cidr": t.SourceCIDR},
+	})
+}
+
+// expireTunnel disables a tunnel that reached its expiry date. Unlike
+// inactivity revocation the tunnel is kept, so it can be re-enabled by moving
+// or clearing expires_at. A node's agent drops the peer once it syncs the
+// disabled tunnel.
+func (r *Reconciler) expireTunnel(t *store.Tunnel, now time.Time) {
+	r.logger.Info("tunnel reached its expiry date, disabling", "id", t.ID, "expires_at", t.ExpiresAt)
+	if t.NodeID == "" && !r.observing() {
+		if err := r.wgManager.RemovePeer(t.PublicKey); err != nil {
+			r.logger.Error("failed to remove expired peer", "id", t.ID, "error", err)
+		}
+	}
+	if _, err := r.tunnelStore.SetEnabled(t.ID, false); err != nil {
+		r.logger.Error("failed to disable expired tunnel", "id", t.ID, "error", err)
+		return
+	}
+	r.notify(notify.Event{
+		Type: notify.EventTunnelExpired, TunnelID: t.ID, Time: now,
+		Data: map[string]interface{}{"expires_at": t.ExpiresAt.UTC()},
+	})
+}
+
+// tunnelDomains returns the SNI domains routed to a tunnel.
+func (r *Reconciler) tunnelDomains(tunnelID string) []string {
+	routes, err := r.routeStore.ListByTunnelID(tunnelID)
+	if err != nil {
+		r.logger.Error("failed to list tunnel routes", "id", tunnelID, "error", err)
+		return nil
+	}
+	var domains []string
+	for _, route := range routes {
+		if route.MatchType == "sni" {
+			domains = append(domains, route.MatchValue...)
+		}
+	}
+	return domains
+}
+
+// unpublishDNS removes DNS records for domains, if DNS management is
+// enabled. Called with r.mu held.
+func (r *Reconciler) unpublishDNS(domains []string) {
+	if r.dns == nil || len(domains) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := r.dns.Unpublish(ctx, domains); err != nil {
+		r.logger.Error("failed to remove DNS records", "domains", domains, "error", err)
+	}
+}
+
+// deleteTunnel soft-deletes a tunnel when retention is set, so it can be
+// restored, and deletes it and its routes otherwise.
+func (r *Reconciler) deleteTunnel(id string, now time.Time) error {
+	if r.tunnelRetention > 0 {
+		return r.tunnelStore.SoftDelete(id, now)
+	}
+	if err := r.routeStore.DeleteByTunnelID(id); err != nil {
+		return err
+	}
+	return r.tunnelStore.Delete(id)
+}
+
+// purgeDeletedTunnels removes tunnels soft-deleted longer ago than the
+// retention, releasing their keys and VPN IPs.
+func (r *Reconciler) purgeDeletedTunnels(now time.Time) {
+	if r.tunnelRetention <= 0 {
+		return
+	}
+	n, err := r.tunnelStore.PurgeDeleted(now.Add(-r.tunnelRetention))
+	if err != nil {
+		r.logger.Error("failed to purge deleted tunnels", "error", err)
+		return
+	}
+	if n > 0 {
+		r.logger.Info("purged deleted tunnels", "count", n)
+	}
+}
+
+// expirePendingApprovals discards the tunnels that have waited for approval
+// longer than the approval TTL, like a rejection: nothing was applied for
+// them, so only their rows are removed, with the PSK issued at creation.
+func (r *Reconciler) expirePendingApprovals(now time.Time) {
+	if r.approvalTTL <= 0 {
+		return
+	}
+	tunnels, err := r.tunnelStore.List()
+	if err != nil {
+		r.logger.Error("failed to list tunnels awaiting approval", "error", err)
+		return
+	}
+	for _, t := range tunnels {
+		if !t.PendingApproval || t.CreatedAt.After(now.Add(-r.approvalTTL)) {
+			continue
+		}
+		if err := r.routeStore.DeleteByTunnelID(t.ID); err != nil {
+			r.logger.Error("failed to delete routes of expired approval request", "id", t.ID, "error", err)
+			continue
+		}
+		if err := r.tunnelStore.Delete(t.ID); err != nil {
+			r.logger.Error("failed to delete expired approval request", "id", t.ID, "error", err)
+			continue
+		}
+		r.logger.Info("approval request expired, tunnel discarded", "id", t.ID, "created_at", t.CreatedAt)
+		r.notify(notify.Event{
+			Type: notify.EventTunnelRejected, TunnelID: t.ID, Time: now,
+			Data: map[string]interface{}{"reason": "approval request expired"},
+		})
+	}
+}
+
+// checkOrphanedRoutes logs each route whose tunnel is missing once, when
+// it is first seen, so an operator can delete it. The route stays in Caddy
+// until then.
+func (r *Reconciler) checkOrphanedRoutes() {
+	routes, err := r.routeStore.ListOrphaned()
+	if err != nil {
+		r.logger.Error("failed to check for orphaned routes", "error", err)
+		return
+	}
+	seen := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		seen[route.ID] = true
+		if !r.orphans[route.ID] {
+			r.logger.Warn("route references a missing tunnel", "route_id", route.ID, "tunnel_id", route.TunnelID)
+		}
+	}
+	r.orphans = seen
+}
+
+// expireRoutes deletes the temporary routes whose TTL has run out.
+func (r *Reconciler) expireRoutes(now time.Time) {
+	routes, err := r.routeStore.ListExpired(now)
+	if err != nil {
+		r.logger.Error("failed to list expired routes", "error", err)
+		return
+	}
+	for _, route := range routes {
+		if err := r.routeStore.Delete(route.ID); err != nil {
+			r.logger.Error("failed to delete expired route", "id", route.ID, "error", err)
+			continue
+		}
+		r.logger.Info("route TTL expired, deleted", "id", route.ID, "name", route.Name, "expires_at", route.ExpiresAt)
+		if route.MatchType == "sni" {
+			r.unpublishDNS(route.MatchValue)
+		}
+		r.notify(notify.Event{
+			Type: notify.EventRouteExpired, TunnelID: route.TunnelID, Time: now,
+			Data: map[string]interface{}{"route_id": route.ID, "name": route.Name, "expires_at": route.ExpiresAt.UTC()},
+		})
+	}
+}
+
+// checkRotations applies the expiry, revocation, and rotation policies of
+// enabled tunnels. It returns the revocations observe mode left out.
+func (r *Reconciler) checkRotations() []DriftOp {
 	tunnels, err := r.tunnelStore.ListEnabled()
 	if err != nil {
 		r.logger.Error("failed to list tunnels for rotation check", "error", err)
-		return
+		return nil
 	}
 
 	now := time.Now()
+	d := r.newDrift(lifecycleDrift)
 
 	for _, t := range tunnels {
+		// Check expires_at
+		if t.Expired(now) {
+			r.expireTunnel(t, now)
+			continue
+		}
+		if t.ReachesExpiryDateWithin(now, r.inactivityWarning) && t.ExpiryDateWarnedAt == nil {
+			r.logger.Info("tunnel reaching its expiry date soon", "id", t.ID, "expires_at", t.ExpiresAt)
+			r.notify(notify.Event{
+				Type: notify.EventTunnelExpiring, TunnelID: t.ID, Time: now,
+				Data: map[string]interface{}{"reason": "expires_at", "expires_at": t.ExpiresAt.UTC()},
+			})
+			if err := r.tunnelStore.MarkExpiryDateWarned(t.ID, now); err != nil {
+				r.logger.Error("failed to record expiry warning", "id", t.ID, "error", err)
+			}
+		}
+
 		// Check auto_revoke_inactive
-		if t.AutoRevokeInactive && t.LastHandshake != nil {
-			inactiveThreshold := t.LastHandshake.Add(time.Duration(t.InactiveExpiryDays) * 24 * time.Hour)
-			if now.After(inactiveThreshold) {
+		if revokeAt := t.RevocationAt(); revokeAt != nil {
+			if now.After(*revokeAt) && d.observe {
+				// Deleting the tunnel would remove its peer and DNS records
+				d.done("remove", t.ID, "inactive tunnel")
+				continue
+			}
+			if now.After(*revokeAt) {
 				r.logger.Info("auto-revoking inactive tunnel", "id", t.ID, "last_handshake", t.LastHandshake)
-				if err := r.wgManager.RemovePeer(t.PublicKey); err != nil {
-					r.logger.Error("failed to remove inactive peer", "id", t.ID, "error", err)
+				if t.NodeID == "" {
+					if err := r.wgManager.RemovePeer(t.PublicKey); err != nil {
+						r.logger.Error("failed to remove inactive peer", "id", t.ID, "error", err)
+					}
 				}
-				if err := r.tunnelStore.Delete(t.ID); err != nil {
+				domains := r.tunnelDomains(t.ID)
+				if err := r.deleteTunnel(t.ID, now); err != nil {
 					r.logger.Error("failed to delete inactive tunnel", "id", t.ID, "error", err)
+				} else {
+					r.unpublishDNS(domains)
 				}
+				r.notify(notify.Event{
+					Type: notify.EventTunnelRevoked, TunnelID: t.ID, Time: now,
+					Data: map[string]interface{}{"reason": "inactive", "last_handshake": t.LastHandshake},
+				})
 				continue
 			}
+
+			// Warn once per expiry cycle: a warning sent before the current
+			// window opened belongs to an earlier (since extended) expiry.
+			windowStart := revokeAt.Add(-r.inactivityWarning)
+			warned := t.ExpiryWarnedAt != nil && !t.ExpiryWarnedAt.Before(windowStart)
+			if t.ExpiringSoon(now, r.inactivityWarning) && !warned {
+				r.logger.Info("tunnel expiring soon", "id", t.ID, "revocation_at", revokeAt)
+				r.notify(notify.Event{
+					Type: notify.EventTunnelExpiring, TunnelID: t.ID, Time: now,
+					Data: map[string]interface{}{"revocation_at": revokeAt.UTC(), "last_handshake": t.LastHandshake},
+				})
+				if err := r.tunnelStore.MarkExpiryWarned(t.ID, now); err != nil {
+					r.logger.Error("failed to record expiry warning", "id", t.ID, "error", err)
+				}
+			}
 		}
 
 		// Check pending rotation grace period expiry
@@ -460,12 +1685,146 @@ func (r *Reconciler) checkRotations() {
 			}
 
 			nextRotation := lastRotation.Add(time.Duration(t.PSKRotationIntervalDays) * 24 * time.Hour)
-			if now.After(nextRotation) {
+			if now.After(nextRotation) && r.observing() {
+				r.logger.Debug("auto PSK rotation due, waiting in observe mode", "id", t.ID, "last_rotation", lastRotation)
+			} else if now.After(nextRotation) {
 				r.logger.Info("auto PSK rotation due", "id", t.ID, "last_rotation", lastRotation)
-				// PSK rotation is handled by the API (generates new keys, creates new peer entry).
-				// The reconciler just logs it. In a full implementation, this would trigger the
-				// same flow as POST /api/v1/tunnels/{id}/rotate.
+				if err := r.rotatePSK(t, now); err != nil {
+					r.logger.Error("failed to rotate PSK", "id", t.ID, "error", err)
+				}
 			}
 		}
 	}
+	return d.ops
+}
+
+// rotatePSK replaces a peer's pre-shared key in place. WireGuard holds a
+// single PSK per peer, so the old key stops working immediately; the new
+// client config is delivered through a tunnel.psk_rotated event.
+func (r *Reconciler) rotatePSK(t *store.Tunnel, now time.Time) error {
+	psk, err := wireguard.GeneratePSK()
+	if err != nil {
+		return err
+	}
+	serverPubKey, endpoint := "", r.serverEndpoint
+	if t.NodeID != "" {
+		// The node's agent applies the new PSK at its next sync
+		node, err := r.nodes.Get(t.NodeID)
+		if err != nil {
+			return fmt.Errorf("get node: %w", err)
+		}
+		if err := r.tunnelStore.SetPendingPSK(t.ID, psk); err != nil {
+			return err
+		}
+		serverPubKey, endpoint = node.WGPublicKey, node.Endpoint
+	} else if err := r.wgManager.AddPeer(t.PublicKey, psk, t.VpnIP, t.AdvertisedRoutes, t.Keepalive(r.keepalive)); err != nil {
+		return fmt.Errorf("apply psk: %w", err)
+	}
+	if err := r.tunnelStore.RecordPSKRotation(t.ID, wireguard.HashPSK(psk), now); err != nil {
+		return err
+	}
+
+	if serverPubKey == "" {
+		if serverPubKey, err = r.wgManager.GetServerPublicKey(); err != nil {
+			r.logger.Warn("failed to read server public key for rotated config", "id", t.ID, "error", err)
+		}
+	}
+	dns := t.ClientDNS
+	if dns == nil {
+		dns = wireguard.DefaultDNS
+	}
+	config := wireguard.ClientConfig{
+		PrivateKey:     wireguard.PrivateKeyPlaceholder,
+		Address:        t.VpnIP,
+		DNS:            dns,
+		MTU:            t.ClientMTU,
+		ServerPubKey:   serverPubKey,
+		PresharedKey:   psk,
+		ServerEndpoint: endpoint,
+		AllowedIPs:     wireguard.ClientAllowedIPs(t.ClientRouting, r.vpnServerIP, r.vpnSubnet),
+		Keepalive:      t.Keepalive(r.keepalive),
+	}.Render()
+
+	r.logger.Info("rotated PSK", "id", t.ID)
+	r.notify(notify.Event{
+		Type: notify.EventTunnelPSKRotated, TunnelID: t.ID, Time: now,
+		Data: map[string]interface{}{
+			"preshared_key":    psk,
+			"config":           config,
+			"next_rotation_at": now.Add(time.Duration(t.PSKRotationIntervalDays) * 24 * time.Hour).UTC(),
+		},
+	})
+	return nil
+}
+
+// localTunnels drops tunnels placed on remote nodes.
+func localTunnels(tunnels []*store.Tunnel) []*store.Tunnel {
+	var local []*store.Tunnel
+	for _, t := range tunnels {
+		if t.NodeID == "" {
+			local = append(local, t)
+		}
+	}
+	return local
+}
+
+// localRoutes drops routes placed on remote nodes.
+func localRoutes(routes []*store.Route) []*store.Route {
+	var local []*store.Route
+	for _, rt := range routes {
+		if rt.NodeID == "" {
+			local = append(local, rt)
+		}
+	}
+	return local
+}
+
+// notify delivers an event, logging rather than failing on delivery errors.
+func (r *Reconciler) notify(e notify.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := r.notifier.Notify(ctx, e); err != nil {
+		r.logger.Error("failed to deliver event", "type", e.Type, "tunnel_id", e.TunnelID, "error", err)
+	}
+}
+
+// sortSNIRoutes orders SNI routes the way Caddy should match them: higher
+// priority first, then routes without wildcard domains before wildcard ones
+// so a catch-all never shadows a specific name, then oldest first.
+func sortSNIRoutes(routes []*store.Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if wa, wb := hasWildcard(a.MatchValue), hasWildcard(b.MatchValue); wa != wb {
+			return wb
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+}
+
+func hasWildcard(domains []string) bool {
+	for _, d := range domains {
+		if strings.Contains(d, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrder reports whether ids lists exactly the routes' Caddy IDs in order.
+func sameOrder(ids []string, routes []*store.Route) bool {
+	if len(ids) != len(routes) {
+		return false
+	}
+	for i, route := range routes {
+		if ids[i] != route.CaddyID {
+			return false
+		}
+	}
+	return true
 }
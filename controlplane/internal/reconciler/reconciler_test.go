@@ -3,26 +3,40 @@ package reconciler
 import (
 	"context"
 	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/proxy-manager/controlplane/internal/caddy"
+	"github.com/proxy-manager/controlplane/internal/config"
 	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/notify"
+	"github.com/proxy-manager/controlplane/internal/sockstats"
 	"github.com/proxy-manager/controlplane/internal/store"
 	"github.com/proxy-manager/controlplane/internal/wireguard"
 )
 
 // mockCaddyClient implements caddy.Client for testing.
 type mockCaddyClient struct {
-	config       *caddy.L4Config
-	routes       []caddy.CaddyRoute
-	serverExists bool
-	addErr       error
-	deleteErr    error
-	getErr       error
-	createErr    error
-	addedRoutes  []caddy.CaddyRoute
-	deletedIDs   []string
+	config         *caddy.L4Config
+	routes         []caddy.CaddyRoute
+	serverExists   bool
+	addErr         error
+	deleteErr      error
+	getErr         error
+	createErr      error
+	addedRoutes    []caddy.CaddyRoute
+	deletedIDs     []string
+	quicServer     bool
+	quicRoutes     []caddy.CaddyRoute
+	replacedRoutes []caddy.CaddyRoute
+	updatedRoutes  []caddy.CaddyRoute
+	pfServers      []string
+	deletedServers []string
+	managedCerts   []string
 }
 
 func newMockCaddyClient() *mockCaddyClient {
@@ -46,6 +60,16 @@ func (m *mockCaddyClient) AddRoute(ctx context.Context, route caddy.CaddyRoute)
 	return nil
 }
 
+func (m *mockCaddyClient) UpdateRoute(ctx context.Context, route caddy.CaddyRoute) error {
+	m.updatedRoutes = append(m.updatedRoutes, route)
+	return nil
+}
+
+func (m *mockCaddyClient) ReplaceRoutes(ctx context.Context, routes []caddy.CaddyRoute) error {
+	m.replacedRoutes = routes
+	return nil
+}
+
 func (m *mockCaddyClient) DeleteRoute(ctx context.Context, caddyID string) error {
 	if m.deleteErr != nil {
 		return m.deleteErr
@@ -62,36 +86,71 @@ func (m *mockCaddyClient) CreateServer(ctx context.Context) error {
 	return nil
 }
 
-func (m *mockCaddyClient) CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID string) error {
+func (m *mockCaddyClient) CreatePortForwardServer(ctx context.Context, serverName, listenAddr, upstream, caddyID, proxyProtocol string) error {
+	m.pfServers = append(m.pfServers, serverName)
+	server := caddy.PortForwardServer{ListenAddr: listenAddr, Upstream: upstream, CaddyID: caddyID, ProxyProtocol: proxyProtocol}
+	m.config.Servers[serverName] = &caddy.L4Server{Listen: []string{listenAddr}, Routes: []caddy.CaddyRoute{server.Route()}}
+	return nil
+}
+
+func (m *mockCaddyClient) CreateQUICServer(ctx context.Context) error {
+	m.quicServer = true
+	return nil
+}
+
+func (m *mockCaddyClient) AddQUICRoute(ctx context.Context, route caddy.CaddyRoute) error {
+	m.quicRoutes = append(m.quicRoutes, route)
 	return nil
 }
 
 func (m *mockCaddyClient) DeleteServer(ctx context.Context, serverName string) error {
+	m.deletedServers = append(m.deletedServers, serverName)
+	delete(m.config.Servers, serverName)
 	return nil
 }
 
+func (m *mockCaddyClient) SyncManagedCertificates(ctx context.Context, subjects []string, issuer caddy.ACMEIssuer) (bool, error) {
+	changed := strings.Join(m.managedCerts, ",") != strings.Join(subjects, ",")
+	m.managedCerts = subjects
+	return changed, nil
+}
+
+func (m *mockCaddyClient) CheckManagedCertificates(ctx context.Context, subjects []string, issuer caddy.ACMEIssuer) (bool, error) {
+	return strings.Join(m.managedCerts, ",") != strings.Join(subjects, ","), nil
+}
+
 // mockWGClient for reconciler tests.
 type mockWGClient struct {
-	peers     map[string]wireguard.PeerInfo
-	publicKey string
-	addErr    error
-	removeErr error
+	peers      map[string]wireguard.PeerInfo
+	psks       map[string]string
+	publicKey  string
+	addErr     error
+	removeErr  error
+	applyErr   error
+	applyCalls int
 }
 
 func newMockWGClient() *mockWGClient {
 	return &mockWGClient{
 		peers:     make(map[string]wireguard.PeerInfo),
+		psks:      make(map[string]string),
 		publicKey: "server-key==",
 	}
 }
 
-func (m *mockWGClient) AddPeer(iface string, pubkey, psk, vpnIP string) error {
+func (m *mockWGClient) AddPeer(iface string, pubkey, psk, vpnIP string, routes []string, keepalive time.Duration) error {
 	if m.addErr != nil {
 		return m.addErr
 	}
-	m.peers[pubkey] = wireguard.PeerInfo{
-		PublicKey:  pubkey,
-		AllowedIPs: []string{vpnIP + "/32"},
+	// Like the kernel, an existing peer keeps its stats and, without a new
+	// one, its PSK
+	p := m.peers[pubkey]
+	p.PublicKey = pubkey
+	p.AllowedIPs = wireguard.PeerAllowedIPs(vpnIP, routes)
+	p.Keepalive = keepalive
+	m.peers[pubkey] = p
+	if psk != "" {
+		m.psks[pubkey] = psk
 	}
 	return nil
 }
@@ -104,6 +163,27 @@ func (m *mockWGClient) RemovePeer(iface string, pubkey string) error {
 	return nil
 }
 
+func (m *mockWGClient) ApplyPeers(iface string, peers []wireguard.PeerConfig) error {
+	m.applyCalls++
+	if m.applyErr != nil {
+		return m.applyErr
+	}
+	for _, p := range peers {
+		var err error
+		if p.Remove {
+			err = m.RemovePeer(iface, p.PublicKey)
+		} else {
+			err = m.AddPeer(iface, p.PublicKey, p.PSK, p.VpnIP, p.Routes, p.Keepalive)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockWGClient) HostPrefixes(iface string) ([]netip.Prefix, error) { return nil, nil }
+
 func (m *mockWGClient) GetDevice(iface string) (*wireguard.DeviceInfo, error) {
 	var peers []wireguard.PeerInfo
 	for _, p := range m.peers {
@@ -118,16 +198,21 @@ func (m *mockWGClient) GetDevice(iface string) (*wireguard.DeviceInfo, error) {
 
 // mockNFTConn for reconciler tests.
 type mockNFTConn struct {
-	rules   map[string]firewall.Rule
-	addErr  error
-	delErr  error
+	rules    map[string]firewall.Rule
+	bans     map[string]bool
+	isolated map[string]bool
+	counters map[string]firewall.RouteCounter
+	services map[string]firewall.Service
+	upstream map[string]firewall.UpstreamRestriction
+	addErr   error
+	delErr   error
 }
 
 func newMockNFTConn() *mockNFTConn {
 	return &mockNFTConn{rules: make(map[string]firewall.Rule)}
 }
 
-func (m *mockNFTConn) Init() error { return nil }
+func (m *mockNFTConn) Init(firewall.ChainOptions) error { return nil }
 
 func (m *mockNFTConn) AddRule(rule firewall.Rule) error {
 	if m.addErr != nil {
@@ -145,6 +230,116 @@ func (m *mockNFTConn) DeleteRule(id string) error {
 	return nil
 }
 
+func (m *mockNFTConn) ReplaceRule(rule firewall.Rule) error {
+	m.rules[rule.ID] = rule
+	return nil
+}
+
+func (m *mockNFTConn) AddBan(ip string) error {
+	if m.bans == nil {
+		m.bans = make(map[string]bool)
+	}
+	m.bans[ip] = true
+	return nil
+}
+
+func (m *mockNFTConn) DeleteBan(ip string) error {
+	delete(m.bans, ip)
+	return nil
+}
+
+func (m *mockNFTConn) ListBans() ([]string, error) {
+	var ips []string
+	for ip := range m.bans {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (m *mockNFTConn) AddIsolation(ip string) error {
+	if m.isolated == nil {
+		m.isolated = make(map[string]bool)
+	}
+	m.isolated[ip] = true
+	return nil
+}
+
+func (m *mockNFTConn) DeleteIsolation(ip string) error {
+	delete(m.isolated, ip)
+	return nil
+}
+
+func (m *mockNFTConn) ListIsolated() ([]string, error) {
+	var ips []string
+	for ip := range m.isolated {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func (m *mockNFTConn) RestrictUpstream(r firewall.UpstreamRestriction) error {
+	if m.upstream == nil {
+		m.upstream = make(map[string]firewall.UpstreamRestriction)
+	}
+	m.upstream[r.IP] = r
+	return nil
+}
+
+func (m *mockNFTConn) DeleteUpstreamRestriction(ip string) error {
+	delete(m.upstream, ip)
+	return nil
+}
+
+func (m *mockNFTConn) ListUpstreamRestrictions() (map[string]string, error) {
+	digests := map[string]string{}
+	for ip, r := range m.upstream {
+		digests[ip] = r.Digest()
+	}
+	return digests, nil
+}
+
+func (m *mockNFTConn) AddRouteCounter(c firewall.RouteCounter) error {
+	if m.counters == nil {
+		m.counters = make(map[string]firewall.RouteCounter)
+	}
+	m.counters[c.Key()] = c
+	return nil
+}
+
+func (m *mockNFTConn) DeleteRouteCounter(key string) error {
+	delete(m.counters, key)
+	return nil
+}
+
+func (m *mockNFTConn) AddService(s firewall.Service) error {
+	if m.services == nil {
+		m.services = make(map[string]firewall.Service)
+	}
+	m.services[s.Name] = s
+	return nil
+}
+
+func (m *mockNFTConn) DeleteService(name string) error {
+	delete(m.services, name)
+	return nil
+}
+
+func (m *mockNFTConn) ListServices() ([]firewall.Service, error) {
+	var services []firewall.Service
+	for _, s := range m.services {
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+func (m *mockNFTConn) ListRouteCounters() ([]firewall.RouteCounter, error) {
+	var counters []firewall.RouteCounter
+	for _, c := range m.counters {
+		counters = append(counters, c)
+	}
+	return counters, nil
+}
+
 func (m *mockNFTConn) ListRules() ([]firewall.Rule, error) {
 	var rules []firewall.Rule
 	for _, r := range m.rules {
@@ -177,6 +372,11 @@ func setupReconciler(t *testing.T) (*Reconciler, *store.DB, *mockCaddyClient, *m
 	return rec, db, mockCaddy, mockWG, mockNFT
 }
 
+// applied returns how many of a subsystem pass's corrections went through.
+func applied(ops []DriftOp, err error) (int, error) {
+	return succeeded(ops), err
+}
+
 func TestReconcileCaddyAddMissingRoute(t *testing.T) {
 	rec, db, mockCaddy, _, _ := setupReconciler(t)
 
@@ -196,7 +396,7 @@ func TestReconcileCaddyAddMissingRoute(t *testing.T) {
 
 	// Run reconciliation
 	ctx := context.Background()
-	ops, err := rec.reconcileCaddy(ctx)
+	ops, err := applied(rec.reconcileCaddy(ctx))
 	if err != nil {
 		t.Fatalf("reconcile caddy: %v", err)
 	}
@@ -213,6 +413,146 @@ func TestReconcileCaddyAddMissingRoute(t *testing.T) {
 	}
 }
 
+func TestReconcileCaddyTerminateTLS(t *testing.T) {
+	rec, db, mockCaddy, _, _ := setupReconciler(t)
+
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	routeStore.Create(&store.Route{
+		ID: "route_1", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"b.example.com", "a.example.com"}, Upstream: "10.0.0.2:80",
+		CaddyID: "route-tun_1-443", TerminateTLS: true, Enabled: true,
+	})
+	mockCaddy.config = &caddy.L4Config{Servers: map[string]*caddy.L4Server{}}
+
+	if _, err := applied(rec.reconcileCaddy(context.Background())); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	if len(mockCaddy.addedRoutes) != 1 {
+		t.Fatalf("expected 1 added route, got %d", len(mockCaddy.addedRoutes))
+	}
+	handles := mockCaddy.addedRoutes[0].Handle
+	if len(handles) != 2 || handles[0].Handler != "tls" || handles[1].Handler != "proxy" {
+		t.Errorf("expected tls then proxy handlers, got %+v", handles)
+	}
+	if strings.Join(mockCaddy.managedCerts, ",") != "a.example.com,b.example.com" {
+		t.Errorf("expected certificates for both domains, got %v", mockCaddy.managedCerts)
+	}
+}
+
+func TestReconcileCaddyWGFallback(t *testing.T) {
+	rec, _, mockCaddy, _, _ := setupReconciler(t)
+	rec.SetWGFallback("wstunnel", "wg.example.com", 443, "127.0.0.1:8080")
+	mockCaddy.config = &caddy.L4Config{Servers: map[string]*caddy.L4Server{}}
+
+	if _, err := applied(rec.reconcileCaddy(context.Background())); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	if len(mockCaddy.addedRoutes) != 1 || mockCaddy.addedRoutes[0].ID != "pm-wg-fallback" {
+		t.Fatalf("expected the fallback route, got %+v", mockCaddy.addedRoutes)
+	}
+	if handles := mockCaddy.addedRoutes[0].Handle; len(handles) != 2 || handles[0].Handler != "tls" {
+		t.Errorf("expected the fallback to terminate TLS, got %+v", handles)
+	}
+	if strings.Join(mockCaddy.managedCerts, ",") != "wg.example.com" {
+		t.Errorf("expected a certificate for the fallback host, got %v", mockCaddy.managedCerts)
+	}
+}
+
+func TestReconcileCaddyQUICRoutes(t *testing.T) {
+	rec, db, mockCaddy, _, _ := setupReconciler(t)
+
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	routeStore.Create(&store.Route{
+		ID: "route_1", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"app.example.com"}, Upstream: "10.0.0.2:443",
+		CaddyID: "route-tun_1-443", Enabled: true, QUIC: true,
+	})
+
+	// Caddy already has the TCP route and a stale QUIC route
+	mockCaddy.config = &caddy.L4Config{
+		Servers: map[string]*caddy.L4Server{
+			"proxy": {Routes: []caddy.CaddyRoute{{ID: "route-tun_1-443"}}},
+			"quic":  {Routes: []caddy.CaddyRoute{{ID: "pm-route-stale-443-quic"}}},
+		},
+	}
+
+	if _, err := applied(rec.reconcileCaddy(context.Background())); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+
+	if len(mockCaddy.quicRoutes) != 1 || mockCaddy.quicRoutes[0].ID != "route-tun_1-443-quic" {
+		t.Fatalf("expected quic route route-tun_1-443-quic, got %+v", mockCaddy.quicRoutes)
+	}
+	if dial := mockCaddy.quicRoutes[0].Handle[0].Upstreams[0].Dial[0]; dial != "udp/10.0.0.2:443" {
+		t.Errorf("expected udp/10.0.0.2:443, got %s", dial)
+	}
+	if len(mockCaddy.deletedIDs) != 1 || mockCaddy.deletedIDs[0] != "pm-route-stale-443-quic" {
+		t.Errorf("expected stale quic route deleted, got %v", mockCaddy.deletedIDs)
+	}
+	if mockCaddy.quicServer {
+		t.Error("quic server already existed and should not be recreated")
+	}
+}
+
+func TestReconcileCaddyRoutePriority(t *testing.T) {
+	rec, db, mockCaddy, _, _ := setupReconciler(t)
+
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	for _, r := range []*store.Route{
+		{ID: "route_wild", MatchValue: []string{"*.example.com"}, CaddyID: "route-wild"},
+		{ID: "route_app", MatchValue: []string{"app.example.com"}, CaddyID: "route-app"},
+		{ID: "route_top", MatchValue: []string{"*.example.org"}, CaddyID: "route-top", Priority: 10},
+	} {
+		r.TunnelID, r.ListenPort, r.MatchType, r.Upstream, r.Enabled = "tun_1", 443, "sni", "10.0.0.2:443", true
+		if err := routeStore.Create(r); err != nil {
+			t.Fatalf("create route: %v", err)
+		}
+	}
+
+	// Caddy has the routes in insertion order plus one unmanaged route
+	wild := caddy.BuildCaddyRoute("route-wild", []string{"*.example.com"}, "10.0.0.2:443", "", false)
+	app := caddy.BuildCaddyRoute("route-app", []string{"app.example.com"}, "10.0.0.2:443", "", false)
+	top := caddy.BuildCaddyRoute("route-top", []string{"*.example.org"}, "10.0.0.2:443", "", false)
+	mockCaddy.config = &caddy.L4Config{
+		Servers: map[string]*caddy.L4Server{
+			"proxy": {Routes: []caddy.CaddyRoute{wild, {}, app, top}},
+		},
+	}
+
+	ops, err := applied(rec.reconcileCaddy(context.Background()))
+	if err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	if ops != 1 {
+		t.Errorf("expected 1 op (reorder), got %d", ops)
+	}
+
+	var got []string
+	for _, r := range mockCaddy.replacedRoutes {
+		got = append(got, r.ID)
+	}
+	want := []string{"route-top", "route-app", "route-wild", ""}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected order %v, got %v", want, got)
+	}
+
+	// Already in order: nothing to do
+	mockCaddy.replacedRoutes = nil
+	mockCaddy.config.Servers["proxy"].Routes = []caddy.CaddyRoute{top, app, wild}
+	if ops, _ := applied(rec.reconcileCaddy(context.Background())); ops != 0 || mockCaddy.replacedRoutes != nil {
+		t.Errorf("expected no drift, got %d ops", ops)
+	}
+}
+
 func TestReconcileCaddyRemoveExtraRoute(t *testing.T) {
 	rec, _, mockCaddy, _, _ := setupReconciler(t)
 
@@ -222,7 +562,7 @@ func TestReconcileCaddyRemoveExtraRoute(t *testing.T) {
 			"proxy": {
 				Listen: []string{"0.0.0.0:443"},
 				Routes: []caddy.CaddyRoute{
-					{ID: "route-stale-443", Match: []caddy.RouteMatch{{TLS: &caddy.TLSMatch{SNI: []string{"old.com"}}}},
+					{ID: "pm-route-stale-443", Match: []caddy.RouteMatch{{TLS: &caddy.TLSMatch{SNI: []string{"old.com"}}}},
 						Handle: []caddy.RouteHandle{{Handler: "proxy", Upstreams: []caddy.RouteUpstream{{Dial: []string{"10.0.0.5:443"}}}}}},
 				},
 			},
@@ -230,7 +570,7 @@ func TestReconcileCaddyRemoveExtraRoute(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	ops, err := rec.reconcileCaddy(ctx)
+	ops, err := applied(rec.reconcileCaddy(ctx))
 	if err != nil {
 		t.Fatalf("reconcile caddy: %v", err)
 	}
@@ -238,97 +578,613 @@ func TestReconcileCaddyRemoveExtraRoute(t *testing.T) {
 	if ops != 1 {
 		t.Errorf("expected 1 op (remove), got %d", ops)
 	}
-	if len(mockCaddy.deletedIDs) != 1 || mockCaddy.deletedIDs[0] != "route-stale-443" {
-		t.Errorf("expected deleted route-stale-443, got %v", mockCaddy.deletedIDs)
+	if len(mockCaddy.deletedIDs) != 1 || mockCaddy.deletedIDs[0] != "pm-route-stale-443" {
+		t.Errorf("expected deleted pm-route-stale-443, got %v", mockCaddy.deletedIDs)
 	}
 }
 
-func TestReconcileWireGuardAddMissingPeer(t *testing.T) {
-	rec, db, _, mockWG, _ := setupReconciler(t)
 
+func TestReconcileCaddyRemovesRetiredRoutes(t *testing.T) {
+	rec, db, mockCaddy, _, _ := setupReconciler(t)
+
+	// An untagged @id from before SNI @ids were derived from the route ID
+	if _, err := db.Conn().Exec(`INSERT INTO retired_caddy_ids (caddy_id, retired_at) VALUES ('route-tun_1-443', 0)`); err != nil {
+		t.Fatalf("retire caddy id: %v", err)
+	}
+	route := func(id, sni string) caddy.CaddyRoute {
+		return caddy.CaddyRoute{ID: id, Match: []caddy.RouteMatch{{TLS: &caddy.TLSMatch{SNI: []string{sni}}}},
+			Handle: []caddy.RouteHandle{{Handler: "proxy", Upstreams: []caddy.RouteUpstream{{Dial: []string{"10.0.0.5:443"}}}}}}
+	}
+	mockCaddy.config = &caddy.L4Config{
+		Servers: map[string]*caddy.L4Server{
+			"proxy": {
+				Listen: []string{"0.0.0.0:443"},
+				Routes: []caddy.CaddyRoute{route("route-tun_1-443", "old.com"), route("operator-route", "mine.com")},
+			},
+		},
+	}
+
+	if _, err := applied(rec.reconcileCaddy(context.Background())); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	if len(mockCaddy.deletedIDs) != 1 || mockCaddy.deletedIDs[0] != "route-tun_1-443" {
+		t.Errorf("expected only the retired route deleted, got %v", mockCaddy.deletedIDs)
+	}
+}
+func TestExpireRoutes(t *testing.T) {
+	rec, db, mockCaddy, _, _ := setupReconciler(t)
 	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+
 	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	routeStore.Create(&store.Route{
+		ID: "route_tmp", Name: "support-session", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"tmp.example.com"}, Upstream: "10.0.0.2:443",
+		CaddyID: "pm-route-tun_1-443-tmp", Enabled: true, ExpiresAt: &past,
+	})
+	routeStore.Create(&store.Route{
+		ID: "route_live", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"live.example.com"}, Upstream: "10.0.0.2:443",
+		CaddyID: "pm-route-tun_1-443-live", Enabled: true, ExpiresAt: &future,
+	})
+	ctx := context.Background()
+	if _, err := applied(rec.reconcileCaddy(ctx)); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	mockCaddy.config.Servers["proxy"] = &caddy.L4Server{Listen: []string{"0.0.0.0:443"}, Routes: mockCaddy.addedRoutes}
 
-	// WG has no peers
-	ops, err := rec.reconcileWireGuard()
-	if err != nil {
-		t.Fatalf("reconcile wg: %v", err)
+	rec.expireRoutes(time.Now())
+	if _, err := routeStore.Get("route_tmp"); err == nil {
+		t.Error("expected the expired route to be deleted")
+	}
+	if _, err := routeStore.Get("route_live"); err != nil {
+		t.Error("a route with TTL left should be kept")
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventRouteExpired || notifier.events[0].Data["route_id"] != "route_tmp" {
+		t.Errorf("expected a route.expired event, got %+v", notifier.events)
 	}
 
-	if ops != 1 {
-		t.Errorf("expected 1 op, got %d", ops)
+	if _, err := applied(rec.reconcileCaddy(ctx)); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
 	}
-	if _, ok := mockWG.peers["pk1"]; !ok {
-		t.Error("expected peer pk1 to be added")
+	if len(mockCaddy.deletedIDs) != 1 || mockCaddy.deletedIDs[0] != "pm-route-tun_1-443-tmp" {
+		t.Errorf("expected the expired route to be removed from Caddy, got %v", mockCaddy.deletedIDs)
 	}
 }
 
-func TestReconcileWireGuardRemoveExtraPeer(t *testing.T) {
-	rec, _, _, mockWG, _ := setupReconciler(t)
+func TestImport(t *testing.T) {
+	rec, db, mockCaddy, mockWG, _ := setupReconciler(t)
+	rec.SetVPNNetwork("10.0.0.1", "10.0.0.0/24")
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
 
-	// WG has a peer not in SQLite
-	mockWG.peers["stale_pk"] = wireguard.PeerInfo{PublicKey: "stale_pk", AllowedIPs: []string{"10.0.0.5/32"}}
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk_managed", VpnIP: "10.0.0.9", Enabled: true, Domains: []string{}})
+	mockWG.AddPeer("wg0", "pk_managed", "", "10.0.0.9", nil, wireguard.DefaultKeepalive)
+	mockWG.AddPeer("wg0", "pk_home", "psk", "10.0.0.2", []string{"192.168.1.0/24"}, wireguard.DefaultKeepalive)
+	mockWG.AddPeer("wg0", "pk_phone", "psk", "10.0.0.3", nil, 0)
+	mockWG.AddPeer("wg0", "pk_outside", "psk", "172.16.0.5", nil, wireguard.DefaultKeepalive)
+
+	mockCaddy.config = &caddy.L4Config{Servers: map[string]*caddy.L4Server{
+		"proxy": {Listen: []string{":443"}, Routes: []caddy.CaddyRoute{
+			caddy.BuildCaddyRoute("", []string{"app.example.com"}, "10.0.0.2:443", "", false),
+			caddy.BuildCaddyRoute("hand-nas", []string{"nas.example.com"}, "192.168.1.20:5001", "v2", false),
+			caddy.BuildCaddyRoute("", []string{"other.example.com"}, "10.9.9.9:443", "", false),
+		}},
+		"pf-udp-25565": {Listen: []string{"udp/0.0.0.0:25565"}, Routes: []caddy.CaddyRoute{
+			{Handle: []caddy.RouteHandle{{Handler: "proxy", Upstreams: []caddy.RouteUpstream{{Dial: []string{"udp/10.0.0.3:25565"}}}}}},
+		}},
+		"srv0": {Listen: []string{":8443"}},
+	}}
+
+	res, err := rec.Import(context.Background(), true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(res.Tunnels) != 2 || len(res.Routes) != 3 || len(res.Skipped) != 3 {
+		t.Fatalf("unexpected dry run result: %d tunnels, %d routes, skipped %+v", len(res.Tunnels), len(res.Routes), res.Skipped)
+	}
+	if tunnels, _ := tunnelStore.List(); len(tunnels) != 1 {
+		t.Fatalf("a dry run should not write, got %d tunnels", len(tunnels))
+	}
 
-	ops, err := rec.reconcileWireGuard()
+	res, err = rec.Import(context.Background(), false)
 	if err != nil {
-		t.Fatalf("reconcile wg: %v", err)
+		t.Fatalf("import: %v", err)
+	}
+	if len(res.Tunnels) != 2 || len(res.Routes) != 3 {
+		t.Fatalf("expected 2 tunnels and 3 routes, got %d and %d (skipped %+v)", len(res.Tunnels), len(res.Routes), res.Skipped)
+	}
+	home, err := tunnelStore.GetByPublicKey("pk_home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !home.Imported || home.VpnIP != "10.0.0.2" || len(home.AdvertisedRoutes) != 1 || home.AdvertisedRoutes[0] != "192.168.1.0/24" {
+		t.Errorf("unexpected imported tunnel %+v", home)
+	}
+	routes, _ := routeStore.List()
+	byDomain := map[string]*store.Route{}
+	for _, route := range routes {
+		if !route.Imported || route.TunnelID == "tun_1" {
+			t.Errorf("unexpected route %+v", route)
+		}
+		if len(route.MatchValue) > 0 {
+			byDomain[route.MatchValue[0]] = route
+		}
+	}
+	if nas := byDomain["nas.example.com"]; nas == nil || nas.TunnelID != home.ID || nas.CaddyID != "hand-nas" || nas.ProxyProtocol != "v2" {
+		t.Errorf("expected the nas route on the advertised LAN of pk_home, got %+v", nas)
+	}
+	app := byDomain["app.example.com"]
+	if app == nil || len(mockCaddy.replacedRoutes) != 3 || mockCaddy.replacedRoutes[0].ID != app.CaddyID || mockCaddy.replacedRoutes[2].ID != "" {
+		t.Errorf("expected only the imported ID-less route to be tagged, got %+v", mockCaddy.replacedRoutes)
 	}
 
-	if ops != 1 {
-		t.Errorf("expected 1 op, got %d", ops)
+	// The next passes keep every adopted peer and route
+	mockCaddy.config.Servers["proxy"].Routes = mockCaddy.replacedRoutes
+	if _, err := applied(rec.reconcileCaddy(context.Background())); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
 	}
-	if _, ok := mockWG.peers["stale_pk"]; ok {
-		t.Error("expected stale peer to be removed")
+	if len(mockCaddy.deletedIDs) != 0 || len(mockCaddy.deletedServers) != 0 {
+		t.Errorf("expected nothing removed from Caddy, got routes %v, servers %v", mockCaddy.deletedIDs, mockCaddy.deletedServers)
+	}
+	if _, err := applied(rec.reconcileWireGuard()); err != nil {
+		t.Fatalf("reconcile wireguard: %v", err)
+	}
+	for _, key := range []string{"pk_home", "pk_phone"} {
+		if _, ok := mockWG.peers[key]; !ok {
+			t.Errorf("expected imported peer %s to be kept", key)
+		}
+	}
+	if mockWG.psks["pk_home"] != "psk" {
+		t.Error("expected the imported peer to keep its PSK")
 	}
 }
 
-func TestReconcileFirewallAddMissingRule(t *testing.T) {
-	rec, db, _, _, mockNFT := setupReconciler(t)
+func TestReconcileWireGuardAddMissingPeer(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
 
-	fwStore := store.NewFirewallStore(db)
-	fwStore.Create(&store.FirewallRule{
-		ID: "fw_1", Port: 8080, Proto: "tcp", Direction: "in",
-		SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true,
-	})
+	tunnelStore := store.NewTunnelStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
 
-	ops, err := rec.reconcileFirewall()
+	// WG has no peers
+	ops, err := applied(rec.reconcileWireGuard())
 	if err != nil {
-		t.Fatalf("reconcile fw: %v", err)
+		t.Fatalf("reconcile wg: %v", err)
 	}
 
 	if ops != 1 {
 		t.Errorf("expected 1 op, got %d", ops)
 	}
-	if _, ok := mockNFT.rules["fw_1"]; !ok {
-		t.Error("expected rule fw_1 to be added")
+	if _, ok := mockWG.peers["pk1"]; !ok {
+		t.Error("expected peer pk1 to be added")
 	}
 }
 
-func TestReconcileFirewallRemoveExtraRule(t *testing.T) {
-	rec, _, _, _, mockNFT := setupReconciler(t)
+func TestReconcileWireGuardBatchesPeers(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
 
-	// NFT has a rule not in SQLite
-	mockNFT.rules["stale_fw"] = firewall.Rule{ID: "stale_fw", Port: 9090, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow"}
+	tunnelStore := store.NewTunnelStore(db)
+	for i := 1; i <= 3; i++ {
+		tunnelStore.Create(&store.Tunnel{ID: fmt.Sprintf("tun_%d", i), PublicKey: fmt.Sprintf("pk%d", i), VpnIP: fmt.Sprintf("10.0.0.%d", i+1), Enabled: true, Domains: []string{}})
+	}
+	tunnelStore.Create(&store.Tunnel{ID: "tun_old", PublicKey: "pk_old", VpnIP: "10.0.0.9", Enabled: false, Domains: []string{}})
+	mockWG.AddPeer("wg0", "pk_old", "", "10.0.0.9", nil, 0)
 
-	ops, err := rec.reconcileFirewall()
+	ops, err := applied(rec.reconcileWireGuard())
 	if err != nil {
-		t.Fatalf("reconcile fw: %v", err)
+		t.Fatalf("reconcile wg: %v", err)
+	}
+	if ops != 4 || mockWG.applyCalls != 1 {
+		t.Errorf("expected 4 ops in 1 batch, got %d in %d", ops, mockWG.applyCalls)
+	}
+	if _, ok := mockWG.peers["pk_old"]; ok || len(mockWG.peers) != 3 {
+		t.Errorf("expected the 3 enabled peers only, got %v", mockWG.peers)
 	}
 
-	if ops != 1 {
-		t.Errorf("expected 1 op, got %d", ops)
+	// A failed batch is applied one peer at a time
+	mockWG.applyErr = fmt.Errorf("netlink: message too long")
+	delete(mockWG.peers, "pk2")
+	ops, err = applied(rec.reconcileWireGuard())
+	if err != nil {
+		t.Fatalf("reconcile wg: %v", err)
 	}
-	if _, ok := mockNFT.rules["stale_fw"]; ok {
-		t.Error("expected stale rule to be removed")
+	if _, ok := mockWG.peers["pk2"]; !ok || ops != 1 {
+		t.Errorf("expected pk2 re-added on its own, got %d ops", ops)
 	}
 }
 
-func TestReconcileNoDrift(t *testing.T) {
+func TestReconcileWireGuardAppliesPendingPSK(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+
+	// An approved tunnel whose peer the API could not add
+	tunnelStore := store.NewTunnelStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}, PendingPSK: "psk1"})
+
+	if _, err := applied(rec.reconcileWireGuard()); err != nil {
+		t.Fatalf("reconcile wg: %v", err)
+	}
+	if mockWG.psks["pk1"] != "psk1" {
+		t.Errorf("expected the peer added with its pending PSK, got %q", mockWG.psks["pk1"])
+	}
+	if tunnel, _ := tunnelStore.Get("tun_1"); tunnel.PendingPSK != "" {
+		t.Error("expected the applied PSK to be cleared")
+	}
+}
+
+func TestReconcileWireGuardKeepalive(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	rec.SetPeerDefaults(15*time.Second, 3*time.Minute)
+
+	tunnelStore := store.NewTunnelStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	mockWG.AddPeer("wg0", "pk1", "psk1", "10.0.0.2", nil, 15*time.Second)
+
+	ops, _ := applied(rec.reconcileWireGuard())
+	if ops != 0 {
+		t.Errorf("expected no ops for a matching keepalive, got %d", ops)
+	}
+
+	keepalive := 0
+	tunnelStore.UpdateConnectionSettings("tun_1", &keepalive, nil)
+	ops, _ = applied(rec.reconcileWireGuard())
+	if ops != 1 {
+		t.Errorf("expected 1 op, got %d", ops)
+	}
+	if mockWG.peers["pk1"].Keepalive != 0 {
+		t.Errorf("expected keepalive disabled, got %s", mockWG.peers["pk1"].Keepalive)
+	}
+	if mockWG.psks["pk1"] != "psk1" {
+		t.Error("expected the keepalive update to keep the PSK")
+	}
+}
+
+func TestReconcileWireGuardAdvertisedRoutes(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+
+	tunnelStore := store.NewTunnelStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{},
+		AdvertisedRoutes: []string{"192.168.1.0/24"}})
+	// The peer lost its LAN, e.g. after a restart of the interface
+	mockWG.AddPeer("wg0", "pk1", "psk1", "10.0.0.2", nil, wireguard.DefaultKeepalive)
+
+	ops, _ := applied(rec.reconcileWireGuard())
+	if ops != 1 {
+		t.Errorf("expected 1 op, got %d", ops)
+	}
+	if got := mockWG.peers["pk1"].AllowedIPs; len(got) != 2 || got[1] != "192.168.1.0/24" {
+		t.Errorf("expected the advertised route restored, got %v", got)
+	}
+	if mockWG.psks["pk1"] != "psk1" {
+		t.Error("expected the route update to keep the PSK")
+	}
+
+	ops, _ = applied(rec.reconcileWireGuard())
+	if ops != 0 {
+		t.Errorf("expected no ops once in sync, got %d", ops)
+	}
+}
+
+func TestReconcileSkippedOnStandby(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+
+	tunnelStore := store.NewTunnelStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+
+	leader := false
+	rec.SetLeaderCheck(func() bool { return leader })
+	rec.reconcileOnce(context.Background(), false)
+	if len(mockWG.peers) != 0 {
+		t.Fatal("a standby must not change WireGuard")
+	}
+
+	leader = true
+	rec.reconcileOnce(context.Background(), false)
+	if _, ok := mockWG.peers["pk1"]; !ok {
+		t.Error("expected the leader to add peer pk1")
+	}
+}
+
+func TestReconcileWireGuardRemoveExtraPeer(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+
+	// WG still has the peer of a tunnel deleted from SQLite
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "stale_pk", VpnIP: "10.0.0.5", Enabled: true, Domains: []string{}})
+	tunnelStore.Delete("tun_1")
+	mockWG.peers["stale_pk"] = wireguard.PeerInfo{PublicKey: "stale_pk", AllowedIPs: []string{"10.0.0.5/32"}}
+
+	ops, err := applied(rec.reconcileWireGuard())
+	if err != nil {
+		t.Fatalf("reconcile wg: %v", err)
+	}
+
+	if ops != 1 {
+		t.Errorf("expected 1 op, got %d", ops)
+	}
+	if _, ok := mockWG.peers["stale_pk"]; ok {
+		t.Error("expected stale peer to be removed")
+	}
+}
+
+func TestReconcileUnmanagedPolicy(t *testing.T) {
+	rec, _, mockCaddy, mockWG, mockNFT := setupReconciler(t)
+
+	// The defaults come from config, keyed by subsystem name
+	for _, system := range []string{SubsystemCaddy, SubsystemWireGuard, SubsystemFirewall} {
+		if rec.UnmanagedPolicy(system) != config.DefaultUnmanagedPolicies[system] || rec.UnmanagedPolicy(system) == "" {
+			t.Errorf("expected the default %s policy, got %q", system, rec.UnmanagedPolicy(system))
+		}
+	}
+
+	mockWG.peers["manual_pk"] = wireguard.PeerInfo{PublicKey: "manual_pk", AllowedIPs: []string{"10.0.0.7/32"}}
+	mockCaddy.config = &caddy.L4Config{Servers: map[string]*caddy.L4Server{
+		"proxy": {Routes: []caddy.CaddyRoute{{ID: "manual-site"}}},
+	}}
+	mockNFT.rules["manual_fw"] = firewall.Rule{ID: "manual_fw", Port: 9090, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow"}
+
+	// By default peers added by hand are reported and kept
+	if ops, err := applied(rec.reconcileWireGuard()); err != nil || ops != 0 {
+		t.Fatalf("expected no ops, got %d, %v", ops, err)
+	}
+	if _, ok := mockWG.peers["manual_pk"]; !ok {
+		t.Error("expected the unmanaged peer to be kept")
+	}
+	found := rec.Unmanaged()[SubsystemWireGuard]
+	if len(found) != 1 || found[0].Kind != "peer" || found[0].ID != "manual_pk" || found[0].FirstSeen.IsZero() {
+		t.Fatalf("expected the peer to be reported, got %+v", found)
+	}
+	firstSeen := found[0].FirstSeen
+	rec.reconcileWireGuard()
+	if found := rec.Unmanaged()[SubsystemWireGuard]; len(found) != 1 || !found[0].FirstSeen.Equal(firstSeen) {
+		t.Errorf("expected the peer to keep its first sighting, got %+v", found)
+	}
+
+	// Ignored resources are kept without being reported
+	rec.SetUnmanagedPolicy(SubsystemCaddy, config.UnmanagedIgnore)
+	rec.SetUnmanagedPolicy(SubsystemFirewall, config.UnmanagedReport)
+	if _, err := applied(rec.reconcileCaddy(context.Background())); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	if len(mockCaddy.deletedIDs) != 0 {
+		t.Errorf("expected the unmanaged route to be kept, deleted %v", mockCaddy.deletedIDs)
+	}
+	if found := rec.Unmanaged()[SubsystemCaddy]; len(found) != 0 {
+		t.Errorf("expected nothing reported for caddy, got %+v", found)
+	}
+	if _, err := applied(rec.reconcileFirewall(time.Now())); err != nil {
+		t.Fatalf("reconcile fw: %v", err)
+	}
+	if _, ok := mockNFT.rules["manual_fw"]; !ok {
+		t.Error("expected the unmanaged rule to be kept")
+	}
+	if found := rec.Unmanaged()[SubsystemFirewall]; len(found) != 1 || found[0].Kind != "firewall_rule" {
+		t.Errorf("expected the rule to be reported, got %+v", found)
+	}
+
+	// The delete policy removes them and clears the report
+	rec.SetUnmanagedPolicy(SubsystemWireGuard, config.UnmanagedDelete)
+	if ops, err := applied(rec.reconcileWireGuard()); err != nil || ops != 1 {
+		t.Fatalf("expected 1 op, got %d, %v", ops, err)
+	}
+	if _, ok := mockWG.peers["manual_pk"]; ok {
+		t.Error("expected the unmanaged peer to be removed")
+	}
+	if found := rec.Unmanaged()[SubsystemWireGuard]; len(found) != 0 {
+		t.Errorf("expected no report under the delete policy, got %+v", found)
+	}
+}
+
+func TestReconcileFirewallAddMissingRule(t *testing.T) {
+	rec, db, _, _, mockNFT := setupReconciler(t)
+
+	fwStore := store.NewFirewallStore(db)
+	fwStore.Create(&store.FirewallRule{
+		ID: "fw_1", Port: 8080, Proto: "tcp", Direction: "in",
+		SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true,
+	})
+
+	ops, err := applied(rec.reconcileFirewall(time.Now()))
+	if err != nil {
+		t.Fatalf("reconcile fw: %v", err)
+	}
+
+	if ops != 1 {
+		t.Errorf("expected 1 op, got %d", ops)
+	}
+	if _, ok := mockNFT.rules["fw_1"]; !ok {
+		t.Error("expected rule fw_1 to be added")
+	}
+}
+
+func TestReconcileFirewallRemoveExtraRule(t *testing.T) {
+	rec, _, _, _, mockNFT := setupReconciler(t)
+
+	// NFT has a rule not in SQLite
+	mockNFT.rules["stale_fw"] = firewall.Rule{ID: "stale_fw", Port: 9090, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow"}
+
+	ops, err := applied(rec.reconcileFirewall(time.Now()))
+	if err != nil {
+		t.Fatalf("reconcile fw: %v", err)
+	}
+
+	if ops != 1 {
+		t.Errorf("expected 1 op, got %d", ops)
+	}
+	if _, ok := mockNFT.rules["stale_fw"]; ok {
+		t.Error("expected stale rule to be removed")
+	}
+}
+
+func TestReconcileFirewallActiveHours(t *testing.T) {
+	rec, db, _, _, mockNFT := setupReconciler(t)
+
+	fwStore := store.NewFirewallStore(db)
+	fwStore.Create(&store.FirewallRule{
+		ID: "fw_day", Port: 8080, Proto: "tcp", Direction: "in",
+		SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true, ActiveHours: "08:00-18:00",
+	})
+
+	morning := time.Date(2026, 1, 2, 8, 0, 0, 0, time.UTC)
+	if ops, err := applied(rec.reconcileFirewall(morning)); err != nil || ops != 1 {
+		t.Fatalf("expected 1 op when the window opens, got %d, %v", ops, err)
+	}
+	if _, ok := mockNFT.rules["fw_day"]; !ok {
+		t.Fatal("expected the rule to be added within its active hours")
+	}
+
+	if ops, err := applied(rec.reconcileFirewall(morning.Add(10 * time.Hour))); err != nil || ops != 1 {
+		t.Fatalf("expected 1 op when the window closes, got %d, %v", ops, err)
+	}
+	if _, ok := mockNFT.rules["fw_day"]; ok {
+		t.Error("expected the rule to be removed outside its active hours")
+	}
+}
+
+func TestReconcileBans(t *testing.T) {
+	rec, db, _, _, mockNFT := setupReconciler(t)
+	fwStore := store.NewFirewallStore(db)
+	now := time.Now()
+
+	fwStore.AddBan(&store.Ban{IP: "198.51.100.7", Reason: "test", Hits: 20, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	fwStore.AddBan(&store.Ban{IP: "198.51.100.8", Reason: "test", Hits: 20, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)})
+	// Enforced in nftables but expired in SQLite
+	mockNFT.bans = map[string]bool{"198.51.100.8": true}
+
+	ops, err := applied(rec.reconcileBans(now))
+	if err != nil {
+		t.Fatalf("reconcile bans: %v", err)
+	}
+	if ops != 2 {
+		t.Errorf("expected 2 ops, got %d", ops)
+	}
+	if !mockNFT.bans["198.51.100.7"] || mockNFT.bans["198.51.100.8"] {
+		t.Errorf("unexpected bans: %v", mockNFT.bans)
+	}
+	if active, _ := fwStore.ListBans(now.Add(-2 * time.Hour)); len(active) != 1 {
+		t.Errorf("expected expired ban deleted, got %d bans", len(active))
+	}
+}
+
+func TestReconcileIsolation(t *testing.T) {
+	rec, db, _, _, mockNFT := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+
+	tunnelStore.Create(&store.Tunnel{ID: "tun_iso", PublicKey: "pk_iso", VpnIP: "10.0.0.2", Enabled: true, Isolate: true})
+	tunnelStore.Create(&store.Tunnel{ID: "tun_open", PublicKey: "pk_open", VpnIP: "10.0.0.3", Enabled: true})
+	tunnelStore.Create(&store.Tunnel{ID: "tun_off", PublicKey: "pk_off", VpnIP: "10.0.0.4", Enabled: false, Isolate: true})
+	// Left over from a tunnel that is no longer isolated
+	mockNFT.isolated = map[string]bool{"10.0.0.3": true}
+
+	ops, err := applied(rec.reconcileIsolation())
+	if err != nil {
+		t.Fatalf("reconcile isolation: %v", err)
+	}
+	if ops != 2 {
+		t.Errorf("expected 2 ops, got %d", ops)
+	}
+	if len(mockNFT.isolated) != 1 || !mockNFT.isolated["10.0.0.2"] {
+		t.Errorf("expected only 10.0.0.2 isolated, got %v", mockNFT.isolated)
+	}
+}
+
+func TestReconcileUpstreamPorts(t *testing.T) {
+	rec, db, _, _, mockNFT := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+
+	web := []store.PortRange{{Start: 443, End: 443}}
+	tunnelStore.Create(&store.Tunnel{ID: "tun_web", PublicKey: "pk_web", VpnIP: "10.0.0.2", Enabled: true, AllowedUpstreamPorts: web})
+	tunnelStore.Create(&store.Tunnel{ID: "tun_lan", PublicKey: "pk_lan", VpnIP: "10.0.0.3", Enabled: true,
+		AdvertisedRoutes: []string{"192.168.1.0/24"}, AllowedUpstreamPorts: web})
+	tunnelStore.Create(&store.Tunnel{ID: "tun_open", PublicKey: "pk_open", VpnIP: "10.0.0.4", Enabled: true})
+	tunnelStore.Create(&store.Tunnel{ID: "tun_off", PublicKey: "pk_off", VpnIP: "10.0.0.5", Enabled: false, AllowedUpstreamPorts: web})
+	// Left over from an unrestricted tunnel, and an outdated restriction
+	mockNFT.upstream = map[string]firewall.UpstreamRestriction{
+		"10.0.0.4": {IP: "10.0.0.4", Dests: []string{"10.0.0.4/32"}, Allowed: []firewall.PortRange{{Start: 22, End: 22}}},
+		"10.0.0.3": {IP: "10.0.0.3", Dests: []string{"10.0.0.3/32"}, Allowed: []firewall.PortRange{{Start: 443, End: 443}}},
+	}
+
+	ops, err := applied(rec.reconcileUpstreamPorts())
+	if err != nil {
+		t.Fatalf("reconcile upstream ports: %v", err)
+	}
+	if ops != 3 {
+		t.Errorf("expected 3 ops, got %d", ops)
+	}
+	if len(mockNFT.upstream) != 2 {
+		t.Fatalf("expected 10.0.0.2 and 10.0.0.3 restricted, got %v", mockNFT.upstream)
+	}
+	if got := mockNFT.upstream["10.0.0.3"].Dests; !slices.Equal(got, []string{"10.0.0.3/32", "192.168.1.0/24"}) {
+		t.Errorf("expected the advertised route restricted too, got %v", got)
+	}
+
+	// Converged: nothing left to do
+	if ops, err := applied(rec.reconcileUpstreamPorts()); err != nil || ops != 0 {
+		t.Errorf("expected no ops on a second pass, got %d, %v", ops, err)
+	}
+}
+
+func TestReconcileServices(t *testing.T) {
+	rec, db, _, _, mockNFT := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	routeStore.Create(&store.Route{
+		ID: "route_web", TunnelID: "tun_1", ListenPort: 443, Protocol: "tcp", MatchType: "sni",
+		MatchValue: []string{"app.example.com"}, Upstream: "10.0.0.2:443",
+		CaddyID: "route-web", Enabled: true, QUIC: true,
+	})
+	routeStore.Create(&store.Route{
+		ID: "route_games", TunnelID: "tun_1", ListenPort: 27015, ListenPortEnd: 27016, Protocol: "udp",
+		MatchType: "port_forward", Upstream: "10.0.0.2:28015", CaddyID: "route-games", Enabled: true,
+	})
+
+	// Under an accept policy no service is needed, and stale ones go
+	mockNFT.services = map[string]firewall.Service{"tcp/8080": {Name: "tcp/8080", Proto: "tcp", Port: 8080}}
+	if ops, err := applied(rec.reconcileServices()); err != nil || ops != 1 || len(mockNFT.services) != 0 {
+		t.Fatalf("expected the stale service removed, got %d ops, %v, services %v", ops, err, mockNFT.services)
+	}
+
+	rec.fwManager.SetChainOptions(firewall.ChainOptions{
+		Policy: firewall.PolicyDrop,
+		Services: []firewall.Service{
+			{Name: "ssh", Proto: "tcp", Port: 22},
+			{Name: "https", Proto: "tcp", Port: 443}, // covers route_web's TCP half
+		},
+	})
+	ops, err := applied(rec.reconcileServices())
+	if err != nil {
+		t.Fatalf("reconcile services: %v", err)
+	}
+	if ops != 4 {
+		t.Errorf("expected 4 services opened, got %d: %v", ops, mockNFT.services)
+	}
+	for _, name := range []string{"ssh", "https", "udp/443", "udp/27015-27016"} {
+		if _, ok := mockNFT.services[name]; !ok {
+			t.Errorf("expected service %s, got %v", name, mockNFT.services)
+		}
+	}
+
+	// A service whose port changed is replaced
+	mockNFT.services["ssh"] = firewall.Service{Name: "ssh", Proto: "tcp", Port: 2222}
+	if ops, _ := applied(rec.reconcileServices()); ops != 1 || mockNFT.services["ssh"].Port != 22 {
+		t.Errorf("expected ssh replaced in 1 op, got %d: %+v", ops, mockNFT.services["ssh"])
+	}
+	if ops, _ := applied(rec.reconcileServices()); ops != 0 {
+		t.Errorf("expected no drift, got %d ops", ops)
+	}
+}
+
+func TestReconcileNoDrift(t *testing.T) {
 	rec, db, _, _, _ := setupReconciler(t)
 
 	// Everything empty — no drift
 	ctx := context.Background()
-	rec.reconcileOnce(ctx)
+	rec.reconcileOnce(ctx, false)
 
 	// Check reconciliation state updated
 	fwStore := store.NewFirewallStore(db)
@@ -355,7 +1211,7 @@ func TestReconcileCaddyError(t *testing.T) {
 	mockCaddy.getErr = fmt.Errorf("socket down")
 
 	ctx := context.Background()
-	_, err := rec.reconcileCaddy(ctx)
+	_, err := applied(rec.reconcileCaddy(ctx))
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -369,7 +1225,7 @@ func TestReconcileWireGuardError(t *testing.T) {
 	rec.wgManager = wireguard.NewManager("wg0", &errorWGClient{})
 	_ = mockWG2
 
-	_, err := rec.reconcileWireGuard()
+	_, err := applied(rec.reconcileWireGuard())
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -377,16 +1233,23 @@ func TestReconcileWireGuardError(t *testing.T) {
 
 type errorWGClient struct{}
 
-func (e *errorWGClient) AddPeer(iface string, pubkey, psk, vpnIP string) error {
+func (e *errorWGClient) AddPeer(iface string, pubkey, psk, vpnIP string, routes []string, keepalive time.Duration) error {
 	return fmt.Errorf("add error")
 }
 func (e *errorWGClient) RemovePeer(iface string, pubkey string) error {
 	return fmt.Errorf("remove error")
 }
+func (e *errorWGClient) ApplyPeers(iface string, peers []wireguard.PeerConfig) error {
+	return fmt.Errorf("apply error")
+}
 func (e *errorWGClient) GetDevice(iface string) (*wireguard.DeviceInfo, error) {
 	return nil, fmt.Errorf("device error")
 }
 
+func (e *errorWGClient) HostPrefixes(iface string) ([]netip.Prefix, error) {
+	return nil, fmt.Errorf("device error")
+}
+
 func TestCheckRotationsAutoRevoke(t *testing.T) {
 	rec, db, _, mockWG, _ := setupReconciler(t)
 
@@ -413,3 +1276,1007 @@ func TestCheckRotationsAutoRevoke(t *testing.T) {
 		t.Error("expected tunnel to be deleted due to inactivity")
 	}
 }
+
+func TestCheckRotationsAutoRevokeObserved(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	rec.SetMode(ModeObserve)
+	tunnelStore := store.NewTunnelStore(db)
+
+	oldTime := time.Now().Add(-100 * 24 * time.Hour)
+	tunnelStore.Create(&store.Tunnel{
+		ID: "tun_old", PublicKey: "pk_old", VpnIP: "10.0.0.2",
+		Enabled: true, Domains: []string{},
+		AutoRevokeInactive: true, InactiveExpiryDays: 90,
+		LastHandshake: &oldTime,
+	})
+	mockWG.peers["pk_old"] = wireguard.PeerInfo{PublicKey: "pk_old"}
+
+	rec.reconcileOnce(context.Background(), true)
+
+	// The tunnel and its peer stay, and the revocation is listed as drift
+	if _, err := tunnelStore.Get("tun_old"); err != nil {
+		t.Errorf("expected tunnel kept in observe mode, got %v", err)
+	}
+	if _, ok := mockWG.peers["pk_old"]; !ok {
+		t.Error("expected peer kept in observe mode")
+	}
+	drift := rec.Drift()[SubsystemWireGuard]
+	if !slices.ContainsFunc(drift, func(d ObservedDrift) bool { return d.ID == "tun_old" && d.Type == "remove" }) {
+		t.Errorf("expected the revocation listed, got %+v", drift)
+	}
+	runs, _ := store.NewReconcileRunStore(db).List(1)
+	if runs[0].Status != "drift_detected" || runs[0].Subsystems[SubsystemWireGuard].Observed != len(drift) {
+		t.Errorf("expected the revocation counted as observed, got %q %+v", runs[0].Status, runs[0].Subsystems)
+	}
+}
+
+func TestUpdatePeerStatsRecordsHistory(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	mockWG.peers["pk1"] = wireguard.PeerInfo{PublicKey: "pk1", ReceiveBytes: 1000, TransmitBytes: 500}
+
+	// History is disabled by default
+	rec.updatePeerStats()
+	var count int
+	db.Conn().QueryRow(`SELECT COUNT(*) FROM peer_stats_history`).Scan(&count)
+	if count != 0 {
+		t.Fatalf("expected no samples without retention, got %d", count)
+	}
+
+	rec.SetStatsRetention(24 * time.Hour)
+	rec.updatePeerStats()
+	db.Conn().QueryRow(`SELECT COUNT(*) FROM peer_stats_history WHERE peer_id = 'tun_1'`).Scan(&count)
+	if count != 1 {
+		t.Errorf("expected 1 sample, got %d", count)
+	}
+}
+
+func TestRouteStats(t *testing.T) {
+	rec, db, _, _, mockNFT := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	routeStore.Create(&store.Route{
+		ID: "route_web", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"app.example.com"}, Upstream: "10.0.0.2:443",
+		CaddyID: "route-web", Enabled: true, QUIC: true,
+	})
+	routeStore.Create(&store.Route{
+		ID: "route_games", TunnelID: "tun_1", ListenPort: 27015, ListenPortEnd: 27016, MatchType: "port_forward",
+		Upstream: "10.0.0.2:28015", CaddyID: "route-games", Enabled: true,
+	})
+
+	// Counters are only kept while route stats are enabled
+	if ops, _ := applied(rec.reconcileRouteCounters()); ops != 0 || len(mockNFT.counters) != 0 {
+		t.Fatalf("expected no counters without route stats, got %d", len(mockNFT.counters))
+	}
+
+	conns := []sockstats.Conn{
+		{Cookie: 1, Remote: netip.MustParseAddrPort("10.0.0.2:443")},
+		{Cookie: 2, Remote: netip.MustParseAddrPort("10.0.0.2:28015")},
+		{Cookie: 3, Remote: netip.MustParseAddrPort("10.0.0.2:28016")},
+		{Cookie: 4, Remote: netip.MustParseAddrPort("192.0.2.1:443")}, // not an upstream
+	}
+	rec.SetRouteStats(func() ([]sockstats.Conn, error) { return conns, nil }, time.Hour)
+
+	ops, err := applied(rec.reconcileRouteCounters())
+	if err != nil {
+		t.Fatalf("reconcile route counters: %v", err)
+	}
+	if ops != 3 {
+		t.Errorf("expected 3 counters added, got %d", ops)
+	}
+	games := mockNFT.counters["counter:tcp:route_games"]
+	if games.Addr != "10.0.0.2" || games.Port != 28015 || games.PortEnd != 28016 {
+		t.Errorf("unexpected port range counter %+v", games)
+	}
+	if _, ok := mockNFT.counters["counter:udp:route_web"]; !ok {
+		t.Error("expected a UDP counter for the QUIC half of route_web")
+	}
+
+	// A changed upstream replaces the counter
+	mockNFT.counters["counter:tcp:route_games"] = firewall.RouteCounter{ID: "route_games", Proto: "tcp", Addr: "10.0.0.2", Port: 1}
+	if ops, _ := applied(rec.reconcileRouteCounters()); ops != 2 || mockNFT.counters["counter:tcp:route_games"].Port != 28015 {
+		t.Errorf("expected the stale counter to be replaced in 2 ops, got %d", ops)
+	}
+
+	for key, bytes := range map[string]uint64{"counter:tcp:route_web": 1000, "counter:udp:route_web": 500, "counter:tcp:route_games": 60} {
+		c := mockNFT.counters[key]
+		c.RxBytes, c.TxBytes = bytes, bytes/10
+		mockNFT.counters[key] = c
+	}
+	rec.updateRouteStats()
+	latest, err := routeStore.LatestStats()
+	if err != nil {
+		t.Fatalf("latest stats: %v", err)
+	}
+	if got := latest["route_web"]; got.ActiveConns != 1 || got.RxBytes != 1500 || got.TxBytes != 150 {
+		t.Errorf("route_web: expected TCP and QUIC traffic summed, got %+v", got)
+	}
+	if got := latest["route_games"]; got.ActiveConns != 2 || got.RxBytes != 60 || got.TxBytes != 6 {
+		t.Errorf("route_games: expected connections to both ports, got %+v", got)
+	}
+
+	// A newer route sharing route_web's upstream is not counted, so the
+	// upstream's traffic is only recorded once
+	routeStore.Create(&store.Route{
+		ID: "route_blog", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"blog.example.com"}, Upstream: "10.0.0.2:443",
+		CaddyID: "route-blog", Enabled: true,
+	})
+	db.Conn().Exec(`UPDATE l4_routes SET created_at = created_at + 60 WHERE id = 'route_blog'`)
+	if ops, _ := applied(rec.reconcileRouteCounters()); ops != 0 {
+		t.Errorf("expected no counter for a shared upstream, got %d ops", ops)
+	}
+	rec.updateRouteStats()
+	if latest, _ := routeStore.LatestStats(); len(latest) != 2 {
+		t.Errorf("expected stats for route_web and route_games only, got %+v", latest)
+	}
+}
+
+type recordingNotifier struct {
+	events []notify.Event
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, e notify.Event) error {
+	n.events = append(n.events, e)
+	return nil
+}
+
+func TestExpirePendingApprovals(t *testing.T) {
+	rec, db, _, _, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+	rec.SetApprovalTTL(72 * time.Hour)
+
+	for i, id := range []string{"tun_old", "tun_new"} {
+		tunnelStore.Create(&store.Tunnel{
+			ID: id, PublicKey: "pk_" + id, VpnIP: fmt.Sprintf("10.0.0.%d", i+2),
+			Domains: []string{}, PendingApproval: true, PendingPSK: "psk",
+		})
+	}
+	routeStore.Create(&store.Route{ID: "route_old", TunnelID: "tun_old", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"old.example.com"}, Upstream: "10.0.0.2:443", CaddyID: "route-old"})
+	db.Conn().Exec(`UPDATE wg_peers SET created_at = created_at - 73*3600 WHERE id = 'tun_old'`)
+
+	rec.expirePendingApprovals(time.Now())
+
+	if _, err := tunnelStore.Get("tun_old"); err == nil {
+		t.Error("expected the expired request to be discarded")
+	}
+	if routes, _ := routeStore.ListByTunnelID("tun_old"); len(routes) != 0 {
+		t.Errorf("expected its routes deleted, got %d", len(routes))
+	}
+	if _, err := tunnelStore.Get("tun_new"); err != nil {
+		t.Errorf("expected the recent request kept: %v", err)
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventTunnelRejected || notifier.events[0].TunnelID != "tun_old" {
+		t.Errorf("expected a rejected event for tun_old, got %+v", notifier.events)
+	}
+}
+
+func TestCheckRotationsWarnsBeforeRevocation(t *testing.T) {
+	rec, db, _, _, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+	rec.SetInactivityWarning(7 * 24 * time.Hour)
+
+	// Revocation due in 3 days: inside the warning window
+	lastHS := time.Now().Add(-87 * 24 * time.Hour)
+	tunnelStore.Create(&store.Tunnel{
+		ID: "tun_idle", PublicKey: "pk_idle", VpnIP: "10.0.0.2",
+		Enabled: true, Domains: []string{},
+		AutoRevokeInactive: true, InactiveExpiryDays: 90,
+		LastHandshake: &lastHS,
+	})
+
+	rec.checkRotations()
+	rec.checkRotations()
+
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventTunnelExpiring {
+		t.Fatalf("expected a single expiring event, got %+v", notifier.events)
+	}
+	if _, err := tunnelStore.Get("tun_idle"); err != nil {
+		t.Fatal("tunnel should not be revoked yet")
+	}
+
+	// Deferring revocation re-arms the warning for the new expiry
+	tunnelStore.DeferRevocation("tun_idle", time.Now().Add(5*24*time.Hour))
+	rec.checkRotations()
+	if len(notifier.events) != 2 {
+		t.Errorf("expected a new warning after deferral, got %d events", len(notifier.events))
+	}
+}
+
+func TestCheckRotationsRevocationNotifies(t *testing.T) {
+	rec, db, _, _, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+
+	lastHS := time.Now().Add(-100 * 24 * time.Hour)
+	tunnelStore.Create(&store.Tunnel{
+		ID: "tun_old", PublicKey: "pk_old", VpnIP: "10.0.0.2",
+		Enabled: true, Domains: []string{},
+		AutoRevokeInactive: true, InactiveExpiryDays: 90,
+		LastHandshake: &lastHS,
+	})
+
+	// A deferral in the future keeps the tunnel alive
+	tunnelStore.DeferRevocation("tun_old", time.Now().Add(24*time.Hour))
+	rec.checkRotations()
+	if _, err := tunnelStore.Get("tun_old"); err != nil {
+		t.Fatal("deferred tunnel should not be revoked")
+	}
+
+	tunnelStore.DeferRevocation("tun_old", time.Now().Add(-time.Hour))
+	rec.checkRotations()
+	if _, err := tunnelStore.Get("tun_old"); err == nil {
+		t.Fatal("expected tunnel to be revoked")
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventTunnelRevoked {
+		t.Errorf("expected a revoked event, got %+v", notifier.events)
+	}
+}
+
+func TestCheckRotationsDisablesExpiredTunnels(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+	rec.SetInactivityWarning(7 * 24 * time.Hour)
+
+	expiresAt := time.Now().Add(3 * 24 * time.Hour)
+	tunnelStore.Create(&store.Tunnel{
+		ID: "tun_contractor", PublicKey: "pk_contractor", VpnIP: "10.0.0.2",
+		Enabled: true, Domains: []string{}, ExpiresAt: &expiresAt,
+	})
+	mockWG.AddPeer("wg0", "pk_contractor", "psk", "10.0.0.2", nil, wireguard.DefaultKeepalive)
+
+	// Inside the warning window: warned once, still enabled
+	rec.checkRotations()
+	rec.checkRotations()
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventTunnelExpiring || notifier.events[0].Data["reason"] != "expires_at" {
+		t.Fatalf("expected a single expiring event, got %+v", notifier.events)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	tunnelStore.SetExpiry("tun_contractor", &past)
+	rec.checkRotations()
+
+	tunnel, err := tunnelStore.Get("tun_contractor")
+	if err != nil {
+		t.Fatal("an expired tunnel should be disabled, not deleted")
+	}
+	if tunnel.Enabled {
+		t.Error("expected the expired tunnel to be disabled")
+	}
+	if _, ok := mockWG.peers["pk_contractor"]; ok {
+		t.Error("expected the expired peer to be removed from the kernel")
+	}
+	if len(notifier.events) != 2 || notifier.events[1].Type != notify.EventTunnelExpired {
+		t.Errorf("expected an expired event, got %+v", notifier.events)
+	}
+}
+
+func TestCheckRotationsRotatesPSK(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+	rec.SetServerEndpoint("vpn.example.com:51820")
+	rec.SetVPNNetwork("10.0.0.1", "10.0.0.0/24")
+
+	tunnelStore.Create(&store.Tunnel{
+		ID: "tun_rot", PublicKey: "pk_rot", VpnIP: "10.0.0.2",
+		Enabled: true, Domains: []string{},
+		AutoRotatePSK: true, PSKRotationIntervalDays: 30,
+		ClientRouting: wireguard.RoutingSubnet,
+	})
+	mockWG.AddPeer("wg0", "pk_rot", "old-psk", "10.0.0.2", nil, wireguard.DefaultKeepalive)
+
+	// Not due yet
+	rec.checkRotations()
+	if mockWG.psks["pk_rot"] != "old-psk" || len(notifier.events) != 0 {
+		t.Fatal("rotation should not run before the interval elapses")
+	}
+
+	past := time.Now().Add(-31 * 24 * time.Hour).Unix()
+	db.Conn().Exec(`UPDATE wg_peers SET last_rotation_at = ? WHERE id = ?`, past, "tun_rot")
+
+	rec.checkRotations()
+
+	newPSK := mockWG.psks["pk_rot"]
+	if newPSK == "" || newPSK == "old-psk" {
+		t.Fatalf("expected a new PSK on the kernel peer, got %q", newPSK)
+	}
+	tunnel, err := tunnelStore.Get("tun_rot")
+	if err != nil {
+		t.Fatalf("get tunnel: %v", err)
+	}
+	if tunnel.PSKHash != wireguard.HashPSK(newPSK) {
+		t.Errorf("expected stored hash of the new PSK, got %q", tunnel.PSKHash)
+	}
+	if tunnel.LastRotationAt == nil || time.Since(*tunnel.LastRotationAt) > time.Minute {
+		t.Errorf("expected last_rotation_at to be updated, got %v", tunnel.LastRotationAt)
+	}
+
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventTunnelPSKRotated {
+		t.Fatalf("expected a psk_rotated event, got %+v", notifier.events)
+	}
+	config, _ := notifier.events[0].Data["config"].(string)
+	if !strings.Contains(config, "PresharedKey = "+newPSK) || !strings.Contains(config, "Endpoint = vpn.example.com:51820") ||
+		!strings.Contains(config, "AllowedIPs = 10.0.0.0/24") {
+		t.Errorf("unexpected config in event:\n%s", config)
+	}
+
+	// The next pass finds the rotation up to date
+	rec.checkRotations()
+	if mockWG.psks["pk_rot"] != newPSK || len(notifier.events) != 1 {
+		t.Error("rotation should not repeat within the interval")
+	}
+}
+
+func TestUpdatePeerStatsEnforcesSourceCIDR(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+
+	tunnelStore.Create(&store.Tunnel{
+		ID: "tun_home", PublicKey: "pk_home", VpnIP: "10.0.0.2",
+		Enabled: true, Domains: []string{}, SourceCIDR: "198.51.100.0/24",
+	})
+	mockWG.peers["pk_home"] = wireguard.PeerInfo{PublicKey: "pk_home", Endpoint: "198.51.100.7:51820"}
+
+	// Inside the CIDR: endpoint is recorded
+	rec.updatePeerStats()
+	tunnel, _ := tunnelStore.Get("tun_home")
+	if !tunnel.Enabled || tunnel.Endpoint != "198.51.100.7:51820" {
+		t.Fatalf("expected allowed endpoint to be recorded, got enabled=%v endpoint=%q", tunnel.Enabled, tunnel.Endpoint)
+	}
+
+	// Roaming outside the CIDR disables the tunnel and removes the peer
+	mockWG.peers["pk_home"] = wireguard.PeerInfo{PublicKey: "pk_home", Endpoint: "203.0.113.4:40000"}
+	rec.updatePeerStats()
+	tunnel, _ = tunnelStore.Get("tun_home")
+	if tunnel.Enabled {
+		t.Error("expected tunnel to be disabled")
+	}
+	if _, ok := mockWG.peers["pk_home"]; ok {
+		t.Error("expected kernel peer to be removed")
+	}
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventTunnelEndpointBlocked {
+		t.Errorf("expected an endpoint_blocked event, got %+v", notifier.events)
+	}
+}
+
+func TestRecordNodePeersFailover(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	tunnelStore.Create(&store.Tunnel{
+		ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true,
+		NodeID: "node_1", FailoverNodeIDs: []string{"node_2"},
+	})
+	tunnelStore.Create(&store.Tunnel{ID: "tun_2", PublicKey: "pk2", VpnIP: "10.0.0.3", Enabled: true, NodeID: "node_3"})
+
+	now := time.Unix(1_700_000_000, 0)
+	active := wireguard.PeerInfo{PublicKey: "pk1", LastHandshakeTime: now.Add(-time.Minute), ReceiveBytes: 100}
+	if err := rec.RecordNodePeers("node_1", []wireguard.PeerInfo{active, {PublicKey: "pk2", ReceiveBytes: 5}}, now); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := tunnelStore.Get("tun_1"); got.RxBytes != 100 {
+		t.Errorf("expected stats from the node the peer handshook with, got rx %d", got.RxBytes)
+	}
+	if got, _ := tunnelStore.Get("tun_2"); got.RxBytes != 0 {
+		t.Error("expected peers of tunnels on other nodes to be ignored")
+	}
+
+	// The standby's idle peer and an older handshake don't overwrite them
+	stale := wireguard.PeerInfo{PublicKey: "pk1", LastHandshakeTime: now.Add(-time.Hour), ReceiveBytes: 7}
+	rec.RecordNodePeers("node_2", []wireguard.PeerInfo{{PublicKey: "pk1"}}, now)
+	rec.RecordNodePeers("node_2", []wireguard.PeerInfo{stale}, now)
+	if got, _ := tunnelStore.Get("tun_1"); got.RxBytes != 100 {
+		t.Errorf("expected stale standby stats to be ignored, got rx %d", got.RxBytes)
+	}
+
+	// After failover the standby reports the newer handshake
+	moved := wireguard.PeerInfo{PublicKey: "pk1", LastHandshakeTime: now, ReceiveBytes: 3}
+	rec.RecordNodePeers("node_2", []wireguard.PeerInfo{moved}, now)
+	if got, _ := tunnelStore.Get("tun_1"); got.RxBytes != 3 {
+		t.Errorf("expected stats from the failover node, got rx %d", got.RxBytes)
+	}
+	if len(mockWG.peers) != 0 {
+		t.Error("expected no local peers for node tunnels")
+	}
+}
+
+func TestPeerConnectionEvents(t *testing.T) {
+	rec, db, _, _, _ := setupReconciler(t)
+	tunnelStore := store.NewTunnelStore(db)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+	tunnel := &store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true}
+	tunnelStore.Create(tunnel)
+	byKey := map[string]*store.Tunnel{"pk1": tunnel}
+
+	now := time.Unix(1_700_000_000, 0)
+	peer := wireguard.PeerInfo{PublicKey: "pk1", Endpoint: "198.51.100.7:51820", LastHandshakeTime: now.Add(-time.Minute)}
+	rec.recordPeers([]wireguard.PeerInfo{peer}, byKey, now)
+	rec.recordPeers([]wireguard.PeerInfo{peer}, byKey, now.Add(time.Minute))
+	if len(notifier.events) != 1 || notifier.events[0].Type != notify.EventTunnelConnected {
+		t.Fatalf("expected one connected event, got %+v", notifier.events)
+	}
+
+	// No handshake for longer than the window: disconnected
+	rec.recordPeers([]wireguard.PeerInfo{peer}, byKey, now.Add(10*time.Minute))
+	if len(notifier.events) != 2 || notifier.events[1].Type != notify.EventTunnelDisconnected {
+		t.Fatalf("expected a disconnected event, got %+v", notifier.events)
+	}
+	if events, _ := tunnelStore.PeerEvents("tun_1"); len(events) != 2 {
+		t.Errorf("expected 2 recorded events, got %d", len(events))
+	}
+
+	// A tunnel with a longer threshold still counts as connected
+	threshold := 900
+	tunnelStore.UpdateConnectionSettings("tun_1", nil, &threshold)
+	tunnel, _ = tunnelStore.Get("tun_1")
+	byKey["pk1"] = tunnel
+	rec.recordPeers([]wireguard.PeerInfo{peer}, byKey, now.Add(10*time.Minute))
+	if len(notifier.events) != 3 || notifier.events[2].Type != notify.EventTunnelConnected {
+		t.Fatalf("expected a connected event under the tunnel's threshold, got %+v", notifier.events)
+	}
+}
+
+// blockingCaddy holds GetL4Config until released and records whether the
+// pass's context was canceled by then.
+type blockingCaddy struct {
+	*mockCaddyClient
+	once     sync.Once
+	started  chan struct{}
+	release  chan struct{}
+	canceled error
+}
+
+func (b *blockingCaddy) GetL4Config(ctx context.Context) (*caddy.L4Config, error) {
+	first := false
+	b.once.Do(func() { first = true; close(b.started) })
+	if first {
+		<-b.release
+		b.canceled = ctx.Err()
+	}
+	return b.mockCaddyClient.GetL4Config(ctx)
+}
+
+func TestRunDrainsOnShutdown(t *testing.T) {
+	rec, db, mockCaddy, _, mockNFT := setupReconciler(t)
+	blocking := &blockingCaddy{mockCaddyClient: mockCaddy, started: make(chan struct{}), release: make(chan struct{})}
+	rec.caddyClient = blocking
+	fwStore := store.NewFirewallStore(db)
+	fwStore.Create(&store.FirewallRule{
+		ID: "fw_1", Port: 8080, Proto: "tcp", Direction: "in",
+		SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rec.Run(ctx)
+	}()
+
+	// Shut down while the initial pass is talking to Caddy
+	<-blocking.started
+	cancel()
+	select {
+	case <-done:
+		t.Fatal("expected Run to wait for the pass in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(blocking.release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the pass finished")
+	}
+
+	if blocking.canceled != nil {
+		t.Errorf("expected the pass to keep its context during the drain, got %v", blocking.canceled)
+	}
+	if _, ok := mockNFT.rules["fw_1"]; !ok {
+		t.Error("expected the pass to go on to apply the firewall")
+	}
+	if rs, err := fwStore.GetReconciliationState(); err != nil || rs.LastStatus != "shutdown" {
+		t.Errorf("expected status shutdown, got %+v, %v", rs, err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	rec, _, _, _, _ := setupReconciler(t)
+	rec.SetDrainTimeout(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pass, release := rec.drainContext(ctx)
+	defer release()
+	cancel()
+	if pass.Err() != nil {
+		t.Fatal("expected the pass to outlive the canceled context")
+	}
+	select {
+	case <-pass.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the pass to be canceled after the drain timeout")
+	}
+}
+
+// countingCaddy counts GetL4Config calls, i.e. attempts to reconcile Caddy.
+type countingCaddy struct {
+	*mockCaddyClient
+	calls int
+}
+
+func (c *countingCaddy) GetL4Config(ctx context.Context) (*caddy.L4Config, error) {
+	c.calls++
+	return c.mockCaddyClient.GetL4Config(ctx)
+}
+
+func TestReconcileBackoff(t *testing.T) {
+	rec, _, mockCaddy, _, _ := setupReconciler(t)
+	counting := &countingCaddy{mockCaddyClient: mockCaddy}
+	rec.caddyClient = counting
+	mockCaddy.getErr = fmt.Errorf("connection refused")
+	ctx := context.Background()
+
+	// The first failure is retried on the next pass, the second backs off
+	rec.reconcileOnce(ctx, false)
+	rec.reconcileOnce(ctx, false)
+	if counting.calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", counting.calls)
+	}
+	st := rec.Subsystems()[SubsystemCaddy]
+	if st.ConsecutiveFailures != 2 || st.RetryAt == nil || st.LastError == "" {
+		t.Fatalf("expected caddy to back off after 2 failures, got %+v", st)
+	}
+	if wg := rec.Subsystems()[SubsystemWireGuard]; wg.ConsecutiveFailures != 0 {
+		t.Errorf("expected wireguard to be unaffected, got %+v", wg)
+	}
+
+	rec.reconcileOnce(ctx, false)
+	if counting.calls != 2 {
+		t.Errorf("expected the timer pass to skip caddy, got %d attempts", counting.calls)
+	}
+	if rs, _ := rec.fwStore.GetReconciliationState(); rs.LastStatus != "error" || !strings.Contains(rs.LastError, "connection refused") {
+		t.Errorf("expected the skipped subsystem to keep the status an error, got %+v", rs)
+	}
+
+	// A forced pass retries anyway; success clears the backoff
+	mockCaddy.getErr = nil
+	rec.reconcileOnce(ctx, true)
+	if counting.calls != 3 {
+		t.Errorf("expected the forced pass to retry caddy, got %d attempts", counting.calls)
+	}
+	if st := rec.Subsystems()[SubsystemCaddy]; st.ConsecutiveFailures != 0 || st.RetryAt != nil {
+		t.Errorf("expected the backoff to be cleared, got %+v", st)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for _, tc := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{20, maxBackoff},
+	} {
+		got := backoffDelay(30*time.Second, tc.failures)
+		if got < tc.want-tc.want/10 || got > tc.want+tc.want/10 {
+			t.Errorf("failures %d: expected %s ±10%%, got %s", tc.failures, tc.want, got)
+		}
+	}
+}
+
+func TestReconcileCaddyUpdatesChangedRoutes(t *testing.T) {
+	rec, db, mockCaddy, _, _ := setupReconciler(t)
+
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	routeStore.Create(&store.Route{
+		ID: "route_1", TunnelID: "tun_1", ListenPort: 443, Protocol: "tcp", MatchType: "sni",
+		MatchValue: []string{"app.example.com", "www.example.com"}, Upstream: "10.0.0.2:8443",
+		CaddyID: "route-1", Enabled: true, QUIC: true,
+	})
+
+	// Caddy still has the route's old domains and upstream
+	mockCaddy.config = &caddy.L4Config{
+		Servers: map[string]*caddy.L4Server{
+			"proxy": {Routes: []caddy.CaddyRoute{
+				caddy.BuildCaddyRoute("route-1", []string{"app.example.com"}, "10.0.0.2:443", "", false),
+			}},
+			caddy.QUICServerName: {Routes: []caddy.CaddyRoute{
+				caddy.BuildQUICRoute("route-1", []string{"app.example.com"}, "10.0.0.2:443"),
+			}},
+		},
+	}
+
+	ops, err := applied(rec.reconcileCaddy(context.Background()))
+	if err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	if ops != 2 || len(mockCaddy.updatedRoutes) != 2 {
+		t.Fatalf("expected the SNI and QUIC routes to be updated, got %d ops: %+v", ops, mockCaddy.updatedRoutes)
+	}
+	if len(mockCaddy.deletedIDs) != 0 || len(mockCaddy.addedRoutes) != 0 {
+		t.Errorf("expected updates in place, got deletes %v and adds %v", mockCaddy.deletedIDs, mockCaddy.addedRoutes)
+	}
+	want := caddy.BuildCaddyRoute("route-1", []string{"app.example.com", "www.example.com"}, "10.0.0.2:8443", "", false)
+	if !caddy.RoutesEqual(mockCaddy.updatedRoutes[0], want) {
+		t.Errorf("unexpected updated route: %+v", mockCaddy.updatedRoutes[0])
+	}
+
+	// Once Caddy matches, nothing is sent
+	mockCaddy.updatedRoutes = nil
+	mockCaddy.config.Servers["proxy"].Routes = []caddy.CaddyRoute{want}
+	mockCaddy.config.Servers[caddy.QUICServerName].Routes = []caddy.CaddyRoute{
+		caddy.BuildQUICRoute("route-1", []string{"app.example.com", "www.example.com"}, "10.0.0.2:8443"),
+	}
+	if ops, _ := applied(rec.reconcileCaddy(context.Background())); ops != 0 || mockCaddy.updatedRoutes != nil {
+		t.Errorf("expected no drift, got %d ops", ops)
+	}
+}
+
+func TestReconcileCaddyPortForwardServers(t *testing.T) {
+	rec, db, mockCaddy, _, _ := setupReconciler(t)
+
+	tunnelStore := store.NewTunnelStore(db)
+	routeStore := store.NewRouteStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	routeStore.Create(&store.Route{
+		ID: "route_ssh", TunnelID: "tun_1", ListenPort: 2222, Protocol: "tcp", MatchType: "port_forward",
+		MatchValue: []string{}, Upstream: "10.0.0.2:22", CaddyID: "route-ssh", Enabled: true,
+	})
+	routeStore.Create(&store.Route{
+		ID: "route_game", TunnelID: "tun_1", ListenPort: 27015, ListenPortEnd: 27016, Protocol: "udp",
+		MatchType: "port_forward", MatchValue: []string{}, Upstream: "udp/10.0.0.2:27015", CaddyID: "route-game", Enabled: true,
+	})
+
+	// After a Caddy restart no pf-* server exists; a stale one is removed,
+	// and one configured by hand is reported and kept
+	mockCaddy.config.Servers["pf-tcp-9999"] = &caddy.L4Server{Listen: []string{":9999"}, Routes: []caddy.CaddyRoute{{ID: "pm-pf-route_old"}}}
+	mockCaddy.config.Servers["pf-tcp-8888"] = &caddy.L4Server{Listen: []string{":8888"}, Routes: []caddy.CaddyRoute{{ID: "admin-tunnel"}}}
+	ops, err := applied(rec.reconcileCaddy(context.Background()))
+	if err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	slices.Sort(mockCaddy.pfServers)
+	if want := []string{"pf-tcp-2222", "pf-udp-27015", "pf-udp-27016"}; !slices.Equal(mockCaddy.pfServers, want) {
+		t.Errorf("expected servers %v to be created, got %v", want, mockCaddy.pfServers)
+	}
+	if !slices.Equal(mockCaddy.deletedServers, []string{"pf-tcp-9999"}) {
+		t.Errorf("expected the stale server to be deleted, got %v", mockCaddy.deletedServers)
+	}
+	if found := rec.Unmanaged()[SubsystemCaddy]; len(found) != 1 || found[0].Kind != "server" || found[0].ID != "pf-tcp-8888" {
+		t.Errorf("expected the hand-configured server to be reported, got %+v", found)
+	}
+	if ops != 4 {
+		t.Errorf("expected 4 ops, got %d", ops)
+	}
+
+	// In sync: nothing to do
+	mockCaddy.pfServers, mockCaddy.deletedServers = nil, nil
+	if ops, _ := applied(rec.reconcileCaddy(context.Background())); ops != 0 || mockCaddy.pfServers != nil {
+		t.Errorf("expected no drift, got %d ops, created %v", ops, mockCaddy.pfServers)
+	}
+
+	// A server forwarding to the wrong upstream is rewritten
+	mockCaddy.config.Servers["pf-tcp-2222"].Routes[0].Handle[0].Upstreams[0].Dial = []string{"10.0.0.9:22"}
+	if ops, _ := applied(rec.reconcileCaddy(context.Background())); ops != 1 || !slices.Equal(mockCaddy.pfServers, []string{"pf-tcp-2222"}) {
+		t.Errorf("expected the changed server to be rewritten, got %d ops, created %v", ops, mockCaddy.pfServers)
+	}
+}
+
+func TestReconcileCountsFailedOps(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	fwStore := store.NewFirewallStore(db)
+	fwStore.Create(&store.FirewallRule{
+		ID: "fw_1", Port: 8080, Proto: "tcp", Direction: "in",
+		SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true,
+	})
+	tunnelStore := store.NewTunnelStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	tunnelStore.Create(&store.Tunnel{ID: "tun_2", PublicKey: "pk2", VpnIP: "10.0.0.3", Enabled: true, Domains: []string{}})
+	mockWG.addErr = fmt.Errorf("device busy")
+
+	rec.reconcileOnce(context.Background(), false)
+
+	runs, err := store.NewReconcileRunStore(db).List(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("expected 1 recorded run, got %d", len(runs))
+	}
+	run := runs[0]
+	want := store.OpCounts{Attempted: 3, Succeeded: 1, Failed: 2}
+	if run.Ops != want {
+		t.Errorf("expected %+v, got %+v", want, run.Ops)
+	}
+	if wg := run.Subsystems[SubsystemWireGuard]; wg != (store.OpCounts{Attempted: 2, Failed: 2}) {
+		t.Errorf("expected both peer additions to fail, got %+v", wg)
+	}
+	if run.Status != "error" || !strings.Contains(run.Error, "wireguard: 2 of 2 operations failed") {
+		t.Errorf("expected the pass to report the failed operations, got %q: %q", run.Status, run.Error)
+	}
+	if rs, _ := fwStore.GetReconciliationState(); rs.DriftCorrections != 1 {
+		t.Errorf("expected only the succeeded op to count as a correction, got %d", rs.DriftCorrections)
+	}
+
+	// Failed operations do not back the subsystem off
+	if st := rec.Subsystems()[SubsystemWireGuard]; st.ConsecutiveFailures != 0 {
+		t.Errorf("expected no backoff for failed operations, got %+v", st)
+	}
+
+	mockWG.addErr = nil
+	rec.reconcileOnce(context.Background(), false)
+	runs, _ = store.NewReconcileRunStore(db).List(1)
+	if runs[0].Status != "drift_corrected" || runs[0].Ops != (store.OpCounts{Attempted: 2, Succeeded: 2}) {
+		t.Errorf("expected the retried peers to be corrected, got %+v", runs[0])
+	}
+}
+
+func TestObserveMode(t *testing.T) {
+	rec, db, mockCaddy, mockWG, mockNFT := setupReconciler(t)
+	notifier := &recordingNotifier{}
+	rec.SetNotifier(notifier)
+	rec.SetMode(ModeObserve)
+	fwStore := store.NewFirewallStore(db)
+	fwStore.Create(&store.FirewallRule{
+		ID: "fw_1", Port: 8080, Proto: "tcp", Direction: "in",
+		SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true,
+	})
+	store.NewTunnelStore(db).Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	store.NewRouteStore(db).Create(&store.Route{
+		ID: "route_1", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"app.example.com"}, Upstream: "10.0.0.2:443",
+		CaddyID: "pm-route-route_1", Enabled: true,
+	})
+	mockCaddy.config = &caddy.L4Config{Servers: map[string]*caddy.L4Server{}}
+
+	rec.reconcileOnce(context.Background(), false)
+
+	// Nothing was changed
+	if mockCaddy.serverExists || len(mockCaddy.addedRoutes) != 0 {
+		t.Errorf("expected caddy untouched, got server %v, routes %v", mockCaddy.serverExists, mockCaddy.addedRoutes)
+	}
+	if len(mockWG.peers) != 0 || mockWG.applyCalls != 0 {
+		t.Errorf("expected no peers applied, got %d peers and %d calls", len(mockWG.peers), mockWG.applyCalls)
+	}
+	if len(mockNFT.rules) != 0 {
+		t.Errorf("expected no firewall rules added, got %v", mockNFT.rules)
+	}
+
+	// ...but the drift was recorded and reported
+	runs, _ := store.NewReconcileRunStore(db).List(1)
+	if runs[0].Status != "drift_detected" || runs[0].Ops != (store.OpCounts{Observed: 4}) {
+		t.Errorf("expected 4 observed ops, got %q %+v", runs[0].Status, runs[0].Ops)
+	}
+	if rs, _ := fwStore.GetReconciliationState(); rs.LastStatus != "drift_detected" || rs.DriftCorrections != 0 {
+		t.Errorf("expected drift_detected without corrections, got %q and %d", rs.LastStatus, rs.DriftCorrections)
+	}
+	drift := rec.Drift()
+	if got := drift[SubsystemWireGuard]; len(got) != 1 || got[0].ID != "pk1" || got[0].Type != "add" {
+		t.Errorf("expected the missing peer listed, got %+v", got)
+	}
+	if len(drift[SubsystemCaddy]) != 2 || len(drift[SubsystemFirewall]) != 1 {
+		t.Errorf("expected caddy and firewall drift listed, got %+v", drift)
+	}
+	if len(notifier.events) != 3 || notifier.events[0].Type != notify.EventDriftDetected {
+		t.Fatalf("expected a drift event per subsystem, got %+v", notifier.events)
+	}
+
+	// Drift already reported is not sent again
+	rec.reconcileOnce(context.Background(), false)
+	if len(notifier.events) != 3 {
+		t.Errorf("expected no new events, got %d", len(notifier.events)-3)
+	}
+	if first := rec.Drift()[SubsystemWireGuard][0].FirstSeen; !first.Equal(drift[SubsystemWireGuard][0].FirstSeen) {
+		t.Errorf("expected first_seen kept, got %v", first)
+	}
+
+	// Enforcing corrects it and clears the list
+	rec.SetMode(ModeEnforce)
+	rec.reconcileOnce(context.Background(), true)
+	if len(mockWG.peers) != 1 || len(mockCaddy.addedRoutes) != 1 || len(mockNFT.rules) != 1 {
+		t.Errorf("expected the drift corrected, got %d peers, %d routes, %d rules", len(mockWG.peers), len(mockCaddy.addedRoutes), len(mockNFT.rules))
+	}
+	if drift := rec.Drift(); len(drift) != 0 {
+		t.Errorf("expected no drift listed, got %+v", drift)
+	}
+}
+
+func TestStartupReport(t *testing.T) {
+	rec, db, _, mockWG, _ := setupReconciler(t)
+	fwStore := store.NewFirewallStore(db)
+	tunnelStore := store.NewTunnelStore(db)
+	tunnelStore.Create(&store.Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	tunnelStore.Create(&store.Tunnel{ID: "tun_2", PublicKey: "pk2", VpnIP: "10.0.0.3", Enabled: true, Domains: []string{}})
+	mockWG.peers["pk1"] = wireguard.PeerInfo{PublicKey: "pk1", AllowedIPs: []string{"10.0.0.2/32"}, Keepalive: wireguard.DefaultKeepalive}
+	// The previous process stopped without recording its shutdown
+	fwStore.UpdateReconciliationState("ok", nil, 0)
+
+	rec.reconcileOnce(context.Background(), false)
+
+	report, err := fwStore.GetStartupReport()
+	if err != nil || report == nil {
+		t.Fatalf("expected a startup report, got %v", err)
+	}
+	if report.PreviousStatus != "ok" || report.PreviousRunAt == nil || report.Mode != ModeEnforce {
+		t.Errorf("expected the unclean previous state recorded, got %+v", report)
+	}
+	wg := report.Subsystems[SubsystemWireGuard]
+	if wg.InSync || len(wg.Ops) != 1 || wg.Ops[0] != (store.RepairOp{Type: "add", ID: "pk2", Detail: "peer", Result: "repaired"}) {
+		t.Errorf("expected the missing peer repaired, got %+v", wg)
+	}
+	if !report.Subsystems[SubsystemCaddy].InSync || report.Status != "drift_corrected" {
+		t.Errorf("expected caddy in sync and drift corrected, got %+v", report)
+	}
+
+	// Later passes leave it alone
+	tunnelStore.Create(&store.Tunnel{ID: "tun_3", PublicKey: "pk3", VpnIP: "10.0.0.4", Enabled: true, Domains: []string{}})
+	rec.reconcileOnce(context.Background(), true)
+	if again, _ := fwStore.GetStartupReport(); !again.StartedAt.Equal(report.StartedAt) {
+		t.Errorf("expected the startup report kept, got one from %v", again.StartedAt)
+	}
+}
+
+// fakeSubsystem is a registered subsystem returning canned corrections.
+type fakeSubsystem struct {
+	name     string
+	interval time.Duration
+	ops      []DriftOp
+	err      error
+	runs     int
+}
+
+func (f *fakeSubsystem) Name() string            { return f.name }
+func (f *fakeSubsystem) Interval() time.Duration { return f.interval }
+func (f *fakeSubsystem) Reconcile(ctx context.Context) ([]DriftOp, error) {
+	f.runs++
+	return f.ops, f.err
+}
+
+func TestRegisteredSubsystem(t *testing.T) {
+	rec, db, _, _, _ := setupReconciler(t)
+	dnsSys := &fakeSubsystem{name: "dns", ops: []DriftOp{
+		{Type: "add", System: "dns", ID: "a.example.com"},
+		{Type: "remove", System: "dns", ID: "b.example.com", Err: fmt.Errorf("provider error")},
+	}}
+	certs := &fakeSubsystem{name: "certs", interval: time.Hour, err: fmt.Errorf("acme unreachable")}
+	rec.Register(dnsSys)
+	rec.Register(certs)
+	if _, ok := rec.Subsystems()["dns"]; !ok {
+		t.Error("expected a registered subsystem listed before its first pass")
+	}
+
+	rec.reconcileOnce(context.Background(), false)
+	runs, _ := store.NewReconcileRunStore(db).List(1)
+	if got := runs[0].Subsystems["dns"]; got != (store.OpCounts{Attempted: 2, Succeeded: 1, Failed: 1}) {
+		t.Errorf("unexpected dns counts: %+v", got)
+	}
+	if !strings.Contains(runs[0].Error, "dns: 1 of 2 operations failed") {
+		t.Errorf("expected the failed dns correction reported, got %q", runs[0].Error)
+	}
+	if st := rec.Subsystems()["certs"]; st.ConsecutiveFailures != 1 || st.LastError != "acme unreachable" {
+		t.Errorf("expected certs to back off on its own, got %+v", st)
+	}
+
+	// A subsystem with its own interval waits for it on timer passes, but
+	// forced passes run it
+	rec.reconcileOnce(context.Background(), false)
+	if dnsSys.runs != 2 || certs.runs != 1 {
+		t.Errorf("expected dns run twice and certs once, got %d and %d", dnsSys.runs, certs.runs)
+	}
+	rec.reconcileOnce(context.Background(), true)
+	if certs.runs != 2 {
+		t.Errorf("expected a forced pass to run certs, got %d runs", certs.runs)
+	}
+}
+
+func TestSubsystemIntervals(t *testing.T) {
+	rec, db, _, _, _ := setupReconciler(t)
+	runStore := store.NewReconcileRunStore(db)
+	rec.SetSubsystemInterval(SubsystemCaddy, 0)
+	rec.SetSubsystemInterval(SubsystemWireGuard, 10*time.Second)
+	rec.SetSubsystemInterval(SubsystemFirewall, 5*time.Minute)
+	rec.SetStatsInterval(time.Minute)
+	if tick := rec.tickInterval(); tick != 10*time.Second {
+		t.Errorf("expected the loop to tick every 10s, got %v", tick)
+	}
+
+	start := time.Now()
+	rec.reconcileOnce(context.Background(), false)
+	statsAt := rec.lastRun[statsRun]
+	if statsAt.IsZero() {
+		t.Fatal("expected the first pass to collect stats")
+	}
+
+	// Ten seconds on, only WireGuard is due
+	now := start.Add(10 * time.Second)
+	for _, s := range rec.subsystems {
+		want := s.Name() == SubsystemWireGuard
+		if got := rec.due(s, now); got != want {
+			t.Errorf("%s due after 10s: expected %v, got %v", s.Name(), want, got)
+		}
+	}
+	if rec.dueEvery(statsRun, rec.statsInterval, now) {
+		t.Error("expected stats not due after 10s")
+	}
+	// Caddy follows the reconcile interval
+	if !rec.due(rec.subsystems[0], start.Add(30*time.Second)) {
+		t.Error("expected caddy due after 30s")
+	}
+
+	// A pass that reconciles nothing leaves the run history alone
+	for _, s := range rec.subsystems {
+		rec.lastRun[s.Name()] = time.Now()
+	}
+	before, _ := runStore.List(10)
+	rec.reconcileOnce(context.Background(), false)
+	if after, _ := runStore.List(10); len(after) != len(before) {
+		t.Errorf("expected no run recorded, got %d runs instead of %d", len(after), len(before))
+	}
+	if !rec.lastRun[statsRun].Equal(statsAt) {
+		t.Error("expected stats not collected again within their interval")
+	}
+}
+
+func TestPollCaddy(t *testing.T) {
+	rec, _, mockCaddy, _, _ := setupReconciler(t)
+	ctx := context.Background()
+	mockCaddy.config = &caddy.L4Config{Servers: map[string]*caddy.L4Server{
+		"proxy": {Listen: []string{":443"}},
+	}}
+
+	// The first poll adopts the config without forcing a pass
+	if rec.pollCaddy(ctx) {
+		t.Error("expected the first poll to adopt the config")
+	}
+	if rec.pollCaddy(ctx) {
+		t.Error("expected no change")
+	}
+
+	// A server added by hand is a change, reported once
+	mockCaddy.config.Servers["pf-tcp-2222"] = &caddy.L4Server{Listen: []string{":2222"}}
+	if !rec.pollCaddy(ctx) {
+		t.Error("expected the out-of-band change to be detected")
+	}
+	if rec.pollCaddy(ctx) {
+		t.Error("expected the change to be reported once")
+	}
+
+	// What a pass leaves in Caddy is not an out-of-band change
+	if _, err := applied(rec.reconcileCaddy(ctx)); err != nil {
+		t.Fatalf("reconcile caddy: %v", err)
+	}
+	if rec.pollCaddy(ctx) {
+		t.Error("expected the config the pass left to match")
+	}
+
+	// Nor is a route the API adds
+	mockCaddy.config.Servers["pf-tcp-2223"] = &caddy.L4Server{Listen: []string{":2223"}}
+	rec.CaddyWritten()
+	if rec.pollCaddy(ctx) {
+		t.Error("expected the control plane's own write to be adopted")
+	}
+	if rec.pollCaddy(ctx) {
+		t.Error("expected no change")
+	}
+}
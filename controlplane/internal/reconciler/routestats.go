@@ -0,0 +1,171 @@
+package reconciler
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/firewall"
+	"github.com/proxy-manager/controlplane/internal/sockstats"
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// SetRouteStats enables per-route traffic accounting. The firewall step of
+// each pass keeps nftables counters on the upstream of every local route,
+// and each pass records a sample per route of those counters and of the TCP
+// connections open to the upstream, read with dump. Samples older than
+// retention are dropped.
+func (r *Reconciler) SetRouteStats(dump func() ([]sockstats.Conn, error), retention time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dumpConns = dump
+	r.routeStatsRetention = retention
+}
+
+// RouteCounters returns the nftables counters of a route, on the host that
+// proxies it: one for its protocol, and a UDP one for the QUIC half of a
+// TCP route. Traffic is counted on the upstream, so routes whose counters
+// overlap could not be told apart.
+func RouteCounters(rt *store.Route) []firewall.RouteCounter {
+	upstream, err := netip.ParseAddrPort(strings.TrimPrefix(rt.Upstream, "udp/"))
+	if err != nil {
+		return nil
+	}
+	c := firewall.RouteCounter{ID: rt.ID, Proto: rt.Protocol, Addr: upstream.Addr().String(), Port: int(upstream.Port())}
+	if rt.ListenPortEnd > rt.ListenPort {
+		c.PortEnd = c.Port + rt.ListenPortEnd - rt.ListenPort
+	}
+	counters := []firewall.RouteCounter{c}
+	if rt.QUIC && rt.Protocol == "tcp" {
+		c.Proto = "udp"
+		counters = append(counters, c)
+	}
+	return counters
+}
+
+// reconcileRouteCounters makes the nftables route counters match the
+// enabled local routes. A counter whose match changed is replaced, which
+// restarts it from zero. Routes that share an upstream, which the API
+// refuses but older databases may hold, would each count all of its
+// traffic, so only the oldest of them gets a counter.
+func (r *Reconciler) reconcileRouteCounters() ([]DriftOp, error) {
+	if r.routeStatsRetention <= 0 {
+		return nil, nil
+	}
+	routes, err := r.routeStore.ListEnabled()
+	if err != nil {
+		return nil, fmt.Errorf("list routes: %w", err)
+	}
+	actual, err := r.fwManager.ListRouteCounters()
+	if err != nil {
+		return nil, fmt.Errorf("list route counters: %w", err)
+	}
+
+	type match struct {
+		addr          string
+		port, portEnd int
+	}
+	matchOf := func(c firewall.RouteCounter) match { return match{c.Addr, c.Port, c.PortEnd} }
+
+	desired := make(map[string]firewall.RouteCounter)
+	var counted []firewall.RouteCounter
+	for _, rt := range routes {
+		// Routes served by a remote node are not counted
+		if rt.NodeID != "" {
+			continue
+		}
+		for _, c := range RouteCounters(rt) {
+			if slices.ContainsFunc(counted, c.Overlaps) {
+				continue
+			}
+			desired[c.Key()] = c
+			counted = append(counted, c)
+		}
+	}
+	actualMap := make(map[string]match, len(actual))
+	for _, c := range actual {
+		actualMap[c.Key()] = matchOf(c)
+	}
+
+	d := r.newDrift(SubsystemFirewall)
+	for key, m := range actualMap {
+		if c, ok := desired[key]; ok && matchOf(c) == m {
+			continue
+		}
+		if err := d.apply("remove", key, "route counter", func() error { return r.fwManager.DeleteRouteCounter(key) }); err != nil {
+			d.failed("remove", key, err, "failed to delete route counter", "counter", key)
+			continue
+		}
+		delete(actualMap, key)
+	}
+	for key, c := range desired {
+		if _, ok := actualMap[key]; ok {
+			continue
+		}
+		if err := d.apply("add", key, "route counter", func() error { return r.fwManager.AddRouteCounter(c) }); err != nil {
+			d.failed("add", key, err, "failed to add route counter", "counter", key)
+		}
+	}
+	return d.ops, nil
+}
+
+// updateRouteStats records the traffic counted for each route, and the TCP
+// connections open to its upstream. Only routes with a counter get a
+// sample, so an upstream's traffic is never recorded for two routes.
+func (r *Reconciler) updateRouteStats() {
+	if r.routeStatsRetention <= 0 {
+		return
+	}
+	counters, err := r.fwManager.ListRouteCounters()
+	if err != nil {
+		r.logger.Error("failed to read route counters", "error", err)
+		return
+	}
+	active := map[netip.AddrPort]int{}
+	if r.dumpConns != nil {
+		conns, err := r.dumpConns()
+		if err != nil {
+			r.logger.Error("failed to read connections for route stats", "error", err)
+		}
+		for _, c := range conns {
+			active[c.Remote]++
+		}
+	}
+
+	type sample struct {
+		active int
+		rx, tx uint64
+	}
+	samples := make(map[string]*sample)
+	for _, c := range counters {
+		s := samples[c.ID]
+		if s == nil {
+			s = &sample{}
+			samples[c.ID] = s
+		}
+		s.rx += c.RxBytes
+		s.tx += c.TxBytes
+		if c.Proto != "tcp" {
+			continue
+		}
+		addr, err := netip.ParseAddr(c.Addr)
+		if err != nil {
+			continue
+		}
+		for port := c.Port; port <= max(c.Port, c.PortEnd); port++ {
+			s.active += active[netip.AddrPortFrom(addr, uint16(port))]
+		}
+	}
+
+	now := time.Now()
+	for id, s := range samples {
+		if err := r.routeStore.RecordStatsSample(id, s.active, int64(s.rx), int64(s.tx), now); err != nil {
+			r.logger.Error("failed to record route stats sample", "route_id", id, "error", err)
+		}
+	}
+	if _, err := r.routeStore.PruneStatsHistory(now.Add(-r.routeStatsRetention)); err != nil {
+		r.logger.Error("failed to prune route stats history", "error", err)
+	}
+}
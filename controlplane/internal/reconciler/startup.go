@@ -0,0 +1,80 @@
+package reconciler
+
+import (
+	"github.com/proxy-manager/controlplane/internal/store"
+)
+
+// startupPass collects what the first pass of the process finds, for the
+// startup report.
+type startupPass struct {
+	previous   *store.ReconciliationState // as the previous process left it
+	subsystems map[string]store.StartupSubsystem
+}
+
+// newStartupPass starts collecting the startup report, or returns nil if it
+// was already written. Called with r.mu held, before the pass records its
+// own status.
+func (r *Reconciler) newStartupPass() *startupPass {
+	if r.startupDone {
+		return nil
+	}
+	previous, err := r.fwStore.GetReconciliationState()
+	if err != nil {
+		r.logger.Warn("failed to read the previous reconciliation state", "error", err)
+	}
+	return &startupPass{previous: previous, subsystems: map[string]store.StartupSubsystem{}}
+}
+
+// add records the corrections one subsystem made, and the error that
+// stopped it, if any. A nil pass ignores them.
+func (p *startupPass) add(system string, ops []DriftOp, err error) {
+	if p == nil {
+		return
+	}
+	sub := store.StartupSubsystem{InSync: err == nil && len(ops) == 0, Ops: make([]store.RepairOp, 0, len(ops))}
+	if err != nil {
+		sub.Error = err.Error()
+	}
+	for _, op := range ops {
+		repair := store.RepairOp{Type: op.Type, ID: op.ID, Detail: op.Detail, Result: "repaired"}
+		switch {
+		case op.Observed:
+			repair.Result = "observed"
+		case op.Err != nil:
+			repair.Result, repair.Error = "failed", op.Err.Error()
+		}
+		sub.Ops = append(sub.Ops, repair)
+	}
+	p.subsystems[system] = sub
+}
+
+// saveStartup writes the startup report of the pass recorded as run. It is
+// written once per process, even if saving it fails.
+func (r *Reconciler) saveStartup(p *startupPass, run *store.ReconcileRun) {
+	r.startupDone = true
+	report := &store.StartupReport{
+		StartedAt:      run.StartedAt,
+		Duration:       run.Duration,
+		Mode:           r.Mode(),
+		PreviousStatus: "pending",
+		Status:         run.Status,
+		Error:          run.Error,
+		Ops:            run.Ops,
+		Subsystems:     p.subsystems,
+	}
+	if p.previous != nil {
+		report.PreviousStatus, report.PreviousRunAt = p.previous.LastStatus, p.previous.LastRunAt
+	}
+	if err := r.fwStore.SaveStartupReport(report); err != nil {
+		r.logger.Error("failed to save startup report", "error", err)
+		return
+	}
+
+	args := []any{"previous_status", report.PreviousStatus, "repaired", run.Ops.Succeeded,
+		"failed", run.Ops.Failed, "observed", run.Ops.Observed}
+	if clean := report.PreviousStatus == "shutdown" || report.PreviousStatus == "pending"; !clean {
+		r.logger.Warn("previous process did not shut down cleanly, startup reconciliation complete", args...)
+		return
+	}
+	r.logger.Info("startup reconciliation complete", args...)
+}
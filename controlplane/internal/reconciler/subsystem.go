@@ -0,0 +1,209 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// DriftOp represents a single drift correction operation.
+type DriftOp struct {
+	Type   string // "add", "remove", "update"
+	System string // the subsystem that made it: "caddy", "wireguard", "firewall", ...
+	ID     string // what was corrected: a Caddy @id, peer key, rule ID, ...
+	Detail string
+	Err    error // nil if the correction went through
+	// Observed is set on corrections found in observe mode and not made
+	Observed bool
+}
+
+// Subsystem reconciles one part of the runtime state with the store.
+// Reconcile corrects the drift it finds and returns the corrections it
+// attempted, failed ones included. An error means the subsystem could not be
+// reconciled at all, such as when its runtime state cannot be read, and
+// backs it off. Each subsystem has its own backoff and entry under
+// reconciliation.subsystems in GET /api/v1/status.
+type Subsystem interface {
+	Name() string
+	Reconcile(ctx context.Context) ([]DriftOp, error)
+}
+
+// Scheduled is implemented by subsystems reconciled on their own interval
+// instead of on every pass. Forced passes reconcile them regardless.
+type Scheduled interface {
+	Interval() time.Duration // 0 reconciles on every pass
+}
+
+// Register adds a subsystem reconciled after the built-in Caddy, WireGuard,
+// and firewall subsystems. Call it before Run.
+func (r *Reconciler) Register(s Subsystem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subsystems = append(r.subsystems, s)
+	r.backoffs.add(s.Name())
+}
+
+// tickInterval is how often the loop wakes up: the reconcile interval, or
+// the interval of a subsystem or of stats collection scheduled more often.
+// Called with r.mu held.
+func (r *Reconciler) tickInterval() time.Duration {
+	tick := r.interval
+	for _, s := range r.subsystems {
+		if d := subsystemInterval(s); d > 0 && d < tick {
+			tick = d
+		}
+	}
+	if r.statsInterval > 0 && r.statsInterval < tick {
+		tick = r.statsInterval
+	}
+	return tick
+}
+
+// subsystemInterval returns how often s is reconciled; 0 means every pass.
+func subsystemInterval(s Subsystem) time.Duration {
+	if sched, ok := s.(Scheduled); ok {
+		return sched.Interval()
+	}
+	return 0
+}
+
+// due reports whether a timer pass at now reconciles s. Called with r.mu
+// held.
+func (r *Reconciler) due(s Subsystem, now time.Time) bool {
+	return r.dueEvery(s.Name(), subsystemInterval(s), now)
+}
+
+// dueEvery reports whether work last run under name is due again at now.
+// Work without an interval of its own runs on every pass; the rest once its
+// interval, less half a tick of slack for timer jitter, has passed since
+// its last run. Called with r.mu held.
+func (r *Reconciler) dueEvery(name string, interval time.Duration, now time.Time) bool {
+	if interval <= 0 {
+		return true
+	}
+	last, ok := r.lastRun[name]
+	return !ok || now.Sub(last) >= interval-r.tickInterval()/2
+}
+
+// SetSubsystemInterval sets how often the timer reconciles one of the
+// built-in subsystems; 0 uses the reconcile interval. An interval shorter
+// than the reconcile interval makes the loop wake up that often, and
+// built-in subsystems never given an interval run on every wakeup. Call it
+// before Run.
+func (r *Reconciler) SetSubsystemInterval(system string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d <= 0 {
+		d = r.interval
+	}
+	for _, s := range r.subsystems {
+		if b, ok := s.(*builtin); ok && b.name == system {
+			b.interval = d
+		}
+	}
+}
+
+// statsRun is the lastRun entry of stats collection.
+const statsRun = "stats"
+
+// lifecycleDrift is the drift entry of the tunnels lifecycle policies would
+// revoke, had observe mode not left them in place. It is reported with the
+// WireGuard drift, since revoking a tunnel removes its peer.
+const lifecycleDrift = "lifecycle"
+
+// SetStatsInterval sets how often peer and route stats are collected from
+// the kernel; 0 uses the reconcile interval. Call it before Run.
+func (r *Reconciler) SetStatsInterval(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d <= 0 {
+		d = r.interval
+	}
+	r.statsInterval = d
+}
+
+// builtin is a subsystem backed by one of the Reconciler's own methods.
+type builtin struct {
+	name     string
+	interval time.Duration
+	fn       func(ctx context.Context) ([]DriftOp, error)
+}
+
+func (b *builtin) Name() string                                     { return b.name }
+func (b *builtin) Interval() time.Duration                          { return b.interval }
+func (b *builtin) Reconcile(ctx context.Context) ([]DriftOp, error) { return b.fn(ctx) }
+
+// builtins returns the Caddy, WireGuard, and firewall subsystems, in the
+// order passes reconcile them.
+func (r *Reconciler) builtins() []Subsystem {
+	return []Subsystem{
+		&builtin{name: SubsystemCaddy, fn: r.reconcileCaddy},
+		&builtin{name: SubsystemWireGuard, fn: func(context.Context) ([]DriftOp, error) { return r.reconcileWireGuard() }},
+		&builtin{name: SubsystemFirewall, fn: func(context.Context) ([]DriftOp, error) { return r.reconcileNFTables() }},
+	}
+}
+
+// drift collects the corrections one subsystem makes in a pass.
+type drift struct {
+	system  string
+	logger  *slog.Logger
+	observe bool // record corrections instead of making them
+	ops     []DriftOp
+}
+
+func (r *Reconciler) newDrift(system string) *drift {
+	return &drift{system: system, logger: r.logger, observe: r.observing()}
+}
+
+// apply makes a correction with fix and records it as done; in observe mode
+// fix is not called. Errors are returned for the caller to record with
+// failed, or to fail the pass.
+func (d *drift) apply(typ, id, detail string, fix func() error) error {
+	if !d.observe {
+		if err := fix(); err != nil {
+			return err
+		}
+	}
+	d.done(typ, id, detail)
+	return nil
+}
+
+// done records a correction that went through, or in observe mode one that
+// was found and not made.
+func (d *drift) done(typ, id, detail string) {
+	d.ops = append(d.ops, DriftOp{Type: typ, System: d.system, ID: id, Detail: detail, Observed: d.observe})
+}
+
+// failed logs msg with args and the error, and records the correction as
+// failed.
+func (d *drift) failed(typ, id string, err error, msg string, args ...any) {
+	d.logger.Error(msg, append(args, "error", err)...)
+	d.ops = append(d.ops, DriftOp{Type: typ, System: d.system, ID: id, Err: err})
+}
+
+// succeeded returns how many corrections went through.
+func succeeded(ops []DriftOp) int {
+	n := 0
+	for _, op := range ops {
+		if op.Err == nil && !op.Observed {
+			n++
+		}
+	}
+	return n
+}
+
+// observed returns how many corrections were left unmade in observe mode.
+func observed(ops []DriftOp) int {
+	n := 0
+	for _, op := range ops {
+		if op.Observed {
+			n++
+		}
+	}
+	return n
+}
+
+// errNotManaged fails a correction the control plane must not make because
+// the resource in its way was configured by hand.
+var errNotManaged = errors.New("configured outside the control plane")
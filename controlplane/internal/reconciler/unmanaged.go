@@ -0,0 +1,126 @@
+package reconciler
+
+import (
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/config"
+)
+
+// UnmanagedResource is a resource the last pass found but did not remove
+// because of the report policy.
+type UnmanagedResource struct {
+	Kind      string    `json:"kind"` // "peer", "route", "server", or "firewall_rule"
+	ID        string    `json:"id"`   // public key, Caddy @id or server name, or nftables comment
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// unmanagedTracker holds the policy of each subsystem and the resources
+// reported under it, so the API can read them while a pass runs.
+type unmanagedTracker struct {
+	mu       sync.Mutex
+	policies map[string]string
+	found    map[string][]UnmanagedResource
+}
+
+func newUnmanagedTracker() *unmanagedTracker {
+	policies := maps.Clone(config.DefaultUnmanagedPolicies)
+	return &unmanagedTracker{policies: policies, found: map[string][]UnmanagedResource{}}
+}
+
+func (u *unmanagedTracker) policy(system string) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.policies[system]
+}
+
+func (u *unmanagedTracker) setPolicy(system, policy string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.policies[system] = policy
+	if policy != config.UnmanagedReport {
+		delete(u.found, system)
+	}
+}
+
+// unmanagedPass collects what one subsystem's pass finds.
+type unmanagedPass struct {
+	system string
+	policy string
+	found  []UnmanagedResource
+}
+
+// unmanaged starts collecting the unmanaged resources of system for a pass.
+func (r *Reconciler) unmanaged(system string) *unmanagedPass {
+	return &unmanagedPass{system: system, policy: r.unmanagedTracker.policy(system)}
+}
+
+// keep reports whether the unmanaged resource kind/id stays in place, and
+// notes it if it is reported.
+func (p *unmanagedPass) keep(kind, id string) bool {
+	switch p.policy {
+	case config.UnmanagedDelete:
+		return false
+	case config.UnmanagedReport:
+		p.found = append(p.found, UnmanagedResource{Kind: kind, ID: id})
+	}
+	return true
+}
+
+// finishUnmanaged replaces what system reported with what pass found.
+// Resources seen for the first time are logged; the others keep the time
+// they were first seen.
+func (r *Reconciler) finishUnmanaged(pass *unmanagedPass, now time.Time) {
+	u := r.unmanagedTracker
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	seen := make(map[string]time.Time)
+	for _, res := range u.found[pass.system] {
+		seen[res.Kind+"/"+res.ID] = res.FirstSeen
+	}
+	found := make([]UnmanagedResource, 0, len(pass.found))
+	for _, res := range pass.found {
+		if first, ok := seen[res.Kind+"/"+res.ID]; ok {
+			res.FirstSeen = first
+		} else {
+			res.FirstSeen = now
+			r.logger.Warn("found "+pass.system+" "+strings.ReplaceAll(res.Kind, "_", " ")+" not created by the control plane, leaving it in place",
+				"id", res.ID, "policy", pass.policy)
+		}
+		found = append(found, res)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Kind != found[j].Kind {
+			return found[i].Kind < found[j].Kind
+		}
+		return found[i].ID < found[j].ID
+	})
+	u.found[pass.system] = found
+}
+
+// SetUnmanagedPolicy sets what passes do with resources of system that the
+// control plane did not create: ignore, report, or delete them.
+func (r *Reconciler) SetUnmanagedPolicy(system, policy string) {
+	r.unmanagedTracker.setPolicy(system, policy)
+}
+
+// UnmanagedPolicy returns the unmanaged resource policy of system.
+func (r *Reconciler) UnmanagedPolicy(system string) string {
+	return r.unmanagedTracker.policy(system)
+}
+
+// Unmanaged returns the resources of each subsystem that the last pass left
+// in place under the report policy.
+func (r *Reconciler) Unmanaged() map[string][]UnmanagedResource {
+	u := r.unmanagedTracker
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	out := make(map[string][]UnmanagedResource, len(u.found))
+	for system, found := range u.found {
+		out[system] = append([]UnmanagedResource(nil), found...)
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+package reconciler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/proxy-manager/controlplane/internal/caddy"
+)
+
+// caddyWatch holds the hash of the layer4 config as the last pass left it.
+// Caddy's admin API has no change notifications, so WatchCaddy polls the
+// config and compares.
+type caddyWatch struct {
+	mu     sync.Mutex
+	hash   string // "" until known; the next poll adopts what it sees
+	writes int    // writes by the control plane, so a poll racing one is discarded
+}
+
+// hashL4Config returns a hash of cfg as the reconciler reads it, or "" for
+// nil. Fields the reconciler does not model are not part of it, since no
+// pass would correct them.
+func hashL4Config(cfg *caddy.L4Config) string {
+	if cfg == nil {
+		return ""
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// caddySynced records the config a pass left Caddy in. After corrections it
+// is read back; if that fails, the watcher adopts whatever it sees next.
+func (r *Reconciler) caddySynced(ctx context.Context, actual *caddy.L4Config, ops int) {
+	if ops > 0 {
+		var err error
+		if actual, err = r.caddyClient.GetL4Config(ctx); err != nil {
+			actual = nil
+		}
+	}
+	r.caddyWatch.mu.Lock()
+	defer r.caddyWatch.mu.Unlock()
+	r.caddyWatch.hash = hashL4Config(actual)
+}
+
+// CaddyWritten tells the watcher that the control plane itself changed
+// Caddy's config, outside a pass, as the API does when it creates or
+// deletes a route, so the next poll adopts the result instead of forcing a
+// pass. Register it with caddy.HTTPClient.SetOnWrite.
+func (r *Reconciler) CaddyWritten() {
+	r.caddyWatch.mu.Lock()
+	defer r.caddyWatch.mu.Unlock()
+	r.caddyWatch.hash = ""
+	r.caddyWatch.writes++
+}
+
+// WatchCaddy polls Caddy's layer4 config every interval and forces a pass
+// when it differs from what the last pass left, so a route deleted or
+// edited out of band is restored within seconds instead of at the next
+// RECONCILE_INTERVAL. It returns when ctx is canceled.
+func (r *Reconciler) WatchCaddy(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if r.pollCaddy(ctx) {
+				r.logger.Info("caddy config changed outside the control plane, reconciling")
+				r.ForceReconcile()
+			}
+		}
+	}
+}
+
+// pollCaddy reads the layer4 config and reports whether it changed since
+// the last pass, poll, or write by the control plane. Read errors are left
+// to the reconciliation loop and Caddy's health tracking.
+func (r *Reconciler) pollCaddy(ctx context.Context) bool {
+	r.caddyWatch.mu.Lock()
+	writes := r.caddyWatch.writes
+	r.caddyWatch.mu.Unlock()
+
+	cfg, err := r.caddyClient.GetL4Config(ctx)
+	if err != nil {
+		r.logger.Debug("failed to poll caddy config", "error", err)
+		return false
+	}
+	hash := hashL4Config(cfg)
+	r.caddyWatch.mu.Lock()
+	defer r.caddyWatch.mu.Unlock()
+	if r.caddyWatch.writes != writes {
+		// The config read may predate the write; the next poll adopts it
+		return false
+	}
+	if r.caddyWatch.hash == hash {
+		return false
+	}
+	changed := r.caddyWatch.hash != ""
+	r.caddyWatch.hash = hash
+	return changed
+}
@@ -0,0 +1,105 @@
+// Package sockstats reads the established TCP connections of the host and
+// their byte counters from the kernel (sock_diag). Caddy's layer4 app exports
+// no per-route metrics, so the connections of a route are counted on Caddy's
+// connections to its upstream instead.
+package sockstats
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Conn is one established TCP connection.
+type Conn struct {
+	Cookie   uint64         // kernel socket identity, stable for the connection's lifetime
+	Remote   netip.AddrPort // the peer's address
+	Sent     uint64         // bytes acknowledged by the peer
+	Received uint64
+}
+
+// sock_diag layout (linux/inet_diag.h, linux/tcp.h).
+const (
+	sockDiagByFamily = 20 // SOCK_DIAG_BY_FAMILY
+	inetDiagInfo     = 2  // INET_DIAG_INFO attribute, a struct tcp_info
+	sizeofReq        = 56 // struct inet_diag_req_v2
+	sizeofMsg        = 72 // struct inet_diag_msg
+	tcpEstablished   = 1
+
+	tcpInfoBytesAcked    = 120 // offsets in struct tcp_info
+	tcpInfoBytesReceived = 128
+)
+
+// Established returns the host's established TCP connections over IPv4 and
+// IPv6. Connections of kernels too old to report byte counters have zero
+// counters.
+func Established() ([]Conn, error) {
+	conn, err := netlink.Dial(unix.NETLINK_SOCK_DIAG, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial sock_diag: %w", err)
+	}
+	defer conn.Close()
+
+	var conns []Conn
+	for _, family := range []byte{unix.AF_INET, unix.AF_INET6} {
+		req := make([]byte, sizeofReq)
+		req[0] = family
+		req[1] = unix.IPPROTO_TCP
+		req[2] = 1 << (inetDiagInfo - 1)
+		binary.NativeEndian.PutUint32(req[4:], 1<<tcpEstablished)
+
+		msgs, err := conn.Execute(netlink.Message{
+			Header: netlink.Header{Type: sockDiagByFamily, Flags: netlink.Request | netlink.Dump},
+			Data:   req,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("dump TCP sockets: %w", err)
+		}
+		for _, m := range msgs {
+			if c, ok := parseConn(m.Data); ok {
+				conns = append(conns, c)
+			}
+		}
+	}
+	return conns, nil
+}
+
+// parseConn decodes an inet_diag_msg and its tcp_info attribute.
+func parseConn(b []byte) (Conn, bool) {
+	if len(b) < sizeofMsg {
+		return Conn{}, false
+	}
+	// struct inet_diag_sockid starts at 4: sport, dport (big endian), src, dst, if, cookie
+	port := binary.BigEndian.Uint16(b[6:8])
+	var addr netip.Addr
+	switch b[0] {
+	case unix.AF_INET:
+		addr = netip.AddrFrom4([4]byte(b[24:28]))
+	case unix.AF_INET6:
+		addr = netip.AddrFrom16([16]byte(b[24:40])).Unmap()
+	default:
+		return Conn{}, false
+	}
+	c := Conn{
+		Cookie: uint64(binary.NativeEndian.Uint32(b[44:48])) | uint64(binary.NativeEndian.Uint32(b[48:52]))<<32,
+		Remote: netip.AddrPortFrom(addr, port),
+	}
+
+	ad, err := netlink.NewAttributeDecoder(b[sizeofMsg:])
+	if err != nil {
+		return c, true
+	}
+	for ad.Next() {
+		if ad.Type() != inetDiagInfo {
+			continue
+		}
+		if info := ad.Bytes(); len(info) >= tcpInfoBytesReceived+8 {
+			c.Sent = binary.NativeEndian.Uint64(info[tcpInfoBytesAcked:])
+			c.Received = binary.NativeEndian.Uint64(info[tcpInfoBytesReceived:])
+		}
+	}
+	return c, true
+}
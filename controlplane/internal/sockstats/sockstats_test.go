@@ -0,0 +1,38 @@
+package sockstats
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseConn(t *testing.T) {
+	msg := make([]byte, sizeofMsg)
+	msg[0] = unix.AF_INET
+	binary.BigEndian.PutUint16(msg[6:], 8443)
+	copy(msg[24:], []byte{10, 0, 0, 2})
+	binary.NativeEndian.PutUint32(msg[44:], 7)
+	binary.NativeEndian.PutUint32(msg[48:], 1)
+
+	info := make([]byte, 232)
+	binary.NativeEndian.PutUint64(info[tcpInfoBytesAcked:], 1000)
+	binary.NativeEndian.PutUint64(info[tcpInfoBytesReceived:], 5000)
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(inetDiagInfo, info)
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, ok := parseConn(append(msg, attrs...))
+	want := Conn{Cookie: 1<<32 | 7, Remote: netip.MustParseAddrPort("10.0.0.2:8443"), Sent: 1000, Received: 5000}
+	if !ok || c != want {
+		t.Errorf("expected %+v, got %+v (ok=%v)", want, c, ok)
+	}
+	if _, ok := parseConn(msg[:40]); ok {
+		t.Error("expected a short message to be rejected")
+	}
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AuditRecord is an audit log entry as stored.
+type AuditRecord struct {
+	ID        int64
+	Timestamp time.Time
+	AuditEntry
+}
+
+// AuditArchive is an archive file holding the audit entries written before
+// a time with an ID up to MaxID, recorded until they are deleted.
+type AuditArchive struct {
+	Path   string
+	Before time.Time
+	MaxID  int64
+}
+
+// AuditStore reads and prunes the audit log. Entries are written through
+// FirewallStore.WriteAuditEntry.
+type AuditStore struct {
+	db *sql.DB
+}
+
+// NewAuditStore creates an AuditStore using the given DB.
+func NewAuditStore(db *DB) *AuditStore {
+	return &AuditStore{db: db.Conn()}
+}
+
+// EntriesBefore returns up to limit of the oldest audit entries written
+// before the given time with an ID above afterID, oldest first.
+func (s *AuditStore) EntriesBefore(before time.Time, afterID int64, limit int) ([]*AuditRecord, error) {
+	rows, err := s.db.Query(`SELECT id, timestamp, client_cn, source_ip, method, path, body_hash, result, error_msg, request_body, diff
+		FROM audit_log WHERE timestamp < ? AND id > ? ORDER BY id ASC LIMIT ?`, before.Unix(), afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	var records []*AuditRecord
+	for rows.Next() {
+		var (
+			r                                                   AuditRecord
+			ts                                                  int64
+			clientCN, sourceIP, bodyHash, errMsg, reqBody, diff sql.NullString
+		)
+		if err := rows.Scan(&r.ID, &ts, &clientCN, &sourceIP, &r.Method, &r.Path, &bodyHash, &r.Result, &errMsg, &reqBody, &diff); err != nil {
+			return nil, fmt.Errorf("scan audit entry: %w", err)
+		}
+		r.Timestamp = time.Unix(ts, 0)
+		r.ClientCN = clientCN.String
+		r.SourceIP = sourceIP.String
+		r.BodyHash = bodyHash.String
+		r.ErrorMsg = errMsg.String
+		r.RequestBody = reqBody.String
+		r.Diff = diff.String
+		records = append(records, &r)
+	}
+	return records, rows.Err()
+}
+
+// DeleteBefore deletes the audit entries written before the given time,
+// and returns how many it deleted.
+func (s *AuditStore) DeleteBefore(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM audit_log WHERE timestamp < ?`, before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("delete audit entries: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// RecordArchive records that the entries of a have been archived, so a
+// pruning run that fails to delete them is finished by the next one
+// instead of archiving them again.
+func (s *AuditStore) RecordArchive(a AuditArchive) error {
+	_, err := s.db.Exec(`INSERT INTO audit_archives (path, written_before, max_id) VALUES (?, ?, ?)`,
+		a.Path, a.Before.Unix(), a.MaxID)
+	if err != nil {
+		return fmt.Errorf("record audit archive: %w", err)
+	}
+	return nil
+}
+
+// PendingArchives returns the recorded archives whose entries are not
+// deleted yet, oldest first.
+func (s *AuditStore) PendingArchives() ([]AuditArchive, error) {
+	rows, err := s.db.Query(`SELECT path, written_before, max_id FROM audit_archives ORDER BY max_id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("list audit archives: %w", err)
+	}
+	defer rows.Close()
+
+	var archives []AuditArchive
+	for rows.Next() {
+		var (
+			a      AuditArchive
+			before int64
+		)
+		if err := rows.Scan(&a.Path, &before, &a.MaxID); err != nil {
+			return nil, fmt.Errorf("scan audit archive: %w", err)
+		}
+		a.Before = time.Unix(before, 0)
+		archives = append(archives, a)
+	}
+	return archives, rows.Err()
+}
+
+// DeleteArchived deletes the entries of a, and its record, in one
+// transaction, and returns how many entries it deleted.
+func (s *AuditStore) DeleteArchived(a AuditArchive) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM audit_log WHERE timestamp < ? AND id <= ?`, a.Before.Unix(), a.MaxID)
+	if err != nil {
+		return 0, fmt.Errorf("delete audit entries: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM audit_archives WHERE path = ?`, a.Path); err != nil {
+		return 0, fmt.Errorf("delete audit archive record: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("delete audit entries: %w", err)
+	}
+	return res.RowsAffected()
+}
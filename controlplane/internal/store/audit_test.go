@@ -0,0 +1,40 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditArchives(t *testing.T) {
+	db := setupTestDB(t)
+	as := NewAuditStore(db)
+
+	now := time.Now()
+	for _, age := range []time.Duration{48 * time.Hour, 36 * time.Hour, time.Hour} {
+		db.conn.Exec(`INSERT INTO audit_log (timestamp, client_cn, method, path, result) VALUES (?, 'admin', 'POST', '/api/v1/tunnels', 'ok')`,
+			now.Add(-age).Unix())
+	}
+
+	entries, err := as.EntriesBefore(now.Add(-24*time.Hour), 0, 10)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 old entries, got %d (%v)", len(entries), err)
+	}
+	a := AuditArchive{Path: "/archive/a.jsonl.gz", Before: now.Add(-24 * time.Hour), MaxID: entries[0].ID}
+	if err := as.RecordArchive(a); err != nil {
+		t.Fatalf("record archive: %v", err)
+	}
+	if pending, err := as.PendingArchives(); err != nil || len(pending) != 1 || pending[0].MaxID != a.MaxID {
+		t.Fatalf("expected the archive pending, got %+v (%v)", pending, err)
+	}
+
+	// Only the archived entries are deleted, along with the record
+	if n, err := as.DeleteArchived(a); err != nil || n != 1 {
+		t.Fatalf("expected 1 entry deleted, got %d (%v)", n, err)
+	}
+	if pending, _ := as.PendingArchives(); len(pending) != 0 {
+		t.Errorf("expected no pending archives, got %+v", pending)
+	}
+	if n, err := as.DeleteBefore(now.Add(-24 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("expected the other old entry deleted, got %d (%v)", n, err)
+	}
+}
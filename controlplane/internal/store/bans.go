@@ -0,0 +1,64 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Ban is a source IP temporarily blocked by the automatic ban subsystem.
+type Ban struct {
+	IP        string
+	Reason    string
+	Hits      int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// AddBan stores a ban. Banning an IP that is already banned replaces the
+// reason, adds the hits, and moves the expiry to the new ban's.
+func (s *FirewallStore) AddBan(b *Ban) error {
+	_, err := s.db.Exec(`INSERT INTO firewall_bans (ip, reason, hits, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET reason = excluded.reason, hits = hits + excluded.hits,
+			expires_at = MAX(expires_at, excluded.expires_at)`,
+		b.IP, b.Reason, b.Hits, b.CreatedAt.Unix(), b.ExpiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("insert ban: %w", err)
+	}
+	return nil
+}
+
+// ListBans returns the bans that have not expired at now, soonest expiry
+// first.
+func (s *FirewallStore) ListBans(now time.Time) ([]*Ban, error) {
+	rows, err := s.db.Query(`SELECT ip, reason, hits, created_at, expires_at FROM firewall_bans
+		WHERE expires_at > ? ORDER BY expires_at ASC, ip ASC`, now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("list bans: %w", err)
+	}
+	defer rows.Close()
+
+	var bans []*Ban
+	for rows.Next() {
+		b := &Ban{}
+		var createdAt, expiresAt int64
+		if err := rows.Scan(&b.IP, &b.Reason, &b.Hits, &createdAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("scan ban: %w", err)
+		}
+		b.CreatedAt = time.Unix(createdAt, 0)
+		b.ExpiresAt = time.Unix(expiresAt, 0)
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+// DeleteExpiredBans removes bans that expired at or before now and returns
+// how many were removed.
+func (s *FirewallStore) DeleteExpiredBans(now time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM firewall_bans WHERE expires_at <= ?`, now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("delete expired bans: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBans(t *testing.T) {
+	db := setupTestDB(t)
+	fs := NewFirewallStore(db)
+	now := time.Unix(1700000000, 0)
+
+	fs.AddBan(&Ban{IP: "198.51.100.7", Reason: "20 events", Hits: 20, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	fs.AddBan(&Ban{IP: "203.0.113.9", Reason: "25 events", Hits: 25, CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+
+	// A repeat offender accumulates hits and keeps the later expiry
+	if err := fs.AddBan(&Ban{IP: "198.51.100.7", Reason: "30 events", Hits: 30, CreatedAt: now, ExpiresAt: now.Add(2 * time.Hour)}); err != nil {
+		t.Fatalf("add ban: %v", err)
+	}
+
+	bans, err := fs.ListBans(now)
+	if err != nil {
+		t.Fatalf("list bans: %v", err)
+	}
+	if len(bans) != 2 || bans[0].IP != "203.0.113.9" {
+		t.Fatalf("expected 2 bans, soonest expiry first, got %+v", bans)
+	}
+	if b := bans[1]; b.Hits != 50 || b.Reason != "30 events" || !b.ExpiresAt.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("unexpected merged ban %+v", b)
+	}
+
+	later := now.Add(30 * time.Minute)
+	if bans, _ := fs.ListBans(later); len(bans) != 1 {
+		t.Errorf("expected expired ban hidden, got %+v", bans)
+	}
+	n, err := fs.DeleteExpiredBans(later)
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 expired ban deleted, got %d (err %v)", n, err)
+	}
+}
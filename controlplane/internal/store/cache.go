@@ -0,0 +1,110 @@
+package store
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// listCache keeps the latest full listing of a table. Triggers bump the
+// table's row in table_versions on every write, from any connection or
+// process sharing the database, so a listing is reused only while that
+// version is unchanged; checking it costs a single-row lookup instead of
+// reading and decoding the whole table. Writes to the stats columns of
+// wg_peers are the exception; TunnelStore.List refreshes those itself.
+type listCache[T any] struct {
+	table string
+	clone func(T) T // callers may modify what they are given
+
+	mu      sync.Mutex
+	loaded  bool
+	version int64
+	items   []T
+}
+
+func newListCache[T any](table string, clone func(T) T) *listCache[T] {
+	return &listCache[T]{table: table, clone: clone}
+}
+
+// list returns the cached listing if the table has not changed since it was
+// loaded, and calls load otherwise. A nil cache always loads.
+func (c *listCache[T]) list(db *conn, load func() ([]T, error)) ([]T, error) {
+	if c == nil {
+		return load()
+	}
+	var version int64
+	if err := db.QueryRow(`SELECT version FROM table_versions WHERE name = ?`, c.table).Scan(&version); err != nil {
+		return nil, fmt.Errorf("read %s version: %w", c.table, err)
+	}
+
+	c.mu.Lock()
+	if c.loaded && c.version == version {
+		items := c.copy(c.items)
+		c.mu.Unlock()
+		return items, nil
+	}
+	c.mu.Unlock()
+
+	// The version was read first, so the listing is at least as new as it.
+	items, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.loaded, c.version, c.items = true, version, items
+	c.mu.Unlock()
+	return c.copy(items), nil
+}
+
+func (c *listCache[T]) copy(items []T) []T {
+	if items == nil {
+		return nil
+	}
+	out := make([]T, len(items))
+	for i, item := range items {
+		out[i] = c.clone(item)
+	}
+	return out
+}
+
+// clonePtr returns a copy of the value p points to, or nil.
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func cloneTunnel(t *Tunnel) *Tunnel {
+	c := *t
+	c.Domains = slices.Clone(t.Domains)
+	c.LastHandshake = clonePtr(t.LastHandshake)
+	c.LastRotationAt = clonePtr(t.LastRotationAt)
+	c.Labels = maps.Clone(t.Labels)
+	c.RevokeDeferredUntil = clonePtr(t.RevokeDeferredUntil)
+	c.ExpiryWarnedAt = clonePtr(t.ExpiryWarnedAt)
+	c.FailoverNodeIDs = slices.Clone(t.FailoverNodeIDs)
+	c.PersistentKeepalive = clonePtr(t.PersistentKeepalive)
+	c.ConnectedThreshold = clonePtr(t.ConnectedThreshold)
+	c.ClientDNS = slices.Clone(t.ClientDNS)
+	c.AdvertisedRoutes = slices.Clone(t.AdvertisedRoutes)
+	c.AllowedUpstreamPorts = slices.Clone(t.AllowedUpstreamPorts)
+	c.ExpiresAt = clonePtr(t.ExpiresAt)
+	c.ExpiryDateWarnedAt = clonePtr(t.ExpiryDateWarnedAt)
+	c.DeletedAt = clonePtr(t.DeletedAt)
+	return &c
+}
+
+func cloneRoute(r *Route) *Route {
+	c := *r
+	c.MatchValue = slices.Clone(r.MatchValue)
+	c.ExpiresAt = clonePtr(r.ExpiresAt)
+	return &c
+}
+
+func cloneFirewallRule(r *FirewallRule) *FirewallRule {
+	c := *r
+	return &c
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func tableVersion(t *testing.T, db *DB, table string) int64 {
+	t.Helper()
+	var v int64
+	if err := db.conn.QueryRow(`SELECT version FROM table_versions WHERE name = ?`, table).Scan(&v); err != nil {
+		t.Fatalf("read %s version: %v", table, err)
+	}
+	return v
+}
+
+func TestListCache(t *testing.T) {
+	db := setupTestDB(t)
+	s := NewTunnelStore(db)
+	if err := s.Create(&Tunnel{ID: "t1", VpnIP: "10.0.0.2", PublicKey: "pk1", Domains: []string{"a.example.com"}, Enabled: true}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	tunnels, err := s.List()
+	if err != nil || len(tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel, got %d (%v)", len(tunnels), err)
+	}
+	// Callers get their own copies
+	tunnels[0].Domains[0] = "changed.example.com"
+	tunnels[0].Enabled = false
+	if again, _ := s.List(); again[0].Domains[0] != "a.example.com" || !again[0].Enabled {
+		t.Errorf("cached listing modified through a returned tunnel: %+v", again[0])
+	}
+
+	// A write from another connection, or a store created separately, is
+	// seen on the next listing
+	if _, err := db.conn.Exec(`UPDATE wg_peers SET enabled = 0 WHERE id = 't1'`); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if again, _ := s.List(); again[0].Enabled {
+		t.Error("expected the listing to reflect the update")
+	}
+	if enabled, _ := s.ListEnabled(); len(enabled) != 0 {
+		t.Errorf("expected no enabled tunnels, got %d", len(enabled))
+	}
+	if err := NewTunnelStore(db).Create(&Tunnel{ID: "t2", VpnIP: "10.0.0.3", PublicKey: "pk2", Enabled: true}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if again, _ := s.List(); len(again) != 2 {
+		t.Errorf("expected 2 tunnels, got %d", len(again))
+	}
+}
+
+func TestUpdatePeerStatsUnchanged(t *testing.T) {
+	db := setupTestDB(t)
+	s := NewTunnelStore(db)
+	if err := s.Create(&Tunnel{ID: "t1", VpnIP: "10.0.0.2", PublicKey: "pk1", Enabled: true}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.UpdatePeerStats("pk1", nil, 100, 200); err != nil {
+		t.Fatalf("update stats: %v", err)
+	}
+	before := tableVersion(t, db, "wg_peers")
+
+	// An idle peer leaves the table, and so the cached listing, untouched
+	if err := s.UpdatePeerStats("pk1", nil, 100, 200); err != nil {
+		t.Fatalf("update stats: %v", err)
+	}
+	if v := tableVersion(t, db, "wg_peers"); v != before {
+		t.Errorf("expected version %d for unchanged stats, got %d", before, v)
+	}
+	if err := s.UpdatePeerStats("pk1", nil, 150, 200); err != nil {
+		t.Fatalf("update stats: %v", err)
+	}
+	got, _ := s.Get("t1")
+	if got.RxBytes != 150 {
+		t.Errorf("expected rx 150, got %d", got.RxBytes)
+	}
+}
+
+func TestUpdatePeerStatsKeepsCache(t *testing.T) {
+	db := setupTestDB(t)
+	s := NewTunnelStore(db)
+	if err := s.Create(&Tunnel{ID: "t1", VpnIP: "10.0.0.2", PublicKey: "pk1", Enabled: true}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	s.List()
+	before := tableVersion(t, db, "wg_peers")
+
+	// Stats and endpoint changes keep the cached listing, which still
+	// shows their current values
+	hs := time.Unix(1700000000, 0)
+	if err := s.UpdatePeerStats("pk1", &hs, 150, 250); err != nil {
+		t.Fatalf("update stats: %v", err)
+	}
+	if _, err := db.conn.Exec(`UPDATE wg_peers SET endpoint = '192.0.2.1:51820' WHERE id = 't1'`); err != nil {
+		t.Fatalf("update endpoint: %v", err)
+	}
+	if v := tableVersion(t, db, "wg_peers"); v != before {
+		t.Errorf("expected version %d after stats writes, got %d", before, v)
+	}
+	tunnels, _ := s.List()
+	got := tunnels[0]
+	if got.RxBytes != 150 || got.TxBytes != 250 || got.LastHandshake == nil || !got.LastHandshake.Equal(hs) || got.Endpoint != "192.0.2.1:51820" {
+		t.Errorf("expected current stats in the listing, got %+v", got)
+	}
+
+	// A configuration change still does
+	if _, err := s.SetEnabled("t1", false); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if v := tableVersion(t, db, "wg_peers"); v == before {
+		t.Error("expected a configuration change to bump the version")
+	}
+}
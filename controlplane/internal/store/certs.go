@@ -0,0 +1,135 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrAlreadyRevoked is returned when revoking a revoked client certificate.
+var ErrAlreadyRevoked = errors.New("certificate is already revoked")
+
+// ClientCert records an API client certificate issued by the embedded CA.
+// The certificate itself is not kept: revocation only needs the serial.
+type ClientCert struct {
+	Serial             string // lowercase hex
+	CommonName         string
+	OrganizationalUnit string
+	IssuedBy           string // CN of the admin who issued it
+	NotBefore          time.Time
+	NotAfter           time.Time
+	CreatedAt          time.Time
+	RevokedAt          *time.Time
+	RevocationReason   string
+}
+
+// CertStore records issued client certificates and their revocation.
+type CertStore struct {
+	db *sql.DB
+}
+
+// NewCertStore creates a CertStore using the given DB.
+func NewCertStore(db *DB) *CertStore {
+	return &CertStore{db: db.Conn()}
+}
+
+const certColumns = `serial, common_name, organizational_unit, issued_by, not_before, not_after, created_at, revoked_at, revocation_reason`
+
+// Create records an issued certificate.
+func (s *CertStore) Create(c *ClientCert) error {
+	c.CreatedAt = time.Unix(time.Now().Unix(), 0)
+	_, err := s.db.Exec(`INSERT INTO client_certs (`+certColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, NULL, NULL)`,
+		c.Serial, c.CommonName, nullString(c.OrganizationalUnit), nullString(c.IssuedBy),
+		c.NotBefore.Unix(), c.NotAfter.Unix(), c.CreatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("insert client cert: %w", err)
+	}
+	return nil
+}
+
+// Get retrieves a certificate by serial.
+func (s *CertStore) Get(serial string) (*ClientCert, error) {
+	return scanCert(s.db.QueryRow(`SELECT `+certColumns+` FROM client_certs WHERE serial = ?`, serial))
+}
+
+// List returns every issued certificate, newest first.
+func (s *CertStore) List() ([]*ClientCert, error) {
+	return s.query(`SELECT ` + certColumns + ` FROM client_certs ORDER BY created_at DESC, serial ASC`)
+}
+
+// ListRevoked returns the revoked certificates that have not expired at now,
+// which are the entries of the revocation list.
+func (s *CertStore) ListRevoked(now time.Time) ([]*ClientCert, error) {
+	return s.query(`SELECT `+certColumns+` FROM client_certs
+		WHERE revoked_at IS NOT NULL AND not_after > ? ORDER BY revoked_at ASC, serial ASC`, now.Unix())
+}
+
+// IsRevoked reports whether the certificate with the given serial was
+// revoked. Serials that were never recorded are not revoked.
+func (s *CertStore) IsRevoked(serial string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM client_certs WHERE serial = ? AND revoked_at IS NOT NULL`, serial).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("check revocation: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Revoke marks a certificate revoked at the given time.
+func (s *CertStore) Revoke(serial, reason string, at time.Time) error {
+	res, err := s.db.Exec(`UPDATE client_certs SET revoked_at = ?, revocation_reason = ?
+		WHERE serial = ? AND revoked_at IS NULL`, at.Unix(), nullString(reason), serial)
+	if err != nil {
+		return fmt.Errorf("revoke client cert: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := s.Get(serial); err != nil {
+			return err
+		}
+		return ErrAlreadyRevoked
+	}
+	return nil
+}
+
+func (s *CertStore) query(q string, args ...interface{}) ([]*ClientCert, error) {
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list client certs: %w", err)
+	}
+	defer rows.Close()
+
+	var certs []*ClientCert
+	for rows.Next() {
+		c, err := scanCert(rows)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, rows.Err()
+}
+
+func scanCert(row rowScanner) (*ClientCert, error) {
+	c := &ClientCert{}
+	var (
+		ou, issuedBy, reason           sql.NullString
+		notBefore, notAfter, createdAt int64
+		revokedAt                      sql.NullInt64
+	)
+	err := row.Scan(&c.Serial, &c.CommonName, &ou, &issuedBy, &notBefore, &notAfter, &createdAt, &revokedAt, &reason)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("client cert not found")
+		}
+		return nil, fmt.Errorf("scan client cert: %w", err)
+	}
+	c.OrganizationalUnit = ou.String
+	c.IssuedBy = issuedBy.String
+	c.NotBefore = time.Unix(notBefore, 0)
+	c.NotAfter = time.Unix(notAfter, 0)
+	c.CreatedAt = time.Unix(createdAt, 0)
+	c.RevokedAt = nullTime(revokedAt)
+	c.RevocationReason = reason.String
+	return c, nil
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClientCerts(t *testing.T) {
+	db := setupTestDB(t)
+	cs := NewCertStore(db)
+	now := time.Unix(1700000000, 0)
+
+	for _, c := range []*ClientCert{
+		{Serial: "a1", CommonName: "alice", OrganizationalUnit: "ops", IssuedBy: "admin", NotBefore: now, NotAfter: now.Add(time.Hour)},
+		{Serial: "b2", CommonName: "bob", NotBefore: now, NotAfter: now.Add(48 * time.Hour)},
+	} {
+		if err := cs.Create(c); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	c, err := cs.Get("a1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if c.CommonName != "alice" || c.OrganizationalUnit != "ops" || c.IssuedBy != "admin" || !c.NotAfter.Equal(now.Add(time.Hour)) || c.RevokedAt != nil {
+		t.Errorf("unexpected cert %+v", c)
+	}
+
+	if err := cs.Revoke("a1", "laptop lost", now); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := cs.Revoke("a1", "", now); !errors.Is(err, ErrAlreadyRevoked) {
+		t.Errorf("expected ErrAlreadyRevoked, got %v", err)
+	}
+	if err := cs.Revoke("ff", "", now); err == nil || errors.Is(err, ErrAlreadyRevoked) {
+		t.Errorf("expected not found for an unknown serial, got %v", err)
+	}
+	if revoked, err := cs.IsRevoked("a1"); err != nil || !revoked {
+		t.Errorf("expected a1 revoked, got %v (err %v)", revoked, err)
+	}
+	if revoked, _ := cs.IsRevoked("b2"); revoked {
+		t.Error("expected b2 not revoked")
+	}
+
+	c, _ = cs.Get("a1")
+	if c.RevokedAt == nil || !c.RevokedAt.Equal(now) || c.RevocationReason != "laptop lost" {
+		t.Errorf("unexpected revocation %+v", c)
+	}
+	if revoked, _ := cs.ListRevoked(now); len(revoked) != 1 || revoked[0].Serial != "a1" {
+		t.Errorf("expected a1 on the revocation list, got %+v", revoked)
+	}
+	// Expired certificates drop off the list
+	if revoked, _ := cs.ListRevoked(now.Add(2 * time.Hour)); len(revoked) != 0 {
+		t.Errorf("expected an empty revocation list after expiry, got %+v", revoked)
+	}
+	if all, _ := cs.List(); len(all) != 2 {
+		t.Errorf("expected 2 certs, got %d", len(all))
+	}
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DefaultQueryTimeout bounds each query of the tunnel, route, and firewall
+// stores unless SetQueryTimeout changes it. It is below the API's write
+// timeout, so a slow query fails the request instead of outliving it.
+const DefaultQueryTimeout = 10 * time.Second
+
+// conn runs a store's queries on the shared connection. Each query, or
+// transaction, ends when the store's context is done or the query timeout
+// passes, whichever comes first.
+type conn struct {
+	db      *sql.DB
+	ctx     context.Context
+	timeout time.Duration
+}
+
+func newConn(db *DB) *conn {
+	return &conn{db: db.conn, ctx: context.Background(), timeout: db.queryTimeout}
+}
+
+// withContext returns a copy of c whose queries also end with ctx.
+func (c *conn) withContext(ctx context.Context) *conn {
+	bound := *c
+	bound.ctx = ctx
+	return &bound
+}
+
+func (c *conn) queryContext() (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(c.ctx)
+	}
+	return context.WithTimeout(c.ctx, c.timeout)
+}
+
+func (c *conn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := c.queryContext()
+	defer cancel()
+	return c.db.ExecContext(ctx, query, args...)
+}
+
+// Query runs query; the returned rows hold its context until closed.
+func (c *conn) Query(query string, args ...interface{}) (*rows, error) {
+	ctx, cancel := c.queryContext()
+	r, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &rows{Rows: r, cancel: cancel}, nil
+}
+
+// QueryRow runs query; the returned row holds its context until scanned.
+func (c *conn) QueryRow(query string, args ...interface{}) *row {
+	ctx, cancel := c.queryContext()
+	return &row{Row: c.db.QueryRowContext(ctx, query, args...), cancel: cancel}
+}
+
+// Begin starts a transaction, which holds its context until committed or
+// rolled back.
+func (c *conn) Begin() (*tx, error) {
+	ctx, cancel := c.queryContext()
+	t, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &tx{Tx: t, cancel: cancel}, nil
+}
+
+// rows releases its query's context when closed.
+type rows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *rows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// row releases its query's context once scanned.
+type row struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+func (r *row) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return r.Row.Scan(dest...)
+}
+
+// tx releases its context when it ends.
+type tx struct {
+	*sql.Tx
+	cancel context.CancelFunc
+}
+
+func (t *tx) Commit() error {
+	defer t.cancel()
+	return t.Tx.Commit()
+}
+
+func (t *tx) Rollback() error {
+	defer t.cancel()
+	return t.Tx.Rollback()
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStoreContext(t *testing.T) {
+	db := setupTestDB(t)
+	s := NewTunnelStore(db)
+	if err := s.Create(&Tunnel{ID: "t1", VpnIP: "10.0.0.2", PublicKey: "pk1", Enabled: true}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bound := s.WithContext(ctx)
+	if _, err := bound.List(); err != nil {
+		t.Fatalf("list with a live context: %v", err)
+	}
+	cancel()
+	if _, err := bound.List(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the list canceled, got %v", err)
+	}
+	if _, err := bound.Get("t1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the get canceled, got %v", err)
+	}
+	// The store it was bound from is unaffected
+	if _, err := s.Get("t1"); err != nil {
+		t.Errorf("get on the unbound store: %v", err)
+	}
+}
+
+func TestStoreQueryTimeout(t *testing.T) {
+	db := setupTestDB(t)
+	db.SetQueryTimeout(time.Nanosecond)
+	s := NewFirewallStore(db)
+	if _, err := s.List(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the query timed out, got %v", err)
+	}
+
+	db.SetQueryTimeout(0)
+	if _, err := NewFirewallStore(db).List(); err != nil {
+		t.Errorf("list without a timeout: %v", err)
+	}
+}
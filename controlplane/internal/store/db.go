@@ -1,17 +1,26 @@
 package store
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"log/slog"
 	"strings"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
 
 // DB wraps the SQLite database connection and provides access to all stores.
 type DB struct {
-	conn *sql.DB
+	conn         *sql.DB
+	path         string        // file path, or ":memory:"
+	queryTimeout time.Duration // bounds the queries of stores created afterwards
+
+	// Listings shared by the stores created from this DB.
+	tunnels *listCache[*Tunnel]
+	routes  *listCache[*Route]
+	rules   *listCache[*FirewallRule]
 }
 
 // New opens a SQLite database at the given path (use ":memory:" for tests),
@@ -31,7 +40,14 @@ func New(path string) (*DB, error) {
 
 	conn.SetMaxOpenConns(1) // SQLite doesn't do well with concurrent writes
 
-	db := &DB{conn: conn}
+	db := &DB{
+		conn:         conn,
+		path:         path,
+		queryTimeout: DefaultQueryTimeout,
+		tunnels:      newListCache("wg_peers", cloneTunnel),
+		routes:       newListCache("l4_routes", cloneRoute),
+		rules:        newListCache("firewall_rules", cloneFirewallRule),
+	}
 	if err := db.migrate(); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("migrate: %w", err)
@@ -45,92 +61,296 @@ func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
+// Snapshot writes a consistent copy of the database to path, which must
+// not exist. A file database is copied on a connection of its own, so the
+// stores' queries do not wait for the copy; an in-memory one can only be
+// copied on the shared connection.
+func (db *DB) Snapshot(path string) error {
+	conn := db.conn
+	if db.path != ":memory:" {
+		c, err := sql.Open("sqlite", db.path+"?_pragma=busy_timeout(5000)")
+		if err != nil {
+			return fmt.Errorf("snapshot database: %w", err)
+		}
+		defer c.Close()
+		conn = c
+	}
+	if _, err := conn.Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("snapshot database: %w", err)
+	}
+	return nil
+}
+
+// volatileTables hold samples, counters, and bookkeeping, which change
+// while the configuration does not.
+var volatileTables = map[string]bool{
+	"audit_archives":        true,
+	"audit_log":             true,
+	"idempotency_keys":      true,
+	"leases":                true,
+	"peer_endpoint_history": true,
+	"peer_events":           true,
+	"peer_probe_samples":    true,
+	"peer_stats_history":    true,
+	"rate_limits":           true,
+	"reconcile_runs":        true,
+	"reconciliation_state":  true,
+	"route_stats_history":   true,
+	"startup_report":        true,
+	"table_versions":        true,
+}
+
+// volatileColumns are the columns of other tables that do so: peer stats
+// and endpoints, and node heartbeats.
+var volatileColumns = map[string]map[string]bool{
+	"wg_peers": {"last_handshake": true, "rx_bytes": true, "tx_bytes": true, "endpoint": true, "updated_at": true},
+	"nodes":    {"last_seen_at": true, "last_error": true},
+}
+
+// ContentDigest hashes the configuration held in the database file at
+// path, leaving out volatileTables and volatileColumns, so two copies that
+// differ only in stats and bookkeeping hash the same.
+func ContentDigest(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return sum, fmt.Errorf("open snapshot: %w", err)
+	}
+	defer conn.Close()
+
+	tables, err := queryStrings(conn, `SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return sum, fmt.Errorf("list tables: %w", err)
+	}
+	h := sha256.New()
+	for _, table := range tables {
+		if volatileTables[table] {
+			continue
+		}
+		all, err := queryStrings(conn, `SELECT name FROM pragma_table_info(?) ORDER BY cid`, table)
+		if err != nil {
+			return sum, fmt.Errorf("list columns of %s: %w", table, err)
+		}
+		var cols, order []string
+		for _, c := range all {
+			if !volatileColumns[table][c] {
+				cols = append(cols, `"`+c+`"`)
+				order = append(order, fmt.Sprint(len(cols)))
+			}
+		}
+		// Rows are ordered by content: VACUUM may renumber rowids
+		rows, err := conn.Query(`SELECT ` + strings.Join(cols, ", ") + ` FROM "` + table + `" ORDER BY ` + strings.Join(order, ", "))
+		if err != nil {
+			return sum, fmt.Errorf("read %s: %w", table, err)
+		}
+		fmt.Fprintf(h, "table %q\n", table)
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(ptrs...); err != nil {
+				rows.Close()
+				return sum, fmt.Errorf("read %s: %w", table, err)
+			}
+			for _, v := range values {
+				fmt.Fprintf(h, "%T:%q\x00", v, fmt.Sprint(v))
+			}
+			h.Write([]byte{'\n'})
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return sum, fmt.Errorf("read %s: %w", table, err)
+		}
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// queryStrings returns the single string column of a query's rows.
+func queryStrings(conn *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// SetQueryTimeout bounds each query of the tunnel, route, and firewall
+// stores created after the call; 0 leaves them unbounded.
+func (db *DB) SetQueryTimeout(d time.Duration) {
+	db.queryTimeout = d
+}
+
 // Conn returns the raw *sql.DB connection for direct use.
 func (db *DB) Conn() *sql.DB {
 	return db.conn
 }
 
+// migration is one versioned schema change. down, when set, undoes up so
+// MigrateDown can step back past it.
+type migration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+}
+
+// migrate brings the schema up to the latest migration.
 func (db *DB) migrate() error {
-	migrations := []string{
-		`CREATE TABLE IF NOT EXISTS wg_peers (
-			id                          TEXT PRIMARY KEY,
-			public_key                  TEXT NOT NULL UNIQUE,
-			vpn_ip                      TEXT NOT NULL UNIQUE,
-			psk_hash                    TEXT,
-			endpoint                    TEXT,
-			domains                     TEXT,
-			enabled                     INTEGER NOT NULL DEFAULT 1,
-			last_handshake              INTEGER,
-			tx_bytes                    INTEGER DEFAULT 0,
-			rx_bytes                    INTEGER DEFAULT 0,
-			auto_rotate_psk             INTEGER NOT NULL DEFAULT 0,
-			psk_rotation_interval_days  INTEGER NOT NULL DEFAULT 0,
-			auto_revoke_inactive        INTEGER NOT NULL DEFAULT 1,
-			inactive_expiry_days        INTEGER NOT NULL DEFAULT 90,
-			grace_period_minutes        INTEGER NOT NULL DEFAULT 30,
-			last_rotation_at            INTEGER,
-			pending_rotation_id         TEXT,
-			created_at                  INTEGER NOT NULL,
-			updated_at                  INTEGER NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS l4_routes (
-			id          TEXT PRIMARY KEY,
-			tunnel_id   TEXT NOT NULL REFERENCES wg_peers(id),
-			listen_port INTEGER NOT NULL DEFAULT 443,
-			match_type  TEXT NOT NULL DEFAULT 'sni',
-			match_value TEXT NOT NULL,
-			upstream    TEXT NOT NULL,
-			caddy_id    TEXT NOT NULL,
-			enabled     INTEGER NOT NULL DEFAULT 1,
-			created_at  INTEGER NOT NULL,
-			updated_at  INTEGER NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS firewall_rules (
-			id          TEXT PRIMARY KEY,
-			port        INTEGER NOT NULL CHECK (port BETWEEN 1 AND 65535),
-			proto       TEXT NOT NULL CHECK (proto IN ('tcp', 'udp')),
-			direction   TEXT NOT NULL DEFAULT 'in' CHECK (direction IN ('in', 'out')),
-			source_cidr TEXT NOT NULL DEFAULT '0.0.0.0/0',
-			action      TEXT NOT NULL DEFAULT 'allow' CHECK (action IN ('allow', 'deny')),
-			enabled     INTEGER NOT NULL DEFAULT 1,
-			created_at  INTEGER NOT NULL,
-			updated_at  INTEGER NOT NULL
-		)`,
-		`CREATE TABLE IF NOT EXISTS reconciliation_state (
-			id                  INTEGER PRIMARY KEY DEFAULT 1,
-			interval_seconds    INTEGER NOT NULL DEFAULT 30,
-			last_run_at         INTEGER,
-			last_status         TEXT DEFAULT 'pending',
-			last_error          TEXT,
-			drift_corrections   INTEGER DEFAULT 0,
-			CHECK (id = 1)
-		)`,
-		`INSERT OR IGNORE INTO reconciliation_state (id, interval_seconds, last_status, drift_corrections) VALUES (1, 30, 'pending', 0)`,
-		// Migration: add protocol column for port-forward routes
-		`ALTER TABLE l4_routes ADD COLUMN protocol TEXT NOT NULL DEFAULT 'tcp' CHECK (protocol IN ('tcp', 'udp'))`,
-		`CREATE TABLE IF NOT EXISTS audit_log (
-			id          INTEGER PRIMARY KEY AUTOINCREMENT,
-			timestamp   INTEGER NOT NULL,
-			client_cn   TEXT,
-			source_ip   TEXT,
-			method      TEXT NOT NULL,
-			path        TEXT NOT NULL,
-			body_hash   TEXT,
-			result      TEXT NOT NULL,
-			error_msg   TEXT
-		)`,
-	}
-
-	for i, m := range migrations {
-		if _, err := db.conn.Exec(m); err != nil {
-			// ALTER TABLE fails if column already exists — skip gracefully
-			if strings.Contains(m, "ALTER TABLE") && strings.Contains(err.Error(), "duplicate column") {
-				continue
+	return migrateUp(db.conn, migrations)
+}
+
+// SchemaVersion returns the version of the last migration applied.
+func (db *DB) SchemaVersion() (int, error) {
+	return schemaVersion(db.conn)
+}
+
+// MigrateDown rolls the schema back to version target, running the down
+// statements of every later migration, newest first. It changes nothing
+// if one of them has no down.
+func (db *DB) MigrateDown(target int) error {
+	return migrateDown(db.conn, migrations, target)
+}
+
+func migrateUp(conn *sql.DB, list []migration) error {
+	if err := checkMigrations(list); err != nil {
+		return err
+	}
+	// A database from before versioning had every statement run on each
+	// start. It is adopted by running them once more the old way, where
+	// an ALTER TABLE for a column that already exists is skipped.
+	hasTunnels, err := tableExists(conn, "wg_peers")
+	if err != nil {
+		return err
+	}
+	versioned, err := tableExists(conn, "schema_version")
+	if err != nil {
+		return err
+	}
+	legacy := hasTunnels && !versioned
+	if _, err := conn.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("create schema_version: %w", err)
+	}
+
+	current, err := schemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	if current > len(list) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, len(list))
+	}
+	for _, m := range list[current:] {
+		err := inTx(conn, func(tx *sql.Tx) error {
+			for _, stmt := range m.up {
+				if _, err := tx.Exec(stmt); err != nil {
+					if legacy && strings.Contains(stmt, "ALTER TABLE") && strings.Contains(err.Error(), "duplicate column") {
+						continue
+					}
+					return err
+				}
+			}
+			_, err := tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.name, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+
+	if current < len(list) {
+		slog.Info("database migrations applied", "from_version", current, "to_version", len(list), "adopted", legacy)
+	}
+	return nil
+}
+
+func migrateDown(conn *sql.DB, list []migration, target int) error {
+	current, err := schemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > current {
+		return fmt.Errorf("cannot roll back to version %d from version %d", target, current)
+	}
+	if current > len(list) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, len(list))
+	}
+	for v := current; v > target; v-- {
+		if m := list[v-1]; len(m.down) == 0 {
+			return fmt.Errorf("migration %d (%s) cannot be rolled back", m.version, m.name)
+		}
+	}
+	for v := current; v > target; v-- {
+		m := list[v-1]
+		err := inTx(conn, func(tx *sql.Tx) error {
+			for _, stmt := range m.down {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
 			}
-			return fmt.Errorf("migration %d: %w", i, err)
+			_, err := tx.Exec(`DELETE FROM schema_version WHERE version = ?`, m.version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("roll back migration %d (%s): %w", m.version, m.name, err)
 		}
 	}
+	slog.Info("database migrations rolled back", "from_version", current, "to_version", target)
+	return nil
+}
 
-	slog.Info("database migrations applied successfully")
+// checkMigrations ensures versions run 1, 2, ... without gaps.
+func checkMigrations(list []migration) error {
+	for i, m := range list {
+		if m.version != i+1 {
+			return fmt.Errorf("migration %q has version %d, expected %d", m.name, m.version, i+1)
+		}
+	}
 	return nil
 }
+
+func schemaVersion(conn *sql.DB) (int, error) {
+	var v int
+	if err := conn.QueryRow(`SELECT IFNULL(MAX(version), 0) FROM schema_version`).Scan(&v); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return v, nil
+}
+
+func tableExists(conn *sql.DB, name string) (bool, error) {
+	var n int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n); err != nil {
+		return false, fmt.Errorf("check table %s: %w", name, err)
+	}
+	return n > 0, nil
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds.
+func inTx(conn *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
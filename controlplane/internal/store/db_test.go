@@ -0,0 +1,228 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestConn(t *testing.T) *sql.DB {
+	t.Helper()
+	conn, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	conn := openTestConn(t)
+	list := []migration{
+		{version: 1, name: "items", up: []string{`CREATE TABLE items (id TEXT PRIMARY KEY)`}, down: []string{`DROP TABLE items`}},
+		{version: 2, name: "item names", up: []string{`ALTER TABLE items ADD COLUMN name TEXT`}, down: []string{`ALTER TABLE items DROP COLUMN name`}},
+	}
+
+	if err := migrateUp(conn, list[:1]); err != nil {
+		t.Fatalf("migrate to 1: %v", err)
+	}
+	if err := migrateUp(conn, list); err != nil {
+		t.Fatalf("migrate to 2: %v", err)
+	}
+	// Applied migrations are not run again
+	if err := migrateUp(conn, list); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	if v, _ := schemaVersion(conn); v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+	if _, err := conn.Exec(`INSERT INTO items (id, name) VALUES ('a', 'b')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	if err := migrateDown(conn, list, 1); err != nil {
+		t.Fatalf("migrate down: %v", err)
+	}
+	if v, _ := schemaVersion(conn); v != 1 {
+		t.Errorf("expected version 1, got %d", v)
+	}
+	if _, err := conn.Exec(`INSERT INTO items (id, name) VALUES ('c', 'd')`); err == nil {
+		t.Error("expected the name column to be gone")
+	}
+
+	// Without a down, nothing is rolled back
+	list[0].down = nil
+	if err := migrateDown(conn, list, 0); err == nil || !strings.Contains(err.Error(), "cannot be rolled back") {
+		t.Errorf("expected an error for a migration without down, got %v", err)
+	}
+	if v, _ := schemaVersion(conn); v != 1 {
+		t.Errorf("expected version 1 to remain, got %d", v)
+	}
+}
+
+func TestMigrateFailureIsAtomic(t *testing.T) {
+	conn := openTestConn(t)
+	list := []migration{
+		{version: 1, name: "items", up: []string{`CREATE TABLE items (id TEXT PRIMARY KEY)`}},
+		{version: 2, name: "broken", up: []string{
+			`ALTER TABLE items ADD COLUMN name TEXT`,
+			`ALTER TABLE missing ADD COLUMN name TEXT`,
+		}},
+	}
+
+	if err := migrateUp(conn, list); err == nil {
+		t.Fatal("expected the broken migration to fail")
+	}
+	if v, _ := schemaVersion(conn); v != 1 {
+		t.Errorf("expected version 1, got %d", v)
+	}
+	// The first statement of the failed migration was rolled back with it
+	list[1].up = list[1].up[:1]
+	if err := migrateUp(conn, list); err != nil {
+		t.Fatalf("retry fixed migration: %v", err)
+	}
+}
+
+func TestMigrateChecks(t *testing.T) {
+	conn := openTestConn(t)
+	if err := migrateUp(conn, []migration{{version: 2, name: "gap"}}); err == nil {
+		t.Error("expected an error for a gap in versions")
+	}
+
+	list := []migration{{version: 1, name: "one"}, {version: 2, name: "two"}}
+	if err := migrateUp(conn, list); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := migrateUp(conn, list[:1]); err == nil || !strings.Contains(err.Error(), "newer than this build") {
+		t.Errorf("expected an error for a newer schema, got %v", err)
+	}
+}
+
+func TestMigrateAdoptsLegacyDatabase(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	if err := ts.Create(&Tunnel{ID: "tun_1", PublicKey: "pk_1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}}); err != nil {
+		t.Fatalf("create tunnel: %v", err)
+	}
+
+	// A database from before versioning has the tables but no history
+	if _, err := db.conn.Exec(`DROP TABLE schema_version`); err != nil {
+		t.Fatalf("drop schema_version: %v", err)
+	}
+	if err := db.migrate(); err != nil {
+		t.Fatalf("adopt legacy database: %v", err)
+	}
+	if v, err := db.SchemaVersion(); err != nil || v != len(migrations) {
+		t.Errorf("expected version %d, got %d (%v)", len(migrations), v, err)
+	}
+	if _, err := ts.Get("tun_1"); err != nil {
+		t.Errorf("expected the tunnel to survive adoption: %v", err)
+	}
+}
+
+func TestMigrationsRollBack(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	if err := ts.Create(&Tunnel{ID: "tun_1", PublicKey: "pk_1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}}); err != nil {
+		t.Fatalf("create tunnel: %v", err)
+	}
+	if err := NewRouteStore(db).Create(&Route{ID: "route_1", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"app.example.com"}, Upstream: "10.0.0.2:443", CaddyID: "pm-route-route_1", Enabled: true}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+	fs := NewFirewallStore(db)
+	for _, r := range []*FirewallRule{
+		{ID: "fw_in", Port: 443, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true},
+		{ID: "fw_out", Port: 53, Proto: "udp", Direction: "out", Chain: "output", DestCIDR: "192.0.2.53/32", Action: "deny", Enabled: true},
+	} {
+		if err := fs.Create(r); err != nil {
+			t.Fatalf("create rule: %v", err)
+		}
+	}
+
+	// Rolling back to before unique names drops their indexes and columns
+	if err := db.MigrateDown(28); err != nil {
+		t.Fatalf("migrate down to 28: %v", err)
+	}
+	var ids []string
+	rows, err := db.conn.Query(`SELECT id FROM firewall_rules ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) != 1 || ids[0] != "fw_in" {
+		t.Errorf("expected only the input rule to survive, got %v", ids)
+	}
+
+	// Every migration can be undone, and redone
+	if err := db.MigrateDown(0); err != nil {
+		t.Fatalf("migrate down to 0: %v", err)
+	}
+	var tables []string
+	rows, err = db.conn.Query(`SELECT name FROM sqlite_master WHERE type IN ('table', 'index', 'trigger')
+		AND name NOT LIKE 'sqlite_%' AND name != 'schema_version'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if len(tables) != 0 {
+		t.Errorf("expected an empty schema, got %v", tables)
+	}
+	if err := db.migrate(); err != nil {
+		t.Fatalf("migrate up again: %v", err)
+	}
+	if v, err := db.SchemaVersion(); err != nil || v != len(migrations) {
+		t.Errorf("expected version %d, got %d (%v)", len(migrations), v, err)
+	}
+}
+
+func TestContentDigest(t *testing.T) {
+	db, err := New(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ts := NewTunnelStore(db)
+	ts.Create(&Tunnel{ID: "tun_1", PublicKey: "pk1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+
+	digest := func() [32]byte {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "snapshot.db")
+		if err := db.Snapshot(path); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := ContentDigest(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	base := digest()
+
+	hs := time.Now()
+	if err := ts.UpdatePeerStats("pk1", &hs, 100, 200); err != nil {
+		t.Fatal(err)
+	}
+	NewLeaseStore(db).Acquire("leader", "a", hs, time.Hour)
+	if digest() != base {
+		t.Error("expected stats and leases to leave the digest unchanged")
+	}
+
+	NewTenantStore(db).Create(&Tenant{ID: "tenant_1", Name: "one"})
+	if digest() == base {
+		t.Error("expected a new tenant to change the digest")
+	}
+}
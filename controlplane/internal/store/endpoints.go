@@ -0,0 +1,85 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// maxEndpointHistory is how many endpoint changes are kept per tunnel.
+const maxEndpointHistory = 100
+
+// EndpointChange is an endpoint a tunnel's peer was first seen connecting from.
+type EndpointChange struct {
+	Endpoint string
+	SeenAt   time.Time
+}
+
+// RecordEndpoint stores the endpoint the peer with the given public key was
+// last observed at. A history entry is added only when the endpoint differs
+// from the stored one; it reports whether that happened. Unknown public keys
+// and empty endpoints are ignored.
+func (s *TunnelStore) RecordEndpoint(publicKey, endpoint string, at time.Time) (bool, error) {
+	if endpoint == "" {
+		return false, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id string
+	var current *string
+	err = tx.QueryRow(`SELECT id, endpoint FROM wg_peers WHERE public_key = ?`, publicKey).Scan(&id, &current)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("get endpoint: %w", err)
+	}
+	if current != nil && *current == endpoint {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(`UPDATE wg_peers SET endpoint = ? WHERE id = ?`, endpoint, id); err != nil {
+		return false, fmt.Errorf("update endpoint: %w", err)
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO peer_endpoint_history (peer_id, endpoint, seen_at) VALUES (?, ?, ?)`,
+		id, endpoint, at.Unix()); err != nil {
+		return false, fmt.Errorf("insert endpoint history: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM peer_endpoint_history WHERE peer_id = ? AND seen_at NOT IN (
+		SELECT seen_at FROM peer_endpoint_history WHERE peer_id = ? ORDER BY seen_at DESC LIMIT ?)`,
+		id, id, maxEndpointHistory); err != nil {
+		return false, fmt.Errorf("trim endpoint history: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit: %w", err)
+	}
+	return true, nil
+}
+
+// EndpointHistory returns a tunnel's endpoint changes, newest first.
+func (s *TunnelStore) EndpointHistory(id string) ([]EndpointChange, error) {
+	rows, err := s.db.Query(`SELECT endpoint, seen_at FROM peer_endpoint_history
+		WHERE peer_id = ? ORDER BY seen_at DESC`, id)
+	if err != nil {
+		return nil, fmt.Errorf("query endpoint history: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []EndpointChange
+	for rows.Next() {
+		var c EndpointChange
+		var seenAt int64
+		if err := rows.Scan(&c.Endpoint, &seenAt); err != nil {
+			return nil, fmt.Errorf("scan endpoint history: %w", err)
+		}
+		c.SeenAt = time.Unix(seenAt, 0)
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
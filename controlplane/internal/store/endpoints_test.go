@@ -0,0 +1,51 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordEndpoint(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+
+	if err := ts.Create(&Tunnel{ID: "tun_ep", PublicKey: "epkey=", VpnIP: "10.0.0.9", Enabled: true}); err != nil {
+		t.Fatalf("create tunnel: %v", err)
+	}
+
+	base := time.Unix(1_700_000_000, 0)
+	steps := []struct {
+		endpoint string
+		changed  bool
+	}{
+		{"", false},
+		{"198.51.100.7:51820", true},
+		{"198.51.100.7:51820", false},
+		{"203.0.113.4:40000", true},
+	}
+	for i, step := range steps {
+		changed, err := ts.RecordEndpoint("epkey=", step.endpoint, base.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if changed != step.changed {
+			t.Errorf("step %d: expected changed=%v, got %v", i, step.changed, changed)
+		}
+	}
+	if changed, err := ts.RecordEndpoint("unknown=", "192.0.2.1:1", base); err != nil || changed {
+		t.Errorf("unknown peer: expected no change, got %v, %v", changed, err)
+	}
+
+	tunnel, _ := ts.Get("tun_ep")
+	if tunnel.Endpoint != "203.0.113.4:40000" {
+		t.Errorf("expected current endpoint to be stored, got %q", tunnel.Endpoint)
+	}
+
+	history, err := ts.EndpointHistory("tun_ep")
+	if err != nil {
+		t.Fatalf("endpoint history: %v", err)
+	}
+	if len(history) != 2 || history[0].Endpoint != "203.0.113.4:40000" || history[1].Endpoint != "198.51.100.7:51820" {
+		t.Errorf("unexpected history: %+v", history)
+	}
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// maxPeerEvents is how many connection events are kept per tunnel.
+const maxPeerEvents = 500
+
+// Peer event types.
+const (
+	PeerConnected    = "connected"
+	PeerDisconnected = "disconnected"
+)
+
+// PeerEvent is a change in whether a tunnel's peer is connected.
+type PeerEvent struct {
+	Type     string // PeerConnected or PeerDisconnected
+	Endpoint string // where the peer connected from, if known
+	At       time.Time
+}
+
+// RecordConnection stores a PeerEvent if connected differs from the tunnel's
+// last recorded state, and reports whether it did. A tunnel without events
+// counts as disconnected.
+func (s *TunnelStore) RecordConnection(id string, connected bool, endpoint string, at time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var last string
+	err = tx.QueryRow(`SELECT type FROM peer_events WHERE peer_id = ? ORDER BY id DESC LIMIT 1`, id).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("get last peer event: %w", err)
+	}
+	wasConnected := last == PeerConnected
+	if connected == wasConnected {
+		return false, nil
+	}
+
+	eventType := PeerDisconnected
+	if connected {
+		eventType = PeerConnected
+	}
+	if _, err := tx.Exec(`INSERT INTO peer_events (peer_id, type, endpoint, at) VALUES (?, ?, ?, ?)`,
+		id, eventType, nullString(endpoint), at.Unix()); err != nil {
+		return false, fmt.Errorf("insert peer event: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM peer_events WHERE peer_id = ? AND id NOT IN (
+		SELECT id FROM peer_events WHERE peer_id = ? ORDER BY id DESC LIMIT ?)`,
+		id, id, maxPeerEvents); err != nil {
+		return false, fmt.Errorf("trim peer events: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit: %w", err)
+	}
+	return true, nil
+}
+
+// PeerEvents returns a tunnel's connection events, newest first.
+func (s *TunnelStore) PeerEvents(id string) ([]PeerEvent, error) {
+	rows, err := s.db.Query(`SELECT type, endpoint, at FROM peer_events
+		WHERE peer_id = ? ORDER BY id DESC`, id)
+	if err != nil {
+		return nil, fmt.Errorf("query peer events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []PeerEvent
+	for rows.Next() {
+		var e PeerEvent
+		var endpoint *string
+		var at int64
+		if err := rows.Scan(&e.Type, &endpoint, &at); err != nil {
+			return nil, fmt.Errorf("scan peer event: %w", err)
+		}
+		if endpoint != nil {
+			e.Endpoint = *endpoint
+		}
+		e.At = time.Unix(at, 0)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
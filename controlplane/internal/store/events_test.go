@@ -0,0 +1,52 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordConnection(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	if err := ts.Create(&Tunnel{ID: "tun_ev", PublicKey: "evkey=", VpnIP: "10.0.0.9", Enabled: true}); err != nil {
+		t.Fatalf("create tunnel: %v", err)
+	}
+
+	base := time.Unix(1_700_000_000, 0)
+	steps := []struct {
+		connected bool
+		changed   bool
+	}{
+		{false, false}, // never connected: nothing to record
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+	}
+	for i, step := range steps {
+		changed, err := ts.RecordConnection("tun_ev", step.connected, "198.51.100.7:51820", base.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if changed != step.changed {
+			t.Errorf("step %d: expected changed=%v, got %v", i, step.changed, changed)
+		}
+	}
+
+	events, err := ts.PeerEvents("tun_ev")
+	if err != nil {
+		t.Fatalf("peer events: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != PeerDisconnected || events[1].Type != PeerConnected {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if !events[1].At.Equal(base.Add(time.Minute)) || events[1].Endpoint != "198.51.100.7:51820" {
+		t.Errorf("unexpected connect event: %+v", events[1])
+	}
+
+	// Events go with the tunnel
+	ts.Delete("tun_ev")
+	if events, _ := ts.PeerEvents("tun_ev"); len(events) != 0 {
+		t.Errorf("expected events to be deleted with the tunnel, got %d", len(events))
+	}
+}
@@ -1,48 +1,157 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 )
 
 // FirewallRule represents a dynamic firewall rule in the database.
 type FirewallRule struct {
 	ID         string
+	Name       string // caller-supplied, unique per tenant; "" if unnamed
 	Port       int
 	Proto      string
+	Chain      string // "input" (traffic to the VPS), "forward" (traffic routed through the WireGuard interface), or "output" (traffic from the VPS)
 	Direction  string
 	SourceCIDR string
+	DestCIDR   string // "" matches every destination
 	Action     string
 	Enabled    bool
+	TenantID   string
 	CreatedAt  time.Time
 	UpdatedAt  time.Time
+
+	// ActiveHours is the daily window in UTC the rule applies in, such as
+	// "08:00-18:00"; "" applies it all day.
+	ActiveHours string
+	// Description documents the rule; Group collects the rules of one
+	// application so they can be listed and deleted together. Both are
+	// optional.
+	Description string
+	Group       string
+}
+
+// ParseActiveHours parses a daily "HH:MM-HH:MM" window into its start and
+// end, in minutes after midnight UTC. A window ending before it starts
+// spans midnight, e.g. "22:00-06:00"; "" is the whole day.
+func ParseActiveHours(s string) (start, end int, err error) {
+	if s == "" {
+		return 0, 24 * 60, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("active hours %q must be HH:MM-HH:MM", s)
+	}
+	if start, err = parseClock(from); err != nil {
+		return 0, 0, fmt.Errorf("active hours %q: %w", s, err)
+	}
+	if end, err = parseClock(to); err != nil {
+		return 0, 0, fmt.Errorf("active hours %q: %w", s, err)
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("active hours %q start and end at the same time", s)
+	}
+	return start, end, nil
+}
+
+// parseClock parses "HH:MM", 00:00 to 24:00, into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
 }
 
+// InActiveHours reports whether now falls within the rule's active hours.
+// A window includes its start and excludes its end; rules with malformed
+// hours, which the API rejects, never apply.
+func (r *FirewallRule) InActiveHours(now time.Time) bool {
+	start, end, err := ParseActiveHours(r.ActiveHours)
+	if err != nil {
+		return false
+	}
+	now = now.UTC()
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// firewallColumns is the column list shared by every firewall_rules SELECT;
+// scanFirewallRule expects columns in exactly this order.
+const firewallColumns = `id, port, proto, direction, source_cidr, action, enabled,
+		created_at, updated_at, tenant_id, chain, name, dest_cidr, active_hours, description, rule_group`
+
 // FirewallStore provides CRUD operations for firewall_rules.
 type FirewallStore struct {
-	db *sql.DB
+	db    *conn
+	cache *listCache[*FirewallRule]
 }
 
-// DB returns the underlying *sql.DB. Used by the reconciler test for direct access.
+// DB returns the underlying database, for the stores of tables that share
+// it, and for direct access in tests.
 func (s *FirewallStore) DB() *DB {
-	return &DB{conn: s.db}
+	return &DB{conn: s.db.db}
 }
 
 // NewFirewallStore creates a FirewallStore using the given DB.
 func NewFirewallStore(db *DB) *FirewallStore {
-	return &FirewallStore{db: db.Conn()}
+	return &FirewallStore{db: newConn(db), cache: db.rules}
+}
+
+// WithContext returns a copy of the store whose queries end when ctx is
+// done, such as when an API client goes away.
+func (s *FirewallStore) WithContext(ctx context.Context) *FirewallStore {
+	return &FirewallStore{db: s.db.withContext(ctx), cache: s.cache}
 }
 
 // Create inserts a new firewall rule.
 func (s *FirewallStore) Create(r *FirewallRule) error {
+	return insertFirewallRule(s.db, r)
+}
+
+// CreateAll inserts the rules in one transaction, so either all of them or
+// none are created.
+func (s *FirewallStore) CreateAll(rules []*FirewallRule) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, r := range rules {
+		if err := insertFirewallRule(tx, r); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertFirewallRule inserts r using db, which may be a transaction.
+func insertFirewallRule(db execer, r *FirewallRule) error {
+	if r.Chain == "" {
+		r.Chain = "input"
+	}
 	now := time.Now().Unix()
-	_, err := s.db.Exec(`INSERT INTO firewall_rules (
-		id, port, proto, direction, source_cidr, action, enabled, created_at, updated_at
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	_, err := db.Exec(`INSERT INTO firewall_rules (
+		id, port, proto, direction, source_cidr, action, enabled, created_at, updated_at, tenant_id, chain, name, dest_cidr,
+		active_hours, description, rule_group
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		r.ID, r.Port, r.Proto, r.Direction, r.SourceCIDR, r.Action,
-		boolToInt(r.Enabled), now, now,
+		boolToInt(r.Enabled), now, now, nullString(r.TenantID), r.Chain, nullString(r.Name), r.DestCIDR,
+		r.ActiveHours, r.Description, r.Group,
 	)
+	if isNameConflict(err) {
+		return fmt.Errorf("insert firewall rule: %s: %w", r.Name, ErrNameInUse)
+	}
 	if err != nil {
 		return fmt.Errorf("insert firewall rule: %w", err)
 	}
@@ -53,17 +162,23 @@ func (s *FirewallStore) Create(r *FirewallRule) error {
 
 // Get retrieves a firewall rule by ID.
 func (s *FirewallStore) Get(id string) (*FirewallRule, error) {
-	row := s.db.QueryRow(`SELECT
-		id, port, proto, direction, source_cidr, action, enabled, created_at, updated_at
-	FROM firewall_rules WHERE id = ?`, id)
+	row := s.db.QueryRow(`SELECT `+firewallColumns+` FROM firewall_rules WHERE id = ?`, id)
+	return scanFirewallRule(row)
+}
+
+// GetByName retrieves a tenant's firewall rule by name.
+func (s *FirewallStore) GetByName(tenantID, name string) (*FirewallRule, error) {
+	row := s.db.QueryRow(`SELECT `+firewallColumns+` FROM firewall_rules WHERE IFNULL(tenant_id, '') = ? AND name = ?`, tenantID, name)
 	return scanFirewallRule(row)
 }
 
 // List returns all firewall rules.
 func (s *FirewallStore) List() ([]*FirewallRule, error) {
-	rows, err := s.db.Query(`SELECT
-		id, port, proto, direction, source_cidr, action, enabled, created_at, updated_at
-	FROM firewall_rules ORDER BY created_at ASC`)
+	return s.cache.list(s.db, s.list)
+}
+
+func (s *FirewallStore) list() ([]*FirewallRule, error) {
+	rows, err := s.db.Query(`SELECT ` + firewallColumns + ` FROM firewall_rules ORDER BY created_at ASC`)
 	if err != nil {
 		return nil, fmt.Errorf("list firewall rules: %w", err)
 	}
@@ -71,7 +186,7 @@ func (s *FirewallStore) List() ([]*FirewallRule, error) {
 
 	var rules []*FirewallRule
 	for rows.Next() {
-		r, err := scanFirewallRuleRows(rows)
+		r, err := scanFirewallRule(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -82,23 +197,35 @@ func (s *FirewallStore) List() ([]*FirewallRule, error) {
 
 // ListEnabled returns only enabled firewall rules.
 func (s *FirewallStore) ListEnabled() ([]*FirewallRule, error) {
-	rows, err := s.db.Query(`SELECT
-		id, port, proto, direction, source_cidr, action, enabled, created_at, updated_at
-	FROM firewall_rules WHERE enabled = 1 ORDER BY created_at ASC`)
+	all, err := s.List()
 	if err != nil {
-		return nil, fmt.Errorf("list enabled firewall rules: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
-
 	var rules []*FirewallRule
-	for rows.Next() {
-		r, err := scanFirewallRuleRows(rows)
-		if err != nil {
-			return nil, err
+	for _, r := range all {
+		if r.Enabled {
+			rules = append(rules, r)
 		}
-		rules = append(rules, r)
 	}
-	return rules, rows.Err()
+	return rules, nil
+}
+
+// Update saves a rule's source CIDR, action, enabled flag, active hours,
+// description, and group.
+func (s *FirewallStore) Update(r *FirewallRule) error {
+	now := time.Now().Unix()
+	res, err := s.db.Exec(`UPDATE firewall_rules SET source_cidr = ?, action = ?, enabled = ?, active_hours = ?,
+		description = ?, rule_group = ?, updated_at = ? WHERE id = ?`,
+		r.SourceCIDR, r.Action, boolToInt(r.Enabled), r.ActiveHours, r.Description, r.Group, now, r.ID)
+	if err != nil {
+		return fmt.Errorf("update firewall rule: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("firewall rule not found: %s", r.ID)
+	}
+	r.UpdatedAt = time.Unix(now, 0)
+	return nil
 }
 
 // Delete removes a firewall rule by ID.
@@ -114,45 +241,50 @@ func (s *FirewallStore) Delete(id string) error {
 	return nil
 }
 
-func scanFirewallRule(row *sql.Row) (*FirewallRule, error) {
-	r := &FirewallRule{}
-	var (
-		enabled              int
-		createdAt, updatedAt int64
-	)
-
-	err := row.Scan(
-		&r.ID, &r.Port, &r.Proto, &r.Direction, &r.SourceCIDR,
-		&r.Action, &enabled, &createdAt, &updatedAt,
-	)
+// DeleteAll removes the firewall rules with the given IDs in one
+// transaction, so either all of them or none are deleted.
+func (s *FirewallStore) DeleteAll(ids []string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("firewall rule not found")
-		}
-		return nil, fmt.Errorf("scan firewall rule: %w", err)
+		return fmt.Errorf("begin tx: %w", err)
 	}
+	defer tx.Rollback()
 
-	r.Enabled = enabled == 1
-	r.CreatedAt = time.Unix(createdAt, 0)
-	r.UpdatedAt = time.Unix(updatedAt, 0)
-	return r, nil
+	for _, id := range ids {
+		res, err := tx.Exec(`DELETE FROM firewall_rules WHERE id = ?`, id)
+		if err != nil {
+			return fmt.Errorf("delete firewall rule: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("firewall rule not found: %s", id)
+		}
+	}
+	return tx.Commit()
 }
 
-func scanFirewallRuleRows(rows *sql.Rows) (*FirewallRule, error) {
+// scanFirewallRule scans a single firewall rule row selected with firewallColumns.
+func scanFirewallRule(row rowScanner) (*FirewallRule, error) {
 	r := &FirewallRule{}
 	var (
+		tenantID, name       sql.NullString
 		enabled              int
 		createdAt, updatedAt int64
 	)
 
-	err := rows.Scan(
+	err := row.Scan(
 		&r.ID, &r.Port, &r.Proto, &r.Direction, &r.SourceCIDR,
-		&r.Action, &enabled, &createdAt, &updatedAt,
+		&r.Action, &enabled, &createdAt, &updatedAt, &tenantID, &r.Chain, &name, &r.DestCIDR, &r.ActiveHours,
+		&r.Description, &r.Group,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("scan firewall rule row: %w", err)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("firewall rule not found")
+		}
+		return nil, fmt.Errorf("scan firewall rule: %w", err)
 	}
 
+	r.Name = name.String
+	r.TenantID = tenantID.String
 	r.Enabled = enabled == 1
 	r.CreatedAt = time.Unix(createdAt, 0)
 	r.UpdatedAt = time.Unix(updatedAt, 0)
@@ -207,15 +339,48 @@ func (s *FirewallStore) UpdateReconciliationState(status string, errMsg *string,
 	return err
 }
 
+// CheckWritable performs a no-op write so a read-only database is detected
+// before a real mutation fails.
+func (s *FirewallStore) CheckWritable() error {
+	if _, err := s.db.Exec(`UPDATE reconciliation_state SET interval_seconds = interval_seconds WHERE id = 1`); err != nil {
+		return fmt.Errorf("write check: %w", err)
+	}
+	return nil
+}
+
+// AuditEntry is one row of the audit log.
+type AuditEntry struct {
+	ClientCN    string
+	SourceIP    string
+	Method      string
+	Path        string
+	BodyHash    string
+	Result      string // "ok" or "error"
+	ErrorMsg    string
+	RequestBody string // redacted request body, if body recording is enabled
+	Diff        string // JSON object of changed fields, if body recording is enabled
+}
+
 // WriteAuditLog writes an entry to the audit log.
 func (s *FirewallStore) WriteAuditLog(clientCN, sourceIP, method, path, bodyHash, result string, errMsg string) error {
+	return s.WriteAuditEntry(&AuditEntry{
+		ClientCN: clientCN,
+		SourceIP: sourceIP,
+		Method:   method,
+		Path:     path,
+		BodyHash: bodyHash,
+		Result:   result,
+		ErrorMsg: errMsg,
+	})
+}
+
+// WriteAuditEntry writes an entry, including any body and diff, to the
+// audit log.
+func (s *FirewallStore) WriteAuditEntry(e *AuditEntry) error {
 	now := time.Now().Unix()
-	var errStr sql.NullString
-	if errMsg != "" {
-		errStr = sql.NullString{String: errMsg, Valid: true}
-	}
-	_, err := s.db.Exec(`INSERT INTO audit_log (timestamp, client_cn, source_ip, method, path, body_hash, result, error_msg)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		now, nullString(clientCN), nullString(sourceIP), method, path, nullString(bodyHash), result, errStr)
+	_, err := s.db.Exec(`INSERT INTO audit_log (timestamp, client_cn, source_ip, method, path, body_hash, result, error_msg, request_body, diff)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		now, nullString(e.ClientCN), nullString(e.SourceIP), e.Method, e.Path, nullString(e.BodyHash), e.Result,
+		nullString(e.ErrorMsg), nullString(e.RequestBody), nullString(e.Diff))
 	return err
 }
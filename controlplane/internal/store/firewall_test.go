@@ -1,7 +1,9 @@
 package store
 
 import (
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestFirewallRuleCRUD(t *testing.T) {
@@ -40,6 +42,26 @@ func TestFirewallRuleCRUD(t *testing.T) {
 	if got.Action != "allow" {
 		t.Errorf("expected action allow, got %s", got.Action)
 	}
+	if got.Chain != "input" {
+		t.Errorf("expected default chain input, got %s", got.Chain)
+	}
+	if got.DestCIDR != "" {
+		t.Errorf("expected no destination, got %s", got.DestCIDR)
+	}
+
+	egress := &FirewallRule{
+		ID: "fw_002", Port: 80, Proto: "tcp", Chain: "output", Direction: "out",
+		SourceCIDR: "0.0.0.0/0", DestCIDR: "169.254.169.254/32", Action: "deny", Enabled: true,
+	}
+	if err := fs.Create(egress); err != nil {
+		t.Fatalf("create egress rule: %v", err)
+	}
+	if got, _ := fs.Get("fw_002"); got == nil || got.Chain != "output" || got.DestCIDR != "169.254.169.254/32" {
+		t.Errorf("expected the output chain and destination back, got %+v", got)
+	}
+	if err := fs.Delete("fw_002"); err != nil {
+		t.Fatalf("delete egress rule: %v", err)
+	}
 
 	// List
 	all, err := fs.List()
@@ -89,6 +111,126 @@ func TestFirewallRuleListEnabled(t *testing.T) {
 	}
 }
 
+func TestFirewallRuleActiveHours(t *testing.T) {
+	db := setupTestDB(t)
+	fs := NewFirewallStore(db)
+
+	rule := &FirewallRule{ID: "fw_h1", Port: 8080, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0",
+		Action: "allow", Enabled: true, ActiveHours: "08:00-18:00"}
+	if err := fs.Create(rule); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	rule.ActiveHours = "22:00-06:00"
+	if err := fs.Update(rule); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if got, _ := fs.Get("fw_h1"); got == nil || got.ActiveHours != "22:00-06:00" {
+		t.Fatalf("expected the updated hours back, got %+v", got)
+	}
+
+	at := func(clock string) time.Time {
+		t, _ := time.Parse(time.DateTime, "2026-01-02 "+clock+":00")
+		return t
+	}
+	for _, tc := range []struct {
+		hours string
+		clock string
+		want  bool
+	}{
+		{"", "03:00", true},
+		{"08:00-18:00", "08:00", true},
+		{"08:00-18:00", "17:59", true},
+		{"08:00-18:00", "18:00", false},
+		{"08:00-18:00", "07:59", false},
+		{"22:00-06:00", "23:30", true},
+		{"22:00-06:00", "05:59", true},
+		{"22:00-06:00", "12:00", false},
+		{"00:00-24:00", "23:59", true},
+		{"8-18", "12:00", false},
+	} {
+		r := &FirewallRule{ActiveHours: tc.hours}
+		if got := r.InActiveHours(at(tc.clock)); got != tc.want {
+			t.Errorf("%q at %s: got %v, want %v", tc.hours, tc.clock, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"08:00", "8-18", "08:00-08:00", "25:00-26:00", "08:00-18:60"} {
+		if _, _, err := ParseActiveHours(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestFirewallRuleGroups(t *testing.T) {
+	db := setupTestDB(t)
+	fs := NewFirewallStore(db)
+
+	for _, id := range []string{"fw_g1", "fw_g2", "fw_g3"} {
+		fs.Create(&FirewallRule{ID: id, Port: 8080, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0",
+			Action: "allow", Enabled: true, Description: "web frontend", Group: "shop"})
+	}
+	rule, _ := fs.Get("fw_g3")
+	if rule == nil || rule.Description != "web frontend" || rule.Group != "shop" {
+		t.Fatalf("expected the description and group back, got %+v", rule)
+	}
+	rule.Description, rule.Group = "", "billing"
+	if err := fs.Update(rule); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if got, _ := fs.Get("fw_g3"); got.Description != "" || got.Group != "billing" {
+		t.Errorf("expected the updated notes back, got %+v", got)
+	}
+
+	// One missing rule deletes none of them
+	if err := fs.DeleteAll([]string{"fw_g1", "fw_missing"}); err == nil {
+		t.Error("expected an error for a missing rule")
+	}
+	if all, _ := fs.List(); len(all) != 3 {
+		t.Fatalf("expected no rule to be deleted, got %d left", len(all))
+	}
+	if err := fs.DeleteAll([]string{"fw_g1", "fw_g2"}); err != nil {
+		t.Fatalf("delete all: %v", err)
+	}
+	if all, _ := fs.List(); len(all) != 1 || all[0].ID != "fw_g3" {
+		t.Errorf("expected only fw_g3 left, got %+v", all)
+	}
+}
+
+func TestFirewallRuleCreateAll(t *testing.T) {
+	db := setupTestDB(t)
+	fs := NewFirewallStore(db)
+
+	if err := fs.Create(&FirewallRule{ID: "fw_b0", Name: "web", Port: 80, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A name in use creates none of them
+	err := fs.CreateAll([]*FirewallRule{
+		{ID: "fw_b1", Port: 8080, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true},
+		{ID: "fw_b2", Name: "web", Port: 8081, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true},
+	})
+	if !errors.Is(err, ErrNameInUse) {
+		t.Fatalf("expected ErrNameInUse, got %v", err)
+	}
+	if all, _ := fs.List(); len(all) != 1 {
+		t.Fatalf("expected no rule to be created, got %d rules", len(all))
+	}
+
+	rules := []*FirewallRule{
+		{ID: "fw_b1", Port: 8080, Proto: "tcp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "allow", Enabled: true},
+		{ID: "fw_b2", Port: 8081, Proto: "udp", Direction: "in", SourceCIDR: "0.0.0.0/0", Action: "deny", Enabled: true, Group: "bulk"},
+	}
+	if err := fs.CreateAll(rules); err != nil {
+		t.Fatalf("create all: %v", err)
+	}
+	if rules[1].CreatedAt.IsZero() || rules[1].Chain != "input" {
+		t.Errorf("expected the created rule to be filled in, got %+v", rules[1])
+	}
+	if got, err := fs.Get("fw_b2"); err != nil || got.Proto != "udp" || got.Group != "bulk" {
+		t.Errorf("unexpected rule %+v: %v", got, err)
+	}
+}
+
 func TestReconciliationState(t *testing.T) {
 	db := setupTestDB(t)
 	fs := NewFirewallStore(db)
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileStats describes the size of the database files.
+type FileStats struct {
+	FileBytes int64 // main database file
+	WALBytes  int64 // write-ahead log, emptied by checkpoints
+	PageSize  int64
+	Pages     int64 // pages in the database, free ones included
+	FreePages int64 // pages on the freelist, returned to the OS by Vacuum
+}
+
+// FreeBytes returns the space taken by free pages.
+func (s *FileStats) FreeBytes() int64 {
+	return s.FreePages * s.PageSize
+}
+
+// Stats returns the size of the database files. An in-memory database has
+// no files; its sizes come from the page counts.
+func (db *DB) Stats() (*FileStats, error) {
+	s := &FileStats{}
+	if err := db.conn.QueryRow(`PRAGMA page_size`).Scan(&s.PageSize); err != nil {
+		return nil, fmt.Errorf("read page size: %w", err)
+	}
+	if err := db.conn.QueryRow(`PRAGMA page_count`).Scan(&s.Pages); err != nil {
+		return nil, fmt.Errorf("read page count: %w", err)
+	}
+	if err := db.conn.QueryRow(`PRAGMA freelist_count`).Scan(&s.FreePages); err != nil {
+		return nil, fmt.Errorf("read freelist count: %w", err)
+	}
+	s.FileBytes = s.Pages * s.PageSize
+	if db.path == ":memory:" {
+		return s, nil
+	}
+	if fi, err := os.Stat(db.path); err == nil {
+		s.FileBytes = fi.Size()
+	}
+	if fi, err := os.Stat(db.path + "-wal"); err == nil {
+		s.WALBytes = fi.Size()
+	}
+	return s, nil
+}
+
+// Checkpoint is the outcome of a WAL checkpoint.
+type Checkpoint struct {
+	Busy         bool // a reader or writer kept the checkpoint from completing
+	LogFrames    int  // frames in the WAL
+	Checkpointed int  // frames copied into the database file
+}
+
+// Checkpoint copies the WAL into the database file and truncates it, so
+// the WAL does not keep growing between SQLite's automatic checkpoints.
+func (db *DB) Checkpoint() (*Checkpoint, error) {
+	var busy int
+	c := &Checkpoint{}
+	if err := db.conn.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &c.LogFrames, &c.Checkpointed); err != nil {
+		return nil, fmt.Errorf("wal checkpoint: %w", err)
+	}
+	c.Busy = busy != 0
+	return c, nil
+}
+
+// IntegrityCheck runs SQLite's integrity check and returns the problems it
+// found, none for a sound database.
+func (db *DB) IntegrityCheck() ([]string, error) {
+	rows, err := db.conn.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return nil, fmt.Errorf("integrity check: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, fmt.Errorf("scan integrity check: %w", err)
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// Vacuum returns the free pages left by deleted rows, such as pruned audit
+// entries, to the OS and reports how many bytes it freed. The first call
+// switches the database to incremental auto-vacuum, which takes one full
+// VACUUM; later calls only release the freelist.
+func (db *DB) Vacuum() (int64, error) {
+	before, err := db.Stats()
+	if err != nil {
+		return 0, err
+	}
+	var mode int
+	if err := db.conn.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return 0, fmt.Errorf("read auto_vacuum: %w", err)
+	}
+	const incremental = 2
+	if mode != incremental {
+		if _, err := db.conn.Exec(`PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+			return 0, fmt.Errorf("enable incremental auto_vacuum: %w", err)
+		}
+		if _, err := db.conn.Exec(`VACUUM`); err != nil {
+			return 0, fmt.Errorf("vacuum: %w", err)
+		}
+	} else if _, err := db.conn.Exec(`PRAGMA incremental_vacuum`); err != nil {
+		return 0, fmt.Errorf("incremental vacuum: %w", err)
+	}
+	after, err := db.Stats()
+	if err != nil {
+		return 0, err
+	}
+	return (before.Pages - after.Pages) * before.PageSize, nil
+}
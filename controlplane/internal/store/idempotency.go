@@ -0,0 +1,83 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// IdempotentResponse is a stored response to a request made with an
+// Idempotency-Key. Status is zero while the first request is still running.
+type IdempotentResponse struct {
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore keeps the responses to requests made with an
+// Idempotency-Key, so retries replay them.
+type IdempotencyStore struct {
+	db *sql.DB
+}
+
+// NewIdempotencyStore creates an IdempotencyStore using the given DB.
+func NewIdempotencyStore(db *DB) *IdempotencyStore {
+	return &IdempotencyStore{db: db.Conn()}
+}
+
+// Reserve claims key within scope for a request with the given hash. It
+// returns nil if the key was free (or had expired) and is now reserved, or
+// the existing entry otherwise, leaving it to the caller to compare hashes.
+// Entries older than ttl are purged first.
+func (s *IdempotencyStore) Reserve(scope, key, requestHash string, now time.Time, ttl time.Duration) (*IdempotentResponse, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, now.Add(-ttl).Unix()); err != nil {
+		return nil, fmt.Errorf("purge idempotency keys: %w", err)
+	}
+
+	var (
+		existing    IdempotentResponse
+		contentType sql.NullString
+	)
+	err = tx.QueryRow(`SELECT request_hash, status, content_type, body FROM idempotency_keys
+		WHERE scope = ? AND key = ?`, scope, key).
+		Scan(&existing.RequestHash, &existing.Status, &contentType, &existing.Body)
+	switch {
+	case err == nil:
+		existing.ContentType = contentType.String
+		return &existing, nil
+	case err != sql.ErrNoRows:
+		return nil, fmt.Errorf("get idempotency key: %w", err)
+	}
+
+	if _, err := tx.Exec(`INSERT INTO idempotency_keys (scope, key, request_hash, created_at) VALUES (?, ?, ?, ?)`,
+		scope, key, requestHash, now.Unix()); err != nil {
+		return nil, fmt.Errorf("reserve idempotency key: %w", err)
+	}
+	return nil, tx.Commit()
+}
+
+// Complete stores the response for a reserved key.
+func (s *IdempotencyStore) Complete(scope, key string, status int, contentType string, body []byte) error {
+	_, err := s.db.Exec(`UPDATE idempotency_keys SET status = ?, content_type = ?, body = ?
+		WHERE scope = ? AND key = ?`, status, nullString(contentType), body, scope, key)
+	if err != nil {
+		return fmt.Errorf("complete idempotency key: %w", err)
+	}
+	return nil
+}
+
+// Release drops a reservation so the request can be retried.
+func (s *IdempotencyStore) Release(scope, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE scope = ? AND key = ?`, scope, key)
+	if err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
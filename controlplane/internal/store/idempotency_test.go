@@ -0,0 +1,48 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyLifecycle(t *testing.T) {
+	db := setupTestDB(t)
+	is := NewIdempotencyStore(db)
+	now := time.Now()
+
+	existing, err := is.Reserve("cn|", "k1", "hash-a", now, time.Hour)
+	if err != nil || existing != nil {
+		t.Fatalf("expected fresh reservation, got %+v, %v", existing, err)
+	}
+
+	// In flight: status 0
+	existing, err = is.Reserve("cn|", "k1", "hash-a", now, time.Hour)
+	if err != nil || existing == nil || existing.Status != 0 {
+		t.Fatalf("expected in-flight entry, got %+v, %v", existing, err)
+	}
+
+	if err := is.Complete("cn|", "k1", 201, "application/json", []byte(`{"id":"x"}`)); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	existing, _ = is.Reserve("cn|", "k1", "hash-a", now, time.Hour)
+	if existing == nil || existing.Status != 201 || string(existing.Body) != `{"id":"x"}` || existing.RequestHash != "hash-a" {
+		t.Fatalf("unexpected stored response: %+v", existing)
+	}
+
+	// Keys are scoped
+	if existing, _ := is.Reserve("other|", "k1", "hash-b", now, time.Hour); existing != nil {
+		t.Errorf("expected key to be free in another scope, got %+v", existing)
+	}
+
+	// Expired entries are replaced
+	if existing, _ := is.Reserve("cn|", "k1", "hash-c", now.Add(2*time.Hour), time.Hour); existing != nil {
+		t.Errorf("expected expired key to be reusable, got %+v", existing)
+	}
+
+	if err := is.Release("cn|", "k1"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if existing, _ := is.Reserve("cn|", "k1", "hash-d", now.Add(2*time.Hour), time.Hour); existing != nil {
+		t.Errorf("expected released key to be free, got %+v", existing)
+	}
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LeaseStore provides time-bound named locks shared by every control plane
+// instance using the database, for leader election.
+type LeaseStore struct {
+	db *sql.DB
+}
+
+// NewLeaseStore creates a LeaseStore using the given DB.
+func NewLeaseStore(db *DB) *LeaseStore {
+	return &LeaseStore{db: db.Conn()}
+}
+
+// Acquire takes the lease for holder until now+ttl if it is free, expired,
+// or already held by holder, and reports whether holder now holds it.
+func (s *LeaseStore) Acquire(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	_, err := s.db.Exec(`INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at <= ?`,
+		name, holder, now.Add(ttl).Unix(), now.Unix())
+	if err != nil {
+		return false, fmt.Errorf("acquire lease: %w", err)
+	}
+	current, _, err := s.Holder(name, now)
+	if err != nil {
+		return false, err
+	}
+	return current == holder, nil
+}
+
+// Release gives up the lease if holder holds it, so another instance can
+// take over without waiting for it to expire.
+func (s *LeaseStore) Release(name, holder string) error {
+	if _, err := s.db.Exec(`DELETE FROM leases WHERE name = ? AND holder = ?`, name, holder); err != nil {
+		return fmt.Errorf("release lease: %w", err)
+	}
+	return nil
+}
+
+// Holder returns who holds the lease at now and until when, or "" if it is
+// free or expired.
+func (s *LeaseStore) Holder(name string, now time.Time) (string, time.Time, error) {
+	var holder string
+	var expiresAt int64
+	err := s.db.QueryRow(`SELECT holder, expires_at FROM leases WHERE name = ? AND expires_at > ?`,
+		name, now.Unix()).Scan(&holder, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("get lease: %w", err)
+	}
+	return holder, time.Unix(expiresAt, 0), nil
+}
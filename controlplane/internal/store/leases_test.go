@@ -0,0 +1,37 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeases(t *testing.T) {
+	db := setupTestDB(t)
+	ls := NewLeaseStore(db)
+	now := time.Unix(1700000000, 0)
+
+	if ok, err := ls.Acquire("leader", "a", now, 15*time.Second); err != nil || !ok {
+		t.Fatalf("expected a to acquire a free lease, got %v %v", ok, err)
+	}
+	if ok, _ := ls.Acquire("leader", "b", now.Add(5*time.Second), 15*time.Second); ok {
+		t.Fatal("b must not take a lease a holds")
+	}
+	// Renewal extends the lease
+	ls.Acquire("leader", "a", now.Add(10*time.Second), 15*time.Second)
+	if holder, until, _ := ls.Holder("leader", now.Add(20*time.Second)); holder != "a" || !until.Equal(now.Add(25*time.Second)) {
+		t.Errorf("expected a to hold the lease until +25s, got %q %v", holder, until)
+	}
+
+	// Once it expires, b takes over
+	if ok, _ := ls.Acquire("leader", "b", now.Add(25*time.Second), 15*time.Second); !ok {
+		t.Fatal("expected b to take over the expired lease")
+	}
+	ls.Release("leader", "a") // no longer a's to release
+	if holder, _, _ := ls.Holder("leader", now.Add(26*time.Second)); holder != "b" {
+		t.Errorf("expected b to hold the lease, got %q", holder)
+	}
+	ls.Release("leader", "b")
+	if holder, _, _ := ls.Holder("leader", now.Add(26*time.Second)); holder != "" {
+		t.Errorf("expected released lease to be free, got %q", holder)
+	}
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Maintenance is the read-only maintenance mode, kept in the database so it
+// survives restarts and applies to every instance sharing it.
+type Maintenance struct {
+	Enabled   bool
+	Message   string     // shown to clients whose changes are refused
+	UpdatedBy string     // client CN that last toggled the mode
+	UpdatedAt *time.Time // nil until the mode is first toggled
+}
+
+// GetMaintenance reads the maintenance mode.
+func (s *FirewallStore) GetMaintenance() (*Maintenance, error) {
+	var (
+		m                  Maintenance
+		message, updatedBy sql.NullString
+		updatedAt          sql.NullInt64
+	)
+	err := s.db.QueryRow(`SELECT enabled, message, updated_by, updated_at FROM maintenance WHERE id = 1`).
+		Scan(&m.Enabled, &message, &updatedBy, &updatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("scan maintenance: %w", err)
+	}
+	m.Message = message.String
+	m.UpdatedBy = updatedBy.String
+	if updatedAt.Valid {
+		t := time.Unix(updatedAt.Int64, 0)
+		m.UpdatedAt = &t
+	}
+	return &m, nil
+}
+
+// SetMaintenance turns the maintenance mode on or off, recording who did it.
+func (s *FirewallStore) SetMaintenance(enabled bool, message, updatedBy string) error {
+	_, err := s.db.Exec(`UPDATE maintenance SET enabled = ?, message = ?, updated_by = ?, updated_at = ? WHERE id = 1`,
+		enabled, nullString(message), nullString(updatedBy), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("update maintenance: %w", err)
+	}
+	return nil
+}
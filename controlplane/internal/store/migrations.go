@@ -0,0 +1,1026 @@
+package store
+
+// migrations is the schema history, oldest first. Each entry is applied
+// once, in its own transaction together with its schema_version row, so a
+// failure leaves the database at the previous version. Append new
+// migrations at the end with the next version and a down that undoes
+// them; never edit or reorder applied ones.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS wg_peers (
+				id                          TEXT PRIMARY KEY,
+				public_key                  TEXT NOT NULL UNIQUE,
+				vpn_ip                      TEXT NOT NULL UNIQUE,
+				psk_hash                    TEXT,
+				endpoint                    TEXT,
+				domains                     TEXT,
+				enabled                     INTEGER NOT NULL DEFAULT 1,
+				last_handshake              INTEGER,
+				tx_bytes                    INTEGER DEFAULT 0,
+				rx_bytes                    INTEGER DEFAULT 0,
+				auto_rotate_psk             INTEGER NOT NULL DEFAULT 0,
+				psk_rotation_interval_days  INTEGER NOT NULL DEFAULT 0,
+				auto_revoke_inactive        INTEGER NOT NULL DEFAULT 1,
+				inactive_expiry_days        INTEGER NOT NULL DEFAULT 90,
+				grace_period_minutes        INTEGER NOT NULL DEFAULT 30,
+				last_rotation_at            INTEGER,
+				pending_rotation_id         TEXT,
+				created_at                  INTEGER NOT NULL,
+				updated_at                  INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS l4_routes (
+				id          TEXT PRIMARY KEY,
+				tunnel_id   TEXT NOT NULL REFERENCES wg_peers(id),
+				listen_port INTEGER NOT NULL DEFAULT 443,
+				match_type  TEXT NOT NULL DEFAULT 'sni',
+				match_value TEXT NOT NULL,
+				upstream    TEXT NOT NULL,
+				caddy_id    TEXT NOT NULL,
+				enabled     INTEGER NOT NULL DEFAULT 1,
+				created_at  INTEGER NOT NULL,
+				updated_at  INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS firewall_rules (
+				id          TEXT PRIMARY KEY,
+				port        INTEGER NOT NULL CHECK (port BETWEEN 1 AND 65535),
+				proto       TEXT NOT NULL CHECK (proto IN ('tcp', 'udp')),
+				direction   TEXT NOT NULL DEFAULT 'in' CHECK (direction IN ('in', 'out')),
+				source_cidr TEXT NOT NULL DEFAULT '0.0.0.0/0',
+				action      TEXT NOT NULL DEFAULT 'allow' CHECK (action IN ('allow', 'deny')),
+				enabled     INTEGER NOT NULL DEFAULT 1,
+				created_at  INTEGER NOT NULL,
+				updated_at  INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS reconciliation_state (
+				id                  INTEGER PRIMARY KEY DEFAULT 1,
+				interval_seconds    INTEGER NOT NULL DEFAULT 30,
+				last_run_at         INTEGER,
+				last_status         TEXT DEFAULT 'pending',
+				last_error          TEXT,
+				drift_corrections   INTEGER DEFAULT 0,
+				CHECK (id = 1)
+			)`,
+			`INSERT OR IGNORE INTO reconciliation_state (id, interval_seconds, last_status, drift_corrections) VALUES (1, 30, 'pending', 0)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS l4_routes`,
+			`DROP TABLE IF EXISTS firewall_rules`,
+			`DROP TABLE IF EXISTS reconciliation_state`,
+			`DROP TABLE IF EXISTS wg_peers`,
+		},
+	},
+	{
+		version: 2,
+		name:    "add protocol column for port-forward routes",
+		up: []string{
+			`ALTER TABLE l4_routes ADD COLUMN protocol TEXT NOT NULL DEFAULT 'tcp' CHECK (protocol IN ('tcp', 'udp'))`,
+			`CREATE TABLE IF NOT EXISTS audit_log (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				timestamp   INTEGER NOT NULL,
+				client_cn   TEXT,
+				source_ip   TEXT,
+				method      TEXT NOT NULL,
+				path        TEXT NOT NULL,
+				body_hash   TEXT,
+				result      TEXT NOT NULL,
+				error_msg   TEXT
+			)`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN protocol`,
+			`DROP TABLE IF EXISTS audit_log`,
+		},
+	},
+	{
+		version: 3,
+		name:    "add labels column (JSON object) for tunnel grouping",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN labels TEXT NOT NULL DEFAULT '{}'`,
+			`CREATE TABLE IF NOT EXISTS tenants (
+				id          TEXT PRIMARY KEY,
+				name        TEXT NOT NULL UNIQUE,
+				client_cn   TEXT UNIQUE,
+				token_hash  TEXT UNIQUE,
+				created_at  INTEGER NOT NULL,
+				updated_at  INTEGER NOT NULL
+			)`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN labels`,
+			`DROP TABLE IF EXISTS tenants`,
+		},
+	},
+	{
+		version: 4,
+		name:    "scope resources to tenants (NULL = unowned, admin-only)",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN tenant_id TEXT`,
+			`ALTER TABLE l4_routes ADD COLUMN tenant_id TEXT`,
+			`ALTER TABLE firewall_rules ADD COLUMN tenant_id TEXT`,
+			`ALTER TABLE tenants ADD COLUMN token_scope TEXT NOT NULL DEFAULT 'operator'`,
+			`CREATE TABLE IF NOT EXISTS peer_stats_history (
+				peer_id     TEXT NOT NULL REFERENCES wg_peers(id) ON DELETE CASCADE,
+				sampled_at  INTEGER NOT NULL,
+				rx_bytes    INTEGER NOT NULL,
+				tx_bytes    INTEGER NOT NULL,
+				PRIMARY KEY (peer_id, sampled_at)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_peer_stats_history_sampled_at ON peer_stats_history (sampled_at)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS peer_stats_history`,
+			`ALTER TABLE tenants DROP COLUMN token_scope`,
+			`ALTER TABLE firewall_rules DROP COLUMN tenant_id`,
+			`ALTER TABLE l4_routes DROP COLUMN tenant_id`,
+			`ALTER TABLE wg_peers DROP COLUMN tenant_id`,
+		},
+	},
+	{
+		version: 5,
+		name:    "inactivity warnings and revocation deferral",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN revoke_deferred_until INTEGER`,
+			`ALTER TABLE wg_peers ADD COLUMN expiry_warned_at INTEGER`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN expiry_warned_at`,
+			`ALTER TABLE wg_peers DROP COLUMN revoke_deferred_until`,
+		},
+	},
+	{
+		version: 6,
+		name:    "endpoint history and source restriction",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN source_cidr TEXT`,
+			`CREATE TABLE IF NOT EXISTS peer_endpoint_history (
+				peer_id     TEXT NOT NULL REFERENCES wg_peers(id) ON DELETE CASCADE,
+				endpoint    TEXT NOT NULL,
+				seen_at     INTEGER NOT NULL,
+				PRIMARY KEY (peer_id, seen_at)
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS peer_endpoint_history`,
+			`ALTER TABLE wg_peers DROP COLUMN source_cidr`,
+		},
+	},
+	{
+		version: 7,
+		name:    "PROXY protocol on routes",
+		up: []string{
+			`ALTER TABLE l4_routes ADD COLUMN proxy_protocol TEXT`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN proxy_protocol`,
+		},
+	},
+	{
+		version: 8,
+		name:    "paired QUIC (UDP/443) forwarding on SNI routes",
+		up: []string{
+			`ALTER TABLE l4_routes ADD COLUMN quic INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN quic`,
+		},
+	},
+	{
+		version: 9,
+		name:    "route priority",
+		up: []string{
+			`ALTER TABLE l4_routes ADD COLUMN priority INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN priority`,
+		},
+	},
+	{
+		version: 10,
+		name:    "TLS termination in Caddy for SNI routes",
+		up: []string{
+			`ALTER TABLE l4_routes ADD COLUMN terminate_tls INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN terminate_tls`,
+		},
+	},
+	{
+		version: 11,
+		name:    "idempotency keys for retried POSTs",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+				scope        TEXT NOT NULL,
+				key          TEXT NOT NULL,
+				request_hash TEXT NOT NULL,
+				status       INTEGER NOT NULL DEFAULT 0,
+				content_type TEXT,
+				body         BLOB,
+				created_at   INTEGER NOT NULL,
+				PRIMARY KEY (scope, key)
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS idempotency_keys`,
+		},
+	},
+	{
+		version: 12,
+		name:    "port ranges on port-forward routes",
+		up: []string{
+			`ALTER TABLE l4_routes ADD COLUMN listen_port_end INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN listen_port_end`,
+		},
+	},
+	{
+		version: 13,
+		name:    "automatic bans of abusive source IPs",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS firewall_bans (
+				ip         TEXT PRIMARY KEY,
+				reason     TEXT NOT NULL,
+				hits       INTEGER NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS firewall_bans`,
+		},
+	},
+	{
+		version: 14,
+		name:    "firewall rules on the WireGuard forward chain",
+		up: []string{
+			`ALTER TABLE firewall_rules ADD COLUMN chain TEXT NOT NULL DEFAULT 'input'`,
+		},
+		down: []string{
+			`DELETE FROM firewall_rules WHERE chain != 'input'`,
+			`ALTER TABLE firewall_rules DROP COLUMN chain`,
+		},
+	},
+	{
+		version: 15,
+		name:    "per-tunnel inter-peer isolation",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN isolate INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN isolate`,
+		},
+	},
+	{
+		version: 16,
+		name:    "redacted request bodies and resource diffs in the audit log",
+		up: []string{
+			`ALTER TABLE audit_log ADD COLUMN request_body TEXT`,
+			`ALTER TABLE audit_log ADD COLUMN diff TEXT`,
+			`CREATE TABLE IF NOT EXISTS leases (
+				name       TEXT PRIMARY KEY,
+				holder     TEXT NOT NULL,
+				expires_at INTEGER NOT NULL
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS leases`,
+			`ALTER TABLE audit_log DROP COLUMN diff`,
+			`ALTER TABLE audit_log DROP COLUMN request_body`,
+		},
+	},
+	{
+		version: 17,
+		name:    "remote data-plane nodes managed through agents",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS nodes (
+				id            TEXT PRIMARY KEY,
+				name          TEXT NOT NULL UNIQUE,
+				client_cn     TEXT NOT NULL UNIQUE,
+				wg_public_key TEXT,
+				endpoint      TEXT,
+				agent_version TEXT,
+				last_seen_at  INTEGER,
+				last_error    TEXT,
+				created_at    INTEGER NOT NULL,
+				updated_at    INTEGER NOT NULL
+			)`,
+			`ALTER TABLE wg_peers ADD COLUMN node_id TEXT`,
+			`ALTER TABLE wg_peers ADD COLUMN pending_psk TEXT`,
+			`ALTER TABLE l4_routes ADD COLUMN node_id TEXT`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN node_id`,
+			`ALTER TABLE wg_peers DROP COLUMN pending_psk`,
+			`ALTER TABLE wg_peers DROP COLUMN node_id`,
+			`DROP TABLE IF EXISTS nodes`,
+		},
+	},
+	{
+		version: 18,
+		name:    "standby nodes that also serve a tunnel and its routes",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN failover_node_ids TEXT`,
+			`ALTER TABLE wg_peers ADD COLUMN pending_psk_acks TEXT`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN pending_psk_acks`,
+			`ALTER TABLE wg_peers DROP COLUMN failover_node_ids`,
+		},
+	},
+	{
+		version: 19,
+		name:    "peer connect/disconnect events",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS peer_events (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				peer_id     TEXT NOT NULL REFERENCES wg_peers(id) ON DELETE CASCADE,
+				type        TEXT NOT NULL CHECK (type IN ('connected', 'disconnected')),
+				endpoint    TEXT,
+				at          INTEGER NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_peer_events_peer ON peer_events(peer_id, id)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS peer_events`,
+		},
+	},
+	{
+		version: 20,
+		name:    "per-tunnel keepalive and connected threshold (seconds; NULL = global default)",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN persistent_keepalive INTEGER`,
+			`ALTER TABLE wg_peers ADD COLUMN connected_threshold INTEGER`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN connected_threshold`,
+			`ALTER TABLE wg_peers DROP COLUMN persistent_keepalive`,
+		},
+	},
+	{
+		version: 21,
+		name:    "which destinations a tunnel's client config routes through it",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN client_routing TEXT`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN client_routing`,
+		},
+	},
+	{
+		version: 22,
+		name:    "DNS (JSON list; NULL = default) and MTU of a tunnel's client configs",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN client_dns TEXT`,
+			`ALTER TABLE wg_peers ADD COLUMN client_mtu INTEGER`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN client_mtu`,
+			`ALTER TABLE wg_peers DROP COLUMN client_dns`,
+		},
+	},
+	{
+		version: 23,
+		name:    "LAN prefixes a peer routes for (JSON list of CIDRs)",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN advertised_routes TEXT`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN advertised_routes`,
+		},
+	},
+	{
+		version: 24,
+		name:    "allocated VPN IPs, one row per tunnel address",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS ip_allocations (
+				ip           TEXT PRIMARY KEY,
+				tunnel_id    TEXT NOT NULL REFERENCES wg_peers(id) ON DELETE CASCADE,
+				allocated_at INTEGER NOT NULL
+			)`,
+			`INSERT OR IGNORE INTO ip_allocations (ip, tunnel_id, allocated_at)
+				SELECT vpn_ip, id, created_at FROM wg_peers`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS ip_allocations`,
+		},
+	},
+	{
+		version: 25,
+		name:    "soft-deleted tunnels keep their row, with a JSON snapshot of their routes",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN deleted_at INTEGER`,
+			`ALTER TABLE wg_peers ADD COLUMN deleted_routes TEXT`,
+		},
+		down: []string{
+			`DELETE FROM wg_peers WHERE deleted_at IS NOT NULL`,
+			`ALTER TABLE wg_peers DROP COLUMN deleted_routes`,
+			`ALTER TABLE wg_peers DROP COLUMN deleted_at`,
+		},
+	},
+	{
+		version: 26,
+		name:    "API rate limit buckets saved across restarts",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS rate_limits (
+				scope      TEXT NOT NULL,
+				key        TEXT NOT NULL,
+				tokens     REAL NOT NULL,
+				updated_at INTEGER NOT NULL,
+				PRIMARY KEY (scope, key)
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS rate_limits`,
+		},
+	},
+	{
+		version: 27,
+		name:    "one row per reconciliation pass with its operation counts",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS reconcile_runs (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				started_at  INTEGER NOT NULL,
+				duration_ms INTEGER NOT NULL,
+				status      TEXT NOT NULL,
+				error       TEXT,
+				attempted   INTEGER NOT NULL,
+				succeeded   INTEGER NOT NULL,
+				failed      INTEGER NOT NULL,
+				subsystems  TEXT NOT NULL  -- JSON object of per-subsystem counts
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS reconcile_runs`,
+		},
+	},
+	{
+		version: 28,
+		name:    "read-only maintenance mode, a singleton row",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS maintenance (
+				id         INTEGER PRIMARY KEY DEFAULT 1,
+				enabled    INTEGER NOT NULL DEFAULT 0,
+				message    TEXT,
+				updated_by TEXT,
+				updated_at INTEGER,
+				CHECK (id = 1)
+			)`,
+			`INSERT OR IGNORE INTO maintenance (id, enabled) VALUES (1, 0)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS maintenance`,
+		},
+	},
+	{
+		// A soft-deleted tunnel keeps its name until it is purged.
+		version: 29,
+		name:    "caller-supplied names, unique per tenant",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN name TEXT`,
+			`ALTER TABLE l4_routes ADD COLUMN name TEXT`,
+			`ALTER TABLE firewall_rules ADD COLUMN name TEXT`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_wg_peers_name ON wg_peers (IFNULL(tenant_id, ''), name) WHERE name IS NOT NULL`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_l4_routes_name ON l4_routes (IFNULL(tenant_id, ''), name) WHERE name IS NOT NULL`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_firewall_rules_name ON firewall_rules (IFNULL(tenant_id, ''), name) WHERE name IS NOT NULL`,
+		},
+		down: []string{
+			`DROP INDEX IF EXISTS idx_firewall_rules_name`,
+			`DROP INDEX IF EXISTS idx_l4_routes_name`,
+			`DROP INDEX IF EXISTS idx_wg_peers_name`,
+			`ALTER TABLE firewall_rules DROP COLUMN name`,
+			`ALTER TABLE l4_routes DROP COLUMN name`,
+			`ALTER TABLE wg_peers DROP COLUMN name`,
+		},
+	},
+	{
+		version: 30,
+		name:    "whether the server generated the tunnel's key pair (Flow A)",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN server_key INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN server_key`,
+		},
+	},
+	{
+		version: 31,
+		name:    "free-form notes on who and what a tunnel's peer is",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN description TEXT`,
+			`ALTER TABLE wg_peers ADD COLUMN owner_email TEXT`,
+			`ALTER TABLE wg_peers ADD COLUMN device_name TEXT`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN device_name`,
+			`ALTER TABLE wg_peers DROP COLUMN owner_email`,
+			`ALTER TABLE wg_peers DROP COLUMN description`,
+		},
+	},
+	{
+		version: 32,
+		name:    "date a tunnel's access ends, and when its expiry warning was sent",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN expires_at INTEGER`,
+			`ALTER TABLE wg_peers ADD COLUMN expires_warned_at INTEGER`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN expires_warned_at`,
+			`ALTER TABLE wg_peers DROP COLUMN expires_at`,
+		},
+	},
+	{
+		version: 33,
+		name:    "tunnels waiting for an admin to approve their creation",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN pending_approval INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN pending_approval`,
+		},
+	},
+	{
+		version: 34,
+		name:    "latest latency probes of each peer (rtt_us NULL = lost)",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS peer_probe_samples (
+				peer_id   TEXT NOT NULL REFERENCES wg_peers(id) ON DELETE CASCADE,
+				probed_at INTEGER NOT NULL,
+				rtt_us    INTEGER,
+				PRIMARY KEY (peer_id, probed_at)
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS peer_probe_samples`,
+		},
+	},
+	{
+		version: 35,
+		name:    "connection counts and cumulative bytes of routes' upstream connections",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS route_stats_history (
+				route_id     TEXT NOT NULL REFERENCES l4_routes(id) ON DELETE CASCADE,
+				sampled_at   INTEGER NOT NULL,
+				active_conns INTEGER NOT NULL,
+				rx_bytes     INTEGER NOT NULL,
+				tx_bytes     INTEGER NOT NULL,
+				PRIMARY KEY (route_id, sampled_at)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_route_stats_history_sampled_at ON route_stats_history (sampled_at)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS route_stats_history`,
+		},
+	},
+	{
+		version: 36,
+		name:    "routes the reconciler deletes once their TTL runs out",
+		up: []string{
+			`ALTER TABLE l4_routes ADD COLUMN expires_at INTEGER`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN expires_at`,
+		},
+	},
+	{
+		version: 37,
+		name:    "API client certificates issued by the embedded CA",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS client_certs (
+				serial              TEXT PRIMARY KEY,
+				common_name         TEXT NOT NULL,
+				organizational_unit TEXT,
+				issued_by           TEXT,
+				not_before          INTEGER NOT NULL,
+				not_after           INTEGER NOT NULL,
+				created_at          INTEGER NOT NULL,
+				revoked_at          INTEGER,
+				revocation_reason   TEXT
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS client_certs`,
+		},
+	},
+	{
+		version: 38,
+		name:    "tunnels and routes adopted from existing WireGuard and Caddy state",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN imported INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE l4_routes ADD COLUMN imported INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE l4_routes DROP COLUMN imported`,
+			`ALTER TABLE wg_peers DROP COLUMN imported`,
+		},
+	},
+	{
+		version: 39,
+		name:    "keys of deleted tunnels, whose peers stay ours to remove",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS retired_peer_keys (
+				public_key TEXT PRIMARY KEY,
+				retired_at INTEGER NOT NULL
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS retired_peer_keys`,
+		},
+	},
+	{
+		// The policy with tenant_id '' is global.
+		version: 40,
+		name:    "admin-managed policies on domains, ports, and CIDRs",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS policies (
+				tenant_id       TEXT PRIMARY KEY,
+				domain_suffixes TEXT NOT NULL, -- JSON array
+				port_ranges     TEXT NOT NULL, -- JSON array of {start, end}
+				forbidden_cidrs TEXT NOT NULL, -- JSON array
+				updated_by      TEXT,
+				updated_at      INTEGER NOT NULL
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS policies`,
+		},
+	},
+	{
+		// sni_domains is kept in step with l4_routes by triggers so concurrent
+		// creates cannot both claim a domain. Routes that already shared a
+		// domain keep it; the oldest holds the claim.
+		version: 41,
+		name:    "one route per SNI domain",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS sni_domains (
+				domain   TEXT PRIMARY KEY,
+				route_id TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_sni_domains_route ON sni_domains (route_id)`,
+			`INSERT OR IGNORE INTO sni_domains (domain, route_id)
+				SELECT lower(j.value), r.id FROM l4_routes r, json_each(r.match_value) j
+				WHERE r.match_type = 'sni' ORDER BY r.created_at ASC`,
+			`CREATE TRIGGER IF NOT EXISTS l4_routes_sni_insert AFTER INSERT ON l4_routes
+				WHEN NEW.match_type = 'sni'
+			BEGIN
+				INSERT INTO sni_domains (domain, route_id)
+					SELECT DISTINCT lower(value), NEW.id FROM json_each(NEW.match_value);
+			END`,
+			`CREATE TRIGGER IF NOT EXISTS l4_routes_sni_delete AFTER DELETE ON l4_routes
+				WHEN OLD.match_type = 'sni'
+			BEGIN
+				DELETE FROM sni_domains WHERE route_id = OLD.id;
+			END`,
+		},
+		down: []string{
+			`DROP TRIGGER IF EXISTS l4_routes_sni_insert`,
+			`DROP TRIGGER IF EXISTS l4_routes_sni_delete`,
+			`DROP TABLE IF EXISTS sni_domains`,
+		},
+	},
+	{
+		// SNI routes had @ids made of the tunnel and port, which two routes
+		// could share. Old untagged IDs are kept so the reconciler still
+		// removes them.
+		version: 42,
+		name:    "Caddy @ids derived from the route ID",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS retired_caddy_ids (
+				caddy_id   TEXT PRIMARY KEY,
+				retired_at INTEGER NOT NULL
+			)`,
+			`INSERT OR IGNORE INTO retired_caddy_ids (caddy_id, retired_at)
+				SELECT caddy_id, CAST(strftime('%s', 'now') AS INTEGER) FROM l4_routes
+				WHERE match_type = 'sni' AND imported = 0 AND caddy_id != '' AND caddy_id NOT LIKE 'pm-%'`,
+			`UPDATE l4_routes SET caddy_id = 'pm-route-' || id
+				WHERE match_type = 'sni' AND imported = 0 AND caddy_id != 'pm-route-' || id`,
+			`UPDATE wg_peers SET deleted_routes = (
+				SELECT json_group_array(CASE
+					WHEN json_extract(j.value, '$.MatchType') = 'sni' AND NOT json_extract(j.value, '$.Imported')
+					THEN json_set(j.value, '$.CaddyID', 'pm-route-' || json_extract(j.value, '$.ID'))
+					ELSE json(j.value) END)
+				FROM json_each(deleted_routes) j)
+			WHERE deleted_routes IS NOT NULL AND deleted_routes != '' AND EXISTS (
+				SELECT 1 FROM json_each(deleted_routes) j
+				WHERE json_extract(j.value, '$.MatchType') = 'sni' AND NOT json_extract(j.value, '$.Imported')
+					AND json_extract(j.value, '$.CaddyID') != 'pm-route-' || json_extract(j.value, '$.ID'))`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS retired_caddy_ids`,
+		},
+	},
+	{
+		// Bumped by triggers on every write so cached listings know when
+		// they are stale, whichever connection made the change.
+		version: 43,
+		name:    "table versions",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS table_versions (
+				name    TEXT PRIMARY KEY,
+				version INTEGER NOT NULL DEFAULT 0
+			)`,
+			`INSERT OR IGNORE INTO table_versions (name) VALUES ('wg_peers'), ('l4_routes'), ('firewall_rules')`,
+			`CREATE TRIGGER IF NOT EXISTS wg_peers_version_insert AFTER INSERT ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+			`CREATE TRIGGER IF NOT EXISTS wg_peers_version_update AFTER UPDATE ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+			`CREATE TRIGGER IF NOT EXISTS wg_peers_version_delete AFTER DELETE ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+			`CREATE TRIGGER IF NOT EXISTS l4_routes_version_insert AFTER INSERT ON l4_routes
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'l4_routes'; END`,
+			`CREATE TRIGGER IF NOT EXISTS l4_routes_version_update AFTER UPDATE ON l4_routes
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'l4_routes'; END`,
+			`CREATE TRIGGER IF NOT EXISTS l4_routes_version_delete AFTER DELETE ON l4_routes
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'l4_routes'; END`,
+			`CREATE TRIGGER IF NOT EXISTS firewall_rules_version_insert AFTER INSERT ON firewall_rules
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'firewall_rules'; END`,
+			`CREATE TRIGGER IF NOT EXISTS firewall_rules_version_update AFTER UPDATE ON firewall_rules
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'firewall_rules'; END`,
+			`CREATE TRIGGER IF NOT EXISTS firewall_rules_version_delete AFTER DELETE ON firewall_rules
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'firewall_rules'; END`,
+		},
+		down: []string{
+			`DROP TRIGGER IF EXISTS wg_peers_version_insert`,
+			`DROP TRIGGER IF EXISTS wg_peers_version_update`,
+			`DROP TRIGGER IF EXISTS wg_peers_version_delete`,
+			`DROP TRIGGER IF EXISTS l4_routes_version_insert`,
+			`DROP TRIGGER IF EXISTS l4_routes_version_update`,
+			`DROP TRIGGER IF EXISTS l4_routes_version_delete`,
+			`DROP TRIGGER IF EXISTS firewall_rules_version_insert`,
+			`DROP TRIGGER IF EXISTS firewall_rules_version_update`,
+			`DROP TRIGGER IF EXISTS firewall_rules_version_delete`,
+			`DROP TABLE IF EXISTS table_versions`,
+		},
+	},
+	{
+		version: 44,
+		name:    "drift observed without correction",
+		up: []string{
+			`ALTER TABLE reconcile_runs ADD COLUMN observed INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE reconcile_runs DROP COLUMN observed`,
+		},
+	},
+	{
+		version: 45,
+		name:    "startup report",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS startup_report (
+				id              INTEGER PRIMARY KEY CHECK (id = 1),
+				started_at      INTEGER NOT NULL, -- unix ms
+				duration_ms     INTEGER NOT NULL,
+				mode            TEXT NOT NULL,
+				previous_status TEXT NOT NULL,
+				previous_run_at INTEGER,
+				status          TEXT NOT NULL,
+				error           TEXT,
+				attempted       INTEGER NOT NULL,
+				succeeded       INTEGER NOT NULL,
+				failed          INTEGER NOT NULL,
+				observed        INTEGER NOT NULL,
+				subsystems      TEXT NOT NULL -- JSON
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS startup_report`,
+		},
+	},
+	{
+		version: 46,
+		name:    "firewall rule destinations and the output chain",
+		up: []string{
+			`ALTER TABLE firewall_rules ADD COLUMN dest_cidr TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`DELETE FROM firewall_rules WHERE chain = 'output' OR dest_cidr != ''`,
+			`ALTER TABLE firewall_rules DROP COLUMN dest_cidr`,
+		},
+	},
+	{
+		version: 47,
+		name:    "firewall rule active hours",
+		up: []string{
+			`ALTER TABLE firewall_rules ADD COLUMN active_hours TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`DELETE FROM firewall_rules WHERE active_hours != ''`,
+			`ALTER TABLE firewall_rules DROP COLUMN active_hours`,
+		},
+	},
+	{
+		version: 48,
+		name:    "firewall rule descriptions and groups",
+		up: []string{
+			`ALTER TABLE firewall_rules ADD COLUMN description TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE firewall_rules ADD COLUMN rule_group TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE firewall_rules DROP COLUMN rule_group`,
+			`ALTER TABLE firewall_rules DROP COLUMN description`,
+		},
+	},
+	{
+		version: 49,
+		name:    "tunnel allowed upstream ports",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN allowed_upstream_ports TEXT`, // JSON list of port ranges; NULL allows any
+		},
+		down: []string{
+			`ALTER TABLE wg_peers DROP COLUMN allowed_upstream_ports`,
+		},
+	},
+	{
+		// Stats and endpoint writes no longer bump the wg_peers version, so
+		// they leave the cached listing in place; TunnelStore.List reads
+		// those columns fresh. A column added to tunnelColumns must be
+		// added to the trigger too.
+		version: 50,
+		name:    "tunnel version ignores stats",
+		up: []string{
+			`DROP TRIGGER IF EXISTS wg_peers_version_update`,
+			`CREATE TRIGGER wg_peers_version_update AFTER UPDATE OF
+				id, public_key, vpn_ip, psk_hash, domains, enabled,
+				auto_rotate_psk, psk_rotation_interval_days,
+				auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
+				last_rotation_at, pending_rotation_id, created_at,
+				labels, tenant_id, revoke_deferred_until, expiry_warned_at,
+				source_cidr, isolate, node_id, pending_psk, failover_node_ids,
+				persistent_keepalive, connected_threshold, client_routing, client_dns, client_mtu,
+				advertised_routes, deleted_at, name, server_key,
+				description, owner_email, device_name, expires_at, expires_warned_at,
+				pending_approval, imported, allowed_upstream_ports
+			ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+		},
+		down: []string{
+			`DROP TRIGGER IF EXISTS wg_peers_version_update`,
+			`CREATE TRIGGER wg_peers_version_update AFTER UPDATE ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+		},
+	},
+	{
+		// Only enabled routes claim their SNI domains, and claims follow
+		// routes being enabled, disabled, or edited. When a route lets go
+		// of a domain, the oldest enabled route still listing it takes the
+		// claim over, as when the claims were first derived.
+		version: 51,
+		name:    "SNI domains of enabled routes",
+		up: []string{
+			`DROP TRIGGER IF EXISTS l4_routes_sni_insert`,
+			`DROP TRIGGER IF EXISTS l4_routes_sni_update`,
+			`DROP TRIGGER IF EXISTS l4_routes_sni_delete`,
+			`DELETE FROM sni_domains WHERE route_id NOT IN (
+				SELECT id FROM l4_routes WHERE match_type = 'sni' AND enabled)`,
+			`INSERT OR IGNORE INTO sni_domains (domain, route_id)
+				SELECT lower(j.value), r.id FROM l4_routes r, json_each(r.match_value) j
+				WHERE r.match_type = 'sni' AND r.enabled ORDER BY r.created_at ASC`,
+			`CREATE TRIGGER l4_routes_sni_insert AFTER INSERT ON l4_routes
+				WHEN NEW.match_type = 'sni' AND NEW.enabled
+			BEGIN
+				INSERT INTO sni_domains (domain, route_id)
+					SELECT DISTINCT lower(value), NEW.id FROM json_each(NEW.match_value);
+			END`,
+			`CREATE TRIGGER l4_routes_sni_update AFTER UPDATE OF match_type, match_value, enabled ON l4_routes
+				WHEN OLD.match_type IS NOT NEW.match_type OR OLD.match_value IS NOT NEW.match_value
+					OR OLD.enabled IS NOT NEW.enabled
+			BEGIN
+				DELETE FROM sni_domains WHERE route_id = OLD.id;
+				INSERT INTO sni_domains (domain, route_id)
+					SELECT DISTINCT lower(value), NEW.id FROM json_each(NEW.match_value)
+					WHERE NEW.match_type = 'sni' AND NEW.enabled;
+				INSERT OR IGNORE INTO sni_domains (domain, route_id)
+					SELECT lower(j.value), r.id FROM l4_routes r, json_each(r.match_value) j
+					WHERE r.match_type = 'sni' AND r.enabled
+						AND lower(j.value) IN (SELECT lower(value) FROM json_each(OLD.match_value))
+					ORDER BY r.created_at ASC;
+			END`,
+			`CREATE TRIGGER l4_routes_sni_delete AFTER DELETE ON l4_routes
+				WHEN OLD.match_type = 'sni'
+			BEGIN
+				DELETE FROM sni_domains WHERE route_id = OLD.id;
+				INSERT OR IGNORE INTO sni_domains (domain, route_id)
+					SELECT lower(j.value), r.id FROM l4_routes r, json_each(r.match_value) j
+					WHERE r.match_type = 'sni' AND r.enabled
+						AND lower(j.value) IN (SELECT lower(value) FROM json_each(OLD.match_value))
+					ORDER BY r.created_at ASC;
+			END`,
+		},
+		down: []string{
+			`DROP TRIGGER IF EXISTS l4_routes_sni_insert`,
+			`DROP TRIGGER IF EXISTS l4_routes_sni_update`,
+			`DROP TRIGGER IF EXISTS l4_routes_sni_delete`,
+			`INSERT OR IGNORE INTO sni_domains (domain, route_id)
+				SELECT lower(j.value), r.id FROM l4_routes r, json_each(r.match_value) j
+				WHERE r.match_type = 'sni' ORDER BY r.created_at ASC`,
+			`CREATE TRIGGER l4_routes_sni_insert AFTER INSERT ON l4_routes
+				WHEN NEW.match_type = 'sni'
+			BEGIN
+				INSERT INTO sni_domains (domain, route_id)
+					SELECT DISTINCT lower(value), NEW.id FROM json_each(NEW.match_value);
+			END`,
+			`CREATE TRIGGER l4_routes_sni_delete AFTER DELETE ON l4_routes
+				WHEN OLD.match_type = 'sni'
+			BEGIN
+				DELETE FROM sni_domains WHERE route_id = OLD.id;
+			END`,
+		},
+	},
+	{
+		version: 52,
+		name:    "audit archives",
+		up: []string{
+			// Archives whose entries a pruning run has not deleted yet
+			`CREATE TABLE IF NOT EXISTS audit_archives (
+				path           TEXT PRIMARY KEY,
+				written_before INTEGER NOT NULL,
+				max_id         INTEGER NOT NULL
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS audit_archives`,
+		},
+	},
+	{
+		// Tunnels created earlier have neither server_key nor client_key
+		// set: the origin of their key is unknown
+		version: 53,
+		name:    "whether the client supplied the tunnel's public key (Flow B)",
+		up: []string{
+			`ALTER TABLE wg_peers ADD COLUMN client_key INTEGER NOT NULL DEFAULT 0`,
+			`DROP TRIGGER IF EXISTS wg_peers_version_update`,
+			`CREATE TRIGGER wg_peers_version_update AFTER UPDATE OF
+				id, public_key, vpn_ip, psk_hash, domains, enabled,
+				auto_rotate_psk, psk_rotation_interval_days,
+				auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
+				last_rotation_at, pending_rotation_id, created_at,
+				labels, tenant_id, revoke_deferred_until, expiry_warned_at,
+				source_cidr, isolate, node_id, pending_psk, failover_node_ids,
+				persistent_keepalive, connected_threshold, client_routing, client_dns, client_mtu,
+				advertised_routes, deleted_at, name, server_key,
+				description, owner_email, device_name, expires_at, expires_warned_at,
+				pending_approval, imported, allowed_upstream_ports, client_key
+			ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+		},
+		down: []string{
+			`DROP TRIGGER IF EXISTS wg_peers_version_update`,
+			`CREATE TRIGGER wg_peers_version_update AFTER UPDATE OF
+				id, public_key, vpn_ip, psk_hash, domains, enabled,
+				auto_rotate_psk, psk_rotation_interval_days,
+				auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
+				last_rotation_at, pending_rotation_id, created_at,
+				labels, tenant_id, revoke_deferred_until, expiry_warned_at,
+				source_cidr, isolate, node_id, pending_psk, failover_node_ids,
+				persistent_keepalive, connected_threshold, client_routing, client_dns, client_mtu,
+				advertised_routes, deleted_at, name, server_key,
+				description, owner_email, device_name, expires_at, expires_warned_at,
+				pending_approval, imported, allowed_upstream_ports
+			ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+			`ALTER TABLE wg_peers DROP COLUMN client_key`,
+		},
+	},
+	{
+		// expiry_warned_at is the warning before an inactivity revocation;
+		// the one before the expiry date gets a name of its own
+		version: 54,
+		name:    "rename expires_warned_at to expires_at_warned_at",
+		up: []string{
+			`DROP TRIGGER IF EXISTS wg_peers_version_update`,
+			`ALTER TABLE wg_peers RENAME COLUMN expires_warned_at TO expires_at_warned_at`,
+			`CREATE TRIGGER wg_peers_version_update AFTER UPDATE OF
+				id, public_key, vpn_ip, psk_hash, domains, enabled,
+				auto_rotate_psk, psk_rotation_interval_days,
+				auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
+				last_rotation_at, pending_rotation_id, created_at,
+				labels, tenant_id, revoke_deferred_until, expiry_warned_at,
+				source_cidr, isolate, node_id, pending_psk, failover_node_ids,
+				persistent_keepalive, connected_threshold, client_routing, client_dns, client_mtu,
+				advertised_routes, deleted_at, name, server_key,
+				description, owner_email, device_name, expires_at, expires_at_warned_at,
+				pending_approval, imported, allowed_upstream_ports, client_key
+			ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+		},
+		down: []string{
+			`DROP TRIGGER IF EXISTS wg_peers_version_update`,
+			`ALTER TABLE wg_peers RENAME COLUMN expires_at_warned_at TO expires_warned_at`,
+			`CREATE TRIGGER wg_peers_version_update AFTER UPDATE OF
+				id, public_key, vpn_ip, psk_hash, domains, enabled,
+				auto_rotate_psk, psk_rotation_interval_days,
+				auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
+				last_rotation_at, pending_rotation_id, created_at,
+				labels, tenant_id, revoke_deferred_until, expiry_warned_at,
+				source_cidr, isolate, node_id, pending_psk, failover_node_ids,
+				persistent_keepalive, connected_threshold, client_routing, client_dns, client_mtu,
+				advertised_routes, deleted_at, name, server_key,
+				description, owner_email, device_name, expires_at, expires_warned_at,
+				pending_approval, imported, allowed_upstream_ports, client_key
+			ON wg_peers
+			BEGIN UPDATE table_versions SET version = version + 1 WHERE name = 'wg_peers'; END`,
+		},
+	},
+}
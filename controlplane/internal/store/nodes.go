@@ -0,0 +1,144 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Node is a remote data-plane host whose Caddy, WireGuard, and nftables are
+// managed by an agent that authenticates with the ClientCN certificate.
+type Node struct {
+	ID           string
+	Name         string
+	ClientCN     string
+	WGPublicKey  string // reported by the agent at registration
+	Endpoint     string // public WireGuard host:port written into client configs
+	AgentVersion string
+	LastSeenAt   *time.Time
+	LastError    string // last reconciliation error reported by the agent
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// Registered reports whether the node's agent has registered, so tunnels
+// can be placed on it.
+func (n *Node) Registered() bool {
+	return n.WGPublicKey != ""
+}
+
+// NodeStore provides CRUD operations for nodes.
+type NodeStore struct {
+	db *sql.DB
+}
+
+// NewNodeStore creates a NodeStore using the given DB.
+func NewNodeStore(db *DB) *NodeStore {
+	return &NodeStore{db: db.Conn()}
+}
+
+const nodeColumns = `id, name, client_cn, wg_public_key, endpoint, agent_version,
+		last_seen_at, last_error, created_at, updated_at`
+
+// Create inserts a new node.
+func (s *NodeStore) Create(n *Node) error {
+	now := time.Now().Unix()
+	_, err := s.db.Exec(`INSERT INTO nodes (id, name, client_cn, endpoint, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, n.ID, n.Name, n.ClientCN, nullString(n.Endpoint), now, now)
+	if err != nil {
+		return fmt.Errorf("insert node: %w", err)
+	}
+	n.CreatedAt = time.Unix(now, 0)
+	n.UpdatedAt = time.Unix(now, 0)
+	return nil
+}
+
+// Get retrieves a node by ID.
+func (s *NodeStore) Get(id string) (*Node, error) {
+	return scanNode(s.db.QueryRow(`SELECT `+nodeColumns+` FROM nodes WHERE id = ?`, id))
+}
+
+// GetByClientCN retrieves the node whose agent uses the given certificate CN.
+func (s *NodeStore) GetByClientCN(cn string) (*Node, error) {
+	return scanNode(s.db.QueryRow(`SELECT `+nodeColumns+` FROM nodes WHERE client_cn = ?`, cn))
+}
+
+// List returns all nodes.
+func (s *NodeStore) List() ([]*Node, error) {
+	rows, err := s.db.Query(`SELECT ` + nodeColumns + ` FROM nodes ORDER BY created_at ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	defer rows.Close()
+
+	var nodes []*Node
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// Register records what an agent reports about its node when it starts.
+// An empty endpoint keeps the one configured when the node was created.
+func (s *NodeStore) Register(id, wgPublicKey, endpoint, version string, now time.Time) (*Node, error) {
+	_, err := s.db.Exec(`UPDATE nodes SET
+		wg_public_key = ?, endpoint = COALESCE(?, endpoint), agent_version = ?,
+		last_seen_at = ?, updated_at = ?
+	WHERE id = ?`, wgPublicKey, nullString(endpoint), nullString(version), now.Unix(), now.Unix(), id)
+	if err != nil {
+		return nil, fmt.Errorf("register node: %w", err)
+	}
+	return s.Get(id)
+}
+
+// RecordSeen marks the node's agent as alive and stores the last error it
+// reported, if any.
+func (s *NodeStore) RecordSeen(id string, now time.Time, lastError string) error {
+	_, err := s.db.Exec(`UPDATE nodes SET last_seen_at = ?, last_error = ? WHERE id = ?`,
+		now.Unix(), nullString(lastError), id)
+	if err != nil {
+		return fmt.Errorf("record node seen: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a node by ID.
+func (s *NodeStore) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM nodes WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete node: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("node not found: %s", id)
+	}
+	return nil
+}
+
+func scanNode(row rowScanner) (*Node, error) {
+	n := &Node{}
+	var (
+		pubKey, endpoint, version, lastError sql.NullString
+		lastSeen                             sql.NullInt64
+		createdAt, updatedAt                 int64
+	)
+	err := row.Scan(&n.ID, &n.Name, &n.ClientCN, &pubKey, &endpoint, &version,
+		&lastSeen, &lastError, &createdAt, &updatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("node not found")
+		}
+		return nil, fmt.Errorf("scan node: %w", err)
+	}
+	n.WGPublicKey = pubKey.String
+	n.Endpoint = endpoint.String
+	n.AgentVersion = version.String
+	n.LastError = lastError.String
+	n.LastSeenAt = nullTime(lastSeen)
+	n.CreatedAt = time.Unix(createdAt, 0)
+	n.UpdatedAt = time.Unix(updatedAt, 0)
+	return n, nil
+}
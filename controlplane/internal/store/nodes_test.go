@@ -0,0 +1,117 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodes(t *testing.T) {
+	db := setupTestDB(t)
+	ns := NewNodeStore(db)
+
+	node := &Node{ID: "node_1", Name: "edge-fra", ClientCN: "agent-fra", Endpoint: "fra.example.com:51820"}
+	if err := ns.Create(node); err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if err := ns.Create(&Node{ID: "node_2", Name: "edge-ams", ClientCN: "agent-fra"}); err == nil {
+		t.Error("expected duplicate client CN to be rejected")
+	}
+
+	got, err := ns.GetByClientCN("agent-fra")
+	if err != nil {
+		t.Fatalf("get by CN: %v", err)
+	}
+	if got.Registered() || got.LastSeenAt != nil {
+		t.Errorf("expected a new node to be unregistered, got %+v", got)
+	}
+
+	// An agent that reports no endpoint keeps the configured one
+	now := time.Unix(1700000000, 0)
+	got, err = ns.Register("node_1", "srvkey=", "", "1.2.0", now)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if !got.Registered() || got.Endpoint != "fra.example.com:51820" || !got.LastSeenAt.Equal(now) {
+		t.Errorf("unexpected registered node %+v", got)
+	}
+
+	ns.RecordSeen("node_1", now.Add(time.Minute), "caddy: connection refused")
+	if got, _ = ns.Get("node_1"); got.LastError != "caddy: connection refused" {
+		t.Errorf("expected last error to be recorded, got %q", got.LastError)
+	}
+
+	if err := ns.Delete("node_1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if nodes, _ := ns.List(); len(nodes) != 0 {
+		t.Errorf("expected no nodes, got %d", len(nodes))
+	}
+}
+
+func TestPendingPSK(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	ts.Create(&Tunnel{ID: "tun_1", PublicKey: "pk=", VpnIP: "10.0.0.2", Enabled: true, NodeID: "node_1", PendingPSK: "psk1"})
+	ts.Create(&Tunnel{ID: "tun_2", PublicKey: "pk2=", VpnIP: "10.0.0.3", Enabled: true})
+	if placed, _ := ts.ListByNodeID("node_1"); len(placed) != 1 || placed[0].ID != "tun_1" {
+		t.Fatalf("expected only tun_1 on node_1, got %v", placed)
+	}
+
+	// A stale acknowledgement does not clear a newer PSK
+	ts.SetPendingPSK("tun_1", "psk2")
+	ts.AckPendingPSK("tun_1", "psk1", "node_1")
+	if got, _ := ts.Get("tun_1"); got.PendingPSK != "psk2" || got.NodeID != "node_1" {
+		t.Errorf("expected psk2 pending on node_1, got %q on %q", got.PendingPSK, got.NodeID)
+	}
+	ts.AckPendingPSK("tun_1", "psk2", "node_1")
+	if got, _ := ts.Get("tun_1"); got.PendingPSK != "" {
+		t.Errorf("expected pending PSK to be cleared, got %q", got.PendingPSK)
+	}
+}
+
+func TestFailoverNodes(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+	ts.Create(&Tunnel{
+		ID: "tun_1", PublicKey: "pk=", VpnIP: "10.0.0.2", Enabled: true,
+		NodeID: "node_1", FailoverNodeIDs: []string{"node_2", "node_3"}, PendingPSK: "psk1",
+	})
+	ts.Create(&Tunnel{ID: "tun_2", PublicKey: "pk2=", VpnIP: "10.0.0.3", Enabled: true, NodeID: "node_2"})
+	rs.Create(&Route{ID: "route_1", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"a.example.com"}, Upstream: "10.0.0.2:443", CaddyID: "route-route_1", Enabled: true, NodeID: "node_1"})
+
+	if got, _ := ts.Get("tun_1"); len(got.FailoverNodeIDs) != 2 || got.FailoverNodeIDs[0] != "node_2" {
+		t.Fatalf("expected failover nodes [node_2 node_3], got %v", got.FailoverNodeIDs)
+	}
+	if served, _ := ts.ListByNodeID("node_2"); len(served) != 2 {
+		t.Errorf("expected node_2 to serve both tunnels, got %d", len(served))
+	}
+	if served, _ := rs.ListByNodeID("node_3"); len(served) != 1 || served[0].ID != "route_1" {
+		t.Errorf("expected node_3 to serve route_1, got %v", served)
+	}
+
+	// The PSK stays pending until every serving node has applied it
+	for _, node := range []string{"node_2", "node_1"} {
+		ts.AckPendingPSK("tun_1", "psk1", node)
+		if got, _ := ts.Get("tun_1"); got.PendingPSK != "psk1" {
+			t.Fatalf("expected psk1 still pending after %s acked", node)
+		}
+	}
+	if acked, _ := ts.PendingPSKAcked("tun_1", "node_2"); !acked {
+		t.Error("expected node_2's acknowledgement to be recorded")
+	}
+	if acked, _ := ts.PendingPSKAcked("tun_1", "node_3"); acked {
+		t.Error("expected node_3 not to have acknowledged")
+	}
+	ts.AckPendingPSK("tun_1", "psk1", "node_3")
+	if got, _ := ts.Get("tun_1"); got.PendingPSK != "" {
+		t.Errorf("expected pending PSK to be cleared, got %q", got.PendingPSK)
+	}
+
+	// A new PSK needs every node again
+	ts.SetPendingPSK("tun_1", "psk2")
+	if acked, _ := ts.PendingPSKAcked("tun_1", "node_2"); acked {
+		t.Error("expected acknowledgements to reset with a new PSK")
+	}
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Policy restricts the domains, ports, and CIDRs that tunnels, routes, and
+// firewall rules may claim. The policy with TenantID "" is global and
+// applies to every resource; a tenant's policy applies to its resources on
+// top of it. Empty lists place no restriction.
+type Policy struct {
+	TenantID       string
+	DomainSuffixes []string    // SNI domains must equal or end in one of these
+	PortRanges     []PortRange // listen and firewall ports must fall in one of these
+	ForbiddenCIDRs []string    // source, firewall, and advertised CIDRs may not lie within these
+	UpdatedBy      string      // client CN that last set the policy
+	UpdatedAt      time.Time
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Contains reports whether port is in the range.
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Start && port <= r.End
+}
+
+const policyColumns = `tenant_id, domain_suffixes, port_ranges, forbidden_cidrs, updated_by, updated_at`
+
+// SetPolicy creates or replaces the policy of p.TenantID.
+func (s *TenantStore) SetPolicy(p *Policy) error {
+	domains, err := json.Marshal(nonNil(p.DomainSuffixes))
+	if err != nil {
+		return fmt.Errorf("marshal domain suffixes: %w", err)
+	}
+	ports, err := json.Marshal(nonNil(p.PortRanges))
+	if err != nil {
+		return fmt.Errorf("marshal port ranges: %w", err)
+	}
+	cidrs, err := json.Marshal(nonNil(p.ForbiddenCIDRs))
+	if err != nil {
+		return fmt.Errorf("marshal forbidden cidrs: %w", err)
+	}
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO policies (`+policyColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		p.TenantID, string(domains), string(ports), string(cidrs), nullString(p.UpdatedBy), now)
+	if err != nil {
+		return fmt.Errorf("set policy: %w", err)
+	}
+	p.UpdatedAt = time.Unix(now, 0)
+	return nil
+}
+
+// GetPolicy retrieves the policy of a tenant, or the global one for "".
+func (s *TenantStore) GetPolicy(tenantID string) (*Policy, error) {
+	row := s.db.QueryRow(`SELECT `+policyColumns+` FROM policies WHERE tenant_id = ?`, tenantID)
+	return scanPolicy(row)
+}
+
+// ListPolicies returns every policy, the global one first.
+func (s *TenantStore) ListPolicies() ([]*Policy, error) {
+	rows, err := s.db.Query(`SELECT ` + policyColumns + ` FROM policies ORDER BY tenant_id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("list policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []*Policy
+	for rows.Next() {
+		p, err := scanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// DeletePolicy removes the policy of a tenant, or the global one for "".
+func (s *TenantStore) DeletePolicy(tenantID string) error {
+	res, err := s.db.Exec(`DELETE FROM policies WHERE tenant_id = ?`, tenantID)
+	if err != nil {
+		return fmt.Errorf("delete policy: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("policy not found")
+	}
+	return nil
+}
+
+func scanPolicy(row rowScanner) (*Policy, error) {
+	p := &Policy{}
+	var (
+		domains, ports, cidrs string
+		updatedBy             sql.NullString
+		updatedAt             int64
+	)
+	if err := row.Scan(&p.TenantID, &domains, &ports, &cidrs, &updatedBy, &updatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("policy not found")
+		}
+		return nil, fmt.Errorf("scan policy: %w", err)
+	}
+	_ = json.Unmarshal([]byte(domains), &p.DomainSuffixes)
+	_ = json.Unmarshal([]byte(ports), &p.PortRanges)
+	_ = json.Unmarshal([]byte(cidrs), &p.ForbiddenCIDRs)
+	p.UpdatedBy = updatedBy.String
+	p.UpdatedAt = time.Unix(updatedAt, 0)
+	return p, nil
+}
+
+// nonNil returns s, or an empty slice for nil, so lists encode as [].
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ProbeSummary is the latency and loss of a tunnel's latest probes.
+type ProbeSummary struct {
+	Samples  int
+	Lost     int
+	AvgRTT   time.Duration // over the probes that got a reply; 0 if none did
+	LastRTT  time.Duration // 0 if the last probe was lost
+	ProbedAt time.Time     // time of the last probe
+}
+
+// Loss returns the share of probes that got no reply.
+func (p ProbeSummary) Loss() float64 {
+	if p.Samples == 0 {
+		return 0
+	}
+	return float64(p.Lost) / float64(p.Samples)
+}
+
+// RecordProbe stores the outcome of a latency probe of a tunnel's peer, a
+// nil rtt meaning it got no reply, and drops all but the keep latest probes
+// of the tunnel.
+func (s *TunnelStore) RecordProbe(id string, at time.Time, rtt *time.Duration, keep int) error {
+	var rttUS sql.NullInt64
+	if rtt != nil {
+		rttUS = sql.NullInt64{Int64: rtt.Microseconds(), Valid: true}
+	}
+	if _, err := s.db.Exec(`INSERT OR REPLACE INTO peer_probe_samples (peer_id, probed_at, rtt_us) VALUES (?, ?, ?)`,
+		id, at.Unix(), rttUS); err != nil {
+		return fmt.Errorf("record probe: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM peer_probe_samples WHERE peer_id = ? AND probed_at <= (
+		SELECT probed_at FROM peer_probe_samples WHERE peer_id = ? ORDER BY probed_at DESC LIMIT 1 OFFSET ?)`,
+		id, id, keep); err != nil {
+		return fmt.Errorf("prune probes: %w", err)
+	}
+	return nil
+}
+
+// ProbeSummaries returns the probe summary of every tunnel that has been
+// probed, keyed by tunnel ID.
+func (s *TunnelStore) ProbeSummaries() (map[string]ProbeSummary, error) {
+	rows, err := s.db.Query(`SELECT p.peer_id, COUNT(*), SUM(p.rtt_us IS NULL), AVG(p.rtt_us), MAX(p.probed_at),
+		(SELECT l.rtt_us FROM peer_probe_samples l WHERE l.peer_id = p.peer_id ORDER BY l.probed_at DESC LIMIT 1)
+		FROM peer_probe_samples p GROUP BY p.peer_id`)
+	if err != nil {
+		return nil, fmt.Errorf("query probes: %w", err)
+	}
+	defer rows.Close()
+
+	summaries := make(map[string]ProbeSummary)
+	for rows.Next() {
+		var (
+			id       string
+			sum      ProbeSummary
+			avg      sql.NullFloat64
+			probedAt int64
+			last     sql.NullInt64
+		)
+		if err := rows.Scan(&id, &sum.Samples, &sum.Lost, &avg, &probedAt, &last); err != nil {
+			return nil, fmt.Errorf("scan probe: %w", err)
+		}
+		sum.AvgRTT = time.Duration(avg.Float64) * time.Microsecond
+		sum.LastRTT = time.Duration(last.Int64) * time.Microsecond
+		sum.ProbedAt = time.Unix(probedAt, 0)
+		summaries[id] = sum
+	}
+	return summaries, rows.Err()
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeSummaries(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	if err := ts.Create(&Tunnel{ID: "tun_1", PublicKey: "pk_1", VpnIP: "10.0.0.2", Domains: []string{}}); err != nil {
+		t.Fatalf("create tunnel: %v", err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	rtts := []time.Duration{50 * time.Millisecond, 10 * time.Millisecond, 0, 20 * time.Millisecond, 30 * time.Millisecond}
+	for i, rtt := range rtts {
+		var sample *time.Duration
+		if rtt > 0 {
+			sample = &rtt
+		}
+		if err := ts.RecordProbe("tun_1", start.Add(time.Duration(i)*time.Minute), sample, 4); err != nil {
+			t.Fatalf("record probe %d: %v", i, err)
+		}
+	}
+
+	// The first probe fell out of the window of 4; one of the rest was lost
+	summaries, err := ts.ProbeSummaries()
+	if err != nil {
+		t.Fatalf("probe summaries: %v", err)
+	}
+	got := summaries["tun_1"]
+	if got.Samples != 4 || got.Lost != 1 || got.Loss() != 0.25 {
+		t.Errorf("expected 1 of 4 probes lost, got %+v", got)
+	}
+	if got.AvgRTT != 20*time.Millisecond || got.LastRTT != 30*time.Millisecond {
+		t.Errorf("expected avg 20ms and last 30ms, got %v and %v", got.AvgRTT, got.LastRTT)
+	}
+	if !got.ProbedAt.Equal(start.Add(4 * time.Minute)) {
+		t.Errorf("expected last probe at %v, got %v", start.Add(4*time.Minute), got.ProbedAt)
+	}
+
+	// Probes go with their tunnel
+	if err := ts.Delete("tun_1"); err != nil {
+		t.Fatalf("delete tunnel: %v", err)
+	}
+	if summaries, _ = ts.ProbeSummaries(); len(summaries) != 0 {
+		t.Errorf("expected no probes after delete, got %v", summaries)
+	}
+}
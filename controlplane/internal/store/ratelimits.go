@@ -0,0 +1,73 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// RateBucket is the saved state of one client's API rate limit: the tokens
+// left at UpdatedAt, before any refill since.
+type RateBucket struct {
+	Key       string
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// RateLimitStore keeps the API rate limit buckets, so limits survive
+// restarts.
+type RateLimitStore struct {
+	db *sql.DB
+}
+
+// NewRateLimitStore creates a RateLimitStore using the given DB.
+func NewRateLimitStore(db *DB) *RateLimitStore {
+	return &RateLimitStore{db: db.Conn()}
+}
+
+// List returns the buckets saved for scope.
+func (s *RateLimitStore) List(scope string) ([]RateBucket, error) {
+	rows, err := s.db.Query(`SELECT key, tokens, updated_at FROM rate_limits WHERE scope = ?`, scope)
+	if err != nil {
+		return nil, fmt.Errorf("list rate limits: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []RateBucket
+	for rows.Next() {
+		var (
+			b         RateBucket
+			updatedAt int64
+		)
+		if err := rows.Scan(&b.Key, &b.Tokens, &updatedAt); err != nil {
+			return nil, fmt.Errorf("scan rate limit: %w", err)
+		}
+		b.UpdatedAt = time.UnixMilli(updatedAt)
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// Save writes the changed buckets of scope and deletes the removed ones,
+// leaving the others as they are.
+func (s *RateLimitStore) Save(scope string, changed []RateBucket, removed []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, key := range removed {
+		if _, err := tx.Exec(`DELETE FROM rate_limits WHERE scope = ? AND key = ?`, scope, key); err != nil {
+			return fmt.Errorf("delete rate limit: %w", err)
+		}
+	}
+	for _, b := range changed {
+		if _, err := tx.Exec(`INSERT INTO rate_limits (scope, key, tokens, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (scope, key) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at`,
+			scope, b.Key, b.Tokens, b.UpdatedAt.UnixMilli()); err != nil {
+			return fmt.Errorf("save rate limit: %w", err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateBuckets(t *testing.T) {
+	db := setupTestDB(t)
+	rs := NewRateLimitStore(db)
+	now := time.UnixMilli(time.Now().UnixMilli())
+
+	if err := rs.Save("read", []RateBucket{
+		{Key: "ip:192.0.2.1", Tokens: 2.5, UpdatedAt: now},
+		{Key: "cn:alice", Tokens: 0, UpdatedAt: now},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Save("mutate", []RateBucket{{Key: "cn:alice", Tokens: 1, UpdatedAt: now}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, err := rs.List("read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %+v", buckets)
+	}
+	for _, b := range buckets {
+		if b.Key == "ip:192.0.2.1" && (b.Tokens != 2.5 || !b.UpdatedAt.Equal(now)) {
+			t.Errorf("unexpected bucket %+v", b)
+		}
+	}
+
+	// Saving touches only the changed and removed buckets of the scope
+	later := now.Add(time.Second)
+	if err := rs.Save("read", []RateBucket{{Key: "ip:192.0.2.1", Tokens: 1, UpdatedAt: later}}, []string{"cn:alice"}); err != nil {
+		t.Fatal(err)
+	}
+	buckets, _ = rs.List("read")
+	if len(buckets) != 1 || buckets[0].Tokens != 1 || !buckets[0].UpdatedAt.Equal(later) {
+		t.Errorf("expected only the updated read bucket, got %+v", buckets)
+	}
+	if buckets, _ := rs.List("mutate"); len(buckets) != 1 {
+		t.Errorf("expected the mutate bucket to be kept, got %+v", buckets)
+	}
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// maxReconcileRuns is how many passes the reconcile history keeps.
+const maxReconcileRuns = 1000
+
+// OpCounts tallies the corrective operations of a reconciliation pass. Every
+// attempted operation either succeeded or failed. Observed operations are
+// drift found in observe mode and left in place, and are not attempted.
+type OpCounts struct {
+	Attempted int `json:"attempted"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Observed  int `json:"observed"`
+}
+
+// Add returns the sum of c and o.
+func (c OpCounts) Add(o OpCounts) OpCounts {
+	return OpCounts{c.Attempted + o.Attempted, c.Succeeded + o.Succeeded, c.Failed + o.Failed, c.Observed + o.Observed}
+}
+
+// ReconcileRun is one reconciliation pass in the history.
+type ReconcileRun struct {
+	ID         int64
+	StartedAt  time.Time
+	Duration   time.Duration
+	Status     string // "ok", "drift_corrected", "drift_detected", or "error"
+	Error      string
+	Ops        OpCounts
+	Subsystems map[string]OpCounts
+}
+
+// ReconcileRunStore keeps the history of reconciliation passes.
+type ReconcileRunStore struct {
+	db *sql.DB
+}
+
+// NewReconcileRunStore creates a ReconcileRunStore using the given DB.
+func NewReconcileRunStore(db *DB) *ReconcileRunStore {
+	return &ReconcileRunStore{db: db.Conn()}
+}
+
+// Record appends run to the history, dropping the oldest passes beyond the
+// last 1000.
+func (s *ReconcileRunStore) Record(run *ReconcileRun) error {
+	subsystems, err := json.Marshal(run.Subsystems)
+	if err != nil {
+		return fmt.Errorf("marshal subsystems: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO reconcile_runs
+		(started_at, duration_ms, status, error, attempted, succeeded, failed, observed, subsystems)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.StartedAt.UnixMilli(), run.Duration.Milliseconds(), run.Status, nullString(run.Error),
+		run.Ops.Attempted, run.Ops.Succeeded, run.Ops.Failed, run.Ops.Observed, string(subsystems))
+	if err != nil {
+		return fmt.Errorf("insert reconcile run: %w", err)
+	}
+	if run.ID, err = res.LastInsertId(); err != nil {
+		return fmt.Errorf("reconcile run id: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM reconcile_runs WHERE id <= ?`, run.ID-maxReconcileRuns); err != nil {
+		return fmt.Errorf("trim reconcile runs: %w", err)
+	}
+	return tx.Commit()
+}
+
+// List returns up to limit passes, newest first.
+func (s *ReconcileRunStore) List(limit int) ([]*ReconcileRun, error) {
+	rows, err := s.db.Query(`SELECT id, started_at, duration_ms, status, error,
+		attempted, succeeded, failed, observed, subsystems
+		FROM reconcile_runs ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query reconcile runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []*ReconcileRun
+	for rows.Next() {
+		var (
+			run                   ReconcileRun
+			startedAt, durationMS int64
+			errMsg                sql.NullString
+			subsystems            string
+		)
+		if err := rows.Scan(&run.ID, &startedAt, &durationMS, &run.Status, &errMsg,
+			&run.Ops.Attempted, &run.Ops.Succeeded, &run.Ops.Failed, &run.Ops.Observed, &subsystems); err != nil {
+			return nil, fmt.Errorf("scan reconcile run: %w", err)
+		}
+		run.StartedAt = time.UnixMilli(startedAt)
+		run.Duration = time.Duration(durationMS) * time.Millisecond
+		run.Error = errMsg.String
+		if err := json.Unmarshal([]byte(subsystems), &run.Subsystems); err != nil {
+			return nil, fmt.Errorf("decode reconcile run subsystems: %w", err)
+		}
+		runs = append(runs, &run)
+	}
+	return runs, rows.Err()
+}
+
+// RepairOp is one correction in a startup report.
+type RepairOp struct {
+	Type   string `json:"type"` // "add", "remove", "update"
+	ID     string `json:"id"`
+	Detail string `json:"detail,omitempty"`
+	Result string `json:"result"` // "repaired", "failed", or "observed"
+	Error  string `json:"error,omitempty"`
+}
+
+// StartupSubsystem is what the startup pass found in one subsystem.
+type StartupSubsystem struct {
+	InSync bool       `json:"in_sync"` // nothing to correct and no error
+	Error  string     `json:"error,omitempty"`
+	Ops    []RepairOp `json:"ops"`
+}
+
+// StartupReport is what the first reconciliation pass of a process found
+// and repaired, comparing the database with Caddy and the kernel. It is
+// replaced on every start.
+type StartupReport struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Mode      string // "enforce" or "observe"
+	// The reconciliation status and last pass the previous process left.
+	// "shutdown" means it stopped cleanly and "pending" that there was none;
+	// anything else means it crashed or the host went down.
+	PreviousStatus string
+	PreviousRunAt  *time.Time
+	Status         string // as in ReconcileRun
+	Error          string
+	Ops            OpCounts
+	Subsystems     map[string]StartupSubsystem
+}
+
+// SaveStartupReport replaces the startup report.
+func (s *FirewallStore) SaveStartupReport(r *StartupReport) error {
+	subsystems, err := json.Marshal(r.Subsystems)
+	if err != nil {
+		return fmt.Errorf("marshal subsystems: %w", err)
+	}
+	var prevRunAt sql.NullInt64
+	if r.PreviousRunAt != nil {
+		prevRunAt = sql.NullInt64{Int64: r.PreviousRunAt.Unix(), Valid: true}
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO startup_report
+		(id, started_at, duration_ms, mode, previous_status, previous_run_at, status, error,
+		 attempted, succeeded, failed, observed, subsystems)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.StartedAt.UnixMilli(), r.Duration.Milliseconds(), r.Mode, r.PreviousStatus, prevRunAt,
+		r.Status, nullString(r.Error), r.Ops.Attempted, r.Ops.Succeeded, r.Ops.Failed, r.Ops.Observed,
+		string(subsystems))
+	if err != nil {
+		return fmt.Errorf("save startup report: %w", err)
+	}
+	return nil
+}
+
+// GetStartupReport returns the startup report, or nil if no pass has run
+// since the database was created.
+func (s *FirewallStore) GetStartupReport() (*StartupReport, error) {
+	var (
+		r                     StartupReport
+		startedAt, durationMS int64
+		prevRunAt             sql.NullInt64
+		errMsg                sql.NullString
+		subsystems            string
+	)
+	err := s.db.QueryRow(`SELECT started_at, duration_ms, mode, previous_status, previous_run_at,
+		status, error, attempted, succeeded, failed, observed, subsystems
+		FROM startup_report WHERE id = 1`).Scan(&startedAt, &durationMS, &r.Mode, &r.PreviousStatus, &prevRunAt,
+		&r.Status, &errMsg, &r.Ops.Attempted, &r.Ops.Succeeded, &r.Ops.Failed, &r.Ops.Observed, &subsystems)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scan startup report: %w", err)
+	}
+	r.StartedAt = time.UnixMilli(startedAt)
+	r.Duration = time.Duration(durationMS) * time.Millisecond
+	if prevRunAt.Valid {
+		t := time.Unix(prevRunAt.Int64, 0)
+		r.PreviousRunAt = &t
+	}
+	r.Error = errMsg.String
+	if err := json.Unmarshal([]byte(subsystems), &r.Subsystems); err != nil {
+		return nil, fmt.Errorf("decode startup report subsystems: %w", err)
+	}
+	return &r, nil
+}
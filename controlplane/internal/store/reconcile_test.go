@@ -0,0 +1,99 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconcileRuns(t *testing.T) {
+	db := setupTestDB(t)
+	rs := NewReconcileRunStore(db)
+
+	base := time.Unix(1_700_000_000, 0)
+	for i := range maxReconcileRuns + 5 {
+		run := &ReconcileRun{
+			StartedAt:  base.Add(time.Duration(i) * time.Minute),
+			Duration:   250 * time.Millisecond,
+			Status:     "ok",
+			Subsystems: map[string]OpCounts{},
+		}
+		if i == maxReconcileRuns+4 {
+			run.Status = "error"
+			run.Error = "caddy: 1 of 3 operations failed"
+			run.Ops = OpCounts{Attempted: 3, Succeeded: 2, Failed: 1}
+			run.Subsystems["caddy"] = run.Ops
+		}
+		if err := rs.Record(run); err != nil {
+			t.Fatalf("record run %d: %v", i, err)
+		}
+	}
+
+	runs, err := rs.List(maxReconcileRuns * 2)
+	if err != nil {
+		t.Fatalf("list runs: %v", err)
+	}
+	if len(runs) != maxReconcileRuns {
+		t.Fatalf("expected the history to keep %d runs, got %d", maxReconcileRuns, len(runs))
+	}
+	last := runs[0]
+	if last.Status != "error" || last.Error == "" || last.Duration != 250*time.Millisecond ||
+		!last.StartedAt.Equal(base.Add((maxReconcileRuns+4)*time.Minute)) {
+		t.Errorf("unexpected newest run: %+v", last)
+	}
+	if last.Ops != (OpCounts{Attempted: 3, Succeeded: 2, Failed: 1}) || last.Subsystems["caddy"] != last.Ops {
+		t.Errorf("expected the op counts to round-trip, got %+v %+v", last.Ops, last.Subsystems)
+	}
+	if oldest := runs[len(runs)-1]; !oldest.StartedAt.Equal(base.Add(5 * time.Minute)) {
+		t.Errorf("expected the oldest runs to be dropped, oldest is %s", oldest.StartedAt)
+	}
+}
+
+func TestStartupReport(t *testing.T) {
+	db := setupTestDB(t)
+	fs := NewFirewallStore(db)
+
+	if r, err := fs.GetStartupReport(); err != nil || r != nil {
+		t.Fatalf("expected no report before the first start, got %+v (%v)", r, err)
+	}
+
+	prev := time.Unix(1_700_000_000, 0)
+	report := &StartupReport{
+		StartedAt:      time.UnixMilli(1_700_000_060_000),
+		Duration:       120 * time.Millisecond,
+		Mode:           "enforce",
+		PreviousStatus: "ok",
+		PreviousRunAt:  &prev,
+		Status:         "drift_corrected",
+		Ops:            OpCounts{Attempted: 2, Succeeded: 1, Failed: 1},
+		Subsystems: map[string]StartupSubsystem{
+			"wireguard": {Ops: []RepairOp{
+				{Type: "add", ID: "pk1", Detail: "peer", Result: "repaired"},
+				{Type: "add", ID: "pk2", Detail: "peer", Result: "failed", Error: "device busy"},
+			}},
+			"caddy": {InSync: true, Ops: []RepairOp{}},
+		},
+	}
+	if err := fs.SaveStartupReport(report); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	got, err := fs.GetStartupReport()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !got.StartedAt.Equal(report.StartedAt) || got.Duration != report.Duration || got.PreviousStatus != "ok" ||
+		!got.PreviousRunAt.Equal(prev) || got.Ops != report.Ops {
+		t.Errorf("unexpected report: %+v", got)
+	}
+	if ops := got.Subsystems["wireguard"].Ops; len(ops) != 2 || ops[1].Error != "device busy" || !got.Subsystems["caddy"].InSync {
+		t.Errorf("expected the subsystems to round-trip, got %+v", got.Subsystems)
+	}
+
+	// The next start replaces it
+	report.Status, report.PreviousStatus, report.PreviousRunAt = "ok", "shutdown", nil
+	if err := fs.SaveStartupReport(report); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if got, _ := fs.GetStartupReport(); got.PreviousStatus != "shutdown" || got.PreviousRunAt != nil {
+		t.Errorf("expected the report replaced, got %+v", got)
+	}
+}
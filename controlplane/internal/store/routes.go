@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -9,31 +10,65 @@ import (
 
 // Route represents an L4 forwarding route in the database.
 type Route struct {
-	ID         string
-	TunnelID   string
-	ListenPort int
-	Protocol   string // "tcp" or "udp"
-	MatchType  string // "sni" or "port_forward"
-	MatchValue []string
-	Upstream   string
-	CaddyID    string
-	Enabled    bool
-	CreatedAt  time.Time
-	UpdatedAt  time.Time
+	ID            string
+	Name          string // caller-supplied, unique per tenant; "" if unnamed
+	TunnelID      string
+	ListenPort    int
+	Protocol      string // "tcp" or "udp"
+	MatchType     string // "sni" or "port_forward"
+	MatchValue    []string
+	Upstream      string
+	CaddyID       string
+	Enabled       bool
+	TenantID      string
+	ProxyProtocol string     // "v1", "v2", or "" for none
+	QUIC          bool       // also forward UDP/443 for the SNI domains (sni only)
+	Priority      int        // higher is matched first among SNI routes
+	TerminateTLS  bool       // Caddy terminates TLS with an ACME certificate and proxies plaintext (sni only)
+	ListenPortEnd int        // last port of a port-forward range, or 0 for a single port
+	NodeID        string     // remote node serving the route (always its tunnel's node); empty for this host
+	ExpiresAt     *time.Time // the reconciler deletes the route after this time; nil keeps it
+	Imported      bool       // adopted from a route already in Caddy, not created through the API
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
+// routeColumns is the column list shared by every l4_routes SELECT; scanRoute
+// expects columns in exactly this order.
+const routeColumns = `id, tunnel_id, listen_port, protocol, match_type, match_value,
+		upstream, caddy_id, enabled, created_at, updated_at, tenant_id,
+		proxy_protocol, quic, priority, terminate_tls, listen_port_end, node_id, name, expires_at,
+		imported`
+
 // RouteStore provides CRUD operations for l4_routes.
 type RouteStore struct {
-	db *sql.DB
+	db    *conn
+	cache *listCache[*Route]
 }
 
 // NewRouteStore creates a RouteStore using the given DB.
 func NewRouteStore(db *DB) *RouteStore {
-	return &RouteStore{db: db.Conn()}
+	return &RouteStore{db: newConn(db), cache: db.routes}
+}
+
+// WithContext returns a copy of the store whose queries end when ctx is
+// done, such as when an API client goes away.
+func (s *RouteStore) WithContext(ctx context.Context) *RouteStore {
+	return &RouteStore{db: s.db.withContext(ctx), cache: s.cache}
 }
 
 // Create inserts a new route.
 func (s *RouteStore) Create(r *Route) error {
+	return insertRoute(s.db, r)
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertRoute inserts r using db, which may be a transaction.
+func insertRoute(db execer, r *Route) error {
 	matchJSON, err := json.Marshal(r.MatchValue)
 	if err != nil {
 		return fmt.Errorf("marshal match_value: %w", err)
@@ -44,14 +79,25 @@ func (s *RouteStore) Create(r *Route) error {
 	}
 
 	now := time.Now().Unix()
-	_, err = s.db.Exec(`INSERT INTO l4_routes (
+	_, err = db.Exec(`INSERT INTO l4_routes (
 		id, tunnel_id, listen_port, protocol, match_type, match_value,
-		upstream, caddy_id, enabled, created_at, updated_at
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		upstream, caddy_id, enabled, created_at, updated_at, tenant_id,
+		proxy_protocol, quic, priority, terminate_tls, listen_port_end, node_id, name, expires_at,
+		imported
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		r.ID, r.TunnelID, r.ListenPort, r.Protocol, r.MatchType,
 		string(matchJSON), r.Upstream, r.CaddyID,
-		boolToInt(r.Enabled), now, now,
+		boolToInt(r.Enabled), now, now, nullString(r.TenantID),
+		nullString(r.ProxyProtocol), boolToInt(r.QUIC), r.Priority,
+		boolToInt(r.TerminateTLS), r.ListenPortEnd, nullString(r.NodeID), nullString(r.Name),
+		nullUnix(r.ExpiresAt), boolToInt(r.Imported),
 	)
+	if isNameConflict(err) {
+		return fmt.Errorf("insert route: %s: %w", r.Name, ErrNameInUse)
+	}
+	if isDomainConflict(err) {
+		return fmt.Errorf("insert route: %w", ErrDomainInUse)
+	}
 	if err != nil {
 		return fmt.Errorf("insert route: %w", err)
 	}
@@ -62,19 +108,23 @@ func (s *RouteStore) Create(r *Route) error {
 
 // Get retrieves a route by ID.
 func (s *RouteStore) Get(id string) (*Route, error) {
-	row := s.db.QueryRow(`SELECT
-		id, tunnel_id, listen_port, protocol, match_type, match_value,
-		upstream, caddy_id, enabled, created_at, updated_at
-	FROM l4_routes WHERE id = ?`, id)
+	row := s.db.QueryRow(`SELECT `+routeColumns+` FROM l4_routes WHERE id = ?`, id)
+	return scanRoute(row)
+}
+
+// GetByName retrieves a tenant's route by name.
+func (s *RouteStore) GetByName(tenantID, name string) (*Route, error) {
+	row := s.db.QueryRow(`SELECT `+routeColumns+` FROM l4_routes WHERE IFNULL(tenant_id, '') = ? AND name = ?`, tenantID, name)
 	return scanRoute(row)
 }
 
 // List returns all routes.
 func (s *RouteStore) List() ([]*Route, error) {
-	rows, err := s.db.Query(`SELECT
-		id, tunnel_id, listen_port, protocol, match_type, match_value,
-		upstream, caddy_id, enabled, created_at, updated_at
-	FROM l4_routes ORDER BY created_at ASC`)
+	return s.cache.list(s.db, s.list)
+}
+
+func (s *RouteStore) list() ([]*Route, error) {
+	rows, err := s.db.Query(`SELECT ` + routeColumns + ` FROM l4_routes ORDER BY created_at ASC`)
 	if err != nil {
 		return nil, fmt.Errorf("list routes: %w", err)
 	}
@@ -82,7 +132,7 @@ func (s *RouteStore) List() ([]*Route, error) {
 
 	var routes []*Route
 	for rows.Next() {
-		r, err := scanRouteRows(rows)
+		r, err := scanRoute(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -93,18 +143,54 @@ func (s *RouteStore) List() ([]*Route, error) {
 
 // ListEnabled returns only enabled routes.
 func (s *RouteStore) ListEnabled() ([]*Route, error) {
-	rows, err := s.db.Query(`SELECT
-		id, tunnel_id, listen_port, protocol, match_type, match_value,
-		upstream, caddy_id, enabled, created_at, updated_at
-	FROM l4_routes WHERE enabled = 1 ORDER BY created_at ASC`)
+	all, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var routes []*Route
+	for _, r := range all {
+		if r.Enabled {
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
+
+// ListExpired returns the routes whose expiry is at or before now.
+func (s *RouteStore) ListExpired(now time.Time) ([]*Route, error) {
+	rows, err := s.db.Query(`SELECT `+routeColumns+` FROM l4_routes
+		WHERE expires_at IS NOT NULL AND expires_at <= ? ORDER BY expires_at ASC`, now.Unix())
 	if err != nil {
-		return nil, fmt.Errorf("list enabled routes: %w", err)
+		return nil, fmt.Errorf("list expired routes: %w", err)
 	}
 	defer rows.Close()
 
 	var routes []*Route
 	for rows.Next() {
-		r, err := scanRouteRows(rows)
+		r, err := scanRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return routes, rows.Err()
+}
+
+// ListByNodeID returns the routes a node serves: those placed on it and
+// those of tunnels it is a failover node for.
+func (s *RouteStore) ListByNodeID(nodeID string) ([]*Route, error) {
+	rows, err := s.db.Query(`SELECT `+routeColumns+` FROM l4_routes
+		WHERE node_id = ? OR tunnel_id IN (
+			SELECT wg_peers.id FROM wg_peers, json_each(wg_peers.failover_node_ids) WHERE json_each.value = ?)
+		ORDER BY created_at ASC`, nodeID, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("list routes by node: %w", err)
+	}
+	defer rows.Close()
+
+	var routes []*Route
+	for rows.Next() {
+		r, err := scanRoute(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -115,10 +201,7 @@ func (s *RouteStore) ListEnabled() ([]*Route, error) {
 
 // ListByTunnelID returns all routes for a given tunnel.
 func (s *RouteStore) ListByTunnelID(tunnelID string) ([]*Route, error) {
-	rows, err := s.db.Query(`SELECT
-		id, tunnel_id, listen_port, protocol, match_type, match_value,
-		upstream, caddy_id, enabled, created_at, updated_at
-	FROM l4_routes WHERE tunnel_id = ? ORDER BY created_at ASC`, tunnelID)
+	rows, err := s.db.Query(`SELECT `+routeColumns+` FROM l4_routes WHERE tunnel_id = ? ORDER BY created_at ASC`, tunnelID)
 	if err != nil {
 		return nil, fmt.Errorf("list routes by tunnel: %w", err)
 	}
@@ -126,7 +209,30 @@ func (s *RouteStore) ListByTunnelID(tunnelID string) ([]*Route, error) {
 
 	var routes []*Route
 	for rows.Next() {
-		r, err := scanRouteRows(rows)
+		r, err := scanRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return routes, rows.Err()
+}
+
+// ListOrphaned returns the routes whose tunnel is missing or soft-deleted.
+// Foreign keys and tunnel deletion normally prevent them; they are left by
+// manual database edits or restores of inconsistent backups.
+func (s *RouteStore) ListOrphaned() ([]*Route, error) {
+	rows, err := s.db.Query(`SELECT ` + routeColumns + ` FROM l4_routes
+		WHERE tunnel_id NOT IN (SELECT id FROM wg_peers WHERE deleted_at IS NULL)
+		ORDER BY created_at ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("list orphaned routes: %w", err)
+	}
+	defer rows.Close()
+
+	var routes []*Route
+	for rows.Next() {
+		r, err := scanRoute(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -135,6 +241,45 @@ func (s *RouteStore) ListByTunnelID(tunnelID string) ([]*Route, error) {
 	return routes, rows.Err()
 }
 
+// RetiredCaddyIDs returns the untagged Caddy @ids SNI routes had before
+// their @id was derived from the route ID. Caddy routes with these IDs were
+// created by the control plane and are removed by the reconciler.
+func (s *RouteStore) RetiredCaddyIDs() ([]string, error) {
+	rows, err := s.db.Query(`SELECT caddy_id FROM retired_caddy_ids`)
+	if err != nil {
+		return nil, fmt.Errorf("list retired caddy ids: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan retired caddy id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UpdatePriority changes a route's priority.
+func (s *RouteStore) UpdatePriority(id string, priority int) (*Route, error) {
+	r, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE l4_routes SET priority = ?, updated_at = ? WHERE id = ?`,
+		priority, now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update priority: %w", err)
+	}
+	r.Priority = priority
+	r.UpdatedAt = time.Unix(now, 0)
+	return r, nil
+}
+
 // Delete removes a route by ID.
 func (s *RouteStore) Delete(id string) error {
 	res, err := s.db.Exec(`DELETE FROM l4_routes WHERE id = ?`, id)
@@ -150,10 +295,15 @@ func (s *RouteStore) Delete(id string) error {
 
 // FindByPortAndProtocol checks if a route already uses a given listen_port + protocol.
 func (s *RouteStore) FindByPortAndProtocol(port int, protocol string) (*Route, error) {
-	row := s.db.QueryRow(`SELECT
-		id, tunnel_id, listen_port, protocol, match_type, match_value,
-		upstream, caddy_id, enabled, created_at, updated_at
-	FROM l4_routes WHERE listen_port = ? AND protocol = ? AND enabled = 1 LIMIT 1`, port, protocol)
+	return s.FindByPortRange(port, port, protocol)
+}
+
+// FindByPortRange returns an enabled route whose listen port, or port range,
+// overlaps start..end for protocol, or nil if there is none.
+func (s *RouteStore) FindByPortRange(start, end int, protocol string) (*Route, error) {
+	row := s.db.QueryRow(`SELECT `+routeColumns+` FROM l4_routes
+		WHERE protocol = ? AND enabled = 1 AND listen_port <= ? AND MAX(listen_port, listen_port_end) >= ?
+		ORDER BY listen_port LIMIT 1`, protocol, end, start)
 	r, err := scanRoute(row)
 	if err != nil {
 		if err.Error() == "route not found" {
@@ -170,17 +320,33 @@ func (s *RouteStore) DeleteByTunnelID(tunnelID string) error {
 	return err
 }
 
-func scanRoute(row *sql.Row) (*Route, error) {
+// TTLRemaining returns how long the route has left before it expires at
+// now, zero once it has, and false if it does not expire.
+func (r *Route) TTLRemaining(now time.Time) (time.Duration, bool) {
+	if r.ExpiresAt == nil {
+		return 0, false
+	}
+	return max(r.ExpiresAt.Sub(now), 0), true
+}
+
+// scanRoute scans a single route row selected with routeColumns.
+func scanRoute(row rowScanner) (*Route, error) {
 	r := &Route{}
 	var (
 		matchJSON            string
-		enabled              int
+		tenantID, proxyProto sql.NullString
+		nodeID, name         sql.NullString
+		enabled, quic, term  int
+		imported             int
 		createdAt, updatedAt int64
+		expiresAt            sql.NullInt64
 	)
 
 	err := row.Scan(
 		&r.ID, &r.TunnelID, &r.ListenPort, &r.Protocol, &r.MatchType, &matchJSON,
-		&r.Upstream, &r.CaddyID, &enabled, &createdAt, &updatedAt,
+		&r.Upstream, &r.CaddyID, &enabled, &createdAt, &updatedAt, &tenantID,
+		&proxyProto, &quic, &r.Priority, &term, &r.ListenPortEnd, &nodeID, &name, &expiresAt,
+		&imported,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -189,36 +355,20 @@ func scanRoute(row *sql.Row) (*Route, error) {
 		return nil, fmt.Errorf("scan route: %w", err)
 	}
 
-	fillRoute(r, matchJSON, enabled, createdAt, updatedAt)
-	return r, nil
-}
-
-func scanRouteRows(rows *sql.Rows) (*Route, error) {
-	r := &Route{}
-	var (
-		matchJSON            string
-		enabled              int
-		createdAt, updatedAt int64
-	)
-
-	err := rows.Scan(
-		&r.ID, &r.TunnelID, &r.ListenPort, &r.Protocol, &r.MatchType, &matchJSON,
-		&r.Upstream, &r.CaddyID, &enabled, &createdAt, &updatedAt,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("scan route row: %w", err)
-	}
-
-	fillRoute(r, matchJSON, enabled, createdAt, updatedAt)
-	return r, nil
-}
-
-func fillRoute(r *Route, matchJSON string, enabled int, createdAt, updatedAt int64) {
 	_ = json.Unmarshal([]byte(matchJSON), &r.MatchValue)
 	if r.MatchValue == nil {
 		r.MatchValue = []string{}
 	}
+	r.Name = name.String
+	r.TenantID = tenantID.String
+	r.ProxyProtocol = proxyProto.String
+	r.NodeID = nodeID.String
 	r.Enabled = enabled == 1
+	r.QUIC = quic == 1
+	r.TerminateTLS = term == 1
+	r.ExpiresAt = nullTime(expiresAt)
+	r.Imported = imported == 1
 	r.CreatedAt = time.Unix(createdAt, 0)
 	r.UpdatedAt = time.Unix(updatedAt, 0)
+	return r, nil
 }
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestRouteCRUD(t *testing.T) {
@@ -119,3 +121,225 @@ func TestRouteDeleteByTunnelID(t *testing.T) {
 		t.Errorf("expected 0 routes after delete, got %d", len(all))
 	}
 }
+
+func TestRouteDomainUniqueness(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+
+	ts.Create(&Tunnel{ID: "tun_1", PublicKey: "pk_1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	ts.Create(&Tunnel{ID: "tun_2", PublicKey: "pk_2", VpnIP: "10.0.0.3", Enabled: true, Domains: []string{}})
+	if err := rs.Create(&Route{ID: "r_1", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni", MatchValue: []string{"a.com", "b.com"}, Upstream: "10.0.0.2:443", Enabled: true}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+
+	// Another route cannot claim a domain, whatever its case
+	err := rs.Create(&Route{ID: "r_2", TunnelID: "tun_2", ListenPort: 443, MatchType: "sni", MatchValue: []string{"c.com", "B.com"}, Upstream: "10.0.0.3:443", Enabled: true})
+	if !errors.Is(err, ErrDomainInUse) {
+		t.Fatalf("expected ErrDomainInUse, got %v", err)
+	}
+	if _, err := rs.Get("r_2"); err == nil {
+		t.Error("the conflicting route should not be stored")
+	}
+
+	// Deleting the route, or soft-deleting its tunnel, frees its domains
+	if err := rs.Delete("r_1"); err != nil {
+		t.Fatalf("delete route: %v", err)
+	}
+	if err := rs.Create(&Route{ID: "r_2", TunnelID: "tun_2", ListenPort: 443, MatchType: "sni", MatchValue: []string{"b.com"}, Upstream: "10.0.0.3:443", Enabled: true}); err != nil {
+		t.Fatalf("create route after delete: %v", err)
+	}
+	if err := ts.SoftDelete("tun_2", time.Now()); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	if err := rs.Create(&Route{ID: "r_3", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni", MatchValue: []string{"b.com"}, Upstream: "10.0.0.2:443", Enabled: true}); err != nil {
+		t.Fatalf("create route after soft delete: %v", err)
+	}
+
+	// Restoring the tunnel would route b.com twice
+	if _, _, err := ts.Restore("tun_2", "psk_hash"); !errors.Is(err, ErrDomainInUse) {
+		t.Errorf("expected ErrDomainInUse restoring, got %v", err)
+	}
+}
+
+func TestRouteDomainClaims(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+	claimant := func(domain string) string {
+		t.Helper()
+		var id string
+		db.conn.QueryRow(`SELECT route_id FROM sni_domains WHERE domain = ?`, domain).Scan(&id)
+		return id
+	}
+
+	// A route awaiting approval does not hold its domain, so approving it
+	// fails once another route has taken the domain
+	ts.Create(&Tunnel{ID: "tun_p", PublicKey: "pk_p", VpnIP: "10.0.0.2", PendingApproval: true, Domains: []string{}})
+	ts.Create(&Tunnel{ID: "tun_e", PublicKey: "pk_e", VpnIP: "10.0.0.3", Enabled: true, Domains: []string{}})
+	if err := rs.Create(&Route{ID: "r_p", TunnelID: "tun_p", ListenPort: 443, MatchType: "sni", MatchValue: []string{"x.com"}, Upstream: "10.0.0.2:443"}); err != nil {
+		t.Fatalf("create pending route: %v", err)
+	}
+	if got := claimant("x.com"); got != "" {
+		t.Errorf("expected a disabled route to hold no domain, got %q", got)
+	}
+	if err := rs.Create(&Route{ID: "r_e", TunnelID: "tun_e", ListenPort: 443, MatchType: "sni", MatchValue: []string{"x.com"}, Upstream: "10.0.0.3:443", Enabled: true}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+	if _, err := ts.Approve("tun_p"); !errors.Is(err, ErrDomainInUse) {
+		t.Errorf("expected ErrDomainInUse approving, got %v", err)
+	}
+	rs.Delete("r_e")
+	if _, err := ts.Approve("tun_p"); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if got := claimant("x.com"); got != "r_p" {
+		t.Errorf("expected the approved route to claim its domain, got %q", got)
+	}
+
+	// Routes that shared a domain before it was unique: deleting the one
+	// holding the claim hands it to the other
+	if err := rs.Create(&Route{ID: "r_old", TunnelID: "tun_e", ListenPort: 443, MatchType: "sni", MatchValue: []string{"y.com"}, Upstream: "10.0.0.3:443", Enabled: true}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+	db.conn.Exec(`DELETE FROM sni_domains WHERE domain = 'y.com'`)
+	if err := rs.Create(&Route{ID: "r_new", TunnelID: "tun_p", ListenPort: 443, MatchType: "sni", MatchValue: []string{"y.com"}, Upstream: "10.0.0.2:443", Enabled: true}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+	db.conn.Exec(`UPDATE sni_domains SET route_id = 'r_old' WHERE domain = 'y.com'`)
+	if err := rs.Delete("r_old"); err != nil {
+		t.Fatalf("delete route: %v", err)
+	}
+	if got := claimant("y.com"); got != "r_new" {
+		t.Errorf("expected the remaining route to take the claim over, got %q", got)
+	}
+}
+
+func TestLegacyCaddyIDMigration(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+
+	// Routes as created when the @id came from the tunnel and port
+	ts.Create(&Tunnel{ID: "tun_1", PublicKey: "pk_1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	ts.Create(&Tunnel{ID: "tun_2", PublicKey: "pk_2", VpnIP: "10.0.0.3", Enabled: true, Domains: []string{}})
+	rs.Create(&Route{ID: "r_1", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni", MatchValue: []string{"a.com"}, Upstream: "10.0.0.2:443", CaddyID: "route-tun_1-443", Enabled: true})
+	rs.Create(&Route{ID: "r_2", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni", MatchValue: []string{"b.com"}, Upstream: "10.0.0.2:443", CaddyID: "pm-route-tun_1-443", Enabled: true})
+	rs.Create(&Route{ID: "r_3", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni", MatchValue: []string{"c.com"}, Upstream: "10.0.0.2:443", CaddyID: "legacy-c", Imported: true, Enabled: true})
+	rs.Create(&Route{ID: "r_4", TunnelID: "tun_2", ListenPort: 443, MatchType: "sni", MatchValue: []string{"d.com"}, Upstream: "10.0.0.3:443", CaddyID: "pm-route-tun_2-443", Enabled: true})
+	if err := ts.SoftDelete("tun_2", time.Now()); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+
+	// Apply the migration again, as on a database from before it
+	if _, err := db.conn.Exec(`DELETE FROM schema_version WHERE version >= 42`); err != nil {
+		t.Fatalf("reset schema version: %v", err)
+	}
+	if err := migrateUp(db.conn, migrations[:42]); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	for id, want := range map[string]string{"r_1": "pm-route-r_1", "r_2": "pm-route-r_2", "r_3": "legacy-c"} {
+		got, err := rs.Get(id)
+		if err != nil {
+			t.Fatalf("get %s: %v", id, err)
+		}
+		if got.CaddyID != want {
+			t.Errorf("%s: expected caddy id %s, got %s", id, want, got.CaddyID)
+		}
+	}
+	if _, routes, err := ts.GetDeleted("tun_2"); err != nil || len(routes) != 1 || routes[0].CaddyID != "pm-route-r_4" {
+		t.Errorf("expected snapshot route with pm-route-r_4, got %v (%v)", routes, err)
+	}
+
+	// Only the untagged @id needs remembering; tagged ones are ours anyway
+	retired, err := rs.RetiredCaddyIDs()
+	if err != nil {
+		t.Fatalf("retired caddy ids: %v", err)
+	}
+	if len(retired) != 1 || retired[0] != "route-tun_1-443" {
+		t.Errorf("expected [route-tun_1-443] retired, got %v", retired)
+	}
+}
+
+func TestRouteFindByPortRange(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+
+	ts.Create(&Tunnel{ID: "tun_pf", PublicKey: "pk_pf", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	rs.Create(&Route{ID: "r_single", TunnelID: "tun_pf", ListenPort: 25565, Protocol: "tcp", MatchType: "port_forward", Upstream: "10.0.0.2:25565", CaddyID: "pf-r_single", Enabled: true})
+	rs.Create(&Route{ID: "r_range", TunnelID: "tun_pf", ListenPort: 30000, ListenPortEnd: 30100, Protocol: "udp", MatchType: "port_forward", Upstream: "udp/10.0.0.2:30000", CaddyID: "pf-r_range", Enabled: true})
+
+	got, err := rs.Get("r_range")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.ListenPortEnd != 30100 {
+		t.Errorf("expected listen_port_end 30100, got %d", got.ListenPortEnd)
+	}
+
+	cases := []struct {
+		start, end int
+		protocol   string
+		want       string
+	}{
+		{30050, 30050, "udp", "r_range"},
+		{29990, 30000, "udp", "r_range"},
+		{30100, 30200, "udp", "r_range"},
+		{30101, 30200, "udp", ""},
+		{30050, 30050, "tcp", ""},
+		{25000, 26000, "tcp", "r_single"},
+		{25566, 25600, "tcp", ""},
+	}
+	for _, c := range cases {
+		r, err := rs.FindByPortRange(c.start, c.end, c.protocol)
+		if err != nil {
+			t.Fatalf("find %d-%d/%s: %v", c.start, c.end, c.protocol, err)
+		}
+		id := ""
+		if r != nil {
+			id = r.ID
+		}
+		if id != c.want {
+			t.Errorf("find %d-%d/%s: got %q, want %q", c.start, c.end, c.protocol, id, c.want)
+		}
+	}
+}
+
+func TestRouteListExpired(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+	ts.Create(&Tunnel{ID: "tun_ttl", PublicKey: "pk_ttl", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+
+	now := time.Unix(1700000000, 0)
+	expires := now.Add(30 * time.Minute)
+	rs.Create(&Route{ID: "route_ttl", TunnelID: "tun_ttl", ListenPort: 8080, MatchType: "port_forward", Upstream: "10.0.0.2:8080", Enabled: true, ExpiresAt: &expires})
+	rs.Create(&Route{ID: "route_keep", TunnelID: "tun_ttl", ListenPort: 8081, MatchType: "port_forward", Upstream: "10.0.0.2:8081", Enabled: true})
+
+	got, err := rs.Get("route_ttl")
+	if err != nil {
+		t.Fatalf("get route: %v", err)
+	}
+	if left, ok := got.TTLRemaining(now); !ok || left != 30*time.Minute {
+		t.Errorf("expected 30m remaining, got %v (ok=%v)", left, ok)
+	}
+	if keep, _ := rs.Get("route_keep"); keep.ExpiresAt != nil {
+		t.Errorf("expected no expiry, got %v", keep.ExpiresAt)
+	}
+
+	if expired, _ := rs.ListExpired(now); len(expired) != 0 {
+		t.Errorf("expected no expired routes yet, got %d", len(expired))
+	}
+	expired, err := rs.ListExpired(expires)
+	if err != nil {
+		t.Fatalf("list expired: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ID != "route_ttl" {
+		t.Errorf("expected route_ttl expired, got %+v", expired)
+	}
+	if left, _ := got.TTLRemaining(expires.Add(time.Minute)); left != 0 {
+		t.Errorf("expected no time left after expiry, got %v", left)
+	}
+}
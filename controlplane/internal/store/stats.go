@@ -0,0 +1,210 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// StatsBucket is the traffic a tunnel moved during one time bucket.
+type StatsBucket struct {
+	Start   time.Time
+	RxBytes int64
+	TxBytes int64
+}
+
+// RecordStatsSample stores the cumulative rx/tx counters of the peer with the
+// given public key at time at. Unknown public keys are ignored.
+func (s *TunnelStore) RecordStatsSample(publicKey string, rxBytes, txBytes int64, at time.Time) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO peer_stats_history (peer_id, sampled_at, rx_bytes, tx_bytes)
+		SELECT id, ?, ?, ? FROM wg_peers WHERE public_key = ?`, at.Unix(), rxBytes, txBytes, publicKey)
+	if err != nil {
+		return fmt.Errorf("record stats sample: %w", err)
+	}
+	return nil
+}
+
+// PruneStatsHistory deletes samples taken before the given time and returns how many were removed.
+func (s *TunnelStore) PruneStatsHistory(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM peer_stats_history WHERE sampled_at < ?`, before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("prune stats history: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// StatsHistory returns the traffic of a tunnel between from and to, summed into
+// buckets of the given resolution. Throughput is computed from the deltas
+// between consecutive samples; a counter that went backwards (the kernel peer
+// was re-added) counts from zero. Buckets without traffic are included.
+func (s *TunnelStore) StatsHistory(id string, from, to time.Time, resolution time.Duration) ([]StatsBucket, error) {
+	if resolution <= 0 {
+		return nil, fmt.Errorf("resolution must be positive")
+	}
+
+	// Include the last sample before the window so the first delta is known.
+	rows, err := s.db.Query(`SELECT sampled_at, rx_bytes, tx_bytes FROM peer_stats_history
+		WHERE peer_id = ? AND sampled_at <= ? AND sampled_at >= COALESCE(
+			(SELECT MAX(sampled_at) FROM peer_stats_history WHERE peer_id = ? AND sampled_at < ?), ?)
+		ORDER BY sampled_at ASC`, id, to.Unix(), id, from.Unix(), from.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query stats history: %w", err)
+	}
+	defer rows.Close()
+
+	start := from.Truncate(resolution)
+	n := int(to.Sub(start)/resolution) + 1
+	if n < 1 {
+		n = 1
+	}
+	buckets := make([]StatsBucket, n)
+	for i := range buckets {
+		buckets[i].Start = start.Add(time.Duration(i) * resolution)
+	}
+
+	var (
+		havePrev       bool
+		prevRx, prevTx int64
+	)
+	for rows.Next() {
+		var at, rx, tx int64
+		if err := rows.Scan(&at, &rx, &tx); err != nil {
+			return nil, fmt.Errorf("scan stats sample: %w", err)
+		}
+		if havePrev && at >= from.Unix() {
+			i := int(time.Unix(at, 0).Sub(start) / resolution)
+			if i >= 0 && i < n {
+				buckets[i].RxBytes += counterDelta(prevRx, rx)
+				buckets[i].TxBytes += counterDelta(prevTx, tx)
+			}
+		}
+		havePrev, prevRx, prevTx = true, rx, tx
+	}
+	return buckets, rows.Err()
+}
+
+func counterDelta(prev, cur int64) int64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// RouteStatsSample is a route's upstream connections at one point in time.
+type RouteStatsSample struct {
+	SampledAt   time.Time
+	ActiveConns int
+	RxBytes     int64 // cumulative, received from the upstream
+	TxBytes     int64 // cumulative, sent to the upstream
+}
+
+// RouteStatsBucket is the traffic of a route during one time bucket, with
+// the most connections it had open at once.
+type RouteStatsBucket struct {
+	Start          time.Time
+	RxBytes        int64
+	TxBytes        int64
+	MaxActiveConns int
+}
+
+// RecordStatsSample stores the open connections and cumulative byte counters
+// of a route's upstream at time at.
+func (s *RouteStore) RecordStatsSample(id string, activeConns int, rxBytes, txBytes int64, at time.Time) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO route_stats_history (route_id, sampled_at, active_conns, rx_bytes, tx_bytes)
+		VALUES (?, ?, ?, ?, ?)`, id, at.Unix(), activeConns, rxBytes, txBytes)
+	if err != nil {
+		return fmt.Errorf("record route stats sample: %w", err)
+	}
+	return nil
+}
+
+// PruneStatsHistory deletes route samples taken before the given time and returns how many were removed.
+func (s *RouteStore) PruneStatsHistory(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM route_stats_history WHERE sampled_at < ?`, before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("prune route stats history: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// LatestStats returns the newest sample of every route that has one, keyed
+// by route ID.
+func (s *RouteStore) LatestStats() (map[string]RouteStatsSample, error) {
+	rows, err := s.db.Query(`SELECT h.route_id, h.sampled_at, h.active_conns, h.rx_bytes, h.tx_bytes
+		FROM route_stats_history h
+		JOIN (SELECT route_id, MAX(sampled_at) AS sampled_at FROM route_stats_history GROUP BY route_id) latest
+		ON latest.route_id = h.route_id AND latest.sampled_at = h.sampled_at`)
+	if err != nil {
+		return nil, fmt.Errorf("query latest route stats: %w", err)
+	}
+	defer rows.Close()
+
+	latest := make(map[string]RouteStatsSample)
+	for rows.Next() {
+		var (
+			id     string
+			at     int64
+			sample RouteStatsSample
+		)
+		if err := rows.Scan(&id, &at, &sample.ActiveConns, &sample.RxBytes, &sample.TxBytes); err != nil {
+			return nil, fmt.Errorf("scan route stats sample: %w", err)
+		}
+		sample.SampledAt = time.Unix(at, 0)
+		latest[id] = sample
+	}
+	return latest, rows.Err()
+}
+
+// StatsHistory returns the traffic of a route between from and to, summed
+// into buckets of the given resolution, like TunnelStore.StatsHistory.
+func (s *RouteStore) StatsHistory(id string, from, to time.Time, resolution time.Duration) ([]RouteStatsBucket, error) {
+	if resolution <= 0 {
+		return nil, fmt.Errorf("resolution must be positive")
+	}
+
+	rows, err := s.db.Query(`SELECT sampled_at, active_conns, rx_bytes, tx_bytes FROM route_stats_history
+		WHERE route_id = ? AND sampled_at <= ? AND sampled_at >= COALESCE(
+			(SELECT MAX(sampled_at) FROM route_stats_history WHERE route_id = ? AND sampled_at < ?), ?)
+		ORDER BY sampled_at ASC`, id, to.Unix(), id, from.Unix(), from.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query route stats history: %w", err)
+	}
+	defer rows.Close()
+
+	start := from.Truncate(resolution)
+	n := int(to.Sub(start)/resolution) + 1
+	if n < 1 {
+		n = 1
+	}
+	buckets := make([]RouteStatsBucket, n)
+	for i := range buckets {
+		buckets[i].Start = start.Add(time.Duration(i) * resolution)
+	}
+
+	var (
+		havePrev       bool
+		prevRx, prevTx int64
+	)
+	for rows.Next() {
+		var (
+			at, rx, tx int64
+			active     int
+		)
+		if err := rows.Scan(&at, &active, &rx, &tx); err != nil {
+			return nil, fmt.Errorf("scan route stats sample: %w", err)
+		}
+		if at >= from.Unix() {
+			i := int(time.Unix(at, 0).Sub(start) / resolution)
+			if i >= 0 && i < n {
+				if havePrev {
+					buckets[i].RxBytes += counterDelta(prevRx, rx)
+					buckets[i].TxBytes += counterDelta(prevTx, tx)
+				}
+				buckets[i].MaxActiveConns = max(buckets[i].MaxActiveConns, active)
+			}
+		}
+		havePrev, prevRx, prevTx = true, rx, tx
+	}
+	return buckets, rows.Err()
+}
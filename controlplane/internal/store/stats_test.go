@@ -0,0 +1,135 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsHistory(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+
+	if err := ts.Create(&Tunnel{ID: "tun_stats", PublicKey: "statskey=", VpnIP: "10.0.0.9", Enabled: true}); err != nil {
+		t.Fatalf("create tunnel: %v", err)
+	}
+
+	base := time.Unix(1_700_000_000, 0).Truncate(time.Hour)
+	samples := []struct {
+		offset time.Duration
+		rx, tx int64
+	}{
+		{-10 * time.Minute, 100, 10}, // before the window: baseline only
+		{10 * time.Minute, 300, 20},  // bucket 0: +200/+10
+		{50 * time.Minute, 400, 40},  // bucket 0: +100/+20
+		{70 * time.Minute, 50, 5},    // bucket 1: counter reset, +50/+5
+	}
+	for _, s := range samples {
+		if err := ts.RecordStatsSample("statskey=", s.rx, s.tx, base.Add(s.offset)); err != nil {
+			t.Fatalf("record sample: %v", err)
+		}
+	}
+	// Unknown peers are ignored
+	if err := ts.RecordStatsSample("unknown=", 1, 1, base); err != nil {
+		t.Fatalf("record unknown sample: %v", err)
+	}
+
+	buckets, err := ts.StatsHistory("tun_stats", base, base.Add(2*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatalf("stats history: %v", err)
+	}
+	if len(buckets) != 3 {
+		t.Fatalf("expected 3 buckets, got %d", len(buckets))
+	}
+	if buckets[0].RxBytes != 300 || buckets[0].TxBytes != 30 {
+		t.Errorf("bucket 0: expected 300/30, got %d/%d", buckets[0].RxBytes, buckets[0].TxBytes)
+	}
+	if buckets[1].RxBytes != 50 || buckets[1].TxBytes != 5 {
+		t.Errorf("bucket 1: expected 50/5, got %d/%d", buckets[1].RxBytes, buckets[1].TxBytes)
+	}
+	if buckets[2].RxBytes != 0 || !buckets[2].Start.Equal(base.Add(2*time.Hour)) {
+		t.Errorf("bucket 2: unexpected %+v", buckets[2])
+	}
+
+	// Prune
+	n, err := ts.PruneStatsHistory(base)
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 pruned sample, got %d", n)
+	}
+
+	// History is removed with the tunnel
+	if err := ts.Delete("tun_stats"); err != nil {
+		t.Fatalf("delete tunnel: %v", err)
+	}
+	var count int
+	db.Conn().QueryRow(`SELECT COUNT(*) FROM peer_stats_history`).Scan(&count)
+	if count != 0 {
+		t.Errorf("expected history to cascade, %d samples left", count)
+	}
+}
+
+func TestRouteStatsHistory(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+	ts.Create(&Tunnel{ID: "tun_1", PublicKey: "pk=", VpnIP: "10.0.0.2", Enabled: true})
+	if err := rs.Create(&Route{ID: "route_1", TunnelID: "tun_1", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"a.example.com"}, Upstream: "10.0.0.2:443", CaddyID: "route-route_1", Enabled: true}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+
+	base := time.Unix(1_700_000_000, 0).Truncate(time.Hour)
+	samples := []struct {
+		offset time.Duration
+		active int
+		rx, tx int64
+	}{
+		{-10 * time.Minute, 1, 100, 10}, // before the window: baseline only
+		{10 * time.Minute, 4, 300, 20},  // bucket 0: +200/+10
+		{50 * time.Minute, 2, 400, 40},  // bucket 0: +100/+20
+		{70 * time.Minute, 1, 50, 5},    // bucket 1: tracker restarted, +50/+5
+	}
+	for _, s := range samples {
+		if err := rs.RecordStatsSample("route_1", s.active, s.rx, s.tx, base.Add(s.offset)); err != nil {
+			t.Fatalf("record sample: %v", err)
+		}
+	}
+
+	latest, err := rs.LatestStats()
+	if err != nil {
+		t.Fatalf("latest stats: %v", err)
+	}
+	if got := latest["route_1"]; got.ActiveConns != 1 || got.RxBytes != 50 || !got.SampledAt.Equal(base.Add(70*time.Minute)) {
+		t.Errorf("unexpected latest sample %+v", got)
+	}
+
+	buckets, err := rs.StatsHistory("route_1", base, base.Add(2*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatalf("stats history: %v", err)
+	}
+	if len(buckets) != 3 {
+		t.Fatalf("expected 3 buckets, got %d", len(buckets))
+	}
+	if buckets[0].RxBytes != 300 || buckets[0].TxBytes != 30 || buckets[0].MaxActiveConns != 4 {
+		t.Errorf("bucket 0: expected 300/30 with 4 connections, got %+v", buckets[0])
+	}
+	if buckets[1].RxBytes != 50 || buckets[1].TxBytes != 5 || buckets[1].MaxActiveConns != 1 {
+		t.Errorf("bucket 1: expected 50/5 with 1 connection, got %+v", buckets[1])
+	}
+
+	if n, err := rs.PruneStatsHistory(base); err != nil || n != 1 {
+		t.Errorf("expected 1 pruned sample, got %d (%v)", n, err)
+	}
+
+	// History is removed with the route
+	if err := rs.Delete("route_1"); err != nil {
+		t.Fatalf("delete route: %v", err)
+	}
+	var count int
+	db.Conn().QueryRow(`SELECT COUNT(*) FROM route_stats_history`).Scan(&count)
+	if count != 0 {
+		t.Errorf("expected history to cascade, %d samples left", count)
+	}
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Tenant represents an isolated owner of tunnels, routes, and firewall rules.
+// A client is mapped to a tenant either by its mTLS certificate CN or by an API token.
+type Tenant struct {
+	ID         string
+	Name       string
+	ClientCN   string
+	TokenHash  string
+	TokenScope string // role granted to the API token: "operator" or "read-only"
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// TenantStore provides CRUD operations for tenants.
+type TenantStore struct {
+	db *sql.DB
+}
+
+// NewTenantStore creates a TenantStore using the given DB.
+func NewTenantStore(db *DB) *TenantStore {
+	return &TenantStore{db: db.Conn()}
+}
+
+const tenantColumns = `id, name, client_cn, token_hash, created_at, updated_at, token_scope`
+
+// Create inserts a new tenant.
+func (s *TenantStore) Create(t *Tenant) error {
+	if t.TokenScope == "" {
+		t.TokenScope = "operator"
+	}
+	now := time.Now().Unix()
+	_, err := s.db.Exec(`INSERT INTO tenants (`+tenantColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Name, nullString(t.ClientCN), nullString(t.TokenHash), now, now, t.TokenScope)
+	if err != nil {
+		return fmt.Errorf("insert tenant: %w", err)
+	}
+	t.CreatedAt = time.Unix(now, 0)
+	t.UpdatedAt = time.Unix(now, 0)
+	return nil
+}
+
+// Get retrieves a tenant by ID.
+func (s *TenantStore) Get(id string) (*Tenant, error) {
+	row := s.db.QueryRow(`SELECT `+tenantColumns+` FROM tenants WHERE id = ?`, id)
+	return scanTenant(row)
+}
+
+// GetByClientCN retrieves the tenant mapped to an mTLS client certificate CN.
+func (s *TenantStore) GetByClientCN(cn string) (*Tenant, error) {
+	row := s.db.QueryRow(`SELECT `+tenantColumns+` FROM tenants WHERE client_cn = ?`, cn)
+	return scanTenant(row)
+}
+
+// GetByTokenHash retrieves the tenant owning the API token with the given hash.
+func (s *TenantStore) GetByTokenHash(hash string) (*Tenant, error) {
+	row := s.db.QueryRow(`SELECT `+tenantColumns+` FROM tenants WHERE token_hash = ?`, hash)
+	return scanTenant(row)
+}
+
+// List returns all tenants.
+func (s *TenantStore) List() ([]*Tenant, error) {
+	rows, err := s.db.Query(`SELECT ` + tenantColumns + ` FROM tenants ORDER BY created_at ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("list tenants: %w", err)
+	}
+	defer rows.Close()
+
+	var tenants []*Tenant
+	for rows.Next() {
+		t, err := scanTenant(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+// CountResources returns how many tunnels, routes, and firewall rules a tenant owns.
+// Soft-deleted tunnels count, since they can still be restored into it.
+func (s *TenantStore) CountResources(id string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM wg_peers WHERE tenant_id = ?) +
+		(SELECT COUNT(*) FROM l4_routes WHERE tenant_id = ?) +
+		(SELECT COUNT(*) FROM firewall_rules WHERE tenant_id = ?)`, id, id, id).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("count tenant resources: %w", err)
+	}
+	return n, nil
+}
+
+// Delete removes a tenant by ID.
+func (s *TenantStore) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM tenants WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete tenant: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return fmt.Errorf("tenant not found: %s", id)
+	}
+	if _, err := s.db.Exec(`DELETE FROM policies WHERE tenant_id = ?`, id); err != nil {
+		return fmt.Errorf("delete tenant policy: %w", err)
+	}
+	return nil
+}
+
+func scanTenant(row rowScanner) (*Tenant, error) {
+	t := &Tenant{}
+	var (
+		clientCN, tokenHash  sql.NullString
+		createdAt, updatedAt int64
+	)
+	err := row.Scan(&t.ID, &t.Name, &clientCN, &tokenHash, &createdAt, &updatedAt, &t.TokenScope)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("tenant not found")
+		}
+		return nil, fmt.Errorf("scan tenant: %w", err)
+	}
+	t.ClientCN = clientCN.String
+	t.TokenHash = tokenHash.String
+	t.CreatedAt = time.Unix(createdAt, 0)
+	t.UpdatedAt = time.Unix(updatedAt, 0)
+	return t, nil
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestTenantCRUD(t *testing.T) {
+	db := setupTestDB(t)
+	tns := NewTenantStore(db)
+	ts := NewTunnelStore(db)
+
+	if err := tns.Create(&Tenant{ID: "tnt_1", Name: "team-a", ClientCN: "team-a-client", TokenHash: "abc"}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+
+	got, err := tns.GetByClientCN("team-a-client")
+	if err != nil {
+		t.Fatalf("get by cn: %v", err)
+	}
+	if got.ID != "tnt_1" {
+		t.Errorf("expected tnt_1, got %s", got.ID)
+	}
+	if _, err := tns.GetByTokenHash("abc"); err != nil {
+		t.Errorf("get by token hash: %v", err)
+	}
+
+	// Duplicate names are rejected
+	if err := tns.Create(&Tenant{ID: "tnt_2", Name: "team-a"}); err == nil {
+		t.Error("expected error for duplicate tenant name")
+	}
+
+	ts.Create(&Tunnel{ID: "tun_t1", PublicKey: "pk_t1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}, TenantID: "tnt_1"})
+	n, err := tns.CountResources("tnt_1")
+	if err != nil {
+		t.Fatalf("count resources: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 resource, got %d", n)
+	}
+
+	tun, _ := ts.Get("tun_t1")
+	if tun.TenantID != "tnt_1" {
+		t.Errorf("expected tunnel tenant tnt_1, got %q", tun.TenantID)
+	}
+
+	if err := tns.Delete("tnt_1"); err != nil {
+		t.Fatalf("delete tenant: %v", err)
+	}
+	if err := tns.Delete("tnt_1"); err == nil {
+		t.Error("expected error deleting missing tenant")
+	}
+}
+
+func TestPolicyCRUD(t *testing.T) {
+	db := setupTestDB(t)
+	tns := NewTenantStore(db)
+
+	if err := tns.Create(&Tenant{ID: "tnt_1", Name: "team-a"}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	if _, err := tns.GetPolicy(""); err == nil {
+		t.Error("expected error for missing global policy")
+	}
+
+	if err := tns.SetPolicy(&Policy{PortRanges: []PortRange{{Start: 1024, End: 65535}}, UpdatedBy: "admin"}); err != nil {
+		t.Fatalf("set global policy: %v", err)
+	}
+	if err := tns.SetPolicy(&Policy{TenantID: "tnt_1", DomainSuffixes: []string{"a.example.com"}}); err != nil {
+		t.Fatalf("set tenant policy: %v", err)
+	}
+	// Setting a policy again replaces it
+	if err := tns.SetPolicy(&Policy{TenantID: "tnt_1", DomainSuffixes: []string{"team-a.example.com"}, ForbiddenCIDRs: []string{"10.10.0.0/16"}}); err != nil {
+		t.Fatalf("replace tenant policy: %v", err)
+	}
+
+	policies, err := tns.ListPolicies()
+	if err != nil {
+		t.Fatalf("list policies: %v", err)
+	}
+	if len(policies) != 2 || policies[0].TenantID != "" || policies[1].TenantID != "tnt_1" {
+		t.Fatalf("expected global then tnt_1, got %+v", policies)
+	}
+	if got := policies[0]; len(got.PortRanges) != 1 || !got.PortRanges[0].Contains(8080) || got.PortRanges[0].Contains(80) || got.UpdatedBy != "admin" {
+		t.Errorf("unexpected global policy: %+v", got)
+	}
+	if got := policies[1]; len(got.DomainSuffixes) != 1 || got.DomainSuffixes[0] != "team-a.example.com" || len(got.ForbiddenCIDRs) != 1 {
+		t.Errorf("unexpected tenant policy: %+v", got)
+	}
+
+	// A tenant's policy goes with it
+	if err := tns.Delete("tnt_1"); err != nil {
+		t.Fatalf("delete tenant: %v", err)
+	}
+	if _, err := tns.GetPolicy("tnt_1"); err == nil {
+		t.Error("expected tenant policy to be deleted with the tenant")
+	}
+	if err := tns.DeletePolicy(""); err != nil {
+		t.Fatalf("delete global policy: %v", err)
+	}
+	if err := tns.DeletePolicy(""); err == nil {
+		t.Error("expected error deleting missing policy")
+	}
+}
@@ -1,15 +1,22 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
 	"time"
 )
 
 // Tunnel represents a WireGuard peer in the database.
 type Tunnel struct {
 	ID                      string
+	Name                    string // caller-supplied, unique per tenant; "" if unnamed
 	PublicKey               string
 	VpnIP                   string
 	PSKHash                 string
@@ -26,26 +33,217 @@ type Tunnel struct {
 	GracePeriodMinutes      int
 	LastRotationAt          *time.Time
 	PendingRotationID       string
+	Labels                  map[string]string
+	TenantID                string
+	RevokeDeferredUntil     *time.Time // inactivity revocation is postponed until at least this time
+	ExpiryWarnedAt          *time.Time // when the pre-revocation warning was last sent
+	SourceCIDR              string     // if set, the peer may only connect from addresses in this CIDR
+	Isolate                 bool       // if set, the peer cannot exchange traffic with other peers
+	ServerKey               bool       // the server generated the key pair (Flow A) rather than the client
+	ClientKey               bool       // the client supplied its public key (Flow B); neither is set on tunnels created before this was recorded
+	NodeID                  string     // remote node serving the tunnel; empty for this host
+	PendingPSK              string     // PSK not yet applied: awaiting approval, or unconfirmed by a node serving the tunnel
+	FailoverNodeIDs         []string   // further nodes serving the tunnel, in failover order
+	PersistentKeepalive     *int       // seconds, 0 = disabled; nil uses the global default
+	ConnectedThreshold      *int       // seconds; nil uses the global default
+	ClientRouting           string     // AllowedIPs mode of client configs: "split" (or empty), "subnet", or "full"
+	ClientDNS               []string   // DNS of client configs; nil uses the default
+	ClientMTU               int        // MTU of client configs; 0 leaves it to the client
+	AdvertisedRoutes        []string   // LAN prefixes behind the peer, added to its AllowedIPs and routed to it
+	Description             string     // free-form notes
+	OwnerEmail              string     // who to contact about the peer
+	DeviceName              string     // the device the peer runs on
+	ExpiresAt               *time.Time // the reconciler disables the tunnel at this time
+	ExpiryDateWarnedAt      *time.Time // when the warning before ExpiresAt was sent
+	PendingApproval         bool       // created disabled, waiting for an admin to approve it
+	Imported                bool       // adopted from a peer already in the kernel, not created through the API
+	DeletedAt               *time.Time // set while the tunnel is soft-deleted and can still be restored
 	CreatedAt               time.Time
 	UpdatedAt               time.Time
+
+	// AllowedUpstreamPorts are the ports routes may forward to on the peer,
+	// also enforced in nftables; empty allows any.
+	AllowedUpstreamPorts []PortRange
+}
+
+// tunnelColumns is the column list shared by every wg_peers SELECT; scanTunnel
+// expects columns in exactly this order.
+const tunnelColumns = `id, public_key, vpn_ip, psk_hash, endpoint, domains, enabled,
+		last_handshake, tx_bytes, rx_bytes,
+		auto_rotate_psk, psk_rotation_interval_days,
+		auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
+		last_rotation_at, pending_rotation_id, created_at, updated_at,
+		labels, tenant_id, revoke_deferred_until, expiry_warned_at,
+		source_cidr, isolate, node_id, pending_psk, failover_node_ids,
+		persistent_keepalive, connected_threshold, client_routing, client_dns, client_mtu,
+		advertised_routes, deleted_at, name, server_key,
+		description, owner_email, device_name, expires_at, expires_at_warned_at,
+		pending_approval, imported, allowed_upstream_ports, client_key`
+
+// DefaultConnectedThreshold is how recent a peer's last handshake must be
+// for the peer to count as connected, unless configured otherwise.
+// WireGuard renews handshakes every two minutes while a peer is active.
+const DefaultConnectedThreshold = 5 * time.Minute
+
+// Keepalive returns the tunnel's persistent keepalive interval, or def if
+// the tunnel does not set one.
+func (t *Tunnel) Keepalive(def time.Duration) time.Duration {
+	if t.PersistentKeepalive == nil {
+		return def
+	}
+	return time.Duration(*t.PersistentKeepalive) * time.Second
+}
+
+// ConnectedWithin returns how recent the tunnel's last handshake must be for
+// its peer to count as connected, or def if the tunnel does not set it.
+func (t *Tunnel) ConnectedWithin(def time.Duration) time.Duration {
+	if t.ConnectedThreshold == nil {
+		return def
+	}
+	return time.Duration(*t.ConnectedThreshold) * time.Second
+}
+
+// Connected reports whether the tunnel's peer has handshaken within its
+// connected threshold of now; def is the threshold used when the tunnel
+// does not set one.
+func (t *Tunnel) Connected(now time.Time, def time.Duration) bool {
+	return t.LastHandshake != nil && now.Sub(*t.LastHandshake) < t.ConnectedWithin(def)
 }
 
 // TunnelStore provides CRUD operations for wg_peers.
 type TunnelStore struct {
-	db *sql.DB
+	db    *conn
+	cache *listCache[*Tunnel]
 }
 
 // NewTunnelStore creates a TunnelStore using the given DB.
 func NewTunnelStore(db *DB) *TunnelStore {
-	return &TunnelStore{db: db.Conn()}
+	return &TunnelStore{db: newConn(db), cache: db.tunnels}
+}
+
+// WithContext returns a copy of the store whose queries end when ctx is
+// done, such as when an API client goes away.
+func (s *TunnelStore) WithContext(ctx context.Context) *TunnelStore {
+	return &TunnelStore{db: s.db.withContext(ctx), cache: s.cache}
 }
 
-// Create inserts a new tunnel into the database.
+// ErrIPAllocated is returned when a tunnel's VPN IP is already allocated to
+// another tunnel.
+var ErrIPAllocated = errors.New("vpn ip is already allocated")
+
+// ErrNameInUse is returned when another resource of the same kind and tenant
+// already has the name.
+var ErrNameInUse = errors.New("name is already in use")
+
+// ErrDomainInUse is returned when another SNI route already routes one of a
+// route's domains.
+var ErrDomainInUse = errors.New("domain is already routed by another route")
+
+// ErrNotPending is returned when approving a tunnel that is not awaiting
+// approval.
+var ErrNotPending = errors.New("tunnel is not awaiting approval")
+
+// ErrNoFreeIP is returned when every address pool is full.
+var ErrNoFreeIP = errors.New("no available IP addresses")
+
+// maxAllocationAttempts bounds how often CreateWithAllocatedIP retries after
+// another writer took the address it picked.
+const maxAllocationAttempts = 5
+
+// Create inserts a new tunnel into the database. It returns ErrIPAllocated
+// if the tunnel's VPN IP is taken.
 func (s *TunnelStore) Create(t *Tunnel) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertTunnel(tx.Tx, t); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// CreateWithAllocatedIP assigns t the lowest free address of pools (see
+// AllocateIP) and inserts it in the same transaction, so concurrent creates
+// never get the same address. If another process takes the address first,
+// the insert fails on the unique constraint and is retried.
+func (s *TunnelStore) CreateWithAllocatedIP(t *Tunnel, serverIP string, pools []netip.Prefix) error {
+	for attempt := 0; attempt < maxAllocationAttempts; attempt++ {
+		err := s.createWithAllocatedIP(t, serverIP, pools)
+		if !errors.Is(err, ErrIPAllocated) {
+			return err
+		}
+	}
+	return fmt.Errorf("allocate vpn ip: gave up after %d attempts: %w", maxAllocationAttempts, ErrIPAllocated)
+}
+
+func (s *TunnelStore) createWithAllocatedIP(t *Tunnel, serverIP string, pools []netip.Prefix) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	ip, err := allocateIP(tx, serverIP, pools)
+	if err != nil {
+		return err
+	}
+	t.VpnIP = ip
+	if err := insertTunnel(tx.Tx, t); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// insertTunnel inserts t and its ip_allocations row within tx.
+func insertTunnel(tx *sql.Tx, t *Tunnel) error {
 	domainsJSON, err := json.Marshal(t.Domains)
 	if err != nil {
 		return fmt.Errorf("marshal domains: %w", err)
 	}
+	if t.Labels == nil {
+		t.Labels = map[string]string{}
+	}
+	labelsJSON, err := json.Marshal(t.Labels)
+	if err != nil {
+		return fmt.Errorf("marshal labels: %w", err)
+	}
+	var failoverJSON string
+	if len(t.FailoverNodeIDs) > 0 {
+		b, err := json.Marshal(t.FailoverNodeIDs)
+		if err != nil {
+			return fmt.Errorf("marshal failover nodes: %w", err)
+		}
+		failoverJSON = string(b)
+	}
+	var dnsJSON string
+	if t.ClientDNS != nil {
+		b, err := json.Marshal(t.ClientDNS)
+		if err != nil {
+			return fmt.Errorf("marshal client dns: %w", err)
+		}
+		dnsJSON = string(b)
+	}
+	var routesJSON string
+	if len(t.AdvertisedRoutes) > 0 {
+		b, err := json.Marshal(t.AdvertisedRoutes)
+		if err != nil {
+			return fmt.Errorf("marshal advertised routes: %w", err)
+		}
+		routesJSON = string(b)
+	}
+	portsJSON, err := upstreamPortsJSON(t.AllowedUpstreamPorts)
+	if err != nil {
+		return err
+	}
 
 	now := time.Now().Unix()
 	var lastHandshake *int64
@@ -59,13 +257,17 @@ func (s *TunnelStore) Create(t *Tunnel) error {
 		lastRotation = &v
 	}
 
-	_, err = s.db.Exec(`INSERT INTO wg_peers (
+	_, err = tx.Exec(`INSERT INTO wg_peers (
 		id, public_key, vpn_ip, psk_hash, endpoint, domains, enabled,
 		last_handshake, tx_bytes, rx_bytes,
 		auto_rotate_psk, psk_rotation_interval_days,
 		auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
-		last_rotation_at, pending_rotation_id, created_at, updated_at
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		last_rotation_at, pending_rotation_id, created_at, updated_at,
+		labels, tenant_id, source_cidr, isolate, node_id, pending_psk, failover_node_ids,
+		persistent_keepalive, connected_threshold, client_routing, client_dns, client_mtu,
+		advertised_routes, name, server_key, description, owner_email, device_name,
+		expires_at, pending_approval, imported, allowed_upstream_ports, client_key
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		t.ID, t.PublicKey, t.VpnIP, nullString(t.PSKHash), nullString(t.Endpoint),
 		string(domainsJSON), boolToInt(t.Enabled),
 		lastHandshake, t.TxBytes, t.RxBytes,
@@ -73,48 +275,116 @@ func (s *TunnelStore) Create(t *Tunnel) error {
 		boolToInt(t.AutoRevokeInactive), t.InactiveExpiryDays, t.GracePeriodMinutes,
 		lastRotation, nullString(t.PendingRotationID),
 		now, now,
+		string(labelsJSON), nullString(t.TenantID), nullString(t.SourceCIDR),
+		boolToInt(t.Isolate), nullString(t.NodeID), nullString(t.PendingPSK),
+		nullString(failoverJSON), t.PersistentKeepalive, t.ConnectedThreshold,
+		nullString(t.ClientRouting), nullString(dnsJSON), nullInt(t.ClientMTU),
+		nullString(routesJSON), nullString(t.Name), boolToInt(t.ServerKey),
+		nullString(t.Description), nullString(t.OwnerEmail), nullString(t.DeviceName),
+		nullUnix(t.ExpiresAt), boolToInt(t.PendingApproval), boolToInt(t.Imported),
+		nullString(portsJSON), boolToInt(t.ClientKey),
 	)
+	if isIPConflict(err) {
+		return fmt.Errorf("insert tunnel: %s: %w", t.VpnIP, ErrIPAllocated)
+	}
+	if isNameConflict(err) {
+		return fmt.Errorf("insert tunnel: %s: %w", t.Name, ErrNameInUse)
+	}
 	if err != nil {
 		return fmt.Errorf("insert tunnel: %w", err)
 	}
+	_, err = tx.Exec(`INSERT INTO ip_allocations (ip, tunnel_id, allocated_at) VALUES (?, ?, ?)`,
+		t.VpnIP, t.ID, now)
+	if isIPConflict(err) {
+		return fmt.Errorf("record ip allocation: %s: %w", t.VpnIP, ErrIPAllocated)
+	}
+	if err != nil {
+		return fmt.Errorf("record ip allocation: %w", err)
+	}
 	t.CreatedAt = time.Unix(now, 0)
 	t.UpdatedAt = time.Unix(now, 0)
 	return nil
 }
 
-// Get retrieves a tunnel by ID.
+// Get retrieves a tunnel by ID. Soft-deleted tunnels are not found.
 func (s *TunnelStore) Get(id string) (*Tunnel, error) {
-	row := s.db.QueryRow(`SELECT
-		id, public_key, vpn_ip, psk_hash, endpoint, domains, enabled,
-		last_handshake, tx_bytes, rx_bytes,
-		auto_rotate_psk, psk_rotation_interval_days,
-		auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
-		last_rotation_at, pending_rotation_id, created_at, updated_at
-	FROM wg_peers WHERE id = ?`, id)
+	row := s.db.QueryRow(`SELECT `+tunnelColumns+` FROM wg_peers WHERE id = ? AND deleted_at IS NULL`, id)
 	return scanTunnel(row)
 }
 
-// GetByPublicKey retrieves a tunnel by its WireGuard public key.
+// GetByName retrieves a tenant's tunnel by name, including a soft-deleted
+// one, which still holds the name.
+func (s *TunnelStore) GetByName(tenantID, name string) (*Tunnel, error) {
+	row := s.db.QueryRow(`SELECT `+tunnelColumns+` FROM wg_peers WHERE IFNULL(tenant_id, '') = ? AND name = ?`, tenantID, name)
+	return scanTunnel(row)
+}
+
+// GetByPublicKey retrieves a tunnel by its WireGuard public key, including a
+// soft-deleted one, which still holds the key.
 func (s *TunnelStore) GetByPublicKey(pubkey string) (*Tunnel, error) {
-	row := s.db.QueryRow(`SELECT
-		id, public_key, vpn_ip, psk_hash, endpoint, domains, enabled,
-		last_handshake, tx_bytes, rx_bytes,
-		auto_rotate_psk, psk_rotation_interval_days,
-		auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
-		last_rotation_at, pending_rotation_id, created_at, updated_at
-	FROM wg_peers WHERE public_key = ?`, pubkey)
+	row := s.db.QueryRow(`SELECT `+tunnelColumns+` FROM wg_peers WHERE public_key = ?`, pubkey)
 	return scanTunnel(row)
 }
 
-// List returns all tunnels.
+// List returns all tunnels except soft-deleted ones.
 func (s *TunnelStore) List() ([]*Tunnel, error) {
-	rows, err := s.db.Query(`SELECT
-		id, public_key, vpn_ip, psk_hash, endpoint, domains, enabled,
-		last_handshake, tx_bytes, rx_bytes,
-		auto_rotate_psk, psk_rotation_interval_days,
-		auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
-		last_rotation_at, pending_rotation_id, created_at, updated_at
-	FROM wg_peers ORDER BY created_at ASC`)
+	tunnels, err := s.cache.list(s.db, s.list)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.refreshStats(tunnels); err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+// refreshStats overwrites the columns whose writes do not bump the
+// wg_peers version (stats, endpoint, and updated_at) with their current
+// values, which a cached listing may predate. Reading them alone is much
+// cheaper than reloading the listing on every stats pass.
+func (s *TunnelStore) refreshStats(tunnels []*Tunnel) error {
+	if len(tunnels) == 0 {
+		return nil
+	}
+	byID := make(map[string]*Tunnel, len(tunnels))
+	for _, t := range tunnels {
+		byID[t.ID] = t
+	}
+	rows, err := s.db.Query(`SELECT id, endpoint, last_handshake, tx_bytes, rx_bytes, updated_at
+		FROM wg_peers WHERE deleted_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("list tunnel stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id               string
+			endpoint         sql.NullString
+			lastHS           sql.NullInt64
+			txBytes, rxBytes int64
+			updatedAt        int64
+		)
+		if err := rows.Scan(&id, &endpoint, &lastHS, &txBytes, &rxBytes, &updatedAt); err != nil {
+			return fmt.Errorf("scan tunnel stats: %w", err)
+		}
+		t, ok := byID[id]
+		if !ok {
+			continue
+		}
+		t.Endpoint = endpoint.String
+		t.LastHandshake = nil
+		if lastHS.Valid {
+			v := time.Unix(lastHS.Int64, 0)
+			t.LastHandshake = &v
+		}
+		t.TxBytes, t.RxBytes = txBytes, rxBytes
+		t.UpdatedAt = time.Unix(updatedAt, 0)
+	}
+	return rows.Err()
+}
+
+func (s *TunnelStore) list() ([]*Tunnel, error) {
+	rows, err := s.db.Query(`SELECT ` + tunnelColumns + ` FROM wg_peers WHERE deleted_at IS NULL ORDER BY created_at ASC`)
 	if err != nil {
 		return nil, fmt.Errorf("list tunnels: %w", err)
 	}
@@ -122,7 +392,7 @@ func (s *TunnelStore) List() ([]*Tunnel, error) {
 
 	var tunnels []*Tunnel
 	for rows.Next() {
-		t, err := scanTunnelRows(rows)
+		t, err := scanTunnel(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -133,21 +403,34 @@ func (s *TunnelStore) List() ([]*Tunnel, error) {
 
 // ListEnabled returns only enabled tunnels.
 func (s *TunnelStore) ListEnabled() ([]*Tunnel, error) {
-	rows, err := s.db.Query(`SELECT
-		id, public_key, vpn_ip, psk_hash, endpoint, domains, enabled,
-		last_handshake, tx_bytes, rx_bytes,
-		auto_rotate_psk, psk_rotation_interval_days,
-		auto_revoke_inactive, inactive_expiry_days, grace_period_minutes,
-		last_rotation_at, pending_rotation_id, created_at, updated_at
-	FROM wg_peers WHERE enabled = 1 ORDER BY created_at ASC`)
+	all, err := s.List()
 	if err != nil {
-		return nil, fmt.Errorf("list enabled tunnels: %w", err)
+		return nil, err
+	}
+	var tunnels []*Tunnel
+	for _, t := range all {
+		if t.Enabled {
+			tunnels = append(tunnels, t)
+		}
+	}
+	return tunnels, nil
+}
+
+// ListByNodeID returns the tunnels a node serves, as their primary node or
+// as a failover node.
+func (s *TunnelStore) ListByNodeID(nodeID string) ([]*Tunnel, error) {
+	rows, err := s.db.Query(`SELECT `+tunnelColumns+` FROM wg_peers
+		WHERE (node_id = ? OR EXISTS (SELECT 1 FROM json_each(wg_peers.failover_node_ids) WHERE value = ?))
+		AND deleted_at IS NULL
+		ORDER BY created_at ASC`, nodeID, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("list tunnels by node: %w", err)
 	}
 	defer rows.Close()
 
 	var tunnels []*Tunnel
 	for rows.Next() {
-		t, err := scanTunnelRows(rows)
+		t, err := scanTunnel(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -156,9 +439,19 @@ func (s *TunnelStore) ListEnabled() ([]*Tunnel, error) {
 	return tunnels, rows.Err()
 }
 
-// Delete removes a tunnel by ID.
+// Delete removes a tunnel by ID for good, releasing its VPN IP.
 func (s *TunnelStore) Delete(id string) error {
-	res, err := s.db.Exec(`DELETE FROM wg_peers WHERE id = ?`, id)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO retired_peer_keys (public_key, retired_at)
+		SELECT public_key, ? FROM wg_peers WHERE id = ?`, time.Now().Unix(), id); err != nil {
+		return fmt.Errorf("retire peer key: %w", err)
+	}
+	res, err := tx.Exec(`DELETE FROM wg_peers WHERE id = ?`, id)
 	if err != nil {
 		return fmt.Errorf("delete tunnel: %w", err)
 	}
@@ -166,9 +459,203 @@ func (s *TunnelStore) Delete(id string) error {
 	if n == 0 {
 		return fmt.Errorf("tunnel not found: %s", id)
 	}
+	return tx.Commit()
+}
+
+// KnownPublicKeys returns the public key of every tunnel the store holds,
+// soft-deleted ones included, and of every tunnel deleted for good. A peer
+// with any other key was not created by the control plane.
+func (s *TunnelStore) KnownPublicKeys() (map[string]bool, error) {
+	rows, err := s.db.Query(`SELECT public_key FROM wg_peers UNION SELECT public_key FROM retired_peer_keys`)
+	if err != nil {
+		return nil, fmt.Errorf("list known public keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("scan public key: %w", err)
+		}
+		keys[key] = true
+	}
+	return keys, rows.Err()
+}
+
+// Approve enables a tunnel awaiting approval together with its routes. It
+// returns ErrDomainInUse if another route has claimed one of their domains
+// since they were created.
+func (s *TunnelStore) Approve(id string) (*Tunnel, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res, err := tx.Exec(`UPDATE wg_peers SET pending_approval = 0, enabled = 1, updated_at = ?
+	WHERE id = ? AND pending_approval = 1`, now, id)
+	if err != nil {
+		return nil, fmt.Errorf("approve tunnel: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrNotPending
+	}
+	_, err = tx.Exec(`UPDATE l4_routes SET enabled = 1, updated_at = ? WHERE tunnel_id = ?`, now, id)
+	if isDomainConflict(err) {
+		return nil, fmt.Errorf("enable tunnel routes: %w", ErrDomainInUse)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("enable tunnel routes: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return s.Get(id)
+}
+
+// SoftDelete tombstones a tunnel at the given time, which hides it from Get
+// and the List methods. Its routes are deleted and kept as a snapshot in the
+// tombstone; its keys and VPN IP stay reserved until Restore or PurgeDeleted.
+func (s *TunnelStore) SoftDelete(id string, at time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT `+routeColumns+` FROM l4_routes WHERE tunnel_id = ? ORDER BY created_at ASC`, id)
+	if err != nil {
+		return fmt.Errorf("list tunnel routes: %w", err)
+	}
+	routes := []*Route{}
+	for rows.Next() {
+		r, err := scanRoute(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		routes = append(routes, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("list tunnel routes: %w", err)
+	}
+	routesJSON, err := json.Marshal(routes)
+	if err != nil {
+		return fmt.Errorf("marshal routes: %w", err)
+	}
+
+	res, err := tx.Exec(`UPDATE wg_peers SET deleted_at = ?, deleted_routes = ?, updated_at = ?
+	WHERE id = ? AND deleted_at IS NULL`, at.Unix(), string(routesJSON), time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("soft-delete tunnel: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("tunnel not found: %s", id)
+	}
+	if _, err := tx.Exec(`DELETE FROM l4_routes WHERE tunnel_id = ?`, id); err != nil {
+		return fmt.Errorf("delete tunnel routes: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
 	return nil
 }
 
+// GetDeleted retrieves a soft-deleted tunnel and the routes it had when it
+// was deleted.
+func (s *TunnelStore) GetDeleted(id string) (*Tunnel, []*Route, error) {
+	row := s.db.QueryRow(`SELECT `+tunnelColumns+`, deleted_routes FROM wg_peers
+		WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	return scanDeletedTunnel(row)
+}
+
+// ListDeleted returns the soft-deleted tunnels, most recently deleted first.
+func (s *TunnelStore) ListDeleted() ([]*Tunnel, error) {
+	rows, err := s.db.Query(`SELECT ` + tunnelColumns + ` FROM wg_peers
+		WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("list deleted tunnels: %w", err)
+	}
+	defer rows.Close()
+
+	var tunnels []*Tunnel
+	for rows.Next() {
+		t, err := scanTunnel(rows)
+		if err != nil {
+			return nil, err
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, rows.Err()
+}
+
+// Restore brings back a soft-deleted tunnel together with its snapshot
+// routes, and sets pskHash as its PSK hash since the old key is
+// gone. The caller checks the routes still fit before restoring them.
+func (s *TunnelStore) Restore(id, pskHash string) (*Tunnel, []*Route, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`SELECT `+tunnelColumns+`, deleted_routes FROM wg_peers
+		WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	t, routes, err := scanDeletedTunnel(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	_, err = tx.Exec(`UPDATE wg_peers SET deleted_at = NULL, deleted_routes = NULL,
+		psk_hash = ?, last_rotation_at = ?, updated_at = ? WHERE id = ?`,
+		nullString(pskHash), now.Unix(), now.Unix(), id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("restore tunnel: %w", err)
+	}
+	for _, r := range routes {
+		if err := insertRoute(tx, r); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("commit: %w", err)
+	}
+
+	t.DeletedAt = nil
+	t.PSKHash = pskHash
+	t.LastRotationAt = &now
+	t.UpdatedAt = time.Unix(now.Unix(), 0)
+	return t, routes, nil
+}
+
+// PurgeDeleted removes the tunnels soft-deleted before the given time for
+// good, releasing their VPN IPs, and returns how many it removed.
+func (s *TunnelStore) PurgeDeleted(before time.Time) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO retired_peer_keys (public_key, retired_at)
+		SELECT public_key, ? FROM wg_peers WHERE deleted_at IS NOT NULL AND deleted_at < ?`,
+		time.Now().Unix(), before.Unix()); err != nil {
+		return 0, fmt.Errorf("retire peer keys: %w", err)
+	}
+	res, err := tx.Exec(`DELETE FROM wg_peers WHERE deleted_at IS NOT NULL AND deleted_at < ?`, before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("purge deleted tunnels: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
 // UpdateRotationPolicy updates rotation policy fields for a tunnel.
 func (s *TunnelStore) UpdateRotationPolicy(id string, autoRotatePSK *bool, intervalDays *int, autoRevokeInactive *bool, expiryDays *int, graceMins *int) (*Tunnel, error) {
 	t, err := s.Get(id)
@@ -209,7 +696,250 @@ func (s *TunnelStore) UpdateRotationPolicy(id string, autoRotatePSK *bool, inter
 	return t, nil
 }
 
+// UpdateLabels replaces the label set of a tunnel.
+func (s *TunnelStore) UpdateLabels(id string, labels map[string]string) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return nil, fmt.Errorf("marshal labels: %w", err)
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET labels = ?, updated_at = ? WHERE id = ?`,
+		string(labelsJSON), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update labels: %w", err)
+	}
+	t.Labels = labels
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// UpdateSourceCIDR sets or, with an empty string, clears a tunnel's source restriction.
+func (s *TunnelStore) UpdateSourceCIDR(id, cidr string) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET source_cidr = ?, updated_at = ? WHERE id = ?`,
+		nullString(cidr), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update source cidr: %w", err)
+	}
+	t.SourceCIDR = cidr
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// SetIsolate sets whether a tunnel is isolated from the other peers.
+func (s *TunnelStore) SetIsolate(id string, isolate bool) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET isolate = ?, updated_at = ? WHERE id = ?`,
+		boolToInt(isolate), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update isolate: %w", err)
+	}
+	t.Isolate = isolate
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// UpdateConnectionSettings sets a tunnel's persistent keepalive and
+// connected threshold, in seconds. A nil argument leaves the setting as is.
+func (s *TunnelStore) UpdateConnectionSettings(id string, keepalive, connectedThreshold *int) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if keepalive != nil {
+		t.PersistentKeepalive = keepalive
+	}
+	if connectedThreshold != nil {
+		t.ConnectedThreshold = connectedThreshold
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET
+		persistent_keepalive = ?, connected_threshold = ?, updated_at = ?
+	WHERE id = ?`, t.PersistentKeepalive, t.ConnectedThreshold, now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update connection settings: %w", err)
+	}
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// UpdateNotes sets a tunnel's description, owner email, and device name.
+// A nil argument leaves the field as is.
+func (s *TunnelStore) UpdateNotes(id string, description, ownerEmail, deviceName *string) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if description != nil {
+		t.Description = *description
+	}
+	if ownerEmail != nil {
+		t.OwnerEmail = *ownerEmail
+	}
+	if deviceName != nil {
+		t.DeviceName = *deviceName
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET
+		description = ?, owner_email = ?, device_name = ?, updated_at = ?
+	WHERE id = ?`, nullString(t.Description), nullString(t.OwnerEmail), nullString(t.DeviceName), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update notes: %w", err)
+	}
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// SetExpiry sets the time a tunnel's access ends, or clears it when at is
+// nil, and clears the warning marker so a new warning is sent before then.
+func (s *TunnelStore) SetExpiry(id string, at *time.Time) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET expires_at = ?, expires_at_warned_at = NULL, updated_at = ? WHERE id = ?`,
+		nullUnix(at), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update expiry: %w", err)
+	}
+	t.ExpiresAt = nullTime(nullUnix(at))
+	t.ExpiryDateWarnedAt = nil
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// MarkExpiryDateWarned records that the warning before the expiry date was sent.
+func (s *TunnelStore) MarkExpiryDateWarned(id string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE wg_peers SET expires_at_warned_at = ? WHERE id = ?`, at.Unix(), id)
+	return err
+}
+
+// SetClientRouting sets the AllowedIPs mode of a tunnel's client configs.
+func (s *TunnelStore) SetClientRouting(id, mode string) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET client_routing = ?, updated_at = ? WHERE id = ?`,
+		nullString(mode), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update client routing: %w", err)
+	}
+	t.ClientRouting = mode
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// SetAdvertisedRoutes sets the LAN prefixes a tunnel's peer routes for.
+func (s *TunnelStore) SetAdvertisedRoutes(id string, routes []string) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	var routesJSON string
+	if len(routes) > 0 {
+		b, err := json.Marshal(routes)
+		if err != nil {
+			return nil, fmt.Errorf("marshal advertised routes: %w", err)
+		}
+		routesJSON = string(b)
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET advertised_routes = ?, updated_at = ? WHERE id = ?`,
+		nullString(routesJSON), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update advertised routes: %w", err)
+	}
+	if routes == nil {
+		routes = []string{}
+	}
+	t.AdvertisedRoutes = routes
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// SetAllowedUpstreamPorts sets the ports routes may forward to on a tunnel's
+// peer. Empty allows any.
+func (s *TunnelStore) SetAllowedUpstreamPorts(id string, ports []PortRange) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	portsJSON, err := upstreamPortsJSON(ports)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET allowed_upstream_ports = ?, updated_at = ? WHERE id = ?`,
+		nullString(portsJSON), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("update allowed upstream ports: %w", err)
+	}
+	t.AllowedUpstreamPorts = ports
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
+// upstreamPortsJSON encodes allowed upstream ports for their column, "" for
+// none.
+func upstreamPortsJSON(ports []PortRange) (string, error) {
+	if len(ports) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(ports)
+	if err != nil {
+		return "", fmt.Errorf("marshal allowed upstream ports: %w", err)
+	}
+	return string(b), nil
+}
+
+// SetEnabled enables or disables a tunnel. Disabled tunnels are removed from
+// the kernel by the reconciler but keep their configuration.
+func (s *TunnelStore) SetEnabled(id string, enabled bool) (*Tunnel, error) {
+	t, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	_, err = s.db.Exec(`UPDATE wg_peers SET enabled = ?, updated_at = ? WHERE id = ?`,
+		boolToInt(enabled), now, id)
+	if err != nil {
+		return nil, fmt.Errorf("set tunnel enabled: %w", err)
+	}
+	t.Enabled = enabled
+	t.UpdatedAt = time.Unix(now, 0)
+	return t, nil
+}
+
 // UpdatePeerStats updates the handshake and traffic stats for a peer by public key.
+// An idle peer's row is left alone, so cached tunnel listings stay valid.
 func (s *TunnelStore) UpdatePeerStats(publicKey string, lastHandshake *time.Time, rxBytes, txBytes int64) error {
 	var hs *int64
 	if lastHandshake != nil && !lastHandshake.IsZero() {
@@ -220,7 +950,9 @@ func (s *TunnelStore) UpdatePeerStats(publicKey string, lastHandshake *time.Time
 	_, err := s.db.Exec(`UPDATE wg_peers SET
 		last_handshake = COALESCE(?, last_handshake),
 		rx_bytes = ?, tx_bytes = ?, updated_at = ?
-	WHERE public_key = ?`, hs, rxBytes, txBytes, now, publicKey)
+	WHERE public_key = ?
+		AND (rx_bytes IS NOT ? OR tx_bytes IS NOT ? OR last_handshake IS NOT COALESCE(?, last_handshake))`,
+		hs, rxBytes, txBytes, now, publicKey, rxBytes, txBytes, hs)
 	return err
 }
 
@@ -233,6 +965,118 @@ func (s *TunnelStore) SetPendingRotation(id, pendingID string) error {
 	return err
 }
 
+// RecordPSKRotation stores the hash of a newly applied PSK and the rotation time.
+func (s *TunnelStore) RecordPSKRotation(id, pskHash string, at time.Time) error {
+	res, err := s.db.Exec(`UPDATE wg_peers SET
+		psk_hash = ?, last_rotation_at = ?, updated_at = ?
+	WHERE id = ?`, pskHash, at.Unix(), time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("record psk rotation: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("tunnel not found: %s", id)
+	}
+	return nil
+}
+
+// SetPendingPSK stores a PSK for the agents of the tunnel's nodes to apply.
+// Remote nodes learn PSKs only this way, since the store otherwise keeps
+// hashes.
+func (s *TunnelStore) SetPendingPSK(id, psk string) error {
+	res, err := s.db.Exec(`UPDATE wg_peers SET pending_psk = ?, pending_psk_acks = NULL WHERE id = ?`, nullString(psk), id)
+	if err != nil {
+		return fmt.Errorf("set pending psk: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("tunnel not found: %s", id)
+	}
+	return nil
+}
+
+// AckPendingPSK records that nodeID's agent applied psk, and forgets the PSK
+// once every node serving the tunnel has. A PSK rotated in the meantime is
+// kept for the next delivery.
+func (s *TunnelStore) AckPendingPSK(id, psk, nodeID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	var primary, failoverJSON, acksJSON sql.NullString
+	err = tx.QueryRow(`SELECT node_id, failover_node_ids, pending_psk_acks FROM wg_peers
+		WHERE id = ? AND pending_psk = ?`, id, psk).Scan(&primary, &failoverJSON, &acksJSON)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get pending psk: %w", err)
+	}
+
+	var failover, acks []string
+	if failoverJSON.Valid {
+		_ = json.Unmarshal([]byte(failoverJSON.String), &failover)
+	}
+	if acksJSON.Valid {
+		_ = json.Unmarshal([]byte(acksJSON.String), &acks)
+	}
+	acked := map[string]bool{nodeID: true}
+	for _, n := range acks {
+		acked[n] = true
+	}
+	if !slices.Contains(acks, nodeID) {
+		acks = append(acks, nodeID)
+	}
+
+	done := acked[primary.String]
+	for _, n := range failover {
+		done = done && acked[n]
+	}
+	if done {
+		_, err = tx.Exec(`UPDATE wg_peers SET pending_psk = NULL, pending_psk_acks = NULL WHERE id = ?`, id)
+	} else {
+		b, _ := json.Marshal(acks)
+		_, err = tx.Exec(`UPDATE wg_peers SET pending_psk_acks = ? WHERE id = ?`, string(b), id)
+	}
+	if err != nil {
+		return fmt.Errorf("ack pending psk: %w", err)
+	}
+	return tx.Commit()
+}
+
+// PendingPSKAcked reports whether nodeID's agent has applied the tunnel's
+// pending PSK.
+func (s *TunnelStore) PendingPSKAcked(id, nodeID string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM wg_peers, json_each(wg_peers.pending_psk_acks)
+		WHERE wg_peers.id = ? AND json_each.value = ?`, id, nodeID).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("get pending psk acks: %w", err)
+	}
+	return n > 0, nil
+}
+
+// DeferRevocation postpones inactivity revocation until at least the given
+// time and clears the warning marker so a new warning is sent before then.
+func (s *TunnelStore) DeferRevocation(id string, until time.Time) (*Tunnel, error) {
+	res, err := s.db.Exec(`UPDATE wg_peers SET
+		revoke_deferred_until = ?, expiry_warned_at = NULL, updated_at = ?
+	WHERE id = ?`, until.Unix(), time.Now().Unix(), id)
+	if err != nil {
+		return nil, fmt.Errorf("defer revocation: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("tunnel not found: %s", id)
+	}
+	return s.Get(id)
+}
+
+// MarkExpiryWarned records that the pre-revocation warning was sent.
+func (s *TunnelStore) MarkExpiryWarned(id string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE wg_peers SET expiry_warned_at = ? WHERE id = ?`, at.Unix(), id)
+	return err
+}
+
 // ClearPendingRotation clears the pending rotation ID.
 func (s *TunnelStore) ClearPendingRotation(id string) error {
 	now := time.Now().Unix()
@@ -242,100 +1086,207 @@ func (s *TunnelStore) ClearPendingRotation(id string) error {
 	return err
 }
 
-// AllocateIP finds the next available IP in the subnet.
-// It queries existing VPN IPs and finds the lowest available one in 10.0.0.2..10.0.0.254.
-func (s *TunnelStore) AllocateIP(serverIP string, subnetPrefix string) (string, error) {
-	rows, err := s.db.Query(`SELECT vpn_ip FROM wg_peers ORDER BY vpn_ip`)
+// isNameConflict reports whether err is a violation of a unique name index.
+func isNameConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") && strings.Contains(err.Error(), "_name'")
+}
+
+// isDomainConflict reports whether err is a violation of the unique SNI
+// domain claim in sni_domains.
+func isDomainConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: sni_domains.domain")
+}
+
+// isIPConflict reports whether err is a unique constraint violation on a
+// VPN IP.
+func isIPConflict(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "UNIQUE constraint failed: wg_peers.vpn_ip") ||
+		strings.Contains(err.Error(), "UNIQUE constraint failed: ip_allocations.ip"))
+}
+
+// AllocateIP returns the lowest free host address of the first pool that
+// has one, skipping each pool's network and broadcast addresses and the
+// server's address. Pools are IPv4 prefixes of any size; taken addresses come
+// from the ip_allocations table. The address is not reserved: use
+// CreateWithAllocatedIP to allocate one for a new tunnel.
+func (s *TunnelStore) AllocateIP(serverIP string, pools []netip.Prefix) (string, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return "", fmt.Errorf("query vpn_ips: %w", err)
+		return "", fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+	return allocateIP(tx, serverIP, pools)
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func allocateIP(q querier, serverIP string, pools []netip.Prefix) (string, error) {
+	rows, err := q.Query(`SELECT ip FROM ip_allocations`)
+	if err != nil {
+		return "", fmt.Errorf("query ip allocations: %w", err)
 	}
 	defer rows.Close()
 
-	usedIPs := make(map[string]bool)
+	used := make(map[netip.Addr]bool)
 	for rows.Next() {
 		var ip string
 		if err := rows.Scan(&ip); err != nil {
 			return "", err
 		}
-		usedIPs[ip] = true
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			used[addr] = true
+		}
 	}
 	if err := rows.Err(); err != nil {
 		return "", err
 	}
+	if server, err := netip.ParseAddr(serverIP); err == nil {
+		used[server] = true
+	}
 
-	// Try IPs from .2 to .254 in the subnet prefix (e.g., "10.0.0")
-	for i := 2; i <= 254; i++ {
-		candidate := fmt.Sprintf("%s.%d", subnetPrefix, i)
-		if candidate == serverIP {
+	for _, pool := range pools {
+		pool = pool.Masked()
+		if !pool.Addr().Is4() || pool.Bits() > 30 {
 			continue
 		}
-		if !usedIPs[candidate] {
-			return candidate, nil
+		last := lastHostAddr(pool)
+		for addr := pool.Addr().Next(); addr.Compare(last) <= 0; addr = addr.Next() {
+			if !used[addr] {
+				return addr.String(), nil
+			}
 		}
 	}
 
-	return "", fmt.Errorf("no available IP addresses in subnet %s.0/24", subnetPrefix)
+	return "", fmt.Errorf("%w in %s", ErrNoFreeIP, formatPools(pools))
 }
 
-// Helper scanner for a single row
-func scanTunnel(row *sql.Row) (*Tunnel, error) {
-	t := &Tunnel{}
-	var (
-		pskHash, endpoint, domainsJSON, pendingRotID sql.NullString
-		enabled, autoRotate, autoRevoke              int
-		lastHS, lastRotation                         sql.NullInt64
-		createdAt, updatedAt                         int64
-	)
-
-	err := row.Scan(
-		&t.ID, &t.PublicKey, &t.VpnIP, &pskHash, &endpoint, &domainsJSON,
-		&enabled, &lastHS, &t.TxBytes, &t.RxBytes,
-		&autoRotate, &t.PSKRotationIntervalDays,
-		&autoRevoke, &t.InactiveExpiryDays, &t.GracePeriodMinutes,
-		&lastRotation, &pendingRotID, &createdAt, &updatedAt,
-	)
+// AddressPoolUsage returns how many host addresses of pools are allocated
+// and how many there are in all, not counting the server's address, for
+// alerting before AllocateIP runs out.
+func (s *TunnelStore) AddressPoolUsage(serverIP string, pools []netip.Prefix) (used, total int, err error) {
+	rows, err := s.db.Query(`SELECT ip FROM ip_allocations`)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("tunnel not found")
+		return 0, 0, fmt.Errorf("query ip allocations: %w", err)
+	}
+	defer rows.Close()
+
+	var allocated []netip.Addr
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return 0, 0, err
+		}
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			allocated = append(allocated, addr)
 		}
-		return nil, fmt.Errorf("scan tunnel: %w", err)
 	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	server, _ := netip.ParseAddr(serverIP)
 
-	fillTunnel(t, pskHash, endpoint, domainsJSON, pendingRotID,
-		enabled, autoRotate, autoRevoke, lastHS, lastRotation, createdAt, updatedAt)
-	return t, nil
+	for _, pool := range pools {
+		pool = pool.Masked()
+		if !pool.Addr().Is4() || pool.Bits() > 30 {
+			continue
+		}
+		first, last := pool.Addr().Next(), lastHostAddr(pool)
+		isHost := func(addr netip.Addr) bool {
+			return addr.Compare(first) >= 0 && addr.Compare(last) <= 0 && addr != server
+		}
+		total += 1<<(32-pool.Bits()) - 2
+		if server.IsValid() && server.Compare(first) >= 0 && server.Compare(last) <= 0 {
+			total--
+		}
+		for _, addr := range allocated {
+			if isHost(addr) {
+				used++
+			}
+		}
+	}
+	return used, total, nil
+}
+
+// lastHostAddr returns the highest host address of an IPv4 prefix, the one
+// below its broadcast address.
+func lastHostAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As4()
+	v := binary.BigEndian.Uint32(a[:]) | (uint32(1)<<(32-p.Bits()) - 1)
+	binary.BigEndian.PutUint32(a[:], v-1)
+	return netip.AddrFrom4(a)
 }
 
-// scanTunnelRows scans a tunnel from rows.
-func scanTunnelRows(rows *sql.Rows) (*Tunnel, error) {
+// formatPools joins pools for error messages.
+func formatPools(pools []netip.Prefix) string {
+	s := make([]string, len(pools))
+	for i, p := range pools {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// VpnIPHolder returns the tunnel holding the given VPN IP, or nil if it is
+// free. A soft-deleted tunnel keeps its IP until it is purged.
+func (s *TunnelStore) VpnIPHolder(ip string) (*Tunnel, error) {
+	var id string
+	err := s.db.QueryRow(`SELECT tunnel_id FROM ip_allocations WHERE ip = ?`, ip).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("check vpn ip: %w", err)
+	}
+	return scanTunnel(s.db.QueryRow(`SELECT `+tunnelColumns+` FROM wg_peers WHERE id = ?`, id))
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTunnel scans a single tunnel row selected with tunnelColumns.
+func scanTunnel(row rowScanner) (*Tunnel, error) {
 	t := &Tunnel{}
 	var (
 		pskHash, endpoint, domainsJSON, pendingRotID sql.NullString
-		enabled, autoRotate, autoRevoke              int
+		labelsJSON, tenantID, sourceCIDR             sql.NullString
+		nodeID, pendingPSK, failoverJSON             sql.NullString
+		clientRouting, dnsJSON, routesJSON, name     sql.NullString
+		portsJSON                                    sql.NullString
+		description, ownerEmail, deviceName          sql.NullString
+		enabled, autoRotate, autoRevoke, isolate     int
+		serverKey, pendingApproval, imported         int
+		clientKey                                    int
 		lastHS, lastRotation                         sql.NullInt64
+		deferredUntil, warnedAt, deletedAt           sql.NullInt64
+		expiresAt, expiryDateWarnedAt                sql.NullInt64
+		keepalive, connectedThreshold, mtu           sql.NullInt64
 		createdAt, updatedAt                         int64
 	)
 
-	err := rows.Scan(
+	err := row.Scan(
 		&t.ID, &t.PublicKey, &t.VpnIP, &pskHash, &endpoint, &domainsJSON,
 		&enabled, &lastHS, &t.TxBytes, &t.RxBytes,
 		&autoRotate, &t.PSKRotationIntervalDays,
 		&autoRevoke, &t.InactiveExpiryDays, &t.GracePeriodMinutes,
 		&lastRotation, &pendingRotID, &createdAt, &updatedAt,
+		&labelsJSON, &tenantID, &deferredUntil, &warnedAt,
+		&sourceCIDR, &isolate, &nodeID, &pendingPSK, &failoverJSON,
+		&keepalive, &connectedThreshold, &clientRouting, &dnsJSON, &mtu,
+		&routesJSON, &deletedAt, &name, &serverKey,
+		&description, &ownerEmail, &deviceName, &expiresAt, &expiryDateWarnedAt,
+		&pendingApproval, &imported, &portsJSON, &clientKey,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("scan tunnel row: %w", err)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("tunnel not found")
+		}
+		return nil, fmt.Errorf("scan tunnel: %w", err)
 	}
 
-	fillTunnel(t, pskHash, endpoint, domainsJSON, pendingRotID,
-		enabled, autoRotate, autoRevoke, lastHS, lastRotation, createdAt, updatedAt)
-	return t, nil
-}
-
-func fillTunnel(t *Tunnel, pskHash, endpoint, domainsJSON, pendingRotID sql.NullString,
-	enabled, autoRotate, autoRevoke int, lastHS, lastRotation sql.NullInt64,
-	createdAt, updatedAt int64) {
-
 	if pskHash.Valid {
 		t.PSKHash = pskHash.String
 	}
@@ -348,12 +1299,59 @@ func fillTunnel(t *Tunnel, pskHash, endpoint, domainsJSON, pendingRotID sql.Null
 	if t.Domains == nil {
 		t.Domains = []string{}
 	}
+	if labelsJSON.Valid && labelsJSON.String != "" {
+		_ = json.Unmarshal([]byte(labelsJSON.String), &t.Labels)
+	}
+	if t.Labels == nil {
+		t.Labels = map[string]string{}
+	}
 	if pendingRotID.Valid {
 		t.PendingRotationID = pendingRotID.String
 	}
+	t.Name = name.String
+	t.TenantID = tenantID.String
+	t.SourceCIDR = sourceCIDR.String
+	t.NodeID = nodeID.String
+	t.PendingPSK = pendingPSK.String
+	t.ClientRouting = clientRouting.String
+	t.Description = description.String
+	t.OwnerEmail = ownerEmail.String
+	t.DeviceName = deviceName.String
+	if dnsJSON.Valid {
+		_ = json.Unmarshal([]byte(dnsJSON.String), &t.ClientDNS)
+	}
+	t.ClientMTU = int(mtu.Int64)
+	if routesJSON.Valid && routesJSON.String != "" {
+		_ = json.Unmarshal([]byte(routesJSON.String), &t.AdvertisedRoutes)
+	}
+	if t.AdvertisedRoutes == nil {
+		t.AdvertisedRoutes = []string{}
+	}
+	if portsJSON.Valid && portsJSON.String != "" {
+		_ = json.Unmarshal([]byte(portsJSON.String), &t.AllowedUpstreamPorts)
+	}
+	if failoverJSON.Valid && failoverJSON.String != "" {
+		_ = json.Unmarshal([]byte(failoverJSON.String), &t.FailoverNodeIDs)
+	}
+	if t.FailoverNodeIDs == nil {
+		t.FailoverNodeIDs = []string{}
+	}
+	if keepalive.Valid {
+		v := int(keepalive.Int64)
+		t.PersistentKeepalive = &v
+	}
+	if connectedThreshold.Valid {
+		v := int(connectedThreshold.Int64)
+		t.ConnectedThreshold = &v
+	}
 	t.Enabled = enabled == 1
 	t.AutoRotatePSK = autoRotate == 1
 	t.AutoRevokeInactive = autoRevoke == 1
+	t.Isolate = isolate == 1
+	t.ServerKey = serverKey == 1
+	t.ClientKey = clientKey == 1
+	t.PendingApproval = pendingApproval == 1
+	t.Imported = imported == 1
 	if lastHS.Valid {
 		hs := time.Unix(lastHS.Int64, 0)
 		t.LastHandshake = &hs
@@ -362,8 +1360,93 @@ func fillTunnel(t *Tunnel, pskHash, endpoint, domainsJSON, pendingRotID sql.Null
 		rot := time.Unix(lastRotation.Int64, 0)
 		t.LastRotationAt = &rot
 	}
+	t.RevokeDeferredUntil = nullTime(deferredUntil)
+	t.ExpiryWarnedAt = nullTime(warnedAt)
+	t.ExpiresAt = nullTime(expiresAt)
+	t.ExpiryDateWarnedAt = nullTime(expiryDateWarnedAt)
+	t.DeletedAt = nullTime(deletedAt)
 	t.CreatedAt = time.Unix(createdAt, 0)
 	t.UpdatedAt = time.Unix(updatedAt, 0)
+	return t, nil
+}
+
+// scanDeletedTunnel scans a tunnel row selected with tunnelColumns followed by
+// deleted_routes.
+func scanDeletedTunnel(row rowScanner) (*Tunnel, []*Route, error) {
+	var routesJSON sql.NullString
+	t, err := scanTunnel(scanFunc(func(dest ...interface{}) error {
+		return row.Scan(append(dest, &routesJSON)...)
+	}))
+	if err != nil {
+		return nil, nil, err
+	}
+	routes := []*Route{}
+	if routesJSON.Valid && routesJSON.String != "" {
+		if err := json.Unmarshal([]byte(routesJSON.String), &routes); err != nil {
+			return nil, nil, fmt.Errorf("unmarshal deleted routes: %w", err)
+		}
+	}
+	return t, routes, nil
+}
+
+// scanFunc adapts a Scan function to rowScanner.
+type scanFunc func(dest ...interface{}) error
+
+func (f scanFunc) Scan(dest ...interface{}) error { return f(dest...) }
+
+// RevocationAt returns when the tunnel will be revoked for inactivity, or nil
+// if it never will be. Tunnels that have never handshaked are not revoked.
+func (t *Tunnel) RevocationAt() *time.Time {
+	if !t.AutoRevokeInactive || t.LastHandshake == nil {
+		return nil
+	}
+	at := t.LastHandshake.Add(time.Duration(t.InactiveExpiryDays) * 24 * time.Hour)
+	if t.RevokeDeferredUntil != nil && t.RevokeDeferredUntil.After(at) {
+		at = *t.RevokeDeferredUntil
+	}
+	return &at
+}
+
+// ExpiringSoon reports whether the tunnel will be revoked within window of now.
+func (t *Tunnel) ExpiringSoon(now time.Time, window time.Duration) bool {
+	at := t.RevocationAt()
+	return at != nil && window > 0 && now.Add(window).After(*at)
+}
+
+// Expired reports whether the tunnel has reached its expiry date.
+func (t *Tunnel) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// ReachesExpiryDateWithin reports whether the tunnel reaches its expiry
+// date within window of now.
+func (t *Tunnel) ReachesExpiryDateWithin(now time.Time, window time.Duration) bool {
+	return t.ExpiresAt != nil && window > 0 && now.Add(window).After(*t.ExpiresAt)
+}
+
+// MatchesLabels reports whether the tunnel carries every key/value pair in selector.
+func (t *Tunnel) MatchesLabels(selector map[string]string) bool {
+	for k, v := range selector {
+		if got, ok := t.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+func nullTime(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.Unix(v.Int64, 0)
+	return &t
+}
+
+func nullUnix(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
 }
 
 func boolToInt(b bool) int {
@@ -379,3 +1462,10 @@ func nullString(s string) sql.NullString {
 	}
 	return sql.NullString{String: s, Valid: true}
 }
+
+func nullInt(n int) sql.NullInt64 {
+	if n == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(n), Valid: true}
+}
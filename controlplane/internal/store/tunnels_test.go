@@ -1,6 +1,10 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
 	"testing"
 	"time"
 )
@@ -158,9 +162,10 @@ func TestTunnelUpdatePeerStats(t *testing.T) {
 func TestAllocateIP(t *testing.T) {
 	db := setupTestDB(t)
 	ts := NewTunnelStore(db)
+	pools := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
 
 	// First allocation should be .2
-	ip, err := ts.AllocateIP("10.0.0.1", "10.0.0")
+	ip, err := ts.AllocateIP("10.0.0.1", pools)
 	if err != nil {
 		t.Fatalf("allocate ip: %v", err)
 	}
@@ -170,13 +175,184 @@ func TestAllocateIP(t *testing.T) {
 
 	// Create a peer with .2, next should be .3
 	ts.Create(&Tunnel{ID: "tun_ip1", PublicKey: "pk_ip1", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
-	ip, err = ts.AllocateIP("10.0.0.1", "10.0.0")
+	ip, err = ts.AllocateIP("10.0.0.1", pools)
 	if err != nil {
 		t.Fatalf("allocate ip: %v", err)
 	}
 	if ip != "10.0.0.3" {
 		t.Errorf("expected 10.0.0.3, got %s", ip)
 	}
+
+	// Deleting the tunnel frees its address
+	ts.Delete("tun_ip1")
+	if ip, _ = ts.AllocateIP("10.0.0.1", pools); ip != "10.0.0.2" {
+		t.Errorf("expected the freed 10.0.0.2, got %s", ip)
+	}
+}
+
+func TestAllocateIPPools(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+
+	// A /20 spans octets: allocation continues past x.x.0.255
+	wide := []netip.Prefix{netip.MustParsePrefix("10.8.0.0/20")}
+	for i := 0; i < 255; i++ {
+		ip, err := ts.AllocateIP("10.8.0.1", wide)
+		if err != nil {
+			t.Fatalf("allocate ip %d: %v", i, err)
+		}
+		ts.Create(&Tunnel{ID: fmt.Sprintf("tun_%d", i), PublicKey: fmt.Sprintf("pk_%d", i), VpnIP: ip, Domains: []string{}})
+	}
+	if ip, _ := ts.AllocateIP("10.8.0.1", wide); ip != "10.8.1.1" {
+		t.Errorf("expected 10.8.1.1 after 10.8.0.255, got %s", ip)
+	}
+
+	// Pools are used in order, skipping network, broadcast, and server addresses
+	pools := []netip.Prefix{netip.MustParsePrefix("10.9.0.0/30"), netip.MustParsePrefix("10.9.1.0/29")}
+	ip, _ := ts.AllocateIP("10.9.0.1", pools)
+	if ip != "10.9.0.2" {
+		t.Fatalf("expected 10.9.0.2, got %s", ip)
+	}
+	ts.Create(&Tunnel{ID: "tun_p1", PublicKey: "pk_p1", VpnIP: ip, Domains: []string{}})
+	if ip, _ = ts.AllocateIP("10.9.0.1", pools); ip != "10.9.1.1" {
+		t.Errorf("expected the second pool once the first is full, got %s", ip)
+	}
+
+	full := []netip.Prefix{netip.MustParsePrefix("10.9.0.0/30")}
+	if _, err := ts.AllocateIP("10.9.0.1", full); err == nil {
+		t.Error("expected an error when every pool is full")
+	}
+
+	// The /30 has two hosts, one the server's; the /29 has six, none taken
+	used, total, err := ts.AddressPoolUsage("10.9.0.1", pools)
+	if err != nil {
+		t.Fatalf("address pool usage: %v", err)
+	}
+	if used != 1 || total != 7 {
+		t.Errorf("expected 1 of 7 addresses used, got %d of %d", used, total)
+	}
+}
+
+func TestCreateWithAllocatedIPConcurrent(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	pools := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- ts.CreateWithAllocatedIP(&Tunnel{
+				ID: fmt.Sprintf("tun_c%d", i), PublicKey: fmt.Sprintf("pk_c%d", i), Domains: []string{},
+			}, "10.0.0.1", pools)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("create: %v", err)
+		}
+	}
+
+	tunnels, _ := ts.List()
+	seen := map[string]bool{}
+	for _, tun := range tunnels {
+		if seen[tun.VpnIP] {
+			t.Errorf("vpn ip %s allocated twice", tun.VpnIP)
+		}
+		seen[tun.VpnIP] = true
+	}
+	if len(seen) != n {
+		t.Errorf("expected %d distinct addresses, got %d", n, len(seen))
+	}
+}
+
+func TestCreateIPConflict(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+
+	ts.Create(&Tunnel{ID: "tun_a", PublicKey: "pk_a", VpnIP: "10.0.0.2", Domains: []string{}})
+	err := ts.Create(&Tunnel{ID: "tun_b", PublicKey: "pk_b", VpnIP: "10.0.0.2", Domains: []string{}})
+	if !errors.Is(err, ErrIPAllocated) {
+		t.Errorf("expected ErrIPAllocated, got %v", err)
+	}
+
+	full := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/30")}
+	err = ts.CreateWithAllocatedIP(&Tunnel{ID: "tun_c", PublicKey: "pk_c", Domains: []string{}}, "10.0.0.1", full)
+	if !errors.Is(err, ErrNoFreeIP) {
+		t.Errorf("expected ErrNoFreeIP, got %v", err)
+	}
+}
+
+func TestSoftDeleteRestorePurge(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+
+	ts.Create(&Tunnel{ID: "tun_sd", PublicKey: "pk_sd", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}})
+	rs.Create(&Route{ID: "route_sd", TunnelID: "tun_sd", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"sd.example.com"}, Upstream: "10.0.0.2:443", CaddyID: "route-sd", Enabled: true})
+
+	deletedAt := time.Now().Add(-time.Hour)
+	if err := ts.SoftDelete("tun_sd", deletedAt); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	if _, err := ts.Get("tun_sd"); err == nil {
+		t.Error("expected a soft-deleted tunnel to be hidden from Get")
+	}
+	if tunnels, _ := ts.List(); len(tunnels) != 0 {
+		t.Errorf("expected a soft-deleted tunnel to be hidden from List, got %d", len(tunnels))
+	}
+	if routes, _ := rs.ListByTunnelID("tun_sd"); len(routes) != 0 {
+		t.Errorf("expected the routes to be deleted, got %d", len(routes))
+	}
+	if holder, _ := ts.VpnIPHolder("10.0.0.2"); holder == nil || holder.ID != "tun_sd" || holder.DeletedAt == nil {
+		t.Errorf("expected the VPN IP to stay reserved by the deleted tunnel, got %+v", holder)
+	}
+	deleted, _ := ts.ListDeleted()
+	if len(deleted) != 1 || deleted[0].DeletedAt == nil || deleted[0].DeletedAt.Unix() != deletedAt.Unix() {
+		t.Fatalf("expected the tombstone to be listed, got %+v", deleted)
+	}
+
+	restored, routes, err := ts.Restore("tun_sd", "newhash")
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if restored.DeletedAt != nil || restored.PSKHash != "newhash" || !restored.Enabled {
+		t.Errorf("unexpected restored tunnel: %+v", restored)
+	}
+	if len(routes) != 1 || routes[0].ID != "route_sd" {
+		t.Fatalf("expected the snapshot route back, got %+v", routes)
+	}
+	if got, err := rs.Get("route_sd"); err != nil || got.MatchValue[0] != "sd.example.com" {
+		t.Errorf("expected the route to be re-created, got %+v, %v", got, err)
+	}
+	if _, _, err := ts.Restore("tun_sd", "again"); err == nil {
+		t.Error("expected restoring a live tunnel to fail")
+	}
+
+	// Purging only removes tombstones older than the cutoff
+	rs.DeleteByTunnelID("tun_sd")
+	ts.SoftDelete("tun_sd", deletedAt)
+	if n, err := ts.PurgeDeleted(deletedAt.Add(-time.Minute)); err != nil || n != 0 {
+		t.Errorf("expected nothing purged before the cutoff, got %d, %v", n, err)
+	}
+	if n, err := ts.PurgeDeleted(time.Now()); err != nil || n != 1 {
+		t.Errorf("expected 1 tunnel purged, got %d, %v", n, err)
+	}
+	if _, _, err := ts.GetDeleted("tun_sd"); err == nil {
+		t.Error("expected the purged tunnel to be gone")
+	}
+	if holder, err := ts.VpnIPHolder("10.0.0.2"); err != nil || holder != nil {
+		t.Errorf("expected purging to release the VPN IP, got %+v, %v", holder, err)
+	}
+	if keys, err := ts.KnownPublicKeys(); err != nil || !keys["pk_sd"] {
+		t.Errorf("expected the purged tunnel's key to stay known, got %v, %v", keys, err)
+	}
 }
 
 func TestSetAndClearPendingRotation(t *testing.T) {
@@ -207,3 +383,145 @@ func TestSetAndClearPendingRotation(t *testing.T) {
 		t.Errorf("expected empty pending_rotation_id, got %s", got.PendingRotationID)
 	}
 }
+
+func TestTunnelLabels(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+
+	ts.Create(&Tunnel{ID: "tun_lbl", PublicKey: "pklbl", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{},
+		Labels: map[string]string{"env": "prod", "team": "core"}})
+
+	got, _ := ts.Get("tun_lbl")
+	if got.Labels["env"] != "prod" || got.Labels["team"] != "core" {
+		t.Errorf("expected labels env=prod team=core, got %v", got.Labels)
+	}
+	if !got.MatchesLabels(map[string]string{"env": "prod"}) {
+		t.Error("expected tunnel to match env=prod")
+	}
+	if got.MatchesLabels(map[string]string{"env": "staging"}) {
+		t.Error("expected tunnel not to match env=staging")
+	}
+
+	updated, err := ts.UpdateLabels("tun_lbl", map[string]string{"env": "staging"})
+	if err != nil {
+		t.Fatalf("update labels: %v", err)
+	}
+	if len(updated.Labels) != 1 || updated.Labels["env"] != "staging" {
+		t.Errorf("expected labels replaced with env=staging, got %v", updated.Labels)
+	}
+
+	// Tunnels created without labels get an empty map, not nil
+	ts.Create(&Tunnel{ID: "tun_nolbl", PublicKey: "pknolbl", VpnIP: "10.0.0.3", Enabled: true, Domains: []string{}})
+	got, _ = ts.Get("tun_nolbl")
+	if got.Labels == nil {
+		t.Error("expected non-nil labels map")
+	}
+}
+
+func TestTunnelNotes(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+
+	ts.Create(&Tunnel{ID: "tun_notes", PublicKey: "pknotes", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{},
+		Description: "NAS in the basement", OwnerEmail: "alice@example.com", DeviceName: "nas-01"})
+
+	got, _ := ts.Get("tun_notes")
+	if got.Description != "NAS in the basement" || got.OwnerEmail != "alice@example.com" || got.DeviceName != "nas-01" {
+		t.Errorf("unexpected notes %q %q %q", got.Description, got.OwnerEmail, got.DeviceName)
+	}
+
+	owner, device := "bob@example.com", ""
+	updated, err := ts.UpdateNotes("tun_notes", nil, &owner, &device)
+	if err != nil {
+		t.Fatalf("update notes: %v", err)
+	}
+	got, _ = ts.Get("tun_notes")
+	for _, tun := range []*Tunnel{updated, got} {
+		if tun.Description != "NAS in the basement" || tun.OwnerEmail != "bob@example.com" || tun.DeviceName != "" {
+			t.Errorf("unexpected notes after update %q %q %q", tun.Description, tun.OwnerEmail, tun.DeviceName)
+		}
+	}
+}
+
+func TestTunnelAllowedUpstreamPorts(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+
+	ts.Create(&Tunnel{ID: "tun_ports", PublicKey: "pkports", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{},
+		AllowedUpstreamPorts: []PortRange{{Start: 443, End: 443}, {Start: 8000, End: 8099}}})
+
+	got, _ := ts.Get("tun_ports")
+	if len(got.AllowedUpstreamPorts) != 2 || got.AllowedUpstreamPorts[1] != (PortRange{Start: 8000, End: 8099}) {
+		t.Fatalf("unexpected allowed upstream ports %v", got.AllowedUpstreamPorts)
+	}
+
+	if _, err := ts.SetAllowedUpstreamPorts("tun_ports", nil); err != nil {
+		t.Fatalf("clear allowed upstream ports: %v", err)
+	}
+	got, _ = ts.Get("tun_ports")
+	if len(got.AllowedUpstreamPorts) != 0 {
+		t.Errorf("expected any port allowed after clearing, got %v", got.AllowedUpstreamPorts)
+	}
+}
+
+func TestTunnelApprove(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+	rs := NewRouteStore(db)
+
+	ts.Create(&Tunnel{ID: "tun_pending", PublicKey: "pkpending", VpnIP: "10.0.0.2", Domains: []string{}, PendingApproval: true})
+	rs.Create(&Route{ID: "route_pending", TunnelID: "tun_pending", ListenPort: 443, MatchType: "sni",
+		MatchValue: []string{"app.example.com"}, Upstream: "10.0.0.2:443", CaddyID: "route-pending"})
+
+	approved, err := ts.Approve("tun_pending")
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if approved.PendingApproval || !approved.Enabled {
+		t.Errorf("expected an enabled tunnel, got pending=%v enabled=%v", approved.PendingApproval, approved.Enabled)
+	}
+	if route, _ := rs.Get("route_pending"); !route.Enabled {
+		t.Error("expected the tunnel's route to be enabled")
+	}
+	if _, err := ts.Approve("tun_pending"); !errors.Is(err, ErrNotPending) {
+		t.Errorf("expected ErrNotPending on a second approval, got %v", err)
+	}
+}
+
+func TestTunnelNames(t *testing.T) {
+	db := setupTestDB(t)
+	ts := NewTunnelStore(db)
+
+	if err := ts.Create(&Tunnel{ID: "tun_a", Name: "web", PublicKey: "pka", VpnIP: "10.0.0.2", Enabled: true, Domains: []string{}}); err != nil {
+		t.Fatalf("create named tunnel: %v", err)
+	}
+	got, err := ts.GetByName("", "web")
+	if err != nil || got.ID != "tun_a" {
+		t.Fatalf("expected tun_a by name, got %+v, %v", got, err)
+	}
+
+	// Names are unique per tenant
+	err = ts.Create(&Tunnel{ID: "tun_b", Name: "web", PublicKey: "pkb", VpnIP: "10.0.0.3", Enabled: true, Domains: []string{}})
+	if !errors.Is(err, ErrNameInUse) {
+		t.Fatalf("expected ErrNameInUse, got %v", err)
+	}
+	if err := ts.Create(&Tunnel{ID: "tun_c", Name: "web", TenantID: "acme", PublicKey: "pkc", VpnIP: "10.0.0.4", Enabled: true, Domains: []string{}}); err != nil {
+		t.Fatalf("same name in another tenant: %v", err)
+	}
+
+	// Unnamed tunnels never conflict
+	for i, id := range []string{"tun_d", "tun_e"} {
+		if err := ts.Create(&Tunnel{ID: id, PublicKey: id, VpnIP: fmt.Sprintf("10.0.0.%d", 5+i), Enabled: true, Domains: []string{}}); err != nil {
+			t.Fatalf("create unnamed tunnel: %v", err)
+		}
+	}
+
+	// A soft-deleted tunnel keeps its name
+	if err := ts.SoftDelete("tun_a", time.Now()); err != nil {
+		t.Fatalf("soft delete: %v", err)
+	}
+	err = ts.Create(&Tunnel{ID: "tun_f", Name: "web", PublicKey: "pkf", VpnIP: "10.0.0.9", Enabled: true, Domains: []string{}})
+	if !errors.Is(err, ErrNameInUse) {
+		t.Fatalf("expected ErrNameInUse while soft-deleted, got %v", err)
+	}
+}
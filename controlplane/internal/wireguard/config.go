@@ -0,0 +1,99 @@
+package wireguard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// PrivateKeyPlaceholder stands in for a client private key the server does not know.
+const PrivateKeyPlaceholder = "<your-private-key>"
+
+// DefaultDNS is the resolver written into client configs of tunnels that do
+// not set their own.
+var DefaultDNS = []string{"1.1.1.1"}
+
+// Client routing modes decide which destinations a client sends through the
+// tunnel (its AllowedIPs).
+const (
+	RoutingSplit  = "split"  // only the WireGuard server
+	RoutingSubnet = "subnet" // the whole VPN subnet, including other peers
+	RoutingFull   = "full"   // all traffic
+)
+
+// ValidRouting reports whether mode is a client routing mode.
+func ValidRouting(mode string) bool {
+	return mode == RoutingSplit || mode == RoutingSubnet || mode == RoutingFull
+}
+
+// ClientAllowedIPs returns the client-side AllowedIPs for a routing mode,
+// given the server's VPN IP and the VPN subnet. An empty mode is split.
+func ClientAllowedIPs(mode, serverIP, subnet string) []string {
+	switch mode {
+	case RoutingFull:
+		return []string{"0.0.0.0/0", "::/0"}
+	case RoutingSubnet:
+		if p, err := netip.ParsePrefix(subnet); err == nil {
+			return []string{p.Masked().String()}
+		}
+	}
+	return []string{serverIP + "/32"}
+}
+
+// ClientConfig holds the values of a peer's client config file.
+type ClientConfig struct {
+	PrivateKey     string
+	Address        string   // the peer's VPN IP
+	DNS            []string // resolvers and search domains; empty leaves the line out
+	MTU            int      // 0 leaves the line out
+	ServerPubKey   string
+	PresharedKey   string // "" leaves the line out
+	ServerEndpoint string
+	AllowedIPs     []string
+	Keepalive      time.Duration // 0 leaves PersistentKeepalive out
+	Notes          []string      // comment lines written ahead of the config
+}
+
+// Render returns the config in wg-quick format.
+func (c ClientConfig) Render() string {
+	var b strings.Builder
+	c.writeNotes(&b)
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\nAddress = %s/32\n", c.PrivateKey, c.Address)
+	if len(c.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(c.DNS, ", "))
+	}
+	if c.MTU > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", c.MTU)
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "[Peer]\nPublicKey = %s\n", c.ServerPubKey)
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&b, "PresharedKey = %s\n", c.PresharedKey)
+	}
+	fmt.Fprintf(&b, "Endpoint = %s\nAllowedIPs = %s\n", c.ServerEndpoint, strings.Join(c.AllowedIPs, ", "))
+	if c.Keepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", int(c.Keepalive/time.Second))
+	}
+	return b.String()
+}
+
+// writeNotes writes the config's notes as comments, which every format
+// accepts.
+func (c ClientConfig) writeNotes(b *strings.Builder) {
+	for _, note := range c.Notes {
+		fmt.Fprintf(b, "# %s\n", note)
+	}
+	if len(c.Notes) > 0 {
+		b.WriteString("\n")
+	}
+}
+
+// HashPSK returns the hex SHA-256 of a base64 PSK, which is what the store
+// keeps instead of the key itself.
+func HashPSK(psk string) string {
+	sum := sha256.Sum256([]byte(psk))
+	return hex.EncodeToString(sum[:])
+}
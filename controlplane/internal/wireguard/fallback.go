@@ -0,0 +1,62 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// TCP fallback transports, for clients on networks that block UDP. A relay
+// on the client carries WireGuard's datagrams over a TCP connection to the
+// server, where Caddy hands it to the matching relay in front of WireGuard.
+const (
+	TransportWSTunnel = "wstunnel" // WebSocket over TLS, routed by SNI through Caddy's port 443
+	TransportUDP2TCP  = "udp2tcp"  // mullvad/udp-over-tcp, on a TCP port of its own
+)
+
+// ValidTransport reports whether transport is a TCP fallback transport.
+func ValidTransport(transport string) bool {
+	return transport == TransportWSTunnel || transport == TransportUDP2TCP
+}
+
+// FallbackLocalPort is the UDP port the client-side relay listens on, which
+// fallback configs use as the endpoint.
+const FallbackLocalPort = 51820
+
+// FallbackMTU leaves room for the TCP, TLS, and WebSocket headers the relay
+// adds. Fallback configs of tunnels that set no MTU use it.
+const FallbackMTU = 1280
+
+// Fallback is the TCP transport clients reach the server's WireGuard
+// through when UDP is blocked.
+type Fallback struct {
+	Transport string // TransportWSTunnel or TransportUDP2TCP
+	Host      string // public host name or IP of the relay
+	Port      int    // public TCP port of the relay
+	WGPort    int    // UDP port WireGuard listens on, behind the relay
+}
+
+// RelayCommand returns the command that starts the client side of the
+// relay, forwarding 127.0.0.1:FallbackLocalPort/udp to the server.
+func (f Fallback) RelayCommand() string {
+	local := net.JoinHostPort("127.0.0.1", strconv.Itoa(FallbackLocalPort))
+	remote := net.JoinHostPort(f.Host, strconv.Itoa(f.Port))
+	if f.Transport == TransportUDP2TCP {
+		return fmt.Sprintf("udp2tcp --udp-listen %s --tcp-forward %s", local, remote)
+	}
+	return fmt.Sprintf("wstunnel client -L 'udp://%s:127.0.0.1:%d?timeout_sec=0' wss://%s", local, f.WGPort, remote)
+}
+
+// Via returns c rewritten to reach the server through the client-side relay
+// of f: the endpoint becomes the relay, the MTU defaults to FallbackMTU, and
+// the config starts with the command that runs the relay.
+func (c ClientConfig) Via(f Fallback) ClientConfig {
+	c.ServerEndpoint = net.JoinHostPort("127.0.0.1", strconv.Itoa(FallbackLocalPort))
+	if c.MTU == 0 {
+		c.MTU = FallbackMTU
+	}
+	c.Notes = append(c.Notes,
+		fmt.Sprintf("WireGuard over TCP (%s): start the relay before the interface:", f.Transport),
+		f.RelayCommand())
+	return c
+}
@@ -0,0 +1,174 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Client config formats, for platforms that do not take wg-quick files.
+const (
+	FormatWGQuick         = "wg-quick"         // wg-quick and the WireGuard apps
+	FormatNMConnection    = "nmconnection"     // NetworkManager keyfile
+	FormatMikroTik        = "mikrotik"         // RouterOS script
+	FormatSystemdNetworkd = "systemd-networkd" // .netdev and .network files
+)
+
+// DefaultInterface names the client interface in formats that declare one.
+const DefaultInterface = "wg0"
+
+// ValidFormat reports whether format is a client config format.
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatWGQuick, FormatNMConnection, FormatMikroTik, FormatSystemdNetworkd:
+		return true
+	}
+	return false
+}
+
+// RenderFormat returns the config in the given format, naming the client
+// interface iface where the format declares one ("" uses DefaultInterface).
+func (c ClientConfig) RenderFormat(format, iface string) (string, error) {
+	if iface == "" {
+		iface = DefaultInterface
+	}
+	switch format {
+	case "", FormatWGQuick:
+		return c.Render(), nil
+	case FormatNMConnection:
+		return c.renderNMConnection(iface), nil
+	case FormatMikroTik:
+		return c.renderMikroTik(iface)
+	case FormatSystemdNetworkd:
+		return c.renderNetworkd(iface), nil
+	}
+	return "", fmt.Errorf("unknown config format %q", format)
+}
+
+// splitDNS separates the resolver addresses of a DNS list from its search
+// domains.
+func splitDNS(dns []string) (v4, v6, domains []string) {
+	for _, entry := range dns {
+		addr, err := netip.ParseAddr(entry)
+		switch {
+		case err != nil:
+			domains = append(domains, entry)
+		case addr.Is4():
+			v4 = append(v4, entry)
+		default:
+			v6 = append(v6, entry)
+		}
+	}
+	return v4, v6, domains
+}
+
+// renderNMConnection renders a NetworkManager keyfile, to be saved under
+// /etc/NetworkManager/system-connections with mode 0600.
+func (c ClientConfig) renderNMConnection(iface string) string {
+	v4, v6, domains := splitDNS(c.DNS)
+	list := func(values []string) string { return strings.Join(values, ";") + ";" }
+
+	var b strings.Builder
+	c.writeNotes(&b)
+	fmt.Fprintf(&b, "[connection]\nid=%s\ntype=wireguard\ninterface-name=%s\n\n", iface, iface)
+	fmt.Fprintf(&b, "[wireguard]\nprivate-key=%s\n", c.PrivateKey)
+	if c.MTU > 0 {
+		fmt.Fprintf(&b, "mtu=%d\n", c.MTU)
+	}
+	fmt.Fprintf(&b, "\n[wireguard-peer.%s]\nendpoint=%s\n", c.ServerPubKey, c.ServerEndpoint)
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&b, "preshared-key=%s\npreshared-key-flags=0\n", c.PresharedKey)
+	}
+	fmt.Fprintf(&b, "allowed-ips=%s\n", list(c.AllowedIPs))
+	if c.Keepalive > 0 {
+		fmt.Fprintf(&b, "persistent-keepalive=%d\n", int(c.Keepalive/time.Second))
+	}
+	fmt.Fprintf(&b, "\n[ipv4]\naddress1=%s/32\nmethod=manual\n", c.Address)
+	if len(v4) > 0 {
+		fmt.Fprintf(&b, "dns=%s\n", list(v4))
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(&b, "dns-search=%s\n", list(domains))
+	}
+	b.WriteString("\n[ipv6]\nmethod=ignore\n")
+	if len(v6) > 0 {
+		fmt.Fprintf(&b, "dns=%s\n", list(v6))
+	}
+	return b.String()
+}
+
+// renderMikroTik renders RouterOS commands that add the interface, the
+// server peer, the address, and a route per allowed prefix. DNS is left
+// commented out since it is a router-wide setting.
+func (c ClientConfig) renderMikroTik(iface string) (string, error) {
+	host, port, err := net.SplitHostPort(c.ServerEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("server endpoint %q: %w", c.ServerEndpoint, err)
+	}
+
+	var b strings.Builder
+	c.writeNotes(&b)
+	fmt.Fprintf(&b, "/interface wireguard add name=%s private-key=%q", iface, c.PrivateKey)
+	if c.MTU > 0 {
+		fmt.Fprintf(&b, " mtu=%d", c.MTU)
+	}
+	fmt.Fprintf(&b, "\n/interface wireguard peers add interface=%s public-key=%q", iface, c.ServerPubKey)
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&b, " preshared-key=%q", c.PresharedKey)
+	}
+	fmt.Fprintf(&b, " endpoint-address=%s endpoint-port=%s allowed-address=%s", host, port, strings.Join(c.AllowedIPs, ","))
+	if c.Keepalive > 0 {
+		fmt.Fprintf(&b, " persistent-keepalive=%ds", int(c.Keepalive/time.Second))
+	}
+	fmt.Fprintf(&b, "\n/ip address add address=%s/32 interface=%s\n", c.Address, iface)
+	for _, prefix := range c.AllowedIPs {
+		if p, err := netip.ParsePrefix(prefix); err == nil && p.Addr().Is6() {
+			fmt.Fprintf(&b, "/ipv6 route add dst-address=%s gateway=%s\n", prefix, iface)
+		} else {
+			fmt.Fprintf(&b, "/ip route add dst-address=%s gateway=%s\n", prefix, iface)
+		}
+	}
+	if v4, _, _ := splitDNS(c.DNS); len(v4) > 0 {
+		fmt.Fprintf(&b, "# /ip dns set servers=%s\n", strings.Join(v4, ","))
+	}
+	return b.String(), nil
+}
+
+// renderNetworkd renders the .netdev and .network files of a
+// systemd-networkd interface, each headed by the path it belongs at. The
+// .netdev holds the private key, so it must not be world-readable.
+func (c ClientConfig) renderNetworkd(iface string) string {
+	v4, v6, domains := splitDNS(c.DNS)
+
+	var b strings.Builder
+	c.writeNotes(&b)
+	fmt.Fprintf(&b, "# /etc/systemd/network/90-%s.netdev (mode 0640, group systemd-network)\n", iface)
+	fmt.Fprintf(&b, "[NetDev]\nName=%s\nKind=wireguard\n", iface)
+	if c.MTU > 0 {
+		fmt.Fprintf(&b, "MTUBytes=%d\n", c.MTU)
+	}
+	fmt.Fprintf(&b, "\n[WireGuard]\nPrivateKey=%s\n\n", c.PrivateKey)
+	fmt.Fprintf(&b, "[WireGuardPeer]\nPublicKey=%s\n", c.ServerPubKey)
+	if c.PresharedKey != "" {
+		fmt.Fprintf(&b, "PresharedKey=%s\n", c.PresharedKey)
+	}
+	fmt.Fprintf(&b, "Endpoint=%s\nAllowedIPs=%s\n", c.ServerEndpoint, strings.Join(c.AllowedIPs, ","))
+	if c.Keepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive=%d\n", int(c.Keepalive/time.Second))
+	}
+
+	fmt.Fprintf(&b, "\n# /etc/systemd/network/90-%s.network\n", iface)
+	fmt.Fprintf(&b, "[Match]\nName=%s\n\n[Network]\nAddress=%s/32\n", iface, c.Address)
+	for _, dns := range append(v4, v6...) {
+		fmt.Fprintf(&b, "DNS=%s\n", dns)
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(&b, "Domains=%s\n", strings.Join(domains, " "))
+	}
+	for _, prefix := range c.AllowedIPs {
+		fmt.Fprintf(&b, "\n[Route]\nDestination=%s\n", prefix)
+	}
+	return b.String()
+}
@@ -3,8 +3,11 @@ package wireguard
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
@@ -19,21 +22,38 @@ type PeerInfo struct {
 	LastHandshakeTime time.Time
 	ReceiveBytes      int64
 	TransmitBytes     int64
+	Keepalive         time.Duration // persistent keepalive interval; 0 when disabled
 }
 
 // DeviceInfo holds the WireGuard device info (server side).
 type DeviceInfo struct {
 	PublicKey  string
 	ListenPort int
+	MTU        int // interface MTU; 0 when unknown
 	Peers      []PeerInfo
 }
 
 // WGClient is the interface for interacting with WireGuard at the kernel level.
 // This abstraction allows mocking in tests.
 type WGClient interface {
-	AddPeer(iface string, pubkey, psk string, vpnIP string) error
+	AddPeer(iface string, pubkey, psk string, vpnIP string, routes []string, keepalive time.Duration) error
 	RemovePeer(iface string, pubkey string) error
+	ApplyPeers(iface string, peers []PeerConfig) error
 	GetDevice(iface string) (*DeviceInfo, error)
+	// HostPrefixes returns the IPv4 networks the host reaches other than
+	// through iface, which advertised routes must not take over.
+	HostPrefixes(iface string) ([]netip.Prefix, error)
+}
+
+// PeerConfig is one change of a batch passed to ApplyPeers: a peer to add
+// or update, with the arguments AddPeer takes, or one to remove.
+type PeerConfig struct {
+	PublicKey string
+	PSK       string // "" keeps an existing peer's PSK
+	VpnIP     string
+	Routes    []string // advertised LAN routes
+	Keepalive time.Duration
+	Remove    bool // remove the peer; only PublicKey is used
 }
 
 // Manager wraps WireGuard operations for the control plane.
@@ -50,9 +70,15 @@ func NewManager(iface string, client WGClient) *Manager {
 	}
 }
 
-// AddPeer adds a WireGuard peer with the given public key, PSK, and VPN IP.
-func (m *Manager) AddPeer(pubkey, psk, vpnIP string) error {
-	return m.client.AddPeer(m.iface, pubkey, psk, vpnIP)
+// DefaultKeepalive is the persistent keepalive used for peers that do not
+// set their own.
+const DefaultKeepalive = 25 * time.Second
+
+// AddPeer adds a WireGuard peer with the given public key, PSK, VPN IP,
+// advertised LAN routes, and persistent keepalive (0 disables it), or updates
+// the peer if it exists. An empty PSK leaves an existing peer's PSK unchanged.
+func (m *Manager) AddPeer(pubkey, psk, vpnIP string, routes []string, keepalive time.Duration) error {
+	return m.client.AddPeer(m.iface, pubkey, psk, vpnIP, routes, keepalive)
 }
 
 // RemovePeer removes a WireGuard peer by public key.
@@ -60,6 +86,12 @@ func (m *Manager) RemovePeer(pubkey string) error {
 	return m.client.RemovePeer(m.iface, pubkey)
 }
 
+// ApplyPeers adds, updates, and removes several peers at once, as AddPeer
+// and RemovePeer would one at a time.
+func (m *Manager) ApplyPeers(peers []PeerConfig) error {
+	return m.client.ApplyPeers(m.iface, peers)
+}
+
 // ListPeers returns all WireGuard peers for the managed interface.
 func (m *Manager) ListPeers() ([]PeerInfo, error) {
 	dev, err := m.client.GetDevice(m.iface)
@@ -78,6 +110,17 @@ func (m *Manager) GetServerPublicKey() (string, error) {
 	return dev.PublicKey, nil
 }
 
+// GetDevice returns the server side of the managed interface.
+func (m *Manager) GetDevice() (*DeviceInfo, error) {
+	return m.client.GetDevice(m.iface)
+}
+
+// HostPrefixes returns the IPv4 networks the host reaches other than through
+// the managed interface: its own networks and the routes of the main table.
+func (m *Manager) HostPrefixes() ([]netip.Prefix, error) {
+	return m.client.HostPrefixes(m.iface)
+}
+
 // GenerateKeyPair generates a new WireGuard Curve25519 key pair.
 // Returns (privateKey, publicKey) as base64-encoded strings.
 func GenerateKeyPair() (string, string, error) {
@@ -106,88 +149,196 @@ func GenerateRandomID(prefix string) string {
 	return prefix + base64.RawURLEncoding.EncodeToString(b)
 }
 
-// RealWGClient implements WGClient using the real wgctrl-go library.
-type RealWGClient struct{}
+// RealWGClient implements WGClient using the real wgctrl-go library. It
+// keeps one wgctrl client, and so one netlink socket, open for all calls.
+type RealWGClient struct {
+	mu     sync.Mutex
+	client *wgctrl.Client // opened on first use; nil again after a failed call
+}
 
 // NewRealWGClient creates a new RealWGClient.
 func NewRealWGClient() *RealWGClient {
 	return &RealWGClient{}
 }
 
-// AddPeer adds a peer to the WireGuard interface via wgctrl.
-func (c *RealWGClient) AddPeer(iface string, pubkey, psk, vpnIP string) error {
-	// Lazy import approach: we use wgctrl.New() per-call so we don't hold a netlink socket open
-	pubKeyBytes, err := base64.StdEncoding.DecodeString(pubkey)
-	if err != nil {
-		return fmt.Errorf("decode public key: %w", err)
+// Close closes the wgctrl client, if open.
+func (c *RealWGClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil
 	}
-	var pubKeyArr wgtypes.Key
-	copy(pubKeyArr[:], pubKeyBytes)
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
 
-	pskBytes, err := base64.StdEncoding.DecodeString(psk)
-	if err != nil {
-		return fmt.Errorf("decode psk: %w", err)
+// do runs fn with the shared wgctrl client, opening it if needed. A failed
+// call closes the client, so a broken socket is replaced on the next one.
+func (c *RealWGClient) do(fn func(client *wgctrl.Client) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		client, err := wgctrl.New()
+		if err != nil {
+			return fmt.Errorf("wgctrl.New: %w", err)
+		}
+		c.client = client
 	}
-	var pskArr wgtypes.Key
-	copy(pskArr[:], pskBytes)
-
-	_, allowedNet, err := net.ParseCIDR(vpnIP + "/32")
-	if err != nil {
-		return fmt.Errorf("parse vpn ip: %w", err)
+	if err := fn(c.client); err != nil {
+		c.client.Close()
+		c.client = nil
+		return err
 	}
-	keepalive := 25 * time.Second
+	return nil
+}
 
-	config := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{{
-			PublicKey:                   pubKeyArr,
-			PresharedKey:                &pskArr,
-			AllowedIPs:                  []net.IPNet{*allowedNet},
-			PersistentKeepaliveInterval: &keepalive,
-			ReplaceAllowedIPs:           true,
-		}},
+// AddPeer adds a peer to the WireGuard interface via wgctrl, and points
+// kernel routes for its advertised routes at the interface.
+func (c *RealWGClient) AddPeer(iface string, pubkey, psk, vpnIP string, routes []string, keepalive time.Duration) error {
+	return c.ApplyPeers(iface, []PeerConfig{{PublicKey: pubkey, PSK: psk, VpnIP: vpnIP, Routes: routes, Keepalive: keepalive}})
+}
+
+// RemovePeer removes a peer from the WireGuard interface via wgctrl.
+func (c *RealWGClient) RemovePeer(iface string, pubkey string) error {
+	return c.ApplyPeers(iface, []PeerConfig{{PublicKey: pubkey, Remove: true}})
+}
+
+// ApplyPeers adds, updates, and removes peers in one ConfigureDevice call,
+// then syncs the kernel routes of their advertised routes. Nothing is
+// applied if any peer is invalid.
+func (c *RealWGClient) ApplyPeers(iface string, peers []PeerConfig) error {
+	if len(peers) == 0 {
+		return nil
+	}
+	config := wgtypes.Config{Peers: make([]wgtypes.PeerConfig, 0, len(peers))}
+	allowed := make([][]net.IPNet, len(peers))
+	for i, p := range peers {
+		pc, err := p.wgConfig()
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", p.PublicKey, err)
+		}
+		config.Peers = append(config.Peers, pc)
+		allowed[i] = pc.AllowedIPs
 	}
 
-	client, err := wgctrl.New()
+	// Remember the AllowedIPs the peers had so the routes they no longer
+	// advertise can be dropped
+	previous := make(map[wgtypes.Key][]net.IPNet)
+	err := c.do(func(client *wgctrl.Client) error {
+		if dev, err := client.Device(iface); err == nil {
+			for _, p := range dev.Peers {
+				previous[p.PublicKey] = p.AllowedIPs
+			}
+		}
+		return client.ConfigureDevice(iface, config)
+	})
 	if err != nil {
-		return fmt.Errorf("wgctrl.New: %w", err)
+		return err
+	}
+
+	var errs []error
+	for i, pc := range config.Peers {
+		if pc.Remove {
+			// Routes to the peer's advertised LANs go with it
+			if err := syncPeerRoutes(iface, previous[pc.PublicKey], nil); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		var old []net.IPNet
+		for _, n := range previous[pc.PublicKey] {
+			if n.String() != allowed[i][0].String() {
+				old = append(old, n)
+			}
+		}
+		if err := syncPeerRoutes(iface, old, allowed[i][1:]); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	defer client.Close()
-	return client.ConfigureDevice(iface, config)
+	return errors.Join(errs...)
 }
 
-// RemovePeer removes a peer from the WireGuard interface via wgctrl.
-func (c *RealWGClient) RemovePeer(iface string, pubkey string) error {
-	pubKeyBytes, err := base64.StdEncoding.DecodeString(pubkey)
+// wgConfig converts p for wgctrl.
+func (p PeerConfig) wgConfig() (wgtypes.PeerConfig, error) {
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(p.PublicKey)
 	if err != nil {
-		return fmt.Errorf("decode public key: %w", err)
+		return wgtypes.PeerConfig{}, fmt.Errorf("decode public key: %w", err)
 	}
 	var pubKeyArr wgtypes.Key
 	copy(pubKeyArr[:], pubKeyBytes)
+	if p.Remove {
+		return wgtypes.PeerConfig{PublicKey: pubKeyArr, Remove: true}, nil
+	}
 
-	config := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{{
-			PublicKey: pubKeyArr,
-			Remove:   true,
-		}},
+	// A nil PresharedKey leaves the one already set untouched
+	var pskArr *wgtypes.Key
+	if p.PSK != "" {
+		pskBytes, err := base64.StdEncoding.DecodeString(p.PSK)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("decode psk: %w", err)
+		}
+		pskArr = &wgtypes.Key{}
+		copy(pskArr[:], pskBytes)
 	}
 
-	client, err := wgctrl.New()
-	if err != nil {
-		return fmt.Errorf("wgctrl.New: %w", err)
+	var allowedIPs []net.IPNet
+	for i, cidr := range PeerAllowedIPs(p.VpnIP, p.Routes) {
+		_, allowedNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			if i == 0 {
+				return wgtypes.PeerConfig{}, fmt.Errorf("parse vpn ip: %w", err)
+			}
+			return wgtypes.PeerConfig{}, fmt.Errorf("parse advertised route: %w", err)
+		}
+		allowedIPs = append(allowedIPs, *allowedNet)
 	}
-	defer client.Close()
-	return client.ConfigureDevice(iface, config)
+
+	keepalive := p.Keepalive
+	return wgtypes.PeerConfig{
+		PublicKey:                   pubKeyArr,
+		PresharedKey:                pskArr,
+		AllowedIPs:                  allowedIPs,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+	}, nil
 }
 
-// GetDevice returns the WireGuard device info.
-func (c *RealWGClient) GetDevice(iface string) (*DeviceInfo, error) {
-	client, err := wgctrl.New()
-	if err != nil {
-		return nil, fmt.Errorf("wgctrl.New: %w", err)
+// syncPeerRoutes replaces the kernel routes of a peer's previous advertised
+// routes with routes for the current ones. It fails rather than take over a
+// route the host has through another interface.
+func syncPeerRoutes(iface string, previous, current []net.IPNet) error {
+	keep := make(map[string]bool)
+	for _, n := range current {
+		prefix, err := netip.ParsePrefix(n.String())
+		if err != nil {
+			return fmt.Errorf("parse route %s: %w", n.String(), err)
+		}
+		if err := addRoute(iface, prefix); err != nil {
+			return err
+		}
+		keep[prefix.String()] = true
 	}
-	defer client.Close()
+	for _, n := range previous {
+		prefix, err := netip.ParsePrefix(n.String())
+		if err != nil || keep[prefix.String()] {
+			continue
+		}
+		if err := deleteRoute(iface, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	dev, err := client.Device(iface)
+// GetDevice returns the WireGuard device info.
+func (c *RealWGClient) GetDevice(iface string) (*DeviceInfo, error) {
+	var dev *wgtypes.Device
+	err := c.do(func(client *wgctrl.Client) error {
+		var err error
+		dev, err = client.Device(iface)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("get device %s: %w", iface, err)
 	}
@@ -196,6 +347,9 @@ func (c *RealWGClient) GetDevice(iface string) (*DeviceInfo, error) {
 		PublicKey:  base64.StdEncoding.EncodeToString(dev.PublicKey[:]),
 		ListenPort: dev.ListenPort,
 	}
+	if link, err := net.InterfaceByName(iface); err == nil {
+		info.MTU = link.MTU
+	}
 
 	for _, p := range dev.Peers {
 		var allowedIPs []string
@@ -213,6 +367,7 @@ func (c *RealWGClient) GetDevice(iface string) (*DeviceInfo, error) {
 			LastHandshakeTime: p.LastHandshakeTime,
 			ReceiveBytes:      p.ReceiveBytes,
 			TransmitBytes:     p.TransmitBytes,
+			Keepalive:         p.PersistentKeepaliveInterval,
 		})
 	}
 
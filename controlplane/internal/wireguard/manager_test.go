@@ -3,6 +3,7 @@ package wireguard
 import (
 	"encoding/base64"
 	"fmt"
+	"net/netip"
 	"strings"
 	"testing"
 	"time"
@@ -24,13 +25,14 @@ func NewMockWGClient() *MockWGClient {
 	}
 }
 
-func (m *MockWGClient) AddPeer(iface string, pubkey, psk, vpnIP string) error {
+func (m *MockWGClient) AddPeer(iface string, pubkey, psk, vpnIP string, routes []string, keepalive time.Duration) error {
 	if m.addErr != nil {
 		return m.addErr
 	}
 	m.peers[pubkey] = PeerInfo{
 		PublicKey:  pubkey,
-		AllowedIPs: []string{vpnIP + "/32"},
+		AllowedIPs: PeerAllowedIPs(vpnIP, routes),
+		Keepalive:  keepalive,
 	}
 	return nil
 }
@@ -46,6 +48,23 @@ func (m *MockWGClient) RemovePeer(iface string, pubkey string) error {
 	return nil
 }
 
+func (m *MockWGClient) ApplyPeers(iface string, peers []PeerConfig) error {
+	for _, p := range peers {
+		var err error
+		if p.Remove {
+			err = m.RemovePeer(iface, p.PublicKey)
+		} else {
+			err = m.AddPeer(iface, p.PublicKey, p.PSK, p.VpnIP, p.Routes, p.Keepalive)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MockWGClient) HostPrefixes(iface string) ([]netip.Prefix, error) { return nil, nil }
+
 func (m *MockWGClient) GetDevice(iface string) (*DeviceInfo, error) {
 	if m.getErr != nil {
 		return nil, m.getErr
@@ -65,7 +84,7 @@ func TestManagerAddPeer(t *testing.T) {
 	mock := NewMockWGClient()
 	mgr := NewManager("wg0", mock)
 
-	err := mgr.AddPeer("pubkey1", "psk1", "10.0.0.2")
+	err := mgr.AddPeer("pubkey1", "psk1", "10.0.0.2", nil, DefaultKeepalive)
 	if err != nil {
 		t.Fatalf("add peer: %v", err)
 	}
@@ -81,6 +100,122 @@ func TestManagerAddPeer(t *testing.T) {
 	if peer.AllowedIPs[0] != "10.0.0.2/32" {
 		t.Errorf("expected allowed IP 10.0.0.2/32, got %s", peer.AllowedIPs[0])
 	}
+	if peer.Keepalive != 25*time.Second {
+		t.Errorf("expected keepalive 25s, got %s", peer.Keepalive)
+	}
+}
+
+func TestClientConfigRender(t *testing.T) {
+	c := ClientConfig{
+		PrivateKey: "priv", Address: "10.0.0.2", DNS: []string{"10.0.0.53", "corp.example.com"}, MTU: 1380,
+		ServerPubKey: "server", PresharedKey: "psk",
+		ServerEndpoint: "203.0.113.1:51820", AllowedIPs: []string{"10.0.0.1/32"}, Keepalive: 10 * time.Second,
+	}
+	config := c.Render()
+	for _, line := range []string{
+		"DNS = 10.0.0.53, corp.example.com\n", "MTU = 1380\n",
+		"PresharedKey = psk\n", "AllowedIPs = 10.0.0.1/32\n", "PersistentKeepalive = 10\n",
+	} {
+		if !strings.Contains(config, line) {
+			t.Errorf("expected %q in config, got:\n%s", line, config)
+		}
+	}
+
+	c.PresharedKey, c.Keepalive, c.DNS, c.MTU = "", 0, nil, 0
+	config = c.Render()
+	for _, key := range []string{"PresharedKey", "PersistentKeepalive", "DNS", "MTU"} {
+		if strings.Contains(config, key) {
+			t.Errorf("expected no %s line, got:\n%s", key, config)
+		}
+	}
+}
+
+func TestClientConfigRenderFormat(t *testing.T) {
+	c := ClientConfig{
+		PrivateKey: "priv", Address: "10.0.0.2", DNS: []string{"10.0.0.53", "corp.example.com"}, MTU: 1380,
+		ServerPubKey: "server", PresharedKey: "psk",
+		ServerEndpoint: "203.0.113.1:51820", AllowedIPs: []string{"10.0.0.0/24", "::/0"}, Keepalive: 10 * time.Second,
+	}
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{FormatWGQuick, []string{"[Interface]\nPrivateKey = priv\n"}},
+		{FormatNMConnection, []string{
+			"interface-name=wg1\n", "private-key=priv\nmtu=1380\n", "[wireguard-peer.server]\nendpoint=203.0.113.1:51820\n",
+			"allowed-ips=10.0.0.0/24;::/0;\n", "address1=10.0.0.2/32\n", "dns=10.0.0.53;\n", "dns-search=corp.example.com;\n",
+		}},
+		{FormatMikroTik, []string{
+			`/interface wireguard add name=wg1 private-key="priv" mtu=1380`,
+			`preshared-key="psk" endpoint-address=203.0.113.1 endpoint-port=51820 allowed-address=10.0.0.0/24,::/0 persistent-keepalive=10s`,
+			"/ip route add dst-address=10.0.0.0/24 gateway=wg1\n", "/ipv6 route add dst-address=::/0 gateway=wg1\n",
+		}},
+		{FormatSystemdNetworkd, []string{
+			"[NetDev]\nName=wg1\nKind=wireguard\nMTUBytes=1380\n", "PresharedKey=psk\n", "AllowedIPs=10.0.0.0/24,::/0\n",
+			"[Network]\nAddress=10.0.0.2/32\nDNS=10.0.0.53\nDomains=corp.example.com\n", "[Route]\nDestination=::/0\n",
+		}},
+	}
+	for _, tt := range tests {
+		config, err := c.RenderFormat(tt.format, "wg1")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(config, want) {
+				t.Errorf("%s: expected %q in config, got:\n%s", tt.format, want, config)
+			}
+		}
+	}
+	if _, err := c.RenderFormat("openvpn", ""); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestClientConfigVia(t *testing.T) {
+	c := ClientConfig{
+		PrivateKey: "priv", Address: "10.0.0.2", ServerPubKey: "server",
+		ServerEndpoint: "203.0.113.1:51820", AllowedIPs: []string{"10.0.0.1/32"},
+	}
+	via := c.Via(Fallback{Transport: TransportUDP2TCP, Host: "203.0.113.1", Port: 8443, WGPort: 51821})
+	if c.ServerEndpoint != "203.0.113.1:51820" || c.Notes != nil {
+		t.Errorf("expected Via to leave the original config untouched, got %+v", c)
+	}
+	config := via.Render()
+	for _, want := range []string{
+		"# udp2tcp --udp-listen 127.0.0.1:51820 --tcp-forward 203.0.113.1:8443\n\n[Interface]\n",
+		"MTU = 1280\n", "Endpoint = 127.0.0.1:51820\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("expected %q in config, got:\n%s", want, config)
+		}
+	}
+
+	// An explicit MTU is kept
+	c.MTU = 1200
+	if got := c.Via(Fallback{Transport: TransportWSTunnel, Host: "wg.example.com", Port: 443, WGPort: 51821}); got.MTU != 1200 {
+		t.Errorf("expected MTU 1200, got %d", got.MTU)
+	}
+	ws := Fallback{Transport: TransportWSTunnel, Host: "wg.example.com", Port: 443, WGPort: 51821}
+	if got, want := ws.RelayCommand(), "wstunnel client -L 'udp://127.0.0.1:51820:127.0.0.1:51821?timeout_sec=0' wss://wg.example.com:443"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestClientAllowedIPs(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", "10.0.0.1/32"},
+		{RoutingSplit, "10.0.0.1/32"},
+		{RoutingSubnet, "10.0.0.0/24"},
+		{RoutingFull, "0.0.0.0/0, ::/0"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(ClientAllowedIPs(tt.mode, "10.0.0.1", "10.0.0.1/24"), ", "); got != tt.want {
+			t.Errorf("mode %q: expected %s, got %s", tt.mode, tt.want, got)
+		}
+	}
 }
 
 func TestManagerAddPeerError(t *testing.T) {
@@ -88,7 +223,7 @@ func TestManagerAddPeerError(t *testing.T) {
 	mock.addErr = fmt.Errorf("kernel error")
 	mgr := NewManager("wg0", mock)
 
-	err := mgr.AddPeer("pubkey1", "psk1", "10.0.0.2")
+	err := mgr.AddPeer("pubkey1", "psk1", "10.0.0.2", nil, DefaultKeepalive)
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -101,7 +236,7 @@ func TestManagerRemovePeer(t *testing.T) {
 	mock := NewMockWGClient()
 	mgr := NewManager("wg0", mock)
 
-	mgr.AddPeer("pubkey1", "psk1", "10.0.0.2")
+	mgr.AddPeer("pubkey1", "psk1", "10.0.0.2", nil, DefaultKeepalive)
 
 	err := mgr.RemovePeer("pubkey1")
 	if err != nil {
@@ -122,6 +257,52 @@ func TestManagerRemovePeerNotFound(t *testing.T) {
 	}
 }
 
+func TestManagerApplyPeers(t *testing.T) {
+	mock := NewMockWGClient()
+	mgr := NewManager("wg0", mock)
+	mgr.AddPeer("pubkey1", "psk1", "10.0.0.2", nil, DefaultKeepalive)
+
+	err := mgr.ApplyPeers([]PeerConfig{
+		{PublicKey: "pubkey2", VpnIP: "10.0.0.3", Routes: []string{"192.168.1.0/24"}, Keepalive: DefaultKeepalive},
+		{PublicKey: "pubkey1", Remove: true},
+	})
+	if err != nil {
+		t.Fatalf("apply peers: %v", err)
+	}
+	if _, ok := mock.peers["pubkey1"]; ok || len(mock.peers) != 1 {
+		t.Errorf("expected only pubkey2, got %v", mock.peers)
+	}
+	if ips := mock.peers["pubkey2"].AllowedIPs; len(ips) != 2 || ips[1] != "192.168.1.0/24" {
+		t.Errorf("unexpected allowed IPs: %v", ips)
+	}
+}
+
+func TestPeerConfigWGConfig(t *testing.T) {
+	_, pub, _ := GenerateKeyPair()
+	psk, _ := GeneratePSK()
+
+	pc, err := PeerConfig{PublicKey: pub, PSK: psk, VpnIP: "10.0.0.2", Routes: []string{"192.168.1.0/24"}, Keepalive: DefaultKeepalive}.wgConfig()
+	if err != nil {
+		t.Fatalf("convert peer: %v", err)
+	}
+	if pc.PresharedKey == nil || len(pc.AllowedIPs) != 2 || pc.AllowedIPs[0].String() != "10.0.0.2/32" || !pc.ReplaceAllowedIPs {
+		t.Errorf("unexpected peer config: %+v", pc)
+	}
+	if *pc.PersistentKeepaliveInterval != DefaultKeepalive {
+		t.Errorf("expected keepalive %v, got %v", DefaultKeepalive, *pc.PersistentKeepaliveInterval)
+	}
+
+	if pc, err := (PeerConfig{PublicKey: pub, Remove: true}).wgConfig(); err != nil || !pc.Remove || pc.AllowedIPs != nil {
+		t.Errorf("expected a removal, got %+v (%v)", pc, err)
+	}
+	if _, err := (PeerConfig{PublicKey: "not base64!", VpnIP: "10.0.0.2"}).wgConfig(); err == nil {
+		t.Error("expected error for an invalid public key")
+	}
+	if _, err := (PeerConfig{PublicKey: pub, VpnIP: "10.0.0"}).wgConfig(); err == nil {
+		t.Error("expected error for an invalid VPN IP")
+	}
+}
+
 func TestManagerListPeers(t *testing.T) {
 	mock := NewMockWGClient()
 	mock.peers["pk1"] = PeerInfo{
@@ -0,0 +1,192 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// PeerAllowedIPs returns the server-side AllowedIPs of a peer: its VPN IP
+// plus the LAN prefixes it advertises.
+func PeerAllowedIPs(vpnIP string, routes []string) []string {
+	allowed := []string{vpnIP + "/32"}
+	for _, r := range routes {
+		if p, err := netip.ParsePrefix(r); err == nil {
+			allowed = append(allowed, p.Masked().String())
+		}
+	}
+	return allowed
+}
+
+// addRoute points a kernel route for prefix at iface. A route the main table
+// already has for prefix through another interface is a conflict, not
+// something to replace: it is how the host reaches that network.
+func addRoute(iface string, prefix netip.Prefix) error {
+	err := routeRequest(unix.RTM_NEWROUTE, netlink.Create|netlink.Excl, iface, prefix)
+	if !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("lookup interface %s: %w", iface, err)
+	}
+	routes, err := mainRoutes()
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if r.prefix == prefix.Masked() && r.oif == link.Index {
+			return nil
+		}
+	}
+	return fmt.Errorf("route %s via %s: the host already routes it through another interface", prefix, iface)
+}
+
+// deleteRoute removes the kernel route for prefix through iface, if any.
+func deleteRoute(iface string, prefix netip.Prefix) error {
+	err := routeRequest(unix.RTM_DELROUTE, 0, iface, prefix)
+	if errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+// kernelRoute is a unicast route of the main table.
+type kernelRoute struct {
+	prefix netip.Prefix
+	oif    int // index of the outgoing interface; 0 when it has none
+}
+
+// mainRoutes lists the IPv4 unicast routes of the main routing table.
+func mainRoutes() ([]kernelRoute, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial rtnetlink: %w", err)
+	}
+	defer conn.Close()
+	rtm := make([]byte, unix.SizeofRtMsg)
+	rtm[0] = unix.AF_INET
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: unix.RTM_GETROUTE, Flags: netlink.Request | netlink.Dump},
+		Data:   rtm,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list routes: %w", err)
+	}
+
+	var routes []kernelRoute
+	for _, m := range msgs {
+		if len(m.Data) < unix.SizeofRtMsg || m.Data[7] != unix.RTN_UNICAST {
+			continue
+		}
+		table, bits := uint32(m.Data[4]), int(m.Data[1])
+		ad, err := netlink.NewAttributeDecoder(m.Data[unix.SizeofRtMsg:])
+		if err != nil {
+			continue
+		}
+		dst, oif := netip.IPv4Unspecified(), 0
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.RTA_DST:
+				if addr, ok := netip.AddrFromSlice(ad.Bytes()); ok {
+					dst = addr
+				}
+			case unix.RTA_OIF:
+				oif = int(ad.Uint32())
+			case unix.RTA_TABLE:
+				table = ad.Uint32()
+			}
+		}
+		if table != unix.RT_TABLE_MAIN {
+			continue
+		}
+		routes = append(routes, kernelRoute{prefix: netip.PrefixFrom(dst, bits).Masked(), oif: oif})
+	}
+	return routes, nil
+}
+
+// HostPrefixes returns the IPv4 networks the host reaches other than through
+// iface: those of its interface addresses and the specific routes of the
+// main table. The default route is left out.
+func (c *RealWGClient) HostPrefixes(iface string) ([]netip.Prefix, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("list interfaces: %w", err)
+	}
+	var prefixes []netip.Prefix
+	wgIndex := 0
+	for _, link := range ifaces {
+		if link.Name == iface {
+			wgIndex = link.Index
+			continue
+		}
+		addrs, err := link.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("list addresses of %s: %w", link.Name, err)
+		}
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil && p.Addr().Is4() {
+				prefixes = append(prefixes, p.Masked())
+			}
+		}
+	}
+
+	routes, err := mainRoutes()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if r.prefix.Bits() > 0 && (wgIndex == 0 || r.oif != wgIndex) {
+			prefixes = append(prefixes, r.prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// routeRequest sends one rtnetlink route message for prefix via iface in the
+// main routing table.
+func routeRequest(typ netlink.HeaderType, flags netlink.HeaderFlags, iface string, prefix netip.Prefix) error {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("lookup interface %s: %w", iface, err)
+	}
+
+	family := byte(unix.AF_INET)
+	if prefix.Addr().Is6() {
+		family = unix.AF_INET6
+	}
+	// struct rtmsg
+	rtm := make([]byte, unix.SizeofRtMsg)
+	rtm[0] = family
+	rtm[1] = byte(prefix.Bits())
+	rtm[4] = unix.RT_TABLE_MAIN
+	rtm[5] = unix.RTPROT_STATIC
+	rtm[6] = unix.RT_SCOPE_LINK
+	rtm[7] = unix.RTN_UNICAST
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.RTA_DST, prefix.Masked().Addr().AsSlice())
+	ae.Uint32(unix.RTA_OIF, uint32(link.Index))
+	attrs, err := ae.Encode()
+	if err != nil {
+		return fmt.Errorf("encode route attributes: %w", err)
+	}
+
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return fmt.Errorf("dial rtnetlink: %w", err)
+	}
+	defer conn.Close()
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: typ, Flags: netlink.Request | netlink.Acknowledge | flags},
+		Data:   append(rtm, attrs...),
+	})
+	if err != nil {
+		return fmt.Errorf("route %s via %s: %w", prefix, iface, err)
+	}
+	return nil
+}
@@ -0,0 +1,572 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// dataEnvelope unwraps responses of the form {"data": ...}.
+type dataEnvelope[T any] struct {
+	Data T `json:"data"`
+}
+
+// CreateTunnel creates a WireGuard tunnel.
+func (c *Client) CreateTunnel(ctx context.Context, req CreateTunnelRequest) (*CreatedTunnel, error) {
+	var out CreatedTunnel
+	if err := c.do(ctx, http.MethodPost, "/api/v1/tunnels", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListTunnels lists the tunnels visible to the caller.
+func (c *Client) ListTunnels(ctx context.Context, opts *ListTunnelsOptions) ([]Tunnel, error) {
+	path := "/api/v1/tunnels"
+	if opts != nil && (len(opts.Labels) > 0 || opts.Deleted || opts.Name != "" || opts.OwnerEmail != "" || opts.PendingApproval) {
+		keys := make([]string, 0, len(opts.Labels))
+		for k := range opts.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		q := url.Values{}
+		for _, k := range keys {
+			q.Add("label", k+"="+opts.Labels[k])
+		}
+		if opts.Deleted {
+			q.Set("deleted", "true")
+		}
+		if opts.Name != "" {
+			q.Set("name", opts.Name)
+		}
+		if opts.OwnerEmail != "" {
+			q.Set("owner_email", opts.OwnerEmail)
+		}
+		if opts.PendingApproval {
+			q.Set("pending_approval", "true")
+		}
+		path += "?" + q.Encode()
+	}
+
+	var out dataEnvelope[[]Tunnel]
+	if err := c.do(ctx, http.MethodGet, path, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// PutTunnelByName creates the tunnel with the given name, or updates the
+// existing one to match req. Created is only set when the call created the
+// tunnel; it holds the tunnel's ID and key material, which is not
+// retrievable again, and tunnel the rest.
+func (c *Client) PutTunnelByName(ctx context.Context, name string, req CreateTunnelRequest) (tunnel *Tunnel, created *CreatedTunnel, err error) {
+	var out struct {
+		Data        *Tunnel        `json:"data"`
+		Credentials *CreatedTunnel `json:"credentials"`
+	}
+	if err := c.do(ctx, http.MethodPut, "/api/v1/tunnels/by-name/"+url.PathEscape(name), req, &out); err != nil {
+		return nil, nil, err
+	}
+	if out.Data == nil {
+		return nil, nil, fmt.Errorf("put tunnel %q: response has no data", name)
+	}
+	if created = out.Credentials; created != nil {
+		created.ID, created.Name, created.VpnIP = out.Data.ID, out.Data.Name, out.Data.VpnIP
+		created.PendingApproval = out.Data.PendingApproval
+	}
+	return out.Data, created, nil
+}
+
+// GetTunnel returns a tunnel and its routes.
+func (c *Client) GetTunnel(ctx context.Context, id string) (*TunnelDetail, error) {
+	var out dataEnvelope[TunnelDetail]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/tunnels/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ListTunnelRoutes lists the routes of a tunnel.
+func (c *Client) ListTunnelRoutes(ctx context.Context, id string) ([]Route, error) {
+	var out dataEnvelope[[]Route]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/tunnels/"+url.PathEscape(id)+"/routes", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// SetTunnelLabels replaces a tunnel's labels.
+func (c *Client) SetTunnelLabels(ctx context.Context, id string, labels map[string]string) (*Tunnel, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return c.UpdateTunnel(ctx, id, UpdateTunnelRequest{Labels: &labels})
+}
+
+// UpdateTunnel changes a tunnel's labels, source CIDR, or enabled state.
+func (c *Client) UpdateTunnel(ctx context.Context, id string, req UpdateTunnelRequest) (*Tunnel, error) {
+	var out dataEnvelope[Tunnel]
+	if err := c.do(ctx, http.MethodPatch, "/api/v1/tunnels/"+url.PathEscape(id), req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// TunnelEndpoints returns the endpoints a tunnel's peer has connected from, newest first.
+func (c *Client) TunnelEndpoints(ctx context.Context, id string) ([]EndpointChange, error) {
+	var out dataEnvelope[[]EndpointChange]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/tunnels/"+url.PathEscape(id)+"/endpoints", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// TunnelEvents returns a tunnel's peer connect and disconnect events, newest first.
+func (c *Client) TunnelEvents(ctx context.Context, id string) ([]PeerEvent, error) {
+	var out dataEnvelope[[]PeerEvent]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/tunnels/"+url.PathEscape(id)+"/events", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// DeleteTunnel deletes a tunnel and its routes. Unless the server's
+// retention is zero, RestoreTunnel can bring them back until it is purged.
+// A tunnel with routes or firewall rules referencing it is only deleted
+// with force; otherwise the server returns 409.
+func (c *Client) DeleteTunnel(ctx context.Context, id string, force bool) error {
+	path := "/api/v1/tunnels/" + url.PathEscape(id)
+	if force {
+		path += "?force=true"
+	}
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// RestoreTunnel restores a soft-deleted tunnel and its routes.
+func (c *Client) RestoreTunnel(ctx context.Context, id string) (*RestoredTunnel, error) {
+	var out dataEnvelope[RestoredTunnel]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/tunnels/"+url.PathEscape(id)+"/restore", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ApproveTunnel applies a tunnel awaiting approval. It requires the admin role.
+func (c *Client) ApproveTunnel(ctx context.Context, id string) (*Tunnel, error) {
+	var out dataEnvelope[Tunnel]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/tunnels/"+url.PathEscape(id)+"/approve", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// RejectTunnel discards a tunnel awaiting approval. The reason is passed on
+// to webhook receivers. It requires the admin role.
+func (c *Client) RejectTunnel(ctx context.Context, id, reason string) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/tunnels/"+url.PathEscape(id)+"/reject", map[string]string{"reason": reason}, nil)
+}
+
+// GetTunnelConfig returns the WireGuard client config template for a tunnel.
+func (c *Client) GetTunnelConfig(ctx context.Context, id string) (string, error) {
+	return c.GetTunnelConfigFormat(ctx, id, "", "")
+}
+
+// GetTunnelConfigFormat returns a tunnel's client config in another format:
+// "wg-quick", "nmconnection", "mikrotik", or "systemd-networkd". iface names
+// the client interface where the format declares one; "" uses wg0.
+func (c *Client) GetTunnelConfigFormat(ctx context.Context, id, format, iface string) (string, error) {
+	path := "/api/v1/tunnels/" + url.PathEscape(id) + "/config"
+	q := url.Values{}
+	if format != "" {
+		q.Set("format", format)
+	}
+	if iface != "" {
+		q.Set("interface", iface)
+	}
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	body, err := c.doRaw(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// GetRotationPolicy returns a tunnel's rotation policy.
+func (c *Client) GetRotationPolicy(ctx context.Context, id string) (*RotationPolicy, error) {
+	var out RotationPolicy
+	if err := c.do(ctx, http.MethodGet, "/api/v1/tunnels/"+url.PathEscape(id)+"/rotation-policy", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateRotationPolicy updates a tunnel's rotation policy.
+func (c *Client) UpdateRotationPolicy(ctx context.Context, id string, req UpdateRotationPolicyRequest) (*RotationPolicy, error) {
+	var out RotationPolicy
+	if err := c.do(ctx, http.MethodPatch, "/api/v1/tunnels/"+url.PathEscape(id)+"/rotation-policy", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeferRevocation postpones a tunnel's inactivity revocation by the given
+// number of days from now and returns the new revocation time.
+func (c *Client) DeferRevocation(ctx context.Context, id string, days int) (*time.Time, error) {
+	var out struct {
+		RevocationAt *time.Time `json:"revocation_at"`
+	}
+	body := map[string]int{"days": days}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/tunnels/"+url.PathEscape(id)+"/defer-revocation", body, &out); err != nil {
+		return nil, err
+	}
+	return out.RevocationAt, nil
+}
+
+// TunnelStats returns a tunnel's traffic history between from and to in
+// buckets of the given resolution. Zero values use the server defaults.
+func (c *Client) TunnelStats(ctx context.Context, id string, from, to time.Time, resolution time.Duration) (*TunnelStats, error) {
+	var out dataEnvelope[TunnelStats]
+	if err := c.do(ctx, http.MethodGet, statsPath("/api/v1/tunnels/"+url.PathEscape(id)+"/stats", from, to, resolution), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// statsPath adds the range and resolution of a stats request to path,
+// leaving out zero values.
+func statsPath(path string, from, to time.Time, resolution time.Duration) string {
+	q := url.Values{}
+	if !from.IsZero() {
+		q.Set("from", from.UTC().Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		q.Set("to", to.UTC().Format(time.RFC3339))
+	}
+	if resolution > 0 {
+		q.Set("resolution", resolution.String())
+	}
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return path
+}
+
+// CreateRoute creates an L4 route.
+func (c *Client) CreateRoute(ctx context.Context, req CreateRouteRequest) (*Route, error) {
+	var out dataEnvelope[Route]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/routes", req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// PutRouteByName creates the route with the given name, or updates the
+// priority of the existing one. Changing any other field is a conflict.
+func (c *Client) PutRouteByName(ctx context.Context, name string, req CreateRouteRequest) (*Route, error) {
+	var out dataEnvelope[Route]
+	if err := c.do(ctx, http.MethodPut, "/api/v1/routes/by-name/"+url.PathEscape(name), req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ListRoutes lists the routes visible to the caller.
+func (c *Client) ListRoutes(ctx context.Context) ([]Route, error) {
+	var out dataEnvelope[[]Route]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/routes", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// GetRoute returns a route and a summary of its tunnel.
+func (c *Client) GetRoute(ctx context.Context, id string) (*RouteDetail, error) {
+	var out dataEnvelope[RouteDetail]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/routes/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// UpdateRoute changes a route's priority.
+func (c *Client) UpdateRoute(ctx context.Context, id string, req UpdateRouteRequest) (*Route, error) {
+	var out dataEnvelope[Route]
+	if err := c.do(ctx, http.MethodPatch, "/api/v1/routes/"+url.PathEscape(id), req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// DeleteRoute deletes a route.
+func (c *Client) DeleteRoute(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/routes/"+url.PathEscape(id), nil, nil)
+}
+
+// RouteStats returns the connection and traffic history of a route between
+// from and to in buckets of the given resolution. Zero values use the server
+// defaults.
+func (c *Client) RouteStats(ctx context.Context, id string, from, to time.Time, resolution time.Duration) (*RouteStats, error) {
+	var out dataEnvelope[RouteStats]
+	if err := c.do(ctx, http.MethodGet, statsPath("/api/v1/routes/"+url.PathEscape(id)+"/stats", from, to, resolution), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// AddFirewallRule creates a dynamic firewall rule.
+func (c *Client) AddFirewallRule(ctx context.Context, req CreateFirewallRuleRequest) (*FirewallRule, error) {
+	var out dataEnvelope[FirewallRule]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/firewall/rules", req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// PutFirewallRuleByName creates the firewall rule with the given name, or
+// updates the source CIDR and action of the existing one. Changing its port,
+// protocol, chain, or direction is a conflict.
+func (c *Client) PutFirewallRuleByName(ctx context.Context, name string, req CreateFirewallRuleRequest) (*FirewallRule, error) {
+	var out dataEnvelope[FirewallRule]
+	if err := c.do(ctx, http.MethodPut, "/api/v1/firewall/rules/by-name/"+url.PathEscape(name), req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ListFirewallRules lists the firewall rules visible to the caller.
+func (c *Client) ListFirewallRules(ctx context.Context) ([]FirewallRule, error) {
+	var out dataEnvelope[[]FirewallRule]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/firewall/rules", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// UpdateFirewallRule changes a firewall rule's source CIDR, action, enabled
+// flag, active hours, description, or group.
+func (c *Client) UpdateFirewallRule(ctx context.Context, id string, req UpdateFirewallRuleRequest) (*FirewallRule, error) {
+	var out dataEnvelope[FirewallRule]
+	if err := c.do(ctx, http.MethodPatch, "/api/v1/firewall/rules/"+url.PathEscape(id), req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// DeleteFirewallRule deletes a firewall rule.
+func (c *Client) DeleteFirewallRule(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/firewall/rules/"+url.PathEscape(id), nil, nil)
+}
+
+// BulkCreateFirewallRules creates many firewall rules in one request. By
+// default either all of them are created or, if any is invalid, none;
+// bestEffort creates the valid ones and reports the others in the results.
+func (c *Client) BulkCreateFirewallRules(ctx context.Context, rules []CreateFirewallRuleRequest, bestEffort bool) (*BulkFirewallRules, error) {
+	path := "/api/v1/firewall/rules/bulk"
+	if bestEffort {
+		path += "?mode=best_effort"
+	}
+	var out dataEnvelope[BulkFirewallRules]
+	if err := c.do(ctx, http.MethodPost, path, rules, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// SimulateFirewall reports whether the stored firewall rules let a
+// connection through, and which rule or policy decides.
+func (c *Client) SimulateFirewall(ctx context.Context, req SimulateFirewallRequest) (*FirewallSimulation, error) {
+	var out dataEnvelope[FirewallSimulation]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/firewall/rules/simulate", req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// DeleteFirewallRuleGroup deletes every firewall rule in a group visible to
+// the caller.
+func (c *Client) DeleteFirewallRuleGroup(ctx context.Context, group string) (*DeletedFirewallGroup, error) {
+	var out dataEnvelope[DeletedFirewallGroup]
+	if err := c.do(ctx, http.MethodDelete, "/api/v1/firewall/groups/"+url.PathEscape(group), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ListBans lists the active automatic bans. Requires the admin role.
+func (c *Client) ListBans(ctx context.Context) ([]Ban, error) {
+	var out dataEnvelope[[]Ban]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/firewall/bans", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// CreateTenant creates a tenant. Requires the admin role.
+func (c *Client) CreateTenant(ctx context.Context, req CreateTenantRequest) (*Tenant, error) {
+	var out dataEnvelope[Tenant]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/tenants", req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ListTenants lists all tenants. Requires the admin role.
+func (c *Client) ListTenants(ctx context.Context) ([]Tenant, error) {
+	var out dataEnvelope[[]Tenant]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/tenants", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// DeleteTenant deletes a tenant that owns no resources. Requires the admin role.
+func (c *Client) DeleteTenant(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/tenants/"+url.PathEscape(id), nil, nil)
+}
+
+// IssueCert issues an API client certificate signed by the control plane's
+// client CA. Requires the admin role.
+func (c *Client) IssueCert(ctx context.Context, req IssueCertRequest) (*ClientCert, error) {
+	var out dataEnvelope[ClientCert]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/certs", req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ListCerts lists the issued client certificates, newest first. Requires the
+// admin role.
+func (c *Client) ListCerts(ctx context.Context) ([]ClientCert, error) {
+	var out dataEnvelope[[]ClientCert]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/certs", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// RevokeCert revokes an issued client certificate by its serial. Requires
+// the admin role.
+func (c *Client) RevokeCert(ctx context.Context, serial, reason string) (*ClientCert, error) {
+	var out dataEnvelope[ClientCert]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/certs/"+url.PathEscape(serial)+"/revoke", map[string]string{"reason": reason}, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// GetCRL returns the PEM revocation list of the issued client certificates.
+func (c *Client) GetCRL(ctx context.Context) (string, error) {
+	body, err := c.doRaw(ctx, http.MethodGet, "/api/v1/certs/crl", nil)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// CreateNode creates a node. Requires the admin role.
+func (c *Client) CreateNode(ctx context.Context, req CreateNodeRequest) (*Node, error) {
+	var out dataEnvelope[Node]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/nodes", req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ListNodes lists all nodes.
+func (c *Client) ListNodes(ctx context.Context) ([]Node, error) {
+	var out dataEnvelope[[]Node]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/nodes", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Data, nil
+}
+
+// GetNode returns a node.
+func (c *Client) GetNode(ctx context.Context, id string) (*Node, error) {
+	var out dataEnvelope[Node]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/nodes/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// RouteNodes returns the status of a route on each node serving it.
+func (c *Client) RouteNodes(ctx context.Context, id string) (*RouteNodes, error) {
+	var out dataEnvelope[RouteNodes]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/routes/"+url.PathEscape(id)+"/nodes", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// DeleteNode deletes a node with no tunnels. Requires the admin role.
+func (c *Client) DeleteNode(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/nodes/"+url.PathEscape(id), nil, nil)
+}
+
+// RegisterNode registers the node whose agent certificate the client uses.
+func (c *Client) RegisterNode(ctx context.Context, req RegisterNodeRequest) (*Node, error) {
+	var out dataEnvelope[Node]
+	if err := c.do(ctx, http.MethodPost, "/api/v1/agent/register", req, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// NodeState returns the desired state of the agent's node.
+func (c *Client) NodeState(ctx context.Context) (*NodeState, error) {
+	var out dataEnvelope[NodeState]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/agent/state", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// ReportNode sends what the agent observed on its node.
+func (c *Client) ReportNode(ctx context.Context, report NodeReport) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/agent/report", report, nil)
+}
+
+// ServerPublicKey returns the VPS WireGuard public key.
+func (c *Client) ServerPublicKey(ctx context.Context) (string, error) {
+	var out struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/server/pubkey", nil, &out); err != nil {
+		return "", err
+	}
+	return out.PublicKey, nil
+}
+
+// Server returns the VPS WireGuard settings and control plane version.
+func (c *Client) Server(ctx context.Context) (*ServerInfo, error) {
+	var out dataEnvelope[ServerInfo]
+	if err := c.do(ctx, http.MethodGet, "/api/v1/server", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// Import adopts the WireGuard peers and Caddy routes the control plane does
+// not know. With dryRun it only reports what it would adopt.
+func (c *Client) Import(ctx context.Context, dryRun bool) (*ImportResult, error) {
+	path := "/api/v1/import"
+	if dryRun {
+		path += "?dry_run=true"
+	}
+	var out dataEnvelope[ImportResult]
+	if err := c.do(ctx, http.MethodPost, path, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Data, nil
+}
+
+// Reconcile triggers an immediate reconciliation.
+func (c *Client) Reconcile(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/reconcile", nil, nil)
+}
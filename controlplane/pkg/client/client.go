@@ -0,0 +1,262 @@
+// Package client is a Go client for the proxy-manager control plane API.
+//
+// Callers authenticate with an mTLS client certificate (WithTLSFiles or
+// WithHTTPClient) and/or a tenant API token (WithToken). Idempotent requests,
+// and POSTs made with WithIdempotencyKey, are retried on transport errors,
+// 429, and 5xx responses.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultMaxRetries = 3
+	defaultRetryWait  = 500 * time.Millisecond
+)
+
+// Client calls the control plane API.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+	maxRetries int
+	retryWait  time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client) error
+
+// New creates a client for the control plane at baseURL, e.g. "https://vps:7443".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("base URL is required")
+	}
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		maxRetries: defaultMaxRetries,
+		retryWait:  defaultRetryWait,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type idempotencyKeyCtx struct{}
+
+// WithIdempotencyKey returns a context that sends key as the Idempotency-Key
+// of a POST made with it. The server replays the first response for the key,
+// so such POSTs are retried like idempotent requests. Use a new key for
+// each distinct operation.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+type ifMatchCtx struct{}
+
+// WithIfMatch returns a context that sends etag as the If-Match header of a
+// PATCH or DELETE made with it. If the resource changed since etag was read,
+// the request fails and IsPreconditionFailed reports true.
+func WithIfMatch(ctx context.Context, etag string) context.Context {
+	return context.WithValue(ctx, ifMatchCtx{}, etag)
+}
+
+// WithHTTPClient uses the given *http.Client, e.g. one with a custom TLS config.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) error {
+		c.httpClient = hc
+		return nil
+	}
+}
+
+// WithTLSFiles configures mTLS from a client certificate, key, and the CA that
+// signed the control plane's server certificate.
+func WithTLSFiles(certFile, keyFile, caFile string) Option {
+	return func(c *Client) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("load client cert/key: %w", err)
+		}
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read CA cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("failed to parse CA certificate")
+		}
+		c.httpClient = &http.Client{
+			Timeout: defaultTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					RootCAs:      pool,
+					MinVersion:   tls.VersionTLS13,
+				},
+			},
+		}
+		return nil
+	}
+}
+
+// WithToken authenticates with a tenant API token.
+func WithToken(token string) Option {
+	return func(c *Client) error {
+		c.token = token
+		return nil
+	}
+}
+
+// WithRetries sets how many times idempotent requests are retried and the
+// initial wait between attempts, which doubles after each retry.
+func WithRetries(maxRetries int, wait time.Duration) Option {
+	return func(c *Client) error {
+		if maxRetries < 0 {
+			return fmt.Errorf("max retries must be non-negative")
+		}
+		c.maxRetries = maxRetries
+		c.retryWait = wait
+		return nil
+	}
+}
+
+// APIError is returned when the control plane responds with an error status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("control plane returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is an API 404.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is an API 409.
+func IsConflict(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// IsPreconditionFailed reports whether err is an API 412, returned when an
+// If-Match ETag is stale.
+func IsPreconditionFailed(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusPreconditionFailed
+}
+
+// do sends a JSON request and decodes the JSON response into out, if non-nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	body, err := c.doRaw(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	if out == nil || len(body) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// doRaw sends a request and returns the raw response body, retrying
+// idempotent methods on transient failures.
+func (c *Client) doRaw(ctx context.Context, method, path string, in interface{}) ([]byte, error) {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return nil, fmt.Errorf("encode request: %w", err)
+		}
+	}
+
+	retries := 0
+	if method == http.MethodGet || method == http.MethodDelete || method == http.MethodPut {
+		retries = c.maxRetries
+	}
+	if key, _ := ctx.Value(idempotencyKeyCtx{}).(string); key != "" && method == http.MethodPost {
+		retries = c.maxRetries
+	}
+
+	wait := c.retryWait
+	for attempt := 0; ; attempt++ {
+		body, retryable, err := c.attempt(ctx, method, path, payload)
+		if err == nil || !retryable || attempt >= retries {
+			return body, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte) ([]byte, bool, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return nil, false, fmt.Errorf("create request: %w", err)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if key, _ := ctx.Value(idempotencyKeyCtx{}).(string); key != "" && method == http.MethodPost {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if etag, _ := ctx.Value(ifMatchCtx{}).(string); etag != "" && (method == http.MethodPatch || method == http.MethodDelete) {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		msg := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			msg = e.Error
+		}
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retryable, &APIError{StatusCode: resp.StatusCode, Message: msg}
+	}
+	return body, false, nil
+}
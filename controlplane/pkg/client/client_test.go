@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc, opts ...Option) *Client {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	opts = append([]Option{WithRetries(2, time.Millisecond)}, opts...)
+	c, err := New(ts.URL, opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+func TestListTunnelsWithLabelsAndToken(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer pmt_test" {
+			t.Errorf("expected bearer token, got %q", got)
+		}
+		if got := r.URL.Query()["label"]; len(got) != 2 || got[0] != "env=prod" || got[1] != "team=a" {
+			t.Errorf("unexpected label selector: %v", got)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []map[string]interface{}{{
+				"id": "tun_1", "vpn_ip": "10.0.0.2", "labels": map[string]string{"env": "prod"},
+				"last_handshake": nil, "created_at": "2024-01-01T00:00:00Z", "updated_at": "2024-01-01T00:00:00Z",
+			}},
+		})
+	}, WithToken("pmt_test"))
+
+	tunnels, err := c.ListTunnels(context.Background(), &ListTunnelsOptions{
+		Labels: map[string]string{"team": "a", "env": "prod"},
+	})
+	if err != nil {
+		t.Fatalf("ListTunnels: %v", err)
+	}
+	if len(tunnels) != 1 || tunnels[0].ID != "tun_1" || tunnels[0].Labels["env"] != "prod" {
+		t.Errorf("unexpected tunnels: %+v", tunnels)
+	}
+	if tunnels[0].LastHandshake != nil {
+		t.Errorf("expected nil last handshake")
+	}
+}
+
+func TestAPIErrorDecoding(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "route not found"})
+	})
+
+	err := c.DeleteRoute(context.Background(), "route_missing")
+	if !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if apiErr := err.(*APIError); apiErr.Message != "route not found" {
+		t.Errorf("unexpected message: %q", apiErr.Message)
+	}
+}
+
+func TestRetriesIdempotentRequests(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": []interface{}{}})
+	})
+
+	if _, err := c.ListRoutes(context.Background()); err != nil {
+		t.Fatalf("ListRoutes: %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls.Load())
+	}
+}
+
+func TestDoesNotRetryPost(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	_, err := c.AddFirewallRule(context.Background(), CreateFirewallRuleRequest{Port: 8080, Proto: "tcp"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 attempt for POST, got %d", calls.Load())
+	}
+}
+
+func TestRetriesPostWithIdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Idempotency-Key") != "op-1" {
+			t.Errorf("expected Idempotency-Key op-1, got %q", r.Header.Get("Idempotency-Key"))
+		}
+		if calls.Add(1) < 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"data":{"id":"fw_1"}}`))
+	})
+
+	rule, err := c.AddFirewallRule(WithIdempotencyKey(context.Background(), "op-1"), CreateFirewallRuleRequest{Port: 8080, Proto: "tcp"})
+	if err != nil {
+		t.Fatalf("add rule: %v", err)
+	}
+	if rule.ID != "fw_1" || calls.Load() != 2 {
+		t.Errorf("expected fw_1 after 2 attempts, got %q after %d", rule.ID, calls.Load())
+	}
+}
+
+func TestContextCancelStopsRetries(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}, WithRetries(5, time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ListTunnels(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestCreateTunnelDecodesUnwrappedResponse(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req CreateTunnelRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Labels["env"] != "dev" {
+			t.Errorf("labels not sent: %+v", req)
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id": "tun_2", "vpn_ip": "10.0.0.3", "config": "[Interface]", "server_public_key": "pub",
+		})
+	})
+
+	created, err := c.CreateTunnel(context.Background(), CreateTunnelRequest{Labels: map[string]string{"env": "dev"}})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if created.ID != "tun_2" || created.Config == "" {
+		t.Errorf("unexpected result: %+v", created)
+	}
+}
+
+func TestPutTunnelByName(t *testing.T) {
+	var exists atomic.Bool
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		tunnel := map[string]interface{}{"id": "tun_1", "name": "web", "vpn_ip": "10.0.0.2",
+			"created_at": "2024-01-01T00:00:00Z", "updated_at": "2024-01-01T00:00:00Z"}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v1/tunnels/by-name/web" && !exists.Load():
+			exists.Store(true)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": tunnel, "credentials": map[string]interface{}{"preshared_key": "psk"}})
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v1/tunnels/by-name/web":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": tunnel})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	tunnel, created, err := c.PutTunnelByName(context.Background(), "web", CreateTunnelRequest{PublicKey: "key"})
+	if err != nil {
+		t.Fatalf("PutTunnelByName: %v", err)
+	}
+	if created == nil || created.PresharedKey != "psk" || created.ID != "tun_1" || tunnel.Name != "web" {
+		t.Fatalf("expected the created tunnel with its PSK, got %+v, %+v", tunnel, created)
+	}
+
+	tunnel, created, err = c.PutTunnelByName(context.Background(), "web", CreateTunnelRequest{PublicKey: "key"})
+	if err != nil {
+		t.Fatalf("PutTunnelByName: %v", err)
+	}
+	if created != nil || tunnel.ID != "tun_1" {
+		t.Errorf("expected an update without key material, got %+v, %+v", tunnel, created)
+	}
+}
@@ -0,0 +1,620 @@
+package client
+
+import "time"
+
+// Tunnel is a WireGuard peer as returned by the list endpoint.
+type Tunnel struct {
+	ID                   string            `json:"id"`
+	Name                 string            `json:"name,omitempty"`
+	PublicKey            string            `json:"public_key"`
+	VpnIP                string            `json:"vpn_ip"`
+	Domains              []string          `json:"domains"`
+	Enabled              bool              `json:"enabled"`
+	PendingApproval      bool              `json:"pending_approval"` // created disabled until an admin approves it
+	Imported             bool              `json:"imported"`         // adopted from a peer already in the kernel
+	Endpoint             string            `json:"endpoint,omitempty"`
+	LastHandshake        *time.Time        `json:"last_handshake,omitempty"`
+	TxBytes              int64             `json:"tx_bytes"`
+	RxBytes              int64             `json:"rx_bytes"`
+	Connected            bool              `json:"connected"`
+	ExpiringSoon         bool              `json:"expiring_soon"`
+	RevocationAt         *time.Time        `json:"revocation_at,omitempty"`
+	ExpiresAt            *time.Time        `json:"expires_at,omitempty"` // the tunnel is disabled at this time
+	Expired              bool              `json:"expired"`
+	Labels               map[string]string `json:"labels"`
+	TenantID             string            `json:"tenant_id,omitempty"`
+	SourceCIDR           string            `json:"source_cidr,omitempty"`
+	Isolate              bool              `json:"isolate"`
+	NodeID               string            `json:"node_id,omitempty"`
+	FailoverNodeIDs      []string          `json:"failover_node_ids,omitempty"`
+	PersistentKeepalive  int               `json:"persistent_keepalive"` // seconds, 0 = disabled
+	ConnectedThreshold   int               `json:"connected_threshold"`  // seconds
+	ClientRouting        string            `json:"client_routing"`
+	DNS                  []string          `json:"dns"`
+	MTU                  int               `json:"mtu,omitempty"`
+	AdvertisedRoutes     []string          `json:"advertised_routes,omitempty"`      // LAN prefixes routed to the peer
+	AllowedUpstreamPorts []PortRange       `json:"allowed_upstream_ports,omitempty"` // ports routes may forward to; empty allows any
+	Description          string            `json:"description,omitempty"`
+	OwnerEmail           string            `json:"owner_email,omitempty"`
+	DeviceName           string            `json:"device_name,omitempty"`
+	CreatedAt            time.Time         `json:"created_at"`
+	UpdatedAt            time.Time         `json:"updated_at"`
+	ETag                 string            `json:"etag,omitempty"`
+	DeletedAt            *time.Time        `json:"deleted_at,omitempty"` // set on soft-deleted tunnels
+	PurgeAt              *time.Time        `json:"purge_at,omitempty"`   // when a soft-deleted tunnel stops being restorable
+}
+
+// TunnelDetail is a tunnel as returned by GetTunnel, with its routes.
+type TunnelDetail struct {
+	Tunnel
+	Routes []Route `json:"routes"`
+}
+
+// RestoredTunnel is the result of restoring a soft-deleted tunnel. It has a
+// new PSK, which is not retrievable again; Config is only set for tunnels
+// served by the control plane host and has a placeholder private key.
+type RestoredTunnel struct {
+	Tunnel
+	Routes       []string `json:"routes"` // IDs of the routes restored with it
+	PresharedKey string   `json:"preshared_key"`
+	Config       string   `json:"config,omitempty"`
+}
+
+// CreateTunnelRequest creates a tunnel. Leave PublicKey empty to have the
+// server generate the key pair and return a full client config.
+type CreateTunnelRequest struct {
+	Name         string            `json:"name,omitempty"` // unique per tenant; see PutTunnelByName
+	PublicKey    string            `json:"public_key,omitempty"`
+	Domains      []string          `json:"domains,omitempty"`
+	UpstreamPort int               `json:"upstream_port,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	TenantID     string            `json:"tenant_id,omitempty"`
+	SourceCIDR   string            `json:"source_cidr,omitempty"`
+	Isolate      bool              `json:"isolate,omitempty"`
+	NodeID       string            `json:"node_id,omitempty"` // remote node serving the tunnel; empty for the control plane host
+	// Further nodes serving the tunnel, in failover order. They must share
+	// the WireGuard key of NodeID.
+	FailoverNodeIDs []string `json:"failover_node_ids,omitempty"`
+	// Seconds; nil uses the server's defaults. A zero keepalive disables it.
+	PersistentKeepalive *int `json:"persistent_keepalive,omitempty"`
+	ConnectedThreshold  *int `json:"connected_threshold,omitempty"`
+	// Destinations the client config routes through the tunnel: "split"
+	// (the server only, default), "subnet", or "full".
+	ClientRouting string `json:"client_routing,omitempty"`
+	// DNS entries (resolver IPs and search domains) and MTU of the client
+	// config. Nil DNS uses the server's default; an empty list leaves it out.
+	DNS []string `json:"dns"`
+	MTU int      `json:"mtu,omitempty"`
+	// VPN IP to assign, e.g. to keep a replaced device's address; empty
+	// allocates one.
+	VpnIP string `json:"vpn_ip,omitempty"`
+	// LAN prefixes behind the peer that the proxy routes through the
+	// tunnel, e.g. for an on-prem gateway. They may not overlap the VPN
+	// subnet or another tunnel's.
+	AdvertisedRoutes []string `json:"advertised_routes,omitempty"`
+	// Ports that routes may forward to on the peer and its LAN, also
+	// enforced by the server's firewall. Empty allows any.
+	AllowedUpstreamPorts []PortRange `json:"allowed_upstream_ports,omitempty"`
+	// Notes on who and what the peer is, e.g. before revoking it.
+	Description string `json:"description,omitempty"`
+	OwnerEmail  string `json:"owner_email,omitempty"`
+	DeviceName  string `json:"device_name,omitempty"`
+	// Time at which the server disables the tunnel; must be in the future.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// PortRange is an inclusive range of ports. An End of 0 is the single port
+// Start.
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end,omitempty"`
+}
+
+// UpdateTunnelRequest updates a tunnel. Nil fields are left unchanged; an
+// empty SourceCIDR removes the restriction.
+type UpdateTunnelRequest struct {
+	Labels     *map[string]string `json:"labels,omitempty"`
+	SourceCIDR *string            `json:"source_cidr,omitempty"`
+	Enabled    *bool              `json:"enabled,omitempty"`
+	Isolate    *bool              `json:"isolate,omitempty"`
+
+	PersistentKeepalive *int    `json:"persistent_keepalive,omitempty"` // seconds, 0 = disabled
+	ConnectedThreshold  *int    `json:"connected_threshold,omitempty"`  // seconds
+	ClientRouting       *string `json:"client_routing,omitempty"`
+
+	AdvertisedRoutes *[]string `json:"advertised_routes,omitempty"` // an empty list removes them
+
+	AllowedUpstreamPorts *[]PortRange `json:"allowed_upstream_ports,omitempty"` // an empty list allows any port
+
+	Description *string `json:"description,omitempty"` // an empty string clears a note
+	OwnerEmail  *string `json:"owner_email,omitempty"`
+	DeviceName  *string `json:"device_name,omitempty"`
+
+	ExpiresAt *string `json:"expires_at,omitempty"` // RFC 3339; an empty string removes the expiry date
+}
+
+// EndpointChange is an endpoint a tunnel's peer was first seen connecting from.
+type EndpointChange struct {
+	Endpoint string    `json:"endpoint"`
+	SeenAt   time.Time `json:"seen_at"`
+}
+
+// PeerEvent is a tunnel's peer connecting or disconnecting. Type is
+// "connected" or "disconnected".
+type PeerEvent struct {
+	Type     string    `json:"type"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// CreatedTunnel is the result of creating a tunnel. Config is only set when
+// the server generated the key pair, and is only retrievable again for the
+// server's key escrow window (KEY_ESCROW_MINUTES).
+type CreatedTunnel struct {
+	ID                  string            `json:"id"`
+	Name                string            `json:"name,omitempty"`
+	VpnIP               string            `json:"vpn_ip"`
+	PendingApproval     bool              `json:"pending_approval"` // the tunnel is applied once an admin approves it
+	ServerPublicKey     string            `json:"server_public_key"`
+	ServerEndpoint      string            `json:"server_endpoint,omitempty"`
+	PresharedKey        string            `json:"preshared_key,omitempty"`
+	Config              string            `json:"config,omitempty"`
+	QRCodeURL           string            `json:"qr_code_url,omitempty"`
+	Labels              map[string]string `json:"labels"`
+	TenantID            string            `json:"tenant_id,omitempty"`
+	NodeID              string            `json:"node_id,omitempty"`
+	FailoverNodeIDs     []string          `json:"failover_node_ids,omitempty"`
+	PersistentKeepalive int               `json:"persistent_keepalive"`
+	ConnectedThreshold  int               `json:"connected_threshold"`
+	ClientRouting       string            `json:"client_routing,omitempty"`
+	DNS                 []string          `json:"dns,omitempty"`
+	MTU                 int               `json:"mtu,omitempty"`
+	AdvertisedRoutes    []string          `json:"advertised_routes,omitempty"`
+	Description         string            `json:"description,omitempty"`
+	OwnerEmail          string            `json:"owner_email,omitempty"`
+	DeviceName          string            `json:"device_name,omitempty"`
+	ExpiresAt           *time.Time        `json:"expires_at,omitempty"`
+}
+
+// RotationPolicy describes a tunnel's PSK rotation and inactivity settings.
+type RotationPolicy struct {
+	TunnelID                string     `json:"tunnel_id"`
+	AutoRotatePSK           bool       `json:"auto_rotate_psk"`
+	PSKRotationIntervalDays int        `json:"psk_rotation_interval_days"`
+	AutoRevokeInactive      bool       `json:"auto_revoke_inactive"`
+	InactiveExpiryDays      int        `json:"inactive_expiry_days"`
+	GracePeriodMinutes      int        `json:"grace_period_minutes"`
+	LastRotationAt          *time.Time `json:"last_rotation_at,omitempty"`
+	NextRotationAt          *time.Time `json:"next_rotation_at,omitempty"`
+	ETag                    string     `json:"etag,omitempty"`
+}
+
+// UpdateRotationPolicyRequest updates a rotation policy. Nil fields are left unchanged.
+type UpdateRotationPolicyRequest struct {
+	AutoRotatePSK           *bool `json:"auto_rotate_psk,omitempty"`
+	PSKRotationIntervalDays *int  `json:"psk_rotation_interval_days,omitempty"`
+	AutoRevokeInactive      *bool `json:"auto_revoke_inactive,omitempty"`
+	InactiveExpiryDays      *int  `json:"inactive_expiry_days,omitempty"`
+	GracePeriodMinutes      *int  `json:"grace_period_minutes,omitempty"`
+}
+
+// Route is an L4 route forwarding traffic into a tunnel.
+type Route struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name,omitempty"`
+	TunnelID      string    `json:"tunnel_id"`
+	ListenPort    int       `json:"listen_port"`
+	ListenPortEnd int       `json:"listen_port_end,omitempty"`
+	Protocol      string    `json:"protocol"`
+	MatchType     string    `json:"match_type"`
+	MatchValue    []string  `json:"match_value"`
+	Upstream      string    `json:"upstream"`
+	CaddyID       string    `json:"caddy_id"`
+	Enabled       bool      `json:"enabled"`
+	TenantID      string    `json:"tenant_id,omitempty"`
+	ProxyProtocol string    `json:"proxy_protocol,omitempty"`
+	QUIC          bool      `json:"quic,omitempty"`
+	Priority      int       `json:"priority"`
+	TerminateTLS  bool      `json:"terminate_tls,omitempty"`
+	NodeID        string    `json:"node_id,omitempty"`
+	Imported      bool      `json:"imported"` // adopted from a route already in Caddy
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	ETag          string    `json:"etag,omitempty"`
+
+	// ExpiresAt is when a route created with a TTL is deleted, and
+	// TTLRemainingSeconds the time left; both are nil for permanent routes.
+	ExpiresAt           *time.Time `json:"expires_at,omitempty"`
+	TTLRemainingSeconds *int       `json:"ttl_remaining_seconds,omitempty"`
+
+	// Connections is the latest sample of the route's upstream traffic, nil
+	// if route stats are disabled or the route is served by a remote node.
+	Connections *RouteConnections `json:"connections,omitempty"`
+}
+
+// RouteConnections is a route's open upstream connections and the bytes
+// counted to and from its upstream since the route's nftables counter was
+// created.
+type RouteConnections struct {
+	Active    int       `json:"active"`
+	RxBytes   int64     `json:"rx_bytes"`
+	TxBytes   int64     `json:"tx_bytes"`
+	SampledAt time.Time `json:"sampled_at"`
+}
+
+// RouteDetail is a route as returned by GetRoute, with a summary of its
+// tunnel. Tunnel is nil if the tunnel is missing.
+type RouteDetail struct {
+	Route
+	Tunnel *RouteTunnel `json:"tunnel"`
+}
+
+// RouteTunnel summarizes the tunnel a route forwards to.
+type RouteTunnel struct {
+	ID            string            `json:"id"`
+	VpnIP         string            `json:"vpn_ip"`
+	Enabled       bool              `json:"enabled"`
+	Connected     bool              `json:"connected"`
+	LastHandshake *time.Time        `json:"last_handshake,omitempty"`
+	Labels        map[string]string `json:"labels"`
+	NodeID        string            `json:"node_id,omitempty"`
+}
+
+// CreateRouteRequest creates an SNI or port-forward route.
+type CreateRouteRequest struct {
+	Name          string   `json:"name,omitempty"` // unique per tenant; see PutRouteByName
+	TunnelID      string   `json:"tunnel_id"`
+	MatchType     string   `json:"match_type"`
+	MatchValue    []string `json:"match_value,omitempty"`
+	UpstreamPort  int      `json:"upstream_port"`
+	Protocol      string   `json:"protocol,omitempty"`
+	ListenPort    int      `json:"listen_port,omitempty"`
+	ListenPortEnd int      `json:"listen_port_end,omitempty"` // last port of a range; port_forward only
+	ProxyProtocol string   `json:"proxy_protocol,omitempty"`  // "v1" or "v2"; tcp only
+	QUIC          bool     `json:"quic,omitempty"`            // also forward UDP/443 for HTTP/3; sni only
+	Priority      int      `json:"priority,omitempty"`        // higher matches first; sni only
+	TerminateTLS  bool     `json:"terminate_tls,omitempty"`   // Caddy terminates TLS with an ACME certificate; sni only
+	UpstreamIP    string   `json:"upstream_ip,omitempty"`     // a host in the tunnel's advertised routes; defaults to its VPN IP
+	TTLMinutes    int      `json:"ttl_minutes,omitempty"`     // delete the route this long after creation, at most 10080; 0 keeps it
+}
+
+// UpdateRouteRequest updates a route. Nil fields are left unchanged.
+type UpdateRouteRequest struct {
+	Priority *int `json:"priority,omitempty"`
+}
+
+// FirewallRule is a dynamic nftables rule.
+type FirewallRule struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	Port       int       `json:"port"`
+	Proto      string    `json:"proto"`
+	Chain      string    `json:"chain,omitempty"`
+	Direction  string    `json:"direction,omitempty"`
+	SourceCIDR string    `json:"source_cidr"`
+	DestCIDR   string    `json:"dest_cidr,omitempty"`
+	Action     string    `json:"action"`
+	Enabled    bool      `json:"enabled"`
+	TenantID   string    `json:"tenant_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	ETag       string    `json:"etag,omitempty"`
+
+	// ActiveHours is the daily UTC window the rule applies in, such as
+	// "08:00-18:00"; empty is all day. Active reports whether the rule is
+	// enabled and within it now.
+	ActiveHours string `json:"active_hours,omitempty"`
+	Active      bool   `json:"active"`
+	Description string `json:"description,omitempty"`
+	Group       string `json:"group,omitempty"`
+}
+
+// CreateFirewallRuleRequest opens a port in the dynamic firewall chain.
+// Chain "forward" filters traffic routed through the WireGuard interface;
+// Direction "out" matches traffic towards peers on it, and traffic the VPS
+// sends on chain "output". DestCIDR restricts the rule to one destination
+// network, such as a metadata service peers must not reach.
+type CreateFirewallRuleRequest struct {
+	Name       string `json:"name,omitempty"` // unique per tenant; see PutFirewallRuleByName
+	Port       int    `json:"port"`
+	Proto      string `json:"proto"`
+	Chain      string `json:"chain,omitempty"`
+	Direction  string `json:"direction,omitempty"`
+	SourceCIDR string `json:"source_cidr,omitempty"`
+	DestCIDR   string `json:"dest_cidr,omitempty"`
+	Action     string `json:"action,omitempty"`
+	TenantID   string `json:"tenant_id,omitempty"`
+
+	ActiveHours string `json:"active_hours,omitempty"` // "HH:MM-HH:MM" UTC
+	Description string `json:"description,omitempty"`
+	Group       string `json:"group,omitempty"` // see DeleteFirewallRuleGroup
+}
+
+// UpdateFirewallRuleRequest updates a firewall rule. Nil fields are left
+// unchanged.
+type UpdateFirewallRuleRequest struct {
+	SourceCIDR  *string `json:"source_cidr,omitempty"`
+	Action      *string `json:"action,omitempty"`
+	Enabled     *bool   `json:"enabled,omitempty"`
+	ActiveHours *string `json:"active_hours,omitempty"` // "" applies the rule all day
+	Description *string `json:"description,omitempty"`
+	Group       *string `json:"group,omitempty"` // "" takes the rule out of its group
+}
+
+// BulkFirewallRules is the outcome of BulkCreateFirewallRules.
+type BulkFirewallRules struct {
+	Mode    string           `json:"mode"` // "atomic" or "best_effort"
+	Created int              `json:"created"`
+	Invalid int              `json:"invalid"`
+	Failed  int              `json:"failed"`
+	Results []BulkRuleResult `json:"results"`
+}
+
+// BulkRuleResult is the outcome of one rule of a bulk create.
+type BulkRuleResult struct {
+	Row    int           `json:"row"`    // 1-based position in the request
+	Status string        `json:"status"` // "created", "invalid", or "failed"
+	Error  string        `json:"error,omitempty"`
+	Rule   *FirewallRule `json:"rule,omitempty"`
+}
+
+// SimulateFirewallRequest describes a new connection for SimulateFirewall.
+type SimulateFirewallRequest struct {
+	SourceIP  string `json:"source_ip"`
+	DestIP    string `json:"dest_ip,omitempty"`
+	Port      int    `json:"port"`
+	Proto     string `json:"proto"`
+	Chain     string `json:"chain,omitempty"`
+	Direction string `json:"direction,omitempty"`
+}
+
+// FirewallSimulation is what the firewall would do with a connection.
+// MatchedBy is "rule", "ban", "isolation", "service", "loopback", or
+// "policy"; Rule is the deciding rule, if the caller can see it.
+type FirewallSimulation struct {
+	Allowed   bool          `json:"allowed"`
+	Verdict   string        `json:"verdict"` // "accept" or "drop"
+	MatchedBy string        `json:"matched_by"`
+	Rule      *FirewallRule `json:"rule"`
+	Detail    string        `json:"detail,omitempty"`
+	Policy    string        `json:"policy"`
+}
+
+// DeletedFirewallGroup lists the rules DeleteFirewallRuleGroup deleted.
+type DeletedFirewallGroup struct {
+	Group   string   `json:"group"`
+	Deleted []string `json:"deleted"` // rule IDs
+}
+
+// Ban is a source IP temporarily dropped by the automatic ban subsystem.
+type Ban struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Hits      int       `json:"hits"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Tenant is an isolated owner of tunnels, routes, and firewall rules.
+type Tenant struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	ClientCN   string    `json:"client_cn,omitempty"`
+	HasToken   bool      `json:"has_token"`
+	TokenScope string    `json:"token_scope"`
+	APIToken   string    `json:"api_token,omitempty"` // only set on creation
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// CreateTenantRequest creates a tenant mapped by client CN and/or API token.
+type CreateTenantRequest struct {
+	Name       string `json:"name"`
+	ClientCN   string `json:"client_cn,omitempty"`
+	IssueToken bool   `json:"issue_token,omitempty"`
+	TokenScope string `json:"token_scope,omitempty"`
+}
+
+// ClientCert is an API client certificate issued by the control plane.
+type ClientCert struct {
+	ID                 string     `json:"id"` // the certificate serial, in hex
+	CommonName         string     `json:"common_name"`
+	OrganizationalUnit string     `json:"organizational_unit,omitempty"`
+	IssuedBy           string     `json:"issued_by,omitempty"`
+	NotBefore          time.Time  `json:"not_before"`
+	NotAfter           time.Time  `json:"not_after"`
+	CreatedAt          time.Time  `json:"created_at"`
+	Revoked            bool       `json:"revoked"`
+	RevokedAt          *time.Time `json:"revoked_at,omitempty"`
+	RevocationReason   string     `json:"revocation_reason,omitempty"`
+
+	// Only set on issuance
+	Certificate   string `json:"certificate,omitempty"`
+	PrivateKey    string `json:"private_key,omitempty"` // empty when a CSR was sent
+	CACertificate string `json:"ca_certificate,omitempty"`
+}
+
+// IssueCertRequest issues a client certificate. Without a CSR the server
+// generates the key pair and returns the private key once.
+type IssueCertRequest struct {
+	CommonName         string `json:"common_name"`
+	OrganizationalUnit string `json:"organizational_unit,omitempty"`
+	ValidityDays       int    `json:"validity_days,omitempty"`
+	CSR                string `json:"csr,omitempty"`
+}
+
+// Node is a remote proxy server whose Caddy, WireGuard, and nftables are
+// managed by an agent.
+type Node struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	ClientCN     string     `json:"client_cn"`
+	WGPublicKey  string     `json:"wg_public_key,omitempty"`
+	Endpoint     string     `json:"endpoint,omitempty"`
+	AgentVersion string     `json:"agent_version,omitempty"`
+	Registered   bool       `json:"registered"`
+	Online       bool       `json:"online"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// RouteNodes is the status of a route on each node serving it.
+type RouteNodes struct {
+	RouteID      string      `json:"route_id"`
+	ActiveNodeID string      `json:"active_node_id"` // first serving node in failover order; "" if none
+	Nodes        []RouteNode `json:"nodes"`
+}
+
+// RouteNode is one node serving a route. Status is "serving", "degraded"
+// (its agent reports an error), or "offline".
+type RouteNode struct {
+	NodeID     string     `json:"node_id"`
+	Name       string     `json:"name"`
+	Endpoint   string     `json:"endpoint,omitempty"`
+	Primary    bool       `json:"primary"`
+	Status     string     `json:"status"`
+	Active     bool       `json:"active"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// CreateNodeRequest creates a node whose agent authenticates with a client
+// certificate for ClientCN.
+type CreateNodeRequest struct {
+	Name     string `json:"name"`
+	ClientCN string `json:"client_cn"`
+	Endpoint string `json:"endpoint,omitempty"` // public WireGuard host:port
+}
+
+// RegisterNodeRequest is sent by an agent when it starts.
+type RegisterNodeRequest struct {
+	PublicKey string `json:"public_key"`         // the node's WireGuard public key
+	Endpoint  string `json:"endpoint,omitempty"` // overrides the endpoint set on the node
+	Version   string `json:"version,omitempty"`
+}
+
+// NodeState is everything an agent applies to its node.
+type NodeState struct {
+	Node          Node           `json:"node"`
+	Tunnels       []NodeTunnel   `json:"tunnels"`
+	Routes        []Route        `json:"routes"`
+	FirewallRules []FirewallRule `json:"firewall_rules"`
+}
+
+// NodeTunnel is a tunnel placed on a node. PresharedKey is set until the
+// agent reports it applied.
+type NodeTunnel struct {
+	Tunnel
+	PresharedKey string `json:"preshared_key,omitempty"`
+}
+
+// NodeReport is what an agent observed on its node.
+type NodeReport struct {
+	Error       string       `json:"error,omitempty"` // last reconciliation error, "" when healthy
+	AppliedPSKs []AppliedPSK `json:"applied_psks,omitempty"`
+	Peers       []PeerStats  `json:"peers,omitempty"`
+}
+
+// AppliedPSK acknowledges a delivered preshared key by its hash.
+type AppliedPSK struct {
+	TunnelID string `json:"tunnel_id"`
+	PSKHash  string `json:"psk_hash"`
+}
+
+// ImportResult lists the tunnels and routes adopted by Import, or that would
+// be in a dry run, and the peers, Caddy routes, and servers left alone.
+type ImportResult struct {
+	DryRun  bool         `json:"dry_run"`
+	Tunnels []Tunnel     `json:"tunnels"`
+	Routes  []Route      `json:"routes"`
+	Skipped []ImportSkip `json:"skipped"`
+}
+
+// ImportSkip is something Import did not adopt, and why.
+type ImportSkip struct {
+	Kind   string `json:"kind"` // "peer", "caddy_route", or "caddy_server"
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// PeerStats is the kernel state of one WireGuard peer on a node.
+type PeerStats struct {
+	PublicKey     string     `json:"public_key"`
+	Endpoint      string     `json:"endpoint,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	RxBytes       int64      `json:"rx_bytes"`
+	TxBytes       int64      `json:"tx_bytes"`
+}
+
+// ListTunnelsOptions filters the tunnel list.
+type ListTunnelsOptions struct {
+	// Labels selects tunnels carrying all of the given labels.
+	Labels map[string]string
+	// Deleted lists soft-deleted tunnels that can still be restored instead.
+	Deleted bool
+	// Name selects the tunnel with the given name.
+	Name string
+	// OwnerEmail selects the tunnels of an owner, ignoring case.
+	OwnerEmail string
+	// PendingApproval selects the tunnels awaiting approval.
+	PendingApproval bool
+}
+
+// TunnelStats is a tunnel's traffic history split into fixed-size buckets.
+type TunnelStats struct {
+	TunnelID          string        `json:"tunnel_id"`
+	From              time.Time     `json:"from"`
+	To                time.Time     `json:"to"`
+	ResolutionSeconds int64         `json:"resolution_seconds"`
+	Buckets           []StatsBucket `json:"buckets"`
+}
+
+// StatsBucket is the traffic moved during one bucket, with average throughput in bits per second.
+type StatsBucket struct {
+	Start   time.Time `json:"start"`
+	RxBytes int64     `json:"rx_bytes"`
+	TxBytes int64     `json:"tx_bytes"`
+	RxBps   float64   `json:"rx_bps"`
+	TxBps   float64   `json:"tx_bps"`
+}
+
+// RouteStats is a route's connection and traffic history split into
+// fixed-size buckets.
+type RouteStats struct {
+	RouteID           string             `json:"route_id"`
+	From              time.Time          `json:"from"`
+	To                time.Time          `json:"to"`
+	ResolutionSeconds int64              `json:"resolution_seconds"`
+	Buckets           []RouteStatsBucket `json:"buckets"`
+}
+
+// RouteStatsBucket is the traffic of a route during one bucket, with the
+// most connections it had open at once.
+type RouteStatsBucket struct {
+	StatsBucket
+	MaxActive int `json:"max_active"`
+}
+
+// ServerInfo is the server side of the VPN, for configuring clients.
+type ServerInfo struct {
+	PublicKey  string `json:"public_key"`
+	ListenPort int    `json:"listen_port"`
+	Endpoint   string `json:"endpoint"` // public host:port peers connect to
+	WGSubnet   string `json:"wg_subnet"`
+	ServerIP   string `json:"server_ip"`     // server's address inside WGSubnet
+	MTU        int    `json:"mtu,omitempty"` // 0 when the interface MTU is unknown
+	Version    string `json:"version"`
+
+	Fallback *WGFallback `json:"fallback"`  // nil when no TCP fallback is configured
+	AltPorts []int       `json:"alt_ports"` // extra UDP ports redirected to ListenPort
+}
+
+// WGFallback is the WireGuard over TCP fallback of the server, for clients
+// on networks that block UDP. Tunnel configs for it are rendered with
+// ?transport=tcp.
+type WGFallback struct {
+	Transport string `json:"transport"` // "wstunnel" or "udp2tcp"
+	Endpoint  string `json:"endpoint"`  // public host:port of the relay
+}